@@ -0,0 +1,84 @@
+package irma
+
+import (
+	"sort"
+	"strings"
+)
+
+// This file contains an index of the attribute types of the installed schemes, for requestor
+// tooling that helps building session requests, e.g. to find out which credential types contain
+// a "city" attribute. The index is built on first use and kept until the schemes change.
+
+// IndexedAttribute describes an attribute type of the installed schemes, see
+// Configuration.AttributeIndex.
+type IndexedAttribute struct {
+	ID                 AttributeTypeIdentifier  `json:"id"`
+	Name               TranslatedString         `json:"name"`
+	Description        TranslatedString         `json:"description"`
+	CredentialType     CredentialTypeIdentifier `json:"credentialType"`
+	CredentialTypeName TranslatedString         `json:"credentialTypeName"`
+	Optional           bool                     `json:"optional,omitempty"`
+}
+
+type attributeIndex struct {
+	attributes []*IndexedAttribute                   // sorted by identifier
+	byName     map[string][]CredentialTypeIdentifier // lowercased attribute name to credential types
+}
+
+// AttributeIndex returns all attribute types of the installed schemes, except revocation
+// attributes, sorted by identifier.
+func (conf *Configuration) AttributeIndex() []*IndexedAttribute {
+	index := conf.attributeIndex()
+	return append([]*IndexedAttribute{}, index.attributes...)
+}
+
+// CredentialTypesContaining returns the credential types of the installed schemes that have an
+// attribute with the specified name (e.g. "city"), ignoring case, sorted by identifier.
+func (conf *Configuration) CredentialTypesContaining(attributeName string) []CredentialTypeIdentifier {
+	index := conf.attributeIndex()
+	return append([]CredentialTypeIdentifier{}, index.byName[strings.ToLower(attributeName)]...)
+}
+
+func (conf *Configuration) attributeIndex() *attributeIndex {
+	conf.attributeIndexMutex.Lock()
+	defer conf.attributeIndexMutex.Unlock()
+	if conf.attrIndex != nil {
+		return conf.attrIndex
+	}
+
+	index := &attributeIndex{byName: map[string][]CredentialTypeIdentifier{}}
+	for id, attr := range conf.AttributeTypes {
+		if attr.RevocationAttribute {
+			continue
+		}
+		credid := id.CredentialTypeIdentifier()
+		entry := &IndexedAttribute{
+			ID:             id,
+			Name:           attr.Name,
+			Description:    attr.Description,
+			CredentialType: credid,
+			Optional:       attr.IsOptional(),
+		}
+		if credtype := conf.CredentialTypes[credid]; credtype != nil {
+			entry.CredentialTypeName = credtype.Name
+		}
+		index.attributes = append(index.attributes, entry)
+		name := strings.ToLower(attr.ID)
+		index.byName[name] = append(index.byName[name], credid)
+	}
+	sort.Slice(index.attributes, func(i, j int) bool {
+		return index.attributes[i].ID.String() < index.attributes[j].ID.String()
+	})
+	for _, credtypes := range index.byName {
+		sort.Slice(credtypes, func(i, j int) bool { return credtypes[i].String() < credtypes[j].String() })
+	}
+	conf.attrIndex = index
+	return index
+}
+
+// invalidateAttributeIndex discards the attribute index, after the attribute types changed.
+func (conf *Configuration) invalidateAttributeIndex() {
+	conf.attributeIndexMutex.Lock()
+	defer conf.attributeIndexMutex.Unlock()
+	conf.attrIndex = nil
+}
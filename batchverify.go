@@ -0,0 +1,109 @@
+package irma
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/gabikeys"
+)
+
+// VerificationItem is a disclosure to be verified by Configuration.VerifyProofsBatch, along with
+// the disclosure request in response to which it was made.
+type VerificationItem struct {
+	Disclosure *Disclosure
+	Request    *DisclosureRequest
+}
+
+// VerificationResult is the result of verifying a VerificationItem, as returned by
+// Disclosure.Verify.
+type VerificationResult struct {
+	Attributes [][]*DisclosedAttribute
+	Status     ProofStatus
+	Err        error
+}
+
+// VerifyProofsBatch verifies each of the disclosures as Disclosure.Verify does, returning the
+// results in the order of the items. This is meant for verifiers that verify many disclosures at
+// once: the public keys of the proofs are looked up once for all items, after which the items are
+// verified concurrently by as many workers as GOMAXPROCS.
+//
+// The proofs are not verified using randomized batch verification. The proofs in a gabi.ProofList
+// are Fiat-Shamir proofs that include their challenge instead of their commitments, so verifying
+// them requires recomputing and hashing the commitments of each proof separately, which cannot
+// soundly be combined across proofs.
+func (conf *Configuration) VerifyProofsBatch(items []VerificationItem) []VerificationResult {
+	results := make([]VerificationResult, len(items))
+	keys := make([][]*gabikeys.PublicKey, len(items))
+	cache := map[PublicKeyIdentifier]*gabikeys.PublicKey{}
+	for i, item := range items {
+		if item.Disclosure == nil || item.Request == nil {
+			results[i] = VerificationResult{Status: ProofStatusInvalid, Err: errors.New("missing disclosure or request")}
+			continue
+		}
+		var err error
+		if keys[i], err = conf.batchPublicKeys(item.Disclosure.Proofs, cache); err != nil {
+			results[i] = VerificationResult{Status: ProofStatusInvalid, Err: err}
+		}
+	}
+
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				request, result := items[i].Request, &results[i]
+				result.Attributes, result.Status, result.Err = items[i].Disclosure.VerifyAgainstRequest(
+					conf, request, request.GetContext(), request.GetNonce(nil), keys[i], nil, false,
+				)
+			}
+		}()
+	}
+	for i := range items {
+		if results[i].Status == "" {
+			todo <- i
+		}
+	}
+	close(todo)
+	wg.Wait()
+
+	return results
+}
+
+// batchPublicKeys returns the public keys of the proofs as ProofList.ExtractPublicKeys does,
+// taking them from and adding them to the cache.
+func (conf *Configuration) batchPublicKeys(proofs gabi.ProofList, cache map[PublicKeyIdentifier]*gabikeys.PublicKey,
+) ([]*gabikeys.PublicKey, error) {
+	publicKeys := make([]*gabikeys.PublicKey, 0, len(proofs))
+	for _, proof := range proofs {
+		proofd, ok := proof.(*gabi.ProofD)
+		if !ok {
+			return nil, errors.New("Cannot extract public key, not a disclosure proofD")
+		}
+		if proofd.ADisclosed[1] == nil {
+			return nil, errors.New("Disclosure proof lacks metadata attribute")
+		}
+		metadata := MetadataFromInt(proofd.ADisclosed[1], conf) // index 1 is metadata attribute
+		credtype := metadata.CredentialType()
+		if credtype == nil {
+			return nil, errors.New("Received unknown credential type")
+		}
+		id := PublicKeyIdentifier{Issuer: credtype.IssuerIdentifier(), Counter: metadata.KeyCounter()}
+		publicKey, cached := cache[id]
+		if !cached {
+			var err error
+			if publicKey, err = conf.PublicKey(id.Issuer, id.Counter); err != nil {
+				return nil, err
+			}
+			cache[id] = publicKey
+		}
+		if publicKey == nil {
+			return nil, ErrMissingPublicKey
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return publicKeys, nil
+}
@@ -0,0 +1,221 @@
+package irma
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// BigInt is the wire type of the big integers of the IRMA protocol, such as the nonce and context
+// of session requests. Different generations of IRMA servers encode these differently, so that
+// BigInt accepts JSON numbers, and strings containing base64, or decimal or 0x-prefixed hexadecimal
+// numbers. Strings consisting of decimal digits only are decoded as decimal numbers; the base64
+// encoding of the integers of the protocol, which is the canonical form that is used when
+// marshaling as by gabi, practically never consists of digits only. The size of the integer is
+// bounded by the largest of the limits set with SetBigIntLimits before it is parsed.
+type BigInt big.Int
+
+// BigIntLimits contains the maximum lengths in bytes of the big integers of protocol messages
+// that we accept.
+type BigIntLimits struct {
+	// Nonce and Context bound the nonce and context of session requests.
+	Nonce   int
+	Context int
+	// Proof bounds each of the integers of proofs, issuance commitments and issuance signatures.
+	Proof int
+}
+
+// DefaultBigIntLimits suffice for the integers of the protocol using public keys of up to 4096 bits.
+// The nonce and context limits leave room for the tighter, protocol version dependent bounds
+// that the client imposes on them after unmarshaling.
+var DefaultBigIntLimits = BigIntLimits{
+	Nonce:   64,
+	Context: 64,
+	Proof:   1024,
+}
+
+var bigIntLimits = DefaultBigIntLimits
+
+// SetBigIntLimits sets the maximum lengths of the big integers of protocol messages that are
+// accepted when unmarshaling. Limits that are not positive are set to their default.
+func SetBigIntLimits(limits BigIntLimits) {
+	if limits.Nonce <= 0 {
+		limits.Nonce = DefaultBigIntLimits.Nonce
+	}
+	if limits.Context <= 0 {
+		limits.Context = DefaultBigIntLimits.Context
+	}
+	if limits.Proof <= 0 {
+		limits.Proof = DefaultBigIntLimits.Proof
+	}
+	bigIntLimits = limits
+}
+
+// NewBigInt returns i as a BigInt.
+func NewBigInt(i *big.Int) *BigInt {
+	return (*BigInt)(i)
+}
+
+// Int returns the integer, or nil if b is nil.
+func (b *BigInt) Int() *big.Int {
+	return (*big.Int)(b)
+}
+
+func (b *BigInt) MarshalJSON() ([]byte, error) {
+	return json.Marshal((*big.Int)(b))
+}
+
+func (b *BigInt) UnmarshalJSON(bts []byte) error {
+	limits := bigIntLimits
+	max := limits.Nonce
+	if limits.Context > max {
+		max = limits.Context
+	}
+	if limits.Proof > max {
+		max = limits.Proof
+	}
+	i, err := parseBigInt(bts, max)
+	if err != nil {
+		return err
+	}
+	*b = BigInt(*i)
+	return nil
+}
+
+const (
+	decimalDigits = "0123456789"
+	hexDigits     = "0123456789abcdefABCDEF"
+)
+
+// parseBigInt parses any of the encodings of big integers accepted by BigInt, of at most max bytes.
+func parseBigInt(bts []byte, max int) (*big.Int, error) {
+	bts = bytes.TrimSpace(bts)
+	// None of the encodings takes more than 3 characters per byte, so we can refuse
+	// too large integers before parsing, which for decimal numbers is superlinear.
+	if len(bts) > 3*max+4 {
+		return nil, errors.Errorf("big integer of %d characters exceeds maximum of %d bytes", len(bts), max)
+	}
+	if len(bts) == 0 {
+		return nil, errors.New("empty big integer")
+	}
+
+	var s string
+	base := 10
+	if bts[0] == '"' {
+		if err := json.Unmarshal(bts, &s); err != nil {
+			return nil, err
+		}
+		switch {
+		case s != "" && strings.Trim(s, decimalDigits) == "":
+		case len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X") && strings.Trim(s[2:], hexDigits) == "":
+			s, base = s[2:], 16
+		default:
+			dec, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, errors.Errorf("invalid big integer %.20s", bts)
+			}
+			return checkBigInt(new(big.Int).SetBytes(dec), max)
+		}
+	} else {
+		var n json.Number
+		if err := json.Unmarshal(bts, &n); err != nil {
+			return nil, err
+		}
+		s = n.String()
+	}
+
+	i, ok := new(big.Int).SetString(s, base)
+	if !ok || s == "" || s[0] == '+' || s[0] == '-' {
+		return nil, errors.Errorf("invalid big integer %.20s", bts)
+	}
+	return checkBigInt(i, max)
+}
+
+func checkBigInt(i *big.Int, max int) (*big.Int, error) {
+	if l := (i.BitLen() + 7) / 8; l > max {
+		return nil, errors.Errorf("big integer of %d bytes exceeds maximum of %d bytes", l, max)
+	}
+	return i, nil
+}
+
+// limit returns the integer, checking that it is at most max bytes long.
+func (b *BigInt) limit(name string, max int) (*big.Int, error) {
+	if b == nil {
+		return nil, nil
+	}
+	i, err := checkBigInt(b.Int(), max)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, name, 0)
+	}
+	return i, nil
+}
+
+// setWireInts sets the context and nonce of the request, as unmarshaled separately as BigInts
+// instead of as part of the BaseRequest, checking their lengths.
+func (b *BaseRequest) setWireInts(context, nonce *BigInt) error {
+	var err error
+	if b.Context, err = context.limit("context", bigIntLimits.Context); err != nil {
+		return err
+	}
+	b.Nonce, err = nonce.limit("nonce", bigIntLimits.Nonce)
+	return err
+}
+
+var bigIntType = reflect.TypeOf(big.Int{})
+
+// checkProofInts checks that the big integers contained in the specified proofs, commitments
+// or signatures do not exceed the configured maximum length of proof elements.
+func checkProofInts(v interface{}) error {
+	return walkProofInts(reflect.ValueOf(v), bigIntLimits.Proof, map[uintptr]struct{}{})
+}
+
+func walkProofInts(v reflect.Value, max int, seen map[uintptr]struct{}) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem() == bigIntType {
+			_, err := checkBigInt(v.Interface().(*big.Int), max)
+			return err
+		}
+		if _, ok := seen[v.Pointer()]; ok {
+			return nil
+		}
+		seen[v.Pointer()] = struct{}{}
+		return walkProofInts(v.Elem(), max, seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return walkProofInts(v.Elem(), max, seen)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" { // unexported
+				continue
+			}
+			if err := walkProofInts(v.Field(i), max, seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkProofInts(v.Index(i), max, seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := walkProofInts(iter.Value(), max, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
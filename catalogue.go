@@ -0,0 +1,155 @@
+package irma
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// This file contains the catalogue of credentials that can be obtained, for the "add credential"
+// screens of wallet apps: the schemes, their issuers and the credential types that these issue,
+// grouped like the schemes themselves. Deprecated issuers and credential types are not included.
+
+// CatalogueScheme is a scheme in the catalogue, see Configuration.CatalogueSchemes.
+type CatalogueScheme struct {
+	ID          SchemeManagerIdentifier `json:"id"`
+	Name        TranslatedString        `json:"name"`
+	Description TranslatedString        `json:"description"`
+	Demo        bool                    `json:"demo,omitempty"`
+}
+
+// CatalogueIssuer is an issuer in the catalogue, see Configuration.CatalogueIssuers.
+type CatalogueIssuer struct {
+	ID           IssuerIdentifier `json:"id"`
+	Name         TranslatedString `json:"name"`
+	ContactEMail string           `json:"contactEmail,omitempty"`
+	// Logo is the path of the logo of the issuer on disk, or empty if it has none.
+	Logo string `json:"logo,omitempty"`
+}
+
+// CatalogueCredentialType is a credential type in the catalogue,
+// see Configuration.CatalogueCredentialTypes.
+type CatalogueCredentialType struct {
+	ID          CredentialTypeIdentifier `json:"id"`
+	Name        TranslatedString         `json:"name"`
+	Description TranslatedString         `json:"description"`
+	Category    *TranslatedString        `json:"category,omitempty"`
+	// IssueURL is the web page at which the credential can be obtained, if any.
+	IssueURL *TranslatedString `json:"issueUrl,omitempty"`
+	// Logo is the path of the logo of the credential type on disk, or empty if it has none.
+	Logo      string `json:"logo,omitempty"`
+	Singleton bool   `json:"singleton,omitempty"`
+}
+
+// CatalogueSchemes returns the schemes of the configuration, sorted by identifier.
+func (conf *Configuration) CatalogueSchemes() []*CatalogueScheme {
+	schemes := make([]*CatalogueScheme, 0, len(conf.SchemeManagers))
+	for id, scheme := range conf.SchemeManagers {
+		schemes = append(schemes, &CatalogueScheme{
+			ID:          id,
+			Name:        scheme.Name,
+			Description: scheme.Description,
+			Demo:        scheme.Demo,
+		})
+	}
+	sort.Slice(schemes, func(i, j int) bool { return schemes[i].ID.String() < schemes[j].ID.String() })
+	return schemes
+}
+
+// CatalogueIssuers returns the issuers of the specified scheme that are not deprecated,
+// sorted by identifier.
+func (conf *Configuration) CatalogueIssuers(scheme SchemeManagerIdentifier) []*CatalogueIssuer {
+	var issuers []*CatalogueIssuer
+	for id, issuer := range conf.Issuers {
+		if id.SchemeManagerIdentifier() != scheme || deprecated(issuer.DeprecatedSince) {
+			continue
+		}
+		issuers = append(issuers, conf.catalogueIssuer(issuer))
+	}
+	sort.Slice(issuers, func(i, j int) bool { return issuers[i].ID.String() < issuers[j].ID.String() })
+	return issuers
+}
+
+// CatalogueCredentialTypes returns the credential types of the specified issuer that are not
+// deprecated, sorted by identifier. None are returned if the issuer itself is deprecated.
+func (conf *Configuration) CatalogueCredentialTypes(issuer IssuerIdentifier) []*CatalogueCredentialType {
+	if iss := conf.Issuers[issuer]; iss == nil || deprecated(iss.DeprecatedSince) {
+		return nil
+	}
+	var credtypes []*CatalogueCredentialType
+	for id, credtype := range conf.CredentialTypes {
+		if id.IssuerIdentifier() != issuer || deprecated(credtype.DeprecatedSince) {
+			continue
+		}
+		credtypes = append(credtypes, conf.catalogueCredentialType(credtype))
+	}
+	sort.Slice(credtypes, func(i, j int) bool { return credtypes[i].ID.String() < credtypes[j].ID.String() })
+	return credtypes
+}
+
+// SearchCatalogue returns the credential types of the catalogue whose name, description or
+// category, or the name of whose issuer, contains the query in the specified language,
+// ignoring case. The results are sorted by identifier; an empty query matches all of them.
+func (conf *Configuration) SearchCatalogue(query, lang string) []*CatalogueCredentialType {
+	query = strings.ToLower(strings.TrimSpace(query))
+	var results []*CatalogueCredentialType
+	for _, scheme := range conf.CatalogueSchemes() {
+		for _, issuer := range conf.CatalogueIssuers(scheme.ID) {
+			issuerMatches := strings.Contains(strings.ToLower(issuer.Name.Translation(lang)), query)
+			for _, credtype := range conf.CatalogueCredentialTypes(issuer.ID) {
+				if issuerMatches || credtype.matches(query, lang) {
+					results = append(results, credtype)
+				}
+			}
+		}
+	}
+	return results
+}
+
+func (ct *CatalogueCredentialType) matches(query, lang string) bool {
+	texts := []string{ct.Name.Translation(lang), ct.Description.Translation(lang)}
+	if ct.Category != nil {
+		texts = append(texts, ct.Category.Translation(lang))
+	}
+	for _, text := range texts {
+		if strings.Contains(strings.ToLower(text), query) {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *Configuration) catalogueIssuer(issuer *Issuer) *CatalogueIssuer {
+	entry := &CatalogueIssuer{
+		ID:           issuer.Identifier(),
+		Name:         issuer.Name,
+		ContactEMail: issuer.ContactEMail,
+	}
+	if scheme := conf.SchemeManagers[issuer.SchemeManagerIdentifier()]; scheme != nil {
+		path := filepath.Join(scheme.path(), issuer.ID, "logo.png")
+		if exists, err := common.PathExists(path); err == nil && exists {
+			entry.Logo = path
+		}
+	}
+	return entry
+}
+
+func (conf *Configuration) catalogueCredentialType(credtype *CredentialType) *CatalogueCredentialType {
+	return &CatalogueCredentialType{
+		ID:          credtype.Identifier(),
+		Name:        credtype.Name,
+		Description: credtype.Description,
+		Category:    credtype.Category,
+		IssueURL:    credtype.IssueURL,
+		Logo:        credtype.Logo(conf),
+		Singleton:   credtype.IsSingleton,
+	}
+}
+
+// deprecated returns whether the specified deprecation time has passed.
+func deprecated(since Timestamp) bool {
+	return !since.IsZero() && since.Before(Timestamp(time.Now()))
+}
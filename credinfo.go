@@ -17,6 +17,7 @@ type CredentialInfo struct {
 	Hash                string                                       // SHA256 hash over the attributes
 	Revoked             bool                                         // If the credential has been revoked
 	RevocationSupported bool                                         // If the credential supports creating nonrevocation proofs
+	Nickname            string                                       `json:",omitempty"` // Name given to this instance by the user, if any
 }
 
 // A CredentialInfoList is a list of credentials (implements sort.Interface).
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/go-errors/errors"
@@ -32,6 +33,10 @@ type SchemeManager struct {
 	XMLVersion        int      `xml:"version,attr"`
 	XMLName           xml.Name `xml:"SchemeManager"`
 
+	// Bounds on the length of the PIN of the keyshare server; see KeysharePinLength
+	KeysharePinMinLength int `xml:",omitempty"`
+	KeysharePinMaxLength int `xml:",omitempty"`
+
 	Status    SchemeManagerStatus `xml:"-"`
 	Timestamp Timestamp
 
@@ -109,6 +114,9 @@ type AttributeType struct {
 
 	RevocationAttribute bool `xml:"revocation,attr" json:",omitempty"`
 
+	// Sensitivity classifies the attribute for apps that let the user confirm its disclosure twice
+	Sensitivity AttributeSensitivity `xml:"sensitivity,attr" json:",omitempty"`
+
 	AuthorisedRequestors []RequestorIdentifier `xml:"AuthorisedRequestors>RequestorID" json:",omitempty"`
 
 	// Taken from containing CredentialType
@@ -148,6 +156,10 @@ type RequestorInfo struct {
 	Unverified bool                                   `json:"unverified"`
 	Languages  []string                               `json:"languages"`
 	Wizards    map[IssueWizardIdentifier]*IssueWizard `json:"wizards"`
+
+	// DeveloperMode is set by the IRMA client when it runs in developer mode; the value of this
+	// field in requestor schemes is ignored
+	DeveloperMode bool `json:"developerMode,omitempty"`
 }
 
 // RequestorChunk is a number of verified requestors stored together. The RequestorScheme can consist of multiple such chunks
@@ -373,7 +385,7 @@ func (contents IssueWizardContents) ChoosePath(conf *Configuration, creds map[Cr
 }
 
 func (wizard *IssueWizard) Validate(conf *Configuration) error {
-	conf.validateTranslations(fmt.Sprintf("issue wizard %s", wizard.ID), wizard, wizard.Languages)
+	conf.validateTranslations("", fmt.Sprintf("issue wizard %s", wizard.ID), wizard, wizard.Languages)
 
 	if (wizard.SuccessHeader == nil) != (wizard.SuccessText == nil) {
 		return errors.New("wizard contents must have success header and text either both specified, or both empty")
@@ -422,13 +434,13 @@ func (wizard *IssueWizard) Validate(conf *Configuration) error {
 				if err := item.validate(conf); err != nil {
 					return errors.Errorf("item %d.%d.%d: %w", i, j, k, err)
 				}
-				conf.validateTranslations(fmt.Sprintf("item %d.%d.%d", i, j, k), item, wizard.Languages)
+				conf.validateTranslations("", fmt.Sprintf("item %d.%d.%d", i, j, k), item, wizard.Languages)
 			}
 		}
 	}
-	conf.validateTranslations("issue wizard", wizard, wizard.Languages)
+	conf.validateTranslations("", "issue wizard", wizard, wizard.Languages)
 	for i, qa := range wizard.FAQ {
-		conf.validateTranslations(fmt.Sprintf("QA %d", i), qa, wizard.Languages)
+		conf.validateTranslations("", fmt.Sprintf("QA %d", i), qa, wizard.Languages)
 	}
 
 	return nil
@@ -623,6 +635,64 @@ func (ad AttributeType) IsOptional() bool {
 	return ad.Optional == "true"
 }
 
+// AttributeSensitivity classifies attribute types whose disclosure deserves extra care, such as a
+// second confirmation by the user, see AttributeType.Sensitivity.
+type AttributeSensitivity string
+
+const (
+	// AttributeSensitivityNone is the sensitivity of attributes that are not classified.
+	AttributeSensitivityNone = AttributeSensitivity("")
+	// AttributeSensitivityContact is the sensitivity of contact data, such as email addresses,
+	// phone numbers and postal addresses.
+	AttributeSensitivityContact = AttributeSensitivity("contact")
+	// AttributeSensitivityIdentifier is the sensitivity of identifiers of persons, such as the
+	// BSN or other national identification numbers.
+	AttributeSensitivityIdentifier = AttributeSensitivity("identifier")
+)
+
+// Sensitive returns whether attributes of this sensitivity are sensitive.
+func (s AttributeSensitivity) Sensitive() bool {
+	return s != AttributeSensitivityNone
+}
+
+func (s AttributeSensitivity) valid() bool {
+	switch s {
+	case AttributeSensitivityNone, AttributeSensitivityContact, AttributeSensitivityIdentifier:
+		return true
+	default:
+		return false
+	}
+}
+
+// ageLimitAttributeID matches the IDs of attributes following the over-N convention, in which
+// a credential type contains yes/no attributes such as over18 stating whether its subject is at
+// least N years old.
+var ageLimitAttributeID = regexp.MustCompile("^over([1-9][0-9]?)$")
+
+// AgeLimit returns N if this attribute follows the over-N convention, and 0 otherwise.
+func (ad AttributeType) AgeLimit() int {
+	match := ageLimitAttributeID.FindStringSubmatch(ad.ID)
+	if match == nil || ad.RandomBlind || ad.RevocationAttribute {
+		return 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	return n
+}
+
+// IsAffirmativeAgeValue returns whether the specified value of an over-N attribute states that
+// its subject is at least N years old.
+func IsAffirmativeAgeValue(value *string) bool {
+	if value == nil {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(*value)) {
+	case "yes", "ja", "true":
+		return true
+	default:
+		return false
+	}
+}
+
 // Returns indices of random blind attributes within this credentialtype
 // The indices coincide with indices of an AttributeList (metadataAttribute at index 0)
 func (ct *CredentialType) RandomBlindAttributeIndices() []int {
@@ -650,6 +720,18 @@ func (ct *CredentialType) RandomBlindAttributeNames() []string {
 	return ct.attributeTypeIdentifiers(ct.RandomBlindAttributeIndices())
 }
 
+// AgeLimitAttributes returns the attributes of this credential type following the over-N
+// convention, by N.
+func (ct *CredentialType) AgeLimitAttributes() map[int]AttributeTypeIdentifier {
+	attrs := map[int]AttributeTypeIdentifier{}
+	for _, at := range ct.AttributeTypes {
+		if n := at.AgeLimit(); n != 0 {
+			attrs[n] = at.GetAttributeTypeIdentifier()
+		}
+	}
+	return attrs
+}
+
 func (ct *CredentialType) RevocationSupported() bool {
 	return len(ct.RevocationServers) > 0
 }
@@ -730,6 +812,43 @@ func (ts *TranslatedString) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 	return nil
 }
 
+// preferredLanguage is the language into which TranslatedStrings are rendered if no language is
+// specified, see SetPreferredLanguage.
+var preferredLanguage = "en"
+
+// SetPreferredLanguage sets the language into which TranslatedString.Translation renders the
+// names of schemes, issuers, credential types and attributes, and other translated strings, if no
+// language is specified, e.g. in logs and in results of legacy sessions. Defaults to English.
+func SetPreferredLanguage(lang string) {
+	preferredLanguage = lang
+}
+
+// Translation returns the translation into the specified language, or into the preferred language
+// (see SetPreferredLanguage) if lang is empty. If that translation is missing or empty, the English
+// translation is returned, and otherwise the first nonempty translation in alphabetical order of
+// the languages, so that something is shown if any translation is present.
+func (ts TranslatedString) Translation(lang string) string {
+	if lang == "" {
+		lang = preferredLanguage
+	}
+	for _, l := range []string{lang, "en"} {
+		if text := ts[l]; text != "" {
+			return text
+		}
+	}
+	langs := make([]string, 0, len(ts))
+	for l, text := range ts {
+		if text != "" {
+			langs = append(langs, l)
+		}
+	}
+	if len(langs) == 0 {
+		return ""
+	}
+	sort.Strings(langs)
+	return ts[langs[0]]
+}
+
 // validate checks that all specified languages are present in the TranslatedString, and returns
 // those that are not or are empty.
 func (ts *TranslatedString) validate(langs []string) []string {
@@ -0,0 +1,62 @@
+package irma
+
+import (
+	"io"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Issuers may send attribute values that should not appear in plaintext in the session request
+// (e.g. in the JWT with which it is started) encrypted against a key that the client generates
+// for the session and includes in its ClientHello. The values are encrypted as anonymous NaCl
+// boxes, i.e. libsodium's crypto_box_seal, so that issuers can use any libsodium binding.
+
+// SessionKeyLength is the length of the X25519 keys of ClientHello.EncryptionKey.
+const SessionKeyLength = 32
+
+// GenerateSessionKey generates an X25519 keypair for decrypting the encrypted attribute values
+// of a session.
+func GenerateSessionKey(rand io.Reader) (publicKey, privateKey *[SessionKeyLength]byte, err error) {
+	return box.GenerateKey(rand)
+}
+
+// EncryptAttribute encrypts the value of the specified attribute against the encryption key of
+// the ClientHello of the session, moving it from Attributes to EncryptedAttributes.
+func (cr *CredentialRequest) EncryptAttribute(name string, encryptionKey []byte, rand io.Reader) error {
+	if len(encryptionKey) != SessionKeyLength {
+		return errors.New("invalid session encryption key")
+	}
+	value, ok := cr.Attributes[name]
+	if !ok {
+		return errors.Errorf("attribute %s not present in credential request", name)
+	}
+	var key [SessionKeyLength]byte
+	copy(key[:], encryptionKey)
+	encrypted, err := box.SealAnonymous(nil, []byte(value), &key, rand)
+	if err != nil {
+		return err
+	}
+	if cr.EncryptedAttributes == nil {
+		cr.EncryptedAttributes = map[string][]byte{}
+	}
+	cr.EncryptedAttributes[name] = encrypted
+	delete(cr.Attributes, name)
+	return nil
+}
+
+// DecryptAttributes decrypts the EncryptedAttributes into Attributes using the session keypair.
+func (cr *CredentialRequest) DecryptAttributes(publicKey, privateKey *[SessionKeyLength]byte) error {
+	for name, encrypted := range cr.EncryptedAttributes {
+		value, ok := box.OpenAnonymous(nil, encrypted, publicKey, privateKey)
+		if !ok {
+			return errors.Errorf("failed to decrypt attribute %s", name)
+		}
+		if cr.Attributes == nil {
+			cr.Attributes = map[string]string{}
+		}
+		cr.Attributes[name] = string(value)
+	}
+	cr.EncryptedAttributes = nil
+	return nil
+}
@@ -0,0 +1,323 @@
+package irma
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// ErrorMessages contains for each ErrorType a message that can be shown to users, see
+// SessionError.UserMessage. Apps may add translations or override messages, but should do so
+// before using this package, as this map is not protected against concurrent access.
+// Messages may contain the placeholders {host} and {seconds}, see SessionError.UserMessage.
+var ErrorMessages = map[ErrorType]TranslatedString{
+	ErrorProtocolVersionNotSupported: {
+		"en": "This app is not compatible with the IRMA server at {host}. Please update the app.",
+		"nl": "Deze app is niet compatibel met de IRMA-server van {host}. Werk de app bij.",
+	},
+	ErrorTransport: {
+		"en": "Could not connect to {host}. Please check your internet connection and try again.",
+		"nl": "Kan geen verbinding maken met {host}. Controleer je internetverbinding en probeer het opnieuw.",
+	},
+	ErrorHTTPS: {
+		"en": "The connection to {host} is not secure, so the session was stopped.",
+		"nl": "De verbinding met {host} is niet beveiligd, daarom is de sessie gestopt.",
+	},
+	ErrorInvalidJWT: {
+		"en": "The session request of {host} is invalid.",
+		"nl": "Het sessieverzoek van {host} is ongeldig.",
+	},
+	ErrorUnknownAction: {
+		"en": "This app does not support this kind of session.",
+		"nl": "Deze app ondersteunt dit soort sessies niet.",
+	},
+	ErrorCrypto: {
+		"en": "Something went wrong while computing the response to the session.",
+		"nl": "Er ging iets mis bij het berekenen van het antwoord op de sessie.",
+	},
+	ErrorRevocation: {
+		"en": "Could not check whether your data is still valid. Please try again later.",
+		"nl": "Kan niet controleren of je gegevens nog geldig zijn. Probeer het later opnieuw.",
+	},
+	ErrorMissingWitness: {
+		"en": "Your data cannot be shown to be still valid, which this session requires. Please obtain your data again from its issuer.",
+		"nl": "Van je gegevens kan niet worden aangetoond dat ze nog geldig zijn, wat deze sessie vereist. Haal je gegevens opnieuw op bij de uitgever.",
+	},
+	ErrorPairingRejected: {
+		"en": "The pairing with {host} was rejected.",
+		"nl": "De koppeling met {host} is geweigerd.",
+	},
+	ErrorRejected: {
+		"en": "Your data was not accepted by {host}.",
+		"nl": "Je gegevens zijn niet geaccepteerd door {host}.",
+	},
+	ErrorSerialization: {
+		"en": "A message of the session could not be processed.",
+		"nl": "Een bericht van de sessie kon niet verwerkt worden.",
+	},
+	ErrorKeyshare: {
+		"en": "Something went wrong while communicating with the PIN server. Please try again later.",
+		"nl": "Er ging iets mis in de communicatie met de PIN-server. Probeer het later opnieuw.",
+	},
+	ErrorKeyshareUnenrolled: {
+		"en": "You are not registered at the PIN server that this session needs.",
+		"nl": "Je bent niet geregistreerd bij de PIN-server die nodig is voor deze sessie.",
+	},
+	ErrorKeysharePinBackoff: {
+		"en": "You entered an incorrect PIN too often. Please try again in {seconds} seconds.",
+		"nl": "Je hebt te vaak een onjuiste PIN ingevoerd. Probeer het over {seconds} seconden opnieuw.",
+	},
+	ErrorKeysharePinPolicy: {
+		"en": "This PIN is not allowed. Please choose another PIN.",
+		"nl": "Deze PIN is niet toegestaan. Kies een andere PIN.",
+	},
+	ErrorKeyshareEmailNotVerified: {
+		"en": "Please first verify your email address, using the link in the email that we sent you.",
+		"nl": "Bevestig eerst je e-mailadres, via de link in de e-mail die we je gestuurd hebben.",
+	},
+	ErrorKeyshareVersionUnsupported: {
+		"en": "This app is not compatible with the PIN server. Please update the app.",
+		"nl": "Deze app is niet compatibel met de PIN-server. Werk de app bij.",
+	},
+	ErrorApi: {
+		"en": "An error was reported by {host}.",
+		"nl": "Er is een fout gemeld door {host}.",
+	},
+	ErrorServerResponse: {
+		"en": "An unexpected response was received from {host}.",
+		"nl": "Er is een onverwacht antwoord ontvangen van {host}.",
+	},
+	ErrorUnknownIdentifier: {
+		"en": "The session involves data that this app does not know.",
+		"nl": "De sessie betreft gegevens die deze app niet kent.",
+	},
+	ErrorRequiredAttributeMissing: {
+		"en": "The session request is incomplete.",
+		"nl": "Het sessieverzoek is onvolledig.",
+	},
+	ErrorConfigurationDownload: {
+		"en": "Could not download the information needed for this session. Please try again later.",
+		"nl": "Kan de informatie die nodig is voor deze sessie niet downloaden. Probeer het later opnieuw.",
+	},
+	ErrorUnknownSchemeManager: {
+		"en": "The session involves data from an unknown source.",
+		"nl": "De sessie betreft gegevens van een onbekende bron.",
+	},
+	ErrorInvalidSchemeManager: {
+		"en": "The session involves data from a source that currently has a problem.",
+		"nl": "De sessie betreft gegevens van een bron waarmee momenteel een probleem is.",
+	},
+	ErrorInvalidRequest: {
+		"en": "The session request of {host} is invalid.",
+		"nl": "Het sessieverzoek van {host} is ongeldig.",
+	},
+	ErrorInvalidSessionInfo: {
+		"en": "The session request of {host} is invalid.",
+		"nl": "Het sessieverzoek van {host} is ongeldig.",
+	},
+	ErrorPanic: {
+		"en": "An unexpected error occurred.",
+		"nl": "Er is een onverwachte fout opgetreden.",
+	},
+	ErrorRandomBlind: {
+		"en": "The session request of {host} is invalid.",
+		"nl": "Het sessieverzoek van {host} is ongeldig.",
+	},
+	ErrorLocked: {
+		"en": "The app is locked. Please unlock it and try again.",
+		"nl": "De app is vergrendeld. Ontgrendel de app en probeer het opnieuw.",
+	},
+	ErrorClosed: {
+		"en": "The app is shutting down.",
+		"nl": "De app wordt afgesloten.",
+	},
+	ErrorRequestorBlocked: {
+		"en": "Sessions with {host} are not allowed.",
+		"nl": "Sessies met {host} zijn niet toegestaan.",
+	},
+	ErrorSessionUnknownOrExpired: {
+		"en": "This QR code has expired or has already been used. Ask {host} to show a new one.",
+		"nl": "Deze QR-code is verlopen of al gebruikt. Vraag {host} om een nieuwe te tonen.",
+	},
+	ErrorSessionExpired: {
+		"en": "This session has expired. Please start a new session.",
+		"nl": "Deze sessie is verlopen. Start een nieuwe sessie.",
+	},
+	ErrorOverDisclosure: {
+		"en": "The chosen data would reveal more than {host} asked for, so nothing was shared.",
+		"nl": "De gekozen gegevens zouden meer onthullen dan {host} vroeg, dus er is niets gedeeld.",
+	},
+	ErrorMissingPublicKeyCounter: {
+		"en": "The session request of {host} does not specify the key with which your data is issued.",
+		"nl": "Het sessieverzoek van {host} geeft niet aan met welke sleutel je gegevens worden uitgegeven.",
+	},
+	ErrorValidityRefused: {
+		"en": "The data that {host} wants to issue has a validity that is not accepted.",
+		"nl": "De gegevens die {host} wil uitgeven hebben een geldigheid die niet wordt geaccepteerd.",
+	},
+	ErrorResponseTooLarge: {
+		"en": "{host} sent a response that is too large, so the session was stopped.",
+		"nl": "{host} stuurde een te groot antwoord, daarom is de sessie gestopt.",
+	},
+	ErrorIssuanceFailed: {
+		"en": "{host} could not issue your data, so nothing was added.",
+		"nl": "{host} kon je gegevens niet uitgeven, dus er is niets toegevoegd.",
+	},
+	ErrorRedirect: {
+		"en": "The server sent you on to another address that is not trusted, so the session was stopped.",
+		"nl": "De server stuurde je door naar een ander adres dat niet vertrouwd wordt, daarom is de sessie gestopt.",
+	},
+	ErrorUnexpectedContentType: {
+		"en": "An unexpected response was received from {host}. The server may be misconfigured.",
+		"nl": "Er is een onverwacht antwoord ontvangen van {host}. De server is mogelijk verkeerd ingesteld.",
+	},
+	ErrorIssuanceBindingViolated: {
+		"en": "The data that {host} wants to issue does not match the data you shared, so nothing was added.",
+		"nl": "De gegevens die {host} wil uitgeven komen niet overeen met de gegevens die je deelde, dus er is niets toegevoegd.",
+	},
+	ErrorSensitiveDisclosureUnconfirmed: {
+		"en": "This app cannot ask you to confirm sharing sensitive data, so nothing was shared.",
+		"nl": "Deze app kan je niet vragen het delen van gevoelige gegevens te bevestigen, dus er is niets gedeeld.",
+	},
+}
+
+// RemoteErrorMessages contains messages for common errors reported by IRMA servers and keyshare
+// servers, keyed by RemoteError.ErrorName, which take precedence over those in ErrorMessages.
+// Like ErrorMessages it may be extended by apps.
+var RemoteErrorMessages = map[string]TranslatedString{
+	"SESSION_UNKNOWN": {
+		"en": "This session has expired or does not exist. Please start a new session.",
+		"nl": "Deze sessie is verlopen of bestaat niet. Start een nieuwe sessie.",
+	},
+	"UNEXPECTED_REQUEST": {
+		"en": "This session has already been completed or cancelled.",
+		"nl": "Deze sessie is al afgerond of geannuleerd.",
+	},
+	"PAIRING_REQUIRED": {
+		"en": "Please first enter the pairing code shown by {host}.",
+		"nl": "Voer eerst de koppelcode in die {host} toont.",
+	},
+	"UNAUTHORIZED": {
+		"en": "Unfortunately, {host} is not authorized to perform this session.",
+		"nl": "Helaas is {host} niet bevoegd om deze sessie uit te voeren.",
+	},
+	"TOO_MANY_REQUESTS": {
+		"en": "The server is busy. Please try again later.",
+		"nl": "De server is bezet. Probeer het later opnieuw.",
+	},
+	"PROTOCOL_VERSION": {
+		"en": "This app is not compatible with the IRMA server at {host}. Please update the app.",
+		"nl": "Deze app is niet compatibel met de IRMA-server van {host}. Werk de app bij.",
+	},
+	"INVALID_PROOFS": {
+		"en": "Your data could not be verified by {host}.",
+		"nl": "Je gegevens konden niet geverifieerd worden door {host}.",
+	},
+	"ATTRIBUTES_EXPIRED": {
+		"en": "Some of your data has expired. Please renew it and try again.",
+		"nl": "Een deel van je gegevens is verlopen. Vernieuw ze en probeer het opnieuw.",
+	},
+	"ISSUANCE_BINDING_VIOLATED": {
+		"en": "The data that {host} wants to issue does not match the data you shared, so nothing was added.",
+		"nl": "De gegevens die {host} wil uitgeven komen niet overeen met de gegevens die je deelde, dus er is niets toegevoegd.",
+	},
+	"ATTRIBUTES_MISSING": {
+		"en": "You did not share all requested data.",
+		"nl": "Je hebt niet alle gevraagde gegevens gedeeld.",
+	},
+	"UNKNOWN_PUBLIC_KEY": {
+		"en": "Your data is not accepted by {host}, as it has been issued with an unknown key.",
+		"nl": "Je gegevens worden niet geaccepteerd door {host}, omdat ze met een onbekende sleutel zijn uitgegeven.",
+	},
+	"ISSUANCE_FAILED": {
+		"en": "Your data could not be issued by {host}. Please try again later.",
+		"nl": "Je gegevens konden niet uitgegeven worden door {host}. Probeer het later opnieuw.",
+	},
+	"USER_NOT_REGISTERED": {
+		"en": "Your registration at the PIN server is not yet complete.",
+		"nl": "Je registratie bij de PIN-server is nog niet voltooid.",
+	},
+	"EMAIL_NOT_VERIFIED": {
+		"en": "Please first verify your email address, using the link in the email that we sent you.",
+		"nl": "Bevestig eerst je e-mailadres, via de link in de e-mail die we je gestuurd hebben.",
+	},
+	"INTERNAL_ERROR": {
+		"en": "An internal error occurred at {host}. Please try again later.",
+		"nl": "Er trad een interne fout op bij {host}. Probeer het later opnieuw.",
+	},
+	"EXCEPTION": {
+		"en": "An internal error occurred at {host}. Please try again later.",
+		"nl": "Er trad een interne fout op bij {host}. Probeer het later opnieuw.",
+	},
+}
+
+var (
+	// unknownErrorMessage is used for errors not present in ErrorMessages.
+	unknownErrorMessage = TranslatedString{
+		"en": "An unknown error occurred.",
+		"nl": "Er is een onbekende fout opgetreden.",
+	}
+	// unknownHost replaces {host} if the error does not mention the server.
+	unknownHost = TranslatedString{
+		"en": "the server",
+		"nl": "de server",
+	}
+)
+
+// UserMessage returns a message describing the error that can be shown to users, in the specified
+// language, or in English if the message has not been translated to it (see
+// TranslatedString.Translation). The message is taken from
+// RemoteErrorMessages if the server reported a known error, and otherwise from ErrorMessages.
+// The placeholder {host} is replaced by the host name of the server involved in the error if
+// known, and {seconds} by the amount of seconds that the user has to wait. Other details of
+// the error are not included, as they are not meant for users.
+func (e *SessionError) UserMessage(lang string) string {
+	message, ok := TranslatedString(nil), false
+	if e.RemoteError != nil && e.ErrorType != ErrorSessionUnknownOrExpired {
+		message, ok = RemoteErrorMessages[e.RemoteError.ErrorName]
+	}
+	if !ok {
+		message, ok = ErrorMessages[e.ErrorType]
+	}
+	if !ok {
+		message = unknownErrorMessage
+	}
+
+	host := e.host()
+	if host == "" {
+		host = unknownHost.Translation(lang)
+	}
+	replacer := strings.NewReplacer("{host}", host, "{seconds}", e.seconds())
+	return replacer.Replace(message.Translation(lang))
+}
+
+// host returns the host name of the server involved in the error, if known.
+func (e *SessionError) host() string {
+	if e.ErrorType == ErrorRequestorBlocked || e.ErrorType == ErrorSessionUnknownOrExpired ||
+		e.ErrorType == ErrorOverDisclosure || e.ErrorType == ErrorResponseTooLarge ||
+		e.ErrorType == ErrorIssuanceFailed {
+		return e.Info
+	}
+	var urlErr *url.Error
+	if !errors.As(e.Err, &urlErr) {
+		return ""
+	}
+	u, err := url.Parse(urlErr.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// seconds returns the amount of seconds that the user has to wait, if the error mentions it.
+func (e *SessionError) seconds() string {
+	if e.ErrorType != ErrorKeysharePinBackoff {
+		return ""
+	}
+	if _, err := strconv.Atoi(e.Info); err != nil {
+		return ""
+	}
+	return e.Info
+}
@@ -3,6 +3,7 @@ package irma
 import (
 	"database/sql/driver" // only imported to refer to the driver.Value type
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -68,8 +69,8 @@ type CredentialIdentifier struct {
 
 // AttributeIdentifier identifies an attribute instance.
 type AttributeIdentifier struct {
-	Type           AttributeTypeIdentifier
-	CredentialHash string
+	Type           AttributeTypeIdentifier `json:"type"`
+	CredentialHash string                  `json:"credentialHash"`
 }
 
 // IrmaIdentifierSet contains a set (ensured by using map[...]struct{}) of all scheme managers,
@@ -167,6 +168,64 @@ func NewAttributeTypeIdentifier(id string) AttributeTypeIdentifier {
 	return AttributeTypeIdentifier{metaObjectIdentifier(id)}
 }
 
+// identifierPart matches the parts of scheme, issuer, credential type and attribute type identifiers.
+var identifierPart = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// parseIdentifier checks that the identifier consists of parts separated by dots, each consisting
+// only of letters, digits, dashes and underscores. If partCounts is specified, the amount of parts
+// must equal one of them.
+func parseIdentifier(kind, id string, partCounts ...int) error {
+	parts := strings.Split(id, ".")
+	countOK := len(partCounts) == 0
+	for _, count := range partCounts {
+		countOK = countOK || len(parts) == count
+	}
+	if !countOK {
+		return errors.Errorf("malformed %s identifier %q: wrong number of parts", kind, id)
+	}
+	for _, part := range parts {
+		if !identifierPart.MatchString(part) {
+			return errors.Errorf("malformed %s identifier %q: invalid part %q", kind, id, part)
+		}
+	}
+	return nil
+}
+
+// ParseSchemeManagerIdentifier parses and validates a scheme identifier such as "irma-demo".
+func ParseSchemeManagerIdentifier(id string) (SchemeManagerIdentifier, error) {
+	if err := parseIdentifier("scheme", id, 1); err != nil {
+		return SchemeManagerIdentifier{}, err
+	}
+	return NewSchemeManagerIdentifier(id), nil
+}
+
+// ParseIssuerIdentifier parses and validates an issuer identifier such as "irma-demo.RU".
+func ParseIssuerIdentifier(id string) (IssuerIdentifier, error) {
+	if err := parseIdentifier("issuer", id, 2); err != nil {
+		return IssuerIdentifier{}, err
+	}
+	return NewIssuerIdentifier(id), nil
+}
+
+// ParseCredentialTypeIdentifier parses and validates a credential type identifier such as
+// "irma-demo.RU.studentCard".
+func ParseCredentialTypeIdentifier(id string) (CredentialTypeIdentifier, error) {
+	if err := parseIdentifier("credential type", id, 3); err != nil {
+		return CredentialTypeIdentifier{}, err
+	}
+	return NewCredentialTypeIdentifier(id), nil
+}
+
+// ParseAttributeTypeIdentifier parses and validates an attribute type identifier such as
+// "irma-demo.RU.studentCard.studentID", or a credential type identifier referring to the
+// credential itself (see AttributeTypeIdentifier.IsCredential).
+func ParseAttributeTypeIdentifier(id string) (AttributeTypeIdentifier, error) {
+	if err := parseIdentifier("attribute type", id, 3, 4); err != nil {
+		return AttributeTypeIdentifier{}, err
+	}
+	return NewAttributeTypeIdentifier(id), nil
+}
+
 // RequestorIdentifier returns the requestor identifier of the issue wizard.
 func (id IssueWizardIdentifier) RequestorIdentifier() RequestorIdentifier {
 	return NewRequestorIdentifier(id.Parent())
@@ -191,6 +250,12 @@ func (id CredentialTypeIdentifier) SchemeManagerIdentifier() SchemeManagerIdenti
 	return NewSchemeManagerIdentifier(id.Root())
 }
 
+// AttributeTypeIdentifier returns the identifier of the attribute with the specified name within
+// the credential type.
+func (id CredentialTypeIdentifier) AttributeTypeIdentifier(name string) AttributeTypeIdentifier {
+	return NewAttributeTypeIdentifier(id.String() + "." + name)
+}
+
 // CredentialTypeIdentifier returns the CredentialTypeIdentifier of the attribute identifier.
 func (id AttributeTypeIdentifier) CredentialTypeIdentifier() CredentialTypeIdentifier {
 	if id.IsCredential() {
@@ -199,6 +264,16 @@ func (id AttributeTypeIdentifier) CredentialTypeIdentifier() CredentialTypeIdent
 	return NewCredentialTypeIdentifier(id.Parent())
 }
 
+// IssuerIdentifier returns the IssuerIdentifier of the attribute identifier.
+func (id AttributeTypeIdentifier) IssuerIdentifier() IssuerIdentifier {
+	return id.CredentialTypeIdentifier().IssuerIdentifier()
+}
+
+// SchemeManagerIdentifier returns the SchemeManagerIdentifier of the attribute identifier.
+func (id AttributeTypeIdentifier) SchemeManagerIdentifier() SchemeManagerIdentifier {
+	return NewSchemeManagerIdentifier(id.Root())
+}
+
 // IsCredential returns true if this attribute refers to its containing credential
 // (i.e., it consists of only 3 parts).
 func (id AttributeTypeIdentifier) IsCredential() bool {
@@ -215,8 +290,14 @@ func (id SchemeManagerIdentifier) MarshalText() ([]byte, error) {
 	return []byte(id.String()), nil
 }
 
-// UnmarshalText implements encoding.TextUnmarshaler.
+// UnmarshalText implements encoding.TextUnmarshaler, refusing identifiers containing invalid
+// characters. Use ParseSchemeManagerIdentifier to also check the amount of parts.
 func (id *SchemeManagerIdentifier) UnmarshalText(text []byte) error {
+	if len(text) > 0 {
+		if err := parseIdentifier("scheme", string(text)); err != nil {
+			return err
+		}
+	}
 	*id = NewSchemeManagerIdentifier(string(text))
 	return nil
 }
@@ -259,8 +340,14 @@ func (id IssuerIdentifier) MarshalText() ([]byte, error) {
 	return []byte(id.String()), nil
 }
 
-// UnmarshalText implements encoding.TextUnmarshaler.
+// UnmarshalText implements encoding.TextUnmarshaler, refusing identifiers containing invalid
+// characters. Use ParseIssuerIdentifier to also check the amount of parts.
 func (id *IssuerIdentifier) UnmarshalText(text []byte) error {
+	if len(text) > 0 {
+		if err := parseIdentifier("issuer", string(text)); err != nil {
+			return err
+		}
+	}
 	*id = NewIssuerIdentifier(string(text))
 	return nil
 }
@@ -288,8 +375,14 @@ func (id CredentialTypeIdentifier) MarshalText() ([]byte, error) {
 	return []byte(id.String()), nil
 }
 
-// UnmarshalText implements encoding.TextUnmarshaler.
+// UnmarshalText implements encoding.TextUnmarshaler, refusing identifiers containing invalid
+// characters. Use ParseCredentialTypeIdentifier to also check the amount of parts.
 func (id *CredentialTypeIdentifier) UnmarshalText(text []byte) error {
+	if len(text) > 0 {
+		if err := parseIdentifier("credential type", string(text)); err != nil {
+			return err
+		}
+	}
 	*id = NewCredentialTypeIdentifier(string(text))
 	return nil
 }
@@ -299,8 +392,14 @@ func (id AttributeTypeIdentifier) MarshalText() ([]byte, error) {
 	return []byte(id.String()), nil
 }
 
-// UnmarshalText implements encoding.TextUnmarshaler.
+// UnmarshalText implements encoding.TextUnmarshaler, refusing identifiers containing invalid
+// characters. Use ParseAttributeTypeIdentifier to also check the amount of parts.
 func (id *AttributeTypeIdentifier) UnmarshalText(text []byte) error {
+	if len(text) > 0 {
+		if err := parseIdentifier("attribute type", string(text)); err != nil {
+			return err
+		}
+	}
 	*id = NewAttributeTypeIdentifier(string(text))
 	return nil
 }
@@ -93,6 +93,9 @@ func (th TestHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIde
 func (th TestHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
 	th.Failure(&irma.SessionError{Err: errors.New("KeyshareBlocked")})
 }
+func (th TestHandler) KeysharePinBackoff(manager irma.SchemeManagerIdentifier, duration int) {
+	th.Failure(&irma.SessionError{Err: errors.New("KeysharePinBackoff")})
+}
 func (th TestHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
 	th.Failure(&irma.SessionError{Err: errors.Errorf("Missing keyshare server %s", manager.String())})
 }
@@ -100,6 +103,7 @@ func (th TestHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdenti
 	th.Failure(&irma.SessionError{Err: errors.Errorf("Keyshare enrollment deleted for %s", manager.String())})
 }
 func (th TestHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {}
+func (th TestHandler) Unsatisfiable(request *irmaclient.UnsatisfiableRequest)    {}
 func (th *TestHandler) Success(result string) {
 	th.result = result
 	th.c <- nil
@@ -150,8 +154,11 @@ func (th TestHandler) RequestSignaturePermission(request *irma.SignatureRequest,
 func (th TestHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
 	callback(true)
 }
-func (th TestHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
-	callback(true, "12345")
+func (th TestHandler) RequestPin(metadata irmaclient.PinMetadata, proceed func(pin string), cancel func()) {
+	proceed("12345")
+}
+func (th TestHandler) RequestUnlock(callback func(proceed bool)) {
+	callback(th.client.Unlock() == nil)
 }
 func (th TestHandler) PairingRequired(pairingCode string) {
 	// Send pairing code via channel to calling test. This is done such that
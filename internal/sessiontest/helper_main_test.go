@@ -10,7 +10,6 @@ import (
 
 	"github.com/privacybydesign/gabi/signed"
 	irma "github.com/privacybydesign/irmago"
-	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/irmaclient"
 	"github.com/stretchr/testify/require"
@@ -174,9 +173,10 @@ func setPairingMethod(method irma.PairingMethod, handler *TestHandler) string {
 }
 
 func expectedRequestorInfo(t *testing.T, conf *irma.Configuration) *irma.RequestorInfo {
-	if common.ForceHTTPS {
-		return irma.NewRequestorInfo("localhost")
-	}
+	// The IRMA servers of the tests run in development mode, in which they do not authenticate
+	// requestors, so the client does not consider the requestor verified
 	require.Contains(t, conf.Requestors, "localhost")
-	return conf.Requestors["localhost"]
+	info := irma.NewRequestorInfo("localhost")
+	info.DeveloperMode = true
+	return info
 }
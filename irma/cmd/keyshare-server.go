@@ -66,6 +66,11 @@ func init() {
 	flags.String("storage-primary-keyfile", "", "Primary key used for encrypting and decrypting secure containers")
 	flags.StringSlice("storage-fallback-keyfile", nil, "Fallback key(s) used to decrypt older secure containers")
 
+	headers["pin-min-length"] = "PIN policy, enforced by clients"
+	flags.Int("pin-min-length", keyshareserver.PinMinLengthDefault, "Minimum length of user PINs")
+	flags.Int("pin-max-length", 0, "Maximum length of user PINs (default unlimited)")
+	flags.String("pin-characters", "", "Characters allowed in user PINs (default all)")
+
 	headers["keyshare-attribute"] = "Keyshare server attribute issued during registration"
 	flags.String("keyshare-attribute", "", "Attribute identifier that contains username")
 
@@ -118,6 +123,10 @@ func configureKeyshareServer(cmd *cobra.Command) (*keyshareserver.Configuration,
 		StoragePrimaryKeyFile:   viper.GetString("storage_primary_key_file"),
 		StorageFallbackKeyFiles: viper.GetStringSlice("storage_fallback_key_file"),
 
+		PinMinLength:  viper.GetInt("pin_min_length"),
+		PinMaxLength:  viper.GetInt("pin_max_length"),
+		PinCharacters: viper.GetString("pin_characters"),
+
 		KeyshareAttribute: irma.NewAttributeTypeIdentifier(viper.GetString("keyshare_attribute")),
 
 		RegistrationEmailSubjects: viper.GetStringMapString("registration_email_subjects"),
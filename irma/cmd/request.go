@@ -117,6 +117,7 @@ func constructSessionRequest(cmd *cobra.Command, conf *irma.Configuration) (irma
 	message, _ := cmd.Flags().GetString("message")
 	jsonrequest, _ := cmd.Flags().GetString("request")
 	revocationKey, _ := cmd.Flags().GetString("revocation-key")
+	nonrevocation, _ := cmd.Flags().GetIntSlice("nonrevocation")
 
 	if len(disclose) == 0 && len(issue) == 0 && len(sign) == 0 && message == "" {
 		if jsonrequest == "" {
@@ -181,6 +182,15 @@ func constructSessionRequest(cmd *cobra.Command, conf *irma.Configuration) (irma
 		request.SessionRequest().(*irma.IssuanceRequest).Disclose = disclose
 	}
 
+	for _, disjunction := range nonrevocation {
+		if request == nil {
+			return nil, errors.New("--nonrevocation requires a disclosure, signature or issuance request")
+		}
+		if err := request.SessionRequest().Disclosure().RequestRevocation(conf, disjunction); err != nil {
+			return nil, err
+		}
+	}
+
 	return request, nil
 }
 
@@ -196,7 +206,11 @@ func parseCredentials(
 			return nil, errors.New("--issue argument must contain exactly 1 = sign")
 		}
 		credIdStr, attrsStr := parts[0], parts[1]
-		credtype := conf.CredentialTypes[irma.NewCredentialTypeIdentifier(credIdStr)]
+		credid, err := irma.ParseCredentialTypeIdentifier(credIdStr)
+		if err != nil {
+			return nil, err
+		}
+		credtype := conf.CredentialTypes[credid]
 		if credtype == nil {
 			return nil, errors.New("unknown credential type: " + credIdStr)
 		}
@@ -221,9 +235,13 @@ func parseCredentials(
 			i++
 		}
 		req := &irma.CredentialRequest{
-			CredentialTypeID: irma.NewCredentialTypeIdentifier(credIdStr),
+			CredentialTypeID: credid,
 			Attributes:       attrs,
 		}
+		// Reference the current key of the issuer, if we have it; the server otherwise chooses it
+		if pk, err := conf.LatestKey(credid.IssuerIdentifier()); err == nil {
+			req.SetKeyCounter(pk.Counter)
+		}
 		if credtype.RevocationSupported() {
 			if revocationKey == "" {
 				return nil, errors.Errorf("revocationKey required for %s", credIdStr)
@@ -247,7 +265,10 @@ func parseAttrs(attrsStr []string, conf *irma.Configuration) (irma.AttributeConD
 		disjunction := irma.AttributeDisCon{}
 		attrids := strings.Split(disjunctionStr, ",")
 		for _, attridStr := range attrids {
-			attrid := irma.NewAttributeTypeIdentifier(attridStr)
+			attrid, err := irma.ParseAttributeTypeIdentifier(attridStr)
+			if err != nil {
+				return nil, err
+			}
 			if conf.AttributeTypes[attrid] == nil {
 				return nil, errors.New("unknown attribute: " + attridStr)
 			}
@@ -326,4 +347,5 @@ func addRequestFlags(flags *pflag.FlagSet) {
 	flags.StringArray("sign", nil, "Add an attribute disjunction to signature session")
 	flags.String("message", "", "Message to sign in signature session")
 	flags.String("revocation-key", "", "Revocation key")
+	flags.IntSlice("nonrevocation", nil, "Require nonrevocation proofs in the disjunctions with these indices (comma-separated)")
 }
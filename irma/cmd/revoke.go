@@ -20,10 +20,14 @@ var revokeCmd = &cobra.Command{
 		name, _ := flags.GetString("name")
 		verbosity, _ := cmd.Flags().GetCount("verbose")
 		url := args[2]
+		credid, err := irma.ParseCredentialTypeIdentifier(args[0])
+		if err != nil {
+			die("", err)
+		}
 
 		request := &irma.RevocationRequest{
 			LDContext:      irma.LDContextRevocationRequest,
-			CredentialType: irma.NewCredentialTypeIdentifier(args[0]),
+			CredentialType: credid,
 			Key:            args[1],
 		}
 
@@ -75,7 +75,11 @@ func VerifyScheme(path string, verbose bool) error {
 		return err
 	}
 
-	if _, err = conf.ParseSchemeFolder(path); err != nil {
+	scheme, err := conf.ParseSchemeFolder(path)
+	if manager, ok := scheme.(*irma.SchemeManager); ok {
+		return validateScheme(conf, manager.Identifier())
+	}
+	if err != nil {
 		return err
 	}
 	if err := conf.ValidateKeys(); err != nil {
@@ -88,6 +92,25 @@ func VerifyScheme(path string, verbose bool) error {
 	return nil
 }
 
+// validateScheme prints all problems of the specified issuer scheme, failing if any of them is an error.
+func validateScheme(conf *irma.Configuration, id irma.SchemeManagerIdentifier) error {
+	issues, err := conf.ValidateScheme(id)
+	if err != nil {
+		return err
+	}
+	errs := 0
+	for _, issue := range issues {
+		if issue.Severity == irma.SchemeValidationError {
+			errs++
+		}
+		fmt.Println(issue.String())
+	}
+	if errs > 0 {
+		return errors.Errorf("scheme %s has %d error(s)", id, errs)
+	}
+	return nil
+}
+
 func VerifyIrmaConfiguration(path string, verbose bool) error {
 	log(verbose, "Verifying as configuration directory")
 	conf, err := irma.NewConfiguration(path, irma.ConfigurationOptions{ReadOnly: true})
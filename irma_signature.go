@@ -3,10 +3,12 @@ package irma
 import (
 	"crypto/sha256"
 	"encoding/asn1"
+	"encoding/hex"
 	"log"
 	gobig "math/big"
 
 	"github.com/bwesterb/go-atum"
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 )
@@ -23,6 +25,66 @@ type SignedMessage struct {
 	Context   *big.Int                  `json:"context"`
 	Message   string                    `json:"message"`
 	Timestamp *atum.Timestamp           `json:"timestamp"`
+	// MessageType is the type of Message; omitted for SignatureMessageTypeString.
+	MessageType SignatureMessageType `json:"messageType,omitempty"`
+}
+
+// SignatureMessageType is the type of the message of an attribute-based signature, which
+// determines how the message is hashed into the nonce and timestamp of the signature.
+type SignatureMessageType string
+
+const (
+	// SignatureMessageTypeString is a text message, of which the SHA-256 hash is signed. This is
+	// the type of messages of which the type is not specified.
+	SignatureMessageTypeString = SignatureMessageType("STRING")
+	// SignatureMessageTypeRawHash is a message consisting of the hex-encoded SHA-256 hash of
+	// e.g. a document, which is signed as is.
+	SignatureMessageTypeRawHash = SignatureMessageType("RAWHASH")
+)
+
+// SignatureMessageHash returns the hash of a message of the specified type that is included in
+// the nonce and timestamp of attribute-based signatures over the message.
+func SignatureMessageHash(typ SignatureMessageType, message string) ([]byte, error) {
+	switch typ {
+	case "", SignatureMessageTypeString:
+		hash := sha256.Sum256([]byte(message))
+		return hash[:], nil
+	case SignatureMessageTypeRawHash:
+		hash, err := hex.DecodeString(message)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, errors.Errorf("%s message must be a hex-encoded SHA-256 hash", typ)
+		}
+		return hash, nil
+	default:
+		return nil, errors.Errorf("unsupported signature message type %s", typ)
+	}
+}
+
+// messageHash returns the hash of the message that is signed, or that of the message as
+// STRING if it is not of its type, which Verify rejects.
+func messageHash(typ SignatureMessageType, message string) []byte {
+	hash, err := SignatureMessageHash(typ, message)
+	if err != nil {
+		hash, _ = SignatureMessageHash(SignatureMessageTypeString, message)
+	}
+	return hash
+}
+
+// orDefault returns the type, defaulting to SignatureMessageTypeString.
+func (typ SignatureMessageType) orDefault() SignatureMessageType {
+	if typ == "" {
+		return SignatureMessageTypeString
+	}
+	return typ
+}
+
+// omitDefault returns the type to include in JSON: empty for SignatureMessageTypeString, so that
+// signatures over such messages remain readable by verifiers that do not know message types.
+func (typ SignatureMessageType) omitDefault() SignatureMessageType {
+	if typ == SignatureMessageTypeString {
+		return ""
+	}
+	return typ
 }
 
 func (sm *SignedMessage) Version() int {
@@ -33,14 +95,26 @@ func (sm *SignedMessage) Version() int {
 }
 
 func (sm *SignedMessage) GetNonce() *big.Int {
-	return ASN1ConvertSignatureNonce(sm.Message, sm.Nonce, sm.Timestamp)
+	return asn1ConvertSignatureNonce(messageHash(sm.MessageType, sm.Message), sm.Nonce, sm.Timestamp)
+}
+
+// MessageHash returns the hash of the message that is included in the nonce and timestamp.
+func (sm *SignedMessage) MessageHash() ([]byte, error) {
+	return SignatureMessageHash(sm.MessageType, sm.Message)
 }
 
 func (sm *SignedMessage) MatchesNonceAndContext(request *SignatureRequest) bool {
-	return sm.Context.Cmp(request.GetContext()) == 0 &&
+	return sm.MessageType.orDefault() == request.MessageType.orDefault() &&
+		sm.Context.Cmp(request.GetContext()) == 0 &&
 		sm.GetNonce().Cmp(request.GetNonce(sm.Timestamp)) == 0
 }
 
+// Validate checks that the integers of the signature do not exceed the maximum length of proof
+// elements, see SetBigIntLimits.
+func (sm *SignedMessage) Validate() error {
+	return checkProofInts(sm)
+}
+
 func (sm *SignedMessage) Disclosure() *Disclosure {
 	return &Disclosure{
 		Proofs:  sm.Signature,
@@ -52,14 +126,18 @@ func (sm *SignedMessage) Disclosure() *Disclosure {
 //
 //	nonce = SHA256(serverNonce, SHA256(message), timestampSignature)
 //
-// where serverNonce is the nonce sent by the signature requestor.
+// where serverNonce is the nonce sent by the signature requestor. For messages of type
+// SignatureMessageTypeRawHash, the message is the hash used instead of SHA256(message).
 func ASN1ConvertSignatureNonce(message string, nonce *big.Int, timestamp *atum.Timestamp) *big.Int {
-	msgHash := sha256.Sum256([]byte(message))
+	return asn1ConvertSignatureNonce(messageHash(SignatureMessageTypeString, message), nonce, timestamp)
+}
+
+func asn1ConvertSignatureNonce(msgHash []byte, nonce *big.Int, timestamp *atum.Timestamp) *big.Int {
 	n := nonce.Go()
 	if n == nil {
 		n = gobig.NewInt(0)
 	}
-	tohash := []interface{}{n, new(gobig.Int).SetBytes(msgHash[:])}
+	tohash := []interface{}{n, new(gobig.Int).SetBytes(msgHash)}
 	if timestamp != nil {
 		tohash = append(tohash, timestamp.Sig.Data)
 	}
@@ -1,8 +1,11 @@
 package irmaclient
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"net/http"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -45,7 +48,7 @@ import (
 
 type Client struct {
 	// Stuff we manage on disk
-	secretkey        *secretKey
+	secretkey        *secretKey // guarded by secretKeyMutex, see secretKey
 	attributes       map[irma.CredentialTypeIdentifier][]*irma.AttributeList
 	credentialsCache concmap.ConcMap[credLookup, *credential]
 	keyshareServers  map[irma.SchemeManagerIdentifier]*keyshareServer
@@ -53,6 +56,10 @@ type Client struct {
 
 	lookup map[string]*credLookup
 
+	// Nicknames given by the user to credential instances, by credential hash; guarded by
+	// credMutex, and only replaced after storing the new nicknames (see withNickname)
+	nicknames map[string]string
+
 	// Where we store/load it to/from
 	storage storage
 
@@ -72,7 +79,54 @@ type Client struct {
 	jobsPause  chan struct{} // sending pauses background jobs
 	jobsPaused bool
 
+	closed    chan struct{} // closed by Close
+	closeOnce sync.Once
+
+	nonrevUpdateJob *gocron.Job // scheduled job updating nonrevocation witnesses, see initRevocation
+
+	sharedConfiguration bool // Configuration is owned by the creator of the client, see NewMemoryClient
+
+	policy           SessionPolicy    // see SetSessionPolicy
+	keyCounterPolicy KeyCounterPolicy // see SetKeyCounterPolicy
+	validityPolicy   ValidityPolicy   // see SetValidityPolicy
+	policyMutex      sync.Mutex       // guards policy, keyCounterPolicy, validityPolicy and sensitivity
+
+	// see SetAttributeSensitivity, guarded by policyMutex
+	sensitivity map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity
+
+	pinGracePeriod time.Duration // see SetPinGracePeriod
+	pinMutex       sync.Mutex    // guards pinGracePeriod, and pinVerified, pin and pinTimer of keyshareServer
+
+	transportTimeout      time.Duration     // see SetTransportTimeout
+	transportRoundTripper http.RoundTripper // see SetTransportRoundTripper
+	strictRedirects       bool              // see SetStrictRedirects
+	diagnosticCapture     bool              // see SetDiagnosticCapture
+	transportMutex        sync.Mutex        // guards transportTimeout, transportRoundTripper, strictRedirects and diagnosticCapture
+
+	lastFailure      *failureCapture // see LastFailureBundle
+	lastFailureMutex sync.Mutex
+
+	statistics      *logStatistics // cached statistics of the logs, see Statistics
+	statisticsMutex sync.Mutex
+
+	proofTimingsCache map[int]float64 // proof timings of this device, see EstimateResponse
+	proofTimingsMutex sync.Mutex
+
+	logRetention      LogRetention // see SetLogRetention
+	logRetentionMutex sync.Mutex
+
 	credMutex sync.Mutex
+
+	// Credentials with which no proof could be built by hash, see quarantineCredential; guarded by credMutex
+	quarantined map[string]irma.CredentialIdentifier
+
+	secretKeyStore SecretKeyStore // see SetSecretKeyStore; nil means storage
+	secretKeyHolds int            // see holdSecretKey
+	secretKeyMutex sync.Mutex     // guards secretkey, secretKeyHolds and the tokens of keyshareServers
+
+	clock clock // estimated skew of the device clock, see clock.go
+
+	subscriptions subscriptions
 }
 
 // TODO: consider if we should save irmamobile preferences here, because they would automatically
@@ -120,12 +174,28 @@ type credCandidateSet [][]*credCandidate
 
 type credCandidate irma.CredentialIdentifier
 
+// DisclosureCandidate is an attribute that the user can choose to disclose. UI layers receive
+// the candidates of a session in JSON, in which a candidate has the following shape; the
+// credentialHash is empty for attributes that the user does not have, and nickname is optional:
+//
+//	{
+//	  "type": "irma-demo.RU.studentCard.studentID",
+//	  "credentialHash": "...",
+//	  "value": {"": "s1234567", "en": "s1234567", "nl": "s1234567"},
+//	  "expired": false,
+//	  "revoked": false,
+//	  "notRevokable": false,
+//	  "nickname": "..."
+//	}
 type DisclosureCandidate struct {
 	*irma.AttributeIdentifier
-	Value        irma.TranslatedString
-	Expired      bool
-	Revoked      bool
-	NotRevokable bool
+	Value        irma.TranslatedString `json:"value"`
+	Expired      bool                  `json:"expired"`
+	Revoked      bool                  `json:"revoked"`
+	NotRevokable bool                  `json:"notRevokable"`
+	Nickname     string                `json:"nickname,omitempty"`
+	// Sensitivity of the attribute type, see Client.AttributeSensitivity
+	Sensitivity irma.AttributeSensitivity `json:"sensitivity,omitempty"`
 }
 
 type DisclosureCandidates []*DisclosureCandidate
@@ -159,23 +229,33 @@ func New(
 		return nil, err
 	}
 
-	client := &Client{
-		keyshareServers:       make(map[irma.SchemeManagerIdentifier]*keyshareServer),
-		attributes:            make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList),
-		irmaConfigurationPath: irmaConfigurationPath,
-		handler:               handler,
-		signer:                signer,
-		minVersion:            &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][0]},
-		maxVersion:            &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][len(supportedVersions[2])-1]},
-	}
+	client := newClient(handler, signer)
+	client.irmaConfigurationPath = irmaConfigurationPath
 
 	client.Configuration, err = irma.NewConfiguration(
 		filepath.Join(storagePath, "irma_configuration"),
-		irma.ConfigurationOptions{Assets: irmaConfigurationPath, IgnorePrivateKeys: true},
+		irma.ConfigurationOptions{Assets: irmaConfigurationPath, IgnorePrivateKeys: true, Scheduler: sharedScheduler()},
 	)
 	if err != nil {
 		return nil, err
 	}
+	client.Configuration.ServerDateListeners = append(client.Configuration.ServerDateListeners, client.observeServerDate)
+
+	// Ensure storage path exists, and populate it with necessary files
+	client.storage = storage{storagePath: storagePath, Configuration: client.Configuration, aesKey: aesKey}
+	if err = client.storage.Open(); err != nil {
+		return nil, err
+	}
+	if err = client.storage.recoverEntries(); err != nil {
+		_ = client.storage.Close()
+		return nil, err
+	}
+
+	// Unsigned schemes installed in developer mode can only be parsed in developer mode
+	if client.Preferences, err = client.storage.LoadPreferences(); err != nil {
+		return nil, err
+	}
+	client.Configuration.SetDeveloperMode(client.Preferences.DeveloperMode)
 
 	schemeMgrErr := client.Configuration.ParseOrRestoreFolder()
 	// If schemMgrErr is of type SchemeManagerError, we continue and
@@ -185,30 +265,110 @@ func New(
 		return nil, schemeMgrErr
 	}
 
-	// Ensure storage path exists, and populate it with necessary files
-	client.storage = storage{storagePath: storagePath, Configuration: client.Configuration, aesKey: aesKey}
-	if err = client.storage.Open(); err != nil {
-		return nil, err
-	}
-
 	// Perform new update functions from clientUpdates, if any
 	if err = client.update(); err != nil {
 		return nil, err
 	}
 
 	// Load our stuff
-	if client.Preferences, err = client.storage.LoadPreferences(); err != nil {
+	if err = client.load(); err != nil {
 		return nil, err
 	}
-	client.applyPreferences()
+	if err = client.recoverCredentials(); err != nil {
+		return nil, err
+	}
+	client.garbageCollectIfDue()
+	client.start()
+	client.reportStorageRecovery()
 
-	err = client.loadCredentialStorage()
-	if err != nil {
+	return client, schemeMgrErr
+}
+
+// NewMemoryClient creates a new Client that keeps its credentials, logs and keyshare enrollments
+// in memory only, for tests and short-lived flows that must not touch the disk. Nothing is shared
+// between such clients except the specified configuration, which the client uses as is; note that
+// if schemes are updated (e.g. when a session needs a new public key), they are stored in the
+// configuration's directory.
+// The client starts with the specified credentials, which must share their secret key
+// (i.e., their zeroth attribute), or with a fresh secret key if none are specified.
+func NewMemoryClient(
+	conf *irma.Configuration,
+	handler ClientHandler,
+	signer Signer,
+	credentials ...*gabi.Credential,
+) (*Client, error) {
+	var aesKey [32]byte
+	if _, err := rand.Read(aesKey[:]); err != nil {
+		return nil, err
+	}
+
+	client := newClient(handler, signer)
+	client.Configuration = conf
+	client.sharedConfiguration = true
+	client.storage = storage{Configuration: conf, db: newMemoryDB(), aesKey: aesKey}
+
+	if len(credentials) > 0 {
+		sk := &secretKey{Key: credentials[0].Attributes[0]}
+		err := client.storage.Transaction(func(tx *transaction) error {
+			return client.storage.TxStoreSecretKey(tx, sk)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := client.load(); err != nil {
 		return nil, err
 	}
 
+	for _, gabicred := range credentials {
+		if len(gabicred.Attributes) < 2 || gabicred.Attributes[0].Cmp(client.secretKey().Key) != 0 {
+			return nil, errors.New("credentials must share their secret key")
+		}
+		if irma.MetadataFromInt(gabicred.Attributes[1], conf).CredentialType() == nil {
+			return nil, errors.New("credential of unknown type")
+		}
+		attrs := irma.NewAttributeListFromInts(gabicred.Attributes[1:], conf)
+		cred, err := newCredential(gabicred, attrs, conf)
+		if err != nil {
+			return nil, err
+		}
+		if err = client.addCredential(cred); err != nil {
+			return nil, err
+		}
+	}
+
+	client.start()
+	return client, nil
+}
+
+func newClient(handler ClientHandler, signer Signer) *Client {
+	return &Client{
+		keyshareServers: make(map[irma.SchemeManagerIdentifier]*keyshareServer),
+		attributes:      make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList),
+		handler:         handler,
+		signer:          signer,
+		pinGracePeriod:  defaultPinGracePeriod,
+		minVersion:      supportedVersions[0],
+		maxVersion:      supportedVersions[len(supportedVersions)-1],
+	}
+}
+
+// load loads the preferences, credentials and keyshare enrollments from storage.
+func (client *Client) load() (err error) {
+	if client.Preferences, err = client.storage.LoadPreferences(); err != nil {
+		return
+	}
+	client.applyPreferences()
+	if err = client.loadCredentialStorage(); err != nil {
+		return
+	}
 	client.sessions = sessions{client: client, sessions: map[string]*session{}}
+	client.closed = make(chan struct{})
+	return
+}
 
+// start starts the background jobs of the client.
+func (client *Client) start() {
 	gocron.SetPanicHandler(func(jobName string, recoverData interface{}) {
 		var details string
 		b, err := json.Marshal(recoverData)
@@ -223,16 +383,123 @@ func New(
 	client.jobs = make(chan func(), 100)
 	client.initRevocation()
 	client.StartJobs()
+}
 
-	return client, schemeMgrErr
+var (
+	scheduler     *gocron.Scheduler
+	schedulerOnce sync.Once
+)
+
+// sharedScheduler returns the scheduler that runs the periodic jobs of all clients. Clients share it
+// so that closing a client just removes its jobs, instead of having to stop a scheduler of its own.
+func sharedScheduler() *gocron.Scheduler {
+	schedulerOnce.Do(func() {
+		scheduler = gocron.NewScheduler(time.UTC)
+		scheduler.StartAsync()
+	})
+	return scheduler
 }
 
+// ErrClosed is returned by operations on the client after it has been closed.
+var ErrClosed = errors.New("client is closed")
+
+// Close stops all background activity of the client: running sessions are dismissed, background
+// jobs and scheduled nonrevocation witness updates are stopped, and the storage is closed, releasing
+// its file lock. Afterwards, operations on the client that need the storage fail with ErrClosed,
+// and new sessions fail immediately. Calling Close more than once does nothing.
 func (client *Client) Close() error {
-	return client.storage.Close()
+	var err error
+	client.closeOnce.Do(func() {
+		close(client.closed)
+		for _, session := range client.sessions.list() {
+			session.Dismiss()
+		}
+		client.PauseJobs()
+		if !client.sharedConfiguration {
+			client.Configuration.RemoveJobs()
+		}
+		if client.nonrevUpdateJob != nil {
+			client.Configuration.Scheduler.RemoveByReference(client.nonrevUpdateJob)
+		}
+		err = client.storage.Close()
+	})
+	return err
+}
+
+// Closed returns whether or not Close has been called on the client.
+func (client *Client) Closed() bool {
+	select {
+	case <-client.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrLocked is returned by operations requiring the secret key while the client is locked.
+var ErrLocked = errors.New("client is locked")
+
+// Lock removes the secret key and any cached keyshare tokens from memory, overwriting them
+// on a best-effort basis. Credential metadata and attributes remain available, but operations
+// that require the secret key (i.e., computing proofs) fail with ErrLocked until Unlock is called.
+// Sessions started while locked ask the Handler to unlock the client using RequestUnlock().
+func (client *Client) Lock() {
+	client.secretKeyMutex.Lock()
+	if client.secretkey != nil {
+		wipeBigInt(client.secretkey.Key)
+		client.secretkey = nil
+	}
+	for _, kss := range client.keyshareServers {
+		wipeBytes(kss.token)
+		kss.token = nil
+	}
+	// Cached credentials contain the secret key, so we drop them; they are reloaded on demand
+	client.credentialsCache = concmap.New[credLookup, *credential]()
+	client.secretKeyMutex.Unlock()
+
+	client.ClearPinCache()
+}
+
+// Unlock reloads the secret key from storage, after which the client can compute proofs again.
+func (client *Client) Unlock() error {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	if client.secretKey() != nil {
+		return nil
+	}
+	return client.loadSecretKey()
+}
+
+// Locked returns whether or not the client is locked, i.e. whether Unlock has to be called
+// before the client can participate in sessions. Clients using a transient SecretKeyStore
+// never keep the secret key in memory, and so are never locked.
+func (client *Client) Locked() bool {
+	return client.secretKey() == nil && !client.transientSecretKey()
+}
+
+// wipeBigInt overwrites the limbs of i with zeroes. As the Go runtime may have copied the
+// value elsewhere, this is best-effort only.
+func wipeBigInt(i *big.Int) {
+	if i == nil {
+		return
+	}
+	words := i.Go().Bits()
+	for j := range words {
+		words[j] = 0
+	}
+	i.SetInt64(0)
+}
+
+// wipeBytes overwrites b with zeroes. Like wipeBigInt, this is best-effort only.
+func wipeBytes(b []byte) {
+	for j := range b {
+		b[j] = 0
+	}
 }
 
 func (client *Client) loadCredentialStorage() (err error) {
-	if client.secretkey, err = client.storage.LoadSecretKey(); err != nil {
+	if err = client.loadSecretKey(); err != nil {
 		return
 	}
 	if client.attributes, err = client.storage.LoadAttributes(); err != nil {
@@ -241,6 +508,9 @@ func (client *Client) loadCredentialStorage() (err error) {
 	if client.keyshareServers, err = client.storage.LoadKeyshareServers(); err != nil {
 		return
 	}
+	if client.nicknames, err = client.storage.LoadNicknames(); err != nil {
+		return
+	}
 
 	client.lookup = map[string]*credLookup{}
 	for _, attrlistlist := range client.attributes {
@@ -270,6 +540,10 @@ func (client *Client) reportError(err error) {
 // Pause pending jobs with PauseJobs().
 func (client *Client) StartJobs() {
 	irma.Logger.Debug("starting jobs")
+	if client.Closed() {
+		irma.Logger.Debug("client closed")
+		return
+	}
 	if client.jobsPause != nil {
 		irma.Logger.Debug("already running")
 		return
@@ -304,16 +578,32 @@ func (client *Client) PauseJobs() {
 	close(client.jobsPause)
 }
 
-// CredentialInfoList returns a list of information of all contained credentials.
+// addJob queues a background job, dropping it if the client is closed.
+func (client *Client) addJob(job func()) {
+	select {
+	case client.jobs <- job:
+	case <-client.closed:
+	}
+}
+
+// CredentialInfoList returns a list of information of all contained credentials, ordered by
+// credential type identifier (i.e. scheme, issuer and credential type in lexical order), and
+// the credentials of each type in the order in which they were added.
 func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
 
-	for _, attrlistlist := range client.attributes {
-		for _, attrlist := range attrlistlist {
+	ids := make([]irma.CredentialTypeIdentifier, 0, len(client.attributes))
+	for id := range client.attributes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	for _, id := range ids {
+		for _, attrlist := range client.attributes[id] {
 			info := attrlist.Info()
 			if info == nil {
 				continue
 			}
+			info.Nickname = client.nicknames[info.Hash]
 			list = append(list, info)
 		}
 	}
@@ -321,14 +611,47 @@ func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 	return list
 }
 
+// AgeProofAvailable returns whether the client has a valid, unrevoked credential with an
+// affirmative over-N attribute (see irma.AttributeType.AgeLimit) with which it can prove that
+// its owner is at least n years old.
+func (client *Client) AgeProofAvailable(n int) bool {
+	for id, attrlistlist := range client.attributes {
+		credtype := client.Configuration.CredentialTypes[id]
+		if credtype == nil {
+			continue
+		}
+		attr, ok := credtype.AgeLimitAttributes()[n]
+		if !ok {
+			continue
+		}
+		for _, attrs := range attrlistlist {
+			if !attrs.Revoked && attrs.IsValidOn(client.now()) && irma.IsAffirmativeAgeValue(attrs.UntranslatedAttribute(attr)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // addCredential adds the specified credential to the Client, saving its signature
 // immediately, and optionally cm.attributes as well.
 func (client *Client) addCredential(cred *credential) (err error) {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
 	id := irma.NewCredentialTypeIdentifier("")
 	if cred.CredentialType() != nil {
 		id = cred.CredentialType().Identifier()
 	}
 
+	// The nickname of a credential that we replace below carries over to the new one
+	nickname := client.nicknames[cred.attrs.Hash()]
+	keepNickname := func(attrs *irma.AttributeList) {
+		if n := client.nicknames[attrs.Hash()]; n != "" && nickname == "" {
+			nickname = n
+		}
+	}
+
 	// If we receive a duplicate credential it should overwrite the previous one; remove it first
 	// (it makes no sense to possess duplicate credentials, but the new signature might contain new
 	// functionality such as a nonrevocation witness, so it does not suffice to just return here)
@@ -352,6 +675,7 @@ func (client *Client) addCredential(cred *credential) (err error) {
 	if !id.Empty() {
 		if cred.CredentialType().IsSingleton {
 			for len(client.attrs(id)) != 0 {
+				keepNickname(client.attrs(id)[0])
 				if err = client.remove(id, 0, false); err != nil {
 					return
 				}
@@ -360,6 +684,7 @@ func (client *Client) addCredential(cred *credential) (err error) {
 
 		for i := len(client.attrs(id)) - 1; i >= 0; i-- { // Go backwards through array because remove manipulates it
 			if client.attrs(id)[i].EqualsExceptMetadata(cred.attrs) {
+				keepNickname(client.attrs(id)[i])
 				if err = client.remove(id, i, false); err != nil {
 					return
 				}
@@ -372,16 +697,34 @@ func (client *Client) addCredential(cred *credential) (err error) {
 	if !id.Empty() {
 		counter := len(client.attributes[id]) - 1
 		credlookup := credLookup{id: id, counter: counter}
-		client.credentialsCache.Set(credlookup, cred)
+		// The credential contains the secret key, which transient SecretKeyStores do not let us keep
+		if !client.transientSecretKey() {
+			client.credentialsCache.Set(credlookup, cred)
+		}
 		client.lookup[cred.attrs.Hash()] = &credlookup
 	}
 
-	return client.storage.Transaction(func(tx *transaction) error {
+	nicknames := client.nicknames
+	if nickname != "" {
+		nicknames = client.withNickname(cred.attrs.Hash(), nickname)
+	}
+	err = client.storage.Transaction(func(tx *transaction) error {
 		if err = client.storage.TxStoreSignature(tx, cred); err != nil {
 			return err
 		}
+		if nickname != "" {
+			if err = client.storage.TxStoreNicknames(tx, nicknames); err != nil {
+				return err
+			}
+		}
 		return client.storage.TxStoreAttributes(tx, id, client.attributes[id])
 	})
+	if err != nil {
+		return err
+	}
+	client.nicknames = nicknames
+	client.emit(CredentialAdded{Info: cred.attrs.Info()})
+	return nil
 }
 
 func generateSecretKey() (*secretKey, error) {
@@ -406,25 +749,45 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storeL
 	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
 	removed[id] = attrs.Strings()
 
-	err := client.storage.Transaction(func(tx *transaction) error {
+	var log *LogEntry
+	var pruned []uint64
+	nicknames := client.nicknames
+	_, nicknamed := nicknames[attrs.Hash()]
+	if nicknamed {
+		nicknames = client.withNickname(attrs.Hash(), "")
+	}
+	err := client.storage.Transaction(func(tx *transaction) (err error) {
 		if err := client.storage.TxDeleteSignature(tx, attrs.Hash()); err != nil {
 			return err
 		}
 		if err := client.storage.TxStoreAttributes(tx, id, client.attributes[id]); err != nil {
 			return err
 		}
+		if nicknamed {
+			if err := client.storage.TxStoreNicknames(tx, nicknames); err != nil {
+				return err
+			}
+		}
 		if storeLog {
-			return client.storage.TxAddLogEntry(tx, &LogEntry{
+			log = &LogEntry{
 				Type:    ActionRemoval,
 				Time:    irma.Timestamp(time.Now()),
 				Removed: removed,
-			})
+			}
+			pruned, err = client.txAddLogEntry(tx, log)
+			return err
 		}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
+	client.nicknames = nicknames
+	client.emit(CredentialRemoved{ID: irma.CredentialIdentifier{Type: id, Hash: attrs.Hash()}})
+	if log != nil {
+		client.emit(LogAppended{Entry: log})
+		client.emitPruned(pruned)
+	}
 
 	// Remove credential from cache
 	client.credentialsCache.Delete(credLookup{id: id, counter: index})
@@ -440,6 +803,8 @@ func (client *Client) RemoveCredential(id irma.CredentialTypeIdentifier, index i
 	if client.Configuration.CredentialTypes[id].DisallowDelete {
 		return errors.Errorf("configuration does not allow removal of credential type %s", id.String())
 	}
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
 	return client.remove(id, index, true)
 }
 
@@ -452,6 +817,44 @@ func (client *Client) RemoveCredentialByHash(hash string) error {
 	return client.RemoveCredential(cred.CredentialType().Identifier(), index)
 }
 
+// SetCredentialNickname sets the nickname of the credential with the specified hash, which is
+// included in its CredentialInfo and in disclosure candidates so that the user can tell apart
+// credentials of the same type. The nickname is kept when the credential is reissued. An empty
+// nickname removes it.
+func (client *Client) SetCredentialNickname(hash, nickname string) error {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	if _, ok := client.lookup[hash]; !ok {
+		return errors.Errorf("no credential with hash %s", hash)
+	}
+	nicknames := client.withNickname(hash, nickname)
+	err := client.storage.Transaction(func(tx *transaction) error {
+		return client.storage.TxStoreNicknames(tx, nicknames)
+	})
+	if err != nil {
+		return err
+	}
+	client.nicknames = nicknames
+	return nil
+}
+
+// withNickname returns a copy of the nicknames in which the credential with the specified hash
+// has the specified nickname, or none if it is empty. The copy is to be stored before it
+// replaces client.nicknames, so that the latter does not change if storing fails.
+func (client *Client) withNickname(hash, nickname string) map[string]string {
+	nicknames := make(map[string]string, len(client.nicknames)+1)
+	for h, n := range client.nicknames {
+		nicknames[h] = n
+	}
+	if nickname == "" {
+		delete(nicknames, hash)
+	} else {
+		nicknames[hash] = nickname
+	}
+	return nicknames
+}
+
 // Removes all attributes, signatures, logs and userdata
 // Includes the user's secret key, keyshare servers and preferences/updates
 // A fresh secret key is installed.
@@ -463,28 +866,36 @@ func (client *Client) RemoveStorage() error {
 	client.keyshareServers = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
 	client.credentialsCache = concmap.New[credLookup, *credential]()
 	client.lookup = make(map[string]*credLookup)
+	client.nicknames = make(map[string]string)
 
 	if err = client.storage.DeleteAll(); err != nil {
 		return err
 	}
-	fileStorage := fileStorage{storagePath: client.storage.storagePath, Configuration: client.Configuration}
-	if err = fileStorage.DeleteAll(); err != nil {
-		return err
-	}
-	storageOld := storageOld{storageOldPath: client.storage.storagePath, Configuration: client.Configuration}
-	if err = storageOld.Open(); err != nil {
-		return err
-	}
-	if err = storageOld.DeleteAll(); err != nil {
-		return err
-	}
-	if err = storageOld.Close(); err != nil {
-		return err
+	if client.storage.storagePath != "" { // storage of older versions, if not in memory
+		fileStorage := fileStorage{storagePath: client.storage.storagePath, Configuration: client.Configuration}
+		if err = fileStorage.DeleteAll(); err != nil {
+			return err
+		}
+		storageOld := storageOld{storageOldPath: client.storage.storagePath, Configuration: client.Configuration}
+		if err = storageOld.Open(); err != nil {
+			return err
+		}
+		if err = storageOld.DeleteAll(); err != nil {
+			return err
+		}
+		if err = storageOld.Close(); err != nil {
+			return err
+		}
 	}
 
 	// Client assumes there is always a secret key, so we have to load a new one
-	client.secretkey, err = client.storage.LoadSecretKey()
-	if err != nil {
+	if client.secretKeyStore != nil {
+		if err = client.secretKeyStore.Generate(); err != nil {
+			return err
+		}
+	}
+	client.setSecretKey(nil)
+	if err = client.loadSecretKey(); err != nil {
 		return err
 	}
 
@@ -494,6 +905,7 @@ func (client *Client) RemoveStorage() error {
 	}
 	client.applyPreferences()
 
+	client.emit(CredentialsReplaced{})
 	return nil
 }
 
@@ -572,8 +984,17 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 	if pk == nil {
 		return nil, errors.New("unknown public key")
 	}
+	// While locked, or while a transient SecretKeyStore is not held, the credential is constructed
+	// without secret key, so that its metadata and nonrevocation witness remain usable; it is not
+	// cached so that it is reloaded when the secret key is available.
+	var sk *big.Int
+	secretkey := client.secretKey()
+	locked := secretkey == nil
+	if !locked {
+		sk = secretkey.Key
+	}
 	cred, err = newCredential(&gabi.Credential{
-		Attributes:           append([]*big.Int{client.secretkey.Key}, attrs.Ints...),
+		Attributes:           append([]*big.Int{sk}, attrs.Ints...),
 		Signature:            sig,
 		NonRevocationWitness: witness,
 		Pk:                   pk,
@@ -581,7 +1002,9 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 	if err != nil {
 		return nil, err
 	}
-	client.credentialsCache.Set(credLookup{id, counter}, cred)
+	if !locked {
+		client.credentialsCache.Set(credLookup{id, counter}, cred)
+	}
 	return cred, nil
 }
 
@@ -600,6 +1023,9 @@ func (client *Client) credCandidates(request irma.SessionRequest, con irma.Attri
 		var c []*credCandidate
 		haveUsableCred := false
 		for _, attrlist := range attrlistlist {
+			if _, ok := client.quarantined[attrlist.Hash()]; ok {
+				continue
+			}
 			satisfies, usable := client.satisfiesCon(request.Base(), attrlist, con)
 			if satisfies { // add it to the list, even if they are unusable
 				c = append(c, &credCandidate{Type: credTypeID, Hash: attrlist.Hash()})
@@ -684,7 +1110,7 @@ func (client *Client) satisfiesCon(base *irma.BaseRequest, attrs *irma.Attribute
 			continue
 		}
 		credfound = true
-		if !attr.Satisfy(attr.Type, attrs.UntranslatedAttribute(attr.Type)) {
+		if !attr.SatisfyAge(attr.Type, attrs.UntranslatedAttribute(attr.Type), client.Configuration) {
 			// Using attributes out of more than one instance of a credential type to satisfy
 			// a single con is not allowed, so if any one of the attributes of this instance does
 			// not have the appropriate value, then this entire credential cannot be used
@@ -696,7 +1122,7 @@ func (client *Client) satisfiesCon(base *irma.BaseRequest, attrs *irma.Attribute
 		return false, false
 	}
 	cred, _, _ := client.credentialByHash(attrs.Hash())
-	usable := !attrs.Revoked && attrs.IsValid() && (!base.RequestsRevocation(credtype) || cred.NonRevocationWitness != nil)
+	usable := !attrs.Revoked && attrs.IsValidOn(client.now()) && (!base.RequestsRevocation(credtype) || cred.NonRevocationWitness != nil)
 	return true, usable
 }
 
@@ -725,7 +1151,8 @@ func (set credCandidateSet) expand(client *Client, base *irma.BaseRequest, con i
 						Type:           attr.Type,
 						CredentialHash: credopt.Hash,
 					},
-					Value: irma.NewTranslatedString(attr.Value),
+					Value:       irma.NewTranslatedString(attr.Value),
+					Sensitivity: client.AttributeSensitivity(attr.Type),
 				}
 				if credopt.Present() {
 					attrlist, _ := client.attributesByHash(credopt.Hash)
@@ -733,8 +1160,9 @@ func (set credCandidateSet) expand(client *Client, base *irma.BaseRequest, con i
 					if err != nil {
 						return nil, err
 					}
-					attropt.Expired = !attrlist.IsValid()
+					attropt.Expired = !attrlist.IsValidOn(client.now())
 					attropt.Revoked = attrlist.Revoked
+					attropt.Nickname = client.nicknames[credopt.Hash]
 					attropt.NotRevokable = cred.NonRevocationWitness == nil && base.RequestsRevocation(credopt.Type)
 				}
 				candidateSet = append(candidateSet, attropt)
@@ -806,26 +1234,91 @@ func (client *Client) candidatesDisCon(request irma.SessionRequest, discon irma.
 
 // Candidates returns a list of options for the user to choose from,
 // given a session request and the credentials currently in storage.
+// The order of the result is stable: the disjunctions and their conjunctions are in the order of
+// the request, and the candidates of a conjunction are ordered by the credentials they use, in
+// the order in which these were added to the client, with suggestions of credentials to obtain
+// ordered after the credentials of their type.
 func (client *Client) Candidates(request irma.SessionRequest) (
 	candidates [][]DisclosureCandidates, satisfiable bool, err error,
+) {
+	candidates, unsatisfiable, err := client.candidates(request)
+	return candidates, err == nil && unsatisfiable == nil, err
+}
+
+// RequestCheck describes which of the attributes of the client satisfy the disclosure part of a
+// session request, as computed by CheckRequest.
+type RequestCheck struct {
+	// Request is the request as it is shown to the user in a session, in which identical
+	// disjunctions occur once. Candidates and Unsatisfiable refer to its disjunctions.
+	Request    irma.SessionRequest      `json:"request"`
+	Candidates [][]DisclosureCandidates `json:"candidates"`
+	// Unsatisfiable describes why the request cannot be satisfied, or is nil if it can.
+	Unsatisfiable *UnsatisfiableRequest `json:"unsatisfiable,omitempty"`
+
+	disjunctions []int // per disjunction of the original request, its index in Request
+}
+
+// Satisfiable returns whether the client can satisfy the request.
+func (check *RequestCheck) Satisfiable() bool {
+	return check.Unsatisfiable == nil
+}
+
+// CheckRequest computes which of the attributes of the client satisfy the disclosure part of the
+// specified disclosure, signature or issuance request, just like when the request is received
+// in a session, but without network access or a Handler.
+func (client *Client) CheckRequest(request irma.SessionRequest) (*RequestCheck, error) {
+	switch request.(type) {
+	case *irma.DisclosureRequest, *irma.SignatureRequest, *irma.IssuanceRequest:
+	default:
+		return nil, errors.Errorf("cannot check request of type %T", request)
+	}
+	canonical, disjunctions := canonicalRequest(request)
+	candidates, unsatisfiable, err := client.candidates(canonical)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestCheck{
+		Request:       canonical,
+		Candidates:    candidates,
+		Unsatisfiable: unsatisfiable,
+		disjunctions:  disjunctions,
+	}, nil
+}
+
+// candidates computes the candidates of the request as Candidates does, and in case the request
+// is unsatisfiable, why.
+func (client *Client) candidates(request irma.SessionRequest) (
+	[][]DisclosureCandidates, *UnsatisfiableRequest, error,
 ) {
 	condiscon := request.Disclosure().Disclose
-	candidates = make([][]DisclosureCandidates, len(condiscon))
+	candidates := make([][]DisclosureCandidates, len(condiscon))
+	var unsatisfiable *UnsatisfiableRequest
 
-	satisfiable = true
 	client.credMutex.Lock()
 	defer client.credMutex.Unlock()
 	for i, discon := range condiscon {
 		cands, disconSatisfiable, err := client.candidatesDisCon(request, discon)
 		if err != nil {
-			return nil, false, err
+			return nil, nil, err
 		}
-		if !disconSatisfiable {
-			satisfiable = false
+		var unsatisfied *UnsatisfiedDisCon
+		if disconSatisfiable {
+			// Disclosing attributes of a scheme with a keyshare server requires its registration credential
+			unsatisfied = client.keyshareRegistrationDisCon(i, cands)
+		} else {
+			unsatisfied = client.unsatisfiedDisCon(request.Base(), i, discon)
+		}
+		if !disconSatisfiable || unsatisfied != nil {
+			if unsatisfiable == nil {
+				unsatisfiable = &UnsatisfiableRequest{Disjunctions: len(condiscon), EmptyWallet: client.walletEmpty()}
+			}
+			if unsatisfied != nil {
+				unsatisfiable.Unsatisfied = append(unsatisfiable.Unsatisfied, unsatisfied)
+			}
 		}
 		candidates[i] = cands
 	}
-	return
+	return candidates, unsatisfiable, nil
 }
 
 // attributeGroup points to a credential and some of its attributes which are to be disclosed
@@ -875,16 +1368,37 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 			// These attribute indices will be used in the []*big.Int at gabi.credential.Attributes,
 			// which doesn't know about the secret key and metadata attribute, so +2
 			attributeIndices[i] = append(attributeIndices[i], &irma.DisclosedAttributeIndex{CredentialIndex: credIndex, AttributeIndex: attrIndex + 2, Identifier: ici})
-			todisclose[credIndex].attrs = append(todisclose[credIndex].attrs, attrIndex+2)
+			if !containsInt(todisclose[credIndex].attrs, attrIndex+2) { // disclosed before for another disjunction
+				todisclose[credIndex].attrs = append(todisclose[credIndex].attrs, attrIndex+2)
+			}
 		}
 	}
 
 	return todisclose, attributeIndices, nil
 }
 
+func containsInt(list []int, i int) bool {
+	for _, j := range list {
+		if j == i {
+			return true
+		}
+	}
+	return false
+}
+
 // ProofBuilders constructs a list of proof builders for the specified attribute choice.
 func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.SessionRequest,
 ) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *atum.Timestamp, error) {
+	return client.proofBuilders(choice, request, nil)
+}
+
+func (client *Client) proofBuilders(choice *irma.DisclosureChoice, request irma.SessionRequest, p *progress,
+) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *atum.Timestamp, error) {
+	release, err := client.holdSecretKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer release()
 	todisclose, attributeIndices, err := client.groupCredentials(choice)
 	if err != nil {
 		return nil, nil, nil, err
@@ -894,8 +1408,11 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 	var builder gabi.ProofBuilder
 	for _, grp := range todisclose {
 		cred, err := client.credentialByID(grp.cred)
+		if err == nil && cred == nil {
+			err = errors.New("credential not found")
+		}
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, &credentialBuildError{cred: grp.cred, err: err}
 		}
 		if cred.attrs.Revoked {
 			return nil, nil, nil, revocation.ErrorRevoked
@@ -903,9 +1420,10 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 		nonrev := request.Base().RequestsRevocation(cred.CredentialType().Identifier())
 		builder, err = cred.CreateDisclosureProofBuilder(grp.attrs, nil, nonrev)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, &credentialBuildError{cred: grp.cred, err: err}
 		}
 		builders = append(builders, builder)
+		p.step()
 	}
 
 	var timestamp *atum.Timestamp
@@ -919,7 +1437,11 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 			sigs = append(sigs, s)
 			disclosed = append(disclosed, d)
 		}
-		timestamp, err = irma.GetTimestamp(r.Message, sigs, disclosed, client.Configuration)
+		msgHash, err := r.MessageHash()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		timestamp, err = irma.GetTimestamp(msgHash, sigs, disclosed, client.Configuration)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -929,23 +1451,55 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 }
 
 // Proofs computes disclosure proofs containing the attributes specified by choice.
-func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.SessionRequest) (*irma.Disclosure, *atum.Timestamp, error) {
-	builders, choices, timestamp, err := client.ProofBuilders(choice, request)
+func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.SessionRequest) (*irma.DisclosureResponse, *atum.Timestamp, error) {
+	return client.proofs(choice, request, nil)
+}
+
+func (client *Client) proofs(choice *irma.DisclosureChoice, request irma.SessionRequest, p *progress,
+) (*irma.DisclosureResponse, *atum.Timestamp, error) {
+	var builders gabi.ProofBuilderList
+	var choices irma.DisclosedAttributeIndices
+	var timestamp *atum.Timestamp
+	err := withRandomness(client, func() (err error) {
+		builders, choices, timestamp, err = client.proofBuilders(choice, request, p)
+		return
+	})
 	if err != nil {
 		return nil, nil, err
 	}
 
 	_, issig := request.(*irma.SignatureRequest)
-	proofs, err := builders.BuildProofList(request.Base().GetContext(), request.GetNonce(timestamp), issig)
+	context, nonce := request.Base().GetContext(), request.GetNonce(timestamp)
+	var proofs gabi.ProofList
+	err = withRandomness(client, func() (err error) {
+		proofs, err = buildProofList(builders, context, nonce, issig, p)
+		return
+	})
 	if err != nil {
 		return nil, nil, err
 	}
-	return &irma.Disclosure{
-		Proofs:  proofs,
-		Indices: choices,
+	return &irma.DisclosureResponse{
+		Disclosure: irma.Disclosure{Proofs: proofs, Indices: choices},
+		Context:    context,
+		Nonce:      nonce,
 	}, timestamp, nil
 }
 
+// buildProofList does the same as gabi.ProofBuilderList.BuildProofList, stepping the progress
+// after each proof.
+func buildProofList(builders gabi.ProofBuilderList, context, nonce *big.Int, issig bool, p *progress) (gabi.ProofList, error) {
+	challenge, err := builders.Challenge(context, nonce, issig)
+	if err != nil {
+		return nil, err
+	}
+	proofs := make(gabi.ProofList, len(builders))
+	for i, builder := range builders {
+		proofs[i] = builder.CreateProof(challenge)
+		p.step()
+	}
+	return proofs, nil
+}
+
 // generateIssuerProofNonce generates a nonce which the issuer must use in its gabi.ProofS.
 func generateIssuerProofNonce() (*big.Int, error) {
 	return gabi.GenerateNonce()
@@ -956,6 +1510,16 @@ func generateIssuerProofNonce() (*big.Int, error) {
 // a nonce against which the issuer's proof of knowledge must verify.
 func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest, choice *irma.DisclosureChoice,
 ) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *big.Int, error) {
+	return client.issuanceProofBuilders(request, choice, nil)
+}
+
+func (client *Client) issuanceProofBuilders(request *irma.IssuanceRequest, choice *irma.DisclosureChoice, p *progress,
+) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *big.Int, error) {
+	release, err := client.holdSecretKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer release()
 	issuerProofNonce, err := generateIssuerProofNonce()
 	if err != nil {
 		return nil, nil, nil, err
@@ -969,14 +1533,15 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest, choic
 		}
 		credtype := client.Configuration.CredentialTypes[futurecred.CredentialTypeID]
 		credBuilder, err := gabi.NewCredentialBuilder(pk, request.GetContext(),
-			client.secretkey.Key, issuerProofNonce, credtype.RandomBlindAttributeIndices())
+			client.secretKey().Key, issuerProofNonce, credtype.RandomBlindAttributeIndices())
 		if err != nil {
 			return nil, nil, nil, err
 		}
 		builders = append(builders, credBuilder)
+		p.step()
 	}
 
-	disclosures, choices, _, err := client.ProofBuilders(choice, request)
+	disclosures, choices, _, err := client.proofBuilders(choice, request, p)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -988,11 +1553,23 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest, choic
 // and also returns the credential builders which will become the new credentials upon combination with the issuer's signature.
 func (client *Client) IssueCommitments(request *irma.IssuanceRequest, choice *irma.DisclosureChoice,
 ) (*irma.IssueCommitmentMessage, gabi.ProofBuilderList, error) {
-	builders, choices, issuerProofNonce, err := client.IssuanceProofBuilders(request, choice)
-	if err != nil {
-		return nil, nil, err
-	}
-	proofs, err := builders.BuildProofList(request.GetContext(), request.GetNonce(nil), false)
+	return client.issueCommitments(request, choice, nil)
+}
+
+func (client *Client) issueCommitments(request *irma.IssuanceRequest, choice *irma.DisclosureChoice, p *progress,
+) (*irma.IssueCommitmentMessage, gabi.ProofBuilderList, error) {
+	var builders gabi.ProofBuilderList
+	var choices irma.DisclosedAttributeIndices
+	var issuerProofNonce *big.Int
+	var proofs gabi.ProofList
+	err := withRandomness(client, func() (err error) {
+		builders, choices, issuerProofNonce, err = client.issuanceProofBuilders(request, choice, p)
+		if err != nil {
+			return err
+		}
+		proofs, err = buildProofList(builders, request.GetContext(), request.GetNonce(nil), false, p)
+		return err
+	})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1005,16 +1582,97 @@ func (client *Client) IssueCommitments(request *irma.IssuanceRequest, choice *ir
 	}, builders, nil
 }
 
+// credentialChanges computes which of our credentials the credentials of the issuance request
+// will replace, mirroring the rules of addCredential.
+func (client *Client) credentialChanges(request *irma.IssuanceRequest, version *irma.ProtocolVersion, issuedAt time.Time,
+) ([]*irma.CredentialChange, error) {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	changes := []*irma.CredentialChange{}
+	for i, credreq := range request.Credentials {
+		attrs, err := credreq.AttributeList(client.Configuration, irma.GetMetadataVersion(version), nil, issuedAt)
+		if err != nil {
+			return nil, err
+		}
+		validity, err := credreq.ValidityAt(issuedAt)
+		if err != nil {
+			return nil, err
+		}
+		keyStatus, keyExpires, err := client.keyStatus(credreq, issuedAt)
+		if err != nil {
+			return nil, err
+		}
+		var bindings []*irma.AttributeBinding
+		for _, binding := range request.Bindings {
+			if binding.Attribute.CredentialTypeIdentifier() == credreq.CredentialTypeID {
+				bindings = append(bindings, binding)
+			}
+		}
+		singleton := attrs.CredentialType().IsSingleton
+		added := true
+		for _, existing := range client.attrs(credreq.CredentialTypeID) {
+			if singleton || existing.EqualsExceptMetadata(attrs) {
+				changes = append(changes, &irma.CredentialChange{Credential: i, Existing: existing.Info(), New: attrs.Info(), Validity: validity,
+					KeyStatus: keyStatus, KeyExpires: keyExpires, Bindings: bindings})
+				added = false
+			}
+		}
+		if added {
+			changes = append(changes, &irma.CredentialChange{Credential: i, New: attrs.Info(), Validity: validity,
+				KeyStatus: keyStatus, KeyExpires: keyExpires, Bindings: bindings})
+		}
+	}
+	return changes, nil
+}
+
+// keyStatus returns the status and expiry date of the public key with which the credential is to be
+// issued, logging a warning if it is deprecated.
+func (client *Client) keyStatus(credreq *irma.CredentialRequest, issuedAt time.Time) (irma.KeyStatus, *irma.Timestamp, error) {
+	id := irma.PublicKeyIdentifier{Issuer: credreq.CredentialTypeID.IssuerIdentifier(), Counter: credreq.KeyCounter}
+	status, err := client.Configuration.KeyStatus(id, issuedAt)
+	if err != nil {
+		return "", nil, err
+	}
+	pk, err := client.Configuration.PublicKey(id.Issuer, id.Counter)
+	if err != nil {
+		return "", nil, err
+	}
+	expires := irma.Timestamp(time.Unix(pk.ExpiryDate, 0))
+	if status == irma.KeyStatusDeprecated {
+		irma.Logger.Warnf("%s is to be issued with deprecated public key %s-%d, which expires at %s",
+			credreq.CredentialTypeID, id.Issuer, id.Counter, expires.String())
+	}
+	return status, &expires, nil
+}
+
 // ConstructCredentials constructs and saves new credentials using the specified issuance signature messages
 // and credential builders.
 func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList) error {
+	return client.constructCredentials(msg, request, builders, nil, nil, nil)
+}
+
+// constructCredentials constructs new credentials as ConstructCredentials does, but saves only
+// those not declined by the user in the choice and not failed by the issuer; the declined
+// credentials of the choice and the keys of failed contain indices within the credentials of the
+// request, whose signatures in msg are then ignored respectively absent. If the request contains
+// bindings, the new credentials are checked against the attributes disclosed in the choice. The
+// progress is stepped after each credential.
+func (client *Client) constructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest,
+	builders gabi.ProofBuilderList, choice *irma.DisclosureChoice, failed map[int]*irma.RemoteError, p *progress,
+) error {
 	if len(msg) > len(builders) {
 		return errors.New("Received unexpected amount of signatures")
 	}
+	var declined []int
+	if choice != nil {
+		declined = choice.DeclinedCredentials
+	}
 
 	// First collect all credentials in a slice, so that if one of them induces an error,
 	// we save none of them to fail the session cleanly
 	gabicreds := []*gabi.Credential{}
+	indices := []int{}
 	offset := 0
 	for i, builder := range builders {
 		credbuilder, ok := builder.(*gabi.CredentialBuilder)
@@ -1023,6 +1681,13 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 			continue
 		}
 		sig := msg[i-offset]
+		if _, ok := failed[i-offset]; ok {
+			p.step()
+			continue
+		}
+		if sig == nil {
+			return errors.New("Received no signature for credential")
+		}
 
 		var nonrevAttr *big.Int
 		if sig.NonRevocationWitness != nil {
@@ -1030,6 +1695,10 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 		}
 		issuedAt := time.Now()
 		req := request.Credentials[i-offset]
+		// The key may have expired since the session started
+		if err := checkKey(client.Configuration, req.CredentialTypeID.IssuerIdentifier(), req.KeyCounter, client.now()); err != nil {
+			return err
+		}
 		if !req.RevocationSupported && (nonrevAttr != nil) {
 			return errors.New("credential signature unexpectedly containend nonrevocation witness")
 		}
@@ -1050,9 +1719,17 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 			return err
 		}
 		gabicreds = append(gabicreds, cred)
+		indices = append(indices, i-offset)
+		p.step()
 	}
 
-	for _, gabicred := range gabicreds {
+	if err := client.checkBindings(request, choice, declined, failed); err != nil {
+		return err
+	}
+	for i, gabicred := range gabicreds {
+		if containsIndex(declined, indices[i]) {
+			continue
+		}
 		attrs := irma.NewAttributeListFromInts(gabicred.Attributes[1:], client.Configuration)
 		newcred, err := newCredential(gabicred, attrs, client.Configuration)
 		if err != nil {
@@ -1066,6 +1743,39 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 	return nil
 }
 
+// checkBindings checks that the credentials to be stored satisfy the bindings of the request to
+// the attributes disclosed in the choice. The credentials were constructed from the attribute
+// values of the request, so we check those.
+func (client *Client) checkBindings(request *irma.IssuanceRequest, choice *irma.DisclosureChoice,
+	declined []int, failed map[int]*irma.RemoteError,
+) error {
+	if len(request.Bindings) == 0 {
+		return nil
+	}
+	var disclosed [][]*irma.DisclosedAttribute
+	if choice != nil {
+		for _, attrs := range choice.Attributes {
+			con := make([]*irma.DisclosedAttribute, 0, len(attrs))
+			for _, attr := range attrs {
+				disclosedAttr := &irma.DisclosedAttribute{Identifier: attr.Type}
+				if list, _ := client.attributesByHash(attr.CredentialHash); list != nil {
+					disclosedAttr.RawValue = list.UntranslatedAttribute(attr.Type)
+				}
+				con = append(con, disclosedAttr)
+			}
+			disclosed = append(disclosed, con)
+		}
+	}
+	skip := append([]int(nil), declined...)
+	for i := range failed {
+		skip = append(skip, i)
+	}
+	if err := request.VerifyBindings(disclosed, skip...); err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorIssuanceBindingViolated, Err: err}
+	}
+	return nil
+}
+
 // Keyshare server handling
 
 func (client *Client) genSchemeManagersList(enrolled bool) []irma.SchemeManagerIdentifier {
@@ -1087,6 +1797,8 @@ func (client *Client) EnrolledSchemeManagers() []irma.SchemeManagerIdentifier {
 }
 
 // KeyshareEnroll attempts to enroll at the keyshare server of the specified scheme manager.
+// The PIN must satisfy the PIN policy of the keyshare server, see KeysharePinPolicy; if not,
+// enrollment fails with an error of type irma.ErrorKeysharePinPolicy.
 func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email *string, pin string, lang string) {
 	go func() {
 		err := client.keyshareEnrollWorker(manager, email, pin, lang)
@@ -1104,8 +1816,9 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	if len(manager.KeyshareServer) == 0 {
 		return errors.New("Scheme manager has no keyshare server")
 	}
-	if len(pin) < 5 {
-		return errors.New("PIN too short, must be at least 5 characters")
+	policy := client.fetchPinPolicy(manager)
+	if err := policy.Check(pin); err != nil {
+		return err
 	}
 
 	// We expect that the PIN is equal across all keyshare servers. Therefore, we verify the PIN at one other
@@ -1128,32 +1841,28 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		return errors.New("incorrect pin")
 	}
 
-	keyname := challengeResponseKeyName(managerID)
-	pk, err := client.signer.PublicKey(keyname)
+	kss, err := newKeyshareServer(managerID)
 	if err != nil {
 		return err
 	}
+	kss.PinPolicy = policy
 
-	kss, err := newKeyshareServer(managerID)
+	transport := client.newTransport(manager.KeyshareServer)
+	protocol, err := client.keyshareProtocol(kss, transport)
 	if err != nil {
 		return err
 	}
-
-	jwtt, err := SignerCreateJWT(client.signer, keyname, irma.KeyshareEnrollmentClaims{
-		KeyshareEnrollmentData: irma.KeyshareEnrollmentData{
-			Email:     email,
-			Pin:       kss.HashedPin(pin),
-			Language:  lang,
-			PublicKey: pk,
-		},
+	msg, err := protocol.enrollment(client, kss, irma.KeyshareEnrollmentData{
+		Email:    email,
+		Pin:      kss.HashedPin(pin),
+		Language: lang,
 	})
 	if err != nil {
 		return err
 	}
 
-	transport := irma.NewHTTPTransport(manager.KeyshareServer, !client.Preferences.DeveloperMode)
 	qr := &irma.Qr{}
-	err = transport.Post("client/register", qr, irma.KeyshareEnrollment{EnrollmentJWT: jwtt})
+	err = transport.Post("client/register", qr, msg)
 	if err != nil {
 		return err
 	}
@@ -1168,7 +1877,7 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		client: client,
 		pin:    pin,
 		kss:    kss,
-	})
+	}, sessionOptions{})
 
 	return nil
 }
@@ -1180,7 +1889,8 @@ func challengeResponseKeyName(scheme irma.SchemeManagerIdentifier) string {
 
 // KeyshareVerifyPin verifies the specified PIN at the keyshare server, returning if it succeeded;
 // if not, how many tries are left, or for how long the user is blocked. If an error is returned
-// it is of type *irma.SessionError.
+// it is of type *irma.SessionError. This does not start a session, but it does update the
+// KeysharePinStatus.
 func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerIdentifier) (bool, int, int, error) {
 	scheme := client.Configuration.SchemeManagers[schemeid]
 	if scheme == nil || !scheme.Distributed() {
@@ -1191,13 +1901,63 @@ func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerI
 		}
 	}
 	kss := client.keyshareServers[schemeid]
-	return client.verifyPinWorker(pin, kss,
-		irma.NewHTTPTransport(scheme.KeyshareServer, !client.Preferences.DeveloperMode),
+	success, tries, blocked, err := client.verifyPinWorker(pin, kss,
+		client.newTransport(scheme.KeyshareServer),
 	)
+	if success {
+		client.cachePin(kss, pin)
+	}
+	return success, tries, blocked, err
+}
+
+// KeysharePinBackoff returns for how many seconds the user has to wait, after entering too many
+// incorrect PINs, before they may enter their PIN for the specified scheme again. This is imposed by
+// the client itself, independent of the keyshare server which may additionally block the user.
+func (client *Client) KeysharePinBackoff(schemeid irma.SchemeManagerIdentifier) int {
+	kss, enrolled := client.keyshareServers[schemeid]
+	if !enrolled {
+		return 0
+	}
+	return backoffSeconds(kss.pinBackoff())
+}
+
+// KeysharePinStatus returns what the client knows about the PIN of the user at the keyshare server
+// of the specified scheme, e.g. to show the remaining attempts before asking for the PIN, or to
+// disable the app while the user is blocked. It is updated whenever the PIN is verified, during
+// sessions or using KeyshareVerifyPin, and returns nil if the user is not enrolled.
+func (client *Client) KeysharePinStatus(schemeid irma.SchemeManagerIdentifier) *PinStatus {
+	kss, enrolled := client.keyshareServers[schemeid]
+	if !enrolled {
+		return nil
+	}
+	return kss.pinStatus()
+}
+
+// KeysharePinPolicy returns the PIN policy of the keyshare server of the specified scheme,
+// which new PINs must satisfy when enrolling or changing the PIN. The keyshare server publishes
+// its PIN policy, which is stored when enrolling; before that, or if the keyshare server did
+// not publish one, the PIN policy as far as specified by the scheme is returned.
+// It returns nil if the scheme has no keyshare server.
+func (client *Client) KeysharePinPolicy(schemeid irma.SchemeManagerIdentifier) *irma.KeysharePinPolicy {
+	if scheme := client.Configuration.SchemeManagers[schemeid]; scheme == nil || !scheme.Distributed() {
+		return nil
+	}
+	return client.pinPolicy(schemeid)
 }
 
 func (client *Client) KeyshareChangePin(oldPin string, newPin string) {
 	go func() {
+		// Check the new PIN against the PIN policies, before contacting any keyshare server.
+		for schemeID, kss := range client.keyshareServers {
+			if kss.PinOutOfSync {
+				continue
+			}
+			if err := client.pinPolicy(schemeID).Check(newPin); err != nil {
+				client.handler.ChangePinFailure(schemeID, err)
+				return
+			}
+		}
+
 		// Check whether all keyshare servers are available.
 		for schemeID, kss := range client.keyshareServers {
 			if kss.PinOutOfSync {
@@ -1266,24 +2026,18 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 		return errors.New("Unknown keyshare server")
 	}
 
-	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
-
-	claims := irma.KeyshareChangePinClaims{
-		KeyshareChangePinData: irma.KeyshareChangePinData{
-			Username: kss.Username,
-			OldPin:   kss.HashedPin(oldPin),
-			NewPin:   kss.HashedPin(newPin),
-		},
+	transport := client.newTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer)
+	protocol, err := client.keyshareProtocol(kss, transport)
+	if err != nil {
+		return err
 	}
-	jwtt, err := SignerCreateJWT(client.signer, challengeResponseKeyName(managerID), claims)
+	msg, err := protocol.changePin(client, kss, oldPin, newPin)
 	if err != nil {
 		return err
 	}
 
 	res := &irma.KeysharePinStatus{}
-	err = transport.Post("users/change/pin", res, irma.KeyshareChangePin{
-		ChangePinJWT: jwtt,
-	})
+	err = transport.Post("users/change/pin", res, msg)
 	if err != nil {
 		return err
 	}
@@ -1298,6 +2052,7 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 		if !ok {
 			return errors.Errorf("keyshare authorization token could not be refreshed for scheme %s", managerID)
 		}
+		client.cachePin(kss, "")
 		return nil
 	case kssPinFailure:
 		return errors.Errorf("incorrect PIN for scheme %s", managerID)
@@ -1328,17 +2083,24 @@ func (client *Client) keyshareRemoveMultiple(schemeIDs []irma.SchemeManagerIdent
 			return errors.New("can't uninstall unknown keyshare server")
 		}
 	}
+	return client.removeSchemeData(schemeIDs, removeLogs)
+}
 
+// removeSchemeData removes the keyshare enrollments and credentials of the specified schemes, and
+// if specified also the logs involving them.
+func (client *Client) removeSchemeData(schemeIDs []irma.SchemeManagerIdentifier, removeLogs bool) (err error) {
 	client.credMutex.Lock()
 	defer client.credMutex.Unlock()
 
 	defer func() {
-		err := client.loadCredentialStorage()
-		if err != nil {
+		loadErr := client.loadCredentialStorage()
+		if loadErr != nil {
 			// Cached storage is out-of-sync with real storage, so we can't do anything but report the error and
 			// close the client to prevent unexpected changes.
-			client.reportError(err)
+			client.reportError(loadErr)
 			_ = client.Close()
+		} else if err == nil {
+			client.emit(CredentialsReplaced{})
 		}
 	}()
 
@@ -1363,11 +2125,16 @@ func (client *Client) keyshareRemoveMultiple(schemeIDs []irma.SchemeManagerIdent
 				if err != nil {
 					return err
 				}
+				delete(client.nicknames, cred.Hash)
 			}
 		}
+		if err := client.storage.TxStoreNicknames(tx, client.nicknames); err != nil {
+			return err
+		}
 
 		// Remove all logs of given schemes, if necessary.
 		if removeLogs {
+			var ids []uint64
 			err := client.storage.TxIterateLogs(tx, func(log *LogEntry) error {
 				shouldDelete := false
 				for credID := range log.Removed {
@@ -1389,13 +2156,16 @@ func (client *Client) keyshareRemoveMultiple(schemeIDs []irma.SchemeManagerIdent
 				}
 
 				if shouldDelete {
-					return client.storage.TxDeleteLogEntry(tx, log)
+					ids = append(ids, log.ID)
 				}
 				return nil
 			})
 			if err != nil {
 				return err
 			}
+			if err = client.storage.TxDeleteLogEntries(tx, ids); err != nil {
+				return err
+			}
 		}
 
 		return client.storage.TxStoreKeyshareServers(tx, client.keyshareServers)
@@ -1416,6 +2186,10 @@ func (client *Client) LoadLogsBefore(beforeIndex uint64, max int) ([]*LogEntry,
 	return client.storage.LoadLogsBefore(beforeIndex, max)
 }
 
+// SetPreferences sets and stores the preferences. Developer mode allows connecting to IRMA
+// servers and keyshare servers over plain HTTP, sessions with IRMA servers running in development
+// mode, and installing unsigned schemes. It is reflected in the requestor info passed to the
+// permission requests of sessions. Unsigned schemes are removed when developer mode is disabled.
 func (client *Client) SetPreferences(pref Preferences) {
 	if pref.DeveloperMode {
 		irma.Logger.Info("developer mode enabled")
@@ -1427,14 +2201,103 @@ func (client *Client) SetPreferences(pref Preferences) {
 	client.applyPreferences()
 }
 
-func (client *Client) applyPreferences() {}
+// applyPreferences applies the preferences to the configuration, unless it is shared with others
+// (see NewMemoryClient), in which case the owner of the configuration decides on its developer mode.
+func (client *Client) applyPreferences() {
+	conf := client.Configuration
+	if client.sharedConfiguration || conf.DeveloperMode() == client.Preferences.DeveloperMode {
+		return
+	}
+	if !client.Preferences.DeveloperMode {
+		// Otherwise we would fail to parse these schemes on the next startup
+		if err := client.removeUnsignedSchemes(); err != nil {
+			client.reportError(err)
+		}
+	}
+	conf.SetDeveloperMode(client.Preferences.DeveloperMode)
+}
 
-// ConfigurationUpdated should be run after Configuration.Download().
+// removeUnsignedSchemes removes the unsigned schemes, which can only be installed in developer
+// mode, along with the credentials, keyshare enrollments and logs of the unsigned issuer schemes.
+// Schemes included in the assets are restored to their version in the assets.
+func (client *Client) removeUnsignedSchemes() error {
+	var schemeIDs []irma.SchemeManagerIdentifier
+	for _, scheme := range client.Configuration.UnsignedSchemes() {
+		if manager, ok := scheme.(*irma.SchemeManager); ok {
+			schemeIDs = append(schemeIDs, manager.Identifier())
+		}
+	}
+	if len(schemeIDs) > 0 {
+		irma.Logger.Warnf("developer mode disabled, removing unsigned schemes %v", schemeIDs)
+		if err := client.removeSchemeData(schemeIDs, true); err != nil {
+			return err
+		}
+	}
+	if err := client.Configuration.DangerousDeleteUnsignedSchemes(); err != nil {
+		return err
+	}
+	if len(schemeIDs) > 0 {
+		removed := &irma.IrmaIdentifierSet{SchemeManagers: map[irma.SchemeManagerIdentifier]struct{}{}}
+		for _, id := range schemeIDs {
+			removed.SchemeManagers[id] = struct{}{}
+		}
+		client.emit(SchemeUpdated{Identifiers: removed})
+	}
+	return nil
+}
+
+// SetTransportTimeout sets the time limit for each HTTP request to IRMA servers and keyshare
+// servers, see irma.HTTPTransport.SetTimeout. A zero duration restores the default.
+func (client *Client) SetTransportTimeout(timeout time.Duration) {
+	client.transportMutex.Lock()
+	defer client.transportMutex.Unlock()
+	client.transportTimeout = timeout
+}
+
+// SetTransportRoundTripper sets the http.RoundTripper performing the HTTP requests to IRMA
+// servers and keyshare servers, e.g. an irma.TranscriptRecorder or irma.TranscriptReplayer
+// in tests. Passing nil restores the default.
+func (client *Client) SetTransportRoundTripper(rt http.RoundTripper) {
+	client.transportMutex.Lock()
+	defer client.transportMutex.Unlock()
+	client.transportRoundTripper = rt
+}
+
+// newTransport returns a transport to the specified server, configured as per the preferences,
+// SetTransportTimeout and SetTransportRoundTripper.
+func (client *Client) newTransport(serverURL string) *irma.HTTPTransport {
+	transport := irma.NewHTTPTransport(serverURL, !client.Preferences.DeveloperMode)
+	client.transportMutex.Lock()
+	defer client.transportMutex.Unlock()
+	if client.transportTimeout != 0 {
+		transport.SetTimeout(client.transportTimeout)
+	}
+	if client.transportRoundTripper != nil {
+		transport.SetRoundTripper(client.transportRoundTripper)
+	}
+	transport.SetDateListener(client.observeServerDate)
+	return transport
+}
+
+// newSessionTransport returns a transport to the specified IRMA server as newTransport does,
+// which limits the size of the responses of the server to that needed for sessions.
+func (client *Client) newSessionTransport(serverURL string) *irma.HTTPTransport {
+	transport := client.newTransport(serverURL)
+	transport.SetMaxResponseSize("", irma.MaxSessionResponseSize)
+	transport.SetMaxResponseSize("commitments", irma.MaxIssuanceResponseSize)
+	return transport
+}
+
+// ConfigurationUpdated should be run after Configuration.Download() or after updating schemes.
 // For any credential type in the updated scheme to which new attributes were added, this function
 // sets the value of these new attributes to 0 in all instances that the client currently has of this
-// credential type.
+// credential type. It also starts updating the nonrevocation witnesses of our credentials.
 func (client *Client) ConfigurationUpdated(downloaded *irma.IrmaIdentifierSet) error {
-	if downloaded == nil || len(downloaded.CredentialTypes) == 0 {
+	if downloaded == nil || downloaded.Empty() {
+		return nil
+	}
+	client.nonrevUpdateAll()
+	if len(downloaded.CredentialTypes) == 0 {
 		return nil
 	}
 
@@ -1484,7 +2347,13 @@ func (client *Client) RemoveScheme(schemeID irma.SchemeManagerIdentifier) error
 	if err != nil {
 		return err
 	}
-	return client.Configuration.ParseFolder()
+	if err = client.Configuration.ParseFolder(); err != nil {
+		return err
+	}
+	client.emit(SchemeUpdated{Identifiers: &irma.IrmaIdentifierSet{
+		SchemeManagers: map[irma.SchemeManagerIdentifier]struct{}{schemeID: {}},
+	}})
+	return nil
 }
 
 func (cc *credCandidate) Present() bool {
@@ -0,0 +1,89 @@
+package irmaclient
+
+import (
+	"sync"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the estimation of the offset of the clock of the device, from the Date
+// headers of the responses of IRMA servers and scheme servers. The expiry of credentials and of
+// keyshare tokens is evaluated using the time corrected by this offset, so that a wrong device
+// clock does not make valid credentials unusable or expired credentials usable.
+
+const (
+	// maxClockCorrection bounds the correction of the device time, so that a server sending a
+	// false Date header cannot make the client use credentials that expired long ago.
+	maxClockCorrection = 7 * 24 * time.Hour
+
+	// clockSkewThreshold is the offset of the device clock beyond which a ClockSkewHandler is
+	// informed.
+	clockSkewThreshold = 10 * time.Minute
+)
+
+// ClockSkewHandler can optionally be implemented by a ClientHandler, to be informed when the
+// clock of the device is found to be off by more than 10 minutes, so that the app can ask the
+// user to correct it. The skew is the amount of time that the device is ahead of the servers,
+// of which the client corrects at most 7 days. It is called again only after the clock was
+// found to be correct in the meantime.
+type ClockSkewHandler interface {
+	ClockSkewDetected(skew time.Duration)
+}
+
+type clock struct {
+	sync.Mutex
+	skew   time.Duration    // device time minus server time, as last observed
+	warned bool             // whether the ClockSkewHandler was informed of the current skew
+	device func() time.Time // time of the device; nil means time.Now
+}
+
+func (c *clock) deviceTime() time.Time {
+	if c.device == nil {
+		return time.Now()
+	}
+	return c.device()
+}
+
+// observeServerDate updates the estimated clock skew with the time of a server.
+func (client *Client) observeServerDate(date time.Time) {
+	client.clock.Lock()
+	// The Date header has a resolution of a second
+	skew := client.clock.deviceTime().Sub(date).Truncate(time.Second)
+	client.clock.skew = skew
+	exceeded := skew > clockSkewThreshold || skew < -clockSkewThreshold
+	warn := exceeded && !client.clock.warned
+	client.clock.warned = exceeded
+	client.clock.Unlock()
+
+	if !warn {
+		return
+	}
+	irma.Logger.Warnf("Device clock is off by %s", skew)
+	if handler, ok := client.handler.(ClockSkewHandler); ok {
+		handler.ClockSkewDetected(skew)
+	}
+}
+
+// ClockSkew returns the estimated amount of time that the clock of the device is ahead of those
+// of the servers, which is zero until a server has been contacted.
+func (client *Client) ClockSkew() time.Duration {
+	client.clock.Lock()
+	defer client.clock.Unlock()
+	return client.clock.skew
+}
+
+// now returns the time of the device corrected by the estimated clock skew, by at most
+// maxClockCorrection.
+func (client *Client) now() time.Time {
+	client.clock.Lock()
+	defer client.clock.Unlock()
+	skew := client.clock.skew
+	if skew > maxClockCorrection {
+		skew = maxClockCorrection
+	}
+	if skew < -maxClockCorrection {
+		skew = -maxClockCorrection
+	}
+	return client.clock.deviceTime().Add(-skew)
+}
@@ -0,0 +1,213 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the diagnostic capture of failed sessions for support purposes. When enabled
+// using SetDiagnosticCapture, sessions record their exchanges with the IRMA server and keyshare
+// servers in memory; of the last session that failed these are kept, with attribute values, PINs
+// and proofs redacted, so that LastFailureBundle can hand them to the app to be attached to a
+// support request.
+
+// FailureBundle describes the last session that failed, see Client.LastFailureBundle.
+type FailureBundle struct {
+	Time time.Time `json:"time"`
+	// Report describes the failure like the report that is sent to the IRMA server,
+	// see SetErrorReports.
+	Report  *irma.ClientErrorReport `json:"report"`
+	Timings PhaseTimings            `json:"timings"`
+	// Exchanges contains the redacted HTTP requests of the session and the responses to them,
+	// in order. Attribute values and PINs are replaced by their size, and proofs and signatures
+	// by their size and SHA-256 hash, see diagnosticRedacted.
+	Exchanges []*irma.TranscriptExchange `json:"exchanges"`
+	Health    *HealthReport              `json:"health"`
+}
+
+// failureCapture is what is kept of the last failed session until LastFailureBundle is called.
+type failureCapture struct {
+	time      time.Time
+	report    *irma.ClientErrorReport
+	timings   PhaseTimings
+	exchanges []*irma.TranscriptExchange
+}
+
+// diagnosticRedacted replaces a redacted value in the exchanges of a FailureBundle.
+type diagnosticRedacted struct {
+	Redacted int    `json:"redacted"` // size of the JSON of the value
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+var (
+	// diagnosticValueFields are the fields of JSON messages containing attribute values or other
+	// personal data, like the message of an attribute-based signature, or (hashed) PINs.
+	diagnosticValueFields = map[string]bool{
+		"value": true, "rawvalue": true, "attributes": true, "encryptedAttributes": true,
+		"message": true, "email": true, "pin": true, "oldpin": true, "newpin": true,
+		"auth_response_jwt": true, "enrollment_jwt": true, "change_pin_jwt": true,
+	}
+	// diagnosticProofFields are the fields of JSON messages containing proofs or signatures,
+	// whose hashes are kept so that they can be compared across exchanges.
+	diagnosticProofFields = map[string]bool{
+		"proofs": true, "combinedProofs": true, "signature": true, "sigs": true,
+		"proofPJwt": true, "proofPJwts": true,
+	}
+)
+
+// SetDiagnosticCapture sets whether the exchanges of sessions with IRMA servers and keyshare
+// servers are recorded in memory, so that those of the last failed session can be retrieved
+// using LastFailureBundle. It applies to sessions started afterwards. Disabled by default.
+func (client *Client) SetDiagnosticCapture(enabled bool) {
+	client.transportMutex.Lock()
+	defer client.transportMutex.Unlock()
+	client.diagnosticCapture = enabled
+}
+
+// LastFailureBundle returns, as JSON, a FailureBundle describing the last session that failed
+// while diagnostic capture was enabled, together with the report of a HealthCheck that is done
+// now. It returns nil if there is no such session.
+func (client *Client) LastFailureBundle() ([]byte, error) {
+	client.lastFailureMutex.Lock()
+	capture := client.lastFailure
+	client.lastFailureMutex.Unlock()
+	if capture == nil {
+		return nil, nil
+	}
+	return json.Marshal(&FailureBundle{
+		Time:      capture.time,
+		Report:    capture.report,
+		Timings:   capture.timings,
+		Exchanges: capture.exchanges,
+		Health:    client.HealthCheck(0),
+	})
+}
+
+// startCapture starts recording the exchanges of the session if diagnostic capture is enabled.
+func (session *session) startCapture() {
+	client := session.client
+	client.transportMutex.Lock()
+	enabled, next := client.diagnosticCapture, client.transportRoundTripper
+	client.transportMutex.Unlock()
+	if !enabled {
+		return
+	}
+	session.capture = irma.NewTranscriptRecorder(next)
+	session.transport.SetRoundTripper(session.capture)
+}
+
+// transportCapturer is implemented by keyshare session handlers that record the exchanges of the
+// keyshare protocol.
+type transportCapturer interface {
+	captureTransport(transport *irma.HTTPTransport)
+}
+
+var (
+	_ transportCapturer = (*session)(nil)
+	_ transportCapturer = cancellableKeyshareHandler{}
+)
+
+func (session *session) captureTransport(transport *irma.HTTPTransport) {
+	if session.capture != nil {
+		transport.SetRoundTripper(session.capture)
+	}
+}
+
+// captureFailure keeps the redacted exchanges of the failed session for LastFailureBundle,
+// replacing those of the previous failed session.
+func (session *session) captureFailure(err *irma.SessionError) {
+	if session.capture == nil {
+		return
+	}
+	session.statusMutex.Lock()
+	timings := session.timings
+	session.statusMutex.Unlock()
+
+	capture := &failureCapture{
+		time:    time.Now(),
+		report:  session.newErrorReport(err),
+		timings: timings,
+	}
+	for _, exchange := range session.capture.Transcript().Exchanges {
+		exchange.Request = redactDiagnosticBody(exchange.Request)
+		exchange.Response = redactDiagnosticBody(exchange.Response)
+		capture.exchanges = append(capture.exchanges, exchange)
+	}
+
+	client := session.client
+	client.lastFailureMutex.Lock()
+	defer client.lastFailureMutex.Unlock()
+	client.lastFailure = capture
+}
+
+// redactDiagnosticBody redacts the attribute values, PINs and proofs from a request or response
+// body. As we cannot tell what bodies that are not JSON contain, they are redacted entirely.
+func redactDiagnosticBody(body string) string {
+	if body == "" {
+		return body
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(body)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return redactDiagnosticString(body)
+	}
+	if _, isString := value.(string); isString {
+		// e.g. JWTs of keyshare servers
+		return redactDiagnosticString(body)
+	}
+	bts, err := json.Marshal(redactDiagnosticJSON(value))
+	if err != nil {
+		return redactDiagnosticString(body)
+	}
+	return string(bts)
+}
+
+func redactDiagnosticString(body string) string {
+	bts, _ := json.Marshal(newDiagnosticRedacted([]byte(body), true))
+	return string(bts)
+}
+
+// redactDiagnosticJSON returns the decoded JSON value with the values of the fields in
+// diagnosticValueFields and diagnosticProofFields redacted, at any depth.
+func redactDiagnosticJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		_, remoteError := v["error"]
+		for field, fieldValue := range v {
+			switch {
+			case field == "message" && remoteError:
+				// the message of an irma.RemoteError is what support is looking for
+			case diagnosticValueFields[field], diagnosticProofFields[field]:
+				bts, _ := json.Marshal(fieldValue)
+				v[field] = newDiagnosticRedacted(bts, diagnosticProofFields[field])
+			default:
+				v[field] = redactDiagnosticJSON(fieldValue)
+			}
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactDiagnosticJSON(v[i])
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+// newDiagnosticRedacted returns the replacement of the redacted value. Attribute values are
+// too predictable to include their hash.
+func newDiagnosticRedacted(value []byte, hash bool) *diagnosticRedacted {
+	redacted := &diagnosticRedacted{Redacted: len(value)}
+	if hash {
+		sum := sha256.Sum256(value)
+		redacted.SHA256 = hex.EncodeToString(sum[:])
+	}
+	return redacted
+}
@@ -0,0 +1,90 @@
+package irmaclient
+
+import (
+	"sync"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// A Dispatcher invokes the functions passed to it, through which a session invokes all methods
+// of its Handler, for example on the main thread of the app. The functions may be invoked
+// asynchronously, but each must be invoked exactly once. A nil Dispatcher invokes them directly,
+// on the goroutine of the session.
+type Dispatcher func(func())
+
+// SerialDispatcher is a Dispatcher that invokes the functions passed to it one at a time, in the
+// order in which they were passed, on a goroutine of its own. Handler methods of sessions using it
+// thus never run concurrently. The zero value is ready for use; use its Dispatch method as the
+// Dispatcher of one or more sessions.
+type SerialDispatcher struct {
+	mutex   sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// Dispatch queues the function, starting the goroutine that invokes queued functions if it is
+// not running.
+func (d *SerialDispatcher) Dispatch(f func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queue = append(d.queue, f)
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+}
+
+// run invokes queued functions until the queue is empty.
+func (d *SerialDispatcher) run() {
+	for {
+		d.mutex.Lock()
+		if len(d.queue) == 0 {
+			d.running = false
+			d.mutex.Unlock()
+			return
+		}
+		f := d.queue[0]
+		d.queue[0] = nil
+		d.queue = d.queue[1:]
+		d.mutex.Unlock()
+		f()
+	}
+}
+
+// NewSessionWithDispatcher starts a new IRMA session as NewSession does, invoking all methods of
+// the handler using the specified dispatcher, also those of chained sessions.
+func (client *Client) NewSessionWithDispatcher(sessionrequest string, handler Handler, dispatcher Dispatcher) SessionDismisser {
+	return client.newSession(sessionrequest, handler, sessionOptions{dispatcher: dispatcher})
+}
+
+// sessionOptions contains the options with which a session is started, which carry over to
+// chained sessions.
+type sessionOptions struct {
+	policy     SessionPolicy // consulted next to the policy of the client, see SessionPolicy
+	dispatcher Dispatcher    // see Dispatcher
+	dryRun     bool          // see NewDryRunSession
+}
+
+// dispatch invokes f, which invokes a method of the Handler, using the dispatcher of the options.
+func (opts sessionOptions) dispatch(f func()) {
+	if opts.dispatcher == nil {
+		f()
+		return
+	}
+	opts.dispatcher(f)
+}
+
+// fail passes the error to the Failure method of the handler, for sessions that failed before
+// they could be started.
+func (opts sessionOptions) fail(handler Handler, err *irma.SessionError) {
+	opts.dispatch(func() { handler.Failure(err) })
+}
+
+// dispatchingPinRequestor asks for the PIN using the dispatcher of the session.
+type dispatchingPinRequestor struct {
+	session *session
+}
+
+func (r dispatchingPinRequestor) RequestPin(metadata PinMetadata, proceed func(pin string), cancel func()) {
+	r.session.dispatch(func() { r.session.Handler.RequestPin(metadata, proceed, cancel) })
+}
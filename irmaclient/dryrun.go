@@ -0,0 +1,61 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// DryRunHandler is a Handler for sessions started with NewDryRunSession.
+type DryRunHandler interface {
+	Handler
+	// DryRun is called instead of Success, with the endpoint of the server to which the response
+	// would have been posted ("proofs" or "commitments") and the response in JSON.
+	DryRun(endpoint string, response string)
+}
+
+// NewDryRunSession performs a session as NewSession does up to and including the construction of
+// the response to the server, after the user's permission. Instead of posting the response, it
+// passes it to the DryRun method of the handler and cancels the session at the server, so that
+// it can be verified exactly what would have been disclosed or committed to. Keyshare servers
+// do take part in constructing the response. The session is logged with LogEntry.DryRun set.
+//
+// Dry runs can only be requested by the caller of this function, never by the session request
+// or the server.
+func (client *Client) NewDryRunSession(sessionrequest string, handler DryRunHandler) SessionDismisser {
+	return client.newSession(sessionrequest, handler, sessionOptions{dryRun: true})
+}
+
+// finishDryRun completes a dry run session with the response that would have been sent to the
+// specified endpoint of the server.
+func (session *session) finishDryRun(endpoint string, response interface{},
+	disclosure *irma.DisclosureResponse, commitments *irma.IssueCommitmentMessage,
+) {
+	bts, err := json.Marshal(response)
+	if err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return
+	}
+
+	session.timePhase(func(t *PhaseTimings) **time.Time { return &t.Finished })
+	log, err := session.createLogEntry(disclosure, commitments)
+	if err != nil {
+		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to create log entry", 0).ErrorStack())
+		session.client.reportError(err)
+	} else {
+		log.DryRun = true
+		if err = session.client.addLogEntry(log); err != nil {
+			irma.Logger.Warn(errors.WrapPrefix(err, "Failed to write log entry", 0).ErrorStack())
+		}
+	}
+
+	// Cancel the session at the server, which never receives the response
+	session.finish(true)
+	session.setStatus(irma.ClientStatusDone)
+	session.reportTimings()
+	if handler, ok := session.Handler.(DryRunHandler); ok {
+		session.dispatch(func() { handler.DryRun(endpoint, string(bts)) })
+	}
+}
@@ -0,0 +1,104 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// KeyshareEnrollmentState is the state of the enrollment of the user at a keyshare server.
+type KeyshareEnrollmentState string
+
+const (
+	// The user is not enrolled at the keyshare server
+	KeyshareStateUnenrolled = KeyshareEnrollmentState("Unenrolled")
+	// The user is enrolled, but the keyshare server refuses to be used until the user has
+	// verified their email address by clicking the link that the keyshare server mailed them
+	KeyshareStatePendingEmailVerification = KeyshareEnrollmentState("PendingEmailVerification")
+	// The user is enrolled and the keyshare server can be used
+	KeyshareStateEnrolled = KeyshareEnrollmentState("Enrolled")
+)
+
+// KeyshareEnrollmentState returns the state of the enrollment at the keyshare server of the
+// specified scheme. When a session needs a keyshare server whose email verification is pending,
+// the client checks whether this is still the case, in which case the session fails with an
+// error of type irma.ErrorKeyshareEmailNotVerified. If the email address has been verified in the
+// meantime, the session continues and a KeyshareEmailVerified event is emitted.
+func (client *Client) KeyshareEnrollmentState(schemeid irma.SchemeManagerIdentifier) KeyshareEnrollmentState {
+	kss, enrolled := client.keyshareServers[schemeid]
+	switch {
+	case !enrolled:
+		return KeyshareStateUnenrolled
+	case kss.PendingEmailVerification:
+		return KeyshareStatePendingEmailVerification
+	default:
+		return KeyshareStateEnrolled
+	}
+}
+
+// emailNotVerified returns whether the keyshare server refused our request because the user
+// has not yet verified their email address.
+func emailNotVerified(err error) bool {
+	serr, ok := err.(*irma.SessionError)
+	return ok && serr.RemoteError != nil && serr.RemoteError.ErrorName == "EMAIL_NOT_VERIFIED"
+}
+
+func emailNotVerifiedError(managerID irma.SchemeManagerIdentifier) *irma.SessionError {
+	return &irma.SessionError{
+		Err:       errors.Errorf("email address not yet verified at keyshare server of %s", managerID),
+		ErrorType: irma.ErrorKeyshareEmailNotVerified,
+		Info:      managerID.String(),
+	}
+}
+
+// setEmailVerificationPending updates and persists whether the email verification of the
+// keyshare server is pending, emitting KeyshareEmailVerified when it is no longer pending.
+func (client *Client) setEmailVerificationPending(kss *keyshareServer, pending bool) {
+	if kss.PendingEmailVerification == pending {
+		return
+	}
+	kss.PendingEmailVerification = pending
+	if err := client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+		client.reportError(err)
+		return
+	}
+	if !pending {
+		client.emit(KeyshareEmailVerified{SchemeManager: kss.SchemeManagerIdentifier})
+	}
+}
+
+// checkEmailVerification checks at a keyshare server whose email verification is pending whether
+// this is still the case, so that sessions fail before the user enters their PIN. For this we
+// start authentication, which does not require the PIN. It returns an error only if the email
+// verification is still pending; the verification is considered complete only once the keyshare
+// server is actually used, see keyshareSession.GetCommitments.
+func (client *Client) checkEmailVerification(kss *keyshareServer, transport *irma.HTTPTransport) error {
+	if !kss.PendingEmailVerification || !kss.ChallengeResponse {
+		return nil
+	}
+	jwtt, err := SignerCreateJWT(client.signer, challengeResponseKeyName(kss.SchemeManagerIdentifier), irma.KeyshareAuthRequestClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(challengeRequestJWTExpiry))},
+		Username:         kss.Username,
+	})
+	if err != nil {
+		return err
+	}
+	err = transport.Post("users/verify_start", &irma.KeyshareAuthChallenge{}, irma.KeyshareAuthRequest{AuthRequestJWT: jwtt})
+	if emailNotVerified(err) {
+		return emailNotVerifiedError(kss.SchemeManagerIdentifier)
+	}
+	return nil
+}
+
+// keyshareError reports an error of a request to the keyshare server of the specified scheme to
+// the session. If the keyshare server refused because the user has not verified their email
+// address, we register that the email verification is pending.
+func (ks *keyshareSession) keyshareError(managerID irma.SchemeManagerIdentifier, err error) {
+	if emailNotVerified(err) {
+		ks.client.setEmailVerificationPending(ks.client.keyshareServers[managerID], true)
+		err = emailNotVerifiedError(managerID)
+	}
+	ks.sessionHandler.KeyshareError(&managerID, err)
+}
@@ -0,0 +1,75 @@
+package irmaclient
+
+import (
+	"sync/atomic"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// errorReports is 1 if failed sessions are reported to the IRMA server, see SetErrorReports.
+var errorReports int32
+
+// SetErrorReports sets whether sessions that fail after the session request was received from
+// the IRMA server report the failure to the server, see irma.ClientErrorReport. The report is
+// sent before Handler.Failure is called, and failures to send it are ignored. Disabled by default.
+func SetErrorReports(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&errorReports, value)
+}
+
+// errorReport returns the report of the specified failure to the IRMA server, or nil if it
+// should not be reported: if reporting is disabled, if the server did not hand out the session
+// request, or if the server cannot be reached anyway.
+func (session *session) errorReport(err *irma.SessionError) *irma.ClientErrorReport {
+	if atomic.LoadInt32(&errorReports) == 0 || !session.IsInteractive() ||
+		err.ErrorType == irma.ErrorTransport || err.ErrorType == irma.ErrorKeyshareUnenrolled {
+		return nil
+	}
+
+	report := session.newErrorReport(err)
+	if report.Timings == nil {
+		return nil
+	}
+	return report
+}
+
+// newErrorReport describes the specified failure without anything from the session request.
+// Its Timings are nil if the session request was not received.
+func (session *session) newErrorReport(err *irma.SessionError) *irma.ClientErrorReport {
+	session.statusMutex.Lock()
+	phase, timings := session.status, session.timings
+	session.statusMutex.Unlock()
+
+	report := &irma.ClientErrorReport{
+		ErrorType:       err.ErrorType,
+		RemoteStatus:    err.RemoteStatus,
+		Phase:           phase,
+		Action:          session.Action,
+		ProtocolVersion: session.Version,
+		ClientName:      "irmago",
+		ClientVersion:   irma.Version,
+	}
+	if err.RemoteError != nil {
+		report.RemoteError = err.RemoteError.ErrorName
+	}
+	if timings.RequestReceived == nil {
+		return report
+	}
+	d := timings.Durations()
+	report.Timings = map[string]int64{
+		"request": d.Request, "processing": d.Processing, "user": d.User, "proofs": d.Proofs, "response": d.Response,
+	}
+	return report
+}
+
+// postErrorReport posts the report to the IRMA server, ignoring failures, and then deletes the
+// session at the server.
+func (session *session) postErrorReport(report *irma.ClientErrorReport) {
+	if err := session.transport.Post("error", nil, report); err != nil {
+		irma.Logger.Warn("failed to post error report: ", err.Error())
+	}
+	go func() { _ = session.transport.Delete() }()
+}
@@ -0,0 +1,276 @@
+package irmaclient
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the estimate of the size of the response to a session and of the time needed
+// to compute it, so that users on slow connections or devices know what to expect before they
+// consent. The size of proofs is predictable from the key sizes and the amount of attributes of
+// the credentials involved. The time is estimated from the time that proofs took on this device
+// in earlier sessions, which is kept per key size as an exponentially weighted moving average.
+
+// proofTimingsKey is the key in the userdata bucket of the proof timings of this device;
+// value: map[int]float64 (key size in bits to milliseconds per credential).
+const proofTimingsKey = "proofTimings"
+
+var (
+	// defaultProofTimings contains the milliseconds needed per credential for each key size on
+	// a typical phone, used until proofs have been computed on this device.
+	defaultProofTimings = map[int]float64{1024: 20, 2048: 100, 4096: 500}
+
+	// proofTimingWeight is the weight of a new measurement in the moving average.
+	proofTimingWeight = 0.25
+)
+
+// responseOverhead is the estimated size in bytes of the parts of a response other than the proofs.
+const responseOverhead = 128
+
+// ResponseEstimate estimates the response to a session, to be shown to the user before they
+// consent to the session.
+type ResponseEstimate struct {
+	// Bytes is the estimated size of the response that is uploaded to the IRMA server,
+	// excluding nonrevocation proofs.
+	Bytes int `json:"bytes"`
+	// Milliseconds is the estimated time needed to compute the response on this device,
+	// excluding communication with the IRMA server and keyshare servers.
+	Milliseconds int64 `json:"milliseconds"`
+	// Credentials is the amount of credentials that proofs are computed of, i.e. those from
+	// which attributes are disclosed and those that are issued.
+	Credentials int `json:"credentials"`
+}
+
+// ResponseEstimateHandler can optionally be implemented by a Handler, to receive an estimate of
+// the response just before the permission request, computed for the first candidate that can
+// be chosen of each disjunction. When the user makes another choice, the estimate can be
+// recomputed using Client.EstimateResponse.
+type ResponseEstimateHandler interface {
+	ResponseEstimate(estimate *ResponseEstimate)
+}
+
+// proofCost describes a proof to be computed in a session.
+type proofCost struct {
+	keySize int // bit length of the modulus of the public key
+	bytes   int // size of the proof in the response
+}
+
+// EstimateResponse estimates the response to the request when the user makes the specified
+// choice of attributes to disclose.
+func (client *Client) EstimateResponse(request irma.SessionRequest, choice *irma.DisclosureChoice) (*ResponseEstimate, error) {
+	costs, err := client.proofCosts(request, choice)
+	if err != nil {
+		return nil, err
+	}
+	timings := client.proofTimings()
+	estimate := &ResponseEstimate{Bytes: responseOverhead, Credentials: len(costs)}
+	var ms float64
+	for _, cost := range costs {
+		estimate.Bytes += cost.bytes
+		ms += proofTiming(timings, cost.keySize)
+	}
+	estimate.Milliseconds = int64(ms + 0.5)
+	return estimate, nil
+}
+
+// proofCosts returns the proofs that are computed in a session of the request when the user
+// makes the specified choice.
+func (client *Client) proofCosts(request irma.SessionRequest, choice *irma.DisclosureChoice) ([]proofCost, error) {
+	todisclose, _, err := client.groupCredentials(choice)
+	if err != nil {
+		return nil, err
+	}
+	var costs []proofCost
+	for _, grp := range todisclose {
+		attrs, _ := client.attributesByHash(grp.cred.Hash)
+		if attrs == nil {
+			return nil, errors.Errorf("credential %s not found", grp.cred.Type)
+		}
+		pk, err := attrs.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if pk == nil {
+			return nil, errors.Errorf("public key of credential %s not found", grp.cred.Type)
+		}
+		// attrs.Ints contains the metadata attribute but not the secret key, which precedes it
+		disclosed := make(map[int]*big.Int, len(grp.attrs))
+		for _, i := range grp.attrs {
+			disclosed[i] = attrs.Ints[i-1]
+		}
+		costs = append(costs, newProofCost(pk, len(attrs.Ints)+1, disclosed, false))
+	}
+	if ir, ok := request.(*irma.IssuanceRequest); ok {
+		for _, credreq := range ir.Credentials {
+			issuer := credreq.CredentialTypeID.IssuerIdentifier()
+			pk, err := client.Configuration.PublicKey(issuer, credreq.KeyCounter)
+			if err != nil {
+				return nil, err
+			}
+			if pk == nil {
+				return nil, errors.Errorf("public key %s-%d not found", issuer, credreq.KeyCounter)
+			}
+			costs = append(costs, newProofCost(pk, 0, nil, true))
+		}
+	}
+	return costs, nil
+}
+
+// newProofCost computes the size of a disclosure proof (gabi.ProofD) of a credential with the
+// specified amount of attributes, including the secret key, of which the specified ones are
+// disclosed, or of a proof of knowledge of the secret key of a credential to be issued
+// (gabi.ProofU), from the bit lengths of their components.
+func newProofCost(pk *gabikeys.PublicKey, attrs int, disclosed map[int]*big.Int, issuance bool) proofCost {
+	cost := proofCost{keySize: pk.N.BitLen()}
+	params := pk.Params
+	if params == nil {
+		params = gabikeys.DefaultSystemParameters[cost.keySize]
+	}
+	if params == nil {
+		return cost
+	}
+	if issuance {
+		cost.bytes = 2 + jsonFieldSize("U", params.Ln) + jsonFieldSize("c", params.Lh) +
+			jsonFieldSize("v_prime_response", params.LvPrimeCommit) + jsonFieldSize("s_response", params.LsCommit)
+		return cost
+	}
+	cost.bytes = 2 + jsonFieldSize("c", params.Lh) + jsonFieldSize("A", params.Ln) +
+		jsonFieldSize("e_response", params.LeCommit) + jsonFieldSize("v_response", params.LvCommit) +
+		len("a_responses") + 6 + len("a_disclosed") + 6
+	for i := 0; i < attrs; i++ {
+		if value, ok := disclosed[i]; ok {
+			cost.bytes += jsonFieldSize(strconv.Itoa(i), uint(value.BitLen()))
+		} else {
+			cost.bytes += jsonFieldSize(strconv.Itoa(i), params.LmCommit)
+		}
+	}
+	return cost
+}
+
+// jsonFieldSize returns the size of a JSON field with the specified name containing a
+// base64-encoded integer of the specified bit length, including the separators.
+func jsonFieldSize(name string, bits uint) int {
+	bytes := int(bits+7) / 8
+	if bytes == 0 {
+		bytes = 1
+	}
+	return len(name) + 4 + (bytes+2)/3*4 + 2
+}
+
+// proofTimings returns the proof timings of this device.
+func (client *Client) proofTimings() map[int]float64 {
+	client.proofTimingsMutex.Lock()
+	defer client.proofTimingsMutex.Unlock()
+	return client.loadProofTimings()
+}
+
+// loadProofTimings loads the proof timings from storage if necessary; proofTimingsMutex must be
+// held.
+func (client *Client) loadProofTimings() map[int]float64 {
+	if client.proofTimingsCache == nil {
+		timings := map[int]float64{}
+		if _, err := client.storage.load(userdataBucket, proofTimingsKey, &timings); err != nil {
+			irma.Logger.Warn("failed to load proof timings: ", err)
+		}
+		client.proofTimingsCache = timings
+	}
+	return client.proofTimingsCache
+}
+
+// proofTiming returns the milliseconds that a proof for the key size takes on this device.
+func proofTiming(timings map[int]float64, keySize int) float64 {
+	if t, ok := timings[keySize]; ok {
+		return t
+	}
+	if t, ok := defaultProofTimings[keySize]; ok {
+		return t
+	}
+	// Scale the timing of the nearest key size, as modular exponentiation is cubic in the key size
+	nearest := 2048
+	for size := range defaultProofTimings {
+		if d := abs(size - keySize); d < abs(nearest-keySize) || (d == abs(nearest-keySize) && size < nearest) {
+			nearest = size
+		}
+	}
+	ratio := float64(keySize) / float64(nearest)
+	return proofTiming(timings, nearest) * ratio * ratio * ratio
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// observeProofTiming updates the proof timings of this device with the time that the specified
+// proofs took. The elapsed time is divided over the proofs in proportion to their current
+// estimates, and the estimate of each key size involved is moved towards what it took.
+func (client *Client) observeProofTiming(costs []proofCost, elapsed time.Duration) {
+	if len(costs) == 0 || elapsed <= 0 {
+		return
+	}
+	client.proofTimingsMutex.Lock()
+	defer client.proofTimingsMutex.Unlock()
+
+	current := client.loadProofTimings()
+	var expected float64
+	for _, cost := range costs {
+		expected += proofTiming(current, cost.keySize)
+	}
+	ratio := float64(elapsed.Microseconds()) / 1000 / expected
+
+	timings := make(map[int]float64, len(current)+1)
+	for size, t := range current {
+		timings[size] = t
+	}
+	for _, cost := range costs {
+		t := proofTiming(current, cost.keySize)
+		timings[cost.keySize] = (1-proofTimingWeight)*t + proofTimingWeight*ratio*t
+	}
+	client.proofTimingsCache = timings
+	err := client.storage.Transaction(func(tx *transaction) error {
+		return client.storage.txStore(tx, userdataBucket, proofTimingsKey, timings)
+	})
+	if err != nil {
+		irma.Logger.Warn("failed to store proof timings: ", err)
+	}
+}
+
+// estimateResponse estimates the response to the request as shown to the user, for the first
+// candidate that can be chosen of each disjunction, or returns nil if that fails.
+func (session *session) estimateResponse(request irma.SessionRequest, candidates [][]DisclosureCandidates) *ResponseEstimate {
+	choice := &irma.DisclosureChoice{Attributes: [][]*irma.AttributeIdentifier{}}
+	for _, discon := range candidates {
+		for _, candidate := range discon {
+			if ids, err := candidate.Choose(); err == nil {
+				choice.Attributes = append(choice.Attributes, ids)
+				break
+			}
+		}
+	}
+	choice.Attributes = append(choice.Attributes, session.implicitDisclosure...)
+	estimate, err := session.client.EstimateResponse(request, choice)
+	if err != nil {
+		irma.Logger.Warn("failed to estimate response: ", err)
+		return nil
+	}
+	return estimate
+}
+
+// observeProofTiming updates the proof timings of this device with the time that computing the
+// response of the session took since start.
+func (session *session) observeProofTiming(start time.Time) {
+	elapsed := time.Since(start)
+	costs, err := session.client.proofCosts(session.request, session.choice)
+	if err != nil {
+		irma.Logger.Warn("failed to update proof timings: ", err)
+		return
+	}
+	session.client.observeProofTiming(costs, elapsed)
+}
@@ -0,0 +1,160 @@
+package irmaclient
+
+import (
+	"sync"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// Event is a change to the client's state, passed to subscribers (see Client.Subscribe)
+// after the change has been committed to storage.
+type Event interface {
+	event()
+}
+
+// CredentialAdded is emitted when a credential has been stored, e.g. after issuance.
+type CredentialAdded struct {
+	Info *irma.CredentialInfo
+}
+
+// CredentialRemoved is emitted when a credential has been deleted, either by the user
+// or because it was replaced by a newly issued credential.
+type CredentialRemoved struct {
+	ID irma.CredentialIdentifier
+}
+
+// CredentialsReplaced is emitted when (part of) the credential store has been replaced
+// at once, e.g. after RemoveStorage or KeyshareRemove. Subscribers should reload all credentials.
+type CredentialsReplaced struct{}
+
+// CredentialQuarantined is emitted when no proof could be built with a credential, e.g. because
+// its stored signature is corrupted, after which it is no longer offered as candidate, see
+// Client.QuarantinedCredentials.
+type CredentialQuarantined struct {
+	ID    irma.CredentialIdentifier
+	Error string
+}
+
+// KeyshareEnrolled is emitted when enrollment at the keyshare server of a scheme has succeeded.
+type KeyshareEnrolled struct {
+	SchemeManager irma.SchemeManagerIdentifier
+}
+
+// KeyshareEmailVerified is emitted when the keyshare server of a scheme, whose email verification
+// was pending, turns out to be usable, see Client.KeyshareEnrollmentState.
+type KeyshareEmailVerified struct {
+	SchemeManager irma.SchemeManagerIdentifier
+}
+
+// LogAppended is emitted when a log entry has been stored.
+type LogAppended struct {
+	Entry *LogEntry
+}
+
+// LogsPruned is emitted when log entries have been removed according to the log retention,
+// see Client.SetLogRetention.
+type LogsPruned struct {
+	IDs []uint64
+}
+
+// SchemeUpdated is emitted when parts of the schemes have been downloaded or removed.
+type SchemeUpdated struct {
+	Identifiers *irma.IrmaIdentifierSet
+}
+
+func (CredentialAdded) event()       {}
+func (CredentialRemoved) event()     {}
+func (CredentialsReplaced) event()   {}
+func (CredentialQuarantined) event() {}
+func (KeyshareEnrolled) event()      {}
+func (KeyshareEmailVerified) event() {}
+func (LogAppended) event()           {}
+func (LogsPruned) event()            {}
+func (SchemeUpdated) event()         {}
+
+// Subscription receives the events of a client, see Client.Subscribe.
+type Subscription struct {
+	events chan Event
+	subs   *subscriptions
+
+	mutex   sync.Mutex // serializes emitters, so that dropping the oldest event is safe
+	dropped int
+}
+
+// Events returns the channel on which events are delivered. It is closed by Unsubscribe.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns how many events were dropped because the buffer was full.
+func (s *Subscription) Dropped() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+// Unsubscribe stops the delivery of events and closes the events channel.
+func (s *Subscription) Unsubscribe() {
+	s.subs.mutex.Lock()
+	_, ok := s.subs.subscriptions[s]
+	delete(s.subs.subscriptions, s)
+	s.subs.mutex.Unlock()
+
+	if ok {
+		s.mutex.Lock()
+		close(s.events)
+		s.mutex.Unlock()
+	}
+}
+
+func (s *Subscription) deliver(e Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		select {
+		case s.events <- e:
+			return
+		default:
+		}
+		// Buffer full: drop the oldest event to make room
+		select {
+		case <-s.events:
+			s.dropped++
+		default:
+		}
+	}
+}
+
+type subscriptions struct {
+	mutex         sync.Mutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// Subscribe returns a Subscription that receives all subsequent events of the client. Events are
+// buffered up to the specified amount; delivery never blocks the client, so when the buffer is full
+// the oldest event is dropped.
+func (client *Client) Subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	s := &Subscription{events: make(chan Event, buffer), subs: &client.subscriptions}
+
+	client.subscriptions.mutex.Lock()
+	defer client.subscriptions.mutex.Unlock()
+	if client.subscriptions.subscriptions == nil {
+		client.subscriptions.subscriptions = map[*Subscription]struct{}{}
+	}
+	client.subscriptions.subscriptions[s] = struct{}{}
+	return s
+}
+
+// emit delivers the event to all subscriptions. It must only be called after the change
+// that the event describes has been committed to storage.
+func (client *Client) emit(e Event) {
+	client.invalidateStatistics(e)
+	client.subscriptions.mutex.Lock()
+	defer client.subscriptions.mutex.Unlock()
+	for s := range client.subscriptions.subscriptions {
+		s.deliver(e)
+	}
+}
@@ -0,0 +1,77 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// SessionExpiryHandler can optionally be implemented by a Handler, to be warned when the session
+// is about to expire at the server while the user has not yet given permission, so that the app
+// can urge the user to hurry. This requires the server to report the lifetime of the session,
+// see irma.ClientSessionRequest.Lifetime.
+type SessionExpiryHandler interface {
+	// SessionExpiring is called once, when the session expires within the specified amount of seconds.
+	SessionExpiring(remaining int)
+}
+
+// sessionExpiryWarning is how long before the session expires SessionExpiryHandler is called.
+const sessionExpiryWarning = 30 * time.Second
+
+// errSessionExpired is the cause of the irma.ErrorSessionExpired failures of sessions.
+var errSessionExpired = errors.New("session expired at the server")
+
+// startCountdown starts counting down the lifetime in seconds of the session as reported by the
+// server, if any. When the session is about to expire the handler is warned, and when it has
+// expired while the user is still being asked for permission, the session fails with
+// irma.ErrorSessionExpired. The countdown stops when the session finishes.
+func (session *session) startCountdown(lifetime int) {
+	if lifetime <= 0 {
+		return
+	}
+	session.expires = time.Now().Add(time.Duration(lifetime) * time.Second)
+
+	warning := time.NewTimer(time.Until(session.expires.Add(-sessionExpiryWarning)))
+	expiry := time.NewTimer(time.Until(session.expires))
+	go func() {
+		defer warning.Stop()
+		defer expiry.Stop()
+		for {
+			select {
+			case <-session.ctx.Done():
+				return
+			case <-warning.C:
+				if h, ok := session.Handler.(SessionExpiryHandler); ok && !session.finished() {
+					remaining := session.remaining()
+					session.dispatch(func() { h.SessionExpiring(remaining) })
+				}
+			case <-expiry.C:
+				session.statusMutex.Lock()
+				asking := session.status == irma.ClientStatusConnected
+				session.statusMutex.Unlock()
+				// Once the user has given permission, the session fails just before sending the
+				// response, so that we do not abort a response that the server may still accept.
+				if asking {
+					session.fail(&irma.SessionError{ErrorType: irma.ErrorSessionExpired, Err: errSessionExpired})
+				}
+				return
+			}
+		}
+	}()
+}
+
+// remaining returns the amount of seconds until the session expires at the server.
+func (session *session) remaining() int {
+	remaining := time.Until(session.expires).Round(time.Second)
+	if remaining < 0 {
+		return 0
+	}
+	return int(remaining / time.Second)
+}
+
+// expired returns whether the session has expired at the server, so that the server would
+// reject our response.
+func (session *session) expired() bool {
+	return !session.expires.IsZero() && !time.Now().Before(session.expires)
+}
@@ -0,0 +1,179 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the fallback to other credentials when no proof can be built with a chosen
+// credential, e.g. because its stored signature is corrupted. The credential is quarantined: until
+// the client is restarted, it is not offered as candidate anymore. At startup, recoverCredentials
+// removes credentials whose signature is missing or invalid.
+
+// credentialBuildError is an error building a proof with the specified credential.
+type credentialBuildError struct {
+	cred irma.CredentialIdentifier
+	err  error
+}
+
+func (e *credentialBuildError) Error() string { return e.err.Error() }
+
+func (e *credentialBuildError) Unwrap() error { return e.err }
+
+// QuarantinedCredentials returns the credentials with which no proof could be built since the
+// client was started, which are not offered as candidates, see CredentialQuarantined.
+func (client *Client) QuarantinedCredentials() []irma.CredentialIdentifier {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+	ids := make([]irma.CredentialIdentifier, 0, len(client.quarantined))
+	for _, id := range client.quarantined {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// quarantineCredential marks the credential as unusable, so that it is no longer offered as
+// candidate.
+func (client *Client) quarantineCredential(id irma.CredentialIdentifier, err error) {
+	client.credMutex.Lock()
+	_, known := client.quarantined[id.Hash]
+	if !known {
+		if client.quarantined == nil {
+			client.quarantined = map[string]irma.CredentialIdentifier{}
+		}
+		client.quarantined[id.Hash] = id
+	}
+	client.credMutex.Unlock()
+	if known {
+		return
+	}
+
+	irma.Logger.Warnf("quarantining credential %s, failed to build proof: %s", id.Type, err)
+	client.emit(CredentialQuarantined{ID: id, Error: err.Error()})
+}
+
+// buildWithFallback runs build, which builds the proofs of the session for session.choice. If that
+// fails because of one of the chosen credentials, the credential is quarantined and build is run
+// again with a choice in which other credentials take its place, if possible.
+func (session *session) buildWithFallback(build func() error) error {
+	for {
+		err := build()
+		var berr *credentialBuildError
+		if err == nil || !errors.As(err, &berr) {
+			return err
+		}
+		session.client.quarantineCredential(berr.cred, berr.err)
+		choice := session.client.fallbackChoice(session.request, session.choice, berr.cred)
+		if choice == nil {
+			return err
+		}
+		irma.Logger.Infof("retrying to build proofs without credential %s", berr.cred.Type)
+		session.choice = choice
+	}
+}
+
+// fallbackChoice returns a copy of the choice in which the attributes of the failed credential
+// are taken from other credentials, or nil if that is not possible for all disjunctions from
+// which they were chosen. So as not to disclose anything that the user did not consent to, the
+// attributes must be of the same types and have the same values.
+func (client *Client) fallbackChoice(request irma.SessionRequest, choice *irma.DisclosureChoice, failed irma.CredentialIdentifier,
+) *irma.DisclosureChoice {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	disclose := request.Disclosure().Disclose
+	fallback := &irma.DisclosureChoice{
+		Attributes:          make([][]*irma.AttributeIdentifier, len(choice.Attributes)),
+		DeclinedCredentials: choice.DeclinedCredentials,
+	}
+	replaced := false
+	for i, attrs := range choice.Attributes {
+		fallback.Attributes[i] = attrs
+		if !containsCredential(attrs, failed) {
+			continue
+		}
+		// Attributes beyond the disjunctions of the request were disclosed earlier in a chain of
+		// sessions, and must be disclosed again from the same credential
+		if i >= len(disclose) {
+			return nil
+		}
+		alternative := client.alternativeAttributes(request, disclose[i], attrs)
+		if alternative == nil {
+			return nil
+		}
+		fallback.Attributes[i] = alternative
+		replaced = true
+	}
+	if !replaced {
+		return nil
+	}
+	return fallback
+}
+
+func containsCredential(attrs []*irma.AttributeIdentifier, cred irma.CredentialIdentifier) bool {
+	for _, attr := range attrs {
+		if attr.CredentialHash == cred.Hash {
+			return true
+		}
+	}
+	return false
+}
+
+// alternativeAttributes returns usable attributes satisfying the disjunction that are of the same
+// types and have the same values as attrs, in the same order, or nil if there are none.
+func (client *Client) alternativeAttributes(request irma.SessionRequest, discon irma.AttributeDisCon, attrs []*irma.AttributeIdentifier,
+) []*irma.AttributeIdentifier {
+	candidates, _, err := client.candidatesDisCon(request, discon)
+	if err != nil {
+		return nil
+	}
+
+	for _, set := range candidates {
+		if len(set) != len(attrs) {
+			continue
+		}
+		alternative := make([]*irma.AttributeIdentifier, 0, len(attrs))
+		used := map[*DisclosureCandidate]struct{}{}
+		for _, attr := range attrs {
+			for _, candidate := range set {
+				if _, ok := used[candidate]; ok || candidate.Type != attr.Type || !client.usableCandidate(candidate) {
+					continue
+				}
+				if !equalValues(client.attributeValue(candidate.AttributeIdentifier), client.attributeValue(attr)) {
+					continue
+				}
+				used[candidate] = struct{}{}
+				alternative = append(alternative, candidate.AttributeIdentifier)
+				break
+			}
+		}
+		if len(alternative) == len(attrs) {
+			return alternative
+		}
+	}
+	return nil
+}
+
+func (client *Client) usableCandidate(candidate *DisclosureCandidate) bool {
+	return candidate.CredentialHash != "" && !candidate.Expired && !candidate.Revoked && !candidate.NotRevokable
+}
+
+// attributeValue returns the value of the attribute in our credential, or nil if it is a
+// credential type (of which only the metadata is disclosed) or if we do not have it.
+func (client *Client) attributeValue(attr *irma.AttributeIdentifier) *string {
+	if attr.Type.IsCredential() {
+		return nil
+	}
+	attrs, _ := client.attributesByHash(attr.CredentialHash)
+	if attrs == nil {
+		return nil
+	}
+	return attrs.UntranslatedAttribute(attr.Type)
+}
+
+func equalValues(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,196 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the garbage collection of the storage. Interrupted operations of older
+// versions and removed schemes may leave behind stored data that nothing refers to anymore:
+// signatures of credentials whose attributes are gone, nicknames of removed credentials, keyshare
+// enrollments of schemes that are no longer installed, and keys of attribute entries that no
+// longer exist. GarbageCollect removes these, and is run automatically when the client starts, at
+// most once per garbageCollectInterval.
+//
+// What is referenced is determined within the same transaction as the removal, from the stored
+// attributes: as credentials are stored together with their signature in one transaction, a
+// credential that is being stored by a session is either seen together with its signature, or
+// not at all. Responses of sessions that are awaiting a retry are kept in memory only (see
+// responseretry.go), so there are no stored records of sessions in progress to be collected.
+
+// garbageCollectInterval is the minimum time between automatic garbage collections.
+var garbageCollectInterval = 24 * time.Hour
+
+// garbageCollectedKey is the key in the userdata bucket of the time of the last garbage
+// collection; value: irma.Timestamp.
+const garbageCollectedKey = "garbageCollected"
+
+// GarbageCollectionReport describes what GarbageCollect removed.
+type GarbageCollectionReport struct {
+	// Signatures is the number of signatures that belonged to no credential.
+	Signatures int `json:"signatures,omitempty"`
+	// Nicknames is the number of nicknames of credentials that no longer exist.
+	Nicknames int `json:"nicknames,omitempty"`
+	// KeyshareEnrollments contains the schemes that are not installed anymore of which the
+	// keyshare enrollment was removed.
+	KeyshareEnrollments []irma.SchemeManagerIdentifier `json:"keyshareEnrollments,omitempty"`
+	// CredentialTypeKeys is the number of storage keys of credential types without stored
+	// attributes.
+	CredentialTypeKeys int `json:"credentialTypeKeys,omitempty"`
+}
+
+// Empty returns whether nothing was removed.
+func (r *GarbageCollectionReport) Empty() bool {
+	return r.Signatures == 0 && r.Nicknames == 0 && len(r.KeyshareEnrollments) == 0 && r.CredentialTypeKeys == 0
+}
+
+// GarbageCollect removes stored data that is not referenced by any credential or installed
+// scheme, in a single transaction, and reports what it removed.
+func (client *Client) GarbageCollect() (*GarbageCollectionReport, error) {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	report := &GarbageCollectionReport{}
+	var nicknames map[string]string
+	var ksses map[irma.SchemeManagerIdentifier]*keyshareServer
+	err := client.storage.Transaction(func(tx *transaction) error {
+		report = &GarbageCollectionReport{}
+		hashes, keys, err := client.storage.txReferencedCredentials(tx)
+		if err != nil {
+			return err
+		}
+
+		// Signatures
+		if b := tx.Bucket([]byte(signaturesBucket)); b != nil {
+			var orphans [][]byte
+			if err = b.ForEach(func(key, _ []byte) error {
+				if !hashes[string(key)] {
+					orphans = append(orphans, append([]byte(nil), key...))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, key := range orphans {
+				if err = b.Delete(key); err != nil {
+					return err
+				}
+			}
+			report.Signatures = len(orphans)
+		}
+
+		// Nicknames
+		nicknames = map[string]string{}
+		if _, err = client.storage.txLoad(tx, userdataBucket, nicknamesKey, &nicknames); err != nil {
+			return err
+		}
+		for hash := range nicknames {
+			if !hashes[hash] {
+				delete(nicknames, hash)
+				report.Nicknames++
+			}
+		}
+		if report.Nicknames > 0 {
+			if err = client.storage.TxStoreNicknames(tx, nicknames); err != nil {
+				return err
+			}
+		}
+
+		// Keyshare enrollments
+		ksses = map[irma.SchemeManagerIdentifier]*keyshareServer{}
+		if _, err = client.storage.txLoad(tx, userdataBucket, kssKey, &ksses); err != nil {
+			return err
+		}
+		for schemeID := range ksses {
+			if _, installed := client.Configuration.SchemeManagers[schemeID]; !installed {
+				delete(ksses, schemeID)
+				report.KeyshareEnrollments = append(report.KeyshareEnrollments, schemeID)
+			}
+		}
+		if len(report.KeyshareEnrollments) > 0 {
+			if err = client.storage.TxStoreKeyshareServers(tx, ksses); err != nil {
+				return err
+			}
+		}
+
+		// Keys of credential types
+		credTypeKeys := map[irma.CredentialTypeIdentifier][]byte{}
+		if _, err = client.storage.txLoad(tx, userdataBucket, credTypeKeysKey, &credTypeKeys); err != nil {
+			return err
+		}
+		for credTypeID, key := range credTypeKeys {
+			if !keys[string(key)] {
+				delete(credTypeKeys, credTypeID)
+				report.CredentialTypeKeys++
+			}
+		}
+		if report.CredentialTypeKeys > 0 {
+			if err = client.storage.txStore(tx, userdataBucket, credTypeKeysKey, credTypeKeys); err != nil {
+				return err
+			}
+		}
+
+		now := irma.Timestamp(time.Now())
+		return client.storage.txStore(tx, userdataBucket, garbageCollectedKey, &now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Nicknames > 0 {
+		client.nicknames = nicknames
+	}
+	for _, schemeID := range report.KeyshareEnrollments {
+		delete(client.keyshareServers, schemeID)
+	}
+	if !report.Empty() {
+		irma.Logger.Infof("garbage collection: removed %d signatures, %d nicknames, %d keyshare enrollments, %d credential type keys",
+			report.Signatures, report.Nicknames, len(report.KeyshareEnrollments), report.CredentialTypeKeys)
+	}
+	return report, nil
+}
+
+// txReferencedCredentials returns the hashes of the stored credentials, and the keys of the
+// entries in the attributes bucket.
+func (s *storage) txReferencedCredentials(tx *transaction) (hashes, keys map[string]bool, err error) {
+	hashes, keys = map[string]bool{}, map[string]bool{}
+	b := tx.Bucket([]byte(attributesBucket))
+	if b == nil {
+		return
+	}
+	err = b.ForEach(func(key, value []byte) error {
+		keys[string(key)] = true
+		plaintext, err := s.decrypt(value)
+		if err != nil {
+			return err
+		}
+		var attrlistlist []*irma.AttributeList
+		if err = json.Unmarshal(plaintext, &attrlistlist); err != nil {
+			return err
+		}
+		for _, attrlist := range attrlistlist {
+			hashes[attrlist.Hash()] = true
+		}
+		return nil
+	})
+	return
+}
+
+// garbageCollectIfDue runs GarbageCollect if the last garbage collection was longer than
+// garbageCollectInterval ago. Failures are reported but not fatal.
+func (client *Client) garbageCollectIfDue() {
+	var last irma.Timestamp
+	found, err := client.storage.load(userdataBucket, garbageCollectedKey, &last)
+	if err != nil {
+		client.reportError(err)
+		return
+	}
+	if found && time.Since(time.Time(last)) < garbageCollectInterval {
+		return
+	}
+	if _, err = client.GarbageCollect(); err != nil {
+		client.reportError(err)
+	}
+}
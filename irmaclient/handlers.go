@@ -5,6 +5,48 @@ import (
 	irma "github.com/privacybydesign/irmago"
 )
 
+// HandlerBase implements the Handler interface with default behaviour: status updates and other
+// notifications are ignored, requests for permission, PIN or unlocking are declined, and
+// failures are logged. Embed it in a Handler implementation to only implement the methods of
+// interest, and so that methods added to Handler in the future do not break the implementation.
+type HandlerBase struct{}
+
+// Force HandlerBase to implement the Handler interface
+var _ Handler = HandlerBase{}
+
+func (HandlerBase) StatusUpdate(action irma.Action, status irma.ClientStatus) {}
+func (HandlerBase) ClientReturnURLSet(clientReturnURL string)                 {}
+func (HandlerBase) PairingRequired(pairingCode string)                        {}
+func (HandlerBase) Success(result string)                                     {}
+func (HandlerBase) Cancelled()                                                {}
+func (HandlerBase) Failure(err *irma.SessionError) {
+	irma.Logger.Warn("Session failed: ", err.Error())
+}
+func (HandlerBase) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int)    {}
+func (HandlerBase) KeysharePinBackoff(manager irma.SchemeManagerIdentifier, duration int) {}
+func (HandlerBase) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier)     {}
+func (HandlerBase) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier)        {}
+func (HandlerBase) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier)        {}
+func (HandlerBase) RequestIssuancePermission(request *irma.IssuanceRequest, satisfiable bool, candidates [][]DisclosureCandidates, requestorInfo *irma.RequestorInfo, callback PermissionHandler) {
+	callback(false, nil)
+}
+func (HandlerBase) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool, candidates [][]DisclosureCandidates, requestorInfo *irma.RequestorInfo, callback PermissionHandler) {
+	callback(false, nil)
+}
+func (HandlerBase) RequestSignaturePermission(request *irma.SignatureRequest, satisfiable bool, candidates [][]DisclosureCandidates, requestorInfo *irma.RequestorInfo, callback PermissionHandler) {
+	callback(false, nil)
+}
+func (HandlerBase) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	callback(false)
+}
+func (HandlerBase) RequestPin(metadata PinMetadata, proceed func(pin string), cancel func()) {
+	cancel()
+}
+func (HandlerBase) RequestUnlock(callback func(proceed bool)) {
+	callback(false)
+}
+func (HandlerBase) Unsatisfiable(request *UnsatisfiableRequest) {}
+
 // keyshareEnrollmentHandler handles the keyshare attribute issuance session
 // after registering to a new keyshare server.
 type keyshareEnrollmentHandler struct {
@@ -29,17 +71,20 @@ func (h *keyshareEnrollmentHandler) RequestIssuancePermission(request *irma.Issu
 	callback(true, nil)
 }
 
-func (h *keyshareEnrollmentHandler) RequestPin(remainingAttempts int, callback PinHandler) {
-	if remainingAttempts == -1 { // -1 signifies that this is the first attempt
-		callback(true, h.pin)
+func (h *keyshareEnrollmentHandler) RequestPin(metadata PinMetadata, proceed func(pin string), cancel func()) {
+	if !metadata.Retry {
+		proceed(h.pin)
 	} else {
 		h.fail(errors.New("PIN incorrect"))
 	}
 }
 
 func (h *keyshareEnrollmentHandler) Success(result string) {
-	_ = h.client.storage.StoreKeyshareServers(h.client.keyshareServers) // TODO handle err?
+	err := h.client.storage.StoreKeyshareServers(h.client.keyshareServers) // TODO handle err?
 	h.client.handler.EnrollmentSuccess(h.kss.SchemeManagerIdentifier)
+	if err == nil {
+		h.client.emit(KeyshareEnrolled{SchemeManager: h.kss.SchemeManagerIdentifier})
+	}
 }
 
 func (h *keyshareEnrollmentHandler) Failure(err *irma.SessionError) {
@@ -54,6 +99,7 @@ func (h *keyshareEnrollmentHandler) fail(err error) {
 
 // Not interested, ingore
 func (h *keyshareEnrollmentHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {}
+func (h *keyshareEnrollmentHandler) Unsatisfiable(request *UnsatisfiableRequest)               {}
 
 // The methods below should never be called, so we let each of them fail the session
 func (h *keyshareEnrollmentHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool, candidates [][]DisclosureCandidates, ServerName *irma.RequestorInfo, callback PermissionHandler) {
@@ -65,12 +111,18 @@ func (h *keyshareEnrollmentHandler) RequestSignaturePermission(request *irma.Sig
 func (h *keyshareEnrollmentHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
 	callback(false)
 }
+func (h *keyshareEnrollmentHandler) RequestUnlock(callback func(proceed bool)) {
+	callback(false)
+}
 func (h *keyshareEnrollmentHandler) Cancelled() {
 	h.fail(errors.New("Keyshare enrollment session unexpectedly cancelled"))
 }
 func (h *keyshareEnrollmentHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
 	h.fail(errors.New("Keyshare enrollment failed: blocked"))
 }
+func (h *keyshareEnrollmentHandler) KeysharePinBackoff(manager irma.SchemeManagerIdentifier, duration int) {
+	h.fail(errors.New("Keyshare enrollment failed: PIN backoff"))
+}
 func (h *keyshareEnrollmentHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
 	h.fail(errors.New("Keyshare enrollment failed: registration incomplete"))
 }
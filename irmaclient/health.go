@@ -0,0 +1,263 @@
+package irmaclient
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains HealthCheck, a self-test of the client for support purposes. Its report
+// describes the state of the client without containing any attribute values, so that it can be
+// attached to support tickets.
+
+// defaultHealthCheckTimeout is the time limit of HealthCheck if none is specified.
+const defaultHealthCheckTimeout = 10 * time.Second
+
+// HealthReport is the result of Client.HealthCheck.
+type HealthReport struct {
+	Time time.Time `json:"time"`
+	// Complete is false if the time limit passed before all checks were done; what was not
+	// checked is reported as such, e.g. in CredentialHealth.Unchecked.
+	Complete bool `json:"complete"`
+
+	Storage     StorageHealth    `json:"storage"`
+	SecretKey   SecretKeyHealth  `json:"secretKey"`
+	Credentials CredentialHealth `json:"credentials"`
+	Schemes     []SchemeHealth   `json:"schemes"`
+	Clock       ClockHealth      `json:"clock"`
+}
+
+// StorageHealth describes the storage of the client.
+type StorageHealth struct {
+	// InMemory is set for clients created with NewMemoryClient.
+	InMemory bool `json:"inMemory,omitempty"`
+	// Readable is set if the stored data can be read and decrypted.
+	Readable bool   `json:"readable"`
+	Error    string `json:"error,omitempty"`
+	// SchemaVersion is the number of storage updates that were run (see updates.go), and
+	// LatestSchemaVersion the number of updates that this version of the client knows.
+	SchemaVersion       int   `json:"schemaVersion"`
+	LatestSchemaVersion int   `json:"latestSchemaVersion"`
+	FailedUpdates       []int `json:"failedUpdates,omitempty"`
+	// Recovered is set if the storage was recovered from corruption at startup,
+	// see StorageRecovery.
+	Recovered bool `json:"recovered,omitempty"`
+	// LogIntegrityError is the error that VerifyLogIntegrity reports, if any.
+	LogIntegrityError string `json:"logIntegrityError,omitempty"`
+}
+
+// SecretKeyHealth describes the secret key of the client.
+type SecretKeyHealth struct {
+	Present bool   `json:"present"`
+	Locked  bool   `json:"locked,omitempty"` // see Client.Lock
+	Error   string `json:"error,omitempty"`
+}
+
+// CredentialHealth contains the results of verifying the signatures of all credentials.
+type CredentialHealth struct {
+	Count    int `json:"count"`
+	Verified int `json:"verified"`
+	// Invalid contains the type of each credential whose signature is missing or does not verify.
+	Invalid []irma.CredentialTypeIdentifier `json:"invalid,omitempty"`
+	// UnknownPublicKey is the number of credentials whose credential type or public key is not
+	// known, which therefore could not be verified.
+	UnknownPublicKey int `json:"unknownPublicKey,omitempty"`
+	// Unchecked is the number of credentials that were not verified, because the client is
+	// locked or because the time limit passed.
+	Unchecked int `json:"unchecked,omitempty"`
+}
+
+// SchemeHealth describes a scheme of the configuration and the keyshare enrollment of the client
+// at its keyshare server, if it has one.
+type SchemeHealth struct {
+	ID     irma.SchemeManagerIdentifier `json:"id"`
+	Status irma.SchemeManagerStatus     `json:"status"`
+	// Error is the problem that occurred when parsing or verifying the scheme, if any, in which
+	// case the scheme is disabled.
+	Error string `json:"error,omitempty"`
+	// Timestamp is the time at which the scheme was last changed by its maintainer.
+	Timestamp *irma.Timestamp `json:"timestamp,omitempty"`
+
+	Keyshare                 bool `json:"keyshare,omitempty"` // the scheme has a keyshare server
+	Enrolled                 bool `json:"enrolled,omitempty"`
+	PinBlocked               bool `json:"pinBlocked,omitempty"`
+	PinOutOfSync             bool `json:"pinOutOfSync,omitempty"`
+	PendingEmailVerification bool `json:"pendingEmailVerification,omitempty"`
+}
+
+// ClockHealth compares the time of the device with that of the server of a scheme.
+type ClockHealth struct {
+	Server     string    `json:"server,omitempty"`
+	DeviceTime time.Time `json:"deviceTime"`
+	ServerTime time.Time `json:"serverTime"`
+	// Skew is the amount of time that the device is ahead of the server, which may be off by
+	// the duration of the request.
+	Skew  time.Duration `json:"skew"`
+	Error string        `json:"error,omitempty"`
+}
+
+// HealthCheck performs a self-test of the client, returning a report that can be included in
+// support tickets, as it contains no attribute values. It completes within the specified time
+// limit, which is 10 seconds if zero; anything not checked by then is reported as unchecked.
+// The clock is checked by contacting the server of a scheme.
+func (client *Client) HealthCheck(timeout time.Duration) *HealthReport {
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	report := &HealthReport{Time: time.Now()}
+
+	report.Storage = client.storageHealth()
+	report.SecretKey.Present = client.secretKey() != nil || client.transientSecretKey()
+	report.SecretKey.Locked = client.Locked()
+	report.Credentials, report.SecretKey.Error = client.credentialHealth(deadline)
+	report.Schemes = client.schemeHealth()
+	report.Clock = client.clockHealth(deadline)
+
+	report.Complete = report.Credentials.Unchecked == 0 && time.Now().Before(deadline)
+	return report
+}
+
+func (client *Client) storageHealth() StorageHealth {
+	health := StorageHealth{
+		InMemory:            client.storage.storagePath == "",
+		SchemaVersion:       len(client.updates),
+		LatestSchemaVersion: len(clientUpdates),
+		Recovered:           client.StorageRecovery() != nil,
+	}
+	for _, u := range client.updates {
+		if !u.Success {
+			health.FailedUpdates = append(health.FailedUpdates, u.Number)
+		}
+	}
+
+	err := client.storage.view(func(tx dbTx) error {
+		health.Readable = client.storage.txDecryptable(&transaction{tx})
+		return nil
+	})
+	if err != nil {
+		health.Readable = false
+		health.Error = err.Error()
+	}
+	if err = client.VerifyLogIntegrity(); err != nil {
+		health.LogIntegrityError = err.Error()
+	}
+	return health
+}
+
+// credentialHealth verifies the signatures of the credentials until the deadline, returning the
+// error that occurred when obtaining the secret key for this, if any.
+func (client *Client) credentialHealth(deadline time.Time) (CredentialHealth, string) {
+	client.credMutex.Lock()
+	var creds []*irma.AttributeList
+	for _, attrlistlist := range client.attributes {
+		creds = append(creds, attrlistlist...)
+	}
+	client.credMutex.Unlock()
+
+	health := CredentialHealth{Count: len(creds), Unchecked: len(creds)}
+	if len(creds) == 0 {
+		return health, ""
+	}
+	release, err := client.holdSecretKey()
+	if err == ErrLocked {
+		return health, ""
+	}
+	if err != nil {
+		return health, err.Error()
+	}
+	defer release()
+
+	for _, attrs := range creds {
+		if !time.Now().Before(deadline) {
+			break
+		}
+		health.Unchecked--
+		if attrs.CredentialType() == nil {
+			health.UnknownPublicKey++
+			continue
+		}
+		if pk, err := attrs.PublicKey(); err != nil || pk == nil {
+			health.UnknownPublicKey++
+			continue
+		}
+		if valid, _ := client.validCredential(attrs); valid {
+			health.Verified++
+		} else {
+			health.Invalid = append(health.Invalid, attrs.CredentialType().Identifier())
+		}
+	}
+	return health, ""
+}
+
+func (client *Client) schemeHealth() []SchemeHealth {
+	conf := client.Configuration
+	var schemes []SchemeHealth
+	for id, scheme := range conf.SchemeManagers {
+		timestamp := scheme.Timestamp
+		health := SchemeHealth{
+			ID:        id,
+			Status:    scheme.Status,
+			Timestamp: &timestamp,
+			Keyshare:  scheme.Distributed(),
+		}
+		if kss, ok := client.keyshareServers[id]; ok {
+			health.Enrolled = true
+			health.PinBlocked = kss.PinBlockedUntil > time.Now().Unix()
+			health.PinOutOfSync = kss.PinOutOfSync
+			health.PendingEmailVerification = kss.PendingEmailVerification
+		}
+		if serr, ok := conf.DisabledSchemeManagers[id]; ok {
+			health.Error = serr.Error()
+		}
+		schemes = append(schemes, health)
+	}
+	for id, serr := range conf.DisabledSchemeManagers {
+		if _, ok := conf.SchemeManagers[id]; ok {
+			continue
+		}
+		schemes = append(schemes, SchemeHealth{ID: id, Status: serr.Status, Error: serr.Error()})
+	}
+	sort.Slice(schemes, func(i, j int) bool { return schemes[i].ID.String() < schemes[j].ID.String() })
+	return schemes
+}
+
+// clockHealth compares the time of the device with that of the server of the first scheme,
+// in alphabetical order, that has one.
+func (client *Client) clockHealth(deadline time.Time) ClockHealth {
+	var ids []irma.SchemeManagerIdentifier
+	for id, scheme := range client.Configuration.SchemeManagers {
+		if scheme.URL != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ClockHealth{DeviceTime: time.Now(), Error: "no scheme server known"}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+	scheme := client.Configuration.SchemeManagers[ids[0]]
+	transport := client.newTransport(scheme.URL)
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return ClockHealth{Server: scheme.URL, DeviceTime: time.Now(), Error: "time limit exceeded"}
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	transport.SetContext(ctx)
+	transport.SetTimeout(remaining)
+	_, err := transport.GetBytes("timestamp")
+	health := ClockHealth{Server: scheme.URL, DeviceTime: time.Now(), ServerTime: transport.ServerDate()}
+	if health.ServerTime.IsZero() {
+		if err == nil {
+			health.Error = "server sent no date"
+		} else {
+			health.Error = err.Error()
+		}
+		return health
+	}
+	health.Skew = health.DeviceTime.Sub(health.ServerTime)
+	return health
+}
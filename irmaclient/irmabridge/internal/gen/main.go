@@ -0,0 +1,582 @@
+// Command gen generates irmabridge_gen.go from the API of irmaclient: the ClientHandler and
+// SessionHandler interfaces of irmabridge and the optional interfaces of the latter, together with
+// the adapters translating the callbacks of irmaclient to them, and the methods of
+// irmabridge.Client that wrap those of irmaclient.Client.
+// It is run by go generate in the irmabridge package, after changes to these parts of the
+// irmaclient API.
+//
+// Parameters and results are translated as follows:
+//   - strings, integers, booleans and byte slices are passed as is;
+//   - irma.SchemeManagerIdentifier, irma.Action and irma.ClientStatus are passed as strings;
+//   - errors are passed as an *irma.SessionError in JSON, see errorJson in irmabridge;
+//   - callback parameters of other types are passed in JSON, as are results of other types.
+//
+// Methods that cannot be translated this way, e.g. because they take callbacks, must be listed
+// in the manual fields of the specs below and implemented by hand in irmabridge.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// handlerSpec describes an interface of irmaclient whose callbacks irmabridge passes on to an
+// interface of the app.
+type handlerSpec struct {
+	// source is the interface in irmaclient, name its counterpart in irmabridge, and adapter the
+	// type in irmabridge implementing source, having handler and dispatcher fields.
+	source, name, adapter string
+	doc                   string
+	// manual are the methods of source that the adapter implements by hand.
+	manual []string
+	// extra are the methods of the interface in irmabridge through which the manual methods
+	// reach the app, including their doc comments.
+	extra []string
+	// optional is set if the app may leave the interface in irmabridge unimplemented, in which
+	// case the generated methods of the adapter drop the callbacks.
+	optional bool
+}
+
+var handlers = []handlerSpec{
+	{
+		source:  "ClientHandler",
+		name:    "ClientHandler",
+		adapter: "clientHandler",
+		doc:     "ClientHandler is the gomobile-compatible counterpart of irmaclient.ClientHandler.",
+	},
+	{
+		source:  "Handler",
+		name:    "SessionHandler",
+		adapter: "sessionHandler",
+		doc: `SessionHandler is the gomobile-compatible counterpart of irmaclient.Handler. Methods that
+request a decision from the user must be answered using the corresponding Respond method
+of the Session.`,
+		manual: []string{
+			"RequestIssuancePermission", "RequestVerificationPermission", "RequestSignaturePermission",
+			"RequestSchemeManagerPermission", "RequestPin", "RequestUnlock", "Unsatisfiable",
+		},
+		extra: []string{
+			`// RequestPermission receives a PermissionRequest in JSON; answer with Session.RespondPermission
+RequestPermission(permissionRequestJson string)`,
+			`// RequestSchemeManagerPermission receives the irma.SchemeManager in JSON;
+// answer with Session.RespondSchemeManagerPermission
+RequestSchemeManagerPermission(schemeJson string)`,
+			`// RequestPin receives the irmaclient.PinMetadata in JSON; answer with Session.RespondPin
+RequestPin(pinMetadataJson string)`,
+			`// RequestUnlock is answered with Session.RespondUnlock
+RequestUnlock()`,
+		},
+	},
+	{
+		source:  "SensitiveDisclosureHandler",
+		name:    "SensitiveDisclosureHandler",
+		adapter: "sessionHandler",
+		doc: `SensitiveDisclosureHandler can optionally be implemented by a SessionHandler, see
+irmaclient.SensitiveDisclosureHandler. If it is not, sessions in which sensitive attributes
+are chosen are cancelled.`,
+		manual: []string{"ConfirmSensitiveDisclosure"},
+		extra: []string{
+			`// ConfirmSensitiveDisclosure receives the sensitive []*irmaclient.DisclosureCandidate in JSON;
+// answer with Session.RespondSensitiveDisclosure
+ConfirmSensitiveDisclosure(attributesJson string)`,
+		},
+		optional: true,
+	},
+	{
+		source:  "RedirectHandler",
+		name:    "RedirectHandler",
+		adapter: "sessionHandler",
+		doc: `RedirectHandler can optionally be implemented by a SessionHandler, see
+irmaclient.RedirectHandler. If it is not, redirects to another origin are refused.`,
+		manual: []string{"ConfirmRedirect"},
+		extra: []string{
+			`// ConfirmRedirect is answered with Session.RespondRedirect
+ConfirmRedirect(from, to string)`,
+		},
+		optional: true,
+	},
+	{
+		source:   "SessionExpiryHandler",
+		name:     "SessionExpiryHandler",
+		adapter:  "sessionHandler",
+		doc:      "SessionExpiryHandler can optionally be implemented by a SessionHandler, see irmaclient.SessionExpiryHandler.",
+		optional: true,
+	},
+	{
+		source:  "KnownRequestorHandler",
+		name:    "KnownRequestorHandler",
+		adapter: "sessionHandler",
+		doc: `KnownRequestorHandler can optionally be implemented by a SessionHandler, see
+irmaclient.KnownRequestorHandler. If it is not, sessions continue when the server of a known
+requestor presents a different key, as in irmaclient.`,
+		manual: []string{"RequestorKeyChanged"},
+		extra: []string{
+			`// RequestorKeyChanged receives the irmaclient.KnownRequestor and irmaclient.RequestorKeyChange
+// in JSON; answer with Session.RespondRequestorKeyChange
+RequestorKeyChanged(requestorJson, changeJson string)`,
+		},
+		optional: true,
+	},
+}
+
+// clientMethods are the methods of irmaclient.Client that irmabridge.Client wraps without
+// further ado. The others are implemented by hand in irmabridge.
+var clientMethods = []string{
+	"CredentialInfoList",
+	"LoadNewestLogs",
+	"RemoveCredentialByHash",
+	"SetCredentialNickname",
+	"SearchAttributes",
+	"Statistics",
+	"KeysharePinStatus",
+	"KeyshareChangePin",
+	"Lock",
+	"Unlock",
+}
+
+// jsonNames are the names in irmabridge of parameters passed in JSON, if not the name in
+// irmaclient followed by Json.
+var jsonNames = map[string]string{
+	"new":  "identifiersJson",
+	"cred": "credentialJson",
+}
+
+func main() {
+	src := flag.String("src", "..", "directory of the irmaclient package")
+	out := flag.String("o", "irmabridge_gen.go", "output file")
+	flag.Parse()
+
+	bts, err := generate(*src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = ioutil.WriteFile(*out, bts, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// kind is the way in which a value is translated between irmaclient and irmabridge.
+type kind int
+
+const (
+	kindPlain kind = iota
+	kindScheme
+	kindString
+	kindError
+	kindJson
+)
+
+// param is a parameter of a method of irmaclient together with its counterpart in irmabridge.
+type param struct {
+	name, typ  string
+	bridgeName string
+	kind       kind
+}
+
+// bridgeType returns the type of the parameter in irmabridge.
+func (p param) bridgeType() string {
+	if p.kind == kindPlain {
+		return p.typ
+	}
+	return "string"
+}
+
+// toBridge returns the expression converting the parameter to its type in irmabridge, where
+// JSON has already been marshaled to a variable named after the parameter in irmabridge.
+func (p param) toBridge() string {
+	switch p.kind {
+	case kindScheme:
+		return p.name + ".String()"
+	case kindString:
+		return "string(" + p.name + ")"
+	case kindError:
+		return "errorJson(" + p.name + ")"
+	case kindJson:
+		return "string(" + p.bridgeName + ")"
+	default:
+		return p.name
+	}
+}
+
+// fromBridge returns the expression converting the parameter in irmabridge to its type in irmaclient.
+func (p param) fromBridge() (string, error) {
+	switch p.kind {
+	case kindPlain:
+		return p.bridgeName, nil
+	case kindScheme:
+		return "irma.NewSchemeManagerIdentifier(" + p.bridgeName + ")", nil
+	case kindString:
+		return p.typ + "(" + p.bridgeName + ")", nil
+	default:
+		return "", errors.Errorf("cannot pass %s of type %s from irmabridge", p.name, p.typ)
+	}
+}
+
+// generator holds the declarations of the irmaclient package.
+type generator struct {
+	interfaces map[string]*ast.InterfaceType
+	funcTypes  map[string]bool
+	methods    map[string]*ast.FuncDecl
+	buf        bytes.Buffer
+	json       bool
+}
+
+// generate parses the irmaclient package in the specified directory, and returns the contents
+// of irmabridge_gen.go.
+func generate(dir string) ([]byte, error) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := pkgs["irmaclient"]
+	if !ok {
+		return nil, errors.Errorf("no irmaclient package in %s", dir)
+	}
+
+	g := &generator{
+		interfaces: map[string]*ast.InterfaceType{},
+		funcTypes:  map[string]bool{},
+		methods:    map[string]*ast.FuncDecl{},
+	}
+	// Iterate over the files in a fixed order, so that the output does not depend on map order
+	var names []string
+	for name := range pkg.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, decl := range pkg.Files[name].Decls {
+			g.collect(decl)
+		}
+	}
+
+	var body bytes.Buffer
+	for _, spec := range handlers {
+		if err = g.handler(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range clientMethods {
+		if err = g.clientMethod(name); err != nil {
+			return nil, err
+		}
+	}
+
+	body.WriteString("// Code generated by go run ./internal/gen; DO NOT EDIT.\n\npackage irmabridge\n\nimport (\n")
+	if g.json {
+		body.WriteString("\"encoding/json\"\n\n")
+	}
+	body.WriteString("irma \"github.com/privacybydesign/irmago\"\n\"github.com/privacybydesign/irmago/irmaclient\"\n)\n")
+	body.Write(g.buf.Bytes())
+	return format.Source(body.Bytes())
+}
+
+// collect records the interfaces, function types and methods of Client among the declarations.
+func (g *generator) collect(decl ast.Decl) {
+	switch d := decl.(type) {
+	case *ast.GenDecl:
+		for _, s := range d.Specs {
+			spec, ok := s.(*ast.TypeSpec)
+			if !ok {
+				continue
+			}
+			switch t := spec.Type.(type) {
+			case *ast.InterfaceType:
+				g.interfaces[spec.Name.Name] = t
+			case *ast.FuncType:
+				g.funcTypes[spec.Name.Name] = true
+			}
+		}
+	case *ast.FuncDecl:
+		if d.Recv == nil || len(d.Recv.List) != 1 {
+			return
+		}
+		if star, ok := d.Recv.List[0].Type.(*ast.StarExpr); ok {
+			if ident, ok := star.X.(*ast.Ident); ok && ident.Name == "Client" && d.Name.IsExported() {
+				g.methods[d.Name.Name] = d
+			}
+		}
+	}
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// doc prints the text as a doc comment.
+func (g *generator) doc(text string) {
+	for _, line := range strings.Split(text, "\n") {
+		g.printf("// %s\n", line)
+	}
+}
+
+// interfaceMethods returns the methods of the interface, including those of embedded interfaces.
+func (g *generator) interfaceMethods(name string) ([]*ast.Field, error) {
+	iface, ok := g.interfaces[name]
+	if !ok {
+		return nil, errors.Errorf("interface %s not found in irmaclient", name)
+	}
+	var methods []*ast.Field
+	for _, field := range iface.Methods.List {
+		if len(field.Names) > 0 {
+			methods = append(methods, field)
+			continue
+		}
+		ident, ok := field.Type.(*ast.Ident)
+		if !ok {
+			return nil, errors.Errorf("unsupported embedded interface in %s", name)
+		}
+		embedded, err := g.interfaceMethods(ident.Name)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, embedded...)
+	}
+	return methods, nil
+}
+
+// handler generates the interface of the spec in irmabridge, and the methods of its adapter that
+// pass the callbacks of the irmaclient interface on to it.
+func (g *generator) handler(spec handlerSpec) error {
+	methods, err := g.interfaceMethods(spec.source)
+	if err != nil {
+		return err
+	}
+	manual := map[string]bool{}
+	for _, name := range spec.manual {
+		manual[name] = true
+	}
+
+	var adapters bytes.Buffer
+	var decls []string
+	for _, method := range methods {
+		name := method.Names[0].Name
+		if manual[name] {
+			delete(manual, name)
+			continue
+		}
+		params, err := g.params(method.Type.(*ast.FuncType).Params, false)
+		if err != nil {
+			return errors.Errorf("%s.%s: %v", spec.source, name, err)
+		}
+		if method.Type.(*ast.FuncType).Results != nil {
+			return errors.Errorf("%s.%s: callbacks cannot return values", spec.source, name)
+		}
+
+		var sig, args, marshal []string
+		var bridgeSig []string
+		for _, p := range params {
+			sig = append(sig, p.name+" "+p.typ)
+			bridgeSig = append(bridgeSig, p.bridgeName+" "+p.bridgeType())
+			args = append(args, p.toBridge())
+			if p.kind == kindJson {
+				marshal = append(marshal, fmt.Sprintf("%s, _ := json.Marshal(%s)\n", p.bridgeName, p.name))
+			}
+		}
+		decls = append(decls, fmt.Sprintf("%s(%s)", name, strings.Join(bridgeSig, ", ")))
+
+		fmt.Fprintf(&adapters, "\nfunc (h *%s) %s(%s) {\n", spec.adapter, name, strings.Join(sig, ", "))
+		handler := "h.handler"
+		if spec.optional {
+			handler = "handler"
+			fmt.Fprintf(&adapters, "handler, ok := h.handler.(%s)\nif !ok {\nreturn\n}\n", spec.name)
+		}
+		for _, m := range marshal {
+			adapters.WriteString(m)
+		}
+		if len(params) == 0 {
+			fmt.Fprintf(&adapters, "h.dispatcher.dispatch(%s.%s)\n}\n", handler, name)
+		} else {
+			fmt.Fprintf(&adapters, "h.dispatcher.dispatch(func() { %s.%s(%s) })\n}\n", handler, name, strings.Join(args, ", "))
+		}
+	}
+	for name := range manual {
+		return errors.Errorf("manual method %s not found in %s", name, spec.source)
+	}
+
+	g.printf("\n")
+	g.doc(spec.doc)
+	g.printf("type %s interface {\n", spec.name)
+	for _, decl := range decls {
+		g.printf("%s\n", decl)
+	}
+	if len(decls) > 0 && len(spec.extra) > 0 {
+		g.printf("\n")
+	}
+	for _, extra := range spec.extra {
+		g.printf("%s\n", extra)
+	}
+	g.printf("}\n\nvar _ irmaclient.%s = (*%s)(nil)\n", spec.source, spec.adapter)
+	g.buf.Write(adapters.Bytes())
+	return nil
+}
+
+// clientMethod generates the method of irmabridge.Client wrapping the method of irmaclient.Client.
+func (g *generator) clientMethod(name string) error {
+	decl, ok := g.methods[name]
+	if !ok {
+		return errors.Errorf("method Client.%s not found in irmaclient", name)
+	}
+	params, err := g.params(decl.Type.Params, true)
+	if err != nil {
+		return errors.Errorf("Client.%s: %v", name, err)
+	}
+	var sig, args []string
+	for _, p := range params {
+		sig = append(sig, p.bridgeName+" "+p.bridgeType())
+		arg, err := p.fromBridge()
+		if err != nil {
+			return errors.Errorf("Client.%s: %v", name, err)
+		}
+		args = append(args, arg)
+	}
+	call := fmt.Sprintf("c.client.%s(%s)", name, strings.Join(args, ", "))
+
+	var results []ast.Expr
+	if decl.Type.Results != nil {
+		for _, field := range decl.Type.Results.List {
+			for i := 0; i < len(field.Names) || i == 0 && len(field.Names) == 0; i++ {
+				results = append(results, field.Type)
+			}
+		}
+	}
+	returnsErr := len(results) > 0 && g.typeString(results[len(results)-1]) == "error"
+	if returnsErr {
+		results = results[:len(results)-1]
+	}
+	if len(results) > 1 {
+		return errors.Errorf("Client.%s: too many results", name)
+	}
+
+	doc := fmt.Sprintf("%s calls irmaclient.Client.%s.", name, name)
+	var resultSig, body string
+	switch {
+	case len(results) == 0 && returnsErr:
+		resultSig, body = "error", "return "+call
+	case len(results) == 0:
+		body = call
+	default:
+		p, err := g.param("result", results[0], true)
+		if err != nil {
+			return errors.Errorf("Client.%s: %v", name, err)
+		}
+		switch {
+		case p.kind == kindPlain && returnsErr:
+			resultSig, body = "("+p.typ+", error)", "return "+call
+		case p.kind == kindPlain:
+			resultSig, body = p.typ, "return "+call
+		case p.kind == kindJson && returnsErr:
+			doc = fmt.Sprintf("%s calls irmaclient.Client.%s, returning its result in JSON.", name, name)
+			resultSig = "(string, error)"
+			body = fmt.Sprintf("result, err := %s\nif err != nil {\nreturn \"\", err\n}\nreturn marshal(result)", call)
+		case p.kind == kindJson:
+			doc = fmt.Sprintf("%s calls irmaclient.Client.%s, returning its result in JSON.", name, name)
+			resultSig, body = "(string, error)", "return marshal("+call+")"
+		default:
+			return errors.Errorf("Client.%s: unsupported result type %s", name, p.typ)
+		}
+	}
+
+	g.printf("\n")
+	g.doc(doc)
+	g.printf("func (c *Client) %s(%s) %s {\n%s\n}\n", name, strings.Join(sig, ", "), resultSig, body)
+	return nil
+}
+
+// params returns the parameters of the function type. If fromBridge is set, the parameters are
+// passed from irmabridge to irmaclient; otherwise the other way around.
+func (g *generator) params(fields *ast.FieldList, fromBridge bool) ([]param, error) {
+	var params []param
+	for _, field := range fields.List {
+		if len(field.Names) == 0 {
+			return nil, errors.New("unnamed parameter")
+		}
+		for _, name := range field.Names {
+			p, err := g.param(name.Name, field.Type, fromBridge)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, p)
+		}
+	}
+	return params, nil
+}
+
+// param determines how the value of the specified type is translated.
+func (g *generator) param(name string, typ ast.Expr, fromBridge bool) (param, error) {
+	p := param{name: name, typ: g.typeString(typ), bridgeName: name}
+	if g.isFunc(typ) {
+		return p, errors.Errorf("cannot translate %s of function type %s", name, p.typ)
+	}
+	if strings.Contains(strings.NewReplacer("irma.", "", "irmaclient.", "").Replace(p.typ), ".") {
+		return p, errors.Errorf("cannot translate %s of type %s from a package other than irma or irmaclient", name, p.typ)
+	}
+	switch p.typ {
+	case "string", "int", "bool", "[]byte":
+		p.kind = kindPlain
+	case "irma.SchemeManagerIdentifier":
+		p.kind, p.bridgeName = kindScheme, "schemeID"
+	case "irma.Action", "irma.ClientStatus":
+		p.kind = kindString
+	case "error", "*irma.SessionError":
+		p.kind, p.bridgeName = kindError, "errorJson"
+	default:
+		p.kind, p.bridgeName = kindJson, name+"Json"
+		if n, ok := jsonNames[name]; ok {
+			p.bridgeName = n
+		}
+		g.json = g.json || !fromBridge
+	}
+	return p, nil
+}
+
+// isFunc returns whether the type is a function type, or a named function type of irmaclient.
+func (g *generator) isFunc(typ ast.Expr) bool {
+	switch t := typ.(type) {
+	case *ast.FuncType:
+		return true
+	case *ast.Ident:
+		return g.funcTypes[t.Name]
+	}
+	return false
+}
+
+// typeString renders the type as it is written in irmabridge, qualifying the types of irmaclient.
+func (g *generator) typeString(typ ast.Expr) string {
+	switch t := typ.(type) {
+	case *ast.Ident:
+		if types.Universe.Lookup(t.Name) != nil {
+			return t.Name
+		}
+		return "irmaclient." + t.Name
+	case *ast.SelectorExpr:
+		return fmt.Sprintf("%s.%s", t.X, t.Sel.Name)
+	case *ast.StarExpr:
+		return "*" + g.typeString(t.X)
+	case *ast.ArrayType:
+		if t.Len != nil {
+			return fmt.Sprintf("[%s]%s", t.Len.(*ast.BasicLit).Value, g.typeString(t.Elt))
+		}
+		return "[]" + g.typeString(t.Elt)
+	case *ast.MapType:
+		return fmt.Sprintf("map[%s]%s", g.typeString(t.Key), g.typeString(t.Value))
+	default:
+		return fmt.Sprintf("%T", typ)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestGenerated checks that irmabridge_gen.go is up to date with the irmaclient API; if not,
+// run go generate in the irmabridge package.
+func TestGenerated(t *testing.T) {
+	expected, err := generate("../../..")
+	require.NoError(t, err)
+	actual, err := ioutil.ReadFile("../../irmabridge_gen.go")
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(actual))
+}
+
+func TestUntranslatable(t *testing.T) {
+	// Callbacks cannot be translated mechanically, so that generation fails if a method taking
+	// them is not implemented by hand
+	defer func(h []handlerSpec) { handlers = h }(handlers)
+	handlers = []handlerSpec{{source: "Handler", name: "SessionHandler", adapter: "sessionHandler"}}
+	_, err := generate("../../..")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "function type")
+
+	// as are methods of Client taking types of other packages
+	defer func(m []string) { clientMethods = m }(clientMethods)
+	handlers, clientMethods = nil, []string{"ImportOldStorage"}
+	_, err = generate("../../..")
+	require.Error(t, err)
+}
@@ -0,0 +1,241 @@
+// Package irmabridge wraps the irmaclient API in a form that can be bound by gomobile, for use
+// in mobile apps. gomobile only supports a limited set of types in exported signatures, so
+// everything passing through this package is a string, int, bool or byte slice: requests,
+// results and errors are serialized to JSON, and callbacks that take arguments in irmaclient
+// are replaced by methods on the Session that the app calls once the user has decided.
+//
+// All callbacks to the ClientHandler and SessionHandler are invoked sequentially on a single
+// goroutine, so apps need not synchronize them among each other.
+//
+// The irmaclient package remains the primary API; this package only translates. The handler
+// interfaces and most methods of Client are generated from irmaclient into irmabridge_gen.go by
+// the command in internal/gen, which must be rerun using go generate when their counterparts in
+// irmaclient change. The methods that do not translate mechanically are written by hand.
+package irmabridge
+
+//go:generate go run ./internal/gen
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// StorageRecoveryHandler can optionally be implemented by a ClientHandler, to receive the
+// irmaclient.StorageRecoveryReport in JSON when the client recovered from a corrupted storage.
+type StorageRecoveryHandler interface {
+	StorageRecovered(reportJson string)
+}
+
+// Signer is the gomobile-compatible counterpart of irmaclient.Signer.
+type Signer interface {
+	PublicKey(keyname string) ([]byte, error)
+	Sign(keyname string, msg []byte) ([]byte, error)
+}
+
+// SecretKeyStore is the gomobile-compatible counterpart of irmaclient.SecretKeyStore, including
+// irmaclient.TransientSecretKeyStore and irmaclient.ExportableSecretKeyStore, passing the secret
+// key as big-endian bytes. Stores backed by the Android Keystore or the iOS Secure Enclave
+// typically are transient and not exportable.
+type SecretKeyStore interface {
+	Exists() (bool, error)
+	Generate() error
+	GetSecretAttribute() ([]byte, error)
+	Transient() bool
+	Exportable() bool
+}
+
+// secretKeyStore adapts a SecretKeyStore to irmaclient.SecretKeyStore.
+type secretKeyStore struct {
+	store SecretKeyStore
+}
+
+func (s secretKeyStore) Exists() (bool, error) { return s.store.Exists() }
+func (s secretKeyStore) Generate() error       { return s.store.Generate() }
+func (s secretKeyStore) Transient() bool       { return s.store.Transient() }
+func (s secretKeyStore) Exportable() bool      { return s.store.Exportable() }
+
+func (s secretKeyStore) GetSecretAttribute() (*big.Int, error) {
+	bts, err := s.store.GetSecretAttribute()
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bts), nil
+}
+
+// Client wraps an *irmaclient.Client.
+type Client struct {
+	client     *irmaclient.Client
+	dispatcher *dispatcher
+}
+
+// PinResult contains the result of Client.KeyshareVerifyPin.
+type PinResult struct {
+	Success           bool `json:"success"`
+	AttemptsRemaining int  `json:"attemptsRemaining"`
+	Blocked           int  `json:"blocked"`
+}
+
+// New creates a new Client, see irmaclient.New. The aesKey must be 32 bytes long.
+func New(storagePath, irmaConfigurationPath string, aesKey []byte, handler ClientHandler, signer Signer) (*Client, error) {
+	if len(aesKey) != 32 {
+		return nil, errors.New("AES key must be 32 bytes long")
+	}
+	var key [32]byte
+	copy(key[:], aesKey)
+
+	d := newDispatcher()
+	client, err := irmaclient.New(storagePath, irmaConfigurationPath, &clientHandler{handler: handler, dispatcher: d}, signer, key)
+	if err != nil {
+		// A *irma.SchemeManagerError is not fatal, see irmaclient.New
+		if _, ok := err.(*irma.SchemeManagerError); !ok || client == nil {
+			d.close()
+			return nil, err
+		}
+	}
+	return &Client{client: client, dispatcher: d}, err
+}
+
+// Close closes the storage of the client, after which it must not be used anymore.
+func (c *Client) Close() error {
+	c.dispatcher.close()
+	return c.client.Close()
+}
+
+// NewSession starts a new session from a session pointer (QR) or session request in JSON.
+// The returned Session is used to respond to the requests that the session makes to the handler.
+func (c *Client) NewSession(requestJson string, handler SessionHandler) *Session {
+	session := &Session{}
+	session.dismisser = c.client.NewSession(requestJson, &sessionHandler{
+		handler:    handler,
+		dispatcher: c.dispatcher,
+		session:    session,
+	})
+	return session
+}
+
+// ImportOldStorage imports the credentials of the old Android app from its data directory,
+// returning an irmaclient.OldStorageImport in JSON.
+func (c *Client) ImportOldStorage(path string) (string, error) {
+	result, err := c.client.ImportOldStorage(os.DirFS(path))
+	if err != nil {
+		return "", err
+	}
+	return marshal(result)
+}
+
+// SetSecretKeyStore makes the client keep the secret key of the user in the specified store,
+// see irmaclient.Client.SetSecretKeyStore.
+func (c *Client) SetSecretKeyStore(store SecretKeyStore) error {
+	return c.client.SetSecretKeyStore(secretKeyStore{store: store})
+}
+
+// ExportSecretKey returns the secret key of the user as big-endian bytes, see
+// irmaclient.Client.ExportSecretKey.
+func (c *Client) ExportSecretKey() ([]byte, error) {
+	sk, err := c.client.ExportSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	return sk.Bytes(), nil
+}
+
+// KeyshareEnroll enrolls at the keyshare server of the specified scheme. The email address is optional;
+// pass an empty string to omit it. The result is reported to the ClientHandler.
+func (c *Client) KeyshareEnroll(schemeID, email, pin, lang string) {
+	var e *string
+	if email != "" {
+		e = &email
+	}
+	c.client.KeyshareEnroll(irma.NewSchemeManagerIdentifier(schemeID), e, pin, lang)
+}
+
+// KeyshareVerifyPin verifies the PIN at the keyshare server of the specified scheme,
+// returning a PinResult in JSON.
+func (c *Client) KeyshareVerifyPin(pin, schemeID string) (string, error) {
+	success, attempts, blocked, err := c.client.KeyshareVerifyPin(pin, irma.NewSchemeManagerIdentifier(schemeID))
+	if err != nil {
+		return "", err
+	}
+	return marshal(PinResult{Success: success, AttemptsRemaining: attempts, Blocked: blocked})
+}
+
+// SetDeveloperMode enables or disables developer mode, see irmaclient.Preferences.
+func (c *Client) SetDeveloperMode(enabled bool) {
+	prefs := c.client.Preferences
+	prefs.DeveloperMode = enabled
+	c.client.SetPreferences(prefs)
+}
+
+func marshal(v interface{}) (string, error) {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+// errorJson renders the error as JSON. Errors other than *irma.SessionError are rendered
+// as a *irma.SessionError without type, so that apps have to deal with one format only.
+func errorJson(err error) string {
+	var serr *irma.SessionError
+	if !errors.As(err, &serr) {
+		serr = &irma.SessionError{Err: err}
+	}
+	bts, _ := json.Marshal(serr)
+	return string(bts)
+}
+
+// clientHandler translates irmaclient.ClientHandler callbacks to the ClientHandler of the app.
+type clientHandler struct {
+	handler    ClientHandler
+	dispatcher *dispatcher
+}
+
+func (h *clientHandler) StorageRecovered(report *irmaclient.StorageRecoveryReport) {
+	handler, ok := h.handler.(StorageRecoveryHandler)
+	if !ok {
+		return
+	}
+	bts, _ := json.Marshal(report)
+	h.dispatcher.dispatch(func() { handler.StorageRecovered(string(bts)) })
+}
+
+// dispatcher runs the callbacks to the app sequentially on a single goroutine.
+// After close, further callbacks are dropped.
+type dispatcher struct {
+	jobs      chan func()
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newDispatcher() *dispatcher {
+	d := &dispatcher{jobs: make(chan func(), 100), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case <-d.done:
+				return
+			case job := <-d.jobs:
+				job()
+			}
+		}
+	}()
+	return d
+}
+
+func (d *dispatcher) dispatch(job func()) {
+	select {
+	case <-d.done:
+	case d.jobs <- job:
+	}
+}
+
+func (d *dispatcher) close() {
+	d.closeOnce.Do(func() { close(d.done) })
+}
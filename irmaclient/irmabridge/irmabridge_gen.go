@@ -0,0 +1,256 @@
+// Code generated by go run ./internal/gen; DO NOT EDIT.
+
+package irmabridge
+
+import (
+	"encoding/json"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// ClientHandler is the gomobile-compatible counterpart of irmaclient.ClientHandler.
+type ClientHandler interface {
+	EnrollmentFailure(schemeID string, errorJson string)
+	EnrollmentSuccess(schemeID string)
+	ChangePinFailure(schemeID string, errorJson string)
+	ChangePinSuccess()
+	ChangePinIncorrect(schemeID string, attempts int)
+	ChangePinBlocked(schemeID string, timeout int)
+	UpdateConfiguration(identifiersJson string)
+	UpdateAttributes()
+	Revoked(credentialJson string)
+	ReportError(errorJson string)
+}
+
+var _ irmaclient.ClientHandler = (*clientHandler)(nil)
+
+func (h *clientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error) {
+	h.dispatcher.dispatch(func() { h.handler.EnrollmentFailure(manager.String(), errorJson(err)) })
+}
+
+func (h *clientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
+	h.dispatcher.dispatch(func() { h.handler.EnrollmentSuccess(manager.String()) })
+}
+
+func (h *clientHandler) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error) {
+	h.dispatcher.dispatch(func() { h.handler.ChangePinFailure(manager.String(), errorJson(err)) })
+}
+
+func (h *clientHandler) ChangePinSuccess() {
+	h.dispatcher.dispatch(h.handler.ChangePinSuccess)
+}
+
+func (h *clientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int) {
+	h.dispatcher.dispatch(func() { h.handler.ChangePinIncorrect(manager.String(), attempts) })
+}
+
+func (h *clientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int) {
+	h.dispatcher.dispatch(func() { h.handler.ChangePinBlocked(manager.String(), timeout) })
+}
+
+func (h *clientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {
+	identifiersJson, _ := json.Marshal(new)
+	h.dispatcher.dispatch(func() { h.handler.UpdateConfiguration(string(identifiersJson)) })
+}
+
+func (h *clientHandler) UpdateAttributes() {
+	h.dispatcher.dispatch(h.handler.UpdateAttributes)
+}
+
+func (h *clientHandler) Revoked(cred *irma.CredentialIdentifier) {
+	credentialJson, _ := json.Marshal(cred)
+	h.dispatcher.dispatch(func() { h.handler.Revoked(string(credentialJson)) })
+}
+
+func (h *clientHandler) ReportError(err error) {
+	h.dispatcher.dispatch(func() { h.handler.ReportError(errorJson(err)) })
+}
+
+// SessionHandler is the gomobile-compatible counterpart of irmaclient.Handler. Methods that
+// request a decision from the user must be answered using the corresponding Respond method
+// of the Session.
+type SessionHandler interface {
+	StatusUpdate(action string, status string)
+	ClientReturnURLSet(clientReturnURL string)
+	PairingRequired(pairingCode string)
+	Success(result string)
+	Cancelled()
+	Failure(errorJson string)
+	KeyshareBlocked(schemeID string, duration int)
+	KeysharePinBackoff(schemeID string, duration int)
+	KeyshareEnrollmentIncomplete(schemeID string)
+	KeyshareEnrollmentMissing(schemeID string)
+	KeyshareEnrollmentDeleted(schemeID string)
+
+	// RequestPermission receives a PermissionRequest in JSON; answer with Session.RespondPermission
+	RequestPermission(permissionRequestJson string)
+	// RequestSchemeManagerPermission receives the irma.SchemeManager in JSON;
+	// answer with Session.RespondSchemeManagerPermission
+	RequestSchemeManagerPermission(schemeJson string)
+	// RequestPin receives the irmaclient.PinMetadata in JSON; answer with Session.RespondPin
+	RequestPin(pinMetadataJson string)
+	// RequestUnlock is answered with Session.RespondUnlock
+	RequestUnlock()
+}
+
+var _ irmaclient.Handler = (*sessionHandler)(nil)
+
+func (h *sessionHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {
+	h.dispatcher.dispatch(func() { h.handler.StatusUpdate(string(action), string(status)) })
+}
+
+func (h *sessionHandler) ClientReturnURLSet(clientReturnURL string) {
+	h.dispatcher.dispatch(func() { h.handler.ClientReturnURLSet(clientReturnURL) })
+}
+
+func (h *sessionHandler) PairingRequired(pairingCode string) {
+	h.dispatcher.dispatch(func() { h.handler.PairingRequired(pairingCode) })
+}
+
+func (h *sessionHandler) Success(result string) {
+	h.dispatcher.dispatch(func() { h.handler.Success(result) })
+}
+
+func (h *sessionHandler) Cancelled() {
+	h.dispatcher.dispatch(h.handler.Cancelled)
+}
+
+func (h *sessionHandler) Failure(err *irma.SessionError) {
+	h.dispatcher.dispatch(func() { h.handler.Failure(errorJson(err)) })
+}
+
+func (h *sessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.dispatcher.dispatch(func() { h.handler.KeyshareBlocked(manager.String(), duration) })
+}
+
+func (h *sessionHandler) KeysharePinBackoff(manager irma.SchemeManagerIdentifier, duration int) {
+	h.dispatcher.dispatch(func() { h.handler.KeysharePinBackoff(manager.String(), duration) })
+}
+
+func (h *sessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.dispatcher.dispatch(func() { h.handler.KeyshareEnrollmentIncomplete(manager.String()) })
+}
+
+func (h *sessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.dispatcher.dispatch(func() { h.handler.KeyshareEnrollmentMissing(manager.String()) })
+}
+
+func (h *sessionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.dispatcher.dispatch(func() { h.handler.KeyshareEnrollmentDeleted(manager.String()) })
+}
+
+// SensitiveDisclosureHandler can optionally be implemented by a SessionHandler, see
+// irmaclient.SensitiveDisclosureHandler. If it is not, sessions in which sensitive attributes
+// are chosen are cancelled.
+type SensitiveDisclosureHandler interface {
+	// ConfirmSensitiveDisclosure receives the sensitive []*irmaclient.DisclosureCandidate in JSON;
+	// answer with Session.RespondSensitiveDisclosure
+	ConfirmSensitiveDisclosure(attributesJson string)
+}
+
+var _ irmaclient.SensitiveDisclosureHandler = (*sessionHandler)(nil)
+
+// RedirectHandler can optionally be implemented by a SessionHandler, see
+// irmaclient.RedirectHandler. If it is not, redirects to another origin are refused.
+type RedirectHandler interface {
+	// ConfirmRedirect is answered with Session.RespondRedirect
+	ConfirmRedirect(from, to string)
+}
+
+var _ irmaclient.RedirectHandler = (*sessionHandler)(nil)
+
+// SessionExpiryHandler can optionally be implemented by a SessionHandler, see irmaclient.SessionExpiryHandler.
+type SessionExpiryHandler interface {
+	SessionExpiring(remaining int)
+}
+
+var _ irmaclient.SessionExpiryHandler = (*sessionHandler)(nil)
+
+func (h *sessionHandler) SessionExpiring(remaining int) {
+	handler, ok := h.handler.(SessionExpiryHandler)
+	if !ok {
+		return
+	}
+	h.dispatcher.dispatch(func() { handler.SessionExpiring(remaining) })
+}
+
+// KnownRequestorHandler can optionally be implemented by a SessionHandler, see
+// irmaclient.KnownRequestorHandler. If it is not, sessions continue when the server of a known
+// requestor presents a different key, as in irmaclient.
+type KnownRequestorHandler interface {
+	KnownRequestor(requestorJson string)
+
+	// RequestorKeyChanged receives the irmaclient.KnownRequestor and irmaclient.RequestorKeyChange
+	// in JSON; answer with Session.RespondRequestorKeyChange
+	RequestorKeyChanged(requestorJson, changeJson string)
+}
+
+var _ irmaclient.KnownRequestorHandler = (*sessionHandler)(nil)
+
+func (h *sessionHandler) KnownRequestor(requestor *irmaclient.KnownRequestor) {
+	handler, ok := h.handler.(KnownRequestorHandler)
+	if !ok {
+		return
+	}
+	requestorJson, _ := json.Marshal(requestor)
+	h.dispatcher.dispatch(func() { handler.KnownRequestor(string(requestorJson)) })
+}
+
+// CredentialInfoList calls irmaclient.Client.CredentialInfoList, returning its result in JSON.
+func (c *Client) CredentialInfoList() (string, error) {
+	return marshal(c.client.CredentialInfoList())
+}
+
+// LoadNewestLogs calls irmaclient.Client.LoadNewestLogs, returning its result in JSON.
+func (c *Client) LoadNewestLogs(max int) (string, error) {
+	result, err := c.client.LoadNewestLogs(max)
+	if err != nil {
+		return "", err
+	}
+	return marshal(result)
+}
+
+// RemoveCredentialByHash calls irmaclient.Client.RemoveCredentialByHash.
+func (c *Client) RemoveCredentialByHash(hash string) error {
+	return c.client.RemoveCredentialByHash(hash)
+}
+
+// SetCredentialNickname calls irmaclient.Client.SetCredentialNickname.
+func (c *Client) SetCredentialNickname(hash string, nickname string) error {
+	return c.client.SetCredentialNickname(hash, nickname)
+}
+
+// SearchAttributes calls irmaclient.Client.SearchAttributes, returning its result in JSON.
+func (c *Client) SearchAttributes(query string, lang string) (string, error) {
+	return marshal(c.client.SearchAttributes(query, lang))
+}
+
+// Statistics calls irmaclient.Client.Statistics, returning its result in JSON.
+func (c *Client) Statistics() (string, error) {
+	result, err := c.client.Statistics()
+	if err != nil {
+		return "", err
+	}
+	return marshal(result)
+}
+
+// KeysharePinStatus calls irmaclient.Client.KeysharePinStatus, returning its result in JSON.
+func (c *Client) KeysharePinStatus(schemeID string) (string, error) {
+	return marshal(c.client.KeysharePinStatus(irma.NewSchemeManagerIdentifier(schemeID)))
+}
+
+// KeyshareChangePin calls irmaclient.Client.KeyshareChangePin.
+func (c *Client) KeyshareChangePin(oldPin string, newPin string) {
+	c.client.KeyshareChangePin(oldPin, newPin)
+}
+
+// Lock calls irmaclient.Client.Lock.
+func (c *Client) Lock() {
+	c.client.Lock()
+}
+
+// Unlock calls irmaclient.Client.Unlock.
+func (c *Client) Unlock() error {
+	return c.client.Unlock()
+}
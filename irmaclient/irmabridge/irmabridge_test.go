@@ -0,0 +1,205 @@
+package irmabridge
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHandler records all calls to SessionHandler methods as strings.
+type recordingHandler struct {
+	calls chan []interface{}
+}
+
+func (h *recordingHandler) record(args ...interface{}) { h.calls <- args }
+
+func (h *recordingHandler) StatusUpdate(action, status string) {
+	h.record("StatusUpdate", action, status)
+}
+func (h *recordingHandler) ClientReturnURLSet(clientReturnURL string) {
+	h.record("ClientReturnURLSet", clientReturnURL)
+}
+func (h *recordingHandler) PairingRequired(pairingCode string) {
+	h.record("PairingRequired", pairingCode)
+}
+func (h *recordingHandler) Success(result string)    { h.record("Success", result) }
+func (h *recordingHandler) Cancelled()               { h.record("Cancelled") }
+func (h *recordingHandler) Failure(errorJson string) { h.record("Failure", errorJson) }
+func (h *recordingHandler) KeyshareBlocked(schemeID string, duration int) {
+	h.record("KeyshareBlocked", schemeID, duration)
+}
+func (h *recordingHandler) KeysharePinBackoff(schemeID string, duration int) {
+	h.record("KeysharePinBackoff", schemeID, duration)
+}
+func (h *recordingHandler) KeyshareEnrollmentIncomplete(schemeID string) {
+	h.record("KeyshareEnrollmentIncomplete", schemeID)
+}
+func (h *recordingHandler) KeyshareEnrollmentMissing(schemeID string) {
+	h.record("KeyshareEnrollmentMissing", schemeID)
+}
+func (h *recordingHandler) KeyshareEnrollmentDeleted(schemeID string) {
+	h.record("KeyshareEnrollmentDeleted", schemeID)
+}
+func (h *recordingHandler) RequestPermission(permissionRequestJson string) {
+	h.record("RequestPermission", permissionRequestJson)
+}
+func (h *recordingHandler) RequestSchemeManagerPermission(schemeJson string) {
+	h.record("RequestSchemeManagerPermission", schemeJson)
+}
+func (h *recordingHandler) RequestPin(pinMetadataJson string) {
+	h.record("RequestPin", pinMetadataJson)
+}
+func (h *recordingHandler) RequestUnlock() { h.record("RequestUnlock") }
+
+func newTestSessionHandler() (*sessionHandler, *recordingHandler) {
+	rec := &recordingHandler{calls: make(chan []interface{}, 10)}
+	return &sessionHandler{handler: rec, dispatcher: newDispatcher(), session: &Session{}}, rec
+}
+
+func TestPermissionRequestJSON(t *testing.T) {
+	h, rec := newTestSessionHandler()
+	defer h.dispatcher.close()
+
+	attr := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := irma.NewDisclosureRequest(attr)
+	candidates := [][]irmaclient.DisclosureCandidates{{{{
+		AttributeIdentifier: &irma.AttributeIdentifier{Type: attr, CredentialHash: "hash"},
+	}}}}
+
+	choices := make(chan *irma.DisclosureChoice, 1)
+	h.RequestVerificationPermission(request, true, candidates, nil, func(proceed bool, choice *irma.DisclosureChoice) {
+		require.True(t, proceed)
+		choices <- choice
+	})
+
+	call := <-rec.calls
+	require.Equal(t, "RequestPermission", call[0])
+	var shape map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal([]byte(call[1].(string)), &shape))
+	require.Len(t, shape, 5)
+	require.JSONEq(t, `"disclosing"`, string(shape["action"]))
+	require.JSONEq(t, `true`, string(shape["satisfiable"]))
+	require.JSONEq(t, `null`, string(shape["requestorInfo"]))
+	require.JSONEq(t,
+		`[[[{"type":"irma-demo.RU.studentCard.studentID","credentialHash":"hash","value":null,"expired":false,"revoked":false,"notRevokable":false}]]]`,
+		string(shape["candidates"]),
+	)
+	require.Contains(t, string(shape["request"]), `"@context":"https://irma.app/ld/request/disclosure/v2"`)
+
+	require.NoError(t, h.session.RespondPermission(true, `{"attributes":[[{"type":"irma-demo.RU.studentCard.studentID","credentialHash":"hash"}]]}`))
+	choice := <-choices
+	require.Equal(t, "hash", choice.Attributes[0][0].CredentialHash)
+
+	// The callback is consumed by responding
+	require.Error(t, h.session.RespondPermission(false, ""))
+}
+
+func TestPinRequest(t *testing.T) {
+	h, rec := newTestSessionHandler()
+	defer h.dispatcher.close()
+
+	pins := make(chan string, 1)
+	cancelled := make(chan struct{})
+	metadata := irmaclient.PinMetadata{RemainingAttempts: 3, MinLength: 5, Retry: true}
+	h.RequestPin(metadata, func(pin string) { pins <- pin }, func() { close(cancelled) })
+	require.Equal(t, []interface{}{"RequestPin", `{"remainingAttempts":3,"minLength":5,"maxLength":0,"retry":true}`}, <-rec.calls)
+	require.NoError(t, h.session.RespondPin(true, "12345"))
+	require.Equal(t, "12345", <-pins)
+
+	h.RequestPin(metadata, func(pin string) { pins <- pin }, func() { close(cancelled) })
+	<-rec.calls
+	require.NoError(t, h.session.RespondPin(false, ""))
+	<-cancelled
+	require.Error(t, h.session.RespondPin(false, ""))
+}
+
+// optionalHandler also implements the optional interfaces of SessionHandler.
+type optionalHandler struct {
+	*recordingHandler
+}
+
+func (h optionalHandler) ConfirmSensitiveDisclosure(attributesJson string) {
+	h.record("ConfirmSensitiveDisclosure", attributesJson)
+}
+func (h optionalHandler) ConfirmRedirect(from, to string) { h.record("ConfirmRedirect", from, to) }
+func (h optionalHandler) SessionExpiring(remaining int)   { h.record("SessionExpiring", remaining) }
+func (h optionalHandler) KnownRequestor(requestorJson string) {
+	h.record("KnownRequestor", requestorJson)
+}
+func (h optionalHandler) RequestorKeyChanged(requestorJson, changeJson string) {
+	h.record("RequestorKeyChanged", requestorJson, changeJson)
+}
+
+func TestOptionalHandlers(t *testing.T) {
+	attr := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sensitive := []*irmaclient.DisclosureCandidate{{
+		AttributeIdentifier: &irma.AttributeIdentifier{Type: attr, CredentialHash: "hash"},
+		Sensitivity:         irma.AttributeSensitivityIdentifier,
+	}}
+	change := &irmaclient.RequestorKeyChange{Hostname: "example.com"}
+	proceeds := make(chan bool, 1)
+	callback := func(proceed bool) { proceeds <- proceed }
+
+	// Apps that do not implement the optional interfaces refuse sensitive disclosures and
+	// redirects, continue after requestor key changes as irmaclient does, and miss the rest
+	h, rec := newTestSessionHandler()
+	h.ConfirmSensitiveDisclosure(sensitive, callback)
+	require.False(t, <-proceeds)
+	h.ConfirmRedirect("https://a.example.com", "https://b.example.com", callback)
+	require.False(t, <-proceeds)
+	h.RequestorKeyChanged(nil, change, callback)
+	require.True(t, <-proceeds)
+	h.SessionExpiring(30)
+	h.KnownRequestor(nil)
+	h.Cancelled()
+	require.Equal(t, []interface{}{"Cancelled"}, <-rec.calls)
+	h.dispatcher.close()
+
+	// Apps implementing them are asked, and answer through the Session
+	h, rec = newTestSessionHandler()
+	defer h.dispatcher.close()
+	h.handler = optionalHandler{rec}
+
+	h.ConfirmSensitiveDisclosure(sensitive, callback)
+	call := <-rec.calls
+	require.Equal(t, "ConfirmSensitiveDisclosure", call[0])
+	require.Contains(t, call[1], `"sensitivity":"identifier"`)
+	require.NoError(t, h.session.RespondSensitiveDisclosure(true))
+	require.True(t, <-proceeds)
+	require.Error(t, h.session.RespondSensitiveDisclosure(true))
+
+	h.ConfirmRedirect("https://a.example.com", "https://b.example.com", callback)
+	require.Equal(t, []interface{}{"ConfirmRedirect", "https://a.example.com", "https://b.example.com"}, <-rec.calls)
+	require.NoError(t, h.session.RespondRedirect(false))
+	require.False(t, <-proceeds)
+
+	h.RequestorKeyChanged(nil, change, callback)
+	require.Equal(t, []interface{}{"RequestorKeyChanged", "null", `{"hostname":"example.com","previousKey":null,"key":null}`}, <-rec.calls)
+	require.NoError(t, h.session.RespondRequestorKeyChange(false))
+	require.False(t, <-proceeds)
+
+	h.SessionExpiring(30)
+	require.Equal(t, []interface{}{"SessionExpiring", 30}, <-rec.calls)
+	h.KnownRequestor(nil)
+	require.Equal(t, []interface{}{"KnownRequestor", "null"}, <-rec.calls)
+}
+
+func TestErrorJSON(t *testing.T) {
+	h, rec := newTestSessionHandler()
+	defer h.dispatcher.close()
+
+	h.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport, Err: errors.New("connection refused")})
+	require.Equal(t, []interface{}{"Failure", `{"type":"transport","message":"connection refused"}`}, <-rec.calls)
+
+	require.Equal(t, `{"type":"","message":"plain"}`, errorJson(errors.New("plain")))
+}
+
+func TestPinResultJSON(t *testing.T) {
+	bts, err := json.Marshal(PinResult{Success: false, AttemptsRemaining: 2})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"success":false,"attemptsRemaining":2,"blocked":0}`, string(bts))
+}
@@ -0,0 +1,332 @@
+package irmabridge
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// SessionProgressHandler can optionally be implemented by a SessionHandler, to receive the
+// irmaclient.Progress of the session in JSON.
+type SessionProgressHandler interface {
+	SessionProgress(action, progressJson string)
+}
+
+// PermissionRequest is passed in JSON to SessionHandler.RequestPermission.
+type PermissionRequest struct {
+	Action        irma.Action                         `json:"action"`
+	Request       irma.SessionRequest                 `json:"request"`
+	Satisfiable   bool                                `json:"satisfiable"`
+	Candidates    [][]irmaclient.DisclosureCandidates `json:"candidates"`
+	RequestorInfo *irma.RequestorInfo                 `json:"requestorInfo"`
+	// Unsatisfiable explains why the request cannot be satisfied, if it cannot
+	Unsatisfiable *irmaclient.UnsatisfiableRequest `json:"unsatisfiable,omitempty"`
+	// Message is the analysis of the message to be signed, in signature sessions
+	Message *irma.MessageAnalysis `json:"message,omitempty"`
+}
+
+// Session is a running session, through which the app answers the requests of the session
+// to the SessionHandler.
+type Session struct {
+	dismisser irmaclient.SessionDismisser
+
+	mutex            sync.Mutex
+	permission       irmaclient.PermissionHandler
+	schemePermission func(proceed bool)
+	pin              func(pin string)
+	pinCancel        func()
+	unlock           func(proceed bool)
+	sensitive        func(proceed bool)
+	redirect         func(proceed bool)
+	keyChange        func(proceed bool)
+}
+
+// Dismiss aborts the session.
+func (s *Session) Dismiss() {
+	if s.dismisser != nil {
+		s.dismisser.Dismiss()
+	}
+}
+
+// Summary returns the irmaclient.SessionSummary of the session in JSON, or null if the session
+// request has not yet been received.
+func (s *Session) Summary() (string, error) {
+	var summary *irmaclient.SessionSummary
+	if s.dismisser != nil {
+		summary = s.dismisser.Summary()
+	}
+	bts, err := json.Marshal(summary)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+// Durations returns the irmaclient.PhaseDurations of the session so far in JSON, or null if
+// the session has not been started.
+func (s *Session) Durations() (string, error) {
+	var durations *irmaclient.PhaseDurations
+	if s.dismisser != nil {
+		d := s.dismisser.Timings().Durations()
+		durations = &d
+	}
+	bts, err := json.Marshal(durations)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+// RespondPermission answers SessionHandler.RequestPermission. If proceed is true, choiceJson
+// must contain the irma.DisclosureChoice in JSON.
+func (s *Session) RespondPermission(proceed bool, choiceJson string) error {
+	var choice *irma.DisclosureChoice
+	if proceed {
+		choice = &irma.DisclosureChoice{}
+		if err := json.Unmarshal([]byte(choiceJson), choice); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	callback := s.permission
+	s.permission = nil
+	s.mutex.Unlock()
+
+	if callback == nil {
+		return errors.New("no permission request pending")
+	}
+	go callback(proceed, choice)
+	return nil
+}
+
+// RespondSchemeManagerPermission answers SessionHandler.RequestSchemeManagerPermission.
+func (s *Session) RespondSchemeManagerPermission(proceed bool) error {
+	return s.respond(&s.schemePermission, proceed, "scheme permission request")
+}
+
+// RespondPin answers SessionHandler.RequestPin. If proceed is false, the session is cancelled.
+func (s *Session) RespondPin(proceed bool, pin string) error {
+	s.mutex.Lock()
+	callback, cancel := s.pin, s.pinCancel
+	s.pin, s.pinCancel = nil, nil
+	s.mutex.Unlock()
+
+	if callback == nil {
+		return errors.New("no PIN request pending")
+	}
+	if proceed {
+		go callback(pin)
+	} else {
+		go cancel()
+	}
+	return nil
+}
+
+// RespondUnlock answers SessionHandler.RequestUnlock, after Client.Unlock has been called.
+func (s *Session) RespondUnlock(proceed bool) error {
+	return s.respond(&s.unlock, proceed, "unlock request")
+}
+
+// RespondSensitiveDisclosure answers SensitiveDisclosureHandler.ConfirmSensitiveDisclosure.
+func (s *Session) RespondSensitiveDisclosure(proceed bool) error {
+	return s.respond(&s.sensitive, proceed, "sensitive disclosure confirmation")
+}
+
+// RespondRedirect answers RedirectHandler.ConfirmRedirect.
+func (s *Session) RespondRedirect(proceed bool) error {
+	return s.respond(&s.redirect, proceed, "redirect confirmation")
+}
+
+// RespondRequestorKeyChange answers KnownRequestorHandler.RequestorKeyChanged.
+func (s *Session) RespondRequestorKeyChange(proceed bool) error {
+	return s.respond(&s.keyChange, proceed, "requestor key change")
+}
+
+// respond invokes and clears the pending callback, if any, of the specified request.
+func (s *Session) respond(pending *func(proceed bool), proceed bool, request string) error {
+	s.mutex.Lock()
+	callback := *pending
+	*pending = nil
+	s.mutex.Unlock()
+
+	if callback == nil {
+		return errors.New("no " + request + " pending")
+	}
+	go callback(proceed)
+	return nil
+}
+
+// sessionHandler translates irmaclient.Handler callbacks to the SessionHandler of the app.
+type sessionHandler struct {
+	handler    SessionHandler
+	dispatcher *dispatcher
+	session    *Session
+
+	// unsatisfiable is set by Unsatisfiable for the permission request that follows it
+	unsatisfiable *irmaclient.UnsatisfiableRequest
+}
+
+func (h *sessionHandler) SessionProgress(action irma.Action, progress irmaclient.Progress) {
+	handler, ok := h.handler.(SessionProgressHandler)
+	if !ok {
+		return
+	}
+	bts, err := json.Marshal(progress)
+	if err != nil {
+		return
+	}
+	h.dispatcher.dispatch(func() { handler.SessionProgress(string(action), string(bts)) })
+}
+
+func (h *sessionHandler) RequestIssuancePermission(request *irma.IssuanceRequest, satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates, requestorInfo *irma.RequestorInfo, callback irmaclient.PermissionHandler,
+) {
+	h.requestPermission(irma.ActionIssuing, request, satisfiable, candidates, requestorInfo, callback)
+}
+
+func (h *sessionHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates, requestorInfo *irma.RequestorInfo, callback irmaclient.PermissionHandler,
+) {
+	h.requestPermission(irma.ActionDisclosing, request, satisfiable, candidates, requestorInfo, callback)
+}
+
+func (h *sessionHandler) RequestSignaturePermission(request *irma.SignatureRequest, satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates, requestorInfo *irma.RequestorInfo, callback irmaclient.PermissionHandler,
+) {
+	h.requestPermission(irma.ActionSigning, request, satisfiable, candidates, requestorInfo, callback)
+}
+
+func (h *sessionHandler) Unsatisfiable(request *irmaclient.UnsatisfiableRequest) {
+	h.session.mutex.Lock()
+	h.unsatisfiable = request
+	h.session.mutex.Unlock()
+}
+
+func (h *sessionHandler) requestPermission(action irma.Action, request irma.SessionRequest, satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates, requestorInfo *irma.RequestorInfo, callback irmaclient.PermissionHandler,
+) {
+	h.session.mutex.Lock()
+	unsatisfiable := h.unsatisfiable
+	h.unsatisfiable = nil
+	h.session.mutex.Unlock()
+	if satisfiable {
+		unsatisfiable = nil
+	}
+
+	permission := PermissionRequest{
+		Action:        action,
+		Request:       request,
+		Satisfiable:   satisfiable,
+		Candidates:    candidates,
+		RequestorInfo: requestorInfo,
+		Unsatisfiable: unsatisfiable,
+	}
+	if sr, ok := request.(*irma.SignatureRequest); ok {
+		permission.Message = sr.AnalyzeMessage()
+	}
+	bts, err := json.Marshal(permission)
+	if err != nil {
+		h.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		callback(false, nil)
+		return
+	}
+
+	h.session.mutex.Lock()
+	h.session.permission = callback
+	h.session.mutex.Unlock()
+	h.dispatcher.dispatch(func() { h.handler.RequestPermission(string(bts)) })
+}
+
+func (h *sessionHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	bts, err := json.Marshal(manager)
+	if err != nil {
+		callback(false)
+		return
+	}
+
+	h.session.mutex.Lock()
+	h.session.schemePermission = callback
+	h.session.mutex.Unlock()
+	h.dispatcher.dispatch(func() { h.handler.RequestSchemeManagerPermission(string(bts)) })
+}
+
+func (h *sessionHandler) RequestPin(metadata irmaclient.PinMetadata, proceed func(pin string), cancel func()) {
+	bts, err := json.Marshal(metadata)
+	if err != nil {
+		cancel()
+		return
+	}
+
+	h.session.mutex.Lock()
+	h.session.pin, h.session.pinCancel = proceed, cancel
+	h.session.mutex.Unlock()
+	h.dispatcher.dispatch(func() { h.handler.RequestPin(string(bts)) })
+}
+
+func (h *sessionHandler) RequestUnlock(callback func(proceed bool)) {
+	h.session.mutex.Lock()
+	h.session.unlock = callback
+	h.session.mutex.Unlock()
+	h.dispatcher.dispatch(h.handler.RequestUnlock)
+}
+
+func (h *sessionHandler) ConfirmSensitiveDisclosure(attributes []*irmaclient.DisclosureCandidate, callback func(proceed bool)) {
+	handler, ok := h.handler.(SensitiveDisclosureHandler)
+	if !ok {
+		callback(false)
+		return
+	}
+	bts, err := json.Marshal(attributes)
+	if err != nil {
+		callback(false)
+		return
+	}
+
+	h.session.mutex.Lock()
+	h.session.sensitive = callback
+	h.session.mutex.Unlock()
+	h.dispatcher.dispatch(func() { handler.ConfirmSensitiveDisclosure(string(bts)) })
+}
+
+func (h *sessionHandler) ConfirmRedirect(from, to string, callback func(proceed bool)) {
+	handler, ok := h.handler.(RedirectHandler)
+	if !ok {
+		callback(false)
+		return
+	}
+
+	h.session.mutex.Lock()
+	h.session.redirect = callback
+	h.session.mutex.Unlock()
+	h.dispatcher.dispatch(func() { handler.ConfirmRedirect(from, to) })
+}
+
+func (h *sessionHandler) RequestorKeyChanged(requestor *irmaclient.KnownRequestor, change *irmaclient.RequestorKeyChange,
+	callback func(proceed bool),
+) {
+	handler, ok := h.handler.(KnownRequestorHandler)
+	if !ok {
+		irma.Logger.Warnf("server of known requestor at %s presents a different key than before", change.Hostname)
+		callback(true)
+		return
+	}
+	requestorJson, err := json.Marshal(requestor)
+	if err != nil {
+		callback(false)
+		return
+	}
+	changeJson, err := json.Marshal(change)
+	if err != nil {
+		callback(false)
+		return
+	}
+
+	h.session.mutex.Lock()
+	h.session.keyChange = callback
+	h.session.mutex.Unlock()
+	h.dispatcher.dispatch(func() { handler.RequestorKeyChanged(string(requestorJson), string(changeJson)) })
+}
@@ -0,0 +1,62 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func rootIssuanceRequest(bsn string) *irma.IssuanceRequest {
+	return irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+		KeyCounter:       1,
+		Attributes:       map[string]string{"BSN": bsn},
+	}})
+}
+
+func TestIssuanceCredentialChanges(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+	sks := testPrivateKeys(t, client.Configuration)
+	require.NoError(t, client.IssueLocally(rootIssuanceRequest("12345"), sks))
+	require.NoError(t, client.IssueLocally(studentCardIssuanceRequest(), sks))
+
+	// Issue a new root credential, which is a singleton; the same student card; and another student card
+	request := rootIssuanceRequest("67890")
+	otherCard := studentCardIssuanceRequest().Credentials[0]
+	otherCard.Attributes = map[string]string{"university": "Radboud", "studentCardNumber": "2", "studentID": "s2", "level": "1"}
+	request.Credentials = append(request.Credentials, studentCardIssuanceRequest().Credentials[0], otherCard)
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	result := runMockSession(t, client, server, h)
+	require.Nil(t, result.err)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	check := func(changes []*irma.CredentialChange) {
+		require.Len(t, changes, 3)
+		require.Equal(t, "12345", changes[0].Existing.Attributes[bsn][""])
+		require.Equal(t, "67890", changes[0].New.Attributes[bsn][""])
+		require.Equal(t, "s1234567", changes[1].Existing.Attributes[studentID][""])
+		require.Equal(t, "s1234567", changes[1].New.Attributes[studentID][""])
+		require.Nil(t, changes[2].Existing)
+		require.Equal(t, "s2", changes[2].New.Attributes[studentID][""])
+	}
+
+	// The changes are shown when asking permission
+	permission := <-h.permissionRequested
+	check(permission.(*irma.IssuanceRequest).CredentialChanges)
+
+	// and passed to the handler on success
+	var changes []*irma.CredentialChange
+	require.NoError(t, json.Unmarshal([]byte(result.success), &changes))
+	check(changes)
+
+	// They match what actually happened to our credentials
+	require.Len(t, client.attrs(bsn.CredentialTypeIdentifier()), 1)
+	require.Len(t, client.attrs(studentID.CredentialTypeIdentifier()), 2)
+}
@@ -0,0 +1,96 @@
+package irmaclient
+
+import (
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+// skewHandler records the calls of ClockSkewDetected.
+type skewHandler struct {
+	ClientHandler
+	skews []time.Duration
+}
+
+func (h *skewHandler) ClockSkewDetected(skew time.Duration) {
+	h.skews = append(h.skews, skew)
+}
+
+// observeServer lets the client contact a server whose clock is off by the specified amount.
+func observeServer(t *testing.T, client *Client, skew time.Duration) {
+	client.SetTransportRoundTripper(dateStub{skew: skew})
+	_, err := client.newTransport("https://example.com/").GetBytes("")
+	require.NoError(t, err)
+}
+
+func TestClockSkew(t *testing.T) {
+	// Issue a student card that expires at the next epoch boundary, within a week
+	newClient := func(t *testing.T) (*Client, time.Time) {
+		client := parseMemoryClient(t)
+		request := studentCardIssuanceRequest()
+		expiry := irma.Timestamp(irma.FloorToEpochBoundary(time.Now()).Add(irma.ExpiryFactor * time.Second))
+		request.Credentials[0].Validity = &expiry
+		server := newMockServer(t, request)
+		defer server.Close()
+		require.Nil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+		return client, time.Time(expiry)
+	}
+	usable := func(client *Client) bool {
+		check, err := client.CheckRequest(studentIDRequest())
+		require.NoError(t, err)
+		return check.Satisfiable()
+	}
+
+	t.Run("device ahead", func(t *testing.T) {
+		client, expiry := newClient(t)
+		defer func() { require.NoError(t, client.Close()) }()
+		h := &skewHandler{ClientHandler: client.handler}
+		client.handler = h
+
+		// The device thinks the credential expired a day ago
+		ahead := time.Until(expiry) + 24*time.Hour
+		client.clock.device = func() time.Time { return time.Now().Add(ahead) }
+		require.Zero(t, client.ClockSkew())
+		require.False(t, usable(client))
+
+		observeServer(t, client, 0)
+		require.InDelta(t, ahead.Seconds(), client.ClockSkew().Seconds(), 2)
+		require.True(t, usable(client))
+		require.Len(t, h.skews, 1)
+
+		// The handler is informed again only after the clock was correct in the meantime
+		observeServer(t, client, 0)
+		require.Len(t, h.skews, 1)
+		client.clock.device = nil
+		observeServer(t, client, 0)
+		require.Less(t, client.ClockSkew(), clockSkewThreshold)
+		client.clock.device = func() time.Time { return time.Now().Add(ahead) }
+		observeServer(t, client, 0)
+		require.Len(t, h.skews, 2)
+	})
+
+	t.Run("device behind", func(t *testing.T) {
+		client, expiry := newClient(t)
+		defer func() { require.NoError(t, client.Close()) }()
+		require.True(t, usable(client))
+
+		// According to the server the credential expired an hour ago
+		observeServer(t, client, time.Until(expiry)+time.Hour)
+		require.Less(t, client.ClockSkew(), -clockSkewThreshold)
+		require.False(t, usable(client))
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		client := parseMemoryClient(t)
+		defer func() { require.NoError(t, client.Close()) }()
+
+		observeServer(t, client, -365*24*time.Hour)
+		require.InDelta(t, (365 * 24 * time.Hour).Seconds(), client.ClockSkew().Seconds(), 2)
+		require.WithinDuration(t, time.Now().Add(-maxClockCorrection), client.now(), 2*time.Second)
+
+		observeServer(t, client, 365*24*time.Hour)
+		require.WithinDuration(t, time.Now().Add(maxClockCorrection), client.now(), 2*time.Second)
+	})
+}
@@ -0,0 +1,134 @@
+package irmaclient
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// requestorHandler records the requestor passed to the permission request.
+type requestorHandler struct {
+	*mockSessionHandler
+	requestor *irma.RequestorInfo
+}
+
+func (h *requestorHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.requestor = requestor
+	h.mockSessionHandler.RequestVerificationPermission(request, satisfiable, candidates, requestor, callback)
+}
+
+func runRequestorSession(t *testing.T, client *Client, request irma.SessionRequest) (*irma.RequestorInfo, mockSessionResult) {
+	server := newMockServer(t, request)
+	defer server.Close()
+	h := &requestorHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	return h.requestor, h.wait()
+}
+
+func TestDeveloperMode(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("default", func(t *testing.T) {
+		require.False(t, defaultPreferences.DeveloperMode)
+		require.True(t, client.Preferences.DeveloperMode) // enabled by parseStorage
+		require.True(t, client.Configuration.DeveloperMode())
+	})
+
+	t.Run("requestor", func(t *testing.T) {
+		require.Contains(t, client.Configuration.Requestors, "localhost")
+		requestor := requestorInfo("http://localhost:1234/irma/session/token", client.Configuration, true)
+		require.True(t, requestor.DeveloperMode)
+		require.False(t, requestor.Unverified)
+		require.Equal(t, client.Configuration.Requestors["localhost"].ID, requestor.ID)
+		require.False(t, client.Configuration.Requestors["localhost"].DeveloperMode)
+
+		requestor, result := runRequestorSession(t, client, studentIDRequest())
+		require.Nil(t, result.err)
+		require.NotNil(t, requestor)
+		require.True(t, requestor.DeveloperMode)
+	})
+
+	t.Run("development mode server", func(t *testing.T) {
+		request := studentIDRequest()
+		request.DevelopmentMode = true
+		requestor, result := runRequestorSession(t, client, request)
+		require.Nil(t, result.err)
+		require.True(t, requestor.Unverified)
+		require.True(t, requestor.DeveloperMode)
+
+		client.SetPreferences(Preferences{DeveloperMode: false})
+		defer client.SetPreferences(Preferences{DeveloperMode: true})
+		request = studentIDRequest()
+		request.DevelopmentMode = true
+		_, result = runRequestorSession(t, client, request)
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorInvalidRequest, result.err.ErrorType)
+	})
+
+	t.Run("https", func(t *testing.T) {
+		common.ForceHTTPS = true
+		defer func() { common.ForceHTTPS = false }()
+
+		requestor, result := runRequestorSession(t, client, studentIDRequest())
+		require.Nil(t, result.err)
+		require.True(t, requestor.DeveloperMode)
+
+		client.SetPreferences(Preferences{DeveloperMode: false})
+		defer client.SetPreferences(Preferences{DeveloperMode: true})
+		_, result = runRequestorSession(t, client, studentIDRequest())
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorHTTPS, result.err.ErrorType)
+	})
+}
+
+func TestDeveloperModeUnsignedSchemes(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	mijnirma := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	require.NotEmpty(t, client.attrs(studentCard))
+
+	// Strip the signature of a scheme, as if it was installed from an unsigned remote
+	conf := client.Configuration
+	require.NoError(t, os.Remove(filepath.Join(conf.Path, "irma-demo", "index.sig")))
+	require.NoError(t, conf.ParseFolder())
+	require.Len(t, conf.UnsignedSchemes(), 1)
+
+	// Unsigned schemes survive a restart in developer mode
+	require.NoError(t, client.storage.db.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	conf = client.Configuration
+	require.Len(t, conf.UnsignedSchemes(), 1)
+	require.NotEmpty(t, client.attrs(studentCard))
+
+	// Disabling developer mode removes the credentials of the unsigned scheme and restores it from the assets
+	client.SetPreferences(Preferences{DeveloperMode: false})
+	require.False(t, conf.DeveloperMode())
+	require.Empty(t, conf.UnsignedSchemes())
+	require.Contains(t, conf.SchemeManagers, irma.NewSchemeManagerIdentifier("irma-demo"))
+	require.Empty(t, client.attrs(studentCard))
+	require.NotEmpty(t, client.attrs(mijnirma))
+
+	// The client can restart without developer mode
+	require.NoError(t, client.storage.db.Close())
+	client, err := New(
+		filepath.Join(handler.storage, "client"),
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		handler,
+		client.signer,
+		client.storage.aesKey,
+	)
+	require.NoError(t, err)
+	require.False(t, client.Preferences.DeveloperMode)
+	require.Empty(t, client.attrs(studentCard))
+	require.NoError(t, client.Close())
+}
@@ -0,0 +1,91 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/internal/testkeyshare"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastFailureBundle(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// Capture is opt-in
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	server.inject(mockEndpointProofs, mockFault{Status: http.StatusBadRequest})
+	require.NotNil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+	bundle, err := client.LastFailureBundle()
+	require.NoError(t, err)
+	require.Nil(t, bundle)
+
+	client.SetDiagnosticCapture(true)
+	request := studentCardIssuanceRequest()
+	server = newMockServer(t, request)
+	defer server.Close()
+	server.inject(mockEndpointCommitments, mockFault{Status: http.StatusBadRequest})
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+
+	bundle, err = client.LastFailureBundle()
+	require.NoError(t, err)
+	parsed := &FailureBundle{}
+	require.NoError(t, json.Unmarshal(bundle, parsed))
+	require.Equal(t, irma.ErrorApi, parsed.Report.ErrorType)
+	require.Equal(t, "INJECTED_FAULT", parsed.Report.RemoteError)
+	require.NotNil(t, parsed.Timings.RequestReceived)
+	require.NotNil(t, parsed.Health)
+	require.Len(t, parsed.Exchanges, 2)
+	require.Equal(t, http.MethodGet, parsed.Exchanges[0].Method)
+	require.Equal(t, http.StatusBadRequest, parsed.Exchanges[1].Status)
+	require.Contains(t, parsed.Exchanges[1].Response, "INJECTED_FAULT")
+
+	// The attribute values and proofs are replaced by their size and hash
+	for _, value := range request.Credentials[0].Attributes {
+		if len(value) > 3 { // shorter values may occur in hashes by chance
+			require.NotContains(t, string(bundle), value)
+		}
+	}
+	var commitments map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal([]byte(parsed.Exchanges[1].Request), &commitments))
+	redacted := &diagnosticRedacted{}
+	require.NoError(t, json.Unmarshal(commitments["combinedProofs"], redacted))
+	require.NotZero(t, redacted.Redacted)
+	require.Len(t, redacted.SHA256, 64)
+}
+
+func TestLastFailureBundleKeyshare(t *testing.T) {
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, irma.NewSchemeManagerIdentifier("test"))
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	client.SetDiagnosticCapture(true)
+
+	email := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+	server := newMockServer(t, irma.NewDisclosureRequest(email))
+	defer server.Close()
+	server.inject(mockEndpointProofs, mockFault{Status: http.StatusBadRequest})
+
+	h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	require.NotNil(t, h.wait().err)
+	require.Equal(t, 1, h.pins)
+
+	bundle, err := client.LastFailureBundle()
+	require.NoError(t, err)
+	parsed := &FailureBundle{}
+	require.NoError(t, json.Unmarshal(bundle, parsed))
+	require.Greater(t, len(parsed.Exchanges), 2, "keyshare exchanges are captured")
+
+	// Neither the PIN nor the disclosed attribute value occur in the bundle
+	kss := client.keyshareServers[irma.NewSchemeManagerIdentifier("test")]
+	require.NotContains(t, string(bundle), kss.HashedPin("12345"))
+	for _, attrs := range client.attrs(email.CredentialTypeIdentifier()) {
+		require.NotContains(t, string(bundle), *attrs.UntranslatedAttribute(email))
+	}
+}
@@ -0,0 +1,206 @@
+package irmaclient
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// serialHandler checks that all of its methods are invoked through its dispatcher, one at a time.
+type serialHandler struct {
+	*mockSessionHandler
+	serial     SerialDispatcher
+	dispatched int32 // 1 while the dispatcher invokes a function
+	active     int32 // number of methods currently running
+
+	mutex   sync.Mutex
+	methods []string
+}
+
+func newSerialHandler(t *testing.T) *serialHandler {
+	return &serialHandler{mockSessionHandler: newMockSessionHandler(t)}
+}
+
+func (h *serialHandler) dispatch(f func()) {
+	h.serial.Dispatch(func() {
+		atomic.StoreInt32(&h.dispatched, 1)
+		defer atomic.StoreInt32(&h.dispatched, 0)
+		f()
+	})
+}
+
+func (h *serialHandler) enter(method string) func() {
+	if atomic.LoadInt32(&h.dispatched) != 1 {
+		h.t.Errorf("%s invoked outside of the dispatcher", method)
+	}
+	if atomic.AddInt32(&h.active, 1) != 1 {
+		h.t.Errorf("%s invoked while another method was running", method)
+	}
+	h.mutex.Lock()
+	h.methods = append(h.methods, method)
+	h.mutex.Unlock()
+	time.Sleep(time.Millisecond) // give interleavings a chance to happen
+	return func() { atomic.AddInt32(&h.active, -1) }
+}
+
+func (h *serialHandler) invoked() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string{}, h.methods...)
+}
+
+func (h *serialHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {
+	defer h.enter("StatusUpdate")()
+}
+
+func (h *serialHandler) SessionStarted(summary SessionSummary) {
+	defer h.enter("SessionStarted")()
+}
+
+func (h *serialHandler) SessionTimings(timings PhaseTimings) {
+	defer h.enter("SessionTimings")()
+}
+
+func (h *serialHandler) SessionProgress(action irma.Action, progress Progress) {
+	defer h.enter("SessionProgress")()
+}
+
+func (h *serialHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	defer h.enter("RequestVerificationPermission")()
+	h.mockSessionHandler.RequestVerificationPermission(request, satisfiable, candidates, requestor, callback)
+}
+
+func (h *serialHandler) RequestIssuancePermission(request *irma.IssuanceRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	defer h.enter("RequestIssuancePermission")()
+	h.mockSessionHandler.RequestIssuancePermission(request, satisfiable, candidates, requestor, callback)
+}
+
+func (h *serialHandler) Success(result string) {
+	defer h.enter("Success")()
+	h.mockSessionHandler.Success(result)
+}
+
+func (h *serialHandler) Failure(err *irma.SessionError) {
+	defer h.enter("Failure")()
+	h.mockSessionHandler.Failure(err)
+}
+
+func (h *serialHandler) Cancelled() {
+	defer h.enter("Cancelled")()
+	h.mockSessionHandler.Cancelled()
+}
+
+func TestSerialDispatcher(t *testing.T) {
+	var (
+		d       SerialDispatcher
+		active  int32
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		invoked = map[int][]int{}
+	)
+	const producers, count = 8, 50
+	wg.Add(producers * count)
+	for p := 0; p < producers; p++ {
+		go func(p int) {
+			for i := 0; i < count; i++ {
+				i := i
+				d.Dispatch(func() {
+					defer wg.Done()
+					if atomic.AddInt32(&active, 1) != 1 {
+						t.Error("functions invoked concurrently")
+					}
+					defer atomic.AddInt32(&active, -1)
+					mutex.Lock()
+					invoked[p] = append(invoked[p], i)
+					mutex.Unlock()
+				})
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// The functions of each producer were invoked in the order in which they were dispatched
+	for p := 0; p < producers; p++ {
+		require.Len(t, invoked[p], count)
+		for i := range invoked[p] {
+			require.Equal(t, i, invoked[p][i])
+		}
+	}
+
+	// Dispatching after the queue ran empty starts invoking again
+	done := make(chan struct{})
+	d.Dispatch(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("function not invoked")
+	}
+}
+
+func TestMockServerDispatcher(t *testing.T) {
+	t.Run("disclosure", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+
+		h := newSerialHandler(t)
+		client.NewSessionWithDispatcher(server.Qr(), h, h.dispatch)
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.NotEmpty(t, result.success)
+
+		methods := h.invoked()
+		require.Contains(t, methods, "SessionStarted")
+		require.Contains(t, methods, "RequestVerificationPermission")
+		require.Equal(t, []string{"SessionTimings", "Success"}, methods[len(methods)-2:])
+	})
+
+	t.Run("issuance", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+
+		h := newSerialHandler(t)
+		client.NewSessionWithDispatcher(server.Qr(), h, h.dispatch)
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.Contains(t, h.invoked(), "RequestIssuancePermission")
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+
+		h := newSerialHandler(t)
+		h.decline = true
+		client.NewSessionWithDispatcher(server.Qr(), h, h.dispatch)
+		require.True(t, h.wait().cancelled)
+		methods := h.invoked()
+		require.Equal(t, "Cancelled", methods[len(methods)-1])
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+
+		h := newSerialHandler(t)
+		require.Nil(t, client.NewSessionWithDispatcher(`{"malformed":`, h, h.dispatch))
+		result := h.wait()
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorInvalidRequest, result.err.ErrorType)
+		require.Equal(t, []string{"Failure"}, h.invoked())
+	})
+}
@@ -0,0 +1,94 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// dryRunHandler records the endpoint passed to DryRun, and passes the response as result.
+type dryRunHandler struct {
+	*mockSessionHandler
+	endpoint string
+}
+
+func (h *dryRunHandler) DryRun(endpoint string, response string) {
+	h.endpoint = endpoint
+	h.Success(response)
+}
+
+func TestDryRun(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("disclosure", func(t *testing.T) {
+		request := studentIDRequest()
+		server := newMockServer(t, request)
+		defer server.Close()
+		h := &dryRunHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewDryRunSession(server.Qr(), h)
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.Equal(t, "proofs", h.endpoint)
+
+		// Nothing was sent, and the session was cancelled at the server
+		server.waitDeleted()
+		require.NotContains(t, server.Calls(), mockEndpointProofs)
+
+		// The response is what the server would have received
+		disclosure := &irma.Disclosure{}
+		require.NoError(t, json.Unmarshal([]byte(result.success), disclosure))
+		attrs, status, err := disclosure.Verify(client.Configuration, request)
+		require.NoError(t, err)
+		require.Equal(t, irma.ProofStatusValid, status)
+		require.Equal(t, "456", attrs[0][0].Value["en"])
+
+		logs, err := client.LoadNewestLogs(1)
+		require.NoError(t, err)
+		require.True(t, logs[0].DryRun)
+		require.NotNil(t, logs[0].Disclosure)
+	})
+
+	t.Run("issuance", func(t *testing.T) {
+		count := credentialCount(client)
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		h := &dryRunHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewDryRunSession(server.Qr(), h)
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.Equal(t, "commitments", h.endpoint)
+		server.waitDeleted()
+		require.NotContains(t, server.Calls(), mockEndpointCommitments)
+
+		commitments := &irma.IssueCommitmentMessage{}
+		require.NoError(t, json.Unmarshal([]byte(result.success), commitments))
+		require.NotEmpty(t, commitments.Proofs)
+		require.Equal(t, count, credentialCount(client))
+
+		logs, err := client.LoadNewestLogs(1)
+		require.NoError(t, err)
+		require.True(t, logs[0].DryRun)
+		issued, err := logs[0].GetIssuedCredentials(client.Configuration)
+		require.NoError(t, err)
+		require.Empty(t, issued)
+	})
+
+	t.Run("not from qr", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		var qr map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(server.Qr()), &qr))
+		qr["dryRun"] = true
+		bts, err := json.Marshal(qr)
+		require.NoError(t, err)
+
+		h := newMockSessionHandler(t)
+		client.NewSession(string(bts), h)
+		require.Nil(t, h.wait().err)
+		require.Contains(t, server.Calls(), mockEndpointProofs)
+	})
+}
@@ -0,0 +1,91 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptAttributes rewrites the session request sent by the mock server such that the
+// specified attributes of its first credential are encrypted against the specified key, or
+// against the key of the client hello if key is nil.
+func encryptAttributes(t *testing.T, server *mockServer, key []byte, names ...string) func(string) string {
+	return func(response string) string {
+		if key == nil {
+			server.mutex.Lock()
+			key = server.greeted.EncryptionKey
+			server.mutex.Unlock()
+		}
+		var msg map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(response), &msg))
+		cred := msg["request"].(map[string]interface{})["credentials"].([]interface{})[0].(map[string]interface{})
+
+		credreq := &irma.CredentialRequest{Attributes: map[string]string{}}
+		for name, value := range cred["attributes"].(map[string]interface{}) {
+			credreq.Attributes[name] = value.(string)
+		}
+		for _, name := range names {
+			require.NoError(t, credreq.EncryptAttribute(name, key, rand.Reader))
+		}
+		cred["attributes"] = credreq.Attributes
+		cred["encryptedAttributes"] = credreq.EncryptedAttributes
+
+		bts, err := json.Marshal(msg)
+		require.NoError(t, err)
+		return string(bts)
+	}
+}
+
+func TestEncryptedAttributes(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	t.Run("mixed", func(t *testing.T) {
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		server.hello = true
+		server.inject(mockEndpointHello, mockFault{Rewrite: encryptAttributes(t, server, nil, "studentID", "level")})
+
+		h := newMockSessionHandler(t)
+		client.NewSession(server.Qr(), h)
+		request := (<-h.permissionRequested).(*irma.IssuanceRequest)
+		require.Empty(t, request.Credentials[0].EncryptedAttributes)
+		require.Equal(t, studentCardIssuanceRequest().Credentials[0].Attributes, request.Credentials[0].Attributes)
+		require.Nil(t, h.wait().err)
+		require.Len(t, server.greeted.EncryptionKey, irma.SessionKeyLength)
+
+		attrs := client.attrs(studentCard)
+		require.Len(t, attrs, 1)
+		studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+		require.Equal(t, "s1234567", *attrs[0].UntranslatedAttribute(studentID))
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		other, _, err := irma.GenerateSessionKey(rand.Reader)
+		require.NoError(t, err)
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		server.hello = true
+		server.inject(mockEndpointHello, mockFault{Rewrite: encryptAttributes(t, server, other[:], "studentID")})
+
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorCrypto, result.err.ErrorType)
+	})
+
+	t.Run("no key sent", func(t *testing.T) {
+		other, _, err := irma.GenerateSessionKey(rand.Reader)
+		require.NoError(t, err)
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		server.inject(mockEndpointRequest, mockFault{Rewrite: encryptAttributes(t, server, other[:], "studentID")})
+
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorInvalidRequest, result.err.ErrorType)
+	})
+}
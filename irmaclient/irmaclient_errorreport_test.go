@@ -0,0 +1,84 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorReport(t *testing.T) {
+	SetErrorReports(true)
+	defer SetErrorReports(false)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	request := studentCardIssuanceRequest()
+	server := newMockServer(t, request)
+	defer server.Close()
+	server.inject(mockEndpointCommitments, mockFault{Status: http.StatusBadRequest})
+
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorApi, result.err.ErrorType)
+
+	// The report was posted before the handler was informed, and the session deleted afterwards
+	server.waitDeleted()
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointCommitments, mockEndpointError, mockEndpointDelete}, server.Calls())
+	require.Len(t, server.reports, 1)
+	report := &irma.ClientErrorReport{}
+	require.NoError(t, json.Unmarshal([]byte(server.reports[0]), report))
+	require.Equal(t, irma.ErrorApi, report.ErrorType)
+	require.Equal(t, "INJECTED_FAULT", report.RemoteError)
+	require.Equal(t, http.StatusBadRequest, report.RemoteStatus)
+	require.Equal(t, irma.ClientStatusCommunicating, report.Phase)
+	require.Equal(t, irma.ActionIssuing, report.Action)
+	require.Equal(t, irma.Version, report.ClientVersion)
+	require.NotNil(t, report.ProtocolVersion)
+	require.Contains(t, report.Timings, "proofs")
+
+	// The report contains nothing from the request
+	for _, value := range request.Credentials[0].Attributes {
+		if len(value) > 3 { // shorter values may occur in the timings by chance
+			require.NotContains(t, server.reports[0], value)
+		}
+	}
+	require.NotContains(t, server.reports[0], request.Nonce.String())
+	require.NotContains(t, server.reports[0], "studentCard")
+}
+
+func TestErrorReportNotSent(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// Reports are opt-in
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	server.inject(mockEndpointProofs, mockFault{Status: http.StatusBadRequest})
+	require.NotNil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+	server.waitDeleted()
+	require.NotContains(t, server.Calls(), mockEndpointError)
+
+	// Nor are failures reported before the server handed out the session request
+	SetErrorReports(true)
+	defer SetErrorReports(false)
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	server.inject(mockEndpointRequest, mockFault{Status: http.StatusBadRequest})
+	require.NotNil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+	require.NotContains(t, server.Calls(), mockEndpointError)
+
+	// Failures to post the report are ignored
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	server.inject(mockEndpointProofs, mockFault{Status: http.StatusBadRequest})
+	server.inject(mockEndpointError, mockFault{Status: http.StatusInternalServerError})
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorApi, result.err.ErrorType)
+	require.Equal(t, "INJECTED_FAULT", result.err.RemoteError.ErrorName)
+	require.Contains(t, server.Calls(), mockEndpointError)
+}
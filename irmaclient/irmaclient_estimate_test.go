@@ -0,0 +1,101 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// estimateHandler records the estimate of the response it receives.
+type estimateHandler struct {
+	*mockSessionHandler
+	estimate *ResponseEstimate
+}
+
+func (h *estimateHandler) ResponseEstimate(estimate *ResponseEstimate) {
+	h.estimate = estimate
+}
+
+func TestEstimateResponse(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	request := studentIDRequest()
+	request.Context = big.NewInt(1337)
+	request.Nonce = big.NewInt(42)
+	choice := studentIDChoice(t, client, request)
+	estimate, err := client.EstimateResponse(request, choice)
+	require.NoError(t, err)
+	require.Equal(t, 1, estimate.Credentials)
+
+	// The size is close to that of the actual response
+	disclosure, _, err := client.Proofs(choice, request)
+	require.NoError(t, err)
+	bts, err := json.Marshal(disclosure.Disclosure)
+	require.NoError(t, err)
+	require.InDelta(t, len(bts), estimate.Bytes, 0.2*float64(len(bts)))
+
+	// Issuing credentials adds their proofs
+	issuance := studentCardIssuanceRequest()
+	issuance.Disclose = request.Disclose
+	issuanceEstimate, err := client.EstimateResponse(issuance, choice)
+	require.NoError(t, err)
+	require.Equal(t, 2, issuanceEstimate.Credentials)
+	require.Greater(t, issuanceEstimate.Bytes, estimate.Bytes)
+	require.Greater(t, issuanceEstimate.Milliseconds, estimate.Milliseconds)
+}
+
+func TestEstimateResponseConverges(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	request := studentIDRequest()
+	costs, err := client.proofCosts(request, studentIDChoice(t, client, request))
+	require.NoError(t, err)
+	require.Len(t, costs, 1)
+	keySize := costs[0].keySize
+	initial := proofTiming(nil, keySize)
+
+	// The estimate moves towards the observed timings
+	observed := time.Duration(4*initial) * time.Millisecond
+	previous := initial
+	for i := 0; i < 30; i++ {
+		client.observeProofTiming(costs, observed)
+		current := client.proofTimings()[keySize]
+		require.Greater(t, current, previous)
+		previous = current
+	}
+	require.InDelta(t, float64(observed.Microseconds())/1000, previous, 0.01*initial)
+
+	// The timings are stored
+	require.NoError(t, client.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	require.InDelta(t, previous, client.proofTimings()[keySize], 0.001)
+
+	// Sessions report the estimate before permission, and update the timings afterwards
+	timings := map[int]float64{keySize: 1}
+	require.NoError(t, client.storage.Transaction(func(tx *transaction) error {
+		return client.storage.txStore(tx, userdataBucket, proofTimingsKey, timings)
+	}))
+	client.proofTimingsCache = nil
+	server := newMockServer(t, request)
+	defer server.Close()
+	h := &estimateHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	require.Nil(t, h.wait().err)
+	require.NotNil(t, h.estimate)
+	require.Equal(t, int64(1), h.estimate.Milliseconds)
+	require.NotEqual(t, 1.0, client.proofTimings()[keySize])
+}
+
+func TestProofTimingKeySizes(t *testing.T) {
+	require.Equal(t, defaultProofTimings[2048], proofTiming(nil, 2048))
+	require.Equal(t, 50.0, proofTiming(map[int]float64{2048: 50}, 2048))
+	// Unknown key sizes are scaled from the nearest one
+	require.InDelta(t, defaultProofTimings[2048]*3.375, proofTiming(nil, 3072), 0.001)
+	require.InDelta(t, defaultProofTimings[4096]*8, proofTiming(nil, 8192), 0.001)
+}
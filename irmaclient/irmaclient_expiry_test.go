@@ -0,0 +1,95 @@
+package irmaclient
+
+import (
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// expiringSessionHandler records expiry warnings, and leaves permission requests unanswered
+// unless answer is set, so that the user can be made to take too long.
+type expiringSessionHandler struct {
+	*mockSessionHandler
+	answer   bool
+	expiring chan int
+	callback chan PermissionHandler
+}
+
+func newExpiringSessionHandler(t *testing.T, answer bool) *expiringSessionHandler {
+	return &expiringSessionHandler{
+		mockSessionHandler: newMockSessionHandler(t),
+		answer:             answer,
+		expiring:           make(chan int, 1),
+		callback:           make(chan PermissionHandler, 1),
+	}
+}
+
+func (h *expiringSessionHandler) SessionExpiring(remaining int) {
+	h.expiring <- remaining
+}
+
+func (h *expiringSessionHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	if h.answer {
+		h.mockSessionHandler.RequestVerificationPermission(request, satisfiable, candidates, requestor, callback)
+		return
+	}
+	h.callback <- callback
+}
+
+func TestSessionExpiry(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("expires while asking permission", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		server.lifetime = 1
+
+		h := newExpiringSessionHandler(t, false)
+		session := client.NewSession(server.Qr(), h)
+		require.Equal(t, 1, <-h.expiring)
+		result := h.wait()
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorSessionExpired, result.err.ErrorType)
+		require.ErrorIs(t, result.err, errSessionExpired)
+		require.Equal(t, irma.ClientStatusTimeout, session.Status())
+
+		// Giving permission afterwards does not send proofs that the server would reject
+		(<-h.callback)(true, &irma.DisclosureChoice{})
+		server.waitDeleted()
+		require.Equal(t, []string{mockEndpointRequest, mockEndpointDelete}, server.Calls())
+		require.Empty(t, h.result)
+	})
+
+	t.Run("completed before expiry", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		server.lifetime = int((sessionExpiryWarning + time.Second) / time.Second)
+
+		h := newExpiringSessionHandler(t, true)
+		client.NewSession(server.Qr(), h)
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.Equal(t, irma.ServerStatusDone, server.Status())
+
+		// The countdown has been cancelled, so that the warning does not fire after completion
+		time.Sleep(1500 * time.Millisecond)
+		require.Empty(t, h.expiring)
+	})
+
+	t.Run("unknown lifetime", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+
+		h := newExpiringSessionHandler(t, true)
+		client.NewSession(server.Qr(), h)
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.Empty(t, h.expiring)
+	})
+}
@@ -0,0 +1,116 @@
+package irmaclient
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/concmap"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptingHandler corrupts the stored signature of the first candidate of the first disjunction
+// after the candidates have been computed, so that building its proof fails.
+type corruptingHandler struct {
+	*mockSessionHandler
+	client    *Client
+	corrupted *irma.CredentialIdentifier
+}
+
+func (h *corruptingHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	id := candidates[0][0][0].CredentialIdentifier()
+	h.corrupted = &id
+	require.NoError(h.t, h.client.storage.Transaction(func(tx *transaction) error {
+		return tx.Bucket([]byte(signaturesBucket)).Put([]byte(id.Hash), []byte("corrupted"))
+	}))
+	h.client.credentialsCache = concmap.New[credLookup, *credential]()
+	h.mockSessionHandler.RequestVerificationPermission(request, satisfiable, candidates, requestor, callback)
+}
+
+func runCorruptingSession(t *testing.T, client *Client, request irma.SessionRequest) (*mockServer, *corruptingHandler, mockSessionResult) {
+	server := newMockServer(t, request)
+	h := &corruptingHandler{mockSessionHandler: newMockSessionHandler(t), client: client}
+	client.NewSession(server.Qr(), h)
+	return server, h, h.wait()
+}
+
+func issueStudentCard(t *testing.T, client *Client, studentID string) {
+	request := studentCardIssuanceRequest()
+	request.Credentials[0].Attributes["studentID"] = studentID
+	server := newMockServer(t, request)
+	defer server.Close()
+	require.Nil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+}
+
+func studentIDCandidates(t *testing.T, client *Client) []*irma.CredentialIdentifier {
+	candidates, satisfiable, err := client.Candidates(studentIDRequest())
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	var creds []*irma.CredentialIdentifier
+	for _, set := range candidates[0] {
+		if set[0].CredentialHash != "" {
+			id := set[0].CredentialIdentifier()
+			creds = append(creds, &id)
+		}
+	}
+	return creds
+}
+
+func TestProofFallback(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// A second student card with the same studentID as the one in storage
+	issueStudentCard(t, client, "456")
+	require.Len(t, studentIDCandidates(t, client), 2)
+	sub := client.Subscribe(10)
+	defer sub.Unsubscribe()
+
+	// The credential chosen by the user cannot be used, so the session discloses from the other
+	server, h, result := runCorruptingSession(t, client, studentIDRequest())
+	defer server.Close()
+	require.Nil(t, result.err)
+	require.Equal(t, "456", *server.disclosed[0][0].RawValue)
+
+	require.Equal(t, []irma.CredentialIdentifier{*h.corrupted}, client.QuarantinedCredentials())
+	var quarantined []CredentialQuarantined
+	for len(sub.Events()) > 0 {
+		if e, ok := (<-sub.Events()).(CredentialQuarantined); ok {
+			quarantined = append(quarantined, e)
+		}
+	}
+	require.Len(t, quarantined, 1)
+	require.Equal(t, *h.corrupted, quarantined[0].ID)
+	require.NotEmpty(t, quarantined[0].Error)
+
+	// The quarantined credential is no longer a candidate
+	creds := studentIDCandidates(t, client)
+	require.Len(t, creds, 1)
+	require.NotEqual(t, h.corrupted.Hash, creds[0].Hash)
+}
+
+func TestProofFallbackDifferentValue(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// Another student card exists, but it would disclose another studentID than the user chose
+	issueStudentCard(t, client, "789")
+	require.Len(t, studentIDCandidates(t, client), 2)
+
+	server, h, result := runCorruptingSession(t, client, studentIDRequest())
+	defer server.Close()
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorCrypto, result.err.ErrorType)
+	require.Equal(t, []string{mockEndpointRequest}, server.Calls())
+	require.Equal(t, []irma.CredentialIdentifier{*h.corrupted}, client.QuarantinedCredentials())
+
+	// The user can choose the other one in the next session
+	creds := studentIDCandidates(t, client)
+	require.Len(t, creds, 1)
+	require.NotEqual(t, h.corrupted.Hash, creds[0].Hash)
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	require.Nil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+}
@@ -0,0 +1,106 @@
+package irmaclient
+
+import (
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// storeOrphans stores a signature, nickname, keyshare enrollment and credential type key that
+// nothing refers to.
+func storeOrphans(t *testing.T, client *Client) {
+	sig, witness, err := client.storage.LoadSignature(client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))[0])
+	require.NoError(t, err)
+	require.NoError(t, client.storage.Transaction(func(tx *transaction) error {
+		if err := client.storage.TxStoreCLSignature(tx, "orphan", &clSignatureWitness{CLSignature: sig, Witness: witness}); err != nil {
+			return err
+		}
+
+		nicknames := map[string]string{"orphan": "nickname"}
+		for hash, nickname := range client.nicknames {
+			nicknames[hash] = nickname
+		}
+		if err := client.storage.TxStoreNicknames(tx, nicknames); err != nil {
+			return err
+		}
+
+		ksses := map[irma.SchemeManagerIdentifier]*keyshareServer{
+			irma.NewSchemeManagerIdentifier("uninstalled"): {Username: "orphan"},
+		}
+		for schemeID, kss := range client.keyshareServers {
+			ksses[schemeID] = kss
+		}
+		if err := client.storage.TxStoreKeyshareServers(tx, ksses); err != nil {
+			return err
+		}
+
+		_, err := client.storage.credTypeKey(tx, irma.NewCredentialTypeIdentifier("irma-demo.RU.orphan"))
+		return err
+	}))
+}
+
+func TestGarbageCollect(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	studentCard := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))[0]
+	require.NoError(t, client.SetCredentialNickname(studentCard.Hash(), "mine"))
+	credentials := credentialCount(client)
+	enrolled := len(client.keyshareServers)
+	storeOrphans(t, client)
+
+	report, err := client.GarbageCollect()
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Signatures)
+	require.Equal(t, 1, report.Nicknames)
+	require.Equal(t, []irma.SchemeManagerIdentifier{irma.NewSchemeManagerIdentifier("uninstalled")}, report.KeyshareEnrollments)
+	require.Equal(t, 1, report.CredentialTypeKeys)
+
+	// Nothing that is referenced was removed
+	report, err = client.GarbageCollect()
+	require.NoError(t, err)
+	require.True(t, report.Empty())
+	require.Equal(t, credentials, credentialCount(client))
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			sig, _, err := client.storage.LoadSignature(attrs)
+			require.NoError(t, err)
+			require.NotNil(t, sig)
+		}
+	}
+	require.Equal(t, "mine", client.nicknames[studentCard.Hash()])
+	require.Len(t, client.keyshareServers, enrolled)
+	ksses, err := client.storage.LoadKeyshareServers()
+	require.NoError(t, err)
+	require.Len(t, ksses, enrolled)
+
+	// The credentials can still be used
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	require.Nil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+}
+
+func TestGarbageCollectAtStartup(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer func() { test.ClearTestStorage(t, client, handler.storage) }()
+	storeOrphans(t, client)
+
+	// Garbage was collected when the client started, so it is not collected again yet
+	require.NoError(t, client.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	found, err := client.storage.load(signaturesBucket, "orphan", &clSignatureWitness{})
+	require.NoError(t, err)
+	require.True(t, found)
+
+	defer func(interval time.Duration) { garbageCollectInterval = interval }(garbageCollectInterval)
+	garbageCollectInterval = 0
+	require.NoError(t, client.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	found, err = client.storage.load(signaturesBucket, "orphan", &clSignatureWitness{})
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NotContains(t, client.keyshareServers, irma.NewSchemeManagerIdentifier("uninstalled"))
+}
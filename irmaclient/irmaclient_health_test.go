@@ -0,0 +1,161 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// dateStub answers all requests with an empty response whose Date header is off by skew.
+type dateStub struct {
+	skew time.Duration
+}
+
+func (s dateStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Date", time.Now().Add(s.skew).UTC().Format(http.TimeFormat))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// failingRoundTripper fails all requests.
+type failingRoundTripper struct{}
+
+func (failingRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("no network")
+}
+
+func TestHealthCheck(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	client.SetTransportRoundTripper(dateStub{skew: -time.Hour})
+
+	report := client.HealthCheck(0)
+	require.True(t, report.Complete)
+	require.True(t, report.Storage.Readable)
+	require.False(t, report.Storage.InMemory)
+	require.Equal(t, len(clientUpdates), report.Storage.LatestSchemaVersion)
+	if err := client.VerifyLogIntegrity(); err != nil {
+		// The log entries of the test storage predate the chaining of log entries
+		require.Equal(t, err.Error(), report.Storage.LogIntegrityError)
+	}
+	require.True(t, report.SecretKey.Present)
+	require.False(t, report.SecretKey.Locked)
+
+	require.Equal(t, credentialCount(client), report.Credentials.Count)
+	require.NotZero(t, report.Credentials.Count)
+	require.Equal(t, report.Credentials.Count, report.Credentials.Verified+report.Credentials.UnknownPublicKey)
+	require.Empty(t, report.Credentials.Invalid)
+	require.Zero(t, report.Credentials.Unchecked)
+
+	require.Len(t, report.Schemes, len(client.Configuration.SchemeManagers)+len(client.Configuration.DisabledSchemeManagers))
+	var ids []string
+	for _, scheme := range report.Schemes {
+		ids = append(ids, scheme.ID.String())
+		if scheme.ID == irma.NewSchemeManagerIdentifier("test") {
+			require.True(t, scheme.Keyshare)
+			require.Equal(t, client.keyshareServers[scheme.ID] != nil, scheme.Enrolled)
+		}
+	}
+	require.IsIncreasing(t, ids)
+
+	require.Empty(t, report.Clock.Error)
+	require.NotEmpty(t, report.Clock.Server)
+	require.InDelta(t, time.Hour.Seconds(), report.Clock.Skew.Seconds(), 5)
+
+	// The report contains no attribute values
+	bts, err := json.Marshal(report)
+	require.NoError(t, err)
+	for _, info := range client.CredentialInfoList() {
+		for _, value := range info.Attributes {
+			if v := value[""]; strings.IndexFunc(v, unicode.IsLetter) >= 0 {
+				require.NotContains(t, string(bts), v)
+			}
+		}
+	}
+}
+
+func TestHealthCheckProblems(t *testing.T) {
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	t.Run("invalid signature", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		client.SetTransportRoundTripper(dateStub{})
+
+		// Store the signature of another credential as that of the student card
+		var other *irma.AttributeList
+		for id, attrlistlist := range client.attributes {
+			if id != studentCard && len(attrlistlist) > 0 {
+				other = attrlistlist[0]
+			}
+		}
+		sig, witness, err := client.storage.LoadSignature(other)
+		require.NoError(t, err)
+		require.NoError(t, client.storage.Transaction(func(tx *transaction) error {
+			return client.storage.TxStoreCLSignature(tx, client.attrs(studentCard)[0].Hash(),
+				&clSignatureWitness{CLSignature: sig, Witness: witness})
+		}))
+
+		report := client.HealthCheck(0)
+		require.Equal(t, []irma.CredentialTypeIdentifier{studentCard}, report.Credentials.Invalid)
+		require.True(t, report.Complete)
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		client.SetTransportRoundTripper(dateStub{})
+		client.Lock()
+
+		report := client.HealthCheck(0)
+		require.False(t, report.SecretKey.Present)
+		require.True(t, report.SecretKey.Locked)
+		require.Equal(t, report.Credentials.Count, report.Credentials.Unchecked)
+		require.False(t, report.Complete)
+	})
+
+	t.Run("time limit", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+
+		start := time.Now()
+		report := client.HealthCheck(time.Nanosecond)
+		require.Less(t, time.Since(start), 5*time.Second)
+		require.False(t, report.Complete)
+		require.Equal(t, report.Credentials.Count, report.Credentials.Unchecked)
+		require.NotEmpty(t, report.Clock.Error)
+	})
+
+	t.Run("memory client", func(t *testing.T) {
+		client := parseMemoryClient(t)
+		defer func() { require.NoError(t, client.Close()) }()
+
+		// The clock is compared with that of the scheme server of the tests
+		report := client.HealthCheck(0)
+		require.True(t, report.Complete)
+		require.True(t, report.Storage.InMemory)
+		require.True(t, report.Storage.Readable)
+		require.Zero(t, report.Credentials.Count)
+		require.Empty(t, report.Clock.Error)
+		require.InDelta(t, 0, report.Clock.Skew.Seconds(), 5)
+
+		client.SetTransportRoundTripper(failingRoundTripper{})
+		report = client.HealthCheck(0)
+		require.NotEmpty(t, report.Clock.Error)
+		require.True(t, report.Clock.ServerTime.IsZero())
+	})
+}
@@ -0,0 +1,90 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonChoiceHandler answers permission requests as UI layers do: it receives the candidates in
+// JSON and passes back the choice in JSON.
+type jsonChoiceHandler struct {
+	*mockSessionHandler
+	candidates chan string
+}
+
+func (h *jsonChoiceHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, _ *irma.RequestorInfo, callback PermissionHandler,
+) {
+	bts, err := json.Marshal(candidates)
+	require.NoError(h.t, err)
+	h.candidates <- string(bts)
+
+	var parsed [][][]map[string]interface{}
+	require.NoError(h.t, json.Unmarshal(bts, &parsed))
+	var attrs []interface{}
+	for _, discon := range parsed {
+		var con []interface{}
+		for _, cand := range discon[0] {
+			con = append(con, map[string]interface{}{"type": cand["type"], "credentialHash": cand["credentialHash"]})
+		}
+		attrs = append(attrs, con)
+	}
+	choiceJson, err := json.Marshal(map[string]interface{}{"attributes": attrs})
+	require.NoError(h.t, err)
+
+	choice := &irma.DisclosureChoice{}
+	require.NoError(h.t, json.Unmarshal(choiceJson, choice))
+	callback(true, choice)
+}
+
+func TestCandidatesJSONShape(t *testing.T) {
+	candidates := [][]DisclosureCandidates{{{{
+		AttributeIdentifier: &irma.AttributeIdentifier{
+			Type:           irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+			CredentialHash: "hash",
+		},
+		Value:    irma.NewTranslatedString(&[]string{"s1234567"}[0]),
+		Expired:  true,
+		Nickname: "card",
+	}}}}
+	bts, err := json.Marshal(candidates)
+	require.NoError(t, err)
+	require.JSONEq(t, `[[[{
+		"type": "irma-demo.RU.studentCard.studentID",
+		"credentialHash": "hash",
+		"value": {"": "s1234567", "en": "s1234567", "nl": "s1234567"},
+		"expired": true,
+		"revoked": false,
+		"notRevokable": false,
+		"nickname": "card"
+	}]]]`, string(bts))
+
+	var parsed [][]DisclosureCandidates
+	require.NoError(t, json.Unmarshal(bts, &parsed))
+	require.Equal(t, candidates, parsed)
+}
+
+func TestMockServerChoiceFromJSON(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{LDContext: irma.LDContextDisclosureRequest},
+		Disclose: irma.AttributeConDisCon{
+			{{irma.NewAttributeRequest("irma-demo.RU.studentCard.studentID")}},
+			{{irma.NewAttributeRequest("irma-demo.RU.studentCard.university")}},
+		},
+	})
+	defer server.Close()
+
+	h := &jsonChoiceHandler{mockSessionHandler: newMockSessionHandler(t), candidates: make(chan string, 1)}
+	client.NewSession(server.Qr(), h)
+	result := h.wait()
+	require.Nil(t, result.err)
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+	require.Len(t, server.disclosed, 2)
+	require.Contains(t, <-h.candidates, `"credentialHash":`)
+}
@@ -0,0 +1,235 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// omitKeyCounter rewrites the session request as if the server did not specify the nonzero key counter.
+func omitKeyCounter(counter string) func(string) string {
+	return func(s string) string {
+		return strings.Replace(s, `"keyCounter":`+counter+`,`, "", 1)
+	}
+}
+
+func TestMockServerZeroKeyCounter(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// The server omits the key counter as it is zero, which the client does not modify
+	id := irma.NewCredentialTypeIdentifier("irma-demo.stemmen.stempas")
+	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: id,
+		Attributes:       map[string]string{"election": "plantsoen"},
+	}})
+	bts, err := json.Marshal(request)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "keyCounter")
+
+	server := newMockServer(t, request)
+	defer server.Close()
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+
+	creds := client.attrs(id)
+	require.Len(t, creds, 1)
+	require.Equal(t, uint(0), creds[0].MetadataAttribute.KeyCounter())
+}
+
+func TestMockServerMissingKeyCounter(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	client.SetKeyCounterPolicy(KeyCounterRequire)
+
+	server := newMockServer(t, studentCardIssuanceRequest())
+	defer server.Close()
+	server.inject(mockEndpointRequest, mockFault{Rewrite: omitKeyCounter("2")})
+
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorMissingPublicKeyCounter, result.err.ErrorType)
+	require.Equal(t, "irma-demo.RU", result.err.Info)
+	require.NotContains(t, server.Calls(), mockEndpointCommitments)
+	require.Len(t, client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")), 1)
+}
+
+func TestMockServerInferKeyCounter(t *testing.T) {
+	t.Run("latest key", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		client.SetKeyCounterPolicy(KeyCounterInfer)
+
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		server.inject(mockEndpointRequest, mockFault{Rewrite: omitKeyCounter("2")})
+
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.Nil(t, result.err)
+		require.Equal(t, irma.ServerStatusDone, server.Status())
+		require.Len(t, client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")), 2)
+	})
+
+	t.Run("stale local keys", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		client.SetKeyCounterPolicy(KeyCounterInfer)
+
+		// The newest public key of irma-demo.MijnOverheid has expired, so key 1 is inferred
+		id := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+		server := newMockServer(t, irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+			CredentialTypeID: id,
+			KeyCounter:       1,
+			Attributes:       map[string]string{"BSN": "299792458"},
+		}}))
+		defer server.Close()
+		server.inject(mockEndpointRequest, mockFault{Rewrite: omitKeyCounter("1")})
+
+		h := newMockSessionHandler(t)
+		dismisser := client.NewSession(server.Qr(), h)
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.Equal(t, irma.ServerStatusDone, server.Status())
+		require.Equal(t, uint(1), dismisser.Summary().KeyCounters[0].Counter)
+
+		creds := client.attrs(id)
+		require.Len(t, creds, 1)
+		require.Equal(t, uint(1), creds[0].MetadataAttribute.KeyCounter())
+	})
+}
+
+func TestResolveKeyCounters(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	parse := func(credtype, counter string) *irma.IssuanceRequest {
+		field := ""
+		if counter != "" {
+			field = `"keyCounter":` + counter + `,`
+		}
+		ir := &irma.IssuanceRequest{}
+		require.NoError(t, json.Unmarshal([]byte(`{"@context":"https://irma.app/ld/request/issuance/v2",`+
+			`"credentials":[{`+field+`"credential":"`+credtype+`","attributes":{}}]}`), ir))
+		return ir
+	}
+
+	t.Run("zero counter", func(t *testing.T) {
+		// irma-demo.stemmen has just key 0, which must not be mistaken for a missing key counter
+		ir := parse("irma-demo.stemmen.stempas", "0")
+		require.True(t, ir.Credentials[0].HasKeyCounter())
+		require.Nil(t, client.resolveKeyCounters(ir))
+		require.Equal(t, uint(0), ir.Credentials[0].KeyCounter)
+		require.NoError(t, checkKey(client.Configuration, irma.NewIssuerIdentifier("irma-demo.stemmen"), 0, time.Now()))
+
+		// Nor is an explicit key counter replaced when inference is enabled
+		client.SetKeyCounterPolicy(KeyCounterInfer)
+		defer client.SetKeyCounterPolicy(KeyCounterZero)
+		ir = parse("irma-demo.RU.studentCard", "0")
+		require.Nil(t, client.resolveKeyCounters(ir))
+		require.Equal(t, uint(0), ir.Credentials[0].KeyCounter)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		// As IRMA servers omit zero key counters, key 0 is used by default
+		ir := parse("irma-demo.RU.studentCard", "")
+		require.False(t, ir.Credentials[0].HasKeyCounter())
+		require.Nil(t, client.resolveKeyCounters(ir))
+		require.True(t, ir.Credentials[0].HasKeyCounter())
+		require.Equal(t, uint(0), ir.Credentials[0].KeyCounter)
+
+		client.SetKeyCounterPolicy(KeyCounterRequire)
+		defer client.SetKeyCounterPolicy(KeyCounterZero)
+		ir = parse("irma-demo.stemmen.stempas", "")
+		err := client.resolveKeyCounters(ir)
+		require.NotNil(t, err)
+		require.Equal(t, irma.ErrorMissingPublicKeyCounter, err.ErrorType)
+		require.Equal(t, "irma-demo.stemmen", err.Info)
+	})
+
+	t.Run("stale local keys", func(t *testing.T) {
+		client.SetKeyCounterPolicy(KeyCounterInfer)
+		defer client.SetKeyCounterPolicy(KeyCounterZero)
+
+		ir := parse("irma-demo.MijnOverheid.root", "")
+		require.Nil(t, client.resolveKeyCounters(ir))
+		require.True(t, ir.Credentials[0].HasKeyCounter())
+		require.Equal(t, uint(1), ir.Credentials[0].KeyCounter)
+
+		// Nor can a key counter be inferred for issuers without local public keys
+		_, err := latestValidKey(client.Configuration, irma.NewIssuerIdentifier("irma-demo.unknown"))
+		require.Error(t, err)
+	})
+}
+
+// issuancePermissionHandler records the issuance request passed to it, and calls before, if set,
+// before granting permission.
+type issuancePermissionHandler struct {
+	*mockSessionHandler
+	request *irma.IssuanceRequest
+	before  func()
+}
+
+func (h *issuancePermissionHandler) RequestIssuancePermission(request *irma.IssuanceRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.request = request
+	if h.before != nil {
+		h.before()
+	}
+	h.mockSessionHandler.RequestIssuancePermission(request, satisfiable, candidates, requestor, callback)
+}
+
+// setDeviceTime fixes the time of the device of the client, or resets it if now is zero.
+func setDeviceTime(client *Client, now time.Time) {
+	client.clock.Lock()
+	defer client.clock.Unlock()
+	client.clock.device = nil
+	if !now.IsZero() {
+		client.clock.device = func() time.Time { return now }
+	}
+}
+
+func TestMockServerKeyRollover(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	pk, err := client.Configuration.PublicKey(irma.NewIssuerIdentifier("irma-demo.RU"), 2)
+	require.NoError(t, err)
+	expiry := time.Unix(pk.ExpiryDate, 0)
+
+	t.Run("current key", func(t *testing.T) {
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		h := &issuancePermissionHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		change := h.request.CredentialChanges[0]
+		require.Equal(t, irma.KeyStatusValid, change.KeyStatus)
+		require.Equal(t, pk.ExpiryDate, time.Time(*change.KeyExpires).Unix())
+	})
+
+	t.Run("expires soon", func(t *testing.T) {
+		changes, err := client.credentialChanges(studentCardIssuanceRequest(), irma.NewVersion(2, 8), expiry.Add(-24*time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, irma.KeyStatusDeprecated, changes[0].KeyStatus)
+	})
+
+	t.Run("expired upon issuance", func(t *testing.T) {
+		defer setDeviceTime(client, time.Time{})
+		count := credentialCount(client)
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		h := &issuancePermissionHandler{mockSessionHandler: newMockSessionHandler(t)}
+		h.before = func() { setDeviceTime(client, expiry.Add(maxClockCorrection+time.Hour)) }
+		client.NewSession(server.Qr(), h)
+		result := h.wait()
+		require.NotNil(t, result.err)
+		require.Contains(t, result.err.Error(), "expired key")
+		require.Equal(t, count, credentialCount(client))
+	})
+}
@@ -1,8 +1,24 @@
 package irmaclient
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
 
 	"github.com/stretchr/testify/require"
 
@@ -34,7 +50,7 @@ func TestKeyshareChangePin(t *testing.T) {
 	// Test whether the authorization token is still valid after changing the PIN.
 	transport := irma.NewHTTPTransport(fmt.Sprintf("http://%s", ks1.Addr), false)
 	transport.SetHeader("X-IRMA-Keyshare-Username", client.keyshareServers[testSchemeID].Username)
-	transport.SetHeader("Authorization", client.keyshareServers[testSchemeID].token)
+	transport.SetHeader("Authorization", client.keyshareToken(client.keyshareServers[testSchemeID]))
 	reqBody := []string{"test.test-0"}
 	comms := &irma.ProofPCommitmentMap{}
 	err := transport.Post("prove/getCommitments", comms, reqBody)
@@ -44,6 +60,63 @@ func TestKeyshareChangePin(t *testing.T) {
 	require.NoError(t, <-handler.c)
 }
 
+func TestKeysharePinPolicy(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	test2SchemeID := irma.NewSchemeManagerIdentifier("test2")
+	ks1 := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks1.Stop()
+	ks2 := testkeyshare.StartKeyshareServer(t, irma.Logger, test2SchemeID)
+	defer ks2.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	requirePolicyViolation := func(err error, constraint string) {
+		require.True(t, irma.IsErrorType(err, irma.ErrorKeysharePinPolicy))
+		require.Equal(t, constraint, err.(*irma.SessionError).Info)
+	}
+	scheme := client.Configuration.SchemeManagers[test2SchemeID]
+	scheme.KeysharePinMinLength = 6
+
+	// If the keyshare server does not publish its PIN policy, that of the scheme is used
+	kssURL := scheme.KeyshareServer
+	target, err := url.Parse(kssURL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	oldServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/client/pin_policy") {
+			http.NotFound(w, r)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer oldServer.Close()
+	scheme.KeyshareServer = oldServer.URL
+	client.KeyshareEnroll(test2SchemeID, nil, "12345", "en")
+	requirePolicyViolation(<-handler.c, "min_length")
+	scheme.KeyshareServer = kssURL
+
+	// The published PIN policy takes precedence; it requires at least 5 characters
+	client.KeyshareEnroll(test2SchemeID, nil, "1234", "en")
+	requirePolicyViolation(<-handler.c, "min_length")
+	client.KeyshareEnroll(test2SchemeID, nil, "12345", "en")
+	require.NoError(t, <-handler.c)
+	require.Equal(t, &irma.KeysharePinPolicy{MinLength: 5}, client.KeysharePinPolicy(test2SchemeID))
+	require.Equal(t, 5, client.KeysharePinPolicy(test2SchemeID).MinLength)
+
+	// New PINs are checked against the stored PIN policies
+	client.KeyshareChangePin("12345", "1234")
+	requirePolicyViolation(<-handler.c, "min_length")
+	client.keyshareServers[test2SchemeID].PinPolicy.Characters = "0123456789"
+	client.KeyshareChangePin("12345", "1234a")
+	requirePolicyViolation(<-handler.c, "characters")
+	client.keyshareServers[test2SchemeID].PinPolicy.MaxLength = 6
+	client.KeyshareChangePin("12345", "1234567")
+	requirePolicyViolation(<-handler.c, "max_length")
+
+	// The PIN was not changed
+	verifyPin(t, client)
+}
+
 func TestKeyshareChangePinFailed(t *testing.T) {
 	ks1 := testkeyshare.StartKeyshareServer(t, irma.Logger, irma.NewSchemeManagerIdentifier("test"))
 	ks1Stopped := false
@@ -95,13 +168,13 @@ func TestKeyshareChallengeResponseUpgrade(t *testing.T) {
 
 	// Actually trigger the public key registration mechanism using the correct PIN
 	verifyPin(t, client)
-	require.NotEmpty(t, kss.token)
+	require.NotEmpty(t, client.keyshareToken(kss))
 
 	// challenge-response is now enforced for this account
 	checkChallengeResponseEnforced(t, kss)
 
 	// check PIN again using challenge-response
-	kss.token = "" // clear auth token we got from upgrading to challenge-response
+	client.setKeyshareToken(kss, "") // clear auth token we got from upgrading to challenge-response
 	verifyPin(t, client)
 }
 
@@ -120,6 +193,83 @@ func TestKeyshareAuthentication(t *testing.T) {
 	verifyPin(t, client)
 }
 
+func TestKeysharePinBackoff(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// The first incorrect PIN does not induce a backoff
+	verifyWrongPin(t, client)
+	require.Zero(t, client.KeysharePinBackoff(testSchemeID))
+
+	// The second does
+	succeeded, tries, blocked, err := client.KeyshareVerifyPin("00000", testSchemeID)
+	require.NoError(t, err)
+	require.False(t, succeeded)
+	require.Zero(t, blocked)
+	require.NotZero(t, tries)
+	require.InDelta(t, 30, client.KeysharePinBackoff(testSchemeID), 1)
+
+	// The backoff survives restarts
+	require.NoError(t, client.storage.db.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	require.InDelta(t, 30, client.KeysharePinBackoff(testSchemeID), 1)
+
+	// During the backoff, PINs are not sent to the keyshare server
+	_, _, _, err = client.KeyshareVerifyPin("12345", testSchemeID)
+	require.True(t, irma.IsErrorType(err, irma.ErrorKeysharePinBackoff))
+
+	// After the backoff the correct PIN resets it
+	client.keyshareServers[testSchemeID].LastPinFailure -= 30
+	require.Zero(t, client.KeysharePinBackoff(testSchemeID))
+	verifyPin(t, client)
+	require.Zero(t, client.keyshareServers[testSchemeID].PinFailures)
+}
+
+func TestKeysharePinStatus(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	require.Nil(t, client.KeysharePinStatus(irma.NewSchemeManagerIdentifier("irma-demo")))
+	status := client.KeysharePinStatus(testSchemeID)
+	require.Equal(t, -1, status.RemainingAttempts)
+	require.True(t, status.BlockedUntil.IsZero())
+
+	// Incorrect PINs update the remaining attempts, and block the user during the backoff
+	verifyWrongPin(t, client)
+	require.Equal(t, 1, client.KeysharePinStatus(testSchemeID).RemainingAttempts)
+	require.True(t, client.KeysharePinStatus(testSchemeID).BlockedUntil.IsZero())
+	_, tries, _, err := client.KeyshareVerifyPin("00000", testSchemeID)
+	require.NoError(t, err)
+	status = client.KeysharePinStatus(testSchemeID)
+	require.Equal(t, tries, status.RemainingAttempts)
+	require.WithinDuration(t, time.Now().Add(30*time.Second), status.BlockedUntil, 2*time.Second)
+
+	// The status survives restarts
+	require.NoError(t, client.storage.db.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	require.Equal(t, status, client.KeysharePinStatus(testSchemeID))
+
+	// The correct PIN resets it
+	client.keyshareServers[testSchemeID].LastPinFailure -= 30
+	verifyPin(t, client)
+	status = client.KeysharePinStatus(testSchemeID)
+	require.Equal(t, -1, status.RemainingAttempts)
+	require.True(t, status.BlockedUntil.IsZero())
+	require.WithinDuration(t, time.Now(), status.LastVerified, 2*time.Second)
+
+	// Blocking by the keyshare server is reported as well
+	client.updatePinStatus(client.keyshareServers[testSchemeID], kssPinError, 0, 3600)
+	status = client.KeysharePinStatus(testSchemeID)
+	require.Zero(t, status.RemainingAttempts)
+	require.WithinDuration(t, time.Now().Add(time.Hour), status.BlockedUntil, 2*time.Second)
+}
+
 // checkChallengeResponseEnforced manually sends a PIN auth message without challenge-response
 // to check that the server enforces challenge-response for this account.
 func checkChallengeResponseEnforced(t *testing.T, kss *keyshareServer) {
@@ -147,3 +297,726 @@ func verifyWrongPin(t *testing.T, client *Client) {
 	require.Zero(t, blocked)
 	require.Equal(t, 1, tries)
 }
+
+// pinCancellingHandler cancels PIN requests, invoking the callbacks repeatedly to check that
+// only the first invocation has effect.
+type pinCancellingHandler struct {
+	*mockSessionHandler
+	metadata chan PinMetadata
+}
+
+func (h *pinCancellingHandler) RequestPin(metadata PinMetadata, proceed func(pin string), cancel func()) {
+	cancel()
+	cancel()
+	proceed("12345")
+	h.metadata <- metadata
+}
+
+func TestKeysharePinCancel(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")))
+	defer server.Close()
+
+	h := &pinCancellingHandler{mockSessionHandler: newMockSessionHandler(t), metadata: make(chan PinMetadata, 1)}
+	session := client.NewSession(server.Qr(), h)
+	require.True(t, h.wait().cancelled)
+	require.Equal(t, PinMetadata{RemainingAttempts: -1, MinLength: 5}, <-h.metadata)
+
+	// The session was cancelled exactly once
+	server.waitDeleted()
+	require.Empty(t, h.result)
+	require.Equal(t, irma.ClientStatusCancelled, session.Status())
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointDelete}, server.Calls())
+}
+
+func TestKeysharePinMetadata(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	testSchemeID, test2SchemeID := irma.NewSchemeManagerIdentifier("test"), irma.NewSchemeManagerIdentifier("test2")
+	client.Configuration.SchemeManagers[testSchemeID].KeysharePinMaxLength = 16
+	client.Configuration.SchemeManagers[test2SchemeID].KeysharePinMinLength = 6
+	client.Configuration.SchemeManagers[test2SchemeID].KeysharePinMaxLength = 8
+
+	ks := &keyshareSession{client: client, schemeIDs: map[irma.SchemeManagerIdentifier]struct{}{testSchemeID: {}}}
+	require.Equal(t, PinMetadata{RemainingAttempts: -1, MinLength: 5, MaxLength: 16}, ks.pinMetadata(-1))
+
+	// The strictest bounds of all keyshare servers apply
+	ks.schemeIDs[test2SchemeID] = struct{}{}
+	ks.schemeIDs[irma.NewSchemeManagerIdentifier("irma-demo")] = struct{}{}
+	require.Equal(t, PinMetadata{RemainingAttempts: 2, MinLength: 6, MaxLength: 8, Retry: true}, ks.pinMetadata(2))
+}
+
+// pinCountingHandler enters the correct PIN, counting how often it is asked for.
+type pinCountingHandler struct {
+	*mockSessionHandler
+	pins int
+}
+
+func (h *pinCountingHandler) RequestPin(metadata PinMetadata, proceed func(pin string), cancel func()) {
+	h.pins++
+	proceed("12345")
+}
+
+// replaceKeyshareToken replaces the authorization token of the keyshare server by one signed
+// by the keyshare server, whose claims are modified by the specified function.
+func replaceKeyshareToken(t *testing.T, client *Client, kss *keyshareServer, modify func(claims jwt.MapClaims)) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(client.keyshareToken(kss), claims, client.Configuration.KeyshareServerKeyFunc(kss.SchemeManagerIdentifier))
+	require.NoError(t, err)
+	modify(claims)
+
+	bts, err := os.ReadFile(filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "kss-sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = 0
+	signed, err := token.SignedString(sk)
+	require.NoError(t, err)
+	client.setKeyshareToken(kss, signed)
+}
+
+func TestKeysharePinGracePeriod(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	kss := client.keyshareServers[testSchemeID]
+
+	// runSession runs a distributed session, returning how often the PIN was asked for.
+	// Each session starts with a token that expires too soon to be used outside of the grace period.
+	runSession := func() int {
+		if client.keyshareToken(kss) != "" {
+			replaceKeyshareToken(t, client, kss, func(claims jwt.MapClaims) {
+				claims["exp"] = time.Now().Add(30 * time.Second).Unix()
+			})
+		}
+		server := newMockServer(t, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")))
+		defer server.Close()
+		h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		return h.pins
+	}
+
+	// The second of two consecutive sessions does not ask for the PIN
+	require.Equal(t, 1, runSession())
+	require.Equal(t, 0, runSession())
+
+	// unless the cache is cleared,
+	client.ClearPinCache()
+	require.Equal(t, 1, runSession())
+
+	// the client is locked, which wipes the token,
+	token := kss.token
+	client.Lock()
+	require.Equal(t, make([]byte, len(token)), token)
+	require.NoError(t, client.Unlock())
+	require.Equal(t, 1, runSession())
+
+	// the grace period has passed,
+	kss.pinVerified = kss.pinVerified.Add(-defaultPinGracePeriod)
+	require.Equal(t, 1, runSession())
+
+	// If the keyshare server rejects the token within the grace period, the cached PIN is used
+	// to obtain a new one
+	require.Equal(t, 0, runSession())
+	replaceKeyshareToken(t, client, kss, func(claims jwt.MapClaims) {
+		claims["token_id"] = "AAAA"
+	})
+	require.Equal(t, 0, runSession())
+
+	// The grace period can be disabled
+	client.SetPinGracePeriod(0)
+	require.Equal(t, 1, runSession())
+	require.Equal(t, 1, runSession())
+}
+
+func TestKeysharePinGracePeriodTokenLifetime(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	kss := client.keyshareServers[testSchemeID]
+	lifetime := keysharecore.JWTPinExpiryDefault * time.Second
+
+	runSession := func() int {
+		server := newMockServer(t, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")))
+		defer server.Close()
+		h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		return h.pins
+	}
+	// elapse simulates that the specified time passes, by moving back the moment at which the user
+	// entered their PIN, and the token as the keyshare server issued it.
+	elapse := func(d time.Duration) {
+		client.pinMutex.Lock()
+		if !kss.pinVerified.IsZero() {
+			kss.pinVerified = kss.pinVerified.Add(-d)
+		}
+		client.pinMutex.Unlock()
+		replaceKeyshareToken(t, client, kss, func(claims jwt.MapClaims) {
+			iat, exp := int64(claims["iat"].(float64)), int64(claims["exp"].(float64))
+			require.Equal(t, int64(lifetime.Seconds()), exp-iat)
+			claims["iat"], claims["exp"] = iat-int64(d.Seconds()), exp-int64(d.Seconds())
+		})
+	}
+
+	// With the default grace period, which is shorter than the lifetime of the token, the token
+	// is reused as long as it remains valid long enough
+	require.Equal(t, 1, runSession())
+	elapse(lifetime - 2*time.Minute)
+	require.Equal(t, 0, runSession())
+	elapse(time.Minute + time.Second)
+	require.Equal(t, 1, runSession())
+
+	// Within a grace period exceeding the lifetime of the token, we obtain a new token using the
+	// PIN when the token expires, instead of asking the user
+	client.SetPinGracePeriod(2 * lifetime)
+	require.Equal(t, 0, runSession())
+	elapse(lifetime + time.Minute)
+	token := client.keyshareToken(kss)
+	require.Equal(t, 0, runSession())
+	require.NotEqual(t, token, client.keyshareToken(kss))
+
+	// Renewing the token does not extend the grace period
+	elapse(lifetime)
+	require.Equal(t, 1, runSession())
+}
+
+func TestKeysharePinWiped(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	kss := client.keyshareServers[irma.NewSchemeManagerIdentifier("test")]
+	pin := func() []byte {
+		client.pinMutex.Lock()
+		defer client.pinMutex.Unlock()
+		return kss.pin
+	}
+
+	// The PIN is wiped from memory at the end of the grace period, even if it is not used
+	client.SetPinGracePeriod(50 * time.Millisecond)
+	client.cachePin(kss, "12345")
+	cached := pin()
+	require.Equal(t, []byte("12345"), cached)
+	require.Eventually(t, func() bool { return pin() == nil }, time.Second, 10*time.Millisecond)
+	require.Equal(t, make([]byte, 5), cached)
+	_, ok := client.cachedPin(kss)
+	require.False(t, ok)
+
+	// as well as when the grace period is shortened to below the time since the PIN was entered,
+	client.SetPinGracePeriod(time.Hour)
+	client.cachePin(kss, "12345")
+	time.Sleep(10 * time.Millisecond)
+	client.SetPinGracePeriod(5 * time.Millisecond)
+	require.Empty(t, pin())
+
+	// and it is not kept at all if the grace period is disabled
+	client.SetPinGracePeriod(0)
+	client.cachePin(kss, "12345")
+	require.Empty(t, pin())
+}
+
+func TestKeyshareIssuance(t *testing.T) {
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, irma.NewSchemeManagerIdentifier("test"))
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	email := irma.NewAttributeTypeIdentifier("test.test.email.email")
+	existing := len(client.attrs(email.CredentialTypeIdentifier()))
+	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: email.CredentialTypeIdentifier(),
+		KeyCounter:       3,
+		Attributes:       map[string]string{"email": "distributed@example.com"},
+	}})
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	require.Nil(t, h.wait().err)
+	require.Equal(t, 1, h.pins)
+	require.Len(t, client.attrs(email.CredentialTypeIdentifier()), existing+1)
+
+	// The new credential is bound to the secret key shared with the keyshare server,
+	// so we can disclose it using the keyshare server
+	value := "distributed@example.com"
+	disclosure := irma.NewDisclosureRequest()
+	disclosure.Disclose = irma.AttributeConDisCon{{{{Type: email, Value: &value}}}}
+	server = newMockServer(t, disclosure)
+	defer server.Close()
+
+	h = &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	require.Nil(t, h.wait().err)
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+	require.Equal(t, value, *server.disclosed[0][0].RawValue)
+}
+
+// pinStoringHandler passes the callbacks of PIN requests to the test.
+type pinStoringHandler struct {
+	*mockSessionHandler
+	proceed chan func(pin string)
+}
+
+func (h *pinStoringHandler) RequestPin(metadata PinMetadata, proceed func(pin string), cancel func()) {
+	h.proceed <- proceed
+}
+
+// hangingKeyshareServer replaces the keyshare server of the test scheme by one that does not
+// respond until the test ends. Incoming requests, and requests whose client gave up, are reported
+// on the returned channels.
+func hangingKeyshareServer(t *testing.T, client *Client) (received, aborted chan struct{}, stop func()) {
+	received, aborted, release := make(chan struct{}, 10), make(chan struct{}, 10), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body) // after which the server notices when the client disconnects
+		received <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-release:
+		}
+	}))
+	scheme := client.Configuration.SchemeManagers[irma.NewSchemeManagerIdentifier("test")]
+	url := scheme.KeyshareServer
+	scheme.KeyshareServer = server.URL
+	return received, aborted, func() {
+		scheme.KeyshareServer = url
+		close(release)
+		server.Close()
+	}
+}
+
+func TestKeyshareSessionCancel(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	emailRequest := func() irma.SessionRequest {
+		return irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email"))
+	}
+
+	t.Run("pending PIN request", func(t *testing.T) {
+		ks := testkeyshare.StartKeyshareServer(t, irma.Logger, irma.NewSchemeManagerIdentifier("test"))
+		defer ks.Stop()
+		server := newMockServer(t, emailRequest())
+		defer server.Close()
+
+		h := &pinStoringHandler{mockSessionHandler: newMockSessionHandler(t), proceed: make(chan func(pin string), 1)}
+		session := client.NewSession(server.Qr(), h)
+		proceed := <-h.proceed
+		session.Dismiss()
+		require.True(t, h.wait().cancelled)
+		server.waitDeleted()
+
+		// Entering the PIN afterwards has no effect
+		proceed("12345")
+		require.Empty(t, h.result)
+		require.Equal(t, []string{mockEndpointRequest, mockEndpointDelete}, server.Calls())
+		require.Empty(t, client.keyshareServers[irma.NewSchemeManagerIdentifier("test")].token)
+	})
+
+	t.Run("request in flight", func(t *testing.T) {
+		received, aborted, stop := hangingKeyshareServer(t, client)
+		defer stop()
+		server := newMockServer(t, emailRequest())
+		defer server.Close()
+
+		h := &pinStoringHandler{mockSessionHandler: newMockSessionHandler(t), proceed: make(chan func(pin string), 1)}
+		session := client.NewSession(server.Qr(), h)
+		go (<-h.proceed)("12345")
+
+		// Wait until the PIN is being sent to the keyshare server
+		<-received
+		session.Dismiss()
+		require.True(t, h.wait().cancelled)
+
+		// The request to the keyshare server is aborted, without the session failing afterwards
+		select {
+		case <-aborted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("keyshare request not aborted")
+		}
+		time.Sleep(100 * time.Millisecond)
+		require.Empty(t, h.result)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, _, stop := hangingKeyshareServer(t, client)
+		defer stop()
+		client.SetTransportTimeout(100 * time.Millisecond)
+		defer client.SetTransportTimeout(0)
+		server := newMockServer(t, emailRequest())
+		defer server.Close()
+
+		h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+		start := time.Now()
+		client.NewSession(server.Qr(), h)
+		result := h.wait()
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorTransport, result.err.ErrorType)
+		require.Less(t, time.Since(start), 3*time.Second)
+	})
+}
+
+// expiringKeyshareServer proxies the keyshare server of the test scheme, rejecting authorization
+// tokens after they have been used for one request of the keyshare protocol.
+// It counts the forwarded getCommitments requests.
+type expiringKeyshareServer struct {
+	*httptest.Server
+	mutex       sync.Mutex
+	used        map[string]bool
+	commitments int
+}
+
+func newExpiringKeyshareServer(t *testing.T, client *Client) *expiringKeyshareServer {
+	scheme := client.Configuration.SchemeManagers[irma.NewSchemeManagerIdentifier("test")]
+	target, err := url.Parse(scheme.KeyshareServer)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	s := &expiringKeyshareServer{used: map[string]bool{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/verify/") {
+			// Tokens issued within the same second are identical, so we consider each
+			// PIN verification to issue a new one
+			s.mutex.Lock()
+			s.used = map[string]bool{}
+			s.mutex.Unlock()
+		}
+		if strings.Contains(r.URL.Path, "/prove/") {
+			s.mutex.Lock()
+			token := r.Header.Get("Authorization")
+			expired := s.used[token]
+			s.used[token] = true
+			if !expired && strings.HasSuffix(r.URL.Path, "getCommitments") {
+				s.commitments++
+			}
+			s.mutex.Unlock()
+			if expired {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"status":401,"error":"EXPIRED","message":"jwt expired"}`))
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	return s
+}
+
+func TestKeyshareReauthentication(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	proxy := newExpiringKeyshareServer(t, client)
+	defer proxy.Close()
+	scheme := client.Configuration.SchemeManagers[testSchemeID]
+	kssURL := scheme.KeyshareServer
+	scheme.KeyshareServer = proxy.URL
+	defer func() { scheme.KeyshareServer = kssURL }()
+
+	runSession := func() int {
+		server := newMockServer(t, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")))
+		defer server.Close()
+		h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		require.Equal(t, irma.ServerStatusDone, server.Status())
+		return h.pins
+	}
+
+	// The token expires after obtaining the commitments, after which the cached PIN is used
+	// to obtain a new one, without obtaining the commitments again
+	require.Equal(t, 1, runSession())
+	require.Equal(t, 1, proxy.commitments)
+
+	// Without the cached PIN, the user is asked for it again. The token from the previous session
+	// is still valid long enough to start the session without asking for the PIN.
+	client.SetPinGracePeriod(0)
+	proxy.used = map[string]bool{}
+	require.Equal(t, 1, runSession())
+	require.Equal(t, 2, proxy.commitments)
+}
+
+func TestKeysharePendingEmailVerification(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	sub := client.Subscribe(10)
+
+	// Proxy the keyshare server, refusing to be used until the email address is verified
+	scheme := client.Configuration.SchemeManagers[testSchemeID]
+	kssURL := scheme.KeyshareServer
+	target, err := url.Parse(kssURL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var verified int32
+	var calls []string
+	kss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		if atomic.LoadInt32(&verified) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"status":403,"error":"EMAIL_NOT_VERIFIED"}`))
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer kss.Close()
+	scheme.KeyshareServer = kss.URL
+	defer func() { scheme.KeyshareServer = kssURL }()
+
+	runSession := func() (int, *irma.SessionError) {
+		server := newMockServer(t, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")))
+		defer server.Close()
+		h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		return h.pins, h.wait().err
+	}
+	requireNotVerified := func(err *irma.SessionError) {
+		require.NotNil(t, err)
+		require.Equal(t, irma.ErrorKeyshareEmailNotVerified, err.ErrorType)
+		require.Equal(t, "test", err.Info)
+		require.Equal(t, KeyshareStatePendingEmailVerification, client.KeyshareEnrollmentState(testSchemeID))
+	}
+	require.Equal(t, KeyshareStateEnrolled, client.KeyshareEnrollmentState(testSchemeID))
+	require.Equal(t, KeyshareStateUnenrolled, client.KeyshareEnrollmentState(irma.NewSchemeManagerIdentifier("test2")))
+
+	// The keyshare server refuses to verify the PIN
+	pins, serr := runSession()
+	require.Equal(t, 1, pins)
+	requireNotVerified(serr)
+
+	// Now that we know, sessions fail before the user enters their PIN
+	calls = nil
+	pins, serr = runSession()
+	require.Zero(t, pins)
+	requireNotVerified(serr)
+	require.Equal(t, []string{"/users/verify_start"}, calls)
+
+	// The pending state survives restarts
+	require.NoError(t, client.storage.db.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	sub = client.Subscribe(10)
+	scheme = client.Configuration.SchemeManagers[testSchemeID]
+	scheme.KeyshareServer = kss.URL
+	require.Equal(t, KeyshareStatePendingEmailVerification, client.KeyshareEnrollmentState(testSchemeID))
+
+	// After the user verifies their email address the session succeeds, informing subscribers
+	atomic.StoreInt32(&verified, 1)
+	_, serr = runSession()
+	require.Nil(t, serr)
+	require.Equal(t, KeyshareStateEnrolled, client.KeyshareEnrollmentState(testSchemeID))
+	for e := range sub.Events() {
+		if e == (KeyshareEmailVerified{SchemeManager: testSchemeID}) {
+			break
+		}
+	}
+}
+
+func TestChooseKeyshareVersion(t *testing.T) {
+	for status, expected := range map[string]int{
+		`{"min_version":1,"max_version":2}`: 2,
+		`{"min_version":1,"max_version":1}`: 1,
+		`{"min_version":2,"max_version":5}`: 2,
+		`{"min_version":3,"max_version":4}`: 0,
+		`{"min_version":0,"max_version":0}`: 0,
+	} {
+		var s irma.KeyshareStatus
+		require.NoError(t, json.Unmarshal([]byte(status), &s))
+		version, err := chooseKeyshareVersion(&s)
+		if expected == 0 {
+			require.True(t, irma.IsErrorType(err, irma.ErrorKeyshareVersionUnsupported), status)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, expected, version, status)
+		}
+	}
+}
+
+func TestKeyshareProtocolVersions(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	kss := client.keyshareServers[testSchemeID]
+	scheme := client.Configuration.SchemeManagers[testSchemeID]
+	kssURL := scheme.KeyshareServer
+	defer func() { scheme.KeyshareServer = kssURL }()
+	target, err := url.Parse(kssURL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	// runServer has the client use a keyshare server advertising the specified status,
+	// or none if it is empty, recording the requests it receives
+	var calls []string
+	runServer := func(status string, handler http.HandlerFunc) func() {
+		calls = nil
+		kss.protocolVersion = 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, r.URL.Path)
+			switch {
+			case r.URL.Path == "/status" && status == "":
+				http.NotFound(w, r)
+			case r.URL.Path == "/status":
+				_, _ = w.Write([]byte(status))
+			default:
+				handler(w, r)
+			}
+		}))
+		scheme.KeyshareServer = server.URL
+		return server.Close
+	}
+
+	// Version 1 servers receive the hashed PIN from accounts not using challenge-response
+	kss.ChallengeResponse = false
+	stop := runServer(`{"min_version":1,"max_version":1}`, func(w http.ResponseWriter, r *http.Request) {
+		var msg irma.KeyshareAuthResponse
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		require.Empty(t, msg.AuthResponseJWT)
+		require.Equal(t, kss.Username, msg.Username)
+		require.Equal(t, kss.HashedPin("12345"), msg.Pin)
+		_, _ = w.Write([]byte(`{"status":"success","message":"token"}`))
+	})
+	verifyPin(t, client)
+	require.Equal(t, "token", client.keyshareToken(kss))
+	require.Equal(t, []string{"/status", "/users/verify/pin"}, calls)
+	stop()
+	kss.ChallengeResponse = true
+
+	// The version is negotiated once
+	stop = runServer(`{"min_version":1,"max_version":2}`, proxy.ServeHTTP)
+	verifyPin(t, client)
+	verifyPin(t, client)
+	require.Equal(t, []string{"/status", "/users/verify_start", "/users/verify/pin_challengeresponse",
+		"/users/verify_start", "/users/verify/pin_challengeresponse"}, calls)
+	stop()
+
+	// Servers not advertising their versions support version 2
+	stop = runServer("", proxy.ServeHTTP)
+	verifyPin(t, client)
+	require.Equal(t, 2, kss.protocolVersion)
+	stop()
+
+	// Servers only supporting newer versions are refused
+	stop = runServer(`{"min_version":3,"max_version":3}`, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("unexpected request to keyshare server")
+	})
+	_, _, _, err = client.KeyshareVerifyPin("12345", testSchemeID)
+	require.True(t, irma.IsErrorType(err, irma.ErrorKeyshareVersionUnsupported))
+	require.Equal(t, []string{"/status"}, calls)
+	stop()
+
+	// Accounts using challenge-response refuse to be downgraded to version 1
+	stop = runServer(`{"min_version":1,"max_version":1}`, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("unexpected request to keyshare server")
+	})
+	_, _, _, err = client.KeyshareVerifyPin("12345", testSchemeID)
+	require.True(t, irma.IsErrorType(err, irma.ErrorKeyshareVersionUnsupported))
+	require.Equal(t, []string{"/status"}, calls)
+	stop()
+}
+
+func TestKeyshareBatchedRequests(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// Proxy the keyshare server, recording the requests of the keyshare protocol
+	scheme := client.Configuration.SchemeManagers[testSchemeID]
+	kssURL := scheme.KeyshareServer
+	defer func() { scheme.KeyshareServer = kssURL }()
+	target, err := url.Parse(kssURL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var requests []string
+	kss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/prove/") {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			requests = append(requests, path.Base(r.URL.Path)+" "+string(body))
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer kss.Close()
+	scheme.KeyshareServer = kss.URL
+
+	runSession := func(request irma.SessionRequest) {
+		server := newMockServer(t, request)
+		defer server.Close()
+		h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		require.Equal(t, irma.ServerStatusDone, server.Status())
+	}
+
+	// Issue two credentials using the same public key
+	email := irma.NewAttributeTypeIdentifier("test.test.email.email")
+	issuance := irma.NewIssuanceRequest([]*irma.CredentialRequest{
+		{CredentialTypeID: email.CredentialTypeIdentifier(), KeyCounter: 3, Attributes: map[string]string{"email": "one@example.com"}},
+		{CredentialTypeID: email.CredentialTypeIdentifier(), KeyCounter: 3, Attributes: map[string]string{"email": "two@example.com"}},
+	})
+	runSession(issuance)
+	require.Len(t, requests, 2)
+	require.Equal(t, `getCommitments ["test.test-3"]`, requests[0])
+
+	// Disclosing three credentials takes one request per step of the keyshare protocol
+	requests = nil
+	one, two := "one@example.com", "two@example.com"
+	disclosure := irma.NewDisclosureRequest()
+	disclosure.Disclose = irma.AttributeConDisCon{
+		{{{Type: email, Value: &one}}},
+		{{{Type: email, Value: &two}}},
+		{{irma.NewAttributeRequest("test.test.mijnirma.email")}},
+	}
+	runSession(disclosure)
+	require.Len(t, requests, 2)
+	require.Equal(t, `getCommitments ["test.test-3"]`, requests[0]) // all three use the same public key
+	require.True(t, strings.HasPrefix(requests[1], "getResponse "))
+}
+
+func TestKeyshareSignatureMultipleCredentials(t *testing.T) {
+	defer stubTimestampServer()()
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, irma.NewSchemeManagerIdentifier("test"))
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// One credential of a scheme without and one of a scheme with a keyshare server
+	request := irma.NewSignatureRequest("I agree to the contract",
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		irma.NewAttributeTypeIdentifier("test.test.mijnirma.email"),
+	)
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	result := h.wait()
+	require.Nil(t, result.err)
+	require.Equal(t, 1, h.pins)
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+	require.Len(t, server.disclosed, 2)
+	require.Equal(t, "456", *server.disclosed[0][0].RawValue)
+	require.Equal(t, "test.test.mijnirma.email", server.disclosed[1][0].Identifier.String())
+
+	signature := &irma.SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(result.success), signature))
+	require.Len(t, signature.Signature, 2)
+	_, status, err := signature.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+}
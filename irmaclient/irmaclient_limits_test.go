@@ -0,0 +1,76 @@
+package irmaclient
+
+import (
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// padResponse returns a rewrite appending the specified amount of whitespace to the response,
+// which leaves its JSON valid.
+func padResponse(size int) func(string) string {
+	return func(s string) string { return s + strings.Repeat(" ", size) }
+}
+
+func TestMockServerResponseTooLarge(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	server.inject(mockEndpointRequest, mockFault{Rewrite: padResponse(irma.MaxSessionResponseSize)})
+
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorResponseTooLarge, result.err.ErrorType)
+	require.Equal(t, "127.0.0.1", result.err.Info)
+	require.NotContains(t, server.Calls(), mockEndpointProofs)
+}
+
+func TestMockServerIssuanceResponseSize(t *testing.T) {
+	t.Run("within limit", func(t *testing.T) {
+		client := parseMemoryClient(t)
+		defer func() { require.NoError(t, client.Close()) }()
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		// Larger than the session request may be, but within the limit of issuance responses
+		server.inject(mockEndpointCommitments, mockFault{Rewrite: padResponse(2 * irma.MaxSessionResponseSize)})
+
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.Nil(t, result.err)
+		require.Len(t, client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")), 1)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		client := parseMemoryClient(t)
+		defer func() { require.NoError(t, client.Close()) }()
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		server.inject(mockEndpointCommitments, mockFault{Rewrite: padResponse(irma.MaxIssuanceResponseSize)})
+
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorResponseTooLarge, result.err.ErrorType)
+		require.Empty(t, client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")))
+	})
+}
+
+func TestMockServerRequestTooLarge(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	request := studentIDRequest()
+	for len(request.Disclose) <= irma.MaxRequestDisjunctions {
+		request.Disclose = append(request.Disclose, request.Disclose[0])
+	}
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	result := runMockSession(t, client, server, h)
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorServerResponse, result.err.ErrorType)
+	require.Contains(t, result.err.Err.Error(), "Too many disjunctions")
+	require.Empty(t, h.permissionRequested)
+}
@@ -0,0 +1,348 @@
+package irmaclient
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+const day = 24 * time.Hour
+
+// storeLogs replaces the log of the client by entries of the specified actions and ages, from old to new.
+func storeLogs(t *testing.T, client *Client, actions []irma.Action, ages []time.Duration) {
+	require.NoError(t, client.storage.Transaction(func(tx *transaction) error {
+		if err := client.storage.TxDeleteLogs(tx); err != nil {
+			return err
+		}
+		for i, action := range actions {
+			entry := &LogEntry{Type: action, Time: irma.Timestamp(time.Now().Add(-ages[i]))}
+			if err := client.storage.TxAddLogEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// logActions returns the actions of the log entries, from old to new.
+func logActions(t *testing.T, client *Client) []irma.Action {
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	actions := make([]irma.Action, len(logs))
+	for i, entry := range logs {
+		actions[len(logs)-1-i] = entry.Type
+	}
+	return actions
+}
+
+func TestLogRetention(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	disc, sig, rem := irma.ActionDisclosing, irma.ActionSigning, ActionRemoval
+
+	t.Run("none", func(t *testing.T) {
+		storeLogs(t, client, []irma.Action{disc, sig, rem}, []time.Duration{1000 * day, 500 * day, 0})
+		client.SetLogRetention(LogRetention{})
+		require.NoError(t, client.PruneLogs())
+		require.Equal(t, []irma.Action{disc, sig, rem}, logActions(t, client))
+	})
+
+	t.Run("max entries", func(t *testing.T) {
+		storeLogs(t, client, []irma.Action{sig, disc, rem, disc}, []time.Duration{4 * day, 3 * day, 2 * day, day})
+		client.SetLogRetention(LogRetention{LogRetentionPolicy: LogRetentionPolicy{MaxEntries: 2}})
+		require.NoError(t, client.PruneLogs())
+		require.Equal(t, []irma.Action{rem, disc}, logActions(t, client))
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		storeLogs(t, client, []irma.Action{sig, disc, rem}, []time.Duration{10 * day, 5 * day, day})
+		client.SetLogRetention(LogRetention{LogRetentionPolicy: LogRetentionPolicy{MaxAge: 7 * day}})
+		require.NoError(t, client.PruneLogs())
+		require.Equal(t, []irma.Action{disc, rem}, logActions(t, client))
+	})
+
+	t.Run("per action", func(t *testing.T) {
+		storeLogs(t, client, []irma.Action{sig, disc, sig, disc, rem},
+			[]time.Duration{400 * day, 300 * day, 200 * day, 100 * day, day})
+		client.SetLogRetention(LogRetention{
+			LogRetentionPolicy: LogRetentionPolicy{MaxAge: 30 * day},
+			Actions: map[irma.Action]LogRetentionPolicy{
+				sig: {MaxAge: 365 * day},
+			},
+		})
+		require.NoError(t, client.PruneLogs())
+		require.Equal(t, []irma.Action{sig, rem}, logActions(t, client))
+	})
+
+	t.Run("count and age", func(t *testing.T) {
+		// Of the signatures, the count limit removes the oldest and the age limit removes the
+		// second oldest; the signatures are not counted by the default policy
+		storeLogs(t, client, []irma.Action{sig, sig, disc, disc, sig, disc, sig},
+			[]time.Duration{50 * day, 40 * day, 30 * day, 20 * day, 10 * day, 5 * day, day})
+		client.SetLogRetention(LogRetention{
+			LogRetentionPolicy: LogRetentionPolicy{MaxEntries: 2},
+			Actions: map[irma.Action]LogRetentionPolicy{
+				sig: {MaxEntries: 3, MaxAge: 35 * day},
+			},
+		})
+		require.NoError(t, client.PruneLogs())
+		require.Equal(t, []irma.Action{disc, sig, disc, sig}, logActions(t, client))
+	})
+
+	t.Run("on append", func(t *testing.T) {
+		storeLogs(t, client, []irma.Action{sig, disc}, []time.Duration{2 * day, day})
+		client.SetLogRetention(LogRetention{LogRetentionPolicy: LogRetentionPolicy{MaxEntries: 2}})
+		defer client.SetLogRetention(LogRetention{})
+		sub := client.Subscribe(10)
+		defer sub.Unsubscribe()
+
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		h := newMockSessionHandler(t)
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		require.Equal(t, []irma.Action{disc, disc}, logActions(t, client))
+
+		var appended, pruned bool
+		for !pruned {
+			switch e := (<-sub.Events()).(type) {
+			case LogAppended:
+				appended = true
+			case LogsPruned:
+				require.True(t, appended)
+				require.Len(t, e.IDs, 1)
+				pruned = true
+			}
+		}
+	})
+}
+
+func TestExportLogs(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	storeLogs(t, client, nil, nil)
+
+	start := time.Now().Add(-time.Second)
+	for _, request := range []irma.SessionRequest{studentCardIssuanceRequest(), studentIDRequest()} {
+		server := newMockServer(t, request)
+		h := newMockSessionHandler(t)
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		server.Close()
+	}
+
+	export := func(format LogFormat, filter LogFilter) string {
+		var buf bytes.Buffer
+		require.NoError(t, client.ExportLogs(&buf, format, filter))
+		return buf.String()
+	}
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+
+	t.Run("json", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(export(LogFormatJSON, LogFilter{})), "\n")
+		require.Len(t, lines, 2)
+		var entry exportedLogEntry
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry)) // newest first
+		require.Equal(t, irma.ActionDisclosing, entry.Type)
+		require.Len(t, entry.Attributes, 1)
+		require.Equal(t, "disclosed", entry.Attributes[0].Event)
+		require.Equal(t, studentID, entry.Attributes[0].ID)
+		require.Equal(t, "Demo Student Card", entry.Attributes[0].Credential)
+		require.Equal(t, "Student number", entry.Attributes[0].Name)
+		require.Nil(t, entry.Attributes[0].Value)
+
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+		require.Equal(t, irma.ActionIssuing, entry.Type)
+		require.NotEmpty(t, entry.Attributes)
+		for _, attr := range entry.Attributes {
+			require.Equal(t, "issued", attr.Event)
+			require.Nil(t, attr.Value)
+		}
+	})
+
+	t.Run("values", func(t *testing.T) {
+		out := export(LogFormatJSON, LogFilter{IncludeValues: true, Language: "nl"})
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		var entry exportedLogEntry
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+		require.Equal(t, "Studentnummer", entry.Attributes[0].Name)
+		require.NotNil(t, entry.Attributes[0].Value)
+		require.NotEmpty(t, *entry.Attributes[0].Value)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		rows, err := csv.NewReader(strings.NewReader(export(LogFormatCSV, LogFilter{}))).ReadAll()
+		require.NoError(t, err)
+		require.Equal(t, logCSVHeader, rows[0])
+		require.Greater(t, len(rows), 3)
+		require.Equal(t, string(irma.ActionDisclosing), rows[1][2])
+		require.Equal(t, studentID.String(), rows[1][6])
+		require.Empty(t, rows[1][9])
+		for _, row := range rows[2:] {
+			require.Equal(t, string(irma.ActionIssuing), row[2])
+		}
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		out := export(LogFormatJSON, LogFilter{Actions: []irma.Action{irma.ActionIssuing}})
+		require.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 1)
+		require.Contains(t, out, `"type":"issuing"`)
+
+		require.Empty(t, export(LogFormatJSON, LogFilter{Until: start}))
+		require.Empty(t, export(LogFormatJSON, LogFilter{From: time.Now().Add(time.Minute)}))
+		out = export(LogFormatJSON, LogFilter{From: start, Until: time.Now().Add(time.Minute)})
+		require.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 2)
+	})
+
+	t.Run("unsupported format", func(t *testing.T) {
+		require.Error(t, client.ExportLogs(&bytes.Buffer{}, LogFormat("xml"), LogFilter{}))
+	})
+}
+
+// tamperLogs modifies the stored logs of the client directly, bypassing the log chain.
+func tamperLogs(t *testing.T, client *Client, f func(bucket dbBucket, keys [][]byte)) {
+	require.NoError(t, client.storage.Transaction(func(tx *transaction) error {
+		var keys [][]byte
+		for _, record := range client.storage.txLogRecords(tx) {
+			keys = append(keys, record.key)
+		}
+		f(tx.Bucket([]byte(logsBucket)), keys)
+		return nil
+	}))
+}
+
+func requireLogIntegrityError(t *testing.T, client *Client, id uint64) {
+	err := client.VerifyLogIntegrity()
+	require.IsType(t, &LogIntegrityError{}, err)
+	require.Equal(t, id, err.(*LogIntegrityError).ID)
+}
+
+func TestLogIntegrity(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	defer client.SetLogRetention(LogRetention{})
+
+	disc, sig := irma.ActionDisclosing, irma.ActionSigning
+	actions := []irma.Action{disc, sig, disc, sig, disc}
+	ages := []time.Duration{5 * day, 4 * day, 3 * day, 2 * day, day}
+	ids := func() []uint64 {
+		logs, err := client.LoadNewestLogs(100)
+		require.NoError(t, err)
+		var ids []uint64
+		for i := len(logs) - 1; i >= 0; i-- {
+			ids = append(ids, logs[i].ID)
+		}
+		return ids
+	}
+
+	t.Run("intact", func(t *testing.T) {
+		storeLogs(t, client, actions, ages)
+		require.NoError(t, client.VerifyLogIntegrity())
+		require.NoError(t, client.addLogEntry(&LogEntry{Type: disc, Time: irma.Timestamp(time.Now())}))
+		require.NoError(t, client.VerifyLogIntegrity())
+	})
+
+	t.Run("flipped byte", func(t *testing.T) {
+		storeLogs(t, client, actions, ages)
+		all := ids()
+		tamperLogs(t, client, func(bucket dbBucket, keys [][]byte) {
+			value := append([]byte(nil), bucket.Get(keys[2])...)
+			value[len(value)/2] ^= 1
+			require.NoError(t, bucket.Put(keys[2], value))
+		})
+		requireLogIntegrityError(t, client, all[2])
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		storeLogs(t, client, actions, ages)
+		all := ids()
+		tamperLogs(t, client, func(bucket dbBucket, keys [][]byte) {
+			require.NoError(t, bucket.Delete(keys[1]))
+		})
+		requireLogIntegrityError(t, client, all[2])
+
+		storeLogs(t, client, actions, ages)
+		tamperLogs(t, client, func(bucket dbBucket, keys [][]byte) {
+			require.NoError(t, bucket.Delete(keys[len(keys)-1]))
+		})
+		requireLogIntegrityError(t, client, 0)
+	})
+
+	t.Run("reordered", func(t *testing.T) {
+		storeLogs(t, client, actions, ages)
+		all := ids()
+		tamperLogs(t, client, func(bucket dbBucket, keys [][]byte) {
+			first, second := append([]byte(nil), bucket.Get(keys[0])...), append([]byte(nil), bucket.Get(keys[1])...)
+			require.NoError(t, bucket.Put(keys[0], second))
+			require.NoError(t, bucket.Put(keys[1], first))
+		})
+		requireLogIntegrityError(t, client, all[0])
+	})
+
+	t.Run("pruning", func(t *testing.T) {
+		// Prune the oldest entries, moving the anchor
+		storeLogs(t, client, actions, ages)
+		client.SetLogRetention(LogRetention{LogRetentionPolicy: LogRetentionPolicy{MaxEntries: 3}})
+		require.NoError(t, client.PruneLogs())
+		require.Len(t, ids(), 3)
+		require.NoError(t, client.VerifyLogIntegrity())
+
+		// Prune entries in between, chaining the later entries anew
+		storeLogs(t, client, actions, ages)
+		client.SetLogRetention(LogRetention{Actions: map[irma.Action]LogRetentionPolicy{sig: {MaxEntries: 1}}})
+		require.NoError(t, client.PruneLogs())
+		require.Len(t, ids(), 4)
+		require.NoError(t, client.VerifyLogIntegrity())
+
+		// Prune all entries
+		client.SetLogRetention(LogRetention{LogRetentionPolicy: LogRetentionPolicy{MaxAge: time.Hour}})
+		require.NoError(t, client.PruneLogs())
+		require.Empty(t, ids())
+		require.NoError(t, client.VerifyLogIntegrity())
+		client.SetLogRetention(LogRetention{})
+		require.NoError(t, client.addLogEntry(&LogEntry{Type: disc, Time: irma.Timestamp(time.Now())}))
+		require.NoError(t, client.VerifyLogIntegrity())
+	})
+
+	t.Run("pruning does not conceal tampering", func(t *testing.T) {
+		storeLogs(t, client, actions, ages)
+		all := ids()
+		tamperLogs(t, client, func(bucket dbBucket, keys [][]byte) {
+			require.NoError(t, bucket.Delete(keys[2]))
+		})
+		client.SetLogRetention(LogRetention{LogRetentionPolicy: LogRetentionPolicy{MaxEntries: 3}})
+		require.NoError(t, client.PruneLogs())
+		requireLogIntegrityError(t, client, all[3])
+		client.SetLogRetention(LogRetention{})
+	})
+
+	t.Run("unchained logs", func(t *testing.T) {
+		// Logs of clients upgraded from before log entries were chained are chained when verified
+		unchain := func() {
+			storeLogs(t, client, actions, ages)
+			require.NoError(t, client.storage.Transaction(func(tx *transaction) error {
+				return tx.DeleteBucket([]byte(logChainBucket))
+			}))
+		}
+		unchain()
+		require.NoError(t, client.VerifyLogIntegrity())
+		all := ids()
+		tamperLogs(t, client, func(bucket dbBucket, keys [][]byte) {
+			require.NoError(t, bucket.Delete(keys[1]))
+		})
+		requireLogIntegrityError(t, client, all[2])
+
+		// Or when a log entry is added
+		unchain()
+		require.NoError(t, client.addLogEntry(&LogEntry{Type: disc, Time: irma.Timestamp(time.Now())}))
+		require.NoError(t, client.VerifyLogIntegrity())
+	})
+}
@@ -0,0 +1,145 @@
+package irmaclient
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// testCredentials returns the credentials of the test storage, for starting memory clients with.
+func testCredentials(t *testing.T) []*gabi.Credential {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	var creds []*gabi.Credential
+	for _, id := range []string{"irma-demo.RU.studentCard", "test.test.mijnirma"} {
+		cred, err := client.credential(irma.NewCredentialTypeIdentifier(id), 0)
+		require.NoError(t, err)
+		creds = append(creds, cred.Credential)
+	}
+	return creds
+}
+
+func parseMemoryClient(t *testing.T, creds ...*gabi.Credential) *Client {
+	conf, err := irma.NewConfiguration(
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		irma.ConfigurationOptions{IgnorePrivateKeys: true},
+	)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	client, err := NewMemoryClient(conf, &TestClientHandler{t: t, c: make(chan error)}, test.NewSigner(t), creds...)
+	require.NoError(t, err)
+	return client
+}
+
+func TestMemoryClient(t *testing.T) {
+	creds := testCredentials(t)
+
+	t.Run("prepopulated", func(t *testing.T) {
+		t.Parallel()
+		client := parseMemoryClient(t, creds...)
+		defer func() { require.NoError(t, client.Close()) }()
+
+		require.Len(t, client.CredentialInfoList(), 2)
+		require.Equal(t, creds[0].Attributes[0], client.secretkey.Key)
+		request := studentIDRequest()
+		request.ProtocolVersion = irma.NewVersion(2, 8)
+		_, _, err := client.Proofs(studentIDChoice(t, client, request), request)
+		require.NoError(t, err)
+
+		// Sessions and their logs work as with a client on disk
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		require.Nil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+		require.Len(t, client.CredentialInfoList(), 3)
+		logs, err := client.LoadNewestLogs(10)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+
+		require.NoError(t, client.RemoveStorage())
+		require.Empty(t, client.CredentialInfoList())
+		require.NotEqual(t, creds[0].Attributes[0], client.secretkey.Key)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+		client := parseMemoryClient(t)
+		defer func() { require.NoError(t, client.Close()) }()
+
+		require.Empty(t, client.CredentialInfoList())
+		require.NotNil(t, client.secretkey)
+		require.NoError(t, client.storage.StoreKeyshareServers(map[irma.SchemeManagerIdentifier]*keyshareServer{
+			irma.NewSchemeManagerIdentifier("test"): {Username: "user", Nonce: []byte{1}},
+		}))
+		kss, err := client.storage.LoadKeyshareServers()
+		require.NoError(t, err)
+		require.Equal(t, "user", kss[irma.NewSchemeManagerIdentifier("test")].Username)
+	})
+
+	t.Run("different secret keys", func(t *testing.T) {
+		t.Parallel()
+		other := *creds[1]
+		other.Attributes = append([]*big.Int{big.NewInt(1)}, creds[1].Attributes[1:]...)
+		client := parseMemoryClient(t)
+		defer func() { require.NoError(t, client.Close()) }()
+		_, err := NewMemoryClient(client.Configuration, &TestClientHandler{t: t}, test.NewSigner(t), creds[0], &other)
+		require.Error(t, err)
+	})
+}
+
+func TestMemoryDB(t *testing.T) {
+	db := newMemoryDB()
+	put := func(tx dbTx, key string) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(key))
+	}
+	keys := func(tx dbTx) (keys []string) {
+		c := tx.Bucket([]byte("bucket")).Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			keys = append(keys, string(k))
+		}
+		return
+	}
+
+	require.NoError(t, db.Update(func(tx dbTx) error {
+		require.Nil(t, tx.Bucket([]byte("bucket")))
+		require.NoError(t, put(tx, "b"))
+		require.NoError(t, put(tx, "a"))
+		return put(tx, "c")
+	}))
+
+	// Failing transactions are rolled back
+	failure := errors.New("failure")
+	require.ErrorIs(t, db.Update(func(tx dbTx) error {
+		require.NoError(t, put(tx, "d"))
+		require.NoError(t, tx.DeleteBucket([]byte("bucket")))
+		return failure
+	}), failure)
+
+	require.NoError(t, db.View(func(tx dbTx) error {
+		require.Equal(t, []string{"c", "b", "a"}, keys(tx))
+		c := tx.Bucket([]byte("bucket")).Cursor()
+		k, _ := c.Seek([]byte("bb"))
+		require.Equal(t, "c", string(k))
+		k, _ = c.Prev()
+		require.Equal(t, "b", string(k))
+
+		// Read-only transactions cannot write
+		require.Error(t, put(tx, "d"))
+		require.Error(t, tx.Bucket([]byte("bucket")).Put([]byte("d"), nil))
+		return nil
+	}))
+
+	require.NoError(t, db.Close())
+	require.Error(t, db.View(func(tx dbTx) error { return nil }))
+}
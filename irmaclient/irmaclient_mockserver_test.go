@@ -0,0 +1,1345 @@
+package irmaclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// Endpoints of the mockServer, used as keys for fault injection.
+const (
+	mockEndpointRequest     = "GET "
+	mockEndpointPaired      = "GET request"
+	mockEndpointHello       = "POST hello"
+	mockEndpointProofs      = "POST proofs"
+	mockEndpointCommitments = "POST commitments"
+	mockEndpointStatus      = "GET status"
+	mockEndpointDelete      = "DELETE "
+	mockEndpointError       = "POST error"
+)
+
+// mockFault describes how the mockServer deviates from the protocol at an endpoint.
+type mockFault struct {
+	Delay       time.Duration       // wait before responding
+	Status      int                 // respond with this HTTP status and an irma.RemoteError
+	Error       string              // name of that irma.RemoteError, INJECTED_FAULT if empty
+	NoBody      bool                // respond with just the HTTP status, without an irma.RemoteError
+	Malformed   bool                // respond with invalid JSON
+	ProofStatus irma.ProofStatus    // respond with this proof status instead of the one we computed
+	HTML        bool                // respond with an HTML page, as misconfigured proxies do
+	Rewrite     func(string) string // rewrite the JSON of the response
+}
+
+// mockServer is an in-process IRMA server serving a single session for end-to-end tests of
+// the client. Unlike the servers in internal/sessiontest, it lives in this package so that tests
+// can also inspect unexported client state. It verifies disclosures and attribute-based signatures,
+// and issues credentials using the private keys from testdata/privatekeys and the test schemes,
+// including credentials of schemes with a keyshare server.
+type mockServer struct {
+	*httptest.Server
+	t        *testing.T
+	conf     *irma.Configuration
+	action   irma.Action
+	request  irma.SessionRequest
+	hello    bool   // require a client hello before handing out the request, see irma.Qr.Hello
+	lifetime int    // seconds that the session remains valid, reported to the client if nonzero
+	pairing  string // if nonempty, the code to be entered in the frontend before the request is released
+
+	mutex     sync.Mutex
+	faults    map[string]mockFault
+	calls     []string
+	status    irma.ServerStatus
+	disclosed [][]*irma.DisclosedAttribute
+	deleted   chan struct{}
+	greeted   *irma.ClientHello // the client hello that the client posted, if any
+	header    http.Header       // headers of the request for the session request
+	reports   []string          // the error reports that the client posted
+}
+
+func newMockServer(t *testing.T, request irma.SessionRequest) *mockServer {
+	path := test.FindTestdataFolder(t)
+	conf, err := irma.NewConfiguration(filepath.Join(path, "irma_configuration"), irma.ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	ring, err := irma.NewPrivateKeyRingFolder(filepath.Join(path, "privatekeys"), conf)
+	require.NoError(t, err)
+	require.NoError(t, conf.AddPrivateKeyRing(ring))
+
+	nonce, err := gabi.GenerateNonce()
+	require.NoError(t, err)
+	base := request.Base()
+	base.Nonce = nonce
+	base.Context = big.NewInt(1)
+	base.ProtocolVersion = irma.NewVersion(2, 8)
+
+	s := &mockServer{
+		t:       t,
+		conf:    conf,
+		action:  request.Action(),
+		request: request,
+		faults:  map[string]mockFault{},
+		status:  irma.ServerStatusInitialized,
+		deleted: make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Qr returns the session pointer to the session of this server, in JSON.
+func (s *mockServer) Qr() string {
+	bts, err := json.Marshal(&irma.Qr{URL: s.URL + "/session/token", Type: s.action, Hello: s.hello})
+	require.NoError(s.t, err)
+	return string(bts)
+}
+
+func (s *mockServer) inject(endpoint string, fault mockFault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults[endpoint] = fault
+}
+
+// Calls returns the endpoints that the client has invoked, in order.
+func (s *mockServer) Calls() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.calls...)
+}
+
+func (s *mockServer) Status() irma.ServerStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+func (s *mockServer) setStatus(status irma.ServerStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+}
+
+// waitDeleted waits for the client to delete the session, which it does in the background.
+func (s *mockServer) waitDeleted() {
+	select {
+	case <-s.deleted:
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("session was not deleted")
+	}
+}
+
+func (s *mockServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/session/token") {
+		s.writeError(w, http.StatusNotFound, "SESSION_UNKNOWN")
+		return
+	}
+	endpoint := r.Method + " " + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/session/token"), "/")
+
+	s.mutex.Lock()
+	s.calls = append(s.calls, endpoint)
+	fault := s.faults[endpoint]
+	if endpoint == mockEndpointRequest || endpoint == mockEndpointHello {
+		s.header = r.Header.Clone()
+	}
+	s.mutex.Unlock()
+
+	if fault.Delay != 0 {
+		time.Sleep(fault.Delay)
+	}
+	if fault.Status != 0 {
+		s.setStatus(irma.ServerStatusCancelled)
+		if fault.NoBody {
+			w.WriteHeader(fault.Status)
+			return
+		}
+		name := fault.Error
+		if name == "" {
+			name = "INJECTED_FAULT"
+		}
+		s.writeError(w, fault.Status, name)
+		return
+	}
+	if fault.Malformed {
+		_, _ = w.Write([]byte(`{"malformed":`))
+		return
+	}
+	if fault.HTML {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		_, _ = w.Write([]byte(`<html><body>Bad gateway</body></html>`))
+		return
+	}
+
+	var response interface{}
+	switch endpoint {
+	case mockEndpointHello:
+		if !s.hello {
+			s.writeError(w, http.StatusNotFound, "UNKNOWN_ENDPOINT")
+			return
+		}
+		hello := &irma.ClientHello{}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(s.t, err)
+		require.NoError(s.t, json.Unmarshal(body, hello))
+		require.NoError(s.t, hello.Validate())
+		s.mutex.Lock()
+		s.greeted = hello
+		s.request.Base().ProtocolVersion = hello.MaxProtocolVersion
+		s.mutex.Unlock()
+		response = s.clientSessionRequest(hello.MaxProtocolVersion)
+	case mockEndpointRequest:
+		s.mutex.Lock()
+		greeted := s.greeted
+		s.mutex.Unlock()
+		if s.hello && greeted == nil {
+			s.writeError(w, http.StatusBadRequest, "HELLO_REQUIRED")
+			return
+		}
+		response = s.clientSessionRequest(s.request.Base().ProtocolVersion)
+	case mockEndpointPaired:
+		if s.Status() != irma.ServerStatusConnected {
+			s.writeError(w, http.StatusBadRequest, "PAIRING_REQUIRED")
+			return
+		}
+		response = s.request
+	case mockEndpointStatus:
+		response = s.Status()
+	case mockEndpointError:
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(s.t, err)
+		s.mutex.Lock()
+		s.reports = append(s.reports, string(body))
+		s.mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case mockEndpointDelete:
+		s.setStatus(irma.ServerStatusCancelled)
+		close(s.deleted)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case mockEndpointProofs, mockEndpointCommitments:
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(s.t, err)
+		status, sigs := s.verify(endpoint, body)
+		if status == irma.ProofStatusValid {
+			s.setStatus(irma.ServerStatusDone)
+		} else {
+			s.setStatus(irma.ServerStatusCancelled)
+		}
+		if fault.ProofStatus != "" {
+			status = fault.ProofStatus
+		}
+		response = &irma.ServerSessionResponse{
+			ProofStatus:     status,
+			IssueSignatures: sigs,
+			ProtocolVersion: s.request.Base().ProtocolVersion,
+			SessionType:     s.action,
+		}
+	default:
+		s.writeError(w, http.StatusNotFound, "UNKNOWN_ENDPOINT")
+		return
+	}
+
+	bts, err := json.Marshal(response)
+	require.NoError(s.t, err)
+	if fault.Rewrite != nil {
+		bts = []byte(fault.Rewrite(string(bts)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bts)
+}
+
+// clientSessionRequest returns the first message of the session to the client. If pairing is
+// required, it contains the pairing code instead of the request, which is released at the
+// request endpoint once completePairing is called.
+func (s *mockServer) clientSessionRequest(version *irma.ProtocolVersion) *irma.ClientSessionRequest {
+	cr := &irma.ClientSessionRequest{
+		LDContext:       irma.LDContextClientSessionRequest,
+		ProtocolVersion: version,
+		Options:         &irma.SessionOptions{LDContext: irma.LDContextSessionOptions, PairingMethod: irma.PairingMethodNone},
+		Lifetime:        s.lifetime,
+	}
+	if s.pairing != "" {
+		s.setStatus(irma.ServerStatusPairing)
+		cr.Options.PairingMethod = irma.PairingMethodPin
+		cr.Options.PairingCode = s.pairing
+		return cr
+	}
+	s.setStatus(irma.ServerStatusConnected)
+	cr.Request = s.request
+	return cr
+}
+
+// completePairing simulates the user entering the pairing code in the frontend.
+func (s *mockServer) completePairing() {
+	s.setStatus(irma.ServerStatusConnected)
+}
+
+// verify checks the proofs or commitments posted by the client, as the IRMA server would,
+// computing the CL signatures over the requested credentials in case of issuance.
+func (s *mockServer) verify(endpoint string, body []byte) (irma.ProofStatus, []*gabi.IssueSignatureMessage) {
+	var (
+		status irma.ProofStatus
+		err    error
+	)
+	switch {
+	case endpoint == mockEndpointProofs && s.action == irma.ActionDisclosing:
+		disclosure := &irma.Disclosure{}
+		require.NoError(s.t, json.Unmarshal(body, disclosure))
+		s.disclosed, status, err = disclosure.Verify(s.conf, s.request.(*irma.DisclosureRequest))
+	case endpoint == mockEndpointProofs && s.action == irma.ActionSigning:
+		signature := &irma.SignedMessage{}
+		require.NoError(s.t, json.Unmarshal(body, signature))
+		s.disclosed, status, err = signature.Verify(s.conf, s.request.(*irma.SignatureRequest))
+	case endpoint == mockEndpointCommitments && s.action == irma.ActionIssuing:
+		return s.issue(body)
+	default:
+		return irma.ProofStatusInvalid, nil
+	}
+	require.NoError(s.t, err)
+	return status, nil
+}
+
+func (s *mockServer) issue(body []byte) (irma.ProofStatus, []*gabi.IssueSignatureMessage) {
+	request := s.request.(*irma.IssuanceRequest)
+	commitments := &irma.IssueCommitmentMessage{}
+	require.NoError(s.t, json.Unmarshal(body, commitments))
+
+	discloseCount := len(commitments.Proofs) - len(request.Credentials)
+	require.True(s.t, discloseCount >= 0)
+	pubkeys, err := irma.ProofList(commitments.Proofs[:discloseCount]).ExtractPublicKeys(s.conf)
+	require.NoError(s.t, err)
+	for _, cred := range request.Credentials {
+		pk, err := s.conf.PublicKey(cred.CredentialTypeID.IssuerIdentifier(), cred.KeyCounter)
+		require.NoError(s.t, err)
+		pubkeys = append(pubkeys, pk)
+	}
+
+	// Merge the contributions of keyshare servers into the proofs, as the IRMA server does
+	for i, proof := range commitments.Proofs {
+		schemeID := irma.NewIssuerIdentifier(pubkeys[i].Issuer).SchemeManagerIdentifier()
+		if !s.conf.SchemeManagers[schemeID].Distributed() {
+			continue
+		}
+		claims := &struct {
+			jwt.StandardClaims
+			ProofP *gabi.ProofP
+		}{}
+		_, err = jwt.ParseWithClaims(commitments.ProofPjwts[schemeID.Name()], claims, s.conf.KeyshareServerKeyFunc(schemeID))
+		require.NoError(s.t, err)
+		proof.MergeProofP(claims.ProofP, pubkeys[i])
+	}
+
+	now := time.Now()
+	var status irma.ProofStatus
+	s.disclosed, status, err = commitments.Disclosure().VerifyAgainstRequest(
+		s.conf, request, request.GetContext(), request.GetNonce(nil), pubkeys, &now, false,
+	)
+	require.NoError(s.t, err)
+	if status != irma.ProofStatusValid {
+		return status, nil
+	}
+
+	var sigs []*gabi.IssueSignatureMessage
+	for i, cred := range request.Credentials {
+		id := cred.CredentialTypeID.IssuerIdentifier()
+		sk, err := s.conf.PrivateKeys.Get(id, cred.KeyCounter)
+		require.NoError(s.t, err)
+		proof, ok := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
+		require.True(s.t, ok)
+		attrs, err := cred.AttributeList(s.conf, irma.GetMetadataVersion(request.ProtocolVersion), nil, now)
+		require.NoError(s.t, err)
+		rb := s.conf.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeIndices()
+		sig, err := gabi.NewIssuer(sk, pubkeys[i+discloseCount], big.NewInt(1)).
+			IssueSignature(proof.U, attrs.Ints, nil, commitments.Nonce2, rb)
+		require.NoError(s.t, err)
+		sigs = append(sigs, sig)
+	}
+	return irma.ProofStatusValid, sigs
+}
+
+func (s *mockServer) writeError(w http.ResponseWriter, status int, name string) {
+	bts, _ := json.Marshal(&irma.RemoteError{Status: status, ErrorName: name, Description: "mock server error"})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bts)
+}
+
+// mockSessionHandler answers permission requests by choosing the first candidate of each
+// disjunction, or by declining if decline is set, and reports the outcome of the session on result.
+type mockSessionHandler struct {
+	HandlerBase
+	t       *testing.T
+	decline bool
+	result  chan mockSessionResult
+
+	permissionRequested chan irma.SessionRequest
+}
+
+type mockSessionResult struct {
+	success   string
+	cancelled bool
+	err       *irma.SessionError
+}
+
+func newMockSessionHandler(t *testing.T) *mockSessionHandler {
+	return &mockSessionHandler{
+		t:                   t,
+		result:              make(chan mockSessionResult, 1),
+		permissionRequested: make(chan irma.SessionRequest, 1),
+	}
+}
+
+func (h *mockSessionHandler) Success(result string) {
+	h.result <- mockSessionResult{success: result}
+}
+
+func (h *mockSessionHandler) Cancelled() {
+	h.result <- mockSessionResult{cancelled: true}
+}
+
+func (h *mockSessionHandler) Failure(err *irma.SessionError) {
+	h.result <- mockSessionResult{err: err}
+}
+
+func (h *mockSessionHandler) RequestIssuancePermission(request *irma.IssuanceRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, _ *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.requestPermission(request, satisfiable, candidates, callback)
+}
+
+func (h *mockSessionHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, _ *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.requestPermission(request, satisfiable, candidates, callback)
+}
+
+func (h *mockSessionHandler) RequestSignaturePermission(request *irma.SignatureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, _ *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.requestPermission(request, satisfiable, candidates, callback)
+}
+
+func (h *mockSessionHandler) requestPermission(request irma.SessionRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, callback PermissionHandler,
+) {
+	h.permissionRequested <- request
+	if h.decline || !satisfiable {
+		callback(false, nil)
+		return
+	}
+	choice := &irma.DisclosureChoice{}
+	for _, discon := range candidates {
+		var attrs []*irma.AttributeIdentifier
+		for _, cand := range discon[0] {
+			attrs = append(attrs, cand.AttributeIdentifier)
+		}
+		choice.Attributes = append(choice.Attributes, attrs)
+	}
+	callback(true, choice)
+}
+
+func (h *mockSessionHandler) wait() mockSessionResult {
+	select {
+	case result := <-h.result:
+		return result
+	case <-time.After(10 * time.Second):
+		h.t.Fatal("session did not finish")
+		return mockSessionResult{}
+	}
+}
+
+func studentIDRequest() *irma.DisclosureRequest {
+	return irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+}
+
+func studentCardIssuanceRequest() *irma.IssuanceRequest {
+	return irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		KeyCounter:       2,
+		Attributes: map[string]string{
+			"university":        "Radboud",
+			"studentCardNumber": "31415927",
+			"studentID":         "s1234567",
+			"level":             "42",
+		},
+	}})
+}
+
+func runMockSession(t *testing.T, client *Client, server *mockServer, handler *mockSessionHandler) mockSessionResult {
+	client.NewSession(server.Qr(), handler)
+	return handler.wait()
+}
+
+func TestMockServerDisclosure(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+	require.NotEmpty(t, result.success)
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointProofs}, server.Calls())
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+	require.Equal(t, "456", *server.disclosed[0][0].RawValue)
+
+	logs, err := client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	require.Equal(t, irma.ActionDisclosing, logs[0].Type)
+}
+
+func TestMockServerIssuance(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	request := studentCardIssuanceRequest()
+	request.Disclose = irma.AttributeConDisCon{{{irma.NewAttributeRequest("irma-demo.RU.studentCard.studentCardNumber")}}}
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+	require.False(t, result.cancelled)
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointCommitments}, server.Calls())
+	require.Len(t, server.disclosed, 1)
+
+	// The issued credential was added next to the existing student card
+	creds := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.Len(t, creds, 2)
+	var ids []string
+	for _, cred := range creds {
+		ids = append(ids, *cred.UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	}
+	require.ElementsMatch(t, []string{"456", "s1234567"}, ids)
+
+	// The new credential can be disclosed in turn
+	value := "31415927"
+	server = newMockServer(t, &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{LDContext: irma.LDContextDisclosureRequest},
+		Disclose: irma.AttributeConDisCon{{{
+			{Type: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentCardNumber"), Value: &value},
+		}}},
+	})
+	defer server.Close()
+	result = runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+	require.Equal(t, value, *server.disclosed[0][0].RawValue)
+}
+
+func TestMockServerIssuanceBindings(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	count := len(client.attrs(studentCard))
+
+	// The disclosed student ID is 456, which the issued one does not equal
+	request := studentCardIssuanceRequest()
+	request.Disclose = irma.AttributeConDisCon{{{irma.NewAttributeRequest(studentID.String())}}}
+	request.Bindings = []*irma.AttributeBinding{{Attribute: studentID, Disclosed: studentID}}
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	result := runMockSession(t, client, server, h)
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorIssuanceBindingViolated, result.err.ErrorType)
+	require.Len(t, client.attrs(studentCard), count)
+
+	// The binding is shown with the new credential
+	asked := (<-h.permissionRequested).(*irma.IssuanceRequest)
+	require.Len(t, asked.CredentialChanges, 1)
+	require.Equal(t, request.Bindings, asked.CredentialChanges[0].Bindings)
+
+	request = studentCardIssuanceRequest()
+	request.Credentials[0].Attributes["studentID"] = "456"
+	request.Disclose = irma.AttributeConDisCon{{{irma.NewAttributeRequest(studentID.String())}}}
+	request.Bindings = []*irma.AttributeBinding{{Attribute: studentID, Disclosed: studentID}}
+	server = newMockServer(t, request)
+	defer server.Close()
+	require.Nil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+	require.Len(t, client.attrs(studentCard), count+1)
+}
+
+func TestMockServerClientHello(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("required", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		server.hello = true
+
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.Nil(t, result.err)
+		require.Equal(t, []string{mockEndpointHello, mockEndpointProofs}, server.Calls())
+		require.Equal(t, irma.ServerStatusDone, server.Status())
+		require.Equal(t, client.minVersion, server.greeted.MinProtocolVersion)
+		require.Equal(t, client.maxVersion, server.greeted.MaxProtocolVersion)
+		require.Equal(t, "irmago", server.greeted.ClientName)
+	})
+
+	t.Run("not supported by server", func(t *testing.T) {
+		// A QR claiming that the server requires a hello, of a server that does not know it
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		qr, err := json.Marshal(&irma.Qr{URL: server.URL + "/session/token", Type: irma.ActionDisclosing, Hello: true})
+		require.NoError(t, err)
+
+		h := newMockSessionHandler(t)
+		client.NewSession(string(qr), h)
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.Equal(t, []string{mockEndpointHello, mockEndpointRequest, mockEndpointProofs}, server.Calls())
+	})
+
+	t.Run("not indicated by qr", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		server.hello = true
+		qr, err := json.Marshal(&irma.Qr{URL: server.URL + "/session/token", Type: irma.ActionDisclosing})
+		require.NoError(t, err)
+
+		h := newMockSessionHandler(t)
+		client.NewSession(string(qr), h)
+		result := h.wait()
+		require.NotNil(t, result.err)
+		require.Equal(t, http.StatusBadRequest, result.err.RemoteStatus)
+		require.Equal(t, []string{mockEndpointRequest}, server.Calls())
+	})
+}
+
+func TestMockServerQr(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	run := func(t *testing.T, qr *irma.Qr) (*mockServer, mockSessionResult) {
+		server := newMockServer(t, studentIDRequest())
+		t.Cleanup(server.Close)
+		qr.URL = server.URL + "/session/token"
+		bts, err := json.Marshal(qr)
+		require.NoError(t, err)
+		h := newMockSessionHandler(t)
+		client.NewSession(string(bts), h)
+		return server, h.wait()
+	}
+
+	t.Run("generated", func(t *testing.T) {
+		server, result := run(t, irma.NewQr(irma.ActionDisclosing, ""))
+		require.Nil(t, result.err)
+		require.Equal(t, []string{mockEndpointRequest, mockEndpointProofs}, server.Calls())
+		require.Equal(t, irma.MinProtocolVersion.String(), server.header.Get(irma.MinVersionHeader))
+		require.Equal(t, client.maxVersion.String(), server.header.Get(irma.MaxVersionHeader))
+	})
+
+	t.Run("restricted", func(t *testing.T) {
+		qr := irma.NewQr(irma.ActionDisclosing, "")
+		qr.ProtocolVersion, qr.MaxProtocolVersion = irma.NewVersion(2, 6), irma.NewVersion(2, 8)
+		server, result := run(t, qr)
+		require.Nil(t, result.err)
+		require.Equal(t, "2.6", server.header.Get(irma.MinVersionHeader))
+		require.Equal(t, "2.8", server.header.Get(irma.MaxVersionHeader))
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		qr := irma.NewQr(irma.ActionDisclosing, "")
+		qr.ProtocolVersion, qr.MaxProtocolVersion = irma.NewVersion(3, 0), irma.NewVersion(3, 1)
+		server, result := run(t, qr)
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorProtocolVersionNotSupported, result.err.ErrorType)
+		require.Empty(t, server.Calls())
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		// IRMA API servers speaking protocol version 2.1 are refused before the session request
+		// is fetched, so that requestors cannot downgrade the session to it
+		qr := irma.NewQr(irma.ActionDisclosing, "")
+		qr.ProtocolVersion, qr.MaxProtocolVersion = irma.NewVersion(2, 0), irma.NewVersion(2, 1)
+		server, result := run(t, qr)
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorProtocolVersionNotSupported, result.err.ErrorType)
+		require.Contains(t, result.err.Err.Error(), "2.0 - 2.1")
+		require.Empty(t, server.Calls())
+	})
+
+	t.Run("link", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		link, err := irma.NewQr(irma.ActionDisclosing, server.URL+"/session/token").Link()
+		require.NoError(t, err)
+		qr, err := irma.ParseQrLink(link)
+		require.NoError(t, err)
+		bts, err := json.Marshal(qr)
+		require.NoError(t, err)
+		h := newMockSessionHandler(t)
+		client.NewSession(string(bts), h)
+		require.Nil(t, h.wait().err)
+	})
+}
+
+func TestMockServerNonceContext(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	bits := func(n uint) *big.Int {
+		return new(big.Int).Lsh(big.NewInt(1), n-1)
+	}
+	maxNonce := new(big.Int).Sub(bits(maxNonceBits+1), big.NewInt(1))
+	// replaceNonce replaces the base64-encoded nonce in the session request by the specified JSON
+	replaceNonce := func(nonce string) func(string) string {
+		return func(body string) string {
+			return regexp.MustCompile(`"nonce":"[^"]*"`).ReplaceAllString(body, `"nonce":`+nonce)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		nonce     *big.Int
+		context   *big.Int
+		noNonce   bool
+		noContext bool
+		rewrite   func(string) string
+		version   *irma.ProtocolVersion
+		err       irma.ErrorType
+	}{
+		{name: "maximum nonce", nonce: bits(maxNonceBits)},
+		{name: "oversized nonce", nonce: bits(maxNonceBits + 1), err: irma.ErrorInvalidSessionInfo},
+		{name: "zero nonce", nonce: big.NewInt(0), err: irma.ErrorInvalidSessionInfo},
+		{name: "missing nonce", noNonce: true, err: irma.ErrorInvalidSessionInfo},
+		{name: "legacy nonce", nonce: bits(maxLegacyNonceBits), version: irma.NewVersion(2, 4)},
+		{name: "oversized legacy nonce", nonce: bits(maxLegacyNonceBits + 1), version: irma.NewVersion(2, 4), err: irma.ErrorInvalidSessionInfo},
+		{name: "maximum context", context: bits(maxContextBits)},
+		{name: "oversized context", context: bits(maxContextBits + 1), err: irma.ErrorInvalidSessionInfo},
+		{name: "zero context", context: big.NewInt(0), err: irma.ErrorInvalidSessionInfo},
+		{name: "missing context", noContext: true},
+		{name: "decimal number", nonce: maxNonce, rewrite: replaceNonce(maxNonce.String())},
+		{name: "negative decimal number", rewrite: replaceNonce(`-42`), err: irma.ErrorServerResponse},
+		{name: "decimal string", nonce: maxNonce, rewrite: replaceNonce(`"` + maxNonce.String() + `"`)},
+		{name: "prefixed hex string", nonce: maxNonce, rewrite: replaceNonce(`"0x` + maxNonce.Text(16) + `"`)},
+		{name: "oversized decimal string", rewrite: replaceNonce(`"` + strings.Repeat("9", 1000) + `"`), err: irma.ErrorServerResponse},
+		// A hex string without prefix is valid base64, but decodes to a number that is too large
+		{name: "hex string", rewrite: replaceNonce(`"0123456789abcdef0123456789abcdef"`), err: irma.ErrorInvalidSessionInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newMockServer(t, studentIDRequest())
+			defer server.Close()
+			base := server.request.Base()
+			if tt.nonce != nil || tt.noNonce {
+				base.Nonce = tt.nonce
+			}
+			if tt.context != nil || tt.noContext {
+				base.Context = tt.context
+			}
+			if tt.version != nil {
+				base.ProtocolVersion = tt.version
+			}
+			if tt.rewrite != nil {
+				server.inject(mockEndpointRequest, mockFault{Rewrite: tt.rewrite})
+			}
+
+			h := newMockSessionHandler(t)
+			result := runMockSession(t, client, server, h)
+			if tt.err == "" {
+				require.Nil(t, result.err)
+				require.Equal(t, irma.ServerStatusDone, server.Status())
+				return
+			}
+			require.NotNil(t, result.err)
+			require.Equal(t, tt.err, result.err.ErrorType, result.err.Error())
+			require.Empty(t, h.permissionRequested)
+		})
+	}
+}
+
+// messageHandler records the analysis of the message of signature sessions.
+type messageHandler struct {
+	*mockSessionHandler
+	message *irma.MessageAnalysis
+}
+
+func (h *messageHandler) SignatureMessage(message *irma.MessageAnalysis) {
+	h.message = message
+}
+
+func TestMockServerAgeLimit(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// Issue a student card whose level is "yes", next to the existing one whose level is "42"
+	request := studentCardIssuanceRequest()
+	request.Credentials[0].Attributes["level"] = "yes"
+	server := newMockServer(t, request)
+	defer server.Close()
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+
+	// Pretend the level attribute follows the over-N convention
+	level := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	over18 := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.over18")
+	typ := client.Configuration.AttributeTypes[level]
+	typ.ID = "over18"
+	delete(client.Configuration.AttributeTypes, level)
+	client.Configuration.AttributeTypes[over18] = typ
+	require.Equal(t, map[int]irma.AttributeTypeIdentifier{18: over18},
+		client.Configuration.CredentialTypes[over18.CredentialTypeIdentifier()].AgeLimitAttributes())
+
+	require.True(t, client.AgeProofAvailable(18))
+	require.False(t, client.AgeProofAvailable(21))
+
+	presentValues := func(candidates []DisclosureCandidates) (values []string) {
+		for _, candidate := range candidates {
+			if candidate[0].Present() {
+				attrs, _ := client.attributesByHash(candidate[0].CredentialHash)
+				values = append(values, *attrs.UntranslatedAttribute(over18))
+			}
+		}
+		return
+	}
+
+	// Only the card stating "yes" is a candidate for over18
+	candidates, satisfiable, err := client.Candidates(irma.NewDisclosureRequest(over18))
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	require.Equal(t, []string{"yes"}, presentValues(candidates[0]))
+
+	// unless the verifier asks for a specific value
+	value := "42"
+	candidates, satisfiable, err = client.Candidates(&irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{ProtocolVersion: client.maxVersion},
+		Disclose:    irma.AttributeConDisCon{{{{Type: over18, Value: &value}}}},
+	})
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	require.Equal(t, []string{"42"}, presentValues(candidates[0]))
+}
+
+func TestMockServerSignatureMessage(t *testing.T) {
+	defer stubTimestampServer()()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	message := "Pay \u202eRUE 001 to p\u0430ypal"
+	server := newMockServer(t, irma.NewSignatureRequest(message, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	defer server.Close()
+
+	h := &messageHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	result := h.wait()
+	require.Nil(t, result.err)
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+
+	require.Equal(t, message, h.message.Raw)
+	require.Equal(t, "Pay RUE 001 to p\u0430ypal", h.message.Sanitized)
+	require.Equal(t, []irma.MessageAnomaly{irma.MessageAnomalyBidiControl, irma.MessageAnomalyMixedScripts}, h.message.Anomalies)
+
+	// The signature is over the raw message
+	signature := &irma.SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(result.success), signature))
+	require.Equal(t, message, signature.Message)
+}
+
+func TestMockServerSignatureRawHash(t *testing.T) {
+	defer stubTimestampServer()()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	digest := sha256.Sum256([]byte("%PDF-1.7 contract"))
+	request := irma.NewSignatureRequest(hex.EncodeToString(digest[:]), irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.MessageType = irma.SignatureMessageTypeRawHash
+	request.MessageFilename = "contract.pdf"
+	request.MessageMimeType = "application/pdf"
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	result := runMockSession(t, client, server, h)
+	require.Nil(t, result.err)
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+
+	// The hash is presented to the user along with the declared file
+	asked := (<-h.permissionRequested).(*irma.SignatureRequest)
+	require.Equal(t, irma.SignatureMessageTypeRawHash, asked.MessageType)
+	require.Equal(t, "contract.pdf", asked.MessageFilename)
+	require.Equal(t, "application/pdf", asked.MessageMimeType)
+
+	signature := &irma.SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(result.success), signature))
+	require.Equal(t, irma.SignatureMessageTypeRawHash, signature.MessageType)
+	_, status, err := signature.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+
+	// The type is part of what is signed
+	signature.MessageType = irma.SignatureMessageTypeString
+	_, status, err = signature.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, irma.ProofStatusValid, status)
+	_, status, err = signature.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+}
+
+func TestMockServerSignatureMultipleCredentials(t *testing.T) {
+	defer stubTimestampServer()()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	issuer := newMockServer(t, rootIssuanceRequest("12345"))
+	defer issuer.Close()
+	require.Nil(t, runMockSession(t, client, issuer, newMockSessionHandler(t)).err)
+
+	message := "I agree to the contract"
+	request := func() *irma.SignatureRequest {
+		return irma.NewSignatureRequest(message,
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+			irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+		)
+	}
+	sign := func() *irma.SignedMessage {
+		server := newMockServer(t, request())
+		defer server.Close()
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.Nil(t, result.err)
+		require.Equal(t, irma.ServerStatusDone, server.Status())
+		require.Len(t, server.disclosed, 2)
+		signature := &irma.SignedMessage{}
+		require.NoError(t, json.Unmarshal([]byte(result.success), signature))
+		return signature
+	}
+
+	// A single signature contains the proofs of both credentials
+	signature := sign()
+	require.Len(t, signature.Signature, 2)
+	attrs, status, err := signature.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	// Without the request, the attributes are not grouped as in the request
+	require.Len(t, attrs, 1)
+	require.Len(t, attrs[0], 2)
+	require.Equal(t, "456", *attrs[0][0].RawValue)
+	require.Equal(t, "12345", *attrs[0][1].RawValue)
+
+	// The proofs are bound to each other and to the message, through the nonce derived from the
+	// message and timestamp
+	valid, _, err := irma.ProofList(signature.Signature).VerifyProofs(
+		client.Configuration, nil, signature.Context, signature.GetNonce(), nil, nil, true)
+	require.NoError(t, err)
+	require.True(t, valid)
+	other := sign()
+	mixed := gabi.ProofList{signature.Signature[0], other.Signature[1]}
+	valid, _, err = irma.ProofList(mixed).VerifyProofs(
+		client.Configuration, nil, signature.Context, signature.GetNonce(), nil, nil, true)
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	tampered := *signature
+	tampered.Message = "I do not agree to the contract"
+	_, status, err = tampered.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, irma.ProofStatusValid, status)
+}
+
+func TestMockServerSigningDeclined(t *testing.T) {
+	// Completing a signing session requires a timestamp from the scheme's timestamp server,
+	// so here we only check the session up to the permission request
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, irma.NewSignatureRequest("message", irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	h.decline = true
+	result := runMockSession(t, client, server, h)
+	require.True(t, result.cancelled)
+	require.Equal(t, "message", (<-h.permissionRequested).(*irma.SignatureRequest).Message)
+	server.waitDeleted()
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointDelete}, server.Calls())
+	require.Equal(t, irma.ServerStatusCancelled, server.Status())
+}
+
+func TestMockServerUnsatisfiable(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")))
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	result := runMockSession(t, client, server, h)
+	require.True(t, result.cancelled)
+	server.waitDeleted()
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointDelete}, server.Calls())
+}
+
+// rewriteProofStatus replaces the valid proof status in responses by the specified one, which the
+// mock server could not marshal itself if it is not a known proof status.
+func rewriteProofStatus(status string) func(string) string {
+	return func(response string) string {
+		return strings.Replace(response, `"VALID"`, `"`+status+`"`, 1)
+	}
+}
+
+func TestMockServerFaults(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	tests := []struct {
+		name     string
+		request  irma.SessionRequest
+		endpoint string
+		fault    mockFault
+		check    func(t *testing.T, err *irma.SessionError)
+	}{
+		{
+			name: "request 500", request: studentIDRequest(),
+			endpoint: mockEndpointRequest, fault: mockFault{Status: http.StatusInternalServerError},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorApi, err.ErrorType)
+				require.Equal(t, http.StatusInternalServerError, err.RemoteStatus)
+				require.Equal(t, "INJECTED_FAULT", err.RemoteError.ErrorName)
+				require.True(t, irma.IsRemoteError(err))
+				var remote *irma.RemoteError
+				require.ErrorAs(t, err, &remote)
+				require.Equal(t, 1, strings.Count(err.Error(), err.RemoteError.Error()))
+			},
+		},
+		{
+			name: "request malformed", request: studentIDRequest(),
+			endpoint: mockEndpointRequest, fault: mockFault{Malformed: true},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorServerResponse, err.ErrorType)
+			},
+		},
+		{
+			name: "proofs 500", request: studentIDRequest(),
+			endpoint: mockEndpointProofs, fault: mockFault{Status: http.StatusInternalServerError},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorApi, err.ErrorType)
+			},
+		},
+		{
+			name: "proofs malformed", request: studentIDRequest(),
+			endpoint: mockEndpointProofs, fault: mockFault{Malformed: true},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorServerResponse, err.ErrorType)
+			},
+		},
+		{
+			name: "proofs rejected", request: studentIDRequest(),
+			endpoint: mockEndpointProofs, fault: mockFault{ProofStatus: irma.ProofStatusInvalid},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorRejected, err.ErrorType)
+				require.Equal(t, string(irma.ProofStatusInvalid), err.Info)
+				require.Equal(t, irma.ProofStatusInvalid, err.ProofStatus)
+			},
+		},
+		{
+			name: "proofs rejected lowercase", request: studentIDRequest(),
+			endpoint: mockEndpointProofs, fault: mockFault{Rewrite: rewriteProofStatus("missing_attributes")},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorRejected, err.ErrorType)
+				require.Equal(t, irma.ProofStatusMissingAttributes, err.ProofStatus)
+			},
+		},
+		{
+			name: "proofs unknown status", request: studentIDRequest(),
+			endpoint: mockEndpointProofs, fault: mockFault{Rewrite: rewriteProofStatus("MAYBE")},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorServerResponse, err.ErrorType)
+			},
+		},
+		{
+			name: "proofs html", request: studentIDRequest(),
+			endpoint: mockEndpointProofs, fault: mockFault{HTML: true},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorUnexpectedContentType, err.ErrorType)
+				require.Contains(t, err.Err.Error(), "text/html")
+				require.Contains(t, err.Info, "Bad gateway")
+			},
+		},
+		{
+			name: "commitments rejected", request: studentCardIssuanceRequest(),
+			endpoint: mockEndpointCommitments, fault: mockFault{ProofStatus: irma.ProofStatusExpired},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorRejected, err.ErrorType)
+				require.Equal(t, irma.ProofStatusExpired, err.ProofStatus)
+			},
+		},
+		{
+			name: "commitments 500", request: studentCardIssuanceRequest(),
+			endpoint: mockEndpointCommitments, fault: mockFault{Status: http.StatusInternalServerError},
+			check: func(t *testing.T, err *irma.SessionError) {
+				require.Equal(t, irma.ErrorApi, err.ErrorType)
+			},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			server := newMockServer(t, tst.request)
+			defer server.Close()
+			server.inject(tst.endpoint, tst.fault)
+
+			result := runMockSession(t, client, server, newMockSessionHandler(t))
+			require.NotNil(t, result.err)
+			require.Error(t, result.err.Unwrap())
+			tst.check(t, result.err)
+		})
+	}
+
+	// None of the failed issuance sessions touched the existing student card
+	creds := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.Len(t, creds, 1)
+	require.Equal(t, "456", *creds[0].UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+}
+
+func TestMockServerSessionUnknown(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	tests := []struct {
+		name     string
+		hello    bool
+		endpoint string
+		fault    mockFault
+		expected irma.ErrorType
+	}{
+		{
+			name: "404 with json", endpoint: mockEndpointRequest,
+			fault:    mockFault{Status: http.StatusNotFound, Error: "SESSION_UNKNOWN"},
+			expected: irma.ErrorSessionUnknownOrExpired,
+		},
+		{
+			name: "404 without body", endpoint: mockEndpointRequest,
+			fault:    mockFault{Status: http.StatusNotFound, NoBody: true},
+			expected: irma.ErrorSessionUnknownOrExpired,
+		},
+		{
+			name: "unknown token", endpoint: mockEndpointRequest,
+			fault:    mockFault{Status: http.StatusBadRequest, Error: "UNKNOWN_TOKEN"},
+			expected: irma.ErrorSessionUnknownOrExpired,
+		},
+		{
+			name: "unknown at hello", hello: true, endpoint: mockEndpointHello,
+			fault:    mockFault{Status: http.StatusBadRequest, Error: "SESSION_UNKNOWN"},
+			expected: irma.ErrorSessionUnknownOrExpired,
+		},
+		{
+			name: "other failure", endpoint: mockEndpointRequest,
+			fault:    mockFault{Status: http.StatusBadRequest},
+			expected: irma.ErrorApi,
+		},
+		{
+			name: "happy path",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			server := newMockServer(t, studentIDRequest())
+			defer server.Close()
+			server.hello = tst.hello
+			if tst.endpoint != "" {
+				server.inject(tst.endpoint, tst.fault)
+			}
+
+			h := newMockSessionHandler(t)
+			session := client.NewSession(server.Qr(), h)
+			result := h.wait()
+			if tst.expected == "" {
+				require.Nil(t, result.err)
+				require.Len(t, h.permissionRequested, 1)
+				return
+			}
+
+			require.NotNil(t, result.err)
+			require.Equal(t, tst.expected, result.err.ErrorType)
+			require.Error(t, result.err.Unwrap())
+			require.Empty(t, h.permissionRequested)
+			if tst.expected == irma.ErrorSessionUnknownOrExpired {
+				require.Equal(t, irma.ClientStatusTimeout, session.Status())
+				require.Contains(t, result.err.UserMessage("en"), "127.0.0.1")
+			}
+		})
+	}
+}
+
+func TestMockServerSlow(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// A slow server is waited for
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	server.inject(mockEndpointRequest, mockFault{Delay: 200 * time.Millisecond})
+	server.inject(mockEndpointProofs, mockFault{Delay: 200 * time.Millisecond})
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+	require.NotEmpty(t, result.success)
+
+	// A session can be dismissed while waiting for the server
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	server.inject(mockEndpointRequest, mockFault{Delay: time.Second})
+	h := newMockSessionHandler(t)
+	session := client.NewSession(server.Qr(), h)
+	time.Sleep(100 * time.Millisecond)
+	session.Dismiss()
+	result = h.wait()
+	require.True(t, result.cancelled)
+	select {
+	case <-h.permissionRequested:
+		t.Fatal("permission requested after dismissal")
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+// overDisclosingHandler adds the extra attribute type, from the same credential, to the first
+// disjunction of the choice that it would otherwise make.
+type overDisclosingHandler struct {
+	*mockSessionHandler
+	extra irma.AttributeTypeIdentifier
+}
+
+func (h *overDisclosingHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.mockSessionHandler.RequestVerificationPermission(request, satisfiable, candidates, requestor,
+		func(proceed bool, choice *irma.DisclosureChoice) {
+			chosen := *choice.Attributes[0][0]
+			chosen.Type = h.extra
+			choice.Attributes[0] = append(choice.Attributes[0], &chosen)
+			callback(proceed, choice)
+		})
+}
+
+func TestMockServerOverDisclosure(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	extra := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	h := &overDisclosingHandler{mockSessionHandler: newMockSessionHandler(t), extra: extra}
+	client.NewSession(server.Qr(), h)
+	result := h.wait()
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorOverDisclosure, result.err.ErrorType)
+	require.Contains(t, result.err.Error(), extra.String())
+	server.waitDeleted()
+	require.NotContains(t, server.Calls(), mockEndpointProofs)
+
+	// Extra attributes explicitly allowed by the requestor may be disclosed
+	request := studentIDRequest()
+	request.AllowedExtras = []irma.AttributeTypeIdentifier{extra}
+	server = newMockServer(t, request)
+	defer server.Close()
+	h = &overDisclosingHandler{mockSessionHandler: newMockSessionHandler(t), extra: extra}
+	client.NewSession(server.Qr(), h)
+	result = h.wait()
+	require.Nil(t, result.err)
+	require.NotEmpty(t, result.success)
+}
+
+// pairingHandler records the status updates of a session and the pairing codes it is shown.
+type pairingHandler struct {
+	*statusHandler
+	codes chan string
+}
+
+func (h *pairingHandler) PairingRequired(pairingCode string) {
+	h.codes <- pairingCode
+}
+
+func TestMockServerPairing(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	start := func(t *testing.T) (*mockServer, *pairingHandler, SessionDismisser) {
+		server := newMockServer(t, studentIDRequest())
+		t.Cleanup(server.Close)
+		server.pairing = "1234"
+		h := &pairingHandler{statusHandler: newStatusHandler(t), codes: make(chan string, 1)}
+		session := client.NewSession(server.Qr(), h)
+		require.Equal(t, "1234", <-h.codes)
+		require.Equal(t, irma.ClientStatusPairing, session.Status())
+		return server, h, session
+	}
+
+	t.Run("paired", func(t *testing.T) {
+		server, h, _ := start(t)
+		require.Empty(t, h.permissionRequested)
+		server.completePairing()
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.Equal(t, irma.ServerStatusDone, server.Status())
+		require.Contains(t, server.Calls(), mockEndpointPaired)
+		require.Equal(t, []irma.ClientStatus{
+			irma.ClientStatusCommunicating, irma.ClientStatusPairing, irma.ClientStatusCommunicating,
+			irma.ClientStatusConnected, irma.ClientStatusCommunicating,
+		}, h.Statuses())
+	})
+
+	t.Run("dismissed", func(t *testing.T) {
+		server, h, session := start(t)
+		session.Dismiss()
+		require.True(t, h.wait().cancelled)
+		server.waitDeleted()
+		require.NotContains(t, server.Calls(), mockEndpointPaired)
+		require.Empty(t, h.permissionRequested)
+	})
+
+	t.Run("rejected by frontend", func(t *testing.T) {
+		server, h, _ := start(t)
+		server.setStatus(irma.ServerStatusCancelled)
+		result := h.wait()
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorPairingRejected, result.err.ErrorType)
+		require.Empty(t, h.permissionRequested)
+	})
+}
+
+func TestMockServerDuplicateDisjunctions(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	request := irma.NewDisclosureRequest(studentID, university, studentID)
+	request.Disclose = append(request.Disclose, irma.AttributeDisCon{{{Type: university}, {Type: university}}})
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	result := runMockSession(t, client, server, h)
+	require.Nil(t, result.err)
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+
+	// Each distinct disjunction is shown once
+	asked := (<-h.permissionRequested).(*irma.DisclosureRequest)
+	require.Equal(t, irma.AttributeConDisCon{
+		{{{Type: studentID}}},
+		{{{Type: university}}},
+	}, asked.Disclose)
+	require.Len(t, request.Disclose, 4)
+
+	// but the response satisfies the request as the server sent it
+	require.Len(t, server.disclosed, 4)
+	require.Equal(t, "456", *server.disclosed[0][0].RawValue)
+	require.Equal(t, "456", *server.disclosed[2][0].RawValue)
+	require.Len(t, server.disclosed[3], 2)
+	require.Equal(t, server.disclosed[1][0].RawValue, server.disclosed[3][1].RawValue)
+}
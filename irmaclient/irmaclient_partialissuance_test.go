@@ -0,0 +1,106 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+// partialIssuanceHandler records the calls of PartialSuccess.
+type partialIssuanceHandler struct {
+	*mockSessionHandler
+	failed []*irma.CredentialChange
+}
+
+func (h *partialIssuanceHandler) PartialSuccess(result string, failed []*irma.CredentialChange) {
+	h.failed = failed
+	h.Success(result)
+}
+
+// failIssuance rewrites the issuance response of the mock server such that the signatures of
+// the specified credentials are replaced by errors.
+func failIssuance(t *testing.T, indices ...int) func(string) string {
+	return func(response string) string {
+		var msg map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(response), &msg))
+		sigs := msg["sigs"].([]interface{})
+		for _, i := range indices {
+			sigs[i] = &irma.RemoteError{Status: 500, ErrorName: "ISSUANCE_FAILED", Description: "credential unavailable"}
+		}
+		bts, err := json.Marshal(msg)
+		require.NoError(t, err)
+		return string(bts)
+	}
+}
+
+func TestPartialIssuance(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+
+	root := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	newRequest := func() *irma.IssuanceRequest {
+		request := rootIssuanceRequest("12345")
+		request.Credentials = append(request.Credentials, studentCardIssuanceRequest().Credentials[0])
+		return request
+	}
+	run := func(request *irma.IssuanceRequest, failed ...int) (*partialIssuanceHandler, mockSessionResult) {
+		server := newMockServer(t, request)
+		defer server.Close()
+		server.inject(mockEndpointCommitments, mockFault{Rewrite: failIssuance(t, failed...)})
+		h := &partialIssuanceHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		return h, h.wait()
+	}
+
+	t.Run("partial", func(t *testing.T) {
+		h, result := run(newRequest(), 1)
+		require.Nil(t, result.err)
+
+		// The issued credential is stored
+		require.Len(t, client.attrs(root), 1)
+		require.Empty(t, client.attrs(studentCard))
+
+		var changes []*irma.CredentialChange
+		require.NoError(t, json.Unmarshal([]byte(result.success), &changes))
+		require.Len(t, changes, 2)
+		require.Nil(t, changes[0].Error)
+		require.NotNil(t, changes[1].Error)
+		require.Equal(t, "ISSUANCE_FAILED", changes[1].Error.ErrorName)
+		require.Len(t, h.failed, 1)
+		require.Equal(t, 1, h.failed[0].Credential)
+		require.Equal(t, "credential unavailable", h.failed[0].Error.Description)
+
+		logs, err := client.LoadNewestLogs(1)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		require.Contains(t, logs[0].FailedCredentials, 1)
+		issued, err := logs[0].GetIssuedCredentials(client.Configuration)
+		require.NoError(t, err)
+		require.Len(t, issued, 1)
+		require.Equal(t, "MijnOverheid", issued[0].IssuerID)
+	})
+
+	t.Run("atomic", func(t *testing.T) {
+		count := credentialCount(client)
+		request := newRequest()
+		request.Atomic = true
+		_, result := run(request, 1)
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorIssuanceFailed, result.err.ErrorType)
+		require.Equal(t, "ISSUANCE_FAILED", result.err.RemoteError.ErrorName)
+		var remote *irma.RemoteError
+		require.ErrorAs(t, result.err, &remote)
+		require.Equal(t, count, credentialCount(client))
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		count := credentialCount(client)
+		_, result := run(newRequest(), 0, 1)
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorIssuanceFailed, result.err.ErrorType)
+		require.Equal(t, count, credentialCount(client))
+	})
+}
@@ -0,0 +1,99 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// policyCall records the arguments of a call to a SessionPolicy.
+type policyCall struct {
+	action    irma.Action
+	serverURL string
+	requestor *irma.RequestorInfo
+}
+
+func recordingPolicy(decision Decision, calls chan<- policyCall) SessionPolicy {
+	return SessionPolicyFunc(func(action irma.Action, serverURL string, requestor *irma.RequestorInfo) Decision {
+		calls <- policyCall{action, serverURL, requestor}
+		return decision
+	})
+}
+
+func TestSessionPolicy(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("client deny", func(t *testing.T) {
+		calls := make(chan policyCall, 1)
+		client.SetSessionPolicy(recordingPolicy(DecisionDeny, calls))
+		defer client.SetSessionPolicy(nil)
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+
+		h := newMockSessionHandler(t)
+		session := client.NewSession(server.Qr(), h)
+		result := h.wait()
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorRequestorBlocked, result.err.ErrorType)
+		require.Empty(t, h.permissionRequested)
+		require.Equal(t, irma.ClientStatusError, session.Status())
+		server.waitDeleted()
+		require.Equal(t, []string{mockEndpointRequest, mockEndpointDelete}, server.Calls())
+
+		// The requestor of this server is not in the requestor schemes, so we get only its URL
+		call := <-calls
+		require.Equal(t, irma.ActionDisclosing, call.action)
+		require.Equal(t, server.URL+"/session/token/", call.serverURL)
+		require.Nil(t, call.requestor)
+	})
+
+	t.Run("session deny", func(t *testing.T) {
+		clientCalls, sessionCalls := make(chan policyCall, 1), make(chan policyCall, 1)
+		client.SetSessionPolicy(recordingPolicy(DecisionAsk, clientCalls))
+		defer client.SetSessionPolicy(nil)
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+
+		h := newMockSessionHandler(t)
+		client.NewSessionWithPolicy(server.Qr(), h, recordingPolicy(DecisionDeny, sessionCalls))
+		require.Equal(t, irma.ErrorRequestorBlocked, h.wait().err.ErrorType)
+		require.Len(t, clientCalls, 1)
+		require.Len(t, sessionCalls, 1)
+	})
+
+	t.Run("ask verified requestor", func(t *testing.T) {
+		calls := make(chan policyCall, 1)
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+
+		// localhost is a requestor in the test requestor scheme
+		qr := strings.Replace(server.Qr(), "127.0.0.1", "localhost", 1)
+		h := newMockSessionHandler(t)
+		client.NewSessionWithPolicy(qr, h, recordingPolicy(DecisionAsk, calls))
+		result := h.wait()
+		require.Nil(t, result.err)
+		require.NotEmpty(t, result.success)
+		call := <-calls
+		require.NotNil(t, call.requestor)
+		require.Contains(t, call.requestor.Hostnames, "localhost")
+	})
+
+	t.Run("manual session", func(t *testing.T) {
+		calls := make(chan policyCall, 1)
+		request := studentIDRequest()
+		request.ProtocolVersion = client.maxVersion
+		bts, err := json.Marshal(request)
+		require.NoError(t, err)
+		h := newMockSessionHandler(t)
+		client.NewSessionWithPolicy(string(bts), h, recordingPolicy(DecisionDeny, calls))
+		require.Equal(t, irma.ErrorRequestorBlocked, h.wait().err.ErrorType)
+		call := <-calls
+		require.Empty(t, call.serverURL)
+		require.Nil(t, call.requestor)
+	})
+}
@@ -0,0 +1,167 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "write the golden messages in testdata/golden anew")
+
+var (
+	randomMutex   sync.Mutex
+	randomSources sync.Map // *Client -> io.Reader, see setRandomSource
+)
+
+// Make the proof building of clients with a source of randomness draw from it, see random.go.
+func init() {
+	withRandomness = func(client *Client, f func() error) error {
+		source, ok := randomSources.Load(client)
+		if !ok {
+			return f()
+		}
+
+		randomMutex.Lock()
+		defer randomMutex.Unlock()
+
+		reader := rand.Reader
+		rand.Reader = source.(io.Reader)
+		defer func() { rand.Reader = reader }()
+
+		return f()
+	}
+}
+
+// setRandomSource sets the source of randomness used during proof building by the client.
+// Passing nil restores the default, crypto/rand.
+func (client *Client) setRandomSource(r io.Reader) {
+	if r == nil {
+		randomSources.Delete(client)
+	} else {
+		randomSources.Store(client, r)
+	}
+}
+
+// seededRandom is a deterministic io.Reader producing SHA256(seed || counter) blocks,
+// for use as the source of randomness of a client in tests.
+type seededRandom struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func newSeededRandom(seed string) *seededRandom {
+	return &seededRandom{seed: []byte(seed)}
+}
+
+func (r *seededRandom) Read(p []byte) (int, error) {
+	for i := range p {
+		if len(r.buf) == 0 {
+			ctr := make([]byte, 8)
+			binary.BigEndian.PutUint64(ctr, r.counter)
+			r.counter++
+			block := sha256.Sum256(append(append([]byte{}, r.seed...), ctr...))
+			r.buf = block[:]
+		}
+		p[i] = r.buf[0]
+		r.buf = r.buf[1:]
+	}
+	return len(p), nil
+}
+
+func marshalGolden(t *testing.T, v interface{}) []byte {
+	bts, err := json.MarshalIndent(v, "", "  ")
+	require.NoError(t, err)
+	return append(bts, '\n')
+}
+
+// requireGolden checks that the JSON of v is byte for byte equal to the golden file of the
+// specified name in testdata/golden, writing the file first if -update-golden is passed.
+func requireGolden(t *testing.T, name string, v interface{}) {
+	path := filepath.Join(test.FindTestdataFolder(t), "golden", name+".json")
+	bts := marshalGolden(t, v)
+	if *updateGolden {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, bts, 0600))
+	}
+	golden, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, string(golden), string(bts))
+}
+
+func studentIDChoice(t *testing.T, client *Client, request irma.SessionRequest) *irma.DisclosureChoice {
+	candidates, satisfiable, err := client.Candidates(request)
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	return &irma.DisclosureChoice{Attributes: [][]*irma.AttributeIdentifier{
+		{candidates[0][0][0].AttributeIdentifier},
+	}}
+}
+
+func TestGoldenProofs(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.Context = big.NewInt(1337)
+	request.Nonce = big.NewInt(42)
+	request.ProtocolVersion = &irma.ProtocolVersion{Major: 2, Minor: 8}
+	choice := studentIDChoice(t, client, request)
+
+	// The randomness yields the exact message of the golden file, which is valid
+	client.setRandomSource(newSeededRandom("proofs"))
+	disclosure, _, err := client.Proofs(choice, request)
+	require.NoError(t, err)
+	requireGolden(t, "proofs", disclosure)
+	_, status, err := disclosure.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	golden := marshalGolden(t, disclosure)
+
+	// Other randomness yields a different, but still valid, message
+	client.setRandomSource(newSeededRandom("other"))
+	disclosure, _, err = client.Proofs(choice, request)
+	require.NoError(t, err)
+	require.NotEqual(t, golden, marshalGolden(t, disclosure))
+	_, status, err = disclosure.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+
+	// Without a source of randomness we fall back to crypto/rand
+	client.setRandomSource(nil)
+	disclosure, _, err = client.Proofs(choice, request)
+	require.NoError(t, err)
+	require.NotEqual(t, golden, marshalGolden(t, disclosure))
+}
+
+func TestGoldenIssueCommitments(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+		KeyCounter:       2,
+		Attributes:       map[string]string{"BSN": "12345"},
+	}}, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.Context = big.NewInt(1337)
+	request.Nonce = big.NewInt(42)
+	request.ProtocolVersion = &irma.ProtocolVersion{Major: 2, Minor: 8}
+	choice := studentIDChoice(t, client, request)
+
+	client.setRandomSource(newSeededRandom("commitments"))
+	msg, _, err := client.IssueCommitments(request, choice)
+	require.NoError(t, err)
+	requireGolden(t, "issuecommitments", msg)
+}
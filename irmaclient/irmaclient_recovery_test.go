@@ -0,0 +1,187 @@
+package irmaclient
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+// corruptStorage closes the client and overwrites the first stored entry of the bucket for
+// which pick returns true with the output of mangle.
+func corruptStorage(t *testing.T, client *Client, bucket string, pick func(key []byte) bool, mangle func([]byte) []byte) {
+	require.NoError(t, client.Close())
+	db, err := bbolt.Open(client.storage.path(databaseFile), 0600, nil)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		require.NotNil(t, b)
+		var key []byte
+		require.NoError(t, b.ForEach(func(k, _ []byte) error {
+			if key == nil && pick(k) {
+				key = append([]byte(nil), k...)
+			}
+			return nil
+		}))
+		require.NotNil(t, key)
+		return b.Put(key, mangle(append([]byte(nil), b.Get(key)...)))
+	}))
+}
+
+func anyKey([]byte) bool { return true }
+
+func truncate(value []byte) []byte { return value[:len(value)/2] }
+
+func garble(value []byte) []byte {
+	for i := range value {
+		value[i] ^= 0x5a
+	}
+	return value
+}
+
+func credentialCount(client *Client) (count int) {
+	for _, attrs := range client.attributes {
+		count += len(attrs)
+	}
+	return
+}
+
+func TestStorageRecovery(t *testing.T) {
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	t.Run("intact", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		require.Nil(t, client.StorageRecovery())
+		require.Nil(t, handler.recovered)
+	})
+
+	t.Run("secret key", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		require.NotZero(t, credentialCount(client))
+		oldKey := client.secretkey.Key
+		corruptStorage(t, client, userdataBucket, func(k []byte) bool { return string(k) == skKey }, truncate)
+
+		client, handler = parseExistingStorage(t, handler.storage)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		report := handler.recovered
+		require.NotNil(t, report)
+		require.True(t, report.SecretKeyLost)
+		require.NotEmpty(t, report.LostCredentials)
+		require.Zero(t, report.SalvagedCredentials)
+		require.Zero(t, credentialCount(client))
+		require.NotZero(t, client.secretkey.Key.Cmp(oldKey))
+		require.FileExists(t, report.Quarantined[0])
+
+		// The client is usable again
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.Nil(t, result.err)
+		require.Len(t, client.attrs(studentCard), 1)
+	})
+
+	t.Run("attributes", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		count := credentialCount(client)
+		corruptStorage(t, client, attributesBucket, anyKey, garble)
+
+		client, handler = parseExistingStorage(t, handler.storage)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		report := handler.recovered
+		require.NotNil(t, report)
+		require.Equal(t, 1, report.LostCredentialEntries)
+		require.Empty(t, report.LostCredentials)
+		require.Less(t, credentialCount(client), count)
+		require.NotZero(t, credentialCount(client))
+		require.Equal(t, credentialCount(client), report.SalvagedCredentials)
+	})
+
+	t.Run("signature", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		count := credentialCount(client)
+		hash := client.attrs(studentCard)[0].Hash()
+		corruptStorage(t, client, signaturesBucket, func(k []byte) bool { return string(k) == hash }, truncate)
+
+		client, handler = parseExistingStorage(t, handler.storage)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		report := handler.recovered
+		require.NotNil(t, report)
+		require.Equal(t, []irma.CredentialTypeIdentifier{studentCard}, report.LostCredentials)
+		require.Equal(t, count-1, credentialCount(client))
+		require.Equal(t, count-1, report.SalvagedCredentials)
+		require.Empty(t, client.attrs(studentCard))
+		require.Nil(t, client.lookup[hash])
+
+		// Other credentials can still be disclosed
+		server := newMockServer(t, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")))
+		defer server.Close()
+		_, satisfiable, err := client.Candidates(server.request)
+		require.NoError(t, err)
+		require.True(t, satisfiable)
+	})
+
+	t.Run("log", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		logs, err := client.LoadNewestLogs(100)
+		require.NoError(t, err)
+		require.NotEmpty(t, logs)
+		corruptStorage(t, client, logsBucket, anyKey, garble)
+
+		client, handler = parseExistingStorage(t, handler.storage)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		report := handler.recovered
+		require.NotNil(t, report)
+		require.Equal(t, 1, report.LostLogs)
+		require.Equal(t, len(logs)-1, report.SalvagedLogs)
+		remaining, err := client.LoadNewestLogs(100)
+		require.NoError(t, err)
+		require.Len(t, remaining, len(logs)-1)
+		require.NotZero(t, credentialCount(client))
+	})
+
+	t.Run("database", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		require.NoError(t, client.Close())
+		path := client.storage.path(databaseFile)
+		f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+		require.NoError(t, err)
+		_, err = f.WriteAt(make([]byte, 8192), 0)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		client, handler = parseExistingStorage(t, handler.storage)
+		defer test.ClearTestStorage(t, client, handler.storage)
+		report := handler.recovered
+		require.NotNil(t, report)
+		require.True(t, report.DatabaseReset)
+		require.Zero(t, credentialCount(client))
+		require.Equal(t, filepath.Join(filepath.Dir(path), corruptedDir), filepath.Dir(report.Quarantined[0]))
+		require.FileExists(t, report.Quarantined[0])
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, nil, handler.storage)
+		require.NoError(t, client.Close())
+
+		var aesKey [32]byte
+		_, err := New(
+			filepath.Join(handler.storage, "client"),
+			filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			handler, test.NewSigner(t), aesKey,
+		)
+		require.Error(t, err)
+
+		// Nothing was removed
+		client, handler = parseExistingStorage(t, handler.storage)
+		require.NoError(t, client.Close())
+		require.Nil(t, handler.recovered)
+		require.NotZero(t, credentialCount(client))
+	})
+}
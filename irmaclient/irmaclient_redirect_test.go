@@ -0,0 +1,88 @@
+package irmaclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+type redirectHandler struct {
+	*mockSessionHandler
+	proceed   bool
+	confirmed []string
+}
+
+func (h *redirectHandler) ConfirmRedirect(from, to string, callback func(proceed bool)) {
+	h.confirmed = append(h.confirmed, from, to)
+	callback(h.proceed)
+}
+
+// newRedirectingServer returns a server that redirects all requests to the mock server.
+func newRedirectingServer(server *mockServer) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, server.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+}
+
+func startRedirectedSession(t *testing.T, client *Client, server *mockServer, handler Handler) *session {
+	front := newRedirectingServer(server)
+	t.Cleanup(front.Close)
+	qr := strings.Replace(server.Qr(), server.URL, front.URL, 1)
+	return client.NewSession(qr, handler).(*session)
+}
+
+func TestRedirectConfirmed(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+
+	h := &redirectHandler{mockSessionHandler: newMockSessionHandler(t), proceed: true}
+	session := startRedirectedSession(t, client, server, h)
+	result := h.wait()
+	require.Nil(t, result.err)
+	require.NotEmpty(t, result.success)
+	require.Len(t, h.confirmed, 2)
+	require.True(t, strings.HasPrefix(h.confirmed[1], server.URL))
+
+	// The session continued at the server to which it was redirected
+	require.Equal(t, server.URL+"/session/token/", session.ServerURL)
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointProofs}, server.Calls())
+}
+
+func TestRedirectRefused(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+
+	// Declined by the user
+	h := &redirectHandler{mockSessionHandler: newMockSessionHandler(t)}
+	startRedirectedSession(t, client, server, h)
+	result := h.wait()
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorRedirect, result.err.ErrorType)
+	require.Len(t, h.confirmed, 2)
+
+	// Refused without asking in strict mode, and by handlers that cannot confirm redirects
+	client.SetStrictRedirects(true)
+	h = &redirectHandler{mockSessionHandler: newMockSessionHandler(t), proceed: true}
+	startRedirectedSession(t, client, server, h)
+	result = h.wait()
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorRedirect, result.err.ErrorType)
+	require.Empty(t, h.confirmed)
+
+	client.SetStrictRedirects(false)
+	mh := newMockSessionHandler(t)
+	startRedirectedSession(t, client, server, mh)
+	result = mh.wait()
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorRedirect, result.err.ErrorType)
+	require.Empty(t, server.Calls())
+}
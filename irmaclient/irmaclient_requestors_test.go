@@ -0,0 +1,185 @@
+package irmaclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// knownRequestorHandler records the known requestors it is informed of, and answers key change
+// confirmations with confirm.
+type knownRequestorHandler struct {
+	*mockSessionHandler
+	confirm bool
+	known   chan *KnownRequestor
+	changes chan *RequestorKeyChange
+}
+
+func newKnownRequestorHandler(t *testing.T, confirm bool) *knownRequestorHandler {
+	return &knownRequestorHandler{
+		mockSessionHandler: newMockSessionHandler(t),
+		confirm:            confirm,
+		known:              make(chan *KnownRequestor, 1),
+		changes:            make(chan *RequestorKeyChange, 1),
+	}
+}
+
+func (h *knownRequestorHandler) KnownRequestor(requestor *KnownRequestor) {
+	h.known <- requestor
+}
+
+func (h *knownRequestorHandler) RequestorKeyChanged(_ *KnownRequestor, change *RequestorKeyChange, callback func(proceed bool)) {
+	h.changes <- change
+	callback(h.confirm)
+}
+
+// startTLS restarts the mock server using TLS with a new key, returning the SHA-256 hash of
+// its public key, and makes the client use localhost which the test requestor scheme lists.
+func startTLS(t *testing.T, server *mockServer) (qr string, key []byte) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &sk.PublicKey, sk)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	server.Server.Close()
+	server.Server = httptest.NewUnstartedServer(http.HandlerFunc(server.serveHTTP))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: sk}}}
+	server.StartTLS()
+
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + "/session/token"
+	bts, err := json.Marshal(&irma.Qr{URL: url, Type: server.action})
+	require.NoError(t, err)
+	fingerprint := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return string(bts), fingerprint[:]
+}
+
+func TestKnownRequestors(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	irma.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	defer irma.SetTLSClientConfig(nil)
+
+	id := irma.NewRequestorIdentifier("test-requestors.test-requestor")
+	run := func(t *testing.T, confirm bool) (*knownRequestorHandler, *mockServer, []byte, mockSessionResult) {
+		server := newMockServer(t, studentIDRequest())
+		t.Cleanup(server.Close)
+		qr, key := startTLS(t, server)
+		h := newKnownRequestorHandler(t, confirm)
+		client.NewSession(qr, h)
+		return h, server, key, h.wait()
+	}
+
+	var key []byte
+	t.Run("first session", func(t *testing.T) {
+		var h *knownRequestorHandler
+		var result mockSessionResult
+		h, _, key, result = run(t, true)
+		require.Nil(t, result.err)
+		require.Nil(t, <-h.known)
+
+		requestors, err := client.KnownRequestors()
+		require.NoError(t, err)
+		require.Len(t, requestors, 1)
+		require.Equal(t, id, requestors[0].ID)
+		require.Equal(t, "Local IRMA server", requestors[0].Name["en"])
+		require.Equal(t, []string{"localhost"}, requestors[0].Hostnames)
+		require.Equal(t, key, requestors[0].Keys["localhost"])
+		require.Equal(t, 1, requestors[0].Sessions)
+	})
+
+	t.Run("declined key change", func(t *testing.T) {
+		h, server, newKey, result := run(t, false)
+		require.True(t, result.cancelled)
+		change := <-h.changes
+		require.Equal(t, "localhost", change.Hostname)
+		require.Equal(t, key, change.PreviousKey)
+		require.Equal(t, newKey, change.Key)
+		require.Empty(t, h.permissionRequested)
+		server.waitDeleted()
+		require.Equal(t, []string{mockEndpointRequest, mockEndpointDelete}, server.Calls())
+
+		requestors, err := client.KnownRequestors()
+		require.NoError(t, err)
+		require.Equal(t, key, requestors[0].Keys["localhost"])
+		require.Equal(t, 1, requestors[0].Sessions)
+	})
+
+	t.Run("confirmed key change", func(t *testing.T) {
+		h, _, newKey, result := run(t, true)
+		require.Nil(t, result.err)
+		require.Len(t, h.changes, 1)
+		known := <-h.known
+		require.NotNil(t, known)
+		require.Equal(t, 1, known.Sessions)
+
+		requestors, err := client.KnownRequestors()
+		require.NoError(t, err)
+		require.Equal(t, newKey, requestors[0].Keys["localhost"])
+		require.Equal(t, 2, requestors[0].Sessions)
+		require.False(t, requestors[0].LastSeen.Before(requestors[0].FirstSeen))
+	})
+
+	t.Run("unverified requestor", func(t *testing.T) {
+		// The mock server at 127.0.0.1 is not listed in a requestor scheme
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		h := newKnownRequestorHandler(t, true)
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		require.Nil(t, <-h.known)
+
+		requestors, err := client.KnownRequestors()
+		require.NoError(t, err)
+		require.Len(t, requestors, 1)
+		require.Equal(t, 2, requestors[0].Sessions)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		requestors, err := client.KnownRequestors()
+		require.NoError(t, err)
+		first := requestors[0].FirstSeen.Add(-time.Hour)
+		other := irma.NewRequestorIdentifier("test-requestors.other")
+		require.NoError(t, client.ImportKnownRequestors([]*KnownRequestor{
+			{ID: id, Hostnames: []string{"example.com"}, Keys: map[string][]byte{"localhost": []byte("old")}, FirstSeen: first, Sessions: 1},
+			{ID: other, Hostnames: []string{"other.example.com"}, Sessions: 3},
+		}))
+		require.Error(t, client.ImportKnownRequestors([]*KnownRequestor{{Sessions: 1}}))
+
+		requestors, err = client.KnownRequestors()
+		require.NoError(t, err)
+		require.Len(t, requestors, 2)
+		require.Equal(t, other, requestors[0].ID)
+		require.Equal(t, 3, requestors[0].Sessions)
+		require.Equal(t, id, requestors[1].ID)
+		require.Equal(t, []string{"localhost", "example.com"}, requestors[1].Hostnames)
+		require.NotEqual(t, []byte("old"), requestors[1].Keys["localhost"])
+		require.True(t, first.Equal(requestors[1].FirstSeen))
+		require.Equal(t, 2, requestors[1].Sessions)
+	})
+}
@@ -0,0 +1,119 @@
+package irmaclient
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// tunnelRoundTripper fails the specified number of attempts to post a response to the server,
+// or all of them if negative, as if the connection dropped.
+type tunnelRoundTripper struct {
+	mutex    sync.Mutex
+	failures int
+}
+
+func (rt *tunnelRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == http.MethodPost &&
+		(strings.HasSuffix(r.URL.Path, "/proofs") || strings.HasSuffix(r.URL.Path, "/commitments")) {
+		rt.mutex.Lock()
+		fail := rt.failures != 0
+		if rt.failures > 0 {
+			rt.failures--
+		}
+		rt.mutex.Unlock()
+		if fail {
+			return nil, errors.New("no network")
+		}
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+type statusRecordingHandler struct {
+	*mockSessionHandler
+	mutex    sync.Mutex
+	statuses []irma.ClientStatus
+}
+
+func (h *statusRecordingHandler) StatusUpdate(_ irma.Action, status irma.ClientStatus) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.statuses = append(h.statuses, status)
+}
+
+func shortResponseRetries(t *testing.T, window time.Duration) {
+	previousWindow, previousBackoff := responseRetryWindow, responseRetryBackoff
+	responseRetryWindow, responseRetryBackoff = window, []time.Duration{50 * time.Millisecond}
+	t.Cleanup(func() { responseRetryWindow, responseRetryBackoff = previousWindow, previousBackoff })
+}
+
+func TestResponseRetry(t *testing.T) {
+	shortResponseRetries(t, 5*time.Second)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	// Each attempt to post the response consists of three requests by the transport
+	client.SetTransportRoundTripper(&tunnelRoundTripper{failures: 7})
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+
+	h := &statusRecordingHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	result := h.wait()
+	require.Nil(t, result.err)
+	require.NotEmpty(t, result.success)
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointProofs}, server.Calls())
+	require.Equal(t, "456", *server.disclosed[0][0].RawValue)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	require.Contains(t, h.statuses, irma.ClientStatusRetrying)
+	require.Equal(t, irma.ClientStatusCommunicating, h.statuses[len(h.statuses)-1])
+}
+
+func TestResponseRetryIssuance(t *testing.T) {
+	shortResponseRetries(t, 5*time.Second)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	client.SetTransportRoundTripper(&tunnelRoundTripper{failures: 3})
+	server := newMockServer(t, studentCardIssuanceRequest())
+	defer server.Close()
+
+	count := credentialCount(client)
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+	require.Equal(t, count+1, credentialCount(client))
+}
+
+func TestResponseRetryGivesUp(t *testing.T) {
+	shortResponseRetries(t, 300*time.Millisecond)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	client.SetTransportRoundTripper(&tunnelRoundTripper{failures: -1})
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+
+	start := time.Now()
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorTransport, result.err.ErrorType)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, []string{mockEndpointRequest}, server.Calls())
+
+	// Errors reported by the server are not retried
+	shortResponseRetries(t, 5*time.Second)
+	client.SetTransportRoundTripper(nil)
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	server.inject(mockEndpointProofs, mockFault{Status: http.StatusBadRequest})
+	result = runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorApi, result.err.ErrorType)
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointProofs}, server.Calls())
+}
@@ -0,0 +1,103 @@
+package irmaclient
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// hardwareKeyStore mimics a hardware-backed SecretKeyStore: it releases the key only transiently
+// and does not allow it to be exported.
+type hardwareKeyStore struct {
+	mutex sync.Mutex
+	key   *big.Int
+	gets  int
+	err   error
+}
+
+func (s *hardwareKeyStore) Exists() (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.key != nil, nil
+}
+
+func (s *hardwareKeyStore) Generate() error {
+	sk, err := generateSecretKey()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.key = sk.Key
+	return nil
+}
+
+func (s *hardwareKeyStore) GetSecretAttribute() (*big.Int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.gets++
+	return new(big.Int).Set(s.key), nil
+}
+
+func (s *hardwareKeyStore) Transient() bool {
+	return true
+}
+
+func TestSecretKeyStore(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// The default store is exportable
+	require.True(t, client.SecretKeyExportable())
+	sk, err := client.ExportSecretKey()
+	require.NoError(t, err)
+	require.Zero(t, sk.Cmp(client.secretkey.Key))
+
+	// An empty store would make our credentials unusable
+	require.Error(t, client.SetSecretKeyStore(&hardwareKeyStore{}))
+	require.NotNil(t, client.secretkey)
+
+	store := &hardwareKeyStore{key: sk}
+	require.NoError(t, client.SetSecretKeyStore(store))
+	require.False(t, client.Locked())
+	require.Nil(t, client.secretkey)
+	require.False(t, client.SecretKeyExportable())
+	_, err = client.ExportSecretKey()
+	require.Equal(t, ErrSecretKeyNotExportable, err)
+
+	// Proofs are built using the key from the store, which is dropped afterwards
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+	require.Equal(t, irma.ServerStatusDone, server.Status())
+	require.Equal(t, 1, store.gets)
+	require.Nil(t, client.secretkey)
+
+	// Issued credentials are not kept in memory along with the key
+	server = newMockServer(t, studentCardIssuanceRequest())
+	defer server.Close()
+	result = runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+	require.Equal(t, 2, store.gets)
+	require.Nil(t, client.secretkey)
+	cached := 0
+	client.credentialsCache.Iterate(func(credLookup, *credential) { cached++ })
+	require.Zero(t, cached)
+
+	// A store refusing to release the key fails the session
+	store.err = errors.New("user authentication required")
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	result = runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+	require.Contains(t, result.err.Error(), "user authentication required")
+}
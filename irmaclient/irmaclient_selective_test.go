@@ -0,0 +1,107 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+// decliningHandler declines the specified credentials of issuance sessions.
+type decliningHandler struct {
+	*mockSessionHandler
+	declined []int
+}
+
+func (h *decliningHandler) RequestIssuancePermission(request *irma.IssuanceRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.mockSessionHandler.RequestIssuancePermission(request, satisfiable, candidates, requestor,
+		func(proceed bool, choice *irma.DisclosureChoice) {
+			if choice != nil {
+				choice.DeclinedCredentials = h.declined
+			}
+			callback(proceed, choice)
+		},
+	)
+}
+
+func runDecliningSession(t *testing.T, client *Client, request *irma.IssuanceRequest, declined ...int) (*mockServer, mockSessionResult) {
+	server := newMockServer(t, request)
+	h := &decliningHandler{mockSessionHandler: newMockSessionHandler(t), declined: declined}
+	client.NewSession(server.Qr(), h)
+	return server, h.wait()
+}
+
+func TestDeclineCredentials(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	newRequest := func() *irma.IssuanceRequest {
+		request := rootIssuanceRequest("12345")
+		request.Credentials = append(request.Credentials, studentCardIssuanceRequest().Credentials[0])
+		return request
+	}
+
+	t.Run("decline one", func(t *testing.T) {
+		server, result := runDecliningSession(t, client, newRequest(), 1)
+		defer server.Close()
+		require.Nil(t, result.err)
+
+		// Only the accepted credential is stored
+		require.Len(t, client.attrs(bsn.CredentialTypeIdentifier()), 1)
+		require.Empty(t, client.attrs(studentID.CredentialTypeIdentifier()))
+
+		var changes []*irma.CredentialChange
+		require.NoError(t, json.Unmarshal([]byte(result.success), &changes))
+		require.Len(t, changes, 2)
+		require.False(t, changes[0].Declined)
+		require.True(t, changes[1].Declined)
+		require.Equal(t, 1, changes[1].Credential)
+
+		// The log only mentions the accepted credential
+		logs, err := client.LoadNewestLogs(1)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		require.Equal(t, []int{1}, logs[0].DeclinedCredentials)
+		issued, err := logs[0].GetIssuedCredentials(client.Configuration)
+		require.NoError(t, err)
+		require.Len(t, issued, 1)
+		require.Equal(t, "MijnOverheid", issued[0].IssuerID)
+	})
+
+	t.Run("decline all", func(t *testing.T) {
+		server, result := runDecliningSession(t, client, newRequest(), 0, 1)
+		defer server.Close()
+		require.True(t, result.cancelled)
+		server.waitDeleted()
+		require.Empty(t, client.attrs(studentID.CredentialTypeIdentifier()))
+	})
+
+	t.Run("nonexisting credential", func(t *testing.T) {
+		server, result := runDecliningSession(t, client, newRequest(), 2)
+		defer server.Close()
+		require.NotNil(t, result.err)
+		require.Equal(t, irma.ErrorInvalidRequest, result.err.ErrorType)
+	})
+}
+
+func TestWarnDeclined(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+
+	request := studentIDRequest()
+	_, unsatisfiable, err := client.candidates(request)
+	require.NoError(t, err)
+	require.NotNil(t, unsatisfiable)
+	require.Equal(t, UnsatisfiedNoCredential, unsatisfiable.Unsatisfied[0].Reason)
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	session := &session{request: request, declined: []irma.CredentialTypeIdentifier{studentCard}}
+	session.warnDeclined(unsatisfiable)
+	require.Equal(t, UnsatisfiedDeclined, unsatisfiable.Unsatisfied[0].Reason)
+	require.Equal(t, studentCard, unsatisfiable.Unsatisfied[0].CredentialType)
+}
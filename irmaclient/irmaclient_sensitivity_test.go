@@ -0,0 +1,108 @@
+package irmaclient
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+type sensitiveDisclosureHandler struct {
+	*mockSessionHandler
+	proceed    bool
+	candidates [][]DisclosureCandidates
+	confirm    chan []*DisclosureCandidate
+}
+
+func newSensitiveDisclosureHandler(t *testing.T, proceed bool) *sensitiveDisclosureHandler {
+	return &sensitiveDisclosureHandler{
+		mockSessionHandler: newMockSessionHandler(t),
+		proceed:            proceed,
+		confirm:            make(chan []*DisclosureCandidate, 1),
+	}
+}
+
+func (h *sensitiveDisclosureHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool,
+	candidates [][]DisclosureCandidates, requestor *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.candidates = candidates
+	h.mockSessionHandler.RequestVerificationPermission(request, satisfiable, candidates, requestor, callback)
+}
+
+func (h *sensitiveDisclosureHandler) ConfirmSensitiveDisclosure(attributes []*DisclosureCandidate, callback func(proceed bool)) {
+	h.confirm <- attributes
+	callback(h.proceed)
+}
+
+func TestSensitiveDisclosure(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+
+	// Attributes that are not sensitive are not confirmed twice
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	h := newSensitiveDisclosureHandler(t, true)
+	client.NewSession(server.Qr(), h)
+	result := h.wait()
+	require.Nil(t, result.err)
+	require.Equal(t, irma.AttributeSensitivityNone, h.candidates[0][0][0].Sensitivity)
+	require.Empty(t, h.confirm)
+	logs, err := client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	require.Empty(t, logs[0].Sensitivity)
+
+	// Sensitive attributes are annotated in the candidates and confirmed again before disclosure
+	client.SetAttributeSensitivity(map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity{
+		studentID: irma.AttributeSensitivityIdentifier,
+	})
+	require.Equal(t, irma.AttributeSensitivityIdentifier, client.AttributeSensitivity(studentID))
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	h = newSensitiveDisclosureHandler(t, true)
+	client.NewSession(server.Qr(), h)
+	result = h.wait()
+	require.Nil(t, result.err)
+	require.Equal(t, irma.AttributeSensitivityIdentifier, h.candidates[0][0][0].Sensitivity)
+	confirmed := <-h.confirm
+	require.Len(t, confirmed, 1)
+	require.Equal(t, studentID, confirmed[0].Type)
+	require.Equal(t, "456", confirmed[0].Value[""])
+	require.Equal(t, irma.AttributeSensitivityIdentifier, confirmed[0].Sensitivity)
+	require.Equal(t, []string{mockEndpointRequest, mockEndpointProofs}, server.Calls())
+
+	logs, err = client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	require.Equal(t, map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity{
+		studentID: irma.AttributeSensitivityIdentifier,
+	}, logs[0].Sensitivity)
+	require.True(t, logs[0].SensitiveConfirmed)
+
+	// Declining the second confirmation cancels the session before anything is disclosed
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	h = newSensitiveDisclosureHandler(t, false)
+	client.NewSession(server.Qr(), h)
+	result = h.wait()
+	require.True(t, result.cancelled)
+	require.Len(t, <-h.confirm, 1)
+	require.Equal(t, []string{mockEndpointRequest}, server.Calls())
+
+	// Sessions of handlers that cannot confirm twice fail before anything is disclosed
+	server = newMockServer(t, studentIDRequest())
+	defer server.Close()
+	result = runMockSession(t, client, server, newMockSessionHandler(t))
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorSensitiveDisclosureUnconfirmed, result.err.ErrorType)
+	require.Equal(t, studentID.String(), result.err.Info)
+	require.NotContains(t, server.Calls(), mockEndpointProofs)
+
+	// Overrides can declassify attributes
+	client.SetAttributeSensitivity(map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity{
+		studentID: irma.AttributeSensitivityNone,
+	})
+	require.Equal(t, irma.AttributeSensitivityNone, client.AttributeSensitivity(studentID))
+	client.SetAttributeSensitivity(nil)
+	require.Equal(t, irma.AttributeSensitivityNone, client.AttributeSensitivity(studentID))
+}
@@ -0,0 +1,82 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatistics(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	stats, err := client.Statistics()
+	require.NoError(t, err)
+	require.Equal(t, len(client.CredentialInfoList()), stats.Credentials)
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.Equal(t, len(client.attrs(studentCard)), stats.CredentialsByIssuer[studentCard.IssuerIdentifier()])
+	schemeTotal := 0
+	for _, count := range stats.CredentialsByScheme {
+		schemeTotal += count
+	}
+	require.Equal(t, stats.Credentials, schemeTotal)
+
+	// A disclosure is counted once the log entry of the session is stored
+	disclosing := stats.SessionsByAction[irma.ActionDisclosing]
+	month := time.Now().Format("2006-01")
+	thisMonth := stats.SessionsByMonth[month]
+	require.NotNil(t, client.statistics)
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	require.Nil(t, runMockSession(t, client, server, newMockSessionHandler(t)).err)
+	require.Nil(t, client.statistics, "cached statistics not invalidated")
+
+	updated, err := client.Statistics()
+	require.NoError(t, err)
+	require.Equal(t, disclosing+1, updated.SessionsByAction[irma.ActionDisclosing])
+	require.Equal(t, thisMonth+1, updated.SessionsByMonth[month])
+	require.Equal(t, stats.Disclosures+1, updated.Disclosures)
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	var found bool
+	for _, attr := range updated.MostDisclosed {
+		found = found || attr.Type == studentID
+	}
+	require.True(t, found)
+
+	// Statistics contain counts only
+	bts, err := json.Marshal(updated)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "456")
+}
+
+func TestStatisticsExpiry(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+	sks := testPrivateKeys(t, client.Configuration)
+
+	expired := studentCardIssuanceRequest()
+	validity := irma.Timestamp(time.Now())
+	expired.Credentials[0].Validity = &validity
+	require.NoError(t, client.IssueLocally(expired, sks))
+
+	expiring := studentCardIssuanceRequest()
+	expiring.Credentials[0].Attributes["studentID"] = "s7654321"
+	validity = irma.Timestamp(time.Now().Add(14 * 24 * time.Hour))
+	expiring.Credentials[0].Validity = &validity
+	require.NoError(t, client.IssueLocally(expiring, sks))
+
+	valid := studentCardIssuanceRequest()
+	valid.Credentials[0].Attributes["studentID"] = "s1111111"
+	require.NoError(t, client.IssueLocally(valid, sks))
+
+	stats, err := client.Statistics()
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Credentials)
+	require.Equal(t, 1, stats.Expired)
+	require.Equal(t, 1, stats.ExpiringSoon)
+	require.Equal(t, 3, stats.CredentialsByScheme[irma.NewSchemeManagerIdentifier("irma-demo")])
+}
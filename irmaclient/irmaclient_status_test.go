@@ -0,0 +1,353 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// statusHandler records the status updates of a session.
+type statusHandler struct {
+	*mockSessionHandler
+	mutex    sync.Mutex
+	statuses []irma.ClientStatus
+}
+
+func newStatusHandler(t *testing.T) *statusHandler {
+	return &statusHandler{mockSessionHandler: newMockSessionHandler(t)}
+}
+
+func (h *statusHandler) StatusUpdate(_ irma.Action, status irma.ClientStatus) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.statuses = append(h.statuses, status)
+}
+
+func (h *statusHandler) Statuses() []irma.ClientStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]irma.ClientStatus{}, h.statuses...)
+}
+
+func TestSessionStatusTransitions(t *testing.T) {
+	var (
+		created       = irma.ClientStatusCreated
+		manualStarted = irma.ClientStatusManualStarted
+		communicating = irma.ClientStatusCommunicating
+		connected     = irma.ClientStatusConnected
+		pairing       = irma.ClientStatusPairing
+		cancelled     = irma.ClientStatusCancelled
+		done          = irma.ClientStatusDone
+		timeout       = irma.ClientStatusTimeout
+		failed        = irma.ClientStatusError
+	)
+	all := []irma.ClientStatus{created, manualStarted, communicating, connected, pairing, cancelled, done, timeout, failed}
+	legal := map[irma.ClientStatus][]irma.ClientStatus{
+		created:       {manualStarted, communicating, cancelled, timeout, failed},
+		manualStarted: {communicating, connected, cancelled, failed},
+		communicating: {connected, pairing, cancelled, done, timeout, failed},
+		connected:     {communicating, cancelled, timeout, failed},
+		pairing:       {communicating, cancelled, timeout, failed},
+	}
+
+	for _, from := range all {
+		require.Equal(t, legal[from] == nil, from.Finished(), from)
+		for _, to := range all {
+			handler := newStatusHandler(t)
+			session := &session{Action: irma.ActionDisclosing, Handler: handler, status: from}
+			changed := session.setStatus(to)
+
+			expected := false
+			for _, status := range legal[from] {
+				expected = expected || status == to
+			}
+			require.Equal(t, expected, changed, "%s -> %s", from, to)
+			if !expected {
+				// Illegal transitions and transitions to the same status are not reported
+				require.Equal(t, from, session.Status())
+				require.Empty(t, handler.Statuses())
+				continue
+			}
+			require.Equal(t, to, session.Status())
+			if to.Finished() {
+				require.Empty(t, handler.Statuses())
+			} else {
+				require.Equal(t, []irma.ClientStatus{to}, handler.Statuses())
+			}
+		}
+	}
+}
+
+func TestSessionStatus(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("done", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		h := newStatusHandler(t)
+		session := client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+		require.Equal(t, irma.ClientStatusDone, session.Status())
+		require.Equal(t, []irma.ClientStatus{irma.ClientStatusCommunicating, irma.ClientStatusConnected, irma.ClientStatusCommunicating}, h.Statuses())
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		h := newStatusHandler(t)
+		h.decline = true
+		session := client.NewSession(server.Qr(), h)
+		require.True(t, h.wait().cancelled)
+		require.Equal(t, irma.ClientStatusCancelled, session.Status())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		// The server no longer knows the session
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		h := newStatusHandler(t)
+		session := client.NewSession(`{"u":"`+server.URL+`/session/expired","irmaqr":"disclosing"}`, h)
+		require.NotNil(t, h.wait().err)
+		require.Equal(t, irma.ClientStatusTimeout, session.Status())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		server.inject(mockEndpointRequest, mockFault{Malformed: true})
+		h := newStatusHandler(t)
+		session := client.NewSession(server.Qr(), h)
+		require.NotNil(t, h.wait().err)
+		require.Equal(t, irma.ClientStatusError, session.Status())
+
+		// Dismissing a finished session does not change its status
+		session.Dismiss()
+		require.Equal(t, irma.ClientStatusError, session.Status())
+	})
+
+	t.Run("manual", func(t *testing.T) {
+		request := studentIDRequest()
+		request.ProtocolVersion = client.maxVersion
+		bts, err := json.Marshal(request)
+		require.NoError(t, err)
+		h := newStatusHandler(t)
+		session := client.NewSession(string(bts), h)
+		require.Nil(t, h.wait().err)
+		require.Equal(t, irma.ClientStatusDone, session.Status())
+		require.Equal(t, []irma.ClientStatus{irma.ClientStatusManualStarted, irma.ClientStatusConnected, irma.ClientStatusCommunicating}, h.Statuses())
+	})
+}
+
+// summaryHandler records the summary passed to SessionStarted.
+type summaryHandler struct {
+	*mockSessionHandler
+	summary chan SessionSummary
+}
+
+func (h *summaryHandler) SessionStarted(summary SessionSummary) {
+	h.summary <- summary
+}
+
+func TestSessionSummary(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("issuance", func(t *testing.T) {
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		h := &summaryHandler{mockSessionHandler: newMockSessionHandler(t), summary: make(chan SessionSummary, 1)}
+		session := client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+
+		summary := <-h.summary
+		require.Equal(t, &summary, session.Summary())
+		require.Equal(t, irma.ActionIssuing, summary.Action)
+		require.Equal(t, irma.NewVersion(2, 8), summary.ProtocolVersion)
+		require.Equal(t, "127.0.0.1", summary.Hostname)
+		require.Equal(t, 1, summary.Credentials)
+		require.Equal(t, 0, summary.Disjunctions)
+		require.Equal(t, []*irma.PublicKeyIdentifier{{Issuer: irma.NewIssuerIdentifier("irma-demo.RU"), Counter: 2}}, summary.KeyCounters)
+		require.Nil(t, summary.Nonce)
+		require.Nil(t, summary.Context)
+	})
+
+	t.Run("debug", func(t *testing.T) {
+		level := irma.Logger.GetLevel()
+		irma.Logger.SetLevel(logrus.DebugLevel)
+		defer irma.Logger.SetLevel(level)
+
+		request := studentIDRequest()
+		server := newMockServer(t, request)
+		defer server.Close()
+		h := newMockSessionHandler(t)
+		session := client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+
+		summary := session.Summary()
+		require.NotNil(t, summary)
+		require.Equal(t, irma.ActionDisclosing, summary.Action)
+		require.Equal(t, 1, summary.Disjunctions)
+		require.Empty(t, summary.KeyCounters)
+		require.Equal(t, request.Nonce, summary.Nonce)
+		require.Equal(t, request.Context, summary.Context)
+	})
+}
+
+// timingsHandler records the timings passed to SessionTimings.
+type timingsHandler struct {
+	*mockSessionHandler
+	timings chan PhaseTimings
+}
+
+func (h *timingsHandler) SessionTimings(timings PhaseTimings) {
+	h.timings <- timings
+}
+
+func TestSessionTimings(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("success", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		h := &timingsHandler{mockSessionHandler: newMockSessionHandler(t), timings: make(chan PhaseTimings, 1)}
+		session := client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+
+		timings := <-h.timings
+		require.Equal(t, timings, session.Timings())
+		phases := []*time.Time{&timings.Started, timings.RequestReceived, timings.PermissionShown,
+			timings.PermissionAnswered, timings.ProofsBuilt, timings.ResponsePosted, timings.Finished}
+		for i := 1; i < len(phases); i++ {
+			require.NotNil(t, phases[i], "phase %d", i)
+			require.False(t, phases[i].Before(*phases[i-1]), "phase %d", i)
+		}
+
+		logs, err := client.LoadNewestLogs(1)
+		require.NoError(t, err)
+		require.NotNil(t, logs[0].Timings)
+		require.Equal(t, timings.ResponsePosted.UnixNano(), logs[0].Timings.ResponsePosted.UnixNano())
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		server := newMockServer(t, studentIDRequest())
+		defer server.Close()
+		h := &timingsHandler{mockSessionHandler: newMockSessionHandler(t), timings: make(chan PhaseTimings, 1)}
+		h.decline = true
+		client.NewSession(server.Qr(), h)
+		h.wait()
+
+		timings := <-h.timings
+		require.NotNil(t, timings.PermissionAnswered)
+		require.NotNil(t, timings.Finished)
+		require.Nil(t, timings.ProofsBuilt)
+		require.Nil(t, timings.ResponsePosted)
+		require.Zero(t, timings.Durations().Proofs)
+	})
+}
+
+func TestPhaseDurations(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) *time.Time {
+		t := start.Add(time.Duration(ms) * time.Millisecond)
+		return &t
+	}
+	timings := PhaseTimings{
+		Started:            start,
+		RequestReceived:    at(100),
+		PermissionShown:    at(150),
+		PermissionAnswered: at(2150),
+		ProofsBuilt:        at(5250),
+		ResponsePosted:     at(5300),
+		Finished:           at(5310),
+		PinEntry:           3 * time.Second,
+	}
+	require.Equal(t, PhaseDurations{
+		Request:    100,
+		Processing: 50,
+		User:       5000,
+		Proofs:     100,
+		Response:   50,
+		Total:      5310,
+		Protocol:   310,
+	}, timings.Durations())
+	require.Equal(t, PhaseDurations{}, PhaseTimings{Started: start}.Durations())
+}
+
+// progressHandler records the progress passed to SessionProgress.
+type progressHandler struct {
+	*mockSessionHandler
+	mutex    sync.Mutex
+	progress []Progress
+	late     bool // whether progress was reported after the session ended
+}
+
+func (h *progressHandler) SessionProgress(action irma.Action, progress Progress) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.progress = append(h.progress, progress)
+	if len(h.result) > 0 {
+		h.late = true
+	}
+}
+
+func TestSessionProgress(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	t.Run("issuance", func(t *testing.T) {
+		request := studentCardIssuanceRequest()
+		request.Disclose = irma.AttributeConDisCon{{{irma.NewAttributeRequest("irma-demo.RU.studentCard.studentCardNumber")}}}
+		server := newMockServer(t, request)
+		defer server.Close()
+		h := &progressHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		require.Nil(t, h.wait().err)
+
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		require.False(t, h.late)
+		require.Equal(t, []Progress{
+			{Phase: ProgressBuildingProofs, Completed: 0, Total: 4, Percentage: 0},
+			{Phase: ProgressBuildingProofs, Completed: 1, Total: 4, Percentage: 25},
+			{Phase: ProgressBuildingProofs, Completed: 2, Total: 4, Percentage: 50},
+			{Phase: ProgressBuildingProofs, Completed: 3, Total: 4, Percentage: 75},
+			{Phase: ProgressBuildingProofs, Completed: 4, Total: 4, Percentage: 100},
+			{Phase: ProgressPostingResponse, Completed: 0, Total: 1, Percentage: 0},
+			{Phase: ProgressPostingResponse, Completed: 1, Total: 1, Percentage: 100},
+			{Phase: ProgressConstructingCredentials, Completed: 0, Total: 1, Percentage: 0},
+			{Phase: ProgressConstructingCredentials, Completed: 1, Total: 1, Percentage: 100},
+		}, h.progress)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		server := newMockServer(t, studentCardIssuanceRequest())
+		defer server.Close()
+		server.inject(mockEndpointCommitments, mockFault{ProofStatus: irma.ProofStatusInvalid})
+		h := &progressHandler{mockSessionHandler: newMockSessionHandler(t)}
+		client.NewSession(server.Qr(), h)
+		require.NotNil(t, h.wait().err)
+
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		require.False(t, h.late)
+		require.NotEmpty(t, h.progress)
+		for _, progress := range h.progress {
+			require.NotEqual(t, ProgressConstructingCredentials, progress.Phase)
+		}
+	})
+
+	t.Run("no handler", func(t *testing.T) {
+		session := &session{Handler: newMockSessionHandler(t)}
+		p := session.newProgress(ProgressBuildingProofs, 2)
+		require.Nil(t, p)
+		p.step() // does nothing
+	})
+}
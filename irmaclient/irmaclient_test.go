@@ -6,9 +6,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/gabi/signed"
 	irma "github.com/privacybydesign/irmago"
@@ -122,6 +125,42 @@ func verifyKeyshareIsUnmarshaled(t *testing.T, client *Client) {
 	require.NotEmpty(t, kss.Nonce)
 }
 
+func TestSupportedVersions(t *testing.T) {
+	require.NotEmpty(t, supportedVersions)
+	for i := 1; i < len(supportedVersions); i++ {
+		require.True(t, supportedVersions[i].AboveVersion(supportedVersions[i-1]),
+			"supportedVersions must be sorted from low to high: %s follows %s", supportedVersions[i], supportedVersions[i-1])
+	}
+	// QRs generated by irma.NewQr claim exactly the versions that we support
+	require.Equal(t, irma.MinProtocolVersion, supportedVersions[0])
+	require.Equal(t, irma.MaxProtocolVersion, supportedVersions[len(supportedVersions)-1])
+}
+
+func TestRequestorInfoHost(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	conf := client.Configuration
+
+	verified := conf.Requestors["localhost"]
+	require.NotNil(t, verified)
+	requestor := requestorInfo("https://localhost/irma/session/token", conf, false)
+	require.False(t, requestor.Unverified)
+	require.Equal(t, verified.Name, requestor.Name)
+
+	// A host not listed in the requestor schemes cannot pose as another requestor
+	for _, u := range []string{
+		"https://example.com/irma/session/token",
+		"https://localhost.example.com/irma/session/token",
+		"https://example.com/localhost/irma/session/token",
+	} {
+		requestor = requestorInfo(u, conf, false)
+		require.True(t, requestor.Unverified, u)
+		require.NotEqual(t, verified.ID, requestor.ID, u)
+		hostname := requestor.Hostnames[0]
+		require.Equal(t, irma.NewTranslatedString(&hostname), requestor.Name, u)
+	}
+}
+
 func TestStorageDeserialization(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, client, handler.storage)
@@ -265,6 +304,81 @@ func TestCandidateConjunctionOrder(t *testing.T) {
 	}
 }
 
+func TestDeterministicOrder(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	sks := testPrivateKeys(t, client.Configuration)
+	for _, id := range []string{"s2", "s3"} {
+		request := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+			KeyCounter:       2,
+			Attributes:       map[string]string{"university": "Radboud", "studentCardNumber": id, "studentID": id, "level": "1"},
+		}})
+		require.NoError(t, client.IssueLocally(request, sks))
+	}
+
+	studentID := irma.NewAttributeRequest("irma-demo.RU.studentCard.studentID")
+	level := irma.NewAttributeRequest("irma-demo.RU.studentCard.level")
+	email := irma.NewAttributeRequest("test.test.mijnirma.email")
+	request := &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{LDContext: irma.LDContextDisclosureRequest, ProtocolVersion: client.maxVersion},
+		Disclose: irma.AttributeConDisCon{
+			{{email}, {studentID, level}},
+			{{studentID}},
+			{{level, email}},
+		},
+	}
+
+	serialize := func() string {
+		check, err := client.CheckRequest(request)
+		require.NoError(t, err)
+		require.True(t, check.Satisfiable())
+		choice := &irma.DisclosureChoice{}
+		for _, discon := range check.Candidates {
+			// choose the last of the candidates that can be chosen
+			var chosen []*irma.AttributeIdentifier
+			for _, candidate := range discon {
+				if ids, err := candidate.Choose(); err == nil {
+					chosen = ids
+				}
+			}
+			require.NotNil(t, chosen)
+			choice.Attributes = append(choice.Attributes, chosen)
+		}
+		groups, indices, err := client.groupCredentials(choice)
+		require.NoError(t, err)
+		ks := &keyshareSession{schemeIDs: request.Identifiers().SchemeManagers}
+		bts, err := json.Marshal([]interface{}{
+			check, client.CredentialInfoList(), choice, len(groups), indices, ks.schemes(),
+		})
+		require.NoError(t, err)
+		return string(bts)
+	}
+
+	expected := serialize()
+	for i := 0; i < 100; i++ {
+		require.Equal(t, expected, serialize())
+	}
+
+	// Candidates follow the order in which the credentials were added
+	check, err := client.CheckRequest(request)
+	require.NoError(t, err)
+	var ids []string
+	for _, candidate := range check.Candidates[1] {
+		if candidate[0].Present() {
+			attrs, _ := client.attributesByHash(candidate[0].CredentialHash)
+			ids = append(ids, *attrs.UntranslatedAttribute(studentID.Type))
+		}
+	}
+	require.Equal(t, []string{"456", "s2", "s3"}, ids)
+
+	infos := client.CredentialInfoList()
+	for i := 1; i < len(infos); i++ {
+		require.LessOrEqual(t, infos[i-1].Identifier().String(), infos[i].Identifier().String())
+	}
+}
+
 func TestCredentialRemoval(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, client, handler.storage)
@@ -426,12 +540,371 @@ func TestCredentialsConcurrency(t *testing.T) {
 	}
 }
 
+func TestLock(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.ProtocolVersion = &irma.ProtocolVersion{Major: 2, Minor: 8}
+	choice := studentIDChoice(t, client, request)
+	sk := client.secretkey.Key
+	expected := new(big.Int).Set(sk)
+
+	client.Lock()
+	require.Zero(t, sk.Sign(), "secret key was not wiped")
+
+	// Locked does not need credMutex, so that it can be used by holders of it
+	client.credMutex.Lock()
+	require.True(t, client.Locked())
+	client.credMutex.Unlock()
+
+	// Credential metadata is still available
+	require.NotEmpty(t, client.CredentialInfoList())
+	_, satisfiable, err := client.Candidates(request)
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+
+	// but proofs cannot be computed
+	_, _, err = client.Proofs(choice, request)
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, client.Unlock())
+	require.False(t, client.Locked())
+	require.Equal(t, expected, client.secretkey.Key)
+	_, _, err = client.Proofs(choice, request)
+	require.NoError(t, err)
+}
+
+func TestClose(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	// The first client may start goroutines that live as long as the process (e.g. of HTTP
+	// transports), so we take our baseline after it
+	client, _ := parseExistingStorage(t, storage)
+	require.NoError(t, client.Close())
+	goroutines, fds, jobs := runtime.NumGoroutine(), openFiles(), len(sharedScheduler().Jobs())
+
+	for i := 0; i < 10; i++ {
+		client, _ = parseExistingStorage(t, storage)
+		require.NoError(t, client.Close())
+	}
+	require.Eventually(t, func() bool { return runtime.NumGoroutine() <= goroutines },
+		5*time.Second, 10*time.Millisecond, "goroutines leaked")
+	require.LessOrEqual(t, openFiles(), fds, "file descriptors leaked")
+	require.Len(t, sharedScheduler().Jobs(), jobs, "scheduled jobs leaked")
+
+	// A closed client refuses further use
+	require.NoError(t, client.Close())
+	require.True(t, client.Closed())
+	hash := client.CredentialInfoList()[0].Hash
+	require.ErrorIs(t, client.RemoveCredentialByHash(hash), ErrClosed)
+	_, err := client.LoadNewestLogs(10)
+	require.ErrorIs(t, err, ErrClosed)
+
+	sessionHandler := newMockSessionHandler(t)
+	qr, err := json.Marshal(&irma.Qr{URL: "http://localhost/irma/session/token", Type: irma.ActionDisclosing})
+	require.NoError(t, err)
+	require.Nil(t, client.NewSession(string(qr), sessionHandler))
+	result := sessionHandler.wait()
+	require.Error(t, result.err)
+	require.Equal(t, irma.ErrorClosed, result.err.ErrorType)
+
+	// Running sessions are dismissed when the client is closed
+	client, _ = parseExistingStorage(t, storage)
+	server := newMockServer(t, studentIDRequest())
+	defer server.Close()
+	sessionHandler = newMockSessionHandler(t)
+	client.NewSession(server.Qr(), sessionHandler)
+	<-sessionHandler.permissionRequested
+	require.NoError(t, client.Close())
+	require.True(t, sessionHandler.wait().cancelled)
+}
+
+// openFiles returns the amount of open file descriptors of the process, or -1 if unknown.
+func openFiles() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// printingHandler only handles session success, relying on HandlerBase for everything else
+type printingHandler struct {
+	HandlerBase
+}
+
+var _ Handler = printingHandler{}
+
+func (printingHandler) Success(result string) {
+	fmt.Println("success:", result)
+}
+
+func TestHandlerBase(t *testing.T) {
+	var h Handler = printingHandler{}
+
+	h.RequestVerificationPermission(nil, true, nil, nil, func(proceed bool, choice *irma.DisclosureChoice) {
+		require.False(t, proceed)
+		require.Nil(t, choice)
+	})
+	cancelled := false
+	h.RequestPin(PinMetadata{RemainingAttempts: -1}, func(pin string) {
+		require.Fail(t, "PIN request not cancelled")
+	}, func() {
+		cancelled = true
+	})
+	require.True(t, cancelled)
+	h.RequestUnlock(func(proceed bool) {
+		require.False(t, proceed)
+	})
+	h.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport})
+}
+
+func ExampleHandlerBase() {
+	var h Handler = printingHandler{}
+	h.StatusUpdate(irma.ActionDisclosing, irma.ClientStatusConnected) // ignored by HandlerBase
+	h.Success("done")
+	// Output: success: done
+}
+
+func TestSubscribe(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	sub := client.Subscribe(10)
+
+	request := studentCardIssuanceRequest()
+	request.Disclose = irma.AttributeConDisCon{{{irma.NewAttributeRequest("irma-demo.RU.studentCard.studentCardNumber")}}}
+	server := newMockServer(t, request)
+	defer server.Close()
+	result := runMockSession(t, client, server, newMockSessionHandler(t))
+	require.Nil(t, result.err)
+
+	added, ok := (<-sub.Events()).(CredentialAdded)
+	require.True(t, ok)
+	require.Equal(t, "studentCard", added.Info.ID)
+	logged, ok := (<-sub.Events()).(LogAppended)
+	require.True(t, ok)
+	require.Equal(t, irma.ActionIssuing, logged.Entry.Type)
+
+	// Removal of the credential is reported, along with the removal log entry
+	require.NoError(t, client.RemoveCredentialByHash(added.Info.Hash))
+	removed, ok := (<-sub.Events()).(CredentialRemoved)
+	require.True(t, ok)
+	require.Equal(t, added.Info.Hash, removed.ID.Hash)
+	logged, ok = (<-sub.Events()).(LogAppended)
+	require.True(t, ok)
+	require.Equal(t, ActionRemoval, logged.Entry.Type)
+
+	require.NoError(t, client.RemoveStorage())
+	require.Equal(t, CredentialsReplaced{}, <-sub.Events())
+
+	sub.Unsubscribe()
+	_, ok = <-sub.Events()
+	require.False(t, ok)
+	require.NoError(t, client.RemoveStorage()) // no longer delivered, and does not panic
+	sub.Unsubscribe()
+}
+
+func TestSubscribeDropOldest(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	sub := client.Subscribe(2)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 5; i++ {
+		client.emit(KeyshareEnrolled{SchemeManager: irma.NewSchemeManagerIdentifier(fmt.Sprint(i))})
+	}
+	require.Equal(t, 3, sub.Dropped())
+	require.Equal(t, KeyshareEnrolled{SchemeManager: irma.NewSchemeManagerIdentifier("3")}, <-sub.Events())
+	require.Equal(t, KeyshareEnrolled{SchemeManager: irma.NewSchemeManagerIdentifier("4")}, <-sub.Events())
+}
+
+func TestCredentialNickname(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	rootID := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	bsnID := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	issueRoot := func(bsn string) {
+		server := newMockServer(t, irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+			CredentialTypeID: rootID,
+			KeyCounter:       1,
+			Attributes:       map[string]string{"BSN": bsn},
+		}}))
+		defer server.Close()
+		result := runMockSession(t, client, server, newMockSessionHandler(t))
+		require.Nil(t, result.err)
+	}
+	nickname := func(hash string) string {
+		for _, info := range client.CredentialInfoList() {
+			if info.Hash == hash {
+				return info.Nickname
+			}
+		}
+		t.Fatal("credential not found")
+		return ""
+	}
+
+	issueRoot("12345")
+	hash := client.attrs(rootID)[0].Hash()
+	require.Equal(t, "", nickname(hash))
+	require.NoError(t, client.SetCredentialNickname(hash, "personal"))
+	require.Error(t, client.SetCredentialNickname("nonexisting", "personal"))
+	require.Equal(t, "personal", nickname(hash))
+
+	candidates, satisfiable, err := client.Candidates(irma.NewDisclosureRequest(bsnID))
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	require.Equal(t, "personal", candidates[0][0][0].Nickname)
+
+	// The nickname survives reissuance of the singleton credential, and reopening the client
+	issueRoot("54321")
+	require.Len(t, client.attrs(rootID), 1)
+	newHash := client.attrs(rootID)[0].Hash()
+	require.NotEqual(t, hash, newHash)
+	require.Equal(t, "personal", nickname(newHash))
+
+	require.NoError(t, client.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	require.Equal(t, "personal", nickname(newHash))
+
+	// Removing the credential or the nickname removes the nickname
+	require.NoError(t, client.SetCredentialNickname(newHash, ""))
+	require.Equal(t, "", nickname(newHash))
+	require.NoError(t, client.SetCredentialNickname(newHash, "personal"))
+	require.NoError(t, client.RemoveCredentialByHash(newHash))
+	require.Empty(t, client.nicknames)
+
+	// If storing the nickname fails, the nicknames in memory are left as they were
+	hash = client.CredentialInfoList()[0].Hash
+	require.NoError(t, client.storage.db.Close())
+	require.Error(t, client.SetCredentialNickname(hash, "personal"))
+	require.Empty(t, client.nicknames)
+	require.Equal(t, "", nickname(hash))
+}
+
+func TestSearchAttributes(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	hash := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))[0].Hash()
+
+	require.Contains(t, client.SearchAttributes("RADB", "en"), AttributeMatch{
+		CredentialHash: hash,
+		Attribute:      irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"),
+		Value:          "Radboud",
+		Name:           "University",
+		Start:          0,
+		End:            4,
+	})
+	require.Contains(t, client.SearchAttributes("kaartnummer", "nl"), AttributeMatch{
+		CredentialHash: hash,
+		Attribute:      irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentCardNumber"),
+		Value:          "123",
+		Name:           "Studentenkaartnummer",
+		InName:         true,
+		Start:          9,
+		End:            20,
+	})
+	require.Empty(t, client.SearchAttributes("nonexisting", "en"))
+	require.Empty(t, client.SearchAttributes("", "en"))
+
+	start, end := indexFold("Straße ÄMSTERDAM", "ämster")
+	require.Equal(t, "ÄMSTER", "Straße ÄMSTERDAM"[start:end])
+	start, _ = indexFold("Amsterdam", "rotterdam")
+	require.Equal(t, -1, start)
+}
+
+// BenchmarkSearchAttributes searches a wallet of a few hundred credentials, which are
+// kept in memory only: searching does not need the storage.
+func BenchmarkSearchAttributes(b *testing.B) {
+	conf, err := irma.NewConfiguration(filepath.Join("..", "testdata", "irma_configuration"), irma.ConfigurationOptions{})
+	require.NoError(b, err)
+	require.NoError(b, conf.ParseFolder())
+	client := &Client{Configuration: conf, attributes: map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}}
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	for i := 0; i < 300; i++ {
+		attrs, err := (&irma.CredentialRequest{
+			CredentialTypeID: id,
+			KeyCounter:       2,
+			Attributes: map[string]string{
+				"university":        fmt.Sprintf("University of Amsterdam %d", i),
+				"studentCardNumber": fmt.Sprint(i),
+				"studentID":         fmt.Sprintf("s%d", i),
+				"level":             "42",
+			},
+		}).AttributeList(conf, 0x03, nil, time.Now())
+		require.NoError(b, err)
+		client.attributes[id] = append(client.attributes[id], attrs)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(client.SearchAttributes("amster", "en")) != 300 {
+			b.Fatal("unexpected amount of matches")
+		}
+	}
+}
+
+func TestImportOldStorage(t *testing.T) {
+	client, handler := parseExistingStorage(t, test.CreateTestStorage(t))
+	defer func() { test.ClearTestStorage(t, client, handler.storage) }()
+	old := os.DirFS(filepath.Join(test.FindTestdataFolder(t), "legacy_android"))
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	mijnirma := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	root := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+
+	// No storage of the old app is available to us, so the fixture is constructed in its format
+	// from the credentials of the test storage. It contains a valid and a tampered studentCard,
+	// a keyshare credential, and a malformed credential.
+	result, err := client.ImportOldStorage(old)
+	require.NoError(t, err)
+	require.Len(t, result.Credentials, 1)
+	require.Equal(t, studentCard, result.Credentials[0].Type)
+	require.Equal(t, []OldStorageSkipped{
+		{CredentialType: root, Index: 0, Reason: "malformed credential"},
+		{CredentialType: studentCard, Index: 1, Reason: "invalid signature"},
+		{CredentialType: mijnirma, Index: 0, Reason: "scheme has a keyshare server"},
+	}, result.Skipped)
+
+	// The secret key of the old app is adopted, and the imported credential survives a restart
+	cred, _, err := client.credentialByHash(result.Credentials[0].Hash)
+	require.NoError(t, err)
+	require.Equal(t, cred.Attributes[0], client.secretkey.Key)
+	require.NoError(t, client.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	require.Len(t, client.CredentialInfoList(), 1)
+	cred, _, err = client.credentialByHash(result.Credentials[0].Hash)
+	require.NoError(t, err)
+	require.True(t, cred.Signature.Verify(cred.Pk, cred.Attributes))
+	require.Empty(t, client.keyshareServers)
+
+	// Importing again skips the credential that is already present
+	result, err = client.ImportOldStorage(old)
+	require.NoError(t, err)
+	require.Empty(t, result.Credentials)
+	require.Len(t, client.CredentialInfoList(), 1)
+	require.Contains(t, result.Skipped, OldStorageSkipped{CredentialType: studentCard, Index: 0, Reason: "already present"})
+
+	// The fixture was created from the test storage, so importing into it adds nothing
+	other, otherHandler := parseStorage(t)
+	defer test.ClearTestStorage(t, other, otherHandler.storage)
+	sk := other.secretkey.Key
+	result, err = other.ImportOldStorage(old)
+	require.NoError(t, err)
+	require.Empty(t, result.Credentials)
+	require.Equal(t, sk, other.secretkey.Key)
+}
+
 // ------
 
 type TestClientHandler struct {
-	t       *testing.T
-	c       chan error
-	storage string
+	t         *testing.T
+	c         chan error
+	storage   string
+	recovered *StorageRecoveryReport
 }
 
 func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
@@ -479,6 +952,9 @@ func (i *TestClientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifie
 		i.t.Fatal(err)
 	}
 }
+func (i *TestClientHandler) StorageRecovered(report *StorageRecoveryReport) {
+	i.recovered = report
+}
 func (i *TestClientHandler) ReportError(err error) {
 	select {
 	case i.c <- err: //nop
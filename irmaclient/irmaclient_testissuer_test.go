@@ -0,0 +1,67 @@
+package irmaclient
+
+import (
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func testPrivateKeys(t *testing.T, conf *irma.Configuration) irma.PrivateKeyRing {
+	sks, err := irma.NewPrivateKeyRingFolder(filepath.Join(test.FindTestdataFolder(t), "privatekeys"), conf)
+	require.NoError(t, err)
+	return sks
+}
+
+func TestIssueLocally(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+	sks := testPrivateKeys(t, client.Configuration)
+
+	require.NoError(t, client.IssueLocally(studentCardIssuanceRequest(), sks))
+	infos := client.CredentialInfoList()
+	require.Len(t, infos, 1)
+	require.Equal(t, "s1234567", infos[0].Attributes[irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")][""])
+
+	// The signature verifies against the public key from the scheme
+	cred, err := client.credential(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0)
+	require.NoError(t, err)
+	pk, err := client.Configuration.PublicKey(cred.CredentialType().IssuerIdentifier(), cred.KeyCounter())
+	require.NoError(t, err)
+	require.True(t, cred.Signature.Verify(pk, cred.Attributes))
+
+	// and the credential can be disclosed
+	request := studentIDRequest()
+	request.ProtocolVersion = client.maxVersion
+	disclosure, _, err := client.Proofs(studentIDChoice(t, client, request), request)
+	require.NoError(t, err)
+	disclosed, status, err := disclosure.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Equal(t, "s1234567", *disclosed[0][0].RawValue)
+
+	t.Run("unsupported", func(t *testing.T) {
+		request := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier("test.test.email"),
+			Attributes:       map[string]string{"email": "example@example.com"},
+		}})
+		require.Error(t, client.IssueLocally(request, sks))
+
+		request = studentCardIssuanceRequest()
+		request.Credentials[0].RevocationSupported = true
+		require.Error(t, client.IssueLocally(request, sks))
+
+		request = irma.NewIssuanceRequest(studentCardIssuanceRequest().Credentials,
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+		require.Error(t, client.IssueLocally(request, sks))
+	})
+
+	t.Run("missing private key", func(t *testing.T) {
+		request := studentCardIssuanceRequest()
+		request.Credentials[0].KeyCounter = 1
+		require.Error(t, client.IssueLocally(request, sks))
+		require.Len(t, client.CredentialInfoList(), 1)
+	})
+}
@@ -0,0 +1,298 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwesterb/go-atum"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/internal/testkeyshare"
+	"github.com/stretchr/testify/require"
+)
+
+var recordTranscripts = flag.Bool("record-transcripts", false, "record the transcripts in testdata/transcripts anew")
+
+// transcriptSession is a session of which a transcript is kept in testdata/transcripts.
+type transcriptSession struct {
+	name     string
+	keyshare bool
+	request  func() irma.SessionRequest
+	check    func(t *testing.T, client *Client)
+}
+
+var transcriptSessions = []transcriptSession{
+	{
+		name:    "disclosure",
+		request: func() irma.SessionRequest { return studentIDRequest() },
+	},
+	{
+		name: "signing",
+		request: func() irma.SessionRequest {
+			return irma.NewSignatureRequest("To be signed", irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+		},
+	},
+	{
+		name:    "issuance",
+		request: func() irma.SessionRequest { return studentCardIssuanceRequest() },
+		check: func(t *testing.T, client *Client) {
+			// The issued credential is stored next to the one the client already had
+			var ids []string
+			for _, cred := range client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")) {
+				ids = append(ids, *cred.UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+			}
+			require.ElementsMatch(t, []string{"456", "s1234567"}, ids)
+		},
+	},
+	{
+		name:     "keyshare",
+		keyshare: true,
+		request: func() irma.SessionRequest {
+			return irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email"))
+		},
+	},
+}
+
+// TestTranscripts replays the transcripts of the transcriptSessions. Run it with the
+// -record-transcripts flag to record the transcripts anew.
+func TestTranscripts(t *testing.T) {
+	defer stubTimestampServer()()
+
+	for _, session := range transcriptSessions {
+		t.Run(session.name, func(t *testing.T) {
+			path := filepath.Join(test.FindTestdataFolder(t), "transcripts", session.name+".json")
+			if *recordTranscripts {
+				recordTranscript(t, session, path)
+			}
+			replayTranscript(t, session, path)
+		})
+	}
+}
+
+func recordTranscript(t *testing.T, session transcriptSession, path string) {
+	if session.keyshare {
+		ks := testkeyshare.StartKeyshareServer(t, irma.Logger, irma.NewSchemeManagerIdentifier("test"))
+		defer ks.Stop()
+	}
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, session.request())
+	defer server.Close()
+
+	random := &capturingRandom{source: rand.Reader}
+	client.setRandomSource(random)
+	recorder := irma.NewTranscriptRecorder(nil)
+	client.SetTransportRoundTripper(recorder)
+
+	h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(server.Qr(), h)
+	require.Nil(t, h.wait().err)
+
+	transcript := recorder.Transcript()
+	transcript.Qr = &irma.Qr{}
+	require.NoError(t, json.Unmarshal([]byte(server.Qr()), transcript.Qr))
+	transcript.Randomness = random.captured.Bytes()
+	require.NoError(t, transcript.Save(path))
+}
+
+func replayTranscript(t *testing.T, session transcriptSession, path string) {
+	transcript, err := irma.LoadTranscript(path)
+	require.NoError(t, err)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	client.setRandomSource(bytes.NewReader(transcript.Randomness))
+	replayer := irma.NewTranscriptReplayer(transcript)
+	client.SetTransportRoundTripper(replayer)
+
+	qr, err := json.Marshal(transcript.Qr)
+	require.NoError(t, err)
+	h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+	client.NewSession(string(qr), h)
+	require.Nil(t, h.wait().err)
+	require.Empty(t, replayer.Remaining())
+
+	logs, err := client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	require.Equal(t, transcript.Qr.Type, logs[0].Type)
+	if session.check != nil {
+		session.check(t, client)
+	}
+}
+
+// TestTranscriptResponses checks that the proofs and commitments that the client sends in the
+// replayed sessions are byte for byte the same as in the transcripts. Signing is skipped, as
+// its proofs depend on the timestamp, which is not recorded; and so is the keyshare session,
+// in which the order in which the randomness is consumed is not fixed.
+func TestTranscriptResponses(t *testing.T) {
+	for _, name := range []string{"disclosure", "issuance"} {
+		t.Run(name, func(t *testing.T) {
+			transcript, err := irma.LoadTranscript(filepath.Join(test.FindTestdataFolder(t), "transcripts", name+".json"))
+			require.NoError(t, err)
+			client, handler := parseStorage(t)
+			defer test.ClearTestStorage(t, client, handler.storage)
+
+			client.setRandomSource(bytes.NewReader(transcript.Randomness))
+			recorder := &bodyRecorder{next: irma.NewTranscriptReplayer(transcript), bodies: map[string]string{}}
+			client.SetTransportRoundTripper(recorder)
+
+			qr, err := json.Marshal(transcript.Qr)
+			require.NoError(t, err)
+			h := &pinCountingHandler{mockSessionHandler: newMockSessionHandler(t)}
+			client.NewSession(string(qr), h)
+			require.Nil(t, h.wait().err)
+
+			checked := 0
+			for _, exchange := range transcript.Exchanges {
+				if strings.HasSuffix(exchange.URL, "/proofs") || strings.HasSuffix(exchange.URL, "/commitments") {
+					require.Equal(t, exchange.Request, recorder.bodies[exchange.URL])
+					checked++
+				}
+			}
+			require.Equal(t, 1, checked)
+		})
+	}
+}
+
+// bodyRecorder records the bodies of the requests that it passes on, by URL.
+type bodyRecorder struct {
+	next   http.RoundTripper
+	bodies map[string]string
+}
+
+func (r *bodyRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		bts, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.bodies[req.URL.String()] = string(bts)
+		req.Body = ioutil.NopCloser(bytes.NewReader(bts))
+	}
+	return r.next.RoundTrip(req)
+}
+
+func TestTranscriptRedaction(t *testing.T) {
+	exchange := &irma.TranscriptExchange{
+		URL:      "http://localhost:8080/users/verify/pin",
+		Request:  `{"id":"user","pin":"secret"}`,
+		Response: `{"status":"success","message":"token"}`,
+	}
+	irma.RedactTranscriptExchange(exchange)
+	require.NotContains(t, exchange.Request, "secret")
+	require.Contains(t, exchange.Request, "user")
+	require.NotContains(t, exchange.Response, "token")
+
+	exchange = &irma.TranscriptExchange{
+		URL:     "http://localhost:8080/users/verify/pin_challengeresponse",
+		Request: `{"id":"user","auth_response_jwt":"jwt containing the pin"}`,
+	}
+	irma.RedactTranscriptExchange(exchange)
+	require.NotContains(t, exchange.Request, "jwt containing the pin")
+
+	// Failed PIN verifications contain the remaining attempts rather than a token
+	exchange = &irma.TranscriptExchange{
+		URL:      "http://localhost:8080/users/verify/pin",
+		Response: `{"status":"failure","message":"2"}`,
+	}
+	irma.RedactTranscriptExchange(exchange)
+	require.Equal(t, `{"status":"failure","message":"2"}`, exchange.Response)
+}
+
+func TestTranscriptReplayMismatch(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// A session that deviates from the transcript fails without network access
+	transcript, err := irma.LoadTranscript(filepath.Join(test.FindTestdataFolder(t), "transcripts", "disclosure.json"))
+	require.NoError(t, err)
+	transcript.Exchanges = transcript.Exchanges[:1]
+	client.SetTransportRoundTripper(irma.NewTranscriptReplayer(transcript))
+	shortResponseRetries(t, 0) // the deviating response would otherwise be retried for a minute
+	qr, err := json.Marshal(transcript.Qr)
+	require.NoError(t, err)
+	h := newMockSessionHandler(t)
+	client.NewSession(string(qr), h)
+	result := h.wait()
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorTransport, result.err.ErrorType)
+}
+
+// capturingRandom is a source of randomness for the client that records the randomness it
+// hands out, so that it can be replayed.
+type capturingRandom struct {
+	source   io.Reader
+	captured bytes.Buffer
+}
+
+func (r *capturingRandom) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(r.source, p)
+	r.captured.Write(p[:n])
+	return n, err
+}
+
+// timestampStub answers the requests for timestamps of attribute-based signatures, and for
+// checking the public key of timestamps, that are normally sent to the timestamp server of the
+// scheme, and passes all other requests on.
+type timestampStub struct {
+	next http.RoundTripper
+	pk   ed25519.PublicKey
+	sk   ed25519.PrivateKey
+}
+
+// stubTimestampServer installs a timestampStub as http.DefaultTransport, used by go-atum,
+// returning a function that restores the original.
+func stubTimestampServer() func() {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	original := http.DefaultTransport
+	http.DefaultTransport = &timestampStub{next: original, pk: pk, sk: sk}
+	return func() { http.DefaultTransport = original }
+}
+
+func (s *timestampStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != "irma.sidn.nl" {
+		return s.next.RoundTrip(req)
+	}
+	var response interface{}
+	if strings.HasSuffix(req.URL.Path, "/checkPublicKey") {
+		response = &atum.PublicKeyCheckResponse{Trusted: true, Expires: time.Now().Add(time.Hour)}
+	} else {
+		var request atum.Request
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return nil, err
+		}
+		now := time.Now().Unix()
+		response = &atum.Response{Stamp: &atum.Timestamp{
+			Time:      now,
+			ServerUrl: "https://irma.sidn.nl/atumd/",
+			Sig: atum.Signature{
+				Alg:       atum.Ed25519,
+				Data:      ed25519.Sign(s.sk, atum.EncodeTimeNonce(now, request.Nonce)),
+				PublicKey: s.pk,
+			},
+		}}
+	}
+	bts, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(bts)),
+		Request:    req,
+	}, nil
+}
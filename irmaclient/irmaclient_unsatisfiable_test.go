@@ -0,0 +1,345 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/gabi/revocation"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnsatisfiableRequest(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+	sks := testPrivateKeys(t, client.Configuration)
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	firstname := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	request := func(discons ...irma.AttributeDisCon) *irma.DisclosureRequest {
+		r := irma.NewDisclosureRequest()
+		r.Disclose = discons
+		return r
+	}
+	value := func(attr irma.AttributeTypeIdentifier, value string) irma.AttributeCon {
+		return irma.AttributeCon{{Type: attr, Value: &value}}
+	}
+	unsatisfiable := func(request irma.SessionRequest) *UnsatisfiableRequest {
+		_, unsatisfiable, err := client.candidates(request)
+		require.NoError(t, err)
+		return unsatisfiable
+	}
+
+	// Without credentials all disjunctions lack a credential, and where to get them is included
+	result := unsatisfiable(request(irma.AttributeDisCon{value(university, "Radboud")}, irma.AttributeDisCon{{{Type: firstname}}}))
+	conf := client.Configuration
+	require.Equal(t, &UnsatisfiableRequest{Disjunctions: 2, EmptyWallet: true, Unsatisfied: []*UnsatisfiedDisCon{
+		{
+			Index: 0, Reason: UnsatisfiedNoCredential, CredentialType: studentCard,
+			CredentialTypeName: conf.CredentialTypes[studentCard].Name,
+			IssuerName:         conf.Issuers[studentCard.IssuerIdentifier()].Name,
+			IssueURL:           conf.CredentialTypes[studentCard].IssueURL,
+		},
+		{
+			Index: 1, Reason: UnsatisfiedNoCredential, CredentialType: firstname.CredentialTypeIdentifier(),
+			CredentialTypeName: conf.CredentialTypes[firstname.CredentialTypeIdentifier()].Name,
+			IssuerName:         conf.Issuers[firstname.CredentialTypeIdentifier().IssuerIdentifier()].Name,
+		},
+	}}, result)
+	require.Equal(t, "https://example.com", result.Unsatisfied[0].IssueURL.Translation("en"))
+	require.Equal(t, "Demo Radboud University Nijmegen", result.Unsatisfied[0].IssuerName.Translation("en"))
+
+	// Issue a student card that expired right away
+	issuance := studentCardIssuanceRequest()
+	validity := irma.Timestamp(time.Now())
+	issuance.Credentials[0].Validity = &validity
+	require.NoError(t, client.IssueLocally(issuance, sks))
+	expired := client.CredentialInfoList()[0]
+	require.True(t, expired.IsExpired())
+
+	result = unsatisfiable(request(irma.AttributeDisCon{value(university, "Radboud")}))
+	require.False(t, result.EmptyWallet)
+	require.Len(t, result.Unsatisfied, 1)
+	require.Equal(t, UnsatisfiedExpired, result.Unsatisfied[0].Reason)
+	require.Equal(t, expired.Hash, result.Unsatisfied[0].Nearest.Hash)
+
+	result = unsatisfiable(request(irma.AttributeDisCon{value(university, "Other")}))
+	require.Equal(t, UnsatisfiedWrongValue, result.Unsatisfied[0].Reason)
+	require.Equal(t, expired.Hash, result.Unsatisfied[0].Nearest.Hash)
+
+	// Of the options of a disjunction the nearest one is reported, and only unsatisfiable
+	// disjunctions are included
+	result = unsatisfiable(request(
+		irma.AttributeDisCon{{{Type: firstname}}, value(university, "Other"), value(university, "Radboud")},
+		irma.AttributeDisCon{{{Type: firstname}}},
+	))
+	require.Equal(t, 2, result.Disjunctions)
+	require.Len(t, result.Unsatisfied, 2)
+	require.Equal(t, UnsatisfiedExpired, result.Unsatisfied[0].Reason)
+	require.Equal(t, UnsatisfiedNoCredential, result.Unsatisfied[1].Reason)
+	require.Equal(t, 1, result.Unsatisfied[1].Index)
+
+	// The hardest credential of a conjunction determines the reason for the option
+	result = unsatisfiable(request(irma.AttributeDisCon{append(value(university, "Radboud"), irma.AttributeRequest{Type: firstname})}))
+	require.Equal(t, UnsatisfiedNoCredential, result.Unsatisfied[0].Reason)
+	require.Equal(t, firstname.CredentialTypeIdentifier(), result.Unsatisfied[0].CredentialType)
+
+	// A revoked credential
+	client.attributes[studentCard][0].Revoked = true
+	result = unsatisfiable(request(irma.AttributeDisCon{value(university, "Radboud")}))
+	require.Equal(t, UnsatisfiedRevoked, result.Unsatisfied[0].Reason)
+	client.attributes[studentCard][0].Revoked = false
+
+	// Once the user has a valid credential the request is satisfiable
+	require.NoError(t, client.IssueLocally(studentCardIssuanceRequest(), sks))
+	require.Nil(t, unsatisfiable(request(irma.AttributeDisCon{value(university, "Radboud")})))
+
+	// A credential without nonrevocation witness does not satisfy a request for a nonrevocation proof
+	nonrev := request(irma.AttributeDisCon{value(university, "Radboud")})
+	nonrev.Revocation = irma.NonRevocationParameters{studentCard: {Updates: map[uint]*revocation.Update{2: {}}}}
+	result = unsatisfiable(nonrev)
+	require.Equal(t, UnsatisfiedNoWitness, result.Unsatisfied[0].Reason)
+	require.Equal(t, studentCard, *result.missingWitness())
+
+	// The structure can be passed to apps in JSON
+	bts, err := json.Marshal(unsatisfiable(request(irma.AttributeDisCon{value(university, "Other")})))
+	require.NoError(t, err)
+	parsed := &UnsatisfiableRequest{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, UnsatisfiedWrongValue, parsed.Unsatisfied[0].Reason)
+	require.Equal(t, studentCard, parsed.Unsatisfied[0].CredentialType)
+	require.NotNil(t, parsed.Unsatisfied[0].Nearest)
+}
+
+// unsatisfiableHandler records the details passed to Handler.Unsatisfiable.
+type unsatisfiableHandler struct {
+	*mockSessionHandler
+	unsatisfiable chan *UnsatisfiableRequest
+}
+
+func (h *unsatisfiableHandler) Unsatisfiable(request *UnsatisfiableRequest) {
+	h.unsatisfiable <- request
+}
+
+func TestUnsatisfiableSession(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	server := newMockServer(t, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")))
+	defer server.Close()
+
+	h := &unsatisfiableHandler{mockSessionHandler: newMockSessionHandler(t), unsatisfiable: make(chan *UnsatisfiableRequest, 1)}
+	client.NewSession(server.Qr(), h)
+	require.True(t, h.wait().cancelled)
+	unsatisfiable := <-h.unsatisfiable
+	require.Equal(t, 1, unsatisfiable.Disjunctions)
+	require.Equal(t, UnsatisfiedNoCredential, unsatisfiable.Unsatisfied[0].Reason)
+}
+
+func TestMissingWitnessSession(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	request := studentIDRequest()
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	request.Revocation = irma.NonRevocationParameters{studentCard: {Updates: map[uint]*revocation.Update{2: {}}}}
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	client.NewSession(server.Qr(), h)
+	result := h.wait()
+	require.NotNil(t, result.err)
+	require.Equal(t, irma.ErrorMissingWitness, result.err.ErrorType, result.err.Error())
+	require.Equal(t, studentCard.String(), result.err.Info)
+	require.Empty(t, h.permissionRequested)
+}
+
+// checkingHandler declines sessions, recording what they showed the user as a RequestCheck.
+type checkingHandler struct {
+	*mockSessionHandler
+	check         chan *RequestCheck
+	unsatisfiable *UnsatisfiableRequest
+}
+
+func (h *checkingHandler) Unsatisfiable(request *UnsatisfiableRequest) {
+	h.unsatisfiable = request
+}
+
+func (h *checkingHandler) record(request irma.SessionRequest, candidates [][]DisclosureCandidates, callback PermissionHandler) {
+	h.check <- &RequestCheck{Request: request, Candidates: candidates, Unsatisfiable: h.unsatisfiable}
+	callback(false, nil)
+}
+
+func (h *checkingHandler) RequestVerificationPermission(request *irma.DisclosureRequest, _ bool,
+	candidates [][]DisclosureCandidates, _ *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.record(request, candidates, callback)
+}
+
+func (h *checkingHandler) RequestSignaturePermission(request *irma.SignatureRequest, _ bool,
+	candidates [][]DisclosureCandidates, _ *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.record(request, candidates, callback)
+}
+
+func (h *checkingHandler) RequestIssuancePermission(request *irma.IssuanceRequest, _ bool,
+	candidates [][]DisclosureCandidates, _ *irma.RequestorInfo, callback PermissionHandler,
+) {
+	h.record(request, candidates, callback)
+}
+
+func TestCheckRequest(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	sks := testPrivateKeys(t, client.Configuration)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	firstname := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	value := func(attr irma.AttributeTypeIdentifier, value string) irma.AttributeDisCon {
+		return irma.AttributeDisCon{{{Type: attr, Value: &value}}}
+	}
+
+	// Besides the student card that the client has, one with another value and an expired one
+	issuance := studentCardIssuanceRequest()
+	require.NoError(t, client.IssueLocally(issuance, sks))
+	issuance = studentCardIssuanceRequest()
+	issuance.Credentials[0].Attributes["studentID"] = "expired"
+	validity := irma.Timestamp(time.Now())
+	issuance.Credentials[0].Validity = &validity
+	require.NoError(t, client.IssueLocally(issuance, sks))
+
+	signature := irma.NewSignatureRequest("message", studentID)
+	issuanceDisclosure := studentCardIssuanceRequest()
+	issuanceDisclosure.Disclose = irma.AttributeConDisCon{value(studentID, "456")}
+	requests := map[string]func() irma.SessionRequest{
+		"multiple instances": func() irma.SessionRequest { return irma.NewDisclosureRequest(studentID) },
+		"expired": func() irma.SessionRequest {
+			r := irma.NewDisclosureRequest()
+			r.Disclose = irma.AttributeConDisCon{value(studentID, "expired")}
+			return r
+		},
+		"value": func() irma.SessionRequest {
+			r := irma.NewDisclosureRequest()
+			r.Disclose = irma.AttributeConDisCon{value(studentID, "456")}
+			return r
+		},
+		"wrong value": func() irma.SessionRequest {
+			r := irma.NewDisclosureRequest()
+			r.Disclose = irma.AttributeConDisCon{value(university, "Other")}
+			return r
+		},
+		"missing":    func() irma.SessionRequest { return irma.NewDisclosureRequest(studentID, firstname) },
+		"duplicates": func() irma.SessionRequest { return irma.NewDisclosureRequest(studentID, university, studentID) },
+		"signature":  func() irma.SessionRequest { return signature },
+		"issuance":   func() irma.SessionRequest { return issuanceDisclosure },
+	}
+
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			check, err := client.CheckRequest(request())
+			require.NoError(t, err)
+
+			server := newMockServer(t, request())
+			defer server.Close()
+			h := &checkingHandler{mockSessionHandler: newMockSessionHandler(t), check: make(chan *RequestCheck, 1)}
+			client.NewSession(server.Qr(), h)
+			require.True(t, h.wait().cancelled)
+			shown := <-h.check
+
+			require.Equal(t, shown.Request.Disclosure().Disclose, check.Request.Disclosure().Disclose)
+			expected, err := json.Marshal(shown.Candidates)
+			require.NoError(t, err)
+			actual, err := json.Marshal(check.Candidates)
+			require.NoError(t, err)
+			require.JSONEq(t, string(expected), string(actual))
+			require.Equal(t, shown.Unsatisfiable, check.Unsatisfiable)
+		})
+	}
+
+	// Spot checks of the outcomes
+	check, err := client.CheckRequest(requests["multiple instances"]())
+	require.NoError(t, err)
+	require.True(t, check.Satisfiable())
+	expired := 0
+	for _, candidates := range check.Candidates[0] {
+		if candidates[0].Expired {
+			expired++
+		}
+	}
+	require.Greater(t, len(check.Candidates[0]), 2)
+	require.Equal(t, 1, expired)
+
+	check, err = client.CheckRequest(requests["expired"]())
+	require.NoError(t, err)
+	require.False(t, check.Satisfiable())
+	require.Equal(t, UnsatisfiedExpired, check.Unsatisfiable.Unsatisfied[0].Reason)
+
+	check, err = client.CheckRequest(requests["value"]())
+	require.NoError(t, err)
+	require.True(t, check.Satisfiable())
+
+	check, err = client.CheckRequest(requests["wrong value"]())
+	require.NoError(t, err)
+	require.Equal(t, UnsatisfiedWrongValue, check.Unsatisfiable.Unsatisfied[0].Reason)
+
+	check, err = client.CheckRequest(requests["duplicates"]())
+	require.NoError(t, err)
+	require.Len(t, check.Request.Disclosure().Disclose, 2)
+
+	_, err = client.CheckRequest(nil)
+	require.Error(t, err)
+}
+
+func TestUnsatisfiableEmptyWallet(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"))
+
+	_, unsatisfiable, err := client.candidates(request)
+	require.NoError(t, err)
+	require.False(t, unsatisfiable.EmptyWallet)
+
+	// The credential issued by the keyshare server upon registration does not count
+	delete(client.attributes, irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.NotEmpty(t, client.attributes[irma.NewCredentialTypeIdentifier("test.test.mijnirma")])
+	_, unsatisfiable, err = client.candidates(request)
+	require.NoError(t, err)
+	require.True(t, unsatisfiable.EmptyWallet)
+}
+
+func TestUnsatisfiableKeyshareRegistration(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	email := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+	request := irma.NewDisclosureRequest(email)
+	_, unsatisfiable, err := client.candidates(request)
+	require.NoError(t, err)
+	require.Nil(t, unsatisfiable)
+
+	// Pretend that the registration credential is of a type that the user does not have
+	scheme := client.Configuration.SchemeManagers[testSchemeID]
+	keyshareAttribute := scheme.KeyshareAttribute
+	scheme.KeyshareAttribute = "test.test.revocable.email"
+	defer func() { scheme.KeyshareAttribute = keyshareAttribute }()
+	require.Empty(t, client.attrs(irma.NewCredentialTypeIdentifier("test.test.revocable")))
+
+	_, unsatisfiable, err = client.candidates(request)
+	require.NoError(t, err)
+	require.NotNil(t, unsatisfiable)
+	require.Len(t, unsatisfiable.Unsatisfied, 1)
+	unsatisfied := unsatisfiable.Unsatisfied[0]
+	require.Equal(t, UnsatisfiedKeyshareRegistrationMissing, unsatisfied.Reason)
+	require.Equal(t, irma.NewCredentialTypeIdentifier("test.test.revocable"), unsatisfied.CredentialType)
+	require.Equal(t, testSchemeID, *unsatisfied.KeyshareScheme)
+
+	// An optional disjunction can be satisfied without the keyshare server
+	request.Disclose[0] = append(request.Disclose[0], irma.AttributeCon{})
+	_, unsatisfiable, err = client.candidates(request)
+	require.NoError(t, err)
+	require.Nil(t, unsatisfiable)
+}
@@ -0,0 +1,90 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuanceValidity(t *testing.T) {
+	client := parseMemoryClient(t)
+	defer func() { require.NoError(t, client.Close()) }()
+
+	request := studentCardIssuanceRequest()
+	validity := irma.Timestamp(time.Now().AddDate(1, 0, 0))
+	request.Credentials[0].Validity = &validity
+	server := newMockServer(t, request)
+	defer server.Close()
+
+	h := newMockSessionHandler(t)
+	result := runMockSession(t, client, server, h)
+	require.Nil(t, result.err)
+
+	// The validity is shown when asking permission
+	permission := <-h.permissionRequested
+	shown := permission.(*irma.IssuanceRequest).CredentialChanges[0].Validity
+	require.NotNil(t, shown)
+	require.Equal(t, time.Time(validity).Unix(), time.Time(*shown.Requested).Unix())
+	require.False(t, time.Time(shown.Expires).After(time.Time(validity)))
+	require.True(t, time.Time(shown.Expires).After(time.Time(validity).Add(-irma.ExpiryFactor*time.Second)))
+
+	// and passed to the handler on success
+	var changes []*irma.CredentialChange
+	require.NoError(t, json.Unmarshal([]byte(result.success), &changes))
+	require.Equal(t, time.Time(shown.Expires).Unix(), time.Time(changes[0].Validity.Expires).Unix())
+
+	// It matches the metadata attribute of the credential that was issued
+	for _, attrs := range client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")) {
+		if *attrs.UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentCardNumber")) == "31415927" {
+			require.Equal(t, time.Time(shown.SignedOn).Unix(), attrs.MetadataAttribute.SigningDate().Unix())
+			require.Equal(t, time.Time(shown.Expires).Unix(), attrs.MetadataAttribute.Expiry().Unix())
+		}
+	}
+}
+
+func TestValidityPolicy(t *testing.T) {
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	tests := []struct {
+		name     string
+		validity *irma.Timestamp
+		refused  bool
+	}{
+		{name: "default", validity: nil},
+		{name: "too short", validity: timestampIn(0, 0, 20), refused: true},
+		{name: "long enough", validity: timestampIn(0, 2, 0)},
+		// Public key 2 of irma-demo.RU expires in 2030
+		{name: "beyond key expiry", validity: timestampIn(20, 0, 0), refused: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := parseMemoryClient(t)
+			defer func() { require.NoError(t, client.Close()) }()
+			client.SetValidityPolicy(ValidityLimits(30 * 24 * time.Hour))
+
+			request := studentCardIssuanceRequest()
+			request.Credentials[0].Validity = tt.validity
+			server := newMockServer(t, request)
+			defer server.Close()
+
+			result := runMockSession(t, client, server, newMockSessionHandler(t))
+			if !tt.refused {
+				require.Nil(t, result.err)
+				require.Len(t, client.attrs(studentCard), 1)
+				return
+			}
+			require.NotNil(t, result.err)
+			require.Equal(t, irma.ErrorValidityRefused, result.err.ErrorType)
+			require.Equal(t, studentCard.String(), result.err.Info)
+			require.NotContains(t, server.Calls(), mockEndpointCommitments)
+			require.Empty(t, client.attrs(studentCard))
+		})
+	}
+}
+
+func timestampIn(years, months, days int) *irma.Timestamp {
+	t := irma.Timestamp(time.Now().AddDate(years, months, days))
+	return &t
+}
@@ -1,11 +1,14 @@
 package irmaclient
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"net/http"
+	"sort"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwesterb/go-atum"
@@ -22,7 +25,7 @@ import (
 
 // KeysharePinRequestor is used to asking the user for his PIN.
 type KeysharePinRequestor interface {
-	RequestPin(remainingAttempts int, callback PinHandler)
+	RequestPin(metadata PinMetadata, proceed func(pin string), cancel func())
 }
 
 type keyshareSessionHandler interface {
@@ -35,9 +38,82 @@ type keyshareSessionHandler interface {
 	KeyshareError(manager *irma.SchemeManagerIdentifier, err error)
 	KeysharePin()
 	KeysharePinOK()
+	KeysharePinBackoff(manager irma.SchemeManagerIdentifier, duration int)
+}
+
+// cancellableKeyshareHandler passes on the calls of a keyshare session to its handler until
+// the context of the keyshare session is cancelled, after which they are dropped.
+type cancellableKeyshareHandler struct {
+	ctx     context.Context
+	handler keyshareSessionHandler
+}
+
+func (h cancellableKeyshareHandler) active() bool {
+	return h.ctx.Err() == nil
+}
+
+func (h cancellableKeyshareHandler) KeyshareDone(message interface{}) {
+	if h.active() {
+		h.handler.KeyshareDone(message)
+	}
+}
+
+func (h cancellableKeyshareHandler) KeyshareCancelled() {
+	if h.active() {
+		h.handler.KeyshareCancelled()
+	}
+}
+
+func (h cancellableKeyshareHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	if h.active() {
+		h.handler.KeyshareBlocked(manager, duration)
+	}
+}
+
+func (h cancellableKeyshareHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	if h.active() {
+		h.handler.KeyshareEnrollmentIncomplete(manager)
+	}
+}
+
+func (h cancellableKeyshareHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	if h.active() {
+		h.handler.KeyshareEnrollmentDeleted(manager)
+	}
+}
+
+func (h cancellableKeyshareHandler) KeyshareError(manager *irma.SchemeManagerIdentifier, err error) {
+	if h.active() {
+		h.handler.KeyshareError(manager, err)
+	}
+}
+
+func (h cancellableKeyshareHandler) KeysharePin() {
+	if h.active() {
+		h.handler.KeysharePin()
+	}
+}
+
+func (h cancellableKeyshareHandler) KeysharePinOK() {
+	if h.active() {
+		h.handler.KeysharePinOK()
+	}
+}
+
+func (h cancellableKeyshareHandler) KeysharePinBackoff(manager irma.SchemeManagerIdentifier, duration int) {
+	if h.active() {
+		h.handler.KeysharePinBackoff(manager, duration)
+	}
+}
+
+func (h cancellableKeyshareHandler) captureTransport(transport *irma.HTTPTransport) {
+	if capturer, ok := h.handler.(transportCapturer); ok {
+		capturer.captureTransport(transport)
+	}
 }
 
 type keyshareSession struct {
+	ctx              context.Context
 	sessionHandler   keyshareSessionHandler
 	pinRequestor     KeysharePinRequestor
 	builders         gabi.ProofBuilderList
@@ -49,17 +125,41 @@ type keyshareSession struct {
 	issuerProofNonce *big.Int
 	timestamp        *atum.Timestamp
 	pinCheck         bool
+
+	// Progress of the protocol, so that requests can be retried after reauthentication
+	reauthenticated bool
+	commitments     map[irma.PublicKeyIdentifier]*gabi.ProofPCommitment
+	committed       map[irma.SchemeManagerIdentifier]bool
+	challenge       *big.Int
+	responses       map[irma.SchemeManagerIdentifier]string
 }
 
 type keyshareServer struct {
-	Username                string `json:"username"`
-	Nonce                   []byte `json:"nonce"`
-	PinOutOfSync            bool   `json:"pin_out_of_sync,omitempty"`
-	SchemeManagerIdentifier irma.SchemeManagerIdentifier
-	ChallengeResponse       bool
-	token                   string
+	Username                 string `json:"username"`
+	Nonce                    []byte `json:"nonce"`
+	PinOutOfSync             bool   `json:"pin_out_of_sync,omitempty"`
+	SchemeManagerIdentifier  irma.SchemeManagerIdentifier
+	ChallengeResponse        bool
+	PinFailures              int                     `json:"pin_failures,omitempty"`
+	LastPinFailure           int64                   `json:"last_pin_failure,omitempty"`
+	PinAttemptsRemaining     *int                    `json:"pin_attempts_remaining,omitempty"`
+	PinBlockedUntil          int64                   `json:"pin_blocked_until,omitempty"`
+	LastPinVerification      int64                   `json:"last_pin_verification,omitempty"`
+	PinPolicy                *irma.KeysharePinPolicy `json:"pin_policy,omitempty"`
+	PendingEmailVerification bool                    `json:"pending_email_verification,omitempty"`
+	token                    []byte                  // see Client.keyshareToken
+	pinVerified              time.Time               // when the user last entered the correct PIN, see SetPinGracePeriod
+	pin                      []byte                  // the PIN during the PIN grace period, see Client.cachePin
+	pinTimer                 *time.Timer             // wipes the PIN at the end of the PIN grace period
+	protocolVersion          int                     // negotiated keyshare protocol version, see Client.keyshareProtocol
 }
 
+// pinBackoffSchedule contains the time that has to pass after the last incorrect PIN,
+// indexed by the number of consecutive incorrect PINs, before the user may enter their PIN again.
+// This is enforced by the client on top of the blocking done by the keyshare server, to protect
+// users on lost devices.
+var pinBackoffSchedule = []time.Duration{0, 0, 30 * time.Second, 5 * time.Minute, 30 * time.Minute}
+
 const (
 	kssUsernameHeader = "X-IRMA-Keyshare-Username"
 	kssAuthHeader     = "Authorization"
@@ -81,6 +181,55 @@ func newKeyshareServer(schemeManagerIdentifier irma.SchemeManagerIdentifier) (*k
 	return ks, nil
 }
 
+// pinBackoff returns how long the user has to wait before they may enter their PIN again.
+func (kss *keyshareServer) pinBackoff() time.Duration {
+	if kss.PinFailures == 0 {
+		return 0
+	}
+	i := kss.PinFailures
+	if i >= len(pinBackoffSchedule) {
+		i = len(pinBackoffSchedule) - 1
+	}
+	remaining := time.Until(time.Unix(kss.LastPinFailure, 0).Add(pinBackoffSchedule[i]))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// PinStatus contains what the client knows about the PIN of the user at a keyshare server,
+// as last reported by the keyshare server. See Client.KeysharePinStatus.
+type PinStatus struct {
+	// RemainingAttempts is the amount of incorrect PINs that the user may still enter before
+	// the keyshare server blocks them, or -1 if unknown. It is only known after an incorrect PIN.
+	RemainingAttempts int `json:"remainingAttempts"`
+	// BlockedUntil is when the user may enter their PIN again, either because the keyshare
+	// server blocked them or because of the backoff imposed by the client; zero if not blocked.
+	BlockedUntil time.Time `json:"blockedUntil"`
+	// LastVerified is when the user last entered their correct PIN; zero if unknown.
+	LastVerified time.Time `json:"lastVerified"`
+}
+
+// pinStatus returns the PinStatus of the keyshare server.
+func (kss *keyshareServer) pinStatus() *PinStatus {
+	status := &PinStatus{RemainingAttempts: -1}
+	if kss.PinAttemptsRemaining != nil {
+		status.RemainingAttempts = *kss.PinAttemptsRemaining
+	}
+	if blocked := time.Unix(kss.PinBlockedUntil, 0); kss.PinBlockedUntil != 0 && time.Now().Before(blocked) {
+		status.BlockedUntil = blocked
+	}
+	if backoff := kss.pinBackoff(); backoff > 0 {
+		if until := time.Now().Add(backoff).Truncate(time.Second); until.After(status.BlockedUntil) {
+			status.BlockedUntil = until
+		}
+	}
+	if kss.LastPinVerification != 0 {
+		status.LastVerified = time.Unix(kss.LastPinVerification, 0)
+	}
+	return status
+}
+
 func (ks *keyshareServer) HashedPin(pin string) string {
 	hash := sha256.Sum256(append(ks.Nonce, []byte(pin)...))
 	// We must be compatible with the old Android app here,
@@ -89,12 +238,31 @@ func (ks *keyshareServer) HashedPin(pin string) string {
 	return base64.StdEncoding.EncodeToString(hash[:]) + "\n"
 }
 
+// keyshareToken returns the authorization token that the keyshare server issued to us when the
+// PIN was last verified, or the empty string if there is none, e.g. because the client was locked.
+func (client *Client) keyshareToken(kss *keyshareServer) string {
+	client.secretKeyMutex.Lock()
+	defer client.secretKeyMutex.Unlock()
+	return string(kss.token)
+}
+
+// setKeyshareToken replaces the authorization token of the keyshare server, overwriting the
+// previous one so that Lock is not the only place where tokens are wiped.
+func (client *Client) setKeyshareToken(kss *keyshareServer, token string) {
+	client.secretKeyMutex.Lock()
+	defer client.secretKeyMutex.Unlock()
+	wipeBytes(kss.token)
+	kss.token = []byte(token)
+}
+
 // startKeyshareSession starts and completes the entire keyshare protocol with all involved keyshare servers
 // for the specified session, merging the keyshare proofs into the specified ProofBuilder's.
 // The user's pin is retrieved using the KeysharePinRequestor, repeatedly, until either it is correct; or the
 // user cancels; or one of the keyshare servers blocks us.
-// Error, blocked or success of the keyshare session is reported back to the keyshareSessionHandler.
+// Error, blocked or success of the keyshare session is reported back to the keyshareSessionHandler,
+// unless the keyshare session is aborted by cancelling the specified context.
 func startKeyshareSession(
+	ctx context.Context,
 	sessionHandler keyshareSessionHandler,
 	client *Client,
 	pin KeysharePinRequestor,
@@ -104,6 +272,7 @@ func startKeyshareSession(
 	issuerProofNonce *big.Int,
 	timestamp *atum.Timestamp,
 ) {
+	sessionHandler = cancellableKeyshareHandler{ctx: ctx, handler: sessionHandler}
 	ksscount := 0
 
 	// A number of times below we need to look at all involved schemes, and then we need to take into
@@ -116,7 +285,7 @@ func startKeyshareSession(
 		}
 	}
 
-	for managerID := range schemeIDs {
+	for _, managerID := range sortedSchemeIDs(schemeIDs) {
 		if client.Configuration.SchemeManagers[managerID].Distributed() {
 			ksscount++
 			if _, enrolled := client.keyshareServers[managerID]; !enrolled {
@@ -133,6 +302,7 @@ func startKeyshareSession(
 	}
 
 	ks := &keyshareSession{
+		ctx:              ctx,
 		schemeIDs:        schemeIDs,
 		session:          session,
 		client:           client,
@@ -145,35 +315,45 @@ func startKeyshareSession(
 		pinCheck:         false,
 	}
 
-	for managerID := range schemeIDs {
+	for _, managerID := range ks.schemes() {
 		scheme := ks.client.Configuration.SchemeManagers[managerID]
 		if !scheme.Distributed() {
 			continue
 		}
 
 		ks.keyshareServer = ks.client.keyshareServers[managerID]
-		transport := irma.NewHTTPTransport(scheme.KeyshareServer, !ks.client.Preferences.DeveloperMode)
+		transport := ks.client.newTransport(scheme.KeyshareServer)
+		transport.SetContext(ctx)
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
-		transport.SetHeader(kssAuthHeader, ks.keyshareServer.token)
+		token := ks.client.keyshareToken(ks.keyshareServer)
+		transport.SetHeader(kssAuthHeader, token)
+		if capturer, ok := sessionHandler.(transportCapturer); ok {
+			capturer.captureTransport(transport)
+		}
 		ks.transports[managerID] = transport
 
+		if err := ks.client.checkEmailVerification(ks.keyshareServer, transport); err != nil {
+			ks.keyshareError(managerID, err)
+			return
+		}
+
 		// Try to parse token as a jwt to see if it is still valid; if so we don't need to ask for the PIN
 		parser := new(jwt.Parser)
 		parser.SkipClaimsValidation = true // We want to verify expiry on our own below so we can add leeway
 		claims := jwt.StandardClaims{}
-		_, err := parser.ParseWithClaims(ks.keyshareServer.token, &claims, ks.client.Configuration.KeyshareServerKeyFunc(managerID))
+		_, err := parser.ParseWithClaims(token, &claims, ks.client.Configuration.KeyshareServerKeyFunc(managerID))
 		if err != nil {
-			irma.Logger.Info("Keyshare server token invalid, asking for PIN")
-			irma.Logger.Debug("Token: ", ks.keyshareServer.token)
-			ks.pinCheck = true
+			irma.Logger.Info("Keyshare server token invalid")
+			irma.Logger.Debug("Token: ", token)
+			ks.renewToken(managerID)
 			continue
 		}
 		// Add a minute of leeway for possible clockdrift with the server,
 		// and for the rest of the protocol to take place with this token
-		if !claims.VerifyExpiresAt(time.Now().Add(1*time.Minute).Unix(), true) {
-			irma.Logger.Info("Keyshare server token expires too soon, asking for PIN")
-			irma.Logger.Debug("Token: ", ks.keyshareServer.token)
-			ks.pinCheck = true
+		if !claims.VerifyExpiresAt(ks.client.now().Add(time.Minute).Unix(), true) {
+			irma.Logger.Info("Keyshare server token expires too soon")
+			irma.Logger.Debug("Token: ", token)
+			ks.renewToken(managerID)
 		}
 	}
 
@@ -185,6 +365,23 @@ func startKeyshareSession(
 	}
 }
 
+// renewToken obtains a new authorization token from the keyshare server of the specified scheme
+// using the PIN, if the user entered it within the PIN grace period. Otherwise, or if that fails,
+// we will ask the user for their PIN.
+func (ks *keyshareSession) renewToken(managerID irma.SchemeManagerIdentifier) {
+	kss := ks.client.keyshareServers[managerID]
+	if pin, cached := ks.client.cachedPin(kss); cached && !kss.PinOutOfSync {
+		success, _, _, err := ks.client.verifyPinWorker(pin, kss, ks.transports[managerID])
+		if err == nil && success {
+			irma.Logger.Info("Renewed keyshare server token using the PIN of the PIN grace period")
+			return
+		}
+		ks.client.cachePin(kss, "")
+	}
+	irma.Logger.Info("Asking for PIN")
+	ks.pinCheck = true
+}
+
 func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error) {
 	serr, ok := err.(*irma.SessionError)
 	if ok {
@@ -212,14 +409,26 @@ func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error)
 // Ask for a pin, repeatedly if necessary, and either continue the keyshare protocol
 // with authorization, or stop the keyshare protocol and inform of failure.
 func (ks *keyshareSession) VerifyPin(attempts int) {
-	ks.pinRequestor.RequestPin(attempts, PinHandler(func(proceed bool, pin string) {
-		if !proceed {
-			ks.sessionHandler.KeyshareCancelled()
-			return
+	ks.verifyPin(attempts, ks.GetCommitments)
+}
+
+// verifyPin asks for the PIN as VerifyPin does, continuing the keyshare protocol with next.
+func (ks *keyshareSession) verifyPin(attempts int, next func()) {
+	if ks.ctx.Err() != nil {
+		return
+	}
+	if manager, backoff := ks.pinBackoff(); backoff > 0 {
+		ks.sessionHandler.KeysharePinBackoff(manager, backoffSeconds(backoff))
+		time.AfterFunc(backoff, func() { ks.verifyPin(attempts, next) })
+		return
+	}
+	proceed, cancel := pinCallbacks(func(pin string) {
+		if ks.ctx.Err() != nil {
+			return // the PIN was entered after the session was aborted
 		}
 		success, attemptsRemaining, blocked, manager, err := ks.verifyPinAttempt(pin)
 		if err != nil {
-			ks.sessionHandler.KeyshareError(&manager, err)
+			ks.keyshareError(manager, err)
 			return
 		}
 		if blocked != 0 {
@@ -228,12 +437,90 @@ func (ks *keyshareSession) VerifyPin(attempts int) {
 		}
 		if success {
 			ks.sessionHandler.KeysharePinOK()
-			ks.GetCommitments()
+			next()
 			return
 		}
 		// Not successful but no error and not yet blocked: try again
-		ks.VerifyPin(attemptsRemaining)
-	}))
+		ks.verifyPin(attemptsRemaining, next)
+	}, ks.sessionHandler.KeyshareCancelled)
+	ks.pinRequestor.RequestPin(ks.pinMetadata(attempts), proceed, cancel)
+}
+
+// pinCallbacks wraps the proceed and cancel callbacks passed to RequestPin, such that only the
+// first invocation of either has effect. Later invocations, e.g. by a UI calling cancel when the
+// PIN has already been entered, are ignored.
+func pinCallbacks(proceed func(pin string), cancel func()) (func(pin string), func()) {
+	var called int32
+	first := func() bool {
+		if !atomic.CompareAndSwapInt32(&called, 0, 1) {
+			irma.Logger.Warn("PIN request already answered, ignoring")
+			return false
+		}
+		return true
+	}
+	proceedOnce := func(pin string) {
+		if first() {
+			proceed(pin)
+		}
+	}
+	cancelOnce := func() {
+		if first() {
+			cancel()
+		}
+	}
+	return proceedOnce, cancelOnce
+}
+
+// schemes returns the schemes involved in this session, in lexical order, so that the keyshare
+// servers are contacted in the same order in each session.
+func (ks *keyshareSession) schemes() []irma.SchemeManagerIdentifier {
+	return sortedSchemeIDs(ks.schemeIDs)
+}
+
+func sortedSchemeIDs(set map[irma.SchemeManagerIdentifier]struct{}) []irma.SchemeManagerIdentifier {
+	ids := make([]irma.SchemeManagerIdentifier, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	return ids
+}
+
+// pinMetadata returns the metadata of the PIN of the keyshare servers involved in this session.
+func (ks *keyshareSession) pinMetadata(attempts int) PinMetadata {
+	metadata := PinMetadata{RemainingAttempts: attempts, Retry: attempts != -1}
+	for _, id := range ks.schemes() {
+		if !ks.client.Configuration.SchemeManagers[id].Distributed() {
+			continue
+		}
+		policy := ks.client.pinPolicy(id)
+		if policy.MinLength > metadata.MinLength {
+			metadata.MinLength = policy.MinLength
+		}
+		if policy.MaxLength != 0 && (metadata.MaxLength == 0 || policy.MaxLength < metadata.MaxLength) {
+			metadata.MaxLength = policy.MaxLength
+		}
+	}
+	return metadata
+}
+
+// pinBackoff returns the longest time the user has to wait before they may enter their PIN
+// for any of the keyshare servers involved in this session.
+func (ks *keyshareSession) pinBackoff() (manager irma.SchemeManagerIdentifier, backoff time.Duration) {
+	for _, id := range ks.schemes() {
+		if !ks.client.Configuration.SchemeManagers[id].Distributed() {
+			continue
+		}
+		if b := ks.client.keyshareServers[id].pinBackoff(); b > backoff {
+			manager, backoff = id, b
+		}
+	}
+	return
+}
+
+// backoffSeconds rounds the duration up to whole seconds.
+func backoffSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
 }
 
 // challengeRequestJWTExpiry is the expiry of the JWT sent to the keyshareserver at
@@ -290,12 +577,19 @@ func (kss *keyshareServer) doChallengeResponse(signer Signer, transport *irma.HT
 func (client *Client) verifyPinWorker(pin string, kss *keyshareServer, transport *irma.HTTPTransport) (
 	success bool, tries int, blocked int, err error,
 ) {
-	var pinresult *irma.KeysharePinStatus
-	if !kss.ChallengeResponse {
-		pinresult, err = kss.registerPublicKey(client, transport, pin)
-	} else {
-		pinresult, err = kss.doChallengeResponse(client.signer, transport, pin)
+	if backoff := kss.pinBackoff(); backoff > 0 {
+		return false, 0, 0, &irma.SessionError{
+			Err:       errors.Errorf("PIN entry not allowed for another %s", backoff),
+			ErrorType: irma.ErrorKeysharePinBackoff,
+			Info:      strconv.Itoa(backoffSeconds(backoff)),
+		}
+	}
+
+	protocol, err := client.keyshareProtocol(kss, transport)
+	if err != nil {
+		return false, 0, 0, err
 	}
+	pinresult, err := protocol.verifyPin(client, kss, transport, pin)
 	if err != nil {
 		return false, 0, 0, err
 	}
@@ -303,14 +597,17 @@ func (client *Client) verifyPinWorker(pin string, kss *keyshareServer, transport
 	switch pinresult.Status {
 	case kssPinSuccess:
 		success = true
-		kss.token = pinresult.Message
-		transport.SetHeader(kssAuthHeader, kss.token)
+		client.setKeyshareToken(kss, pinresult.Message)
+		transport.SetHeader(kssAuthHeader, pinresult.Message)
+		client.updatePinStatus(kss, pinresult.Status, 0, 0)
 		return
 	case kssPinFailure:
 		tries, err = strconv.Atoi(pinresult.Message)
+		client.updatePinStatus(kss, pinresult.Status, tries, 0)
 		return
 	case kssPinError:
 		blocked, err = strconv.Atoi(pinresult.Message)
+		client.updatePinStatus(kss, pinresult.Status, 0, blocked)
 		return
 	default:
 		err = &irma.SessionError{
@@ -322,6 +619,55 @@ func (client *Client) verifyPinWorker(pin string, kss *keyshareServer, transport
 	}
 }
 
+// pinPolicy returns the PIN policy of the keyshare server of the specified scheme, as published
+// by the keyshare server when we enrolled, or as far as specified by the scheme otherwise.
+func (client *Client) pinPolicy(managerID irma.SchemeManagerIdentifier) *irma.KeysharePinPolicy {
+	if kss, enrolled := client.keyshareServers[managerID]; enrolled && kss.PinPolicy != nil {
+		return kss.PinPolicy
+	}
+	return client.Configuration.SchemeManagers[managerID].KeysharePinPolicy()
+}
+
+// fetchPinPolicy retrieves the PIN policy published by the keyshare server of the scheme. Not all
+// keyshare servers publish one, so if that fails we fall back to the PIN policy of the scheme.
+func (client *Client) fetchPinPolicy(manager *irma.SchemeManager) *irma.KeysharePinPolicy {
+	policy := &irma.KeysharePinPolicy{}
+	if err := client.newTransport(manager.KeyshareServer).Get("client/pin_policy", policy); err != nil {
+		irma.Logger.Warnf("failed to fetch PIN policy of keyshare server of %s, using that of the scheme: %v", manager.ID, err)
+		return manager.KeysharePinPolicy()
+	}
+	return policy
+}
+
+// updatePinStatus registers the outcome of a PIN verification at the keyshare server: it resets
+// or increments the counter of incorrect PINs, and records the remaining attempts or blocking
+// reported by the keyshare server. The result is persisted, so that the backoff and the
+// PinStatus survive restarts.
+func (client *Client) updatePinStatus(kss *keyshareServer, status string, tries, blocked int) {
+	switch status {
+	case kssPinSuccess:
+		kss.PinFailures, kss.LastPinFailure = 0, 0
+		kss.PinAttemptsRemaining, kss.PinBlockedUntil = nil, 0
+		kss.LastPinVerification = time.Now().Unix()
+	case kssPinFailure:
+		kss.PinFailures++
+		kss.LastPinFailure = time.Now().Unix()
+		kss.PinAttemptsRemaining, kss.PinBlockedUntil = &tries, 0
+	case kssPinError:
+		// The keyshare server blocks us, which takes precedence over our own backoff
+		zero := 0
+		kss.PinFailures, kss.LastPinFailure = 0, 0
+		kss.PinAttemptsRemaining = &zero
+		kss.PinBlockedUntil = time.Now().Add(time.Duration(blocked) * time.Second).Unix()
+	}
+	if _, enrolled := client.keyshareServers[kss.SchemeManagerIdentifier]; !enrolled {
+		return // still enrolling; the keyshare server is stored after enrollment succeeds
+	}
+	if err := client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+		client.reportError(err)
+	}
+}
+
 // Verify the specified pin at each of the keyshare servers involved in the specified session.
 // - If the pin did not verify at one of the keyshare servers but there are attempts remaining,
 // the amount of remaining attempts is returned as the second return value.
@@ -332,7 +678,7 @@ func (client *Client) verifyPinWorker(pin string, kss *keyshareServer, transport
 // If all is ok, success will be true.
 func (ks *keyshareSession) verifyPinAttempt(pin string) (
 	success bool, tries int, blocked int, manager irma.SchemeManagerIdentifier, err error) {
-	for manager = range ks.schemeIDs {
+	for _, manager = range ks.schemes() {
 		if !ks.client.Configuration.SchemeManagers[manager].Distributed() {
 			continue
 		}
@@ -347,35 +693,93 @@ func (ks *keyshareSession) verifyPinAttempt(pin string) (
 		if !success {
 			return
 		}
+		ks.client.cachePin(kss, pin)
 	}
 	return
 }
 
+// tokenRejected returns whether the keyshare server refused our authorization token. Older
+// keyshare servers respond with status 401 or 403; the current one with the error message of its JWT check.
+func tokenRejected(err error) bool {
+	remote := err.(*irma.SessionError).RemoteError
+	if remote == nil {
+		return false
+	}
+	return remote.Status == http.StatusUnauthorized || remote.Status == http.StatusForbidden ||
+		remote.Message == "invalid jwt token" || remote.Message == "jwt expired"
+}
+
+// requestFailed handles a failed request to the keyshare server of the specified scheme. If the
+// keyshare server rejected our authorization token, e.g. because it expired while the user was
+// looking at the permission dialog, we obtain a new token after which the request is retried
+// using retry, once per keyshare session. To obtain the token we use the PIN if we still have
+// it within the PIN grace period, and ask the user for it otherwise.
+func (ks *keyshareSession) requestFailed(managerID irma.SchemeManagerIdentifier, err error, retry func()) {
+	if !tokenRejected(err) || ks.reauthenticated {
+		ks.keyshareError(managerID, err)
+		return
+	}
+	ks.reauthenticated = true
+	irma.Logger.Info("Keyshare server rejected token, reauthenticating")
+
+	kss := ks.client.keyshareServers[managerID]
+	pin, cached := ks.client.cachedPin(kss)
+	ks.client.cachePin(kss, "") // we can't rely on our token anymore, so its grace period ends
+	attempts := -1
+	if cached {
+		success, tries, blocked, err := ks.client.verifyPinWorker(pin, kss, ks.transports[managerID])
+		switch {
+		case err != nil:
+			ks.keyshareError(managerID, err)
+			return
+		case blocked != 0:
+			ks.sessionHandler.KeyshareBlocked(managerID, blocked)
+			return
+		case success:
+			retry()
+			return
+		}
+		attempts = tries
+	}
+	ks.pinCheck = true
+	ks.sessionHandler.KeysharePin()
+	ks.verifyPin(attempts, retry)
+}
+
 // GetCommitments gets the commitments (first message in Schnorr zero-knowledge protocol)
 // of all keyshare servers of their part of the private key, and merges these commitments
-// in our own proof builders.
+// in our own proof builders. Each keyshare server is sent a single request, however many of
+// the credentials involved it shares the private key of.
 func (ks *keyshareSession) GetCommitments() {
 	pkids := map[irma.SchemeManagerIdentifier][]*irma.PublicKeyIdentifier{}
-	commitments := map[irma.PublicKeyIdentifier]*gabi.ProofPCommitment{}
+	included := map[irma.PublicKeyIdentifier]bool{}
+	if ks.commitments == nil {
+		ks.commitments = map[irma.PublicKeyIdentifier]*gabi.ProofPCommitment{}
+		ks.committed = map[irma.SchemeManagerIdentifier]bool{}
+	}
 
 	// For each scheme manager, build a list of public keys under this manager
-	// that we will use in the keyshare protocol with the keyshare server of this manager
+	// that we will use in the keyshare protocol with the keyshare server of this manager.
+	// Credentials sharing a public key share its commitment, so each public key is included once.
 	for _, builder := range ks.builders {
 		pk := builder.PublicKey()
 		managerID := irma.NewIssuerIdentifier(pk.Issuer).SchemeManagerIdentifier()
 		if !ks.client.Configuration.SchemeManagers[managerID].Distributed() {
 			continue
 		}
-		if _, contains := pkids[managerID]; !contains {
-			pkids[managerID] = []*irma.PublicKeyIdentifier{}
+		pki := irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier(pk.Issuer), Counter: pk.Counter}
+		if included[pki] {
+			continue
 		}
-		pkids[managerID] = append(pkids[managerID], &irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier(pk.Issuer), Counter: pk.Counter})
+		included[pki] = true
+		pkids[managerID] = append(pkids[managerID], &pki)
 	}
 
 	// Now inform each keyshare server of with respect to which public keys
-	// we want them to send us commitments
-	for managerID := range ks.schemeIDs {
-		if !ks.client.Configuration.SchemeManagers[managerID].Distributed() {
+	// we want them to send us commitments, skipping those that already did
+	// in case we are retrying after reauthentication
+	for _, managerID := range ks.schemes() {
+		if !ks.client.Configuration.SchemeManagers[managerID].Distributed() || ks.committed[managerID] {
 			continue
 		}
 
@@ -383,28 +787,21 @@ func (ks *keyshareSession) GetCommitments() {
 		comms := &irma.ProofPCommitmentMap{}
 		err := transport.Post("prove/getCommitments", comms, pkids[managerID])
 		if err != nil {
-			if err.(*irma.SessionError).RemoteError != nil &&
-				err.(*irma.SessionError).RemoteError.Status == http.StatusForbidden && !ks.pinCheck {
-				// JWT may be out of date due to clock drift; request pin and try again
-				// (but only if we did not ask for a PIN earlier)
-				ks.pinCheck = false
-				ks.sessionHandler.KeysharePin()
-				ks.VerifyPin(-1)
-				return
-			}
-			ks.sessionHandler.KeyshareError(&managerID, err)
+			ks.requestFailed(managerID, err, ks.GetCommitments)
 			return
 		}
 		for pki, c := range comms.Commitments {
-			commitments[pki] = c
+			ks.commitments[pki] = c
 		}
+		ks.committed[managerID] = true
+		ks.client.setEmailVerificationPending(ks.client.keyshareServers[managerID], false)
 	}
 
 	// Merge in the commitments
 	for _, builder := range ks.builders {
 		pk := builder.PublicKey()
 		pki := irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier(pk.Issuer), Counter: pk.Counter}
-		comm, distributed := commitments[pki]
+		comm, distributed := ks.commitments[pki]
 		if !distributed {
 			continue
 		}
@@ -418,30 +815,33 @@ func (ks *keyshareSession) GetCommitments() {
 // to calculate the challenge, which is sent to the keyshare servers in order to
 // receive their responses (2nd and 3rd message in Schnorr zero-knowledge protocol).
 func (ks *keyshareSession) GetProofPs() {
-	_, issig := ks.session.(*irma.SignatureRequest)
-	challenge, err := ks.builders.Challenge(ks.session.Base().GetContext(), ks.session.GetNonce(ks.timestamp), issig)
-	if err != nil {
-		ks.sessionHandler.KeyshareError(&ks.keyshareServer.SchemeManagerIdentifier, err)
-		return
+	// The challenge is computed only once, as retrying after reauthentication must not change it
+	if ks.challenge == nil {
+		_, issig := ks.session.(*irma.SignatureRequest)
+		challenge, err := ks.builders.Challenge(ks.session.Base().GetContext(), ks.session.GetNonce(ks.timestamp), issig)
+		if err != nil {
+			ks.sessionHandler.KeyshareError(&ks.keyshareServer.SchemeManagerIdentifier, err)
+			return
+		}
+		ks.challenge = challenge
+		ks.responses = map[irma.SchemeManagerIdentifier]string{}
 	}
 
 	// Post the challenge, obtaining JWT's containing the ProofP's
-	responses := map[irma.SchemeManagerIdentifier]string{}
-	for managerID := range ks.schemeIDs {
+	for _, managerID := range ks.schemes() {
 		transport, distributed := ks.transports[managerID]
-		if !distributed {
+		if _, done := ks.responses[managerID]; !distributed || done {
 			continue
 		}
 		var j string
-		err = transport.Post("prove/getResponse", &j, challenge)
-		if err != nil {
-			ks.sessionHandler.KeyshareError(&managerID, err)
+		if err := transport.Post("prove/getResponse", &j, ks.challenge); err != nil {
+			ks.requestFailed(managerID, err, ks.GetProofPs)
 			return
 		}
-		responses[managerID] = j
+		ks.responses[managerID] = j
 	}
 
-	ks.Finish(challenge, responses)
+	ks.Finish(ks.challenge, ks.responses)
 }
 
 // Finish the keyshare protocol: in case of issuance, put the keyshare jwt in the
@@ -0,0 +1,142 @@
+package irmaclient
+
+import (
+	"net/http"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// Range of keyshare protocol versions that we support, see irma.KeyshareStatus.
+const (
+	minKeyshareVersion = 1
+	maxKeyshareVersion = 2
+)
+
+// keyshareProtocol contains the requests of the keyshare protocol whose messages differ between
+// keyshare protocol versions.
+type keyshareProtocol interface {
+	// enrollment returns the enrollment message containing the specified data.
+	enrollment(client *Client, kss *keyshareServer, data irma.KeyshareEnrollmentData) (*irma.KeyshareEnrollment, error)
+	// verifyPin verifies the PIN at the keyshare server.
+	verifyPin(client *Client, kss *keyshareServer, transport *irma.HTTPTransport, pin string) (*irma.KeysharePinStatus, error)
+	// changePin returns the message to change the PIN.
+	changePin(client *Client, kss *keyshareServer, oldPin, newPin string) (*irma.KeyshareChangePin, error)
+}
+
+var keyshareProtocols = map[int]keyshareProtocol{
+	1: keyshareProtocolV1{},
+	2: keyshareProtocolV2{},
+}
+
+// keyshareProtocol returns the keyshare protocol to use with the keyshare server. The first time
+// this is called for a keyshare server, the version is negotiated with the keyshare server.
+func (client *Client) keyshareProtocol(kss *keyshareServer, transport *irma.HTTPTransport) (keyshareProtocol, error) {
+	if kss.protocolVersion == 0 {
+		status := &irma.KeyshareStatus{}
+		err := transport.Get("status", status)
+		if serr, ok := err.(*irma.SessionError); ok && serr.RemoteStatus == http.StatusNotFound {
+			// Keyshare servers that do not advertise their versions support both
+			status = &irma.KeyshareStatus{MinVersion: 1, MaxVersion: 2}
+		} else if err != nil {
+			return nil, err
+		}
+		version, err := chooseKeyshareVersion(status)
+		if err != nil {
+			return nil, err
+		}
+		if version == 1 && kss.ChallengeResponse {
+			// Version 1 would have us send the hashed PIN instead of proving possession of our key,
+			// so once we use challenge-response we refuse to be downgraded
+			return nil, &irma.SessionError{
+				Err:       errors.New("Keyshare server only supports keyshare protocol version 1, while challenge-response is in use"),
+				ErrorType: irma.ErrorKeyshareVersionUnsupported,
+			}
+		}
+		kss.protocolVersion = version
+	}
+	return keyshareProtocols[kss.protocolVersion], nil
+}
+
+// chooseKeyshareVersion returns the highest keyshare protocol version that both we and the
+// keyshare server support.
+func chooseKeyshareVersion(status *irma.KeyshareStatus) (int, error) {
+	if status.MinVersion > maxKeyshareVersion || status.MaxVersion < minKeyshareVersion || status.MaxVersion < status.MinVersion {
+		return 0, &irma.SessionError{
+			Err: errors.Errorf("Keyshare protocol version negotiation failed, min=%d max=%d minServer=%d maxServer=%d",
+				minKeyshareVersion, maxKeyshareVersion, status.MinVersion, status.MaxVersion),
+			ErrorType: irma.ErrorKeyshareVersionUnsupported,
+		}
+	}
+	if status.MaxVersion > maxKeyshareVersion {
+		return maxKeyshareVersion, nil
+	}
+	return status.MaxVersion, nil
+}
+
+// keyshareProtocolV1 sends hashed PINs and unsigned messages.
+type keyshareProtocolV1 struct{}
+
+func (keyshareProtocolV1) enrollment(client *Client, kss *keyshareServer, data irma.KeyshareEnrollmentData) (*irma.KeyshareEnrollment, error) {
+	kss.ChallengeResponse = false
+	data.PublicKey = nil
+	return &irma.KeyshareEnrollment{KeyshareEnrollmentData: data}, nil
+}
+
+func (keyshareProtocolV1) verifyPin(client *Client, kss *keyshareServer, transport *irma.HTTPTransport, pin string) (*irma.KeysharePinStatus, error) {
+	pinresult := &irma.KeysharePinStatus{}
+	err := transport.Post("users/verify/pin", pinresult, irma.KeyshareAuthResponse{
+		KeyshareAuthResponseData: irma.KeyshareAuthResponseData{Username: kss.Username, Pin: kss.HashedPin(pin)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pinresult, nil
+}
+
+func (keyshareProtocolV1) changePin(client *Client, kss *keyshareServer, oldPin, newPin string) (*irma.KeyshareChangePin, error) {
+	return &irma.KeyshareChangePin{KeyshareChangePinData: irma.KeyshareChangePinData{
+		Username: kss.Username,
+		OldPin:   kss.HashedPin(oldPin),
+		NewPin:   kss.HashedPin(newPin),
+	}}, nil
+}
+
+// keyshareProtocolV2 uses ECDSA challenge-response to verify PINs, and signs its messages.
+// Accounts enrolled using version 1 are upgraded by registering our public key.
+type keyshareProtocolV2 struct{}
+
+func (keyshareProtocolV2) enrollment(client *Client, kss *keyshareServer, data irma.KeyshareEnrollmentData) (*irma.KeyshareEnrollment, error) {
+	keyname := challengeResponseKeyName(kss.SchemeManagerIdentifier)
+	pk, err := client.signer.PublicKey(keyname)
+	if err != nil {
+		return nil, err
+	}
+	data.PublicKey = pk
+	jwtt, err := SignerCreateJWT(client.signer, keyname, irma.KeyshareEnrollmentClaims{KeyshareEnrollmentData: data})
+	if err != nil {
+		return nil, err
+	}
+	return &irma.KeyshareEnrollment{EnrollmentJWT: jwtt}, nil
+}
+
+func (keyshareProtocolV2) verifyPin(client *Client, kss *keyshareServer, transport *irma.HTTPTransport, pin string) (*irma.KeysharePinStatus, error) {
+	if !kss.ChallengeResponse {
+		return kss.registerPublicKey(client, transport, pin)
+	}
+	return kss.doChallengeResponse(client.signer, transport, pin)
+}
+
+func (keyshareProtocolV2) changePin(client *Client, kss *keyshareServer, oldPin, newPin string) (*irma.KeyshareChangePin, error) {
+	jwtt, err := SignerCreateJWT(client.signer, challengeResponseKeyName(kss.SchemeManagerIdentifier), irma.KeyshareChangePinClaims{
+		KeyshareChangePinData: irma.KeyshareChangePinData{
+			Username: kss.Username,
+			OldPin:   kss.HashedPin(oldPin),
+			NewPin:   kss.HashedPin(newPin),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &irma.KeyshareChangePin{ChangePinJWT: jwtt}, nil
+}
@@ -83,7 +83,6 @@ func (s *storageOld) txLoad(tx *transaction, bucketName string, key string, dest
 		return false, nil
 	}
 	bts := b.Get([]byte(key))
-	b.Sequence()
 	if bts == nil {
 		return false, nil
 	}
@@ -92,7 +91,7 @@ func (s *storageOld) txLoad(tx *transaction, bucketName string, key string, dest
 
 func (s *storageOld) load(bucketName string, key string, dest interface{}) (found bool, err error) {
 	err = s.db.View(func(tx *bbolt.Tx) error {
-		found, err = s.txLoad(&transaction{tx}, bucketName, key, dest)
+		found, err = s.txLoad(&transaction{boltTx{tx}}, bucketName, key, dest)
 		return err
 	})
 	return
@@ -100,7 +99,7 @@ func (s *storageOld) load(bucketName string, key string, dest interface{}) (foun
 
 func (s *storageOld) Transaction(f func(*transaction) error) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
-		return f(&transaction{tx})
+		return f(&transaction{boltTx{tx}})
 	})
 }
 
@@ -165,7 +164,7 @@ func (s *storageOld) TxAddLogEntry(tx *transaction, entry *LogEntry) error {
 	return s.WriteLogEntry(b, entry)
 }
 
-func (s *storageOld) WriteLogEntry(b *bbolt.Bucket, entry *LogEntry) error {
+func (s *storageOld) WriteLogEntry(b dbBucket, entry *LogEntry) error {
 	k := s.logEntryKeyToBytes(entry.ID)
 	v, err := json.Marshal(entry)
 	if err != nil {
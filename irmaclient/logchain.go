@@ -0,0 +1,238 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// This file makes the log tamper-evident. Each log entry is chained to the previous one by an
+// HMAC, keyed with a key derived from the storage encryption key, over the HMAC of the previous
+// entry, the ID and the stored (encrypted) entry. The HMACs are stored in the logChainBucket,
+// together with the anchor, which is what the oldest entry is chained to, and the head, which is
+// the HMAC of the newest entry. Thus changing, reordering, inserting or removing log entries
+// without the key breaks the chain, which VerifyLogIntegrity detects.
+
+const (
+	logChainBucket = "logchain" // Key: log entry key, or one of the keys below; value: HMAC
+	logAnchorKey   = "anchor"   // Value: HMAC to which the oldest log entry is chained
+	logHeadKey     = "head"     // Value: HMAC of the newest log entry
+)
+
+// LogIntegrityError is returned by Client.VerifyLogIntegrity when the log has been tampered with.
+type LogIntegrityError struct {
+	// ID of the oldest log entry whose link to the previous entry is broken, or 0 if log entries
+	// were removed from the end of the log.
+	ID uint64
+}
+
+func (e *LogIntegrityError) Error() string {
+	if e.ID == 0 {
+		return "log integrity violated: newest log entries removed"
+	}
+	return fmt.Sprintf("log integrity violated at log entry %d", e.ID)
+}
+
+// VerifyLogIntegrity checks that the log entries have not been tampered with since they were
+// stored, returning a *LogIntegrityError if they have. Logs stored before log entries were chained
+// are chained when they are first verified, so their integrity is only checked from then on.
+func (client *Client) VerifyLogIntegrity() error {
+	var chained bool
+	err := client.storage.view(func(tx dbTx) error {
+		chained = tx.Bucket([]byte(logChainBucket)) != nil
+		if !chained {
+			return nil
+		}
+		return client.storage.txVerifyLogs(&transaction{tx})
+	})
+	if err != nil || chained {
+		return err
+	}
+	return client.storage.Transaction(func(tx *transaction) error {
+		if _, err := client.storage.txLogChain(tx); err != nil {
+			return err
+		}
+		return client.storage.txVerifyLogs(tx)
+	})
+}
+
+// logRecord is a log entry as stored.
+type logRecord struct {
+	key, value []byte
+}
+
+func (r logRecord) id() uint64 {
+	return binary.BigEndian.Uint64(r.key)
+}
+
+// logChainKey returns the key of the HMACs chaining the log entries.
+func (s *storage) logChainKey() []byte {
+	mac := hmac.New(sha256.New, s.aesKey[:])
+	mac.Write([]byte("irma log integrity"))
+	return mac.Sum(nil)
+}
+
+// logLink computes the HMAC chaining the log entry to the previous one.
+func (s *storage) logLink(key []byte, prev []byte, record logRecord) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(prev)
+	mac.Write(record.key)
+	mac.Write(record.value)
+	return mac.Sum(nil)
+}
+
+// txLogRecords returns the stored log entries, from old to new.
+func (s *storage) txLogRecords(tx *transaction) []logRecord {
+	bucket := tx.Bucket([]byte(logsBucket))
+	if bucket == nil {
+		return nil
+	}
+	// We copy the keys and values, as the records may be deleted while they are in use
+	var records []logRecord
+	c := bucket.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		records = append(records, logRecord{key: append([]byte(nil), k...), value: append([]byte(nil), v...)})
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records
+}
+
+// txLogChain returns the bucket containing the log chain. Logs stored before log entries were
+// chained are chained when this is first called.
+func (s *storage) txLogChain(tx *transaction) (dbBucket, error) {
+	if chain := tx.Bucket([]byte(logChainBucket)); chain != nil {
+		return chain, nil
+	}
+	chain, err := tx.CreateBucketIfNotExists([]byte(logChainBucket))
+	if err != nil {
+		return nil, err
+	}
+	key, prev := s.logChainKey(), make([]byte, sha256.Size)
+	if err = chain.Put([]byte(logAnchorKey), prev); err != nil {
+		return nil, err
+	}
+	for _, record := range s.txLogRecords(tx) {
+		prev = s.logLink(key, prev, record)
+		if err = chain.Put(record.key, prev); err != nil {
+			return nil, err
+		}
+	}
+	return chain, chain.Put([]byte(logHeadKey), prev)
+}
+
+// txChainLogEntry chains the newly stored log entry to the newest one before it.
+func (s *storage) txChainLogEntry(tx *transaction, record logRecord) error {
+	chain, err := s.txLogChain(tx)
+	if err != nil {
+		return err
+	}
+	if chain.Get(record.key) != nil { // chained by txLogChain
+		return nil
+	}
+	link := s.logLink(s.logChainKey(), chain.Get([]byte(logHeadKey)), record)
+	if err = chain.Put(record.key, link); err != nil {
+		return err
+	}
+	return chain.Put([]byte(logHeadKey), link)
+}
+
+// txVerifyLogs walks the log chain, returning a *LogIntegrityError at the first broken link.
+func (s *storage) txVerifyLogs(tx *transaction) error {
+	chain := tx.Bucket([]byte(logChainBucket))
+	records := s.txLogRecords(tx)
+	if chain == nil {
+		if len(records) == 0 {
+			return nil
+		}
+		// VerifyLogIntegrity chains logs stored before log entries were chained before verifying them
+		return &LogIntegrityError{ID: records[0].id()}
+	}
+	if i := s.logChainBreak(chain, records); i < len(records) {
+		return &LogIntegrityError{ID: records[i].id()}
+	}
+	var prev []byte
+	if len(records) == 0 {
+		prev = chain.Get([]byte(logAnchorKey))
+	} else {
+		prev = chain.Get(records[len(records)-1].key)
+	}
+	if !hmac.Equal(prev, chain.Get([]byte(logHeadKey))) {
+		return &LogIntegrityError{}
+	}
+	return nil
+}
+
+// logChainBreak returns the index of the first record whose link is broken, or len(records).
+func (s *storage) logChainBreak(chain dbBucket, records []logRecord) int {
+	key, prev := s.logChainKey(), chain.Get([]byte(logAnchorKey))
+	for i, record := range records {
+		link := chain.Get(record.key)
+		if link == nil || !hmac.Equal(link, s.logLink(key, prev, record)) {
+			return i
+		}
+		prev = link
+	}
+	return len(records)
+}
+
+// TxDeleteLogEntries deletes the specified log entries, and re-anchors the log chain: if the
+// oldest entries are deleted, the anchor becomes the link of the newest deleted one, and the
+// entries after other deleted entries are chained anew. Entries from a broken link onwards are
+// not chained anew, so that tampering is not concealed.
+func (s *storage) TxDeleteLogEntries(tx *transaction, ids []uint64) error {
+	bucket := tx.Bucket([]byte(logsBucket))
+	if bucket == nil || len(ids) == 0 {
+		return nil
+	}
+	chain, err := s.txLogChain(tx)
+	if err != nil {
+		return err
+	}
+	records := s.txLogRecords(tx)
+	broken := s.logChainBreak(chain, records)
+
+	deleted := map[uint64]bool{}
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	get := func(k []byte) []byte { return append([]byte(nil), chain.Get(k)...) }
+	key, anchor := s.logChainKey(), get([]byte(logAnchorKey))
+	prev, kept := anchor, false
+	for i, record := range records {
+		if deleted[record.id()] {
+			if !kept && i < broken {
+				anchor = get(record.key)
+				prev = anchor
+			}
+			if err = bucket.Delete(record.key); err != nil {
+				return err
+			}
+			if err = chain.Delete(record.key); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = true
+		if i >= broken {
+			continue
+		}
+		link := s.logLink(key, prev, record)
+		if !bytes.Equal(link, chain.Get(record.key)) {
+			if err = chain.Put(record.key, link); err != nil {
+				return err
+			}
+		}
+		prev = link
+	}
+	if err = chain.Put([]byte(logAnchorKey), anchor); err != nil {
+		return err
+	}
+	if broken == len(records) {
+		return chain.Put([]byte(logHeadKey), prev)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package irmaclient
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// LogFormat is the format in which ExportLogs writes the log.
+type LogFormat string
+
+const (
+	// LogFormatJSON writes one JSON object per log entry per line.
+	LogFormatJSON = LogFormat("json")
+	// LogFormatCSV writes a header, followed by a row per attribute of each log entry, or a single
+	// row for log entries without attributes.
+	LogFormatCSV = LogFormat("csv")
+)
+
+// LogFilter determines which log entries ExportLogs writes, and what it includes of them.
+type LogFilter struct {
+	// From and Until restrict the log entries to those with From <= time < Until; zero values
+	// mean no restriction.
+	From, Until time.Time
+	// Actions restricts the log entries to the specified types, if not empty.
+	Actions []irma.Action
+	// IncludeValues includes attribute values and signed messages, which are left out by default.
+	IncludeValues bool
+	// Language of names and attribute values, see irma.TranslatedString.Translation.
+	Language string
+}
+
+// exportedLogEntry is the representation of a log entry written by ExportLogs.
+type exportedLogEntry struct {
+	ID         uint64                 `json:"id"`
+	Time       time.Time              `json:"time"`
+	Type       irma.Action            `json:"type"`
+	Requestor  string                 `json:"requestor,omitempty"`
+	Message    *string                `json:"message,omitempty"`
+	Attributes []exportedLogAttribute `json:"attributes,omitempty"`
+}
+
+type exportedLogAttribute struct {
+	// Event is "disclosed", "issued" or "removed".
+	Event      string                       `json:"event"`
+	ID         irma.AttributeTypeIdentifier `json:"id"`
+	Credential string                       `json:"credential"`
+	Name       string                       `json:"name"`
+	Value      *string                      `json:"value,omitempty"`
+}
+
+var logCSVHeader = []string{"id", "time", "type", "requestor", "message", "event", "attribute", "credential", "name", "value"}
+
+// ExportLogs writes the log entries selected by the filter to w in the specified format, from
+// new to old, so that users can take their history elsewhere. Identifiers are resolved to names
+// using the current configuration. The log entries are written one by one as they are read.
+func (client *Client) ExportLogs(w io.Writer, format LogFormat, filter LogFilter) error {
+	var write func(*exportedLogEntry) error
+	var flush func() error
+	switch format {
+	case LogFormatJSON:
+		encoder := json.NewEncoder(w)
+		write = func(entry *exportedLogEntry) error { return encoder.Encode(entry) }
+		flush = func() error { return nil }
+	case LogFormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(logCSVHeader); err != nil {
+			return err
+		}
+		write = func(entry *exportedLogEntry) error { return writer.WriteAll(entry.csvRows()) }
+		flush = func() error { writer.Flush(); return writer.Error() }
+	default:
+		return errors.Errorf("unsupported log format %s", format)
+	}
+
+	err := client.storage.IterateLogs(func(entry *LogEntry) error {
+		if !filter.matches(entry) {
+			return nil
+		}
+		exported, err := client.exportLogEntry(entry, filter)
+		if err != nil {
+			return err
+		}
+		return write(exported)
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (filter LogFilter) matches(entry *LogEntry) bool {
+	t := time.Time(entry.Time)
+	if (!filter.From.IsZero() && t.Before(filter.From)) || (!filter.Until.IsZero() && !t.Before(filter.Until)) {
+		return false
+	}
+	if len(filter.Actions) == 0 {
+		return true
+	}
+	for _, action := range filter.Actions {
+		if action == entry.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (client *Client) exportLogEntry(entry *LogEntry, filter LogFilter) (*exportedLogEntry, error) {
+	conf := client.Configuration
+	exported := &exportedLogEntry{ID: entry.ID, Time: time.Time(entry.Time), Type: entry.Type}
+	if entry.ServerName != nil {
+		exported.Requestor = entry.ServerName.Name.Translation(filter.Language)
+	}
+	if filter.IncludeValues && entry.Type == irma.ActionSigning {
+		message := string(entry.SignedMessage)
+		exported.Message = &message
+	}
+	attribute := func(event string, id irma.AttributeTypeIdentifier, value irma.TranslatedString) {
+		attr := exportedLogAttribute{
+			Event:      event,
+			ID:         id,
+			Credential: id.CredentialTypeIdentifier().String(),
+			Name:       id.Name(),
+		}
+		if credtype := conf.CredentialTypes[id.CredentialTypeIdentifier()]; credtype != nil {
+			attr.Credential = credtype.Name.Translation(filter.Language)
+		}
+		if attrtype := conf.AttributeTypes[id]; attrtype != nil {
+			attr.Name = attrtype.Name.Translation(filter.Language)
+		}
+		if filter.IncludeValues && value != nil {
+			v := value.Translation(filter.Language)
+			attr.Value = &v
+		}
+		exported.Attributes = append(exported.Attributes, attr)
+	}
+
+	switch entry.Type {
+	case ActionRemoval:
+		credids := make([]irma.CredentialTypeIdentifier, 0, len(entry.Removed))
+		for credid := range entry.Removed {
+			credids = append(credids, credid)
+		}
+		sort.Slice(credids, func(i, j int) bool { return credids[i].String() < credids[j].String() })
+		for _, credid := range credids {
+			credtype := conf.CredentialTypes[credid]
+			if credtype == nil {
+				continue
+			}
+			values := entry.Removed[credid]
+			for _, attrtype := range credtype.AttributeTypes {
+				if attrtype.Index < len(values) {
+					attribute("removed", attrtype.GetAttributeTypeIdentifier(), values[attrtype.Index])
+				}
+			}
+		}
+	case irma.ActionDisclosing, irma.ActionSigning, irma.ActionIssuing:
+		disclosed, err := entry.GetDisclosedCredentials(conf)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to export log entry "+strconv.FormatUint(entry.ID, 10), 0)
+		}
+		for _, con := range disclosed {
+			for _, attr := range con {
+				attribute("disclosed", attr.Identifier, attr.Value)
+			}
+		}
+		issued, err := entry.GetIssuedCredentials(conf)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to export log entry "+strconv.FormatUint(entry.ID, 10), 0)
+		}
+		for _, info := range issued {
+			credtype := conf.CredentialTypes[info.Identifier()]
+			if credtype == nil {
+				continue
+			}
+			for _, attrtype := range credtype.AttributeTypes {
+				id := attrtype.GetAttributeTypeIdentifier()
+				if value, ok := info.Attributes[id]; ok {
+					attribute("issued", id, value)
+				}
+			}
+		}
+	}
+	return exported, nil
+}
+
+func (entry *exportedLogEntry) csvRows() [][]string {
+	row := func(attr *exportedLogAttribute) []string {
+		var message, event, id, credential, name, value string
+		if entry.Message != nil {
+			message = *entry.Message
+		}
+		if attr != nil {
+			event, id, credential, name = attr.Event, attr.ID.String(), attr.Credential, attr.Name
+			if attr.Value != nil {
+				value = *attr.Value
+			}
+		}
+		return []string{strconv.FormatUint(entry.ID, 10), entry.Time.Format(time.RFC3339), string(entry.Type),
+			entry.Requestor, message, event, id, credential, name, value}
+	}
+	if len(entry.Attributes) == 0 {
+		return [][]string{row(nil)}
+	}
+	rows := make([][]string, len(entry.Attributes))
+	for i := range entry.Attributes {
+		rows[i] = row(&entry.Attributes[i])
+	}
+	return rows
+}
@@ -0,0 +1,116 @@
+package irmaclient
+
+import (
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// LogRetentionPolicy limits how many log entries are kept, and for how long. Zero values mean
+// no limit. Entries are removed if they are older than MaxAge, or if there are more than
+// MaxEntries newer entries.
+type LogRetentionPolicy struct {
+	MaxEntries int
+	MaxAge     time.Duration
+}
+
+// LogRetention determines which log entries are removed by Client.PruneLogs, which is also done
+// whenever a log entry is added. The log entries of the actions in Actions (e.g. irma.ActionSigning
+// or ActionRemoval) are subject only to the policy for their action, and are not counted by the
+// default policy; all other log entries are subject to the default policy. The zero value keeps
+// all log entries.
+type LogRetention struct {
+	LogRetentionPolicy
+	Actions map[irma.Action]LogRetentionPolicy
+}
+
+// SetLogRetention sets which log entries are kept. Log entries are not removed until the next
+// log entry is added or PruneLogs is called.
+func (client *Client) SetLogRetention(retention LogRetention) {
+	client.logRetentionMutex.Lock()
+	defer client.logRetentionMutex.Unlock()
+	client.logRetention = retention
+}
+
+// PruneLogs removes the log entries that are not to be kept according to SetLogRetention,
+// emitting LogsPruned if any were removed.
+func (client *Client) PruneLogs() error {
+	var pruned []uint64
+	err := client.storage.Transaction(func(tx *transaction) (err error) {
+		pruned, err = client.txPruneLogs(tx, time.Now())
+		return
+	})
+	if err != nil {
+		return err
+	}
+	client.emitPruned(pruned)
+	return nil
+}
+
+// addLogEntry stores the log entry and prunes the log in the same transaction, so that the log
+// never exceeds the log retention. It emits LogAppended and LogsPruned.
+func (client *Client) addLogEntry(entry *LogEntry) error {
+	var pruned []uint64
+	err := client.storage.Transaction(func(tx *transaction) (err error) {
+		pruned, err = client.txAddLogEntry(tx, entry)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	client.emit(LogAppended{Entry: entry})
+	client.emitPruned(pruned)
+	return nil
+}
+
+// txAddLogEntry stores the log entry and prunes the log, returning the IDs of the removed log entries.
+func (client *Client) txAddLogEntry(tx *transaction, entry *LogEntry) ([]uint64, error) {
+	if err := client.storage.TxAddLogEntry(tx, entry); err != nil {
+		return nil, err
+	}
+	return client.txPruneLogs(tx, time.Now())
+}
+
+// txPruneLogs removes the log entries that are not to be kept at the specified time, returning
+// their IDs.
+func (client *Client) txPruneLogs(tx *transaction, now time.Time) ([]uint64, error) {
+	client.logRetentionMutex.Lock()
+	retention := client.logRetention
+	client.logRetentionMutex.Unlock()
+
+	var prune []*LogEntry
+	counts := map[irma.Action]int{}
+	// Logs are iterated from new to old, so we can count how many newer entries there are
+	err := client.storage.TxIterateLogs(tx, func(entry *LogEntry) error {
+		policy, ok := retention.Actions[entry.Type]
+		class := entry.Type
+		if !ok {
+			policy, class = retention.LogRetentionPolicy, ""
+		}
+		counts[class]++
+		if (policy.MaxEntries > 0 && counts[class] > policy.MaxEntries) ||
+			(policy.MaxAge > 0 && now.Sub(time.Time(entry.Time)) > policy.MaxAge) {
+			prune = append(prune, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete after iterating, as deleting would disturb the cursor
+	var ids []uint64
+	for _, entry := range prune {
+		ids = append(ids, entry.ID)
+	}
+	if err = client.storage.TxDeleteLogEntries(tx, ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (client *Client) emitPruned(ids []uint64) {
+	if len(ids) > 0 {
+		client.emit(LogsPruned{IDs: ids})
+	}
+}
@@ -26,13 +26,25 @@ type LogEntry struct {
 
 	// Issuance sessions
 	IssueCommitment *irma.IssueCommitmentMessage `json:",omitempty"`
+	// Indices of the credentials of the request that the user declined and that were not stored
+	DeclinedCredentials []int `json:",omitempty"`
+	// Per index of a credential of the request that the issuer did not issue, the reason it gave
+	FailedCredentials map[int]*irma.RemoteError `json:",omitempty"`
 
 	// All session types
+	// DryRun is set for sessions started with NewDryRunSession, whose response was not sent
+	DryRun     bool                  `json:",omitempty"`
 	ServerName *irma.RequestorInfo   `json:",omitempty"`
 	Version    *irma.ProtocolVersion `json:",omitempty"`
 	Disclosure *irma.Disclosure      `json:",omitempty"`
 	Request    json.RawMessage       `json:",omitempty"` // Message that started the session
+	Timings    *PhaseTimings         `json:",omitempty"`
 	request    irma.SessionRequest   // cached parsed version of Request; get with LogEntry.SessionRequest()
+
+	// Sensitivity of the disclosed sensitive attributes, and whether the user confirmed their
+	// disclosure a second time, see SensitiveDisclosureHandler
+	Sensitivity        map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity `json:",omitempty"`
+	SensitiveConfirmed bool                                                       `json:",omitempty"`
 }
 
 const ActionRemoval = irma.Action("removal")
@@ -93,14 +105,23 @@ func (entry *LogEntry) GetDisclosedCredentials(conf *irma.Configuration) ([][]*i
 
 // GetIssuedCredentials gets the list of issued credentials for a log entry
 func (entry *LogEntry) GetIssuedCredentials(conf *irma.Configuration) (list irma.CredentialInfoList, err error) {
-	if entry.Type != irma.ActionIssuing {
+	if entry.Type != irma.ActionIssuing || entry.DryRun {
 		return irma.CredentialInfoList{}, nil
 	}
 	request, err := entry.SessionRequest()
 	if err != nil {
 		return nil, err
 	}
-	return request.(*irma.IssuanceRequest).GetCredentialInfoList(conf, entry.Version, time.Time(entry.Time))
+	all, err := request.(*irma.IssuanceRequest).GetCredentialInfoList(conf, entry.Version, time.Time(entry.Time))
+	if err != nil || (len(entry.DeclinedCredentials) == 0 && len(entry.FailedCredentials) == 0) {
+		return all, err
+	}
+	for i, info := range all {
+		if _, failed := entry.FailedCredentials[i]; !failed && !containsIndex(entry.DeclinedCredentials, i) {
+			list = append(list, info)
+		}
+	}
+	return list, nil
 }
 
 // GetSignedMessage gets the signed for a log entry
@@ -113,24 +134,36 @@ func (entry *LogEntry) GetSignedMessage() (abs *irma.SignedMessage, err error) {
 		return nil, err
 	}
 	sigrequest := request.(*irma.SignatureRequest)
+	// The signature was computed over the message as the type of the request prescribes;
+	// as in irma.SignatureRequest.SignatureFromMessage, the default type is omitted
+	messageType := sigrequest.MessageType
+	if messageType == irma.SignatureMessageTypeString {
+		messageType = ""
+	}
 	return &irma.SignedMessage{
-		LDContext: entry.SignedMessageLDContext,
-		Signature: entry.Disclosure.Proofs,
-		Nonce:     sigrequest.Nonce,
-		Context:   sigrequest.GetContext(),
-		Message:   string(entry.SignedMessage),
-		Timestamp: entry.Timestamp,
+		LDContext:   entry.SignedMessageLDContext,
+		Signature:   entry.Disclosure.Proofs,
+		Nonce:       sigrequest.Nonce,
+		Context:     sigrequest.GetContext(),
+		Message:     string(entry.SignedMessage),
+		Timestamp:   entry.Timestamp,
+		MessageType: messageType,
 	}, nil
 }
 
-func (session *session) createLogEntry(response interface{}) (*LogEntry, error) {
+func (session *session) createLogEntry(disclosure *irma.DisclosureResponse, commitments *irma.IssueCommitmentMessage) (*LogEntry, error) {
 	entry := &LogEntry{
 		Type:       session.Action,
 		Time:       irma.Timestamp(time.Now()),
 		ServerName: session.RequestorInfo,
 		Version:    session.Version,
 		request:    session.request,
+
+		Sensitivity:        session.sensitivity,
+		SensitiveConfirmed: session.sensitiveConfirmed,
 	}
+	timings := session.Timings()
+	entry.Timings = &timings
 
 	if err := entry.setSessionRequest(); err != nil {
 		return nil, err
@@ -147,9 +180,13 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 
 		fallthrough
 	case irma.ActionDisclosing:
-		entry.Disclosure = response.(*irma.Disclosure)
+		entry.Disclosure = &disclosure.Disclosure
 	case irma.ActionIssuing:
-		entry.IssueCommitment = response.(*irma.IssueCommitmentMessage)
+		entry.IssueCommitment = commitments
+		if session.choice != nil {
+			entry.DeclinedCredentials = session.choice.DeclinedCredentials
+		}
+		entry.FailedCredentials = session.issueErrors
 	default:
 		return nil, errors.New("Invalid log type")
 	}
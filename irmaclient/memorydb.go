@@ -0,0 +1,199 @@
+package irmaclient
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+// memoryDB is a database that is kept in memory only, for clients created by NewMemoryClient.
+// Like bbolt, it allows one read-write transaction at a time next to any number of read-only
+// ones. A read-write transaction works on a copy of the data, which replaces the data only if
+// the transaction succeeds, so that failing transactions are rolled back.
+type memoryDB struct {
+	mutex   sync.RWMutex
+	buckets map[string]*memoryBucket
+	closed  bool
+}
+
+type memoryTx struct {
+	buckets  map[string]*memoryBucket
+	writable bool
+}
+
+type memoryBucket struct {
+	tx       *memoryTx // read-write transaction modifying this bucket, if any
+	values   map[string][]byte
+	sequence uint64
+}
+
+// memoryCursor iterates over the keys of a bucket, in byte-sorted order as in bbolt.
+type memoryCursor struct {
+	bucket *memoryBucket
+	keys   []string
+	index  int
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{buckets: map[string]*memoryBucket{}}
+}
+
+func (db *memoryDB) View(f func(dbTx) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		return bbolt.ErrDatabaseNotOpen
+	}
+	return f(&memoryTx{buckets: db.buckets})
+}
+
+func (db *memoryDB) Update(f func(dbTx) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return bbolt.ErrDatabaseNotOpen
+	}
+
+	tx := &memoryTx{buckets: make(map[string]*memoryBucket, len(db.buckets)), writable: true}
+	for name, b := range db.buckets {
+		tx.buckets[name] = b.copy(tx)
+	}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for _, b := range tx.buckets {
+		b.tx = nil // committed buckets are read-only; later transactions modify copies
+	}
+	db.buckets = tx.buckets
+	return nil
+}
+
+func (db *memoryDB) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.closed = true
+	db.buckets = nil
+	return nil
+}
+
+func (tx *memoryTx) Bucket(name []byte) dbBucket {
+	if b, ok := tx.buckets[string(name)]; ok {
+		return b
+	}
+	return nil
+}
+
+func (tx *memoryTx) CreateBucketIfNotExists(name []byte) (dbBucket, error) {
+	if !tx.writable {
+		return nil, bbolt.ErrTxNotWritable
+	}
+	b, ok := tx.buckets[string(name)]
+	if !ok {
+		b = &memoryBucket{tx: tx, values: map[string][]byte{}}
+		tx.buckets[string(name)] = b
+	}
+	return b, nil
+}
+
+func (tx *memoryTx) DeleteBucket(name []byte) error {
+	if !tx.writable {
+		return bbolt.ErrTxNotWritable
+	}
+	if _, ok := tx.buckets[string(name)]; !ok {
+		return bbolt.ErrBucketNotFound
+	}
+	delete(tx.buckets, string(name))
+	return nil
+}
+
+func (b *memoryBucket) copy(tx *memoryTx) *memoryBucket {
+	c := &memoryBucket{tx: tx, values: make(map[string][]byte, len(b.values)), sequence: b.sequence}
+	for k, v := range b.values {
+		c.values[k] = v // values are never modified in place, so they can be shared
+	}
+	return c
+}
+
+func (b *memoryBucket) writable() bool {
+	return b.tx != nil && b.tx.writable
+}
+
+func (b *memoryBucket) Get(key []byte) []byte {
+	return b.values[string(key)]
+}
+
+func (b *memoryBucket) Put(key, value []byte) error {
+	if !b.writable() {
+		return bbolt.ErrTxNotWritable
+	}
+	b.values[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memoryBucket) Delete(key []byte) error {
+	if !b.writable() {
+		return bbolt.ErrTxNotWritable
+	}
+	delete(b.values, string(key))
+	return nil
+}
+
+func (b *memoryBucket) ForEach(f func(key, value []byte) error) error {
+	c := b.cursor()
+	for _, k := range c.keys {
+		if err := f([]byte(k), b.values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) NextSequence() (uint64, error) {
+	if !b.writable() {
+		return 0, bbolt.ErrTxNotWritable
+	}
+	b.sequence++
+	return b.sequence, nil
+}
+
+func (b *memoryBucket) Cursor() dbCursor {
+	return b.cursor()
+}
+
+func (b *memoryBucket) cursor() *memoryCursor {
+	keys := make([]string, 0, len(b.values))
+	for k := range b.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // byte-wise comparison, as bytes.Compare
+	return &memoryCursor{bucket: b, keys: keys}
+}
+
+func (c *memoryCursor) current() (key, value []byte) {
+	if c.index < 0 || c.index >= len(c.keys) {
+		return nil, nil
+	}
+	k := c.keys[c.index]
+	return []byte(k), c.bucket.values[k]
+}
+
+func (c *memoryCursor) Last() (key, value []byte) {
+	c.index = len(c.keys) - 1
+	return c.current()
+}
+
+func (c *memoryCursor) Seek(seek []byte) (key, value []byte) {
+	c.index = sort.Search(len(c.keys), func(i int) bool {
+		return bytes.Compare([]byte(c.keys[i]), seek) >= 0
+	})
+	return c.current()
+}
+
+func (c *memoryCursor) Prev() (key, value []byte) {
+	if c.index >= 0 {
+		c.index--
+	}
+	return c.current()
+}
@@ -0,0 +1,222 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the import of credentials from the storage of the old Android IRMA app
+// (irma_android_cardemu), which kept them as a JSON string in the shared preferences file
+// shared_prefs/cardemu.xml of the app's data directory, per credential type under "credentials".
+// The secret key is not stored separately, but as the first attribute of each credential.
+//
+// The import is limited to what we know of this format, which is the conversion that irmago
+// itself once performed (see the first entry of clientUpdates); it has not been tested against
+// the storage of an actual installation of the old app. Therefore only credentials without a
+// keyshare server are imported: the keyshare enrollments and the log of the old app, and the
+// credentials that need the former, are not.
+
+const oldStorageFile = "shared_prefs/cardemu.xml"
+
+// OldStorageImport is the result of ImportOldStorage.
+type OldStorageImport struct {
+	Credentials []irma.CredentialIdentifier // imported credentials
+	Skipped     []OldStorageSkipped         // credentials that were not imported
+}
+
+// OldStorageSkipped describes a credential from the old storage that was not imported.
+type OldStorageSkipped struct {
+	CredentialType irma.CredentialTypeIdentifier
+	Index          int // index of the credential within its type
+	Reason         string
+}
+
+type oldCredential struct {
+	Signature  *gabi.CLSignature `json:"signature"`
+	Attributes []*big.Int        `json:"attributes"`
+}
+
+// ImportOldStorage imports the credentials of the old Android app, whose data directory is passed
+// as fsys (e.g. using os.DirFS). The secret key of the old app is adopted, so this is only
+// possible if the client has no credentials yet, or if its credentials share the secret key of
+// the old app (e.g. when importing a second time). Each credential is verified before it is
+// imported; credentials that fail verification, that are already present, or whose scheme has a
+// keyshare server are skipped. All imported data is stored in a single transaction.
+func (client *Client) ImportOldStorage(fsys fs.FS) (*OldStorageImport, error) {
+	oldCreds, err := parseOldStorage(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := client.holdSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	// Check all credentials, in a fixed order, collecting the ones to import per type
+	result := &OldStorageImport{}
+	skip := func(id irma.CredentialTypeIdentifier, i int, reason string) {
+		result.Skipped = append(result.Skipped, OldStorageSkipped{CredentialType: id, Index: i, Reason: reason})
+	}
+	ids := make([]string, 0, len(oldCreds))
+	for id := range oldCreds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var sk *big.Int
+	imported := map[irma.CredentialTypeIdentifier][]*credential{}
+	hashes := map[string]struct{}{}
+	for _, idstr := range ids {
+		id := irma.NewCredentialTypeIdentifier(idstr)
+		for i, old := range oldCreds[idstr] {
+			cred, reason := client.oldCredential(id, old)
+			if cred == nil {
+				skip(id, i, reason)
+				continue
+			}
+			if sk == nil {
+				sk = cred.Attributes[0]
+			}
+			hash := cred.attrs.Hash()
+			_, present := client.lookup[hash]
+			if _, dup := hashes[hash]; present || dup ||
+				(cred.CredentialType().IsSingleton && (len(client.attrs(id)) > 0 || len(imported[id]) > 0)) {
+				skip(id, i, "already present")
+				continue
+			}
+			if cred.Attributes[0].Cmp(sk) != 0 {
+				skip(id, i, "secret key differs from that of the other credentials")
+				continue
+			}
+			hashes[hash] = struct{}{}
+			imported[id] = append(imported[id], cred)
+		}
+	}
+
+	newKey := sk != nil && sk.Cmp(client.secretKey().Key) != 0
+	if newKey && len(client.lookup) > 0 {
+		return nil, errors.New("cannot import credentials of another secret key into a client that has credentials")
+	}
+	if newKey && client.secretKeyStore != nil {
+		return nil, errors.New("cannot import the secret key of the old storage into the secret key store")
+	}
+
+	// Store everything in one transaction, and only then update our in-memory state
+	attributes := map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+	for id, creds := range imported {
+		attributes[id] = append([]*irma.AttributeList{}, client.attrs(id)...)
+		for _, cred := range creds {
+			attributes[id] = append(attributes[id], cred.attrs)
+		}
+	}
+	err = client.storage.Transaction(func(tx *transaction) error {
+		if newKey {
+			if err := client.storage.TxStoreSecretKey(tx, &secretKey{Key: sk}); err != nil {
+				return err
+			}
+		}
+		for id, creds := range imported {
+			for _, cred := range creds {
+				if err := client.storage.TxStoreSignature(tx, cred); err != nil {
+					return err
+				}
+			}
+			if err := client.storage.TxStoreAttributes(tx, id, attributes[id]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if newKey {
+		client.setSecretKey(&secretKey{Key: sk})
+	}
+	for id, list := range attributes {
+		client.attributes[id] = list
+		for i, attrs := range list {
+			client.lookup[attrs.Hash()] = &credLookup{id: id, counter: i}
+		}
+	}
+	for _, idstr := range ids {
+		id := irma.NewCredentialTypeIdentifier(idstr)
+		for _, cred := range imported[id] {
+			result.Credentials = append(result.Credentials, irma.CredentialIdentifier{Type: id, Hash: cred.attrs.Hash()})
+			client.emit(CredentialAdded{Info: cred.attrs.Info()})
+		}
+	}
+	if len(imported) > 0 {
+		client.handler.UpdateAttributes()
+	}
+	return result, nil
+}
+
+func parseOldStorage(fsys fs.FS) (map[string][]*oldCredential, error) {
+	bts, err := fs.ReadFile(fsys, oldStorageFile)
+	if err != nil {
+		return nil, err
+	}
+	prefs := struct {
+		Strings []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:",chardata"`
+		} `xml:"string"`
+	}{}
+	if err = xml.Unmarshal(bts, &prefs); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse old storage", 0)
+	}
+
+	creds := map[string][]*oldCredential{}
+	for _, pref := range prefs.Strings {
+		if pref.Name != "credentials" {
+			continue
+		}
+		if err = json.Unmarshal([]byte(pref.Content), &creds); err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse credentials of old storage", 0)
+		}
+	}
+	return creds, nil
+}
+
+// oldCredential converts and verifies a credential from the old storage, returning the reason
+// for skipping it if it is not fit for importing.
+func (client *Client) oldCredential(id irma.CredentialTypeIdentifier, old *oldCredential) (*credential, string) {
+	if old == nil || old.Signature == nil || len(old.Attributes) < 2 {
+		return nil, "malformed credential"
+	}
+	meta := irma.MetadataFromInt(old.Attributes[1], client.Configuration)
+	if meta.CredentialType() == nil {
+		return nil, "unknown credential type"
+	}
+	if meta.CredentialType().Identifier() != id {
+		return nil, "credential type does not match metadata"
+	}
+	if client.Configuration.SchemeManagers[id.SchemeManagerIdentifier()].Distributed() {
+		return nil, "scheme has a keyshare server"
+	}
+
+	gabicred := &gabi.Credential{Attributes: old.Attributes, Signature: old.Signature}
+	attrs := irma.NewAttributeListFromInts(old.Attributes[1:], client.Configuration)
+	cred, err := newCredential(gabicred, attrs, client.Configuration)
+	if err != nil {
+		return nil, fmt.Sprintf("public key not found: %s", err)
+	}
+	if !cred.Signature.Verify(cred.Pk, cred.Attributes) {
+		return nil, "invalid signature"
+	}
+	return cred, ""
+}
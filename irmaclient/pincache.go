@@ -0,0 +1,88 @@
+package irmaclient
+
+import (
+	"time"
+)
+
+// defaultPinGracePeriod is the PIN grace period of new clients, see SetPinGracePeriod.
+const defaultPinGracePeriod = time.Minute
+
+// SetPinGracePeriod sets the PIN grace period: for the specified duration after the user entered
+// their PIN, sessions using the keyshare server do not ask for it again. For this the PIN is kept
+// in memory during this period, to obtain a new authorization token from the keyshare server
+// without asking the user when the token expires, or when the keyshare server rejects it halfway
+// through a session. Outside of the grace period, the token is reused as long as it remains valid
+// for at least another minute. A zero duration disables this.
+func (client *Client) SetPinGracePeriod(duration time.Duration) {
+	client.pinMutex.Lock()
+	defer client.pinMutex.Unlock()
+	client.pinGracePeriod = duration
+	for _, kss := range client.keyshareServers {
+		if kss.pinTimer == nil {
+			continue
+		}
+		if remaining := duration - time.Since(kss.pinVerified); remaining > 0 {
+			kss.pinTimer.Reset(remaining)
+		} else {
+			clearPin(kss)
+		}
+	}
+}
+
+// ClearPinCache ends the PIN grace period of all keyshare servers, so that the next session
+// asks for the PIN unless the authorization tokens remain valid long enough anyway. This is
+// also done by Lock and when changing the PIN.
+func (client *Client) ClearPinCache() {
+	client.pinMutex.Lock()
+	defer client.pinMutex.Unlock()
+	for _, kss := range client.keyshareServers {
+		clearPin(kss)
+	}
+}
+
+// cachePin registers that the user entered the specified correct PIN for the keyshare server,
+// starting its PIN grace period; an empty PIN ends the grace period. The PIN is kept as a byte
+// slice that is overwritten when the grace period ends. This does not wipe pin itself, nor the
+// copies returned by cachedPin.
+func (client *Client) cachePin(kss *keyshareServer, pin string) {
+	client.pinMutex.Lock()
+	defer client.pinMutex.Unlock()
+	clearPin(kss)
+	if pin == "" || client.pinGracePeriod <= 0 {
+		return
+	}
+	kss.pinVerified, kss.pin = time.Now(), []byte(pin)
+	var timer *time.Timer
+	timer = time.AfterFunc(client.pinGracePeriod, func() {
+		client.pinMutex.Lock()
+		defer client.pinMutex.Unlock()
+		if kss.pinTimer == timer { // not superseded by a later cachePin
+			clearPin(kss)
+		}
+	})
+	kss.pinTimer = timer
+}
+
+// cachedPin returns the PIN of the keyshare server if it is within its PIN grace period.
+func (client *Client) cachedPin(kss *keyshareServer) (string, bool) {
+	client.pinMutex.Lock()
+	defer client.pinMutex.Unlock()
+	if kss.pinVerified.IsZero() {
+		return "", false
+	}
+	if time.Since(kss.pinVerified) >= client.pinGracePeriod {
+		clearPin(kss) // in case the timer has yet to fire
+		return "", false
+	}
+	return string(kss.pin), true
+}
+
+// clearPin ends the PIN grace period of the keyshare server, overwriting the cached PIN.
+// The caller must hold the pinMutex.
+func clearPin(kss *keyshareServer) {
+	if kss.pinTimer != nil {
+		kss.pinTimer.Stop()
+	}
+	wipeBytes(kss.pin)
+	kss.pinVerified, kss.pin, kss.pinTimer = time.Time{}, nil, nil
+}
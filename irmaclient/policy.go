@@ -0,0 +1,73 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// Decision is the outcome of a SessionPolicy.
+type Decision int
+
+const (
+	// DecisionAsk continues the session, asking the user for permission as usual.
+	DecisionAsk Decision = iota
+	// DecisionDeny aborts the session with irma.ErrorRequestorBlocked before the user is asked anything.
+	DecisionDeny
+)
+
+// SessionPolicy decides whether sessions may be performed at all, e.g. to only allow sessions
+// of requestors known to an organization embedding the client.
+type SessionPolicy interface {
+	// Allow is called after the session request has been received and before the user is asked
+	// for permission. The requestor is the requestor as verified against the requestor schemes,
+	// or nil if it is not present in any of them or if the session has no server; serverURL is
+	// the URL of the IRMA server, or empty in case of sessions without server.
+	Allow(action irma.Action, serverURL string, requestor *irma.RequestorInfo) Decision
+}
+
+// SessionPolicyFunc is a function implementing SessionPolicy.
+type SessionPolicyFunc func(action irma.Action, serverURL string, requestor *irma.RequestorInfo) Decision
+
+func (f SessionPolicyFunc) Allow(action irma.Action, serverURL string, requestor *irma.RequestorInfo) Decision {
+	return f(action, serverURL, requestor)
+}
+
+// ErrRequestorBlocked is the error of sessions denied by a SessionPolicy.
+var ErrRequestorBlocked = errors.New("session blocked by session policy")
+
+// SetSessionPolicy sets the policy consulted for all sessions of the client, in addition to the
+// policy of the session itself (see NewSessionWithPolicy). A nil policy allows all sessions.
+func (client *Client) SetSessionPolicy(policy SessionPolicy) {
+	client.policyMutex.Lock()
+	defer client.policyMutex.Unlock()
+	client.policy = policy
+}
+
+// NewSessionWithPolicy starts a new IRMA session as NewSession does, which is only performed if
+// both the specified policy and the policy of the client allow it.
+func (client *Client) NewSessionWithPolicy(sessionrequest string, handler Handler, policy SessionPolicy) SessionDismisser {
+	return client.newSession(sessionrequest, handler, sessionOptions{policy: policy})
+}
+
+// checkPolicies consults the policy of the session and that of the client.
+func (session *session) checkPolicies() *irma.SessionError {
+	// Keyshare enrollment sessions are started by the client itself
+	if _, ok := session.Handler.(*keyshareEnrollmentHandler); ok {
+		return nil
+	}
+
+	session.client.policyMutex.Lock()
+	policies := []SessionPolicy{session.client.policy, session.policy}
+	session.client.policyMutex.Unlock()
+
+	requestor := session.RequestorInfo
+	if requestor != nil && requestor.Unverified {
+		requestor = nil
+	}
+	for _, policy := range policies {
+		if policy != nil && policy.Allow(session.Action, session.ServerURL, requestor) == DecisionDeny {
+			return &irma.SessionError{ErrorType: irma.ErrorRequestorBlocked, Err: ErrRequestorBlocked, Info: session.Hostname}
+		}
+	}
+	return nil
+}
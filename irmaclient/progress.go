@@ -0,0 +1,96 @@
+package irmaclient
+
+import (
+	irma "github.com/privacybydesign/irmago"
+)
+
+// ProgressPhase is a phase of a session during which the client reports its progress.
+type ProgressPhase string
+
+const (
+	// ProgressBuildingProofs is computing the proofs of the response to the server. Its steps are
+	// preparing, and (except in sessions involving a keyshare server) proving, each credential
+	// that is disclosed or issued.
+	ProgressBuildingProofs = ProgressPhase("buildingProofs")
+	// ProgressPostingResponse is sending the response to the server, which is a single step.
+	ProgressPostingResponse = ProgressPhase("postingResponse")
+	// ProgressConstructingCredentials is constructing the issued credentials from the signatures
+	// of the issuer. Its steps are the credentials.
+	ProgressConstructingCredentials = ProgressPhase("constructingCredentials")
+)
+
+// Progress describes how far the client is in a phase of a session that may take a while.
+type Progress struct {
+	Phase     ProgressPhase `json:"phase"`
+	Completed int           `json:"completed"`
+	Total     int           `json:"total"`
+	// Percentage of the steps of the phase that is completed, or -1 if the number of steps is unknown.
+	Percentage int `json:"percentage"`
+}
+
+// SessionProgressHandler can optionally be implemented by a Handler, to receive the progress of
+// the client during the phases of a session in between status updates, e.g. to show a progress
+// bar while multiple credentials are issued. It is called when a phase starts and after each
+// step of it, but never after the session has ended.
+type SessionProgressHandler interface {
+	SessionProgress(action irma.Action, progress Progress)
+}
+
+// progress counts the steps of a phase of a session, reporting them to the handler of the session.
+// A nil *progress ignores the steps, so that it can be passed where progress is not reported.
+type progress struct {
+	session   *session
+	handler   SessionProgressHandler
+	phase     ProgressPhase
+	completed int
+	total     int
+}
+
+// newProgress starts the specified phase of total steps, returning nil if the handler of the
+// session does not implement SessionProgressHandler.
+func (session *session) newProgress(phase ProgressPhase, total int) *progress {
+	handler, ok := session.Handler.(SessionProgressHandler)
+	if !ok {
+		return nil
+	}
+	p := &progress{session: session, handler: handler, phase: phase, total: total}
+	p.report()
+	return p
+}
+
+// step records that a step of the phase was completed.
+func (p *progress) step() {
+	if p == nil {
+		return
+	}
+	p.completed++
+	p.report()
+}
+
+func (p *progress) report() {
+	if p.session.Status().Finished() {
+		return
+	}
+	progress := Progress{Phase: p.phase, Completed: p.completed, Total: p.total, Percentage: -1}
+	if p.total > 0 {
+		if p.completed > p.total {
+			progress.Total = p.completed
+		}
+		progress.Percentage = 100 * p.completed / progress.Total
+	}
+	p.session.dispatch(func() { p.handler.SessionProgress(p.session.Action, progress) })
+}
+
+// proofCount returns the number of credentials of which the response to the server contains
+// a proof.
+func (session *session) proofCount() int {
+	todisclose, _, err := session.client.groupCredentials(session.choice)
+	if err != nil {
+		return 0
+	}
+	n := len(todisclose)
+	if request, ok := session.request.(*irma.IssuanceRequest); ok {
+		n += len(request.Credentials)
+	}
+	return n
+}
@@ -0,0 +1,14 @@
+package irmaclient
+
+// gabi draws all randomness it needs during proof building (commitment randomizers, issuer
+// proof nonces, etc.) directly from crypto/rand.Reader. The parts of proof building that do so
+// run within withRandomness, which outside tests just runs them.
+//
+// In order to be able to reproduce the exact messages that the client sends, the tests of this
+// package replace withRandomness by a function that installs their own source of randomness as
+// crypto/rand.Reader for the duration of f; see irmaclient_random_test.go. This must never be
+// done outside of tests: the randomness of the proofs is essential for their zero-knowledge
+// property, and replacing crypto/rand.Reader affects all goroutines.
+var withRandomness = func(client *Client, f func() error) error {
+	return f()
+}
@@ -0,0 +1,414 @@
+package irmaclient
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"go.etcd.io/bbolt"
+)
+
+// This file contains the recovery of a corrupted storage at startup. When the database cannot be
+// opened at all, it is moved aside and a new one is created. Otherwise, each stored entry that
+// cannot be decrypted or parsed is removed, as are credentials whose signature is missing or does
+// not verify. What is removed is written to the corruptedDir subdirectory of the storage, so that
+// it can be inspected or salvaged later, and reported in a StorageRecoveryReport.
+
+const corruptedDir = "corrupted"
+
+// StorageRecoveryReport describes what the client lost, and what it salvaged, when it found its
+// storage to be corrupted at startup.
+type StorageRecoveryReport struct {
+	// DatabaseReset is set if the database could not be opened at all; everything was lost.
+	DatabaseReset bool `json:"databaseReset,omitempty"`
+	// SecretKeyLost is set if the secret key could not be read. A new secret key was generated,
+	// so all credentials were lost.
+	SecretKeyLost bool `json:"secretKeyLost,omitempty"`
+	// LostCredentials contains the type of each credential that was lost because its signature
+	// was missing or invalid.
+	LostCredentials []irma.CredentialTypeIdentifier `json:"lostCredentials,omitempty"`
+	// LostCredentialEntries is the number of unreadable entries containing the credentials of
+	// one, unknown, credential type.
+	LostCredentialEntries int `json:"lostCredentialEntries,omitempty"`
+	// LostLogs is the number of unreadable log entries.
+	LostLogs int `json:"lostLogs,omitempty"`
+	// LostUserdata contains the names of other unreadable entries, such as "preferences" or
+	// "kss" (keyshare enrollments), which were reset.
+	LostUserdata []string `json:"lostUserdata,omitempty"`
+
+	// SalvagedCredentials and SalvagedLogs are the number of credentials and log entries that
+	// survived.
+	SalvagedCredentials int `json:"salvagedCredentials"`
+	SalvagedLogs        int `json:"salvagedLogs"`
+
+	// Quarantined contains the paths of the files in which the removed data was saved.
+	Quarantined []string `json:"quarantined,omitempty"`
+}
+
+// StorageRecoveryHandler is an optional interface of ClientHandler. If the ClientHandler
+// implements it, it is informed when the client recovered from a corrupted storage at startup,
+// so that the app can inform the user.
+type StorageRecoveryHandler interface {
+	StorageRecovered(report *StorageRecoveryReport)
+}
+
+// Empty returns whether nothing was lost.
+func (r *StorageRecoveryReport) Empty() bool {
+	return !r.DatabaseReset && !r.SecretKeyLost && len(r.LostCredentials) == 0 &&
+		r.LostCredentialEntries == 0 && r.LostLogs == 0 && len(r.LostUserdata) == 0
+}
+
+// StorageRecovery returns what was lost when the client recovered from a corrupted storage at
+// startup, or nil if the storage was intact.
+func (client *Client) StorageRecovery() *StorageRecoveryReport {
+	if client.storage.recovery.Empty() {
+		return nil
+	}
+	return &client.storage.recovery
+}
+
+// reportStorageRecovery passes the StorageRecoveryReport to the handler, if anything was lost.
+func (client *Client) reportStorageRecovery() {
+	report := client.StorageRecovery()
+	if report == nil {
+		return
+	}
+	irma.Logger.Warnf("Recovered from corrupted storage: %+v", report)
+	if handler, ok := client.handler.(StorageRecoveryHandler); ok {
+		handler.StorageRecovered(report)
+	}
+}
+
+// openDatabase opens the bbolt database, converting a panic of bbolt on a mangled file to
+// bbolt.ErrInvalid.
+func (s *storage) openDatabase() (db *bbolt.DB, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			db, err = nil, bbolt.ErrInvalid
+		}
+	}()
+	return bbolt.Open(s.path(databaseFile), 0600, &bbolt.Options{Timeout: 1 * time.Second})
+}
+
+// corruptDatabase returns whether the error returned by openDatabase indicates that the database
+// file is corrupted, as opposed to e.g. in use by another process.
+func corruptDatabase(err error) bool {
+	return err == bbolt.ErrInvalid || err == bbolt.ErrChecksum || err == bbolt.ErrVersionMismatch
+}
+
+// resetDatabase moves the database file into the corruptedDir and opens a new one.
+func (s *storage) resetDatabase() error {
+	if s.db != nil {
+		_ = s.db.Close()
+	}
+	dest, err := s.quarantinePath(databaseFile)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(s.path(databaseFile), dest); err != nil {
+		return err
+	}
+	s.recovery = StorageRecoveryReport{DatabaseReset: true, Quarantined: []string{dest}}
+	db, err := s.openDatabase()
+	if err != nil {
+		return err
+	}
+	s.db = boltDB{db}
+	return nil
+}
+
+// quarantinePath returns a new path within the corruptedDir for the specified name.
+func (s *storage) quarantinePath(name string) (string, error) {
+	dir := s.path(corruptedDir)
+	if err := common.EnsureDirectoryExists(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%d", name, time.Now().UnixNano())), nil
+}
+
+// quarantine saves a stored entry that is about to be removed in the corruptedDir. Storage kept
+// in memory (see NewMemoryClient) has no corruptedDir, so there it is just removed.
+func (s *storage) quarantine(bucket string, key, value []byte) error {
+	if s.storagePath == "" {
+		return nil
+	}
+	path, err := s.quarantinePath(bucket + "-" + hex.EncodeToString(key))
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, value, 0600); err != nil {
+		return err
+	}
+	s.recovery.Quarantined = append(s.recovery.Quarantined, path)
+	return nil
+}
+
+// readable returns whether the stored value can be decrypted and parsed into dest.
+func (s *storage) readable(value []byte, dest interface{}) bool {
+	plaintext, err := s.decrypt(value)
+	return err == nil && json.Unmarshal(plaintext, dest) == nil
+}
+
+// recoverEntries removes the entries that cannot be decrypted or parsed. If the database is
+// so badly corrupted that reading it fails, it is reset altogether.
+func (s *storage) recoverEntries() (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			irma.Logger.Warnf("Reading database panicked: %v", e)
+			err = s.resetDatabase()
+		}
+	}()
+	return s.Transaction(s.txRecoverEntries)
+}
+
+func (s *storage) txRecoverEntries(tx *transaction) error {
+	// If nothing can be decrypted, the storage is most likely opened with the wrong key,
+	// in which case we should not remove anything
+	if !s.txDecryptable(tx) {
+		return errors.New("storage cannot be decrypted")
+	}
+
+	userdata := map[string]func() interface{}{
+		skKey:           func() interface{} { return &secretKey{} },
+		credTypeKeysKey: func() interface{} { return &map[irma.CredentialTypeIdentifier][]byte{} },
+		preferencesKey:  func() interface{} { return &Preferences{} },
+		updatesKey:      func() interface{} { return &[]update{} },
+		kssKey:          func() interface{} { return &map[irma.SchemeManagerIdentifier]*keyshareServer{} },
+		nicknamesKey:    func() interface{} { return &map[string]string{} },
+	}
+	err := s.txRemoveUnreadable(tx, userdataBucket, func(key, value []byte) bool {
+		dest, ok := userdata[string(key)]
+		if !ok {
+			return true
+		}
+		d := dest()
+		if !s.readable(value, d) {
+			return false
+		}
+		sk, ok := d.(*secretKey)
+		return !ok || (sk.Key != nil && sk.Key.Sign() > 0)
+	}, func(key []byte) {
+		if string(key) == skKey {
+			s.recovery.SecretKeyLost = true
+		} else {
+			s.recovery.LostUserdata = append(s.recovery.LostUserdata, string(key))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.txRemoveUnreadable(tx, attributesBucket, func(_, value []byte) bool {
+		var attrlistlist []*irma.AttributeList
+		if !s.readable(value, &attrlistlist) || len(attrlistlist) == 0 {
+			return false
+		}
+		for _, attrs := range attrlistlist {
+			if attrs == nil || len(attrs.Ints) == 0 || attrs.Ints[0] == nil {
+				return false
+			}
+		}
+		return true
+	}, func([]byte) { s.recovery.LostCredentialEntries++ })
+	if err != nil {
+		return err
+	}
+
+	// Credentials whose signature is removed here are reported by recoverCredentials
+	err = s.txRemoveUnreadable(tx, signaturesBucket, func(_, value []byte) bool {
+		sig := &clSignatureWitness{}
+		return s.readable(value, sig) && sig.CLSignature != nil
+	}, func([]byte) {})
+	if err != nil {
+		return err
+	}
+
+	return s.txRecoverLogs(tx)
+}
+
+// txDecryptable returns whether any stored entry can be decrypted, or true if there are none.
+func (s *storage) txDecryptable(tx *transaction) bool {
+	empty := true
+	for _, name := range []string{userdataBucket, attributesBucket, signaturesBucket, logsBucket} {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			continue
+		}
+		errFound := errors.New("found")
+		err := b.ForEach(func(_, value []byte) error {
+			empty = false
+			if _, err := s.decrypt(value); err == nil {
+				return errFound
+			}
+			return nil
+		})
+		if err == errFound {
+			return true
+		}
+	}
+	return empty
+}
+
+// txRemoveUnreadable quarantines and removes the entries of the bucket that are not readable,
+// calling lost for each of them.
+func (s *storage) txRemoveUnreadable(tx *transaction, bucketName string, readable func(key, value []byte) bool, lost func(key []byte)) error {
+	b := tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return nil
+	}
+	var unreadable [][]byte
+	err := b.ForEach(func(key, value []byte) error {
+		if readable(key, value) {
+			return nil
+		}
+		if err := s.quarantine(bucketName, key, value); err != nil {
+			return err
+		}
+		unreadable = append(unreadable, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range unreadable {
+		if err = b.Delete(key); err != nil {
+			return err
+		}
+		lost(key)
+	}
+	return nil
+}
+
+// txRecoverLogs removes the unreadable log entries. As their stored bytes are corrupted, the log
+// chain remains broken at the first of them, so that VerifyLogIntegrity reports it.
+func (s *storage) txRecoverLogs(tx *transaction) error {
+	b := tx.Bucket([]byte(logsBucket))
+	if b == nil {
+		return nil
+	}
+	var ids []uint64
+	err := b.ForEach(func(key, value []byte) error {
+		if len(key) == 8 && s.readable(value, &LogEntry{}) {
+			s.recovery.SalvagedLogs++
+			return nil
+		}
+		if err := s.quarantine(logsBucket, key, value); err != nil {
+			return err
+		}
+		if len(key) != 8 {
+			return b.Delete(key)
+		}
+		ids = append(ids, logRecord{key: key}.id())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.recovery.LostLogs = len(ids)
+	return s.TxDeleteLogEntries(tx, ids)
+}
+
+// recoverCredentials removes the credentials whose signature is missing or does not verify
+// against their attributes and our secret key, e.g. because it was removed by recoverEntries.
+// Credentials whose public key is unknown are kept, as they may be usable once it is known.
+func (client *Client) recoverCredentials() error {
+	if client.secretKey() == nil {
+		return nil
+	}
+	s := &client.storage
+	changed := map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+	var lost []string
+	for id, attrlistlist := range client.attributes {
+		kept := make([]*irma.AttributeList, 0, len(attrlistlist))
+		for _, attrs := range attrlistlist {
+			if valid, err := client.validCredential(attrs); err != nil {
+				return err
+			} else if valid {
+				kept = append(kept, attrs)
+				continue
+			}
+			s.recovery.LostCredentials = append(s.recovery.LostCredentials, id)
+			lost = append(lost, attrs.Hash())
+		}
+		if len(kept) != len(attrlistlist) {
+			changed[id] = kept
+		}
+		s.recovery.SalvagedCredentials += len(kept)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	err := s.Transaction(func(tx *transaction) error {
+		for _, hash := range lost {
+			if err := s.txQuarantineSignature(tx, hash); err != nil {
+				return err
+			}
+		}
+		for id, attrlistlist := range changed {
+			if err := s.TxStoreAttributes(tx, id, attrlistlist); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, attrlistlist := range changed {
+		if len(attrlistlist) == 0 {
+			delete(client.attributes, id)
+		} else {
+			client.attributes[id] = attrlistlist
+		}
+	}
+	client.lookup = make(map[string]*credLookup)
+	for id, attrlistlist := range client.attributes {
+		for i, attrs := range attrlistlist {
+			client.lookup[attrs.Hash()] = &credLookup{id: id, counter: i}
+		}
+	}
+	return nil
+}
+
+// validCredential returns whether the signature of the credential verifies, or true if its
+// public key is unknown.
+func (client *Client) validCredential(attrs *irma.AttributeList) (bool, error) {
+	if attrs.CredentialType() == nil {
+		return true, nil
+	}
+	pk, err := attrs.PublicKey()
+	if err != nil || pk == nil {
+		return true, nil
+	}
+	sig := &clSignatureWitness{}
+	found, err := client.storage.load(signaturesBucket, attrs.Hash(), sig)
+	if err != nil || !found {
+		return false, nil
+	}
+	return sig.Verify(pk, append([]*big.Int{client.secretKey().Key}, attrs.Ints...)), nil
+}
+
+// txQuarantineSignature quarantines and removes the signature of a credential being removed.
+func (s *storage) txQuarantineSignature(tx *transaction, hash string) error {
+	b := tx.Bucket([]byte(signaturesBucket))
+	if b == nil {
+		return nil
+	}
+	value := b.Get([]byte(hash))
+	if value == nil {
+		return nil
+	}
+	if err := s.quarantine(signaturesBucket, []byte(hash), value); err != nil {
+		return err
+	}
+	return b.Delete([]byte(hash))
+}
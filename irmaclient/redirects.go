@@ -0,0 +1,64 @@
+package irmaclient
+
+import (
+	"net/url"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// RedirectHandler can optionally be implemented by a Handler, to let the user confirm redirects
+// of the IRMA server of the session to another origin (i.e. scheme, host or port) than that of
+// the session URL. The session continues at the new server only if callback is invoked with
+// true; otherwise it fails with irma.ErrorRedirect. Without a RedirectHandler, and in strict mode
+// (see Client.SetStrictRedirects), such redirects are always refused. Redirects within the origin
+// of the session URL are followed without confirmation, and redirects to http never.
+type RedirectHandler interface {
+	ConfirmRedirect(from, to string, callback func(proceed bool))
+}
+
+// SetStrictRedirects sets whether redirects of IRMA servers to another origin are refused
+// without asking a RedirectHandler.
+func (client *Client) SetStrictRedirects(strict bool) {
+	client.transportMutex.Lock()
+	defer client.transportMutex.Unlock()
+	client.strictRedirects = strict
+}
+
+// confirmRedirect is the irma.RedirectFunc of the transport of the session.
+func (session *session) confirmRedirect(from, to *url.URL) bool {
+	session.client.transportMutex.Lock()
+	strict := session.client.strictRedirects
+	session.client.transportMutex.Unlock()
+
+	handler, ok := session.Handler.(RedirectHandler)
+	if strict || !ok {
+		irma.Logger.Warnf("refusing redirect from %s to %s", from, to)
+		return false
+	}
+
+	// Buffered, so that the handler does not block if we stopped waiting
+	proceed := make(chan bool, 1)
+	session.dispatch(func() {
+		handler.ConfirmRedirect(from.String(), to.String(), func(p bool) { proceed <- p })
+	})
+	select {
+	case <-session.ctx.Done():
+		return false
+	case p := <-proceed:
+		return p
+	}
+}
+
+// recordRedirect updates the URL and hostname of the session to those of the server to which
+// the transport was redirected, if it was.
+func (session *session) recordRedirect() {
+	if session.transport.Server == session.ServerURL {
+		return
+	}
+	u, err := url.Parse(session.transport.Server)
+	if err != nil {
+		return
+	}
+	session.ServerURL = session.transport.Server
+	session.Hostname = u.Hostname()
+}
@@ -0,0 +1,201 @@
+package irmaclient
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// KnownRequestor is a verified requestor, i.e. one listed in a requestor scheme, with which the
+// user completed sessions before. The client remembers these so that apps can show the user that
+// they shared attributes with the requestor before.
+type KnownRequestor struct {
+	ID   irma.RequestorIdentifier `json:"id"`
+	Name irma.TranslatedString    `json:"name"`
+	// Hostnames at which the user had sessions with the requestor.
+	Hostnames []string `json:"hostnames"`
+	// Keys contains per hostname the SHA-256 hash of the public key of the TLS certificate that
+	// the server of the requestor presented, see irma.HTTPTransport.PeerKeyFingerprint.
+	Keys      map[string][]byte `json:"keys,omitempty"`
+	FirstSeen time.Time         `json:"firstSeen"`
+	LastSeen  time.Time         `json:"lastSeen"`
+	// Sessions is the amount of sessions that the user completed with the requestor.
+	Sessions int `json:"sessions"`
+}
+
+// RequestorKeyChange describes the server of a known requestor presenting a different key than in
+// previous sessions at the same hostname.
+type RequestorKeyChange struct {
+	Hostname    string `json:"hostname"`
+	PreviousKey []byte `json:"previousKey"`
+	Key         []byte `json:"key"`
+}
+
+// KnownRequestorHandler can optionally be implemented by a Handler, to be informed whether the
+// user had sessions with the requestor of the session before.
+type KnownRequestorHandler interface {
+	// KnownRequestor is called just before the permission request with the requestor of the
+	// session, or with nil if the requestor is unverified or the user never had sessions with it.
+	KnownRequestor(requestor *KnownRequestor)
+	// RequestorKeyChanged is called before KnownRequestor if the server of a known requestor
+	// presents a different key than before at the same hostname. This may mean that someone else
+	// is posing as the requestor, so the app should warn the user prominently. The session
+	// continues only if callback is invoked with true, and is cancelled otherwise; the new key is
+	// remembered once the session completes.
+	RequestorKeyChanged(requestor *KnownRequestor, change *RequestorKeyChange, callback func(proceed bool))
+}
+
+// KnownRequestors returns the requestors with which the user completed sessions before, sorted by
+// identifier, e.g. for including them in a backup; see also ImportKnownRequestors.
+func (client *Client) KnownRequestors() ([]*KnownRequestor, error) {
+	known, err := client.storage.LoadKnownRequestors()
+	if err != nil {
+		return nil, err
+	}
+	requestors := make([]*KnownRequestor, 0, len(known))
+	for _, requestor := range known {
+		requestors = append(requestors, requestor)
+	}
+	sort.Slice(requestors, func(i, j int) bool {
+		return requestors[i].ID.String() < requestors[j].ID.String()
+	})
+	return requestors, nil
+}
+
+// ImportKnownRequestors merges the specified requestors, e.g. from a backup made using
+// KnownRequestors, into the requestors known to the client. Keys already known to the client
+// take precedence over imported ones.
+func (client *Client) ImportKnownRequestors(requestors []*KnownRequestor) error {
+	return client.storage.Transaction(func(tx *transaction) error {
+		known, err := client.storage.TxLoadKnownRequestors(tx)
+		if err != nil {
+			return err
+		}
+		for _, requestor := range requestors {
+			if requestor == nil || requestor.ID.String() == "" {
+				return errors.New("cannot import requestor without identifier")
+			}
+			existing, ok := known[requestor.ID]
+			if !ok {
+				known[requestor.ID] = requestor
+				continue
+			}
+			for _, hostname := range requestor.Hostnames {
+				existing.addHostname(hostname)
+			}
+			for hostname, key := range requestor.Keys {
+				if existing.Keys[hostname] == nil {
+					existing.setKey(hostname, key)
+				}
+			}
+			if requestor.FirstSeen.Before(existing.FirstSeen) {
+				existing.FirstSeen = requestor.FirstSeen
+			}
+			if requestor.LastSeen.After(existing.LastSeen) {
+				existing.LastSeen = requestor.LastSeen
+			}
+			if requestor.Sessions > existing.Sessions {
+				existing.Sessions = requestor.Sessions
+			}
+		}
+		return client.storage.TxStoreKnownRequestors(tx, known)
+	})
+}
+
+func (requestor *KnownRequestor) addHostname(hostname string) {
+	for _, h := range requestor.Hostnames {
+		if h == hostname {
+			return
+		}
+	}
+	requestor.Hostnames = append(requestor.Hostnames, hostname)
+}
+
+func (requestor *KnownRequestor) setKey(hostname string, key []byte) {
+	if requestor.Keys == nil {
+		requestor.Keys = map[string][]byte{}
+	}
+	requestor.Keys[hostname] = key
+}
+
+// verifiedRequestor returns whether the requestor of the session is listed in a requestor scheme,
+// in which case it is remembered as a KnownRequestor.
+func (session *session) verifiedRequestor() bool {
+	return session.IsInteractive() && session.RequestorInfo != nil && !session.RequestorInfo.Unverified &&
+		session.RequestorInfo.ID.String() != ""
+}
+
+// checkKnownRequestor looks up the requestor of the session among the known requestors, asking
+// the user for confirmation if its server presents a different key than before, and then
+// continues the session with next.
+func (session *session) checkKnownRequestor(next func()) {
+	if !session.verifiedRequestor() {
+		next()
+		return
+	}
+	known, err := session.client.storage.LoadKnownRequestors()
+	if err != nil {
+		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to load known requestors", 0).ErrorStack())
+		next()
+		return
+	}
+	session.knownRequestor = known[session.RequestorInfo.ID]
+	if session.knownRequestor == nil {
+		next()
+		return
+	}
+
+	previous, key := session.knownRequestor.Keys[session.Hostname], session.transport.PeerKeyFingerprint()
+	if previous == nil || key == nil || bytes.Equal(previous, key) {
+		next()
+		return
+	}
+	change := &RequestorKeyChange{Hostname: session.Hostname, PreviousKey: previous, Key: key}
+	handler, ok := session.Handler.(KnownRequestorHandler)
+	if !ok {
+		irma.Logger.Warnf("server of known requestor %s at %s presents a different key than before",
+			session.RequestorInfo.ID, session.Hostname)
+		next()
+		return
+	}
+	requestor := session.knownRequestor
+	session.dispatch(func() {
+		handler.RequestorKeyChanged(requestor, change, func(proceed bool) {
+			if !proceed {
+				session.cancel()
+				return
+			}
+			next()
+		})
+	})
+}
+
+// recordRequestor remembers the requestor of the successfully completed session as a KnownRequestor.
+func (session *session) recordRequestor() error {
+	if !session.verifiedRequestor() {
+		return nil
+	}
+	return session.client.storage.Transaction(func(tx *transaction) error {
+		known, err := session.client.storage.TxLoadKnownRequestors(tx)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		requestor := known[session.RequestorInfo.ID]
+		if requestor == nil {
+			requestor = &KnownRequestor{ID: session.RequestorInfo.ID, FirstSeen: now}
+			known[requestor.ID] = requestor
+		}
+		requestor.Name = session.RequestorInfo.Name
+		requestor.addHostname(session.Hostname)
+		if key := session.transport.PeerKeyFingerprint(); key != nil {
+			requestor.setKey(session.Hostname, key)
+		}
+		requestor.LastSeen = now
+		requestor.Sessions++
+		return session.client.storage.TxStoreKnownRequestors(tx, known)
+	})
+}
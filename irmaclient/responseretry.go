@@ -0,0 +1,64 @@
+package irmaclient
+
+import (
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// When the connection drops after the user consented to a session and the response was computed,
+// e.g. in a train tunnel, the response is posted again with backoff for a limited time, so that
+// the consent of the user is not wasted. The response is only kept in memory. Only failures to
+// reach the server are retried; errors reported by the server are not.
+
+var (
+	// responseRetryWindow is the time after the first attempt to post the response during which
+	// it is retried.
+	responseRetryWindow = 60 * time.Second
+
+	// responseRetryBackoff contains the time to wait before each retry, the last of which is
+	// repeated.
+	responseRetryBackoff = []time.Duration{time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second}
+)
+
+// postResponse posts the response of the session to the specified endpoint of the server,
+// retrying for responseRetryWindow if the server cannot be reached. While waiting to retry, the
+// session has status irma.ClientStatusRetrying. If the session is dismissed meanwhile, the last
+// error is returned.
+func (session *session) postResponse(path string, serverResponse, response interface{}) error {
+	deadline := time.Now().Add(responseRetryWindow)
+	for attempt := 0; ; attempt++ {
+		err := session.transport.Post(path, serverResponse, response)
+		if err == nil || !retryableResponseError(err) {
+			if err == nil && attempt > 0 {
+				irma.Logger.Infof("posted response after %d retries", attempt)
+			}
+			return err
+		}
+
+		wait := responseRetryBackoff[len(responseRetryBackoff)-1]
+		if attempt < len(responseRetryBackoff) {
+			wait = responseRetryBackoff[attempt]
+		}
+		if time.Now().Add(wait).After(deadline) ||
+			(!session.expires.IsZero() && time.Now().Add(wait).After(session.expires)) {
+			return err
+		}
+
+		irma.Logger.Warnf("failed to post response, retrying in %s: %s", wait, err)
+		session.setStatus(irma.ClientStatusRetrying)
+		select {
+		case <-session.ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		session.setStatus(irma.ClientStatusCommunicating)
+	}
+}
+
+// retryableResponseError returns whether the error means that the server was not reached, or did
+// not respond, so that posting the response may succeed later.
+func retryableResponseError(err error) bool {
+	serr, ok := err.(*irma.SessionError)
+	return ok && serr.ErrorType == irma.ErrorTransport && serr.RemoteError == nil
+}
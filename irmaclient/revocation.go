@@ -24,11 +24,11 @@ func (client *Client) initRevocation() {
 			}
 			id := id // make copy of same name to capture the value for closure below
 			i := i   // see https://golang.org/doc/faq#closures_and_goroutines
-			client.jobs <- func() {
+			client.addJob(func() {
 				if err := client.nonrevPrepareCache(id, i); err != nil {
 					client.reportError(err)
 				}
-			}
+			})
 		}
 	}
 
@@ -41,7 +41,8 @@ func (client *Client) initRevocation() {
 	// increases over time since the last update.
 	// We set the task from starting one second from now to avoid it from running simultaneously
 	// with the job above, because there is no sense in running these simultaneously.
-	_, err := client.Configuration.Scheduler.
+	var err error
+	client.nonrevUpdateJob, err = client.Configuration.Scheduler.
 		Every(irma.RevocationParameters.ClientUpdateInterval).Seconds().
 		StartAt(time.Now().Add(time.Second)).Do(func() {
 		for id, attrsets := range client.attributes {
@@ -73,12 +74,12 @@ func (client *Client) initRevocation() {
 						"hash":        attrs.Hash(),
 					}).Debug("scheduling nonrevocation witness remote update")
 					id := id // copy for closure below (https://golang.org/doc/faq#closures_and_goroutines)
-					client.jobs <- func() {
+					client.addJob(func() {
 						if err = client.NonrevUpdateFromServer(id); err != nil {
 							client.reportError(err)
 							return
 						}
-					}
+					})
 				}
 			}
 		}
@@ -237,9 +238,29 @@ func (client *Client) nonrevPrepareCache(id irma.CredentialTypeIdentifier, index
 	if err != nil {
 		return err
 	}
+	if cred == nil { // removed in the meantime
+		return nil
+	}
 	return cred.NonrevPrepareCache()
 }
 
+// nonrevUpdateAll updates the nonrevocation witnesses of all credentials that have one from the
+// issuers' revocation servers, in background jobs. We do this opportunistically when updating
+// schemes: the user is online anyway, and fresh witnesses speed up later sessions.
+func (client *Client) nonrevUpdateAll() {
+	for id, attrsets := range client.attributes {
+		if len(attrsets) == 0 || attrsets[0].CredentialType() == nil || !attrsets[0].CredentialType().RevocationSupported() {
+			continue
+		}
+		id := id // copy for closure below (https://golang.org/doc/faq#closures_and_goroutines)
+		client.addJob(func() {
+			if err := client.NonrevUpdateFromServer(id); err != nil {
+				client.reportError(err)
+			}
+		})
+	}
+}
+
 // nonrevRepopulateCaches repopulates the consumed nonrevocation caches of the credentials involved
 // in the request, in background jobs, after the request has finished.
 func (client *Client) nonrevRepopulateCaches(request irma.SessionRequest) {
@@ -251,11 +272,11 @@ func (client *Client) nonrevRepopulateCaches(request irma.SessionRequest) {
 		for i := range client.attrs(id) {
 			id := id
 			i := i
-			client.jobs <- func() {
+			client.addJob(func() {
 				if err := client.nonrevPrepareCache(id, i); err != nil {
 					client.reportError(err)
 				}
-			}
+			})
 		}
 	}
 }
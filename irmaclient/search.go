@@ -0,0 +1,116 @@
+package irmaclient
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// AttributeMatch is a result of SearchAttributes: an attribute whose value or name
+// contains the search query.
+type AttributeMatch struct {
+	CredentialHash string
+	Attribute      irma.AttributeTypeIdentifier
+	Value          string // attribute value, translated in the requested language
+	Name           string // attribute name, translated in the requested language
+
+	// InName indicates that the query matched the attribute name instead of its value.
+	// Start and End are the byte offsets of the match in Value, or in Name if InName is set.
+	InName     bool
+	Start, End int
+}
+
+// SearchAttributes returns the attributes of all credentials whose value or name (in the
+// specified language) contains the query, case-insensitively. If both the value and the name
+// match, the match in the value is returned. Only the attributes kept in memory are searched;
+// the credentials themselves are not loaded from storage.
+func (client *Client) SearchAttributes(query string, lang string) []AttributeMatch {
+	if query == "" {
+		return nil
+	}
+
+	var matches []AttributeMatch
+	for credid, attrlistlist := range client.attributes {
+		credtype := client.Configuration.CredentialTypes[credid]
+		if credtype == nil {
+			continue
+		}
+		for _, attrs := range attrlistlist {
+			values := attrs.Map()
+			for _, attrtype := range credtype.AttributeTypes {
+				if attrtype.RevocationAttribute {
+					continue
+				}
+				id := attrtype.GetAttributeTypeIdentifier()
+				value := values[id]
+				if value == nil { // optional attribute without value
+					continue
+				}
+				match := AttributeMatch{
+					CredentialHash: attrs.Hash(),
+					Attribute:      id,
+					Value:          value.Translation(lang),
+					Name:           attrtype.Name.Translation(lang),
+				}
+				if match.Start, match.End = indexFold(match.Value, query); match.Start >= 0 {
+					matches = append(matches, match)
+				} else if match.Start, match.End = indexFold(match.Name, query); match.Start >= 0 {
+					match.InName = true
+					matches = append(matches, match)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Attribute != matches[j].Attribute {
+			return matches[i].Attribute.String() < matches[j].Attribute.String()
+		}
+		return matches[i].CredentialHash < matches[j].CredentialHash
+	})
+	return matches
+}
+
+// indexFold returns the byte offsets of the first occurrence of substr in s under Unicode
+// simple case folding (as in strings.EqualFold), or -1, -1 if there is none.
+func indexFold(s, substr string) (int, int) {
+	for start := 0; start < len(s); {
+		if end := prefixFold(s[start:], substr); end >= 0 {
+			return start, start + end
+		}
+		_, size := utf8.DecodeRuneInString(s[start:])
+		start += size
+	}
+	return -1, -1
+}
+
+// prefixFold returns the length in bytes of the prefix of s that equals prefix under
+// simple case folding, or -1 if s does not start with prefix.
+func prefixFold(s, prefix string) int {
+	i := 0
+	for _, p := range prefix {
+		if i >= len(s) {
+			return -1
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !equalFold(r, p) {
+			return -1
+		}
+		i += size
+	}
+	return i
+}
+
+func equalFold(r, s rune) bool {
+	if r == s {
+		return true
+	}
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago/internal/concmap"
+)
+
+// SecretKeyStore holds the secret key of the user, i.e. the zeroth attribute of all credentials.
+// By default the client keeps the secret key in its storage; using SetSecretKeyStore, platform
+// wrappers can keep it elsewhere, for example in a blob wrapped by the Android Keystore or the
+// iOS Secure Enclave.
+type SecretKeyStore interface {
+	// Exists returns whether the store contains a secret key.
+	Exists() (bool, error)
+	// Generate generates and stores a new secret key, replacing the existing one if any.
+	Generate() error
+	// GetSecretAttribute returns the secret key, for building proofs and credentials.
+	GetSecretAttribute() (*big.Int, error)
+}
+
+// TransientSecretKeyStore is implemented by SecretKeyStores that release the secret key only
+// transiently. If Transient returns true, the client fetches the secret key from the store
+// each time it builds proofs, and drops it afterwards instead of keeping it in memory.
+type TransientSecretKeyStore interface {
+	SecretKeyStore
+	Transient() bool
+}
+
+// ExportableSecretKeyStore is implemented by SecretKeyStores whose secret key may leave the
+// store, see ExportSecretKey. Stores not implementing this interface are not exportable.
+type ExportableSecretKeyStore interface {
+	SecretKeyStore
+	Exportable() bool
+}
+
+// ErrSecretKeyNotExportable is returned by ExportSecretKey if the SecretKeyStore of the client
+// does not allow its secret key to be exported.
+var ErrSecretKeyNotExportable = errors.New("secret key is not exportable")
+
+// storageSecretKeyStore is the default SecretKeyStore, keeping the secret key in the storage
+// of the client.
+type storageSecretKeyStore struct {
+	storage *storage
+}
+
+func (s storageSecretKeyStore) Exists() (bool, error) {
+	return s.storage.load(userdataBucket, skKey, &secretKey{})
+}
+
+func (s storageSecretKeyStore) Generate() error {
+	sk, err := generateSecretKey()
+	if err != nil {
+		return err
+	}
+	return s.storage.StoreSecretKey(sk)
+}
+
+func (s storageSecretKeyStore) GetSecretAttribute() (*big.Int, error) {
+	sk := &secretKey{}
+	found, err := s.storage.load(userdataBucket, skKey, sk)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("secret key not found")
+	}
+	return sk.Key, nil
+}
+
+func (s storageSecretKeyStore) Exportable() bool {
+	return true
+}
+
+// SetSecretKeyStore makes the client use the specified SecretKeyStore for the secret key of
+// the user, instead of its storage. It should be called directly after New, before any session
+// is started. If the store is empty, a new secret key is generated in it, unless the client
+// already has credentials which would then become unusable: in that case an error is returned,
+// and the secret key of the client must first be moved to the store, see ExportSecretKey.
+func (client *Client) SetSecretKeyStore(store SecretKeyStore) error {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	exists, err := store.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists && len(client.lookup) > 0 {
+		return errors.New("secret key store is empty while the client has credentials")
+	}
+
+	client.secretKeyStore = store
+	client.setSecretKey(nil)
+	client.credentialsCache = concmap.New[credLookup, *credential]()
+	return client.loadSecretKey()
+}
+
+// ExportSecretKey returns the secret key of the user, e.g. for including it in a backup, or for
+// moving it to another SecretKeyStore. It returns ErrSecretKeyNotExportable if the SecretKeyStore
+// of the client does not allow this.
+func (client *Client) ExportSecretKey() (*big.Int, error) {
+	if !client.SecretKeyExportable() {
+		return nil, ErrSecretKeyNotExportable
+	}
+	return client.keyStore().GetSecretAttribute()
+}
+
+// SecretKeyExportable returns whether the SecretKeyStore of the client allows its secret key to
+// be exported, see ExportSecretKey.
+func (client *Client) SecretKeyExportable() bool {
+	store, ok := client.keyStore().(ExportableSecretKeyStore)
+	return ok && store.Exportable()
+}
+
+// keyStore returns the SecretKeyStore of the client.
+func (client *Client) keyStore() SecretKeyStore {
+	if client.secretKeyStore != nil {
+		return client.secretKeyStore
+	}
+	return storageSecretKeyStore{storage: &client.storage}
+}
+
+// transientSecretKey returns whether the SecretKeyStore of the client releases the secret key
+// only transiently, in which case client.secretkey is only set while holding it, see holdSecretKey.
+func (client *Client) transientSecretKey() bool {
+	store, ok := client.keyStore().(TransientSecretKeyStore)
+	return ok && store.Transient()
+}
+
+// loadSecretKey loads the secret key from the SecretKeyStore into memory, first generating it
+// if the store is empty. For transient stores it only ensures that the store has a secret key.
+func (client *Client) loadSecretKey() error {
+	store := client.keyStore()
+	exists, err := store.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err = store.Generate(); err != nil {
+			return err
+		}
+	}
+	if client.transientSecretKey() {
+		return nil
+	}
+	sk, err := store.GetSecretAttribute()
+	if err != nil {
+		return err
+	}
+	client.setSecretKey(&secretKey{Key: sk})
+	return nil
+}
+
+// secretKey returns the secret key if it is in memory, and nil if the client is locked or a
+// transient SecretKeyStore is not being held.
+func (client *Client) secretKey() *secretKey {
+	client.secretKeyMutex.Lock()
+	defer client.secretKeyMutex.Unlock()
+	return client.secretkey
+}
+
+func (client *Client) setSecretKey(sk *secretKey) {
+	client.secretKeyMutex.Lock()
+	defer client.secretKeyMutex.Unlock()
+	client.secretkey = sk
+}
+
+// holdSecretKey ensures that client.secretkey is set for an operation requiring it, returning a
+// function that must be called when the operation is done. For transient SecretKeyStores, the
+// secret key is fetched from the store and dropped when the last holder is done; proof builders
+// created in the meantime retain the key until they are discarded.
+func (client *Client) holdSecretKey() (func(), error) {
+	if !client.transientSecretKey() {
+		if client.Locked() {
+			return nil, ErrLocked
+		}
+		return func() {}, nil
+	}
+
+	client.secretKeyMutex.Lock()
+	defer client.secretKeyMutex.Unlock()
+	if client.secretKeyHolds == 0 {
+		sk, err := client.keyStore().GetSecretAttribute()
+		if err != nil {
+			return nil, err
+		}
+		client.secretkey = &secretKey{Key: sk}
+	}
+	client.secretKeyHolds++
+
+	return func() {
+		client.secretKeyMutex.Lock()
+		defer client.secretKeyMutex.Unlock()
+		client.secretKeyHolds--
+		if client.secretKeyHolds == 0 {
+			client.secretkey = nil
+			client.credentialsCache = concmap.New[credLookup, *credential]()
+		}
+	}, nil
+}
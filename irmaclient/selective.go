@@ -0,0 +1,80 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the logic for declining some of the credentials of an issuance session.
+// The IRMA protocol has no way to tell the issuer which credentials the user wants, so the
+// session is performed for all credentials as usual, after which the declined ones are not stored.
+
+func containsIndex(indices []int, index int) bool {
+	for _, i := range indices {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// declineCredentials processes the credentials declined in the user's choice in an issuance
+// session. It returns false if the user declined all credentials.
+func (session *session) declineCredentials() (bool, error) {
+	if session.choice == nil || len(session.choice.DeclinedCredentials) == 0 {
+		return true, nil
+	}
+	request := session.request.(*irma.IssuanceRequest)
+	for _, i := range session.choice.DeclinedCredentials {
+		if i >= len(request.Credentials) {
+			return false, errors.Errorf("declined credential %d does not exist", i)
+		}
+	}
+	accepted := len(request.Credentials)
+	for i := range request.Credentials {
+		if containsIndex(session.choice.DeclinedCredentials, i) {
+			accepted--
+			session.declined = append(session.declined, request.Credentials[i].CredentialTypeID)
+		}
+	}
+	if accepted == 0 {
+		return false, nil
+	}
+
+	for _, change := range request.CredentialChanges {
+		change.Declined = containsIndex(session.choice.DeclinedCredentials, change.Credential)
+	}
+	return true, nil
+}
+
+// warnDeclined marks the disjunctions of an unsatisfiable request that ask for credentials that
+// the user declined earlier in the chain of sessions, in which the requestor most likely
+// expected the user to accept them.
+func (session *session) warnDeclined(unsatisfiable *UnsatisfiableRequest) {
+	if unsatisfiable == nil || len(session.declined) == 0 {
+		return
+	}
+	discons := session.request.Disclosure().Disclose
+	for _, unsatisfied := range unsatisfiable.Unsatisfied {
+		for _, con := range discons[unsatisfied.Index] {
+			for _, credtype := range con.CredentialTypes() {
+				if !session.declinedType(credtype) {
+					continue
+				}
+				irma.Logger.Warnf("session requests %s, which the user declined earlier in the session chain", credtype)
+				unsatisfied.Reason = UnsatisfiedDeclined
+				unsatisfied.CredentialType = credtype
+				unsatisfied.Nearest = nil
+			}
+		}
+	}
+}
+
+func (session *session) declinedType(credtype irma.CredentialTypeIdentifier) bool {
+	for _, declined := range session.declined {
+		if declined == credtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package irmaclient
+
+import (
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// SensitiveDisclosureHandler can optionally be implemented by a Handler, to let the user confirm
+// a second time that sensitive attributes (see Client.SetAttributeSensitivity) are to be
+// disclosed. After the user granted permission for a session in which such attributes were
+// chosen, ConfirmSensitiveDisclosure is called with them, including their values, before any
+// proofs are built. The session continues only if callback is invoked with true; otherwise it is
+// cancelled. If the Handler does not implement it, such sessions fail with
+// irma.ErrorSensitiveDisclosureUnconfirmed before anything is disclosed.
+type SensitiveDisclosureHandler interface {
+	ConfirmSensitiveDisclosure(attributes []*DisclosureCandidate, callback func(proceed bool))
+}
+
+// SetAttributeSensitivity sets the sensitivity of the specified attribute types, overriding the
+// sensitivity that their scheme assigns to them (see irma.AttributeType.Sensitivity). Attribute
+// types mapped to irma.AttributeSensitivityNone are not sensitive. A nil map removes all overrides.
+func (client *Client) SetAttributeSensitivity(overrides map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity) {
+	client.policyMutex.Lock()
+	defer client.policyMutex.Unlock()
+	client.sensitivity = make(map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity, len(overrides))
+	for id, sensitivity := range overrides {
+		client.sensitivity[id] = sensitivity
+	}
+}
+
+// AttributeSensitivity returns the sensitivity of the specified attribute type, as set by
+// SetAttributeSensitivity or otherwise by its scheme.
+func (client *Client) AttributeSensitivity(id irma.AttributeTypeIdentifier) irma.AttributeSensitivity {
+	client.policyMutex.Lock()
+	sensitivity, ok := client.sensitivity[id]
+	client.policyMutex.Unlock()
+	if ok {
+		return sensitivity
+	}
+	if attr := client.Configuration.AttributeTypes[id]; attr != nil {
+		return attr.Sensitivity
+	}
+	return irma.AttributeSensitivityNone
+}
+
+// sensitiveDisclosures returns the sensitive attributes of the choice, along with their values,
+// and records their sensitivity for the log entry of the session.
+func (session *session) sensitiveDisclosures(choice *irma.DisclosureChoice) []*DisclosureCandidate {
+	session.sensitivity = nil
+	if choice == nil {
+		return nil
+	}
+
+	var sensitive []*DisclosureCandidate
+	session.client.credMutex.Lock()
+	defer session.client.credMutex.Unlock()
+	for _, attrs := range choice.Attributes {
+		for _, attr := range attrs {
+			sensitivity := session.client.AttributeSensitivity(attr.Type)
+			if !sensitivity.Sensitive() {
+				continue
+			}
+			if session.sensitivity == nil {
+				session.sensitivity = map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity{}
+			}
+			session.sensitivity[attr.Type] = sensitivity
+
+			candidate := &DisclosureCandidate{AttributeIdentifier: attr, Sensitivity: sensitivity}
+			if list, _ := session.client.attributesByHash(attr.CredentialHash); list != nil {
+				candidate.Value = irma.NewTranslatedString(list.UntranslatedAttribute(attr.Type))
+				candidate.Nickname = session.client.nicknames[attr.CredentialHash]
+			}
+			sensitive = append(sensitive, candidate)
+		}
+	}
+	return sensitive
+}
+
+// confirmSensitiveDisclosure asks the SensitiveDisclosureHandler of the session to confirm the
+// disclosure of the sensitive attributes of the choice, after which doSession is continued, or
+// fails the session if there is no SensitiveDisclosureHandler. It returns false if the choice
+// contains no sensitive attributes, in which case the session is continued without confirmation.
+func (session *session) confirmSensitiveDisclosure(choice *irma.DisclosureChoice) bool {
+	sensitive := session.sensitiveDisclosures(choice)
+	if len(sensitive) == 0 {
+		return false
+	}
+	handler, ok := session.Handler.(SensitiveDisclosureHandler)
+	if !ok {
+		session.fail(&irma.SessionError{
+			ErrorType: irma.ErrorSensitiveDisclosureUnconfirmed,
+			Info:      sensitive[0].Type.String(),
+			Err:       errors.Errorf("handler cannot confirm the disclosure of sensitive attribute %s", sensitive[0].Type),
+		})
+		return true
+	}
+
+	session.dispatch(func() {
+		handler.ConfirmSensitiveDisclosure(sensitive, func(proceed bool) {
+			session.sensitiveConfirmed = proceed
+			session.doSession(proceed, choice)
+		})
+	})
+	return true
+}
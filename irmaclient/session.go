@@ -1,11 +1,15 @@
 package irmaclient
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwesterb/go-atum"
@@ -24,19 +28,39 @@ import (
 // and specifying the attributes to be disclosed.
 type PermissionHandler func(proceed bool, choice *irma.DisclosureChoice)
 
-// PinHandler is used to provide the user's PIN code.
-type PinHandler func(proceed bool, pin string)
+// PinMetadata describes the PIN asked for by Handler.RequestPin.
+type PinMetadata struct {
+	// RemainingAttempts is the amount of PIN attempts left before the user is blocked,
+	// or -1 if unknown because no incorrect PIN has been entered yet
+	RemainingAttempts int `json:"remainingAttempts"`
+	// MinLength and MaxLength bound the length of the PIN, as configured in the schemes of the
+	// keyshare servers involved. MaxLength is 0 if there is no maximum.
+	MinLength int `json:"minLength"`
+	MaxLength int `json:"maxLength"`
+	// Retry is true if the PIN is asked for again after an incorrect PIN
+	Retry bool `json:"retry"`
+}
 
 // A Handler contains callbacks for communication to the user.
 type Handler interface {
 	StatusUpdate(action irma.Action, status irma.ClientStatus)
 	ClientReturnURLSet(clientReturnURL string)
+	// PairingRequired is called with the code that the user must enter in the frontend before the
+	// server releases the session request, while the session has status irma.ClientStatusPairing.
+	// Dismissing the session meanwhile cancels it at the server.
 	PairingRequired(pairingCode string)
+	// Success receives the disclosure or signature in JSON, or for issuance sessions the
+	// CredentialChanges of the issuance request in JSON
 	Success(result string)
 	Cancelled()
+	// Failure receives the error of the session, for which SessionError.UserMessage returns a
+	// message that can be shown to the user
 	Failure(err *irma.SessionError)
 
 	KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int)
+	// KeysharePinBackoff is called when too many incorrect PINs were entered recently, in which case
+	// RequestPin is called again only after the specified amount of seconds
+	KeysharePinBackoff(manager irma.SchemeManagerIdentifier, duration int)
 	KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier)
 	KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier)
 	KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier)
@@ -59,12 +83,46 @@ type Handler interface {
 	RequestSchemeManagerPermission(manager *irma.SchemeManager,
 		callback func(proceed bool))
 
-	RequestPin(remainingAttempts int, callback PinHandler)
+	// RequestPin asks the user for the PIN of the keyshare servers involved in the session. Either
+	// proceed must be called with the PIN, or cancel if the user aborts the PIN entry, which
+	// cancels the session. Only the first invocation of either has effect.
+	RequestPin(metadata PinMetadata, proceed func(pin string), cancel func())
+
+	// Unsatisfiable is called just before requesting permission for a session that the user cannot
+	// satisfy, with details on the missing attributes and the nearest credentials the user does have.
+	Unsatisfiable(request *UnsatisfiableRequest)
+
+	// RequestUnlock is called when a session requires the secret key while the client is locked.
+	// The callback should be invoked with true after Client.Unlock() has been called successfully,
+	// or with false to cancel the session.
+	RequestUnlock(callback func(proceed bool))
+}
+
+// SignatureMessageHandler can optionally be implemented by a Handler, to receive the analysis of
+// the message of a signature session just before RequestSignaturePermission is called, so that
+// the app can show the sanitized message and warn the user about its anomalies. The signature
+// is computed over the raw message.
+type SignatureMessageHandler interface {
+	SignatureMessage(message *irma.MessageAnalysis)
+}
+
+// PartialIssuanceHandler can optionally be implemented by a Handler, to be informed when the
+// issuer did not issue some of the credentials of an issuance session while the others were
+// stored. PartialSuccess is then called instead of Success, with the same result and the
+// changes of the credentials that were not issued, whose Error contains the reason of the issuer.
+// Handlers that do not implement it receive Success, whose result contains the same errors.
+type PartialIssuanceHandler interface {
+	PartialSuccess(result string, failed []*irma.CredentialChange)
 }
 
-// SessionDismisser can dismiss the current IRMA session.
+// SessionDismisser can dismiss the current IRMA session, and query its status.
 type SessionDismisser interface {
 	Dismiss()
+	Status() irma.ClientStatus
+	// Summary returns the summary of the session request, or nil if it has not yet been received.
+	Summary() *SessionSummary
+	// Timings returns when the session reached each of its phases so far.
+	Timings() PhaseTimings
 }
 
 type session struct {
@@ -79,22 +137,47 @@ type session struct {
 	client         *Client
 	request        irma.SessionRequest
 	done           <-chan struct{}
+	ctx            context.Context // cancelled by finish, aborting the keyshare protocol
+	cancelCtx      context.CancelFunc
 	prepRevocation chan error // used when nonrevocation preprocessing is done
+	disjunctions   []int      // per disjunction of request, its index in the canonical request shown to the user
 
-	next               *session
+	next               *session // protected by statusMutex
 	implicitDisclosure [][]*irma.AttributeIdentifier
+	declined           []irma.CredentialTypeIdentifier // credential types declined earlier in the chain
 
 	// State for issuance sessions
 	issuerProofNonce *big.Int
 	builders         gabi.ProofBuilderList
+	issueErrors      map[int]*irma.RemoteError // per credential that the issuer did not issue, its reason
 
 	// State for signature sessions
 	timestamp *atum.Timestamp
 
+	hello *irma.ClientHello // sent to the server before the request, if the server requires it
+	// Keypair against which the issuer may encrypt attribute values, whose public key is sent in the hello
+	encryptionKey, decryptionKey *[irma.SessionKeyLength]byte
+	expires                      time.Time // when the session expires at the server, zero if unknown
+
+	knownRequestor *KnownRequestor // set if the user completed sessions with the requestor before
+
+	// Sensitivity of the chosen sensitive attributes, and whether the user confirmed their disclosure
+	sensitivity        map[irma.AttributeTypeIdentifier]irma.AttributeSensitivity
+	sensitiveConfirmed bool
+
+	statusMutex sync.Mutex
+	status      irma.ClientStatus
+	summary     *SessionSummary // protected by statusMutex
+	timings     PhaseTimings    // protected by statusMutex
+
+	sessionOptions
+
 	// These are empty on manual sessions
 	Hostname  string
 	ServerURL string
 	transport *irma.HTTPTransport
+
+	capture *irma.TranscriptRecorder // records the exchanges of the session, see SetDiagnosticCapture
 }
 
 type sessions struct {
@@ -105,15 +188,13 @@ type sessions struct {
 // We implement the handler for the keyshare protocol
 var _ keyshareSessionHandler = (*session)(nil)
 
-// Supported protocol versions. Minor version numbers should be sorted.
-var supportedVersions = map[int][]int{
-	2: {
-		4, // old protocol with legacy session requests
-		5, // introduces condiscon feature
-		6, // introduces nonrevocation proofs
-		7, // introduces chained sessions
-		8, // introduces session binding
-	},
+// Supported protocol versions, sorted from low to high.
+var supportedVersions = []*irma.ProtocolVersion{
+	irma.NewVersion(2, 4), // old protocol with legacy session requests
+	irma.NewVersion(2, 5), // introduces condiscon feature
+	irma.NewVersion(2, 6), // introduces nonrevocation proofs
+	irma.NewVersion(2, 7), // introduces chained sessions
+	irma.NewVersion(2, 8), // introduces session binding
 }
 
 // Session constructors
@@ -121,46 +202,59 @@ var supportedVersions = map[int][]int{
 // NewSession starts a new IRMA session, given (along with a handler to pass feedback to) a session request.
 // When the request is not suitable to start an IRMA session from, it calls the Failure method of the specified Handler.
 func (client *Client) NewSession(sessionrequest string, handler Handler) SessionDismisser {
+	return client.newSession(sessionrequest, handler, sessionOptions{})
+}
+
+func (client *Client) newSession(sessionrequest string, handler Handler, opts sessionOptions) SessionDismisser {
+	if client.Closed() {
+		opts.fail(handler, &irma.SessionError{ErrorType: irma.ErrorClosed, Err: ErrClosed})
+		return nil
+	}
 	bts := []byte(sessionrequest)
 
 	qr := &irma.Qr{}
 	if err := json.Unmarshal(bts, qr); err == nil && qr.IsQr() {
 		if err = qr.Validate(); err != nil {
-			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+			opts.fail(handler, &irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return nil
 		}
-		return client.newQrSession(qr, handler)
+		return client.newQrSession(qr, handler, opts)
 	}
 
 	sigRequest := &irma.SignatureRequest{}
 	if err := json.Unmarshal(bts, sigRequest); err == nil && sigRequest.IsSignatureRequest() {
 		if err = sigRequest.Validate(); err != nil {
-			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+			opts.fail(handler, &irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return nil
 		}
-		return client.newManualSession(sigRequest, handler, irma.ActionSigning)
+		return client.newManualSession(sigRequest, handler, irma.ActionSigning, opts)
 	}
 
 	disclosureRequest := &irma.DisclosureRequest{}
 	if err := json.Unmarshal(bts, disclosureRequest); err == nil && disclosureRequest.IsDisclosureRequest() {
 		if err = disclosureRequest.Validate(); err != nil {
-			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+			opts.fail(handler, &irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return nil
 		}
-		return client.newManualSession(disclosureRequest, handler, irma.ActionDisclosing)
+		return client.newManualSession(disclosureRequest, handler, irma.ActionDisclosing, opts)
 	}
 
-	handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Info: "session request of unsupported type"})
+	opts.fail(handler, &irma.SessionError{
+		ErrorType: irma.ErrorInvalidRequest,
+		Info:      "session request of unsupported type",
+		Err:       errors.New("session request is neither a QR nor a signature or disclosure request"),
+	})
 	return nil
 }
 
 // newManualSession starts a manual session, given a signature request in JSON and a handler to pass messages to
-func (client *Client) newManualSession(request irma.SessionRequest, handler Handler, action irma.Action) SessionDismisser {
+func (client *Client) newManualSession(request irma.SessionRequest, handler Handler, action irma.Action, opts sessionOptions) SessionDismisser {
 	client.PauseJobs()
 
 	doneChannel := make(chan struct{}, 1)
 	doneChannel <- struct{}{}
 	close(doneChannel)
+	ctx, cancelCtx := context.WithCancel(context.Background())
 	session := &session{
 		Action:         action,
 		Handler:        handler,
@@ -168,29 +262,34 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 		Version:        client.minVersion,
 		request:        request,
 		done:           doneChannel,
+		ctx:            ctx,
+		cancelCtx:      cancelCtx,
 		prepRevocation: make(chan error),
+		status:         irma.ClientStatusCreated,
+		timings:        PhaseTimings{Started: time.Now()},
+		sessionOptions: opts,
 	}
 	client.sessions.add(session)
-	session.Handler.StatusUpdate(session.Action, irma.ClientStatusManualStarted)
+	session.setStatus(irma.ClientStatusManualStarted)
 
 	session.processSessionInfo()
 	return session
 }
 
 // newQrSession creates and starts a new interactive IRMA session
-func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
+func (client *Client) newQrSession(qr *irma.Qr, handler Handler, opts sessionOptions) *session {
 	if qr.Type == irma.ActionRedirect {
 		newqr := &irma.Qr{}
-		transport := irma.NewHTTPTransport("", !client.Preferences.DeveloperMode)
+		transport := client.newSessionTransport("")
 		if err := transport.Post(qr.URL, newqr, struct{}{}); err != nil {
-			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport, Err: errors.Wrap(err, 0)})
+			opts.fail(handler, &irma.SessionError{ErrorType: irma.ErrorTransport, Err: errors.Wrap(err, 0)})
 			return nil
 		}
 		if newqr.Type == irma.ActionRedirect { // explicitly avoid infinite recursion
-			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: errors.New("infinite static QR recursion")})
+			opts.fail(handler, &irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: errors.New("infinite static QR recursion")})
 			return nil
 		}
-		return client.newQrSession(newqr, handler)
+		return client.newQrSession(newqr, handler, opts)
 	}
 
 	client.PauseJobs()
@@ -199,20 +298,28 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 	doneChannel := make(chan struct{}, 1)
 	doneChannel <- struct{}{}
 	close(doneChannel)
+	ctx, cancelCtx := context.WithCancel(context.Background())
 	session := &session{
 		ServerURL:      qr.URL,
 		Hostname:       u.Hostname(),
-		RequestorInfo:  requestorInfo(qr.URL, client.Configuration),
-		transport:      irma.NewHTTPTransport(qr.URL, !client.Preferences.DeveloperMode),
+		RequestorInfo:  requestorInfo(qr.URL, client.Configuration, client.Preferences.DeveloperMode),
+		transport:      client.newSessionTransport(qr.URL),
 		Action:         qr.Type,
 		Handler:        handler,
 		client:         client,
 		done:           doneChannel,
+		ctx:            ctx,
+		cancelCtx:      cancelCtx,
 		prepRevocation: make(chan error),
+		status:         irma.ClientStatusCreated,
+		timings:        PhaseTimings{Started: time.Now()},
+		sessionOptions: opts,
 	}
+	session.transport.SetRedirectFunc(session.confirmRedirect)
+	session.startCapture()
 	client.sessions.add(session)
 
-	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
+	session.setStatus(irma.ClientStatusCommunicating)
 	min := client.minVersion
 
 	// Check if the action is one of the supported types
@@ -227,19 +334,60 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 	case irma.ActionUnknown:
 		fallthrough
 	default:
-		session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownAction, Info: string(session.Action)})
+		session.fail(&irma.SessionError{
+			ErrorType: irma.ErrorUnknownAction,
+			Info:      string(session.Action),
+			Err:       errors.Errorf("unknown session type %s", session.Action),
+		})
+		return nil
+	}
+
+	// Restrict ourselves to the protocol versions that the server supports according to the QR.
+	// Servers offering only versions that we do not support, such as the IRMA API servers of
+	// protocol version 2.1, are refused.
+	clientMin, max := min, client.maxVersion
+	if qr.ProtocolVersion != nil && qr.ProtocolVersion.AboveVersion(min) {
+		min = qr.ProtocolVersion
+	}
+	if qr.MaxProtocolVersion != nil && qr.MaxProtocolVersion.BelowVersion(max) {
+		max = qr.MaxProtocolVersion
+	}
+	if max.BelowVersion(min) {
+		session.fail(&irma.SessionError{
+			ErrorType: irma.ErrorProtocolVersionNotSupported,
+			Info:      fmt.Sprintf("server supports %s - %s", qr.ProtocolVersion, qr.MaxProtocolVersion),
+			Err:       errors.Errorf("server supports protocol versions %s - %s, we support %s - %s", qr.ProtocolVersion, qr.MaxProtocolVersion, clientMin, client.maxVersion),
+		})
 		return nil
 	}
 
 	session.transport.SetHeader(irma.MinVersionHeader, min.String())
-	session.transport.SetHeader(irma.MaxVersionHeader, client.maxVersion.String())
+	session.transport.SetHeader(irma.MaxVersionHeader, max.String())
 
 	// From protocol version 2.8 also an authorization header must be included.
-	if client.maxVersion.Above(2, 7) {
+	if max.Above(2, 7) {
 		clientAuth := common.NewSessionToken()
 		session.transport.SetHeader(irma.AuthorizationHeader, clientAuth)
 	}
 
+	// Servers that indicate so in the QR require a ClientHello before handing out the request,
+	// regardless of the protocol version.
+	if qr.Hello {
+		session.hello = &irma.ClientHello{
+			LDContext:          irma.LDContextClientHello,
+			MinProtocolVersion: min,
+			MaxProtocolVersion: max,
+			ClientName:         "irmago",
+			ClientVersion:      irma.Version,
+		}
+		var err error
+		if session.encryptionKey, session.decryptionKey, err = irma.GenerateSessionKey(rand.Reader); err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+			return nil
+		}
+		session.hello.EncryptionKey = session.encryptionKey[:]
+	}
+
 	if !strings.HasSuffix(session.ServerURL, "/") {
 		session.ServerURL += "/"
 	}
@@ -255,18 +403,21 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 func (session *session) getSessionInfo() {
 	defer session.recoverFromPanic()
 
-	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
+	session.setStatus(irma.ClientStatusCommunicating)
 
 	// Get the first IRMA protocol message and parse it
 	cr := &irma.ClientSessionRequest{
 		Request: session.request, // As request is an interface, it needs to be initialized with a specific instance.
 	}
-	// UnmarshalJSON of ClientSessionRequest takes into account legacy protocols, so we do not have to check that here.
-	err := session.transport.Get("", cr)
+	err := session.getClientSessionRequest(cr)
 	if err != nil {
 		session.fail(err.(*irma.SessionError))
 		return
 	}
+	if session.finished() { // dismissed while we were waiting for the server
+		return
+	}
+	session.recordRedirect()
 
 	// Check whether pairing is needed, and if so, wait for it to be completed.
 	if cr.Options.PairingMethod != irma.PairingMethodNone {
@@ -274,24 +425,93 @@ func (session *session) getSessionInfo() {
 			session.fail(err.(*irma.SessionError))
 			return
 		}
+		if session.finished() { // dismissed during pairing
+			return
+		}
 	}
 
+	session.startCountdown(cr.Lifetime)
 	session.processSessionInfo()
 }
 
+// getClientSessionRequest fetches the session request from the server. If the server requires
+// a ClientHello, we POST it to the hello endpoint, the response to which contains the request.
+// Servers that turn out not to know that endpoint get the legacy GET of the request instead.
+func (session *session) getClientSessionRequest(cr *irma.ClientSessionRequest) error {
+	if session.hello != nil {
+		err := session.transport.Post("hello", cr, session.hello)
+		if err == nil {
+			version := cr.ProtocolVersion
+			if version == nil || version.BelowVersion(session.hello.MinProtocolVersion) ||
+				version.AboveVersion(session.hello.MaxProtocolVersion) {
+				return &irma.SessionError{
+					ErrorType: irma.ErrorProtocolVersionNotSupported,
+					Info:      "server chose unsupported protocol version after client hello",
+					Err:       errors.Errorf("server chose protocol version %s after client hello", version),
+				}
+			}
+			return nil
+		}
+		serr, ok := err.(*irma.SessionError)
+		if ok && sessionUnknown(serr) {
+			return session.unknownOrExpired(serr)
+		}
+		if !ok || (serr.RemoteStatus != http.StatusNotFound && serr.RemoteStatus != http.StatusMethodNotAllowed) {
+			return err
+		}
+		irma.Logger.Info("Server does not support client hello, falling back to GET of session request")
+	}
+	// UnmarshalJSON of ClientSessionRequest takes into account legacy protocols, so we do not have to check that here.
+	err := session.transport.Get("", cr)
+	if serr, ok := err.(*irma.SessionError); ok && (sessionUnknown(serr) || serr.RemoteStatus == http.StatusNotFound) {
+		return session.unknownOrExpired(serr)
+	}
+	return err
+}
+
+// sessionUnknown returns whether the server reported that it does not know the session.
+func sessionUnknown(err *irma.SessionError) bool {
+	return err.RemoteError != nil &&
+		(err.RemoteError.ErrorName == "SESSION_UNKNOWN" || err.RemoteError.ErrorName == "UNKNOWN_TOKEN")
+}
+
+// unknownOrExpired converts an error of the server not knowing the session into
+// irma.ErrorSessionUnknownOrExpired, which happens when the session expired or when another
+// device already scanned the QR, so that the user can be told to ask for a new QR.
+func (session *session) unknownOrExpired(err *irma.SessionError) *irma.SessionError {
+	return &irma.SessionError{
+		ErrorType:    irma.ErrorSessionUnknownOrExpired,
+		Info:         session.Hostname,
+		Err:          err,
+		RemoteStatus: err.RemoteStatus,
+		RemoteError:  err.RemoteError,
+	}
+}
+
+// handlePairing shows the pairing code to the user, and waits until the user has entered it in
+// the frontend, after which the server releases the session request. If the user dismisses the
+// session meanwhile, the session is cancelled at the server and nil is returned.
 func (session *session) handlePairing(pairingCode string) error {
-	session.Handler.PairingRequired(pairingCode)
+	session.setStatus(irma.ClientStatusPairing)
+	session.dispatch(func() { session.Handler.PairingRequired(pairingCode) })
 
-	statuschan := make(chan irma.ServerStatus)
-	errorchan := make(chan error)
+	// Buffered, so that the status is not waited for in vain once we stop listening
+	statuschan := make(chan irma.ServerStatus, 1)
+	errorchan := make(chan error, 1)
 
 	go irma.WaitStatusChanged(session.transport, irma.ServerStatusPairing, statuschan, errorchan)
 	select {
+	case <-session.ctx.Done():
+		return nil
 	case status := <-statuschan:
 		if status == irma.ServerStatusConnected {
+			session.setStatus(irma.ClientStatusCommunicating)
 			return session.transport.Get("request", session.request)
 		} else {
-			return &irma.SessionError{ErrorType: irma.ErrorPairingRejected}
+			return &irma.SessionError{
+				ErrorType: irma.ErrorPairingRejected,
+				Err:       errors.Errorf("pairing ended with server status %s", status),
+			}
 		}
 	case err := <-errorchan:
 		if serr, ok := err.(*irma.SessionError); ok {
@@ -305,7 +525,11 @@ func (session *session) handlePairing(pairingCode string) error {
 	}
 }
 
-func requestorInfo(serverURL string, conf *irma.Configuration) *irma.RequestorInfo {
+// requestorInfo returns the requestor of the IRMA server at the specified URL. Requestors are
+// verified only over HTTPS, which is not enforced in developer mode.
+// The requestor is looked up by the host name of the URL in the requestor schemes, so requestors
+// cannot claim the name of another requestor: unknown hosts are shown by their host name.
+func requestorInfo(serverURL string, conf *irma.Configuration, developerMode bool) *irma.RequestorInfo {
 	if serverURL == "" {
 		return nil
 	}
@@ -313,15 +537,19 @@ func requestorInfo(serverURL string, conf *irma.Configuration) *irma.RequestorIn
 	hostname := u.Hostname()
 	info, present := conf.Requestors[hostname]
 
+	var requestor irma.RequestorInfo
 	if (u.Scheme == "https" || !common.ForceHTTPS) && present &&
 		(info.ValidUntil == nil || info.ValidUntil.After(irma.Timestamp(time.Now()))) {
-		return info
+		requestor = *info
 	} else {
-		return irma.NewRequestorInfo(hostname)
+		requestor = *irma.NewRequestorInfo(hostname)
 	}
+	requestor.DeveloperMode = developerMode
+	return &requestor
 }
 
-func checkKey(conf *irma.Configuration, issuer irma.IssuerIdentifier, counter uint) error {
+// checkKey checks that the specified public key exists and has not expired at the specified time.
+func checkKey(conf *irma.Configuration, issuer irma.IssuerIdentifier, counter uint, now time.Time) error {
 	id := fmt.Sprintf("%s-%d", issuer, counter)
 	pk, err := conf.PublicKey(issuer, counter)
 	if err != nil {
@@ -330,12 +558,77 @@ func checkKey(conf *irma.Configuration, issuer irma.IssuerIdentifier, counter ui
 	if pk == nil {
 		return errors.Errorf("credential signed with unknown public key %s", id)
 	}
-	if time.Now().Unix() > pk.ExpiryDate {
+	if now.Unix() > pk.ExpiryDate {
 		return errors.Errorf("credential signed with expired key %s", id)
 	}
 	return nil
 }
 
+// KeyCounterPolicy determines how the client handles credential requests lacking the counter of
+// the public key with which the credential is issued. IRMA servers omit the counter when it is
+// zero, so KeyCounterZero is the only policy compatible with all IRMA servers.
+type KeyCounterPolicy int
+
+const (
+	// KeyCounterZero uses the public key with counter zero, as IRMA servers intend.
+	KeyCounterZero KeyCounterPolicy = iota
+	// KeyCounterRequire fails such sessions with irma.ErrorMissingPublicKeyCounter, which is
+	// only suitable for clients of IRMA servers that always include the key counter.
+	KeyCounterRequire
+	// KeyCounterInfer uses the newest unexpired public key of the issuer in the Configuration,
+	// which is only correct if the scheme of the client is up to date.
+	KeyCounterInfer
+)
+
+// SetKeyCounterPolicy sets how the client handles issuance requests that do not specify the
+// public key with which a credential is issued. The default is KeyCounterZero.
+func (client *Client) SetKeyCounterPolicy(policy KeyCounterPolicy) {
+	client.policyMutex.Lock()
+	defer client.policyMutex.Unlock()
+	client.keyCounterPolicy = policy
+}
+
+// resolveKeyCounters ensures that all credential requests of an issuance request specify the
+// public key of their issuer, according to the KeyCounterPolicy of the client.
+func (client *Client) resolveKeyCounters(ir *irma.IssuanceRequest) *irma.SessionError {
+	client.policyMutex.Lock()
+	policy := client.keyCounterPolicy
+	client.policyMutex.Unlock()
+
+	for _, credreq := range ir.Credentials {
+		if credreq.HasKeyCounter() {
+			continue
+		}
+		issuer := credreq.CredentialTypeID.IssuerIdentifier()
+		switch policy {
+		case KeyCounterRequire:
+			return &irma.SessionError{
+				ErrorType: irma.ErrorMissingPublicKeyCounter,
+				Info:      issuer.String(),
+				Err:       errors.Errorf("no public key specified for issuer %s", issuer),
+			}
+		case KeyCounterInfer:
+			counter, err := latestValidKey(client.Configuration, issuer)
+			if err != nil {
+				return &irma.SessionError{ErrorType: irma.ErrorMissingPublicKeyCounter, Info: issuer.String(), Err: err}
+			}
+			credreq.SetKeyCounter(counter)
+		default:
+			credreq.SetKeyCounter(0)
+		}
+	}
+	return nil
+}
+
+// latestValidKey returns the counter of the newest public key of the issuer that has not expired.
+func latestValidKey(conf *irma.Configuration, issuer irma.IssuerIdentifier) (uint, error) {
+	pk, err := conf.LatestKey(issuer)
+	if err != nil {
+		return 0, errors.Errorf("no public key specified for issuer %s, and none to infer it from: %s", issuer, err)
+	}
+	return pk.Counter, nil
+}
+
 // checkAttrRestrictedAccess checks whether the requestor is allowed to request the given attribute and returns an error if it is not authorised.
 func checkAttrRestrictedAccess(attr irma.AttributeRequest, info *irma.RequestorInfo, configuration *irma.Configuration) error {
 	attrType := configuration.AttributeTypes[attr.Type]
@@ -376,20 +669,41 @@ func checkRestrictedAccess(cdc irma.AttributeConDisCon, requestor *irma.Requesto
 // it checks if the session can be performed and asks the user for consent.
 func (session *session) processSessionInfo() {
 	defer session.recoverFromPanic()
+	session.timePhase(func(t *PhaseTimings) **time.Time { return &t.RequestReceived })
 
-	if err := session.checkAndUpdateConfiguration(); err != nil {
-		session.fail(err.(*irma.SessionError))
+	baserequest := session.request.Base()
+	if baserequest.DevelopmentMode {
+		if !session.client.Preferences.DeveloperMode {
+			session.fail(&irma.SessionError{
+				ErrorType: irma.ErrorInvalidRequest,
+				Info:      "server running in developer mode: either switch to production mode, or enable developer mode in IRMA app",
+				Err:       errors.New("server running in developer mode while developer mode is disabled"),
+			})
+			return
+		}
+		// IRMA servers in development mode do not authenticate requestors, so we cannot be sure
+		// that the session request stems from the requestor that the scheme lists for the server
+		if session.RequestorInfo != nil && !session.RequestorInfo.Unverified {
+			session.RequestorInfo = irma.NewRequestorInfo(session.Hostname)
+			session.RequestorInfo.DeveloperMode = true
+		}
+	}
+
+	if err := session.decryptAttributes(); err != nil {
+		session.fail(err)
 		return
 	}
 
-	baserequest := session.request.Base()
-	if baserequest.DevelopmentMode && !session.client.Preferences.DeveloperMode {
-		session.fail(&irma.SessionError{
-			ErrorType: irma.ErrorInvalidRequest,
-			Info:      "server running in developer mode: either switch to production mode, or enable developer mode in IRMA app",
-		})
+	if err := session.checkPolicies(); err != nil {
+		session.fail(err)
 		return
 	}
+
+	if err := session.checkAndUpdateConfiguration(); err != nil {
+		session.fail(err.(*irma.SessionError))
+		return
+	}
+
 	confirmedProtocolVersion := baserequest.ProtocolVersion
 	if confirmedProtocolVersion != nil {
 		session.Version = confirmedProtocolVersion
@@ -398,6 +712,21 @@ func (session *session) processSessionInfo() {
 		baserequest.ProtocolVersion = session.Version
 	}
 
+	if ir, ok := session.request.(*irma.IssuanceRequest); ok {
+		if err := session.client.resolveKeyCounters(ir); err != nil {
+			session.fail(err)
+			return
+		}
+	}
+	session.setSummary()
+
+	if session.IsInteractive() {
+		if err := session.checkNonceContext(); err != nil {
+			session.fail(err)
+			return
+		}
+	}
+
 	if session.Action == irma.ActionIssuing {
 		ir := session.request.(*irma.IssuanceRequest)
 		issuedAt := time.Now()
@@ -414,22 +743,31 @@ func (session *session) processSessionInfo() {
 		// Calculate singleton credentials to be removed
 		ir.RemovalCredentialInfoList = irma.CredentialInfoList{}
 		for _, credreq := range ir.Credentials {
-			err := checkKey(session.client.Configuration, credreq.CredentialTypeID.IssuerIdentifier(), credreq.KeyCounter)
+			err := checkKey(session.client.Configuration, credreq.CredentialTypeID.IssuerIdentifier(), credreq.KeyCounter, session.client.now())
 			if err != nil {
 				session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 				return
 			}
 			preexistingCredentials := session.client.attrs(credreq.CredentialTypeID)
-			if len(preexistingCredentials) != 0 && preexistingCredentials[0].IsValid() && preexistingCredentials[0].CredentialType().IsSingleton {
+			if len(preexistingCredentials) != 0 && preexistingCredentials[0].IsValidOn(session.client.now()) && preexistingCredentials[0].CredentialType().IsSingleton {
 				ir.RemovalCredentialInfoList = append(ir.RemovalCredentialInfoList, preexistingCredentials[0].Info())
 			}
 		}
+
+		ir.CredentialChanges, err = session.client.credentialChanges(ir, session.Version, issuedAt)
+		if err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+			return
+		}
+		if err := session.checkValidities(ir); err != nil {
+			session.fail(err)
+			return
+		}
 	}
 
 	if session.Action == irma.ActionDisclosing || session.Action == irma.ActionSigning {
-		req := session.request.(*irma.DisclosureRequest)
-		requestorInfo := requestorInfo(session.Hostname, session.client.Configuration)
-		if err := checkRestrictedAccess(req.Disclose, requestorInfo, session.client.Configuration); err != nil {
+		req := session.request.Disclosure()
+		if err := checkRestrictedAccess(req.Disclose, session.RequestorInfo, session.client.Configuration); err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return
 		}
@@ -461,48 +799,197 @@ func (session *session) processSessionInfo() {
 	}
 
 	// Handle ClientReturnURL if one is found in the session request
-	if session.request.Base().ClientReturnURL != "" {
-		session.Handler.ClientReturnURLSet(session.request.Base().ClientReturnURL)
+	if url := session.request.Base().ClientReturnURL; url != "" {
+		session.dispatch(func() { session.Handler.ClientReturnURLSet(url) })
 	}
 
-	session.requestPermission()
+	session.checkKnownRequestor(session.requestPermission)
 }
 
 func (session *session) requestPermission() {
-	candidates, satisfiable, err := session.client.Candidates(session.request)
+	check, err := session.client.CheckRequest(session.request)
 	if err != nil {
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 		return
 	}
+	// Identical disjunctions are shown only once; see expandChoice
+	request, candidates, unsatisfiable := check.Request, check.Candidates, check.Unsatisfiable
+	session.disjunctions = check.disjunctions
+
+	if id := unsatisfiable.missingWitness(); id != nil {
+		session.fail(&irma.SessionError{
+			ErrorType: irma.ErrorMissingWitness,
+			Info:      id.String(),
+			Err:       errors.Errorf("nonrevocation proof requested for %s, of which we have no credential with nonrevocation witness", id),
+		})
+		return
+	}
+	satisfiable := unsatisfiable == nil
+	session.warnDeclined(unsatisfiable)
+
+	session.setStatus(irma.ClientStatusConnected)
+	if !satisfiable {
+		session.dispatch(func() { session.Handler.Unsatisfiable(unsatisfiable) })
+	}
+
+	if handler, ok := session.Handler.(KnownRequestorHandler); ok {
+		known := session.knownRequestor
+		session.dispatch(func() { handler.KnownRequestor(known) })
+	}
 
-	session.Handler.StatusUpdate(session.Action, irma.ClientStatusConnected)
+	if handler, ok := session.Handler.(ResponseEstimateHandler); ok && satisfiable {
+		if estimate := session.estimateResponse(request, candidates); estimate != nil {
+			session.dispatch(func() { handler.ResponseEstimate(estimate) })
+		}
+	}
 
 	// Ask for permission to execute the session
+	session.timePhase(func(t *PhaseTimings) **time.Time { return &t.PermissionShown })
+	callback := func(proceed bool, choice *irma.DisclosureChoice) {
+		session.doSession(proceed, session.expandChoice(choice))
+	}
+	requestor := session.RequestorInfo
 	switch session.Action {
 	case irma.ActionDisclosing:
-		session.Handler.RequestVerificationPermission(
-			session.request.(*irma.DisclosureRequest), satisfiable, candidates, session.RequestorInfo, session.doSession)
+		session.dispatch(func() {
+			session.Handler.RequestVerificationPermission(
+				request.(*irma.DisclosureRequest), satisfiable, candidates, requestor, callback)
+		})
 	case irma.ActionSigning:
-		session.Handler.RequestSignaturePermission(
-			session.request.(*irma.SignatureRequest), satisfiable, candidates, session.RequestorInfo, session.doSession)
+		if handler, ok := session.Handler.(SignatureMessageHandler); ok {
+			analysis := request.(*irma.SignatureRequest).AnalyzeMessage()
+			session.dispatch(func() { handler.SignatureMessage(analysis) })
+		}
+		session.dispatch(func() {
+			session.Handler.RequestSignaturePermission(
+				request.(*irma.SignatureRequest), satisfiable, candidates, requestor, callback)
+		})
 	case irma.ActionIssuing:
-		session.Handler.RequestIssuancePermission(
-			session.request.(*irma.IssuanceRequest), satisfiable, candidates, session.RequestorInfo, session.doSession)
+		session.dispatch(func() {
+			session.Handler.RequestIssuancePermission(
+				request.(*irma.IssuanceRequest), satisfiable, candidates, requestor, callback)
+		})
 	default:
 		panic("Invalid session type") // does not happen, session.Action has been checked earlier
 	}
 }
 
+// canonicalRequest returns a copy of the request of which the disjunctions are canonicalized, see
+// irma.DisclosureRequest.Canonicalize, along with the index of the canonical disjunction of each
+// of the disjunctions of the request; or the request itself and nil if it is already canonical.
+func canonicalRequest(request irma.SessionRequest) (irma.SessionRequest, []int) {
+	var cp irma.SessionRequest
+	switch r := request.(type) {
+	case *irma.DisclosureRequest:
+		c := *r
+		cp = &c
+	case *irma.SignatureRequest:
+		c := *r
+		cp = &c
+	case *irma.IssuanceRequest:
+		c := *r
+		cp = &c
+	default:
+		return request, nil
+	}
+	disjunctions := cp.Disclosure().Canonicalize()
+	if disjunctions == nil {
+		return request, nil
+	}
+	return cp, disjunctions
+}
+
+// expandChoice maps a choice made for the disjunctions of the canonical request that was shown to
+// the user to the disjunctions of the request of the server, so that the response has the shape
+// that the server expects. Choices of another shape are returned as is.
+func (session *session) expandChoice(choice *irma.DisclosureChoice) *irma.DisclosureChoice {
+	if choice == nil || session.disjunctions == nil {
+		return choice
+	}
+	count := 0
+	for _, j := range session.disjunctions {
+		if j+1 > count {
+			count = j + 1
+		}
+	}
+	if len(choice.Attributes) != count {
+		return choice
+	}
+
+	disclose := session.request.Disclosure().Disclose
+	expanded := &irma.DisclosureChoice{
+		Attributes:          make([][]*irma.AttributeIdentifier, len(session.disjunctions)),
+		DeclinedCredentials: choice.DeclinedCredentials,
+	}
+	for i, j := range session.disjunctions {
+		expanded.Attributes[i] = expandConjunction(disclose[i], choice.Attributes[j])
+	}
+	return expanded
+}
+
+// expandConjunction returns the chosen attributes in the order of the first inner conjunction of
+// the disjunction that they are exactly the requested attribute types of, repeating attributes
+// that the conjunction requests more than once; or the attributes as is if there is none.
+func expandConjunction(discon irma.AttributeDisCon, attrs []*irma.AttributeIdentifier) []*irma.AttributeIdentifier {
+	for _, con := range discon {
+		expanded := make([]*irma.AttributeIdentifier, 0, len(con))
+		used := map[*irma.AttributeIdentifier]struct{}{}
+		for _, req := range con {
+			for _, attr := range attrs {
+				if attr.Type == req.Type {
+					expanded = append(expanded, attr)
+					used[attr] = struct{}{}
+					break
+				}
+			}
+		}
+		if len(expanded) == len(con) && len(used) == len(attrs) {
+			return expanded
+		}
+	}
+	return attrs
+}
+
 // doSession performs the session: it computes all proofs of knowledge, constructs credentials in case of issuance,
 // asks for the pin and performs the keyshare session, and finishes the session by either POSTing the result to the
 // API server or returning it to the caller (in case of interactive and noninteractive sessions, respectively).
 func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 	defer session.recoverFromPanic()
+	session.timePhase(func(t *PhaseTimings) **time.Time { return &t.PermissionAnswered })
 
 	if !proceed {
 		session.cancel()
 		return
 	}
+	if session.expired() {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorSessionExpired, Err: errSessionExpired})
+		return
+	}
+
+	if session.client.Locked() {
+		session.dispatch(func() {
+			session.Handler.RequestUnlock(func(proceed bool) {
+				if proceed && session.client.Locked() {
+					session.fail(&irma.SessionError{ErrorType: irma.ErrorLocked, Err: ErrLocked})
+					return
+				}
+				session.doSession(proceed, choice)
+			})
+		})
+		return
+	}
+
+	// Refuse to disclose attributes that the requestor did not ask for, e.g. due to a mistake in
+	// constructing the choice from the candidates
+	if extra := choice.ExtraAttributes(session.request.Disclosure()); len(extra) > 0 {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorOverDisclosure, Info: session.Hostname, Err: overDisclosure(extra)})
+		return
+	}
+
+	// Let the user confirm the disclosure of sensitive attributes once more
+	if !session.sensitiveConfirmed && session.confirmSensitiveDisclosure(choice) {
+		return
+	}
 
 	// If this is a session in a chain of sessions, also disclose all attributes disclosed in previous sessions
 	if session.implicitDisclosure != nil {
@@ -514,7 +1001,18 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorRequiredAttributeMissing, Err: err})
 		return
 	}
-	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
+	if session.Action == irma.ActionIssuing {
+		accepted, err := session.declineCredentials()
+		if err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+			return
+		}
+		if !accepted {
+			session.cancel()
+			return
+		}
+	}
+	session.setStatus(irma.ClientStatusCommunicating)
 
 	// wait for revocation preparation to finish
 	err := <-session.prepRevocation
@@ -524,23 +1022,38 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 	}
 
 	if !session.Distributed() {
-		message, err := session.getProof()
+		var disclosure *irma.DisclosureResponse
+		var commitments *irma.IssueCommitmentMessage
+		start := time.Now()
+		err = session.buildWithFallback(func() (err error) {
+			disclosure, commitments, err = session.getProof()
+			return
+		})
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 			return
 		}
-		session.sendResponse(message)
+		session.observeProofTiming(start)
+		session.timePhase(func(t *PhaseTimings) **time.Time { return &t.ProofsBuilt })
+		session.sendResponse(disclosure, commitments)
 		session.finish(false)
 	} else {
-		var err error
-		session.builders, session.attrIndices, session.issuerProofNonce, err = session.getBuilders()
+		start := time.Now()
+		err = session.buildWithFallback(func() (err error) {
+			session.builders, session.attrIndices, session.issuerProofNonce, err = session.getBuilders()
+			return
+		})
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+			return
 		}
+		// Most of the work is done here; the keyshare servers contribute to the proofs later on
+		session.observeProofTiming(start)
 		startKeyshareSession(
+			session.ctx,
 			session,
 			session.client,
-			session.Handler,
+			dispatchingPinRequestor{session},
 			session.builders,
 			session.request,
 			session.implicitDisclosure,
@@ -550,9 +1063,19 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 	}
 }
 
+// overDisclosure returns an error listing the attributes that would be disclosed without being requested.
+func overDisclosure(extra []*irma.AttributeIdentifier) error {
+	types := make([]string, 0, len(extra))
+	for _, attr := range extra {
+		types = append(types, attr.Type.String())
+	}
+	return errors.Errorf("choice discloses attributes that were not requested: %s", strings.Join(types, ", "))
+}
+
 // sendResponse sends the proofs of knowledge of the hidden attributes and/or the secret key, or the constructed
-// attribute-based signature, to the API server.
-func (session *session) sendResponse(message interface{}) {
+// attribute-based signature, to the API server. The disclosure is used in disclosure and signature sessions,
+// the commitments in issuance sessions.
+func (session *session) sendResponse(disclosure *irma.DisclosureResponse, commitments *irma.IssueCommitmentMessage) {
 	var log *LogEntry
 	var err error
 	var messageJson []byte
@@ -560,11 +1083,17 @@ func (session *session) sendResponse(message interface{}) {
 	var ourResponse interface{}
 	serverResponse := &irma.ServerSessionResponse{ProtocolVersion: session.Version, SessionType: session.Action}
 
+	// Don't bother sending a response that the server would reject
+	if session.IsInteractive() && session.expired() {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorSessionExpired, Err: errSessionExpired})
+		return
+	}
+
 	switch session.Action {
 	case irma.ActionSigning:
-		irmaSignature, err := session.request.(*irma.SignatureRequest).SignatureFromMessage(message, session.timestamp)
+		irmaSignature, err := session.request.(*irma.SignatureRequest).SignatureFromMessage(&disclosure.Disclosure, session.timestamp)
 		if err != nil {
-			session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Info: "Type assertion failed"})
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Info: "Type assertion failed", Err: err})
 			return
 		}
 		messageJson, err = json.Marshal(irmaSignature)
@@ -575,54 +1104,187 @@ func (session *session) sendResponse(message interface{}) {
 		ourResponse = irmaSignature
 		path = "proofs"
 	case irma.ActionDisclosing:
-		messageJson, err = json.Marshal(message)
+		messageJson, err = json.Marshal(disclosure)
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
 			return
 		}
-		ourResponse = message
+		ourResponse = disclosure
 		path = "proofs"
 	case irma.ActionIssuing:
-		ourResponse = message
+		messageJson, err = json.Marshal(session.request.(*irma.IssuanceRequest).CredentialChanges)
+		if err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+			return
+		}
+		ourResponse = commitments
 		path = "commitments"
 	}
 
+	if session.dryRun {
+		session.finishDryRun(path, ourResponse, disclosure, commitments)
+		return
+	}
+
 	if session.IsInteractive() {
-		if err = session.transport.Post(path, &serverResponse, ourResponse); err != nil {
+		p := session.newProgress(ProgressPostingResponse, 1)
+		if err = session.postResponse(path, &serverResponse, ourResponse); err != nil {
 			session.fail(err.(*irma.SessionError))
 			return
 		}
+		p.step()
+		session.timePhase(func(t *PhaseTimings) **time.Time { return &t.ResponsePosted })
 		if serverResponse.ProofStatus != irma.ProofStatusValid {
-			session.fail(&irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(serverResponse.ProofStatus)})
+			session.fail(&irma.SessionError{
+				ErrorType:   irma.ErrorRejected,
+				Info:        string(serverResponse.ProofStatus),
+				ProofStatus: serverResponse.ProofStatus,
+				Err:         errors.Errorf("server rejected response with proof status %s", serverResponse.ProofStatus),
+			})
 			return
 		}
 		if session.Action == irma.ActionIssuing {
-			if err = session.client.ConstructCredentials(serverResponse.IssueSignatures, session.request.(*irma.IssuanceRequest), session.builders); err != nil {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+			var declined []int
+			if session.choice != nil {
+				declined = session.choice.DeclinedCredentials
+			}
+			if messageJson, err = session.issuanceErrors(serverResponse, declined, messageJson); err != nil {
+				session.fail(err.(*irma.SessionError))
+				return
+			}
+			p = session.newProgress(ProgressConstructingCredentials, len(serverResponse.IssueSignatures))
+			if err = session.client.constructCredentials(serverResponse.IssueSignatures, session.request.(*irma.IssuanceRequest), session.builders, session.choice, session.issueErrors, p); err != nil {
+				if serr, ok := err.(*irma.SessionError); ok {
+					session.fail(serr)
+				} else {
+					session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+				}
 				return
 			}
 		}
 	}
 
-	log, err = session.createLogEntry(message)
+	session.timePhase(func(t *PhaseTimings) **time.Time { return &t.Finished })
+	log, err = session.createLogEntry(disclosure, commitments)
 	if err != nil {
 		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to create log entry", 0).ErrorStack())
 		session.client.reportError(err)
 	}
-	if err = session.client.storage.AddLogEntry(log); err != nil {
+	if err = session.client.addLogEntry(log); err != nil {
 		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to write log entry", 0).ErrorStack())
 	}
+	if err = session.recordRequestor(); err != nil {
+		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to record requestor", 0).ErrorStack())
+	}
 	if session.Action == irma.ActionIssuing {
 		session.client.handler.UpdateAttributes()
 	}
 	session.finish(false)
+	session.setStatus(irma.ClientStatusDone)
 
 	if serverResponse != nil && serverResponse.NextSession != nil {
-		session.next = session.client.newQrSession(serverResponse.NextSession, session.Handler)
-		session.next.implicitDisclosure = session.choice.Attributes
+		next := session.client.newQrSession(serverResponse.NextSession, session.Handler, session.sessionOptions)
+		next.implicitDisclosure = session.choice.Attributes
+		next.declined = session.declined
+		session.statusMutex.Lock()
+		session.next = next
+		session.statusMutex.Unlock()
 	} else {
-		session.Handler.Success(string(messageJson))
+		session.reportTimings()
+		failed := session.failedCredentials()
+		if handler, ok := session.Handler.(PartialIssuanceHandler); ok && len(failed) > 0 {
+			session.dispatch(func() { handler.PartialSuccess(string(messageJson), failed) })
+		} else {
+			session.dispatch(func() { session.Handler.Success(string(messageJson)) })
+		}
+	}
+}
+
+// issuanceErrors processes the errors that the issuer returned instead of the signatures of some
+// of the credentials of an issuance session. The session fails if the request is atomic or if no
+// credential remains to be stored; otherwise the errors are included in the CredentialChanges of
+// the request, and the result of the session is returned with these changes.
+func (session *session) issuanceErrors(response *irma.ServerSessionResponse, declined []int, result []byte) ([]byte, error) {
+	if len(response.IssueErrors) == 0 {
+		return result, nil
+	}
+	request := session.request.(*irma.IssuanceRequest)
+	first := -1
+	for i := range response.IssueErrors {
+		if i < 0 || i >= len(request.Credentials) {
+			return nil, &irma.SessionError{
+				ErrorType: irma.ErrorServerResponse,
+				Info:      "issuance error for unknown credential",
+				Err:       errors.Errorf("issuance error for credential %d of %d", i, len(request.Credentials)),
+			}
+		}
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	issued := 0
+	for i := range request.Credentials {
+		if _, ok := response.IssueErrors[i]; !ok && !containsIndex(declined, i) {
+			issued++
+		}
+	}
+	if request.Atomic || issued == 0 {
+		return nil, &irma.SessionError{
+			ErrorType:   irma.ErrorIssuanceFailed,
+			Info:        session.Hostname,
+			RemoteError: response.IssueErrors[first],
+			Err:         response.IssueErrors[first],
+		}
+	}
+
+	session.issueErrors = response.IssueErrors
+	for _, change := range request.CredentialChanges {
+		change.Error = response.IssueErrors[change.Credential]
+	}
+	result, err := json.Marshal(request.CredentialChanges)
+	if err != nil {
+		return nil, &irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err}
+	}
+	return result, nil
+}
+
+// failedCredentials returns the changes of the credentials that the issuer did not issue.
+func (session *session) failedCredentials() []*irma.CredentialChange {
+	if len(session.issueErrors) == 0 {
+		return nil
+	}
+	var failed []*irma.CredentialChange
+	for _, change := range session.request.(*irma.IssuanceRequest).CredentialChanges {
+		if change.Error != nil {
+			failed = append(failed, change)
+		}
 	}
+	return failed
+}
+
+// decryptAttributes decrypts the attribute values of an issuance request that the issuer
+// encrypted against the encryption key of the session.
+func (session *session) decryptAttributes() *irma.SessionError {
+	ir, ok := session.request.(*irma.IssuanceRequest)
+	if !ok {
+		return nil
+	}
+	for _, credreq := range ir.Credentials {
+		if len(credreq.EncryptedAttributes) == 0 {
+			continue
+		}
+		if session.decryptionKey == nil {
+			return &irma.SessionError{
+				ErrorType: irma.ErrorInvalidRequest,
+				Info:      "received encrypted attributes without having sent an encryption key",
+				Err:       errors.Errorf("encrypted attributes for %s without encryption key", credreq.CredentialTypeID),
+			}
+		}
+		if err := credreq.DecryptAttributes(session.encryptionKey, session.decryptionKey); err != nil {
+			return &irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err}
+		}
+	}
+	return nil
 }
 
 // Response calculation methods
@@ -635,11 +1297,13 @@ func (session *session) getBuilders() (gabi.ProofBuilderList, irma.DisclosedAttr
 	var issuerProofNonce *big.Int
 	var choices irma.DisclosedAttributeIndices
 
+	// The proofs themselves are computed after the keyshare servers have contributed
+	p := session.newProgress(ProgressBuildingProofs, session.proofCount())
 	switch session.Action {
 	case irma.ActionSigning, irma.ActionDisclosing:
-		builders, choices, session.timestamp, err = session.client.ProofBuilders(session.choice, session.request)
+		builders, choices, session.timestamp, err = session.client.proofBuilders(session.choice, session.request, p)
 	case irma.ActionIssuing:
-		builders, choices, issuerProofNonce, err = session.client.IssuanceProofBuilders(session.request.(*irma.IssuanceRequest), session.choice)
+		builders, choices, issuerProofNonce, err = session.client.issuanceProofBuilders(session.request.(*irma.IssuanceRequest), session.choice, p)
 	}
 
 	return builders, choices, issuerProofNonce, err
@@ -647,18 +1311,20 @@ func (session *session) getBuilders() (gabi.ProofBuilderList, irma.DisclosedAttr
 
 // getProofs computes the disclosure proofs or secretkey-knowledge proof (in case of disclosure/signing
 // and issuing respectively) to be sent to the server.
-func (session *session) getProof() (interface{}, error) {
-	var message interface{}
+func (session *session) getProof() (*irma.DisclosureResponse, *irma.IssueCommitmentMessage, error) {
+	var disclosure *irma.DisclosureResponse
+	var commitments *irma.IssueCommitmentMessage
 	var err error
 
+	p := session.newProgress(ProgressBuildingProofs, 2*session.proofCount())
 	switch session.Action {
 	case irma.ActionSigning, irma.ActionDisclosing:
-		message, session.timestamp, err = session.client.Proofs(session.choice, session.request)
+		disclosure, session.timestamp, err = session.client.proofs(session.choice, session.request, p)
 	case irma.ActionIssuing:
-		message, session.builders, err = session.client.IssueCommitments(session.request.(*irma.IssuanceRequest), session.choice)
+		commitments, session.builders, err = session.client.issueCommitments(session.request.(*irma.IssuanceRequest), session.choice, p)
 	}
 
-	return message, err
+	return disclosure, commitments, err
 }
 
 // Helper functions
@@ -671,13 +1337,87 @@ func (session *session) checkKeyshareEnrollment() bool {
 		_, enrolled := session.client.keyshareServers[id]
 		if distributed && !enrolled {
 			session.finish(false)
-			session.Handler.KeyshareEnrollmentMissing(id)
+			session.dispatch(func() { session.Handler.KeyshareEnrollmentMissing(id) })
 			return false
 		}
 	}
 	return true
 }
 
+// Bounds on the bit lengths of the nonce and context of session requests, see checkNonceContext.
+const (
+	// IRMA servers generate nonces using gabi.GenerateNonce, of Lstatzk = 128 bits. Servers
+	// predating protocol version 2.5 may use nonces up to the size of a hash.
+	maxNonceBits       = 128
+	maxLegacyNonceBits = 256
+	// IRMA servers use 1 as context; it should in any case not exceed the size of a hash.
+	maxContextBits = 256
+)
+
+// checkNonceContext checks that the nonce and context of the session request are positive,
+// and that their bit lengths are within the bounds of the negotiated protocol version and
+// below that of the smallest modulus of the issuer public keys involved in the session,
+// so that the server cannot weaken our proofs with them.
+func (session *session) checkNonceContext() *irma.SessionError {
+	maxNonce := maxNonceBits
+	if session.Version.Below(2, 5) {
+		maxNonce = maxLegacyNonceBits
+	}
+	modulus := session.minModulusBits()
+	base := session.request.Base()
+	for _, value := range []struct {
+		name string
+		i    *big.Int
+		max  int
+	}{
+		{"nonce", base.Nonce, maxNonce},
+		{"context", base.GetContext(), maxContextBits},
+	} {
+		var err error
+		switch {
+		case value.i == nil || value.i.Sign() <= 0:
+			err = errors.Errorf("%s must be positive", value.name)
+		case value.i.BitLen() > value.max:
+			err = errors.Errorf("%s of %d bits exceeds maximum of %d bits of protocol version %s",
+				value.name, value.i.BitLen(), value.max, session.Version)
+		case modulus > 0 && value.i.BitLen() >= modulus:
+			err = errors.Errorf("%s of %d bits is not smaller than public key modulus of %d bits",
+				value.name, value.i.BitLen(), modulus)
+		}
+		if err != nil {
+			return &irma.SessionError{ErrorType: irma.ErrorInvalidSessionInfo, Err: err}
+		}
+	}
+	return nil
+}
+
+// minModulusBits returns the bit length of the smallest modulus of the public keys of the
+// issuers involved in the session, or 0 if none of them are known.
+func (session *session) minModulusBits() int {
+	conf := session.client.Configuration
+	ids := session.request.Identifiers()
+	min := 0
+	for issuer := range ids.Issuers {
+		if conf.SchemeManagers[issuer.SchemeManagerIdentifier()] == nil {
+			continue
+		}
+		counters := ids.PublicKeys[issuer]
+		if len(counters) == 0 {
+			counters, _ = conf.PublicKeyIndices(issuer)
+		}
+		for _, counter := range counters {
+			pk, err := conf.PublicKey(issuer, counter)
+			if err != nil || pk == nil {
+				continue
+			}
+			if bits := pk.N.BitLen(); min == 0 || bits < min {
+				min = bits
+			}
+		}
+	}
+	return min
+}
+
 func (session *session) checkAndUpdateConfiguration() error {
 	// Download missing credential types/issuers/public keys from the scheme manager
 	downloaded, err := session.client.Configuration.Download(session.request)
@@ -691,15 +1431,16 @@ func (session *session) checkAndUpdateConfiguration() error {
 			return err
 		}
 		session.client.handler.UpdateConfiguration(downloaded)
+		session.client.emit(SchemeUpdated{Identifiers: downloaded})
 	}
 
 	// Check if we are enrolled into all involved keyshare servers
 	if !session.checkKeyshareEnrollment() {
-		return &irma.SessionError{ErrorType: irma.ErrorKeyshareUnenrolled}
+		return &irma.SessionError{ErrorType: irma.ErrorKeyshareUnenrolled, Err: errors.New("not enrolled at the keyshare server of the session")}
 	}
 
 	if err = session.request.Disclosure().Disclose.Validate(session.client.Configuration); err != nil {
-		return &irma.SessionError{ErrorType: irma.ErrorInvalidRequest}
+		return &irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err}
 	}
 
 	return nil
@@ -743,8 +1484,11 @@ func (session *session) Distributed() bool {
 func (session *session) recoverFromPanic() {
 	if e := recover(); e != nil {
 		session.finish(false)
+		session.setStatus(irma.ClientStatusError)
 		if session.Handler != nil {
-			session.Handler.Failure(panicToError(e))
+			session.reportTimings()
+			err := panicToError(e)
+			session.dispatch(func() { session.Handler.Failure(err) })
 		}
 	}
 }
@@ -761,7 +1505,7 @@ func panicToError(e interface{}) *irma.SessionError {
 	default: // nop
 	}
 	fmt.Println("Panic: " + info)
-	return &irma.SessionError{ErrorType: irma.ErrorPanic, Info: info + "\n\n" + string(debug.Stack())}
+	return &irma.SessionError{ErrorType: irma.ErrorPanic, Info: info + "\n\n" + string(debug.Stack()), Err: errors.New(e)}
 }
 
 // finish the session, by sending a DELETE to the server if there is one, and restarting local
@@ -774,6 +1518,7 @@ func (session *session) finish(delete bool) bool {
 	// will then read that message, whilst all further calls will see the closed channel and know
 	// that no further work is needed.
 	if _, ok := <-session.done; ok {
+		session.cancelCtx()
 		session.client.sessions.remove(session.token)
 		// Do actual delete in background, since that can take a while in some circumstances, and
 		// precise moment of completion isn't relevant for frontend.
@@ -788,8 +1533,23 @@ func (session *session) finish(delete bool) bool {
 	return false
 }
 
+// finished returns whether finish has been called on the session.
+func (session *session) finished() bool {
+	return len(session.done) == 0
+}
+
 func (session *session) fail(err *irma.SessionError) {
-	if session.finish(true) && err.ErrorType != irma.ErrorKeyshareUnenrolled {
+	report := session.errorReport(err)
+	// The session is deleted at the server only after posting the report
+	if !session.finish(report == nil) {
+		return
+	}
+	session.captureFailure(err)
+	if report != nil {
+		session.postErrorReport(report)
+	}
+	session.setStatus(failureStatus(err))
+	if err.ErrorType != irma.ErrorKeyshareUnenrolled {
 		irma.Logger.Warn("client session error: ", err.Error())
 		// Don't use errors.Wrap() if err.Err == nil, otherwise we may get
 		// https://yourbasic.org/golang/gotcha-why-nil-error-not-equal-nil/.
@@ -797,19 +1557,22 @@ func (session *session) fail(err *irma.SessionError) {
 		if err.Err != nil {
 			err.Err = errors.Wrap(err.Err, 0)
 		}
-		session.Handler.Failure(err)
+		session.reportTimings()
+		session.dispatch(func() { session.Handler.Failure(err) })
 	}
 }
 
 func (session *session) cancel() {
 	if session.finish(true) {
-		session.Handler.Cancelled()
+		session.setStatus(irma.ClientStatusCancelled)
+		session.reportTimings()
+		session.dispatch(session.Handler.Cancelled)
 	}
 }
 
 func (session *session) Dismiss() {
-	if session.next != nil {
-		session.next.Dismiss()
+	if next := session.nextSession(); next != nil {
+		next.Dismiss()
 	} else {
 		session.cancel()
 	}
@@ -818,16 +1581,21 @@ func (session *session) Dismiss() {
 // Keyshare session handler methods
 
 func (session *session) KeyshareDone(message interface{}) {
+	session.timePhase(func(t *PhaseTimings) **time.Time { return &t.ProofsBuilt })
 	switch session.Action {
 	case irma.ActionSigning:
 		fallthrough
 	case irma.ActionDisclosing:
-		session.sendResponse(&irma.Disclosure{
-			Proofs:  message.(gabi.ProofList),
-			Indices: session.attrIndices,
-		})
+		session.sendResponse(&irma.DisclosureResponse{
+			Disclosure: irma.Disclosure{
+				Proofs:  message.(gabi.ProofList),
+				Indices: session.attrIndices,
+			},
+			Context: session.request.Base().GetContext(),
+			Nonce:   session.request.GetNonce(session.timestamp),
+		}, nil)
 	case irma.ActionIssuing:
-		session.sendResponse(&irma.IssueCommitmentMessage{
+		session.sendResponse(nil, &irma.IssueCommitmentMessage{
 			IssueCommitmentMessage: message.(*gabi.IssueCommitmentMessage),
 			Indices:                session.attrIndices,
 		})
@@ -840,17 +1608,20 @@ func (session *session) KeyshareCancelled() {
 
 func (session *session) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
 	session.finish(false)
-	session.Handler.KeyshareEnrollmentIncomplete(manager)
+	session.setStatus(irma.ClientStatusError)
+	session.dispatch(func() { session.Handler.KeyshareEnrollmentIncomplete(manager) })
 }
 
 func (session *session) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
 	session.finish(false)
-	session.Handler.KeyshareEnrollmentDeleted(manager)
+	session.setStatus(irma.ClientStatusError)
+	session.dispatch(func() { session.Handler.KeyshareEnrollmentDeleted(manager) })
 }
 
 func (session *session) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
 	session.finish(false)
-	session.Handler.KeyshareBlocked(manager, duration)
+	session.setStatus(irma.ClientStatusError)
+	session.dispatch(func() { session.Handler.KeyshareBlocked(manager, duration) })
 }
 
 func (session *session) KeyshareError(manager *irma.SchemeManagerIdentifier, err error) {
@@ -862,12 +1633,18 @@ func (session *session) KeyshareError(manager *irma.SchemeManagerIdentifier, err
 	session.fail(serr)
 }
 
+func (session *session) KeysharePinBackoff(manager irma.SchemeManagerIdentifier, duration int) {
+	session.dispatch(func() { session.Handler.KeysharePinBackoff(manager, duration) })
+}
+
 func (session *session) KeysharePin() {
-	session.Handler.StatusUpdate(session.Action, irma.ClientStatusConnected)
+	session.timePin(true)
+	session.setStatus(irma.ClientStatusConnected)
 }
 
 func (session *session) KeysharePinOK() {
-	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
+	session.timePin(false)
+	session.setStatus(irma.ClientStatusCommunicating)
 }
 
 func (s sessions) remove(token string) {
@@ -885,6 +1662,14 @@ func (s sessions) remove(token string) {
 	}
 }
 
+func (s sessions) list() []*session {
+	list := make([]*session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, session)
+	}
+	return list
+}
+
 func (s sessions) add(session *session) {
 	session.token = common.NewSessionToken()
 	s.sessions[session.token] = session
@@ -0,0 +1,106 @@
+package irmaclient
+
+import (
+	"net"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// sessionTransitions contains for each status of a session the statuses to which it may move.
+// The final statuses (see irma.ClientStatus.Finished()) have no outgoing transitions.
+var sessionTransitions = map[irma.ClientStatus][]irma.ClientStatus{
+	irma.ClientStatusCreated: {
+		irma.ClientStatusManualStarted, irma.ClientStatusCommunicating,
+		irma.ClientStatusCancelled, irma.ClientStatusTimeout, irma.ClientStatusError,
+	},
+	irma.ClientStatusManualStarted: {
+		irma.ClientStatusConnected, irma.ClientStatusCommunicating,
+		irma.ClientStatusCancelled, irma.ClientStatusError,
+	},
+	irma.ClientStatusCommunicating: {
+		irma.ClientStatusConnected, irma.ClientStatusPairing, irma.ClientStatusRetrying, irma.ClientStatusDone,
+		irma.ClientStatusCancelled, irma.ClientStatusTimeout, irma.ClientStatusError,
+	},
+	irma.ClientStatusRetrying: {
+		irma.ClientStatusCommunicating,
+		irma.ClientStatusCancelled, irma.ClientStatusTimeout, irma.ClientStatusError,
+	},
+	irma.ClientStatusPairing: {
+		irma.ClientStatusCommunicating,
+		irma.ClientStatusCancelled, irma.ClientStatusTimeout, irma.ClientStatusError,
+	},
+	irma.ClientStatusConnected: {
+		irma.ClientStatusCommunicating,
+		irma.ClientStatusCancelled, irma.ClientStatusTimeout, irma.ClientStatusError,
+	},
+}
+
+func legalTransition(from, to irma.ClientStatus) bool {
+	for _, status := range sessionTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the current status of the session, or of the session following it if it is
+// part of a chain of sessions.
+func (session *session) Status() irma.ClientStatus {
+	session.statusMutex.Lock()
+	next, status := session.next, session.status
+	session.statusMutex.Unlock()
+	if next != nil {
+		return next.Status()
+	}
+	return status
+}
+
+// nextSession returns the chained session that was started after this one, if any.
+func (session *session) nextSession() *session {
+	session.statusMutex.Lock()
+	defer session.statusMutex.Unlock()
+	return session.next
+}
+
+// setStatus moves the session to the specified status, and informs the handler if it is not final;
+// final statuses are reported by the Success, Cancelled and Failure methods of the handler.
+// Illegal transitions, such as status updates from a keyshare session that continues after the
+// session was dismissed, are logged and ignored, keeping the current status. Returns whether the
+// status was changed.
+func (session *session) setStatus(status irma.ClientStatus) bool {
+	session.statusMutex.Lock()
+	current := session.status
+	if current == status {
+		session.statusMutex.Unlock()
+		return false
+	}
+	if !legalTransition(current, status) {
+		session.statusMutex.Unlock()
+		irma.Logger.Warnf("ignoring illegal session status transition from %s to %s", current, status)
+		return false
+	}
+	session.status = status
+	session.statusMutex.Unlock()
+
+	if !status.Finished() {
+		action := session.Action
+		session.dispatch(func() { session.Handler.StatusUpdate(action, status) })
+	}
+	return true
+}
+
+// failureStatus returns the final status of a session that failed with the specified error.
+func failureStatus(err *irma.SessionError) irma.ClientStatus {
+	// The server forgets sessions when they expire
+	if err.ErrorType == irma.ErrorSessionUnknownOrExpired || err.ErrorType == irma.ErrorSessionExpired ||
+		(err.RemoteError != nil && err.RemoteError.ErrorName == "SESSION_UNKNOWN") {
+		return irma.ClientStatusTimeout
+	}
+	var netErr net.Error
+	if errors.As(err.Err, &netErr) && netErr.Timeout() {
+		return irma.ClientStatusTimeout
+	}
+	return irma.ClientStatusError
+}
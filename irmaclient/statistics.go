@@ -0,0 +1,155 @@
+package irmaclient
+
+import (
+	"sort"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains Statistics, counts over the credentials and logs of the client for display
+// in the app. They contain no attribute values, so they can be shown and exported safely.
+
+// statisticsExpiringSoon is how long before their expiry credentials count as expiring soon.
+const statisticsExpiringSoon = 30 * 24 * time.Hour
+
+// statisticsMostDisclosed is the maximum amount of attribute types in Statistics.MostDisclosed.
+const statisticsMostDisclosed = 10
+
+// Statistics contains counts over the credentials and logs of the client, see Client.Statistics.
+type Statistics struct {
+	Credentials int `json:"credentials"`
+	// CredentialsByScheme and CredentialsByIssuer count the credentials per scheme and issuer.
+	CredentialsByScheme map[irma.SchemeManagerIdentifier]int `json:"credentialsByScheme"`
+	CredentialsByIssuer map[irma.IssuerIdentifier]int        `json:"credentialsByIssuer"`
+	Expired             int                                  `json:"expired"`
+	// ExpiringSoon is the amount of valid credentials that expire within 30 days.
+	ExpiringSoon int `json:"expiringSoon"`
+
+	// SessionsByAction and SessionsByMonth count the sessions in the logs per action and per
+	// month in which they were completed, formatted as 2006-01 in local time. Dry runs are
+	// not counted.
+	SessionsByAction map[irma.Action]int `json:"sessionsByAction"`
+	SessionsByMonth  map[string]int      `json:"sessionsByMonth"`
+	// Disclosures is the amount of attributes disclosed in all sessions, and MostDisclosed the
+	// attribute types that were disclosed most often, most often first.
+	Disclosures   int                   `json:"disclosures"`
+	MostDisclosed []AttributeStatistics `json:"mostDisclosed,omitempty"`
+}
+
+// AttributeStatistics counts how often attributes of a type were disclosed.
+type AttributeStatistics struct {
+	Type  irma.AttributeTypeIdentifier `json:"type"`
+	Count int                          `json:"count"`
+}
+
+// logStatistics are the parts of Statistics derived from the logs, which are cached by the client
+// until the logs change, see invalidateStatistics.
+type logStatistics struct {
+	sessionsByAction map[irma.Action]int
+	sessionsByMonth  map[string]int
+	disclosures      int
+	mostDisclosed    []AttributeStatistics
+}
+
+// Statistics computes counts over the credentials and logs of the client. The counts over the
+// logs are computed the first time and cached until the logs change.
+func (client *Client) Statistics() (*Statistics, error) {
+	logStats, err := client.logStatistics()
+	if err != nil {
+		return nil, err
+	}
+	stats := &Statistics{
+		CredentialsByScheme: map[irma.SchemeManagerIdentifier]int{},
+		CredentialsByIssuer: map[irma.IssuerIdentifier]int{},
+		SessionsByAction:    map[irma.Action]int{},
+		SessionsByMonth:     map[string]int{},
+		Disclosures:         logStats.disclosures,
+		MostDisclosed:       append([]AttributeStatistics(nil), logStats.mostDisclosed...),
+	}
+	for action, count := range logStats.sessionsByAction {
+		stats.SessionsByAction[action] = count
+	}
+	for month, count := range logStats.sessionsByMonth {
+		stats.SessionsByMonth[month] = count
+	}
+
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+	now := client.now()
+	for credTypeID, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			stats.Credentials++
+			stats.CredentialsByScheme[credTypeID.SchemeManagerIdentifier()]++
+			stats.CredentialsByIssuer[credTypeID.IssuerIdentifier()]++
+			switch {
+			case !attrs.IsValidOn(now):
+				stats.Expired++
+			case !attrs.IsValidOn(now.Add(statisticsExpiringSoon)):
+				stats.ExpiringSoon++
+			}
+		}
+	}
+	return stats, nil
+}
+
+// logStatistics returns the cached statistics of the logs, computing them if necessary.
+func (client *Client) logStatistics() (*logStatistics, error) {
+	client.statisticsMutex.Lock()
+	defer client.statisticsMutex.Unlock()
+	if client.statistics != nil {
+		return client.statistics, nil
+	}
+
+	stats := &logStatistics{sessionsByAction: map[irma.Action]int{}, sessionsByMonth: map[string]int{}}
+	disclosed := map[irma.AttributeTypeIdentifier]int{}
+	err := client.storage.IterateLogs(func(entry *LogEntry) error {
+		if entry.Type == ActionRemoval || entry.DryRun {
+			return nil
+		}
+		stats.sessionsByAction[entry.Type]++
+		stats.sessionsByMonth[time.Time(entry.Time).Local().Format("2006-01")]++
+		attrs, err := entry.GetDisclosedCredentials(client.Configuration)
+		if err != nil {
+			// Logs of sessions involving since removed credential types or schemes
+			// cannot be parsed anymore; we count what we can
+			return nil
+		}
+		for _, con := range attrs {
+			for _, attr := range con {
+				stats.disclosures++
+				disclosed[attr.Identifier]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for id, count := range disclosed {
+		stats.mostDisclosed = append(stats.mostDisclosed, AttributeStatistics{Type: id, Count: count})
+	}
+	sort.Slice(stats.mostDisclosed, func(i, j int) bool {
+		a, b := stats.mostDisclosed[i], stats.mostDisclosed[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Type.String() < b.Type.String())
+	})
+	if len(stats.mostDisclosed) > statisticsMostDisclosed {
+		stats.mostDisclosed = stats.mostDisclosed[:statisticsMostDisclosed]
+	}
+
+	client.statistics = stats
+	return stats, nil
+}
+
+// invalidateStatistics discards the cached statistics of the logs if the event changes the logs.
+func (client *Client) invalidateStatistics(e Event) {
+	switch e.(type) {
+	case LogAppended, LogsPruned, CredentialsReplaced, SchemeUpdated:
+	default:
+		return
+	}
+	client.statisticsMutex.Lock()
+	defer client.statisticsMutex.Unlock()
+	client.statistics = nil
+}
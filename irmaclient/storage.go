@@ -7,7 +7,6 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"path/filepath"
-	"time"
 
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/revocation"
@@ -23,16 +22,87 @@ import (
 
 // Storage provider for a Client
 type storage struct {
-	storagePath   string
-	db            *bbolt.DB
+	storagePath   string // empty if the storage is kept in memory, see NewMemoryClient
+	db            database
 	Configuration *irma.Configuration
 	aesKey        [32]byte
+
+	recovery StorageRecoveryReport // see recovery.go
 }
 
 type transaction struct {
+	dbTx
+}
+
+// database is the key/value store underlying storage: a bbolt database (see boltDB),
+// or a memoryDB. The methods behave as their bbolt counterparts.
+type database interface {
+	View(func(dbTx) error) error
+	Update(func(dbTx) error) error
+	Close() error
+}
+
+type dbTx interface {
+	Bucket(name []byte) dbBucket // nil if the bucket does not exist
+	CreateBucketIfNotExists(name []byte) (dbBucket, error)
+	DeleteBucket(name []byte) error
+}
+
+type dbBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(func(key, value []byte) error) error
+	NextSequence() (uint64, error)
+	Cursor() dbCursor
+}
+
+type dbCursor interface {
+	Last() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+	Prev() (key, value []byte)
+}
+
+// boltDB, boltTx and boltBucket adapt bbolt to the database interface.
+type boltDB struct {
+	*bbolt.DB
+}
+
+type boltTx struct {
 	*bbolt.Tx
 }
 
+type boltBucket struct {
+	*bbolt.Bucket
+}
+
+func (db boltDB) View(f func(dbTx) error) error {
+	return db.DB.View(func(tx *bbolt.Tx) error { return f(boltTx{tx}) })
+}
+
+func (db boltDB) Update(f func(dbTx) error) error {
+	return db.DB.Update(func(tx *bbolt.Tx) error { return f(boltTx{tx}) })
+}
+
+func (tx boltTx) Bucket(name []byte) dbBucket {
+	if b := tx.Tx.Bucket(name); b != nil {
+		return boltBucket{b}
+	}
+	return nil
+}
+
+func (tx boltTx) CreateBucketIfNotExists(name []byte) (dbBucket, error) {
+	b, err := tx.Tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (b boltBucket) Cursor() dbCursor {
+	return b.Bucket.Cursor()
+}
+
 // Filenames
 const databaseFile = "db2"
 
@@ -44,6 +114,8 @@ const (
 	preferencesKey  = "preferences"  // Value: Preferences
 	updatesKey      = "updates"      // Value: []update
 	kssKey          = "kss"          // Value: map[irma.SchemeManagerIdentifier]*keyshareServer
+	nicknamesKey    = "nicknames"    // Value: map[string]string (credential hash to nickname)
+	requestorsKey   = "requestors"   // Value: map[irma.RequestorIdentifier]*KnownRequestor
 
 	attributesBucket = "attrs" // Key: []byte, value: []*irma.AttributeList
 	logsBucket       = "logs"  // Key: (auto-increment index), value: *LogEntry
@@ -63,16 +135,41 @@ func (s *storage) Open() error {
 	if err = common.AssertPathExists(s.storagePath); err != nil {
 		return err
 	}
-	s.db, err = bbolt.Open(s.path(databaseFile), 0600, &bbolt.Options{Timeout: 1 * time.Second})
-	return err
+	db, err := s.openDatabase()
+	if corruptDatabase(err) {
+		irma.Logger.Warnf("Database is corrupted: %v", err)
+		return s.resetDatabase()
+	}
+	if err != nil {
+		return err
+	}
+	s.db = boltDB{db}
+	return nil
 }
 
 func (s *storage) Close() error {
 	return s.db.Close()
 }
 
+// view and update run a read-only and read-write transaction respectively,
+// returning ErrClosed if the storage has been closed.
+func (s *storage) view(f func(dbTx) error) error {
+	return s.closedErr(s.db.View(f))
+}
+
+func (s *storage) update(f func(dbTx) error) error {
+	return s.closedErr(s.db.Update(f))
+}
+
+func (s *storage) closedErr(err error) error {
+	if err == bbolt.ErrDatabaseNotOpen {
+		return ErrClosed
+	}
+	return err
+}
+
 func (s *storage) BucketExists(name []byte) bool {
-	return s.db.View(func(tx *bbolt.Tx) error {
+	return s.view(func(tx dbTx) error {
 		if tx.Bucket(name) == nil {
 			return bbolt.ErrBucketNotFound
 		}
@@ -113,7 +210,6 @@ func (s *storage) txLoad(tx *transaction, bucketName string, key string, dest in
 		return false, nil
 	}
 	bts := b.Get([]byte(key))
-	b.Sequence()
 	if bts == nil {
 		return false, nil
 	}
@@ -127,7 +223,7 @@ func (s *storage) txLoad(tx *transaction, bucketName string, key string, dest in
 }
 
 func (s *storage) load(bucketName string, key string, dest interface{}) (found bool, err error) {
-	err = s.db.View(func(tx *bbolt.Tx) error {
+	err = s.view(func(tx dbTx) error {
 		found, err = s.txLoad(&transaction{tx}, bucketName, key, dest)
 		return err
 	})
@@ -135,7 +231,7 @@ func (s *storage) load(bucketName string, key string, dest interface{}) (found b
 }
 
 func (s *storage) Transaction(f func(*transaction) error) error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
+	return s.update(func(tx dbTx) error {
 		return f(&transaction{tx})
 	})
 }
@@ -277,8 +373,16 @@ func (s *storage) TxStoreKeyshareServers(tx *transaction, keyshareServers map[ir
 	return s.txStore(tx, userdataBucket, kssKey, keyshareServers)
 }
 
+func (s *storage) TxStoreNicknames(tx *transaction, nicknames map[string]string) error {
+	return s.txStore(tx, userdataBucket, nicknamesKey, nicknames)
+}
+
+func (s *storage) TxStoreKnownRequestors(tx *transaction, requestors map[irma.RequestorIdentifier]*KnownRequestor) error {
+	return s.txStore(tx, userdataBucket, requestorsKey, requestors)
+}
+
 func (s *storage) AddLogEntry(entry *LogEntry) error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
+	return s.update(func(tx dbTx) error {
 		return s.TxAddLogEntry(&transaction{tx}, entry)
 	})
 }
@@ -304,7 +408,10 @@ func (s *storage) TxAddLogEntry(tx *transaction, entry *LogEntry) error {
 		return err
 	}
 
-	return b.Put(k, ciphertext)
+	if err = b.Put(k, ciphertext); err != nil {
+		return err
+	}
+	return s.txChainLogEntry(tx, logRecord{key: k, value: ciphertext})
 }
 
 func (s *storage) logEntryKeyToBytes(id uint64) []byte {
@@ -379,7 +486,7 @@ func (s *storage) LoadSecretKey() (*secretKey, error) {
 
 func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*irma.AttributeList, err error) {
 	list = make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList)
-	return list, s.db.View(func(tx *bbolt.Tx) error {
+	return list, s.view(func(tx dbTx) error {
 		b := tx.Bucket([]byte(attributesBucket))
 		if b == nil {
 			return nil
@@ -414,10 +521,28 @@ func (s *storage) LoadKeyshareServers() (ksses map[irma.SchemeManagerIdentifier]
 	return
 }
 
+func (s *storage) LoadNicknames() (nicknames map[string]string, err error) {
+	nicknames = make(map[string]string)
+	_, err = s.load(userdataBucket, nicknamesKey, &nicknames)
+	return
+}
+
+func (s *storage) LoadKnownRequestors() (requestors map[irma.RequestorIdentifier]*KnownRequestor, err error) {
+	requestors = make(map[irma.RequestorIdentifier]*KnownRequestor)
+	_, err = s.load(userdataBucket, requestorsKey, &requestors)
+	return
+}
+
+func (s *storage) TxLoadKnownRequestors(tx *transaction) (requestors map[irma.RequestorIdentifier]*KnownRequestor, err error) {
+	requestors = make(map[irma.RequestorIdentifier]*KnownRequestor)
+	_, err = s.txLoad(tx, userdataBucket, requestorsKey, &requestors)
+	return
+}
+
 // Returns all logs stored before log with ID 'index' sorted from new to old with
 // a maximum result length of 'max'.
 func (s *storage) LoadLogsBefore(index uint64, max int) ([]*LogEntry, error) {
-	return s.loadLogs(max, func(c *bbolt.Cursor) (key, value []byte) {
+	return s.loadLogs(max, func(c dbCursor) (key, value []byte) {
 		c.Seek(s.logEntryKeyToBytes(index))
 		return c.Prev()
 	})
@@ -425,17 +550,17 @@ func (s *storage) LoadLogsBefore(index uint64, max int) ([]*LogEntry, error) {
 
 // Returns the latest logs stored sorted from new to old with a maximum result length of 'max'
 func (s *storage) LoadNewestLogs(max int) ([]*LogEntry, error) {
-	return s.loadLogs(max, func(c *bbolt.Cursor) (key, value []byte) {
+	return s.loadLogs(max, func(c dbCursor) (key, value []byte) {
 		return c.Last()
 	})
 }
 
 // Returns the logs stored sorted from new to old with a maximum result length of 'max' where the starting position
-// of the bbolt cursor can be manipulated by the anonymous function 'startAt'. 'startAt' should return
-// the key and the value of the first element from the bbolt database that should be loaded.
-func (s *storage) loadLogs(max int, startAt func(*bbolt.Cursor) (key, value []byte)) ([]*LogEntry, error) {
+// of the cursor can be manipulated by the anonymous function 'startAt'. 'startAt' should return
+// the key and the value of the first element from the database that should be loaded.
+func (s *storage) loadLogs(max int, startAt func(dbCursor) (key, value []byte)) ([]*LogEntry, error) {
 	logs := make([]*LogEntry, 0, max)
-	return logs, s.db.View(func(tx *bbolt.Tx) error {
+	return logs, s.view(func(tx dbTx) error {
 		bucket := tx.Bucket([]byte(logsBucket))
 		if bucket == nil {
 			return nil
@@ -461,7 +586,7 @@ func (s *storage) loadLogs(max int, startAt func(*bbolt.Cursor) (key, value []by
 
 // IterateLogs iterates over all logs sorted by time, starting with the newest one.
 func (s *storage) IterateLogs(handler func(log *LogEntry) error) error {
-	return s.db.View(func(tx *bbolt.Tx) error {
+	return s.view(func(tx dbTx) error {
 		return s.TxIterateLogs(&transaction{tx}, handler)
 	})
 }
@@ -515,14 +640,13 @@ func (s *storage) DeleteLogEntry(entry *LogEntry) error {
 }
 
 func (s *storage) TxDeleteLogEntry(tx *transaction, entry *LogEntry) error {
-	b := tx.Bucket([]byte(logsBucket))
-	if b == nil {
-		return nil
-	}
-	return b.Delete(s.logEntryKeyToBytes(entry.ID))
+	return s.TxDeleteLogEntries(tx, []uint64{entry.ID})
 }
 
 func (s *storage) TxDeleteLogs(tx *transaction) error {
+	if err := tx.DeleteBucket([]byte(logChainBucket)); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
 	return tx.DeleteBucket([]byte(logsBucket))
 }
 
@@ -559,6 +683,9 @@ func (s *storage) decrypt(ciphertext []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
 	plaintext, err := gcm.Open(nil, ciphertext[:12], ciphertext[12:], nil)
 	if err != nil {
 		return nil, err
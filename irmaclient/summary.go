@@ -0,0 +1,86 @@
+package irmaclient
+
+import (
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+)
+
+// SessionSummary describes the session request that the IRMA server sent, for diagnosing
+// interoperability problems with IRMA servers. It is passed to SessionStartedHandler.SessionStarted
+// and available using SessionDismisser.Summary.
+type SessionSummary struct {
+	Action irma.Action `json:"action"`
+	// ProtocolVersion is the version of the IRMA protocol that the client and server agreed on.
+	ProtocolVersion *irma.ProtocolVersion `json:"protocolVersion"`
+	// Hostname of the session URL; empty for manual sessions.
+	Hostname      string                `json:"hostname,omitempty"`
+	RequestorName irma.TranslatedString `json:"requestorName,omitempty"`
+	// Disjunctions is the amount of disjunctions of attributes to be disclosed.
+	Disjunctions int `json:"disjunctions"`
+	// Credentials is the amount of credentials to be issued.
+	Credentials int `json:"credentials"`
+	// KeyCounters contains the public keys with which the credentials are to be issued.
+	KeyCounters []*irma.PublicKeyIdentifier `json:"keyCounters,omitempty"`
+
+	// Nonce and Context are sensitive and only included if the log level of irma.Logger
+	// is debug or higher.
+	Nonce   *big.Int `json:"nonce,omitempty"`
+	Context *big.Int `json:"context,omitempty"`
+}
+
+// SessionStartedHandler can optionally be implemented by a Handler, to be informed of the
+// session request that the IRMA server sent as soon as it has been received and checked.
+type SessionStartedHandler interface {
+	SessionStarted(summary SessionSummary)
+}
+
+// summarize returns the summary of the session request.
+func (session *session) summarize() *SessionSummary {
+	summary := &SessionSummary{
+		Action:          session.Action,
+		ProtocolVersion: session.Version,
+		Hostname:        session.Hostname,
+		Disjunctions:    len(session.request.Disclosure().Disclose),
+	}
+	if session.RequestorInfo != nil {
+		summary.RequestorName = session.RequestorInfo.Name
+	}
+	if ir, ok := session.request.(*irma.IssuanceRequest); ok {
+		summary.Credentials = len(ir.Credentials)
+		for _, credreq := range ir.Credentials {
+			summary.KeyCounters = append(summary.KeyCounters, &irma.PublicKeyIdentifier{
+				Issuer:  credreq.CredentialTypeID.IssuerIdentifier(),
+				Counter: credreq.KeyCounter,
+			})
+		}
+	}
+	if irma.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		base := session.request.Base()
+		summary.Nonce, summary.Context = base.GetNonce(nil), base.GetContext()
+	}
+	return summary
+}
+
+// Summary returns the summary of the session request, or nil if it has not yet been received.
+// Of chained sessions, it returns that of the current session.
+func (session *session) Summary() *SessionSummary {
+	if next := session.nextSession(); next != nil {
+		return next.Summary()
+	}
+	session.statusMutex.Lock()
+	defer session.statusMutex.Unlock()
+	return session.summary
+}
+
+// setSummary stores the summary of the session request, and passes it to the handler if it
+// implements SessionStartedHandler.
+func (session *session) setSummary() {
+	summary := session.summarize()
+	session.statusMutex.Lock()
+	session.summary = summary
+	session.statusMutex.Unlock()
+	if h, ok := session.Handler.(SessionStartedHandler); ok {
+		session.dispatch(func() { h.SessionStarted(*summary) })
+	}
+}
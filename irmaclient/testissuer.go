@@ -0,0 +1,117 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// IssueLocally issues the credentials of the issuance request to the client, acting as the
+// issuer itself using the private keys from sks, so without an IRMA server or any network
+// traffic. It is meant for tests that need credentials in a wallet, e.g. with the private keys
+// of the test schemes. The client computes its commitments and constructs the credentials
+// exactly as in an issuance session, so the credentials are valid as long as the private keys
+// match the public keys in the client's configuration. No log entry is written.
+//
+// Credentials of schemes using a keyshare server, credentials supporting revocation and
+// issuance requests also requiring disclosures are not supported. A missing nonce, context or
+// protocol version of the request is set as an IRMA server would.
+func (client *Client) IssueLocally(request *irma.IssuanceRequest, sks irma.PrivateKeyRing) error {
+	if len(request.Disclose) > 0 {
+		return errors.New("local issuance does not support disclosures")
+	}
+	if err := client.setLocalIssuanceParameters(request); err != nil {
+		return err
+	}
+
+	// Check the request before computing commitments, which does not validate it
+	var pks []*gabikeys.PublicKey
+	for _, cred := range request.Credentials {
+		credtype := client.Configuration.CredentialTypes[cred.CredentialTypeID]
+		if credtype == nil {
+			return errors.Errorf("unknown credential type %s", cred.CredentialTypeID)
+		}
+		if client.Configuration.SchemeManagers[credtype.SchemeManagerIdentifier()].Distributed() {
+			return errors.Errorf("local issuance of %s requires its keyshare server", cred.CredentialTypeID)
+		}
+		if cred.RevocationSupported {
+			return errors.Errorf("local issuance of %s does not support revocation", cred.CredentialTypeID)
+		}
+		pk, err := client.Configuration.PublicKey(cred.CredentialTypeID.IssuerIdentifier(), cred.KeyCounter)
+		if err != nil {
+			return err
+		}
+		pks = append(pks, pk)
+	}
+
+	commitments, builders, err := client.IssueCommitments(request, nil)
+	if err != nil {
+		return err
+	}
+	msgs, err := issueSignatures(client.Configuration, request, commitments, pks, sks)
+	if err != nil {
+		return err
+	}
+	return client.ConstructCredentials(msgs, request, builders)
+}
+
+func (client *Client) setLocalIssuanceParameters(request *irma.IssuanceRequest) error {
+	base := request.Base()
+	if base.ProtocolVersion == nil {
+		base.ProtocolVersion = client.maxVersion
+	}
+	if base.Context == nil {
+		base.Context = big.NewInt(1)
+	}
+	if base.Nonce == nil {
+		nonce, err := gabi.GenerateNonce()
+		if err != nil {
+			return err
+		}
+		base.Nonce = nonce
+	}
+	return nil
+}
+
+// issueSignatures does what an IRMA server does upon receiving the commitments of an
+// issuance session: it verifies them and signs the credentials of the request.
+func issueSignatures(
+	conf *irma.Configuration,
+	request *irma.IssuanceRequest,
+	commitments *irma.IssueCommitmentMessage,
+	pks []*gabikeys.PublicKey,
+	sks irma.PrivateKeyRing,
+) ([]*gabi.IssueSignatureMessage, error) {
+	if !gabi.ProofList(commitments.Proofs).Verify(pks, request.GetContext(), request.GetNonce(nil), false, nil) {
+		return nil, errors.New("invalid issuance commitments")
+	}
+
+	now := time.Now()
+	var msgs []*gabi.IssueSignatureMessage
+	for i, cred := range request.Credentials {
+		sk, err := sks.Get(cred.CredentialTypeID.IssuerIdentifier(), cred.KeyCounter)
+		if err != nil {
+			return nil, err
+		}
+		proof, ok := commitments.Proofs[i].(*gabi.ProofU)
+		if !ok {
+			return nil, errors.New("received invalid issuance commitment")
+		}
+		attrs, err := cred.AttributeList(conf, irma.GetMetadataVersion(request.ProtocolVersion), nil, now)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := gabi.NewIssuer(sk, pks[i], request.GetContext()).IssueSignature(
+			proof.U, attrs.Ints, nil, commitments.Nonce2, conf.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeIndices(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
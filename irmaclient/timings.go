@@ -0,0 +1,130 @@
+package irmaclient
+
+import (
+	"time"
+)
+
+// PhaseTimings records when a session reached each of its phases, to find out where the time
+// of sessions goes. Phases that the session did not reach are nil. Time spent waiting for the
+// user is kept apart from the other phases by PhaseTimings.Durations, so that it is not mistaken
+// for slowness of the protocol.
+type PhaseTimings struct {
+	Started time.Time `json:"started"`
+	// RequestReceived is when the session request was received from the IRMA server.
+	RequestReceived *time.Time `json:"requestReceived,omitempty"`
+	// PermissionShown is when the permission request was passed to the Handler.
+	PermissionShown *time.Time `json:"permissionShown,omitempty"`
+	// PermissionAnswered is when the user answered the permission request.
+	PermissionAnswered *time.Time `json:"permissionAnswered,omitempty"`
+	// ProofsBuilt is when the response to the IRMA server was computed, including the keyshare
+	// protocol if the session involves keyshare servers.
+	ProofsBuilt *time.Time `json:"proofsBuilt,omitempty"`
+	// ResponsePosted is when the IRMA server accepted the response.
+	ResponsePosted *time.Time `json:"responsePosted,omitempty"`
+	Finished       *time.Time `json:"finished,omitempty"`
+	// PinEntry is the time spent waiting for the user to enter the PIN, which happens between
+	// PermissionAnswered and ProofsBuilt.
+	PinEntry time.Duration `json:"pinEntry,omitempty"`
+
+	pinRequested *time.Time
+}
+
+// PhaseDurations contains the durations of the phases of a session in milliseconds, in a shape
+// that is easily aggregated over many sessions. Phases that the session did not reach are 0.
+type PhaseDurations struct {
+	// Request is the time until the session request was received.
+	Request int64 `json:"request"`
+	// Processing is the time from receiving the session request until asking the user for
+	// permission, during which the client e.g. updates its schemes.
+	Processing int64 `json:"processing"`
+	// User is the time spent waiting for the user, to answer the permission request and to
+	// enter the PIN.
+	User int64 `json:"user"`
+	// Proofs is the time spent computing the response, excluding PIN entry.
+	Proofs int64 `json:"proofs"`
+	// Response is the time spent posting the response to the IRMA server.
+	Response int64 `json:"response"`
+	// Total is the duration of the whole session, and Protocol is Total minus User.
+	Total    int64 `json:"total"`
+	Protocol int64 `json:"protocol"`
+}
+
+// SessionTimingsHandler can optionally be implemented by a Handler, to receive the timings of
+// the session just before the session ends with Success, Failure or Cancelled.
+type SessionTimingsHandler interface {
+	SessionTimings(timings PhaseTimings)
+}
+
+// Durations returns the durations of the phases of the session.
+func (t PhaseTimings) Durations() PhaseDurations {
+	between := func(from, to *time.Time) int64 {
+		if from == nil || to == nil {
+			return 0
+		}
+		return to.Sub(*from).Milliseconds()
+	}
+	pin := t.PinEntry.Milliseconds()
+	d := PhaseDurations{
+		Request:    between(&t.Started, t.RequestReceived),
+		Processing: between(t.RequestReceived, t.PermissionShown),
+		User:       between(t.PermissionShown, t.PermissionAnswered) + pin,
+		Response:   between(t.ProofsBuilt, t.ResponsePosted),
+		Total:      between(&t.Started, t.Finished),
+	}
+	if proofs := between(t.PermissionAnswered, t.ProofsBuilt); proofs > 0 {
+		d.Proofs = proofs - pin
+	}
+	if d.Total > 0 {
+		d.Protocol = d.Total - d.User
+	}
+	return d
+}
+
+// Timings returns the timings of the session. Of chained sessions, it returns those of the
+// current session.
+func (session *session) Timings() PhaseTimings {
+	if next := session.nextSession(); next != nil {
+		return next.Timings()
+	}
+	session.statusMutex.Lock()
+	defer session.statusMutex.Unlock()
+	return session.timings
+}
+
+// timePhase records that the session reached the phase now, if it did not do so before.
+func (session *session) timePhase(phase func(*PhaseTimings) **time.Time) {
+	now := time.Now()
+	session.statusMutex.Lock()
+	defer session.statusMutex.Unlock()
+	if p := phase(&session.timings); *p == nil {
+		*p = &now
+	}
+}
+
+// timePin records that we started or stopped waiting for the user to enter the PIN.
+func (session *session) timePin(waiting bool) {
+	now := time.Now()
+	session.statusMutex.Lock()
+	defer session.statusMutex.Unlock()
+	t := &session.timings
+	switch {
+	case waiting && t.pinRequested == nil:
+		t.pinRequested = &now
+	case !waiting && t.pinRequested != nil:
+		t.PinEntry += now.Sub(*t.pinRequested)
+		t.pinRequested = nil
+	}
+}
+
+// reportTimings passes the timings of the session to the handler if it implements
+// SessionTimingsHandler.
+func (session *session) reportTimings() {
+	session.timePin(false)
+	session.timePhase(func(t *PhaseTimings) **time.Time { return &t.Finished })
+	if h, ok := session.Handler.(SessionTimingsHandler); ok {
+		session.statusMutex.Lock()
+		timings := session.timings
+		session.statusMutex.Unlock()
+		session.dispatch(func() { h.SessionTimings(timings) })
+	}
+}
@@ -0,0 +1,267 @@
+package irmaclient
+
+import (
+	irma "github.com/privacybydesign/irmago"
+)
+
+// UnsatisfiedReason classifies why the user cannot satisfy a disjunction of a session request.
+type UnsatisfiedReason string
+
+const (
+	// The user has no credential of the requested type
+	UnsatisfiedNoCredential = UnsatisfiedReason("NoCredential")
+	// The user has credentials of the requested type, but not with the requested attribute values
+	UnsatisfiedWrongValue = UnsatisfiedReason("WrongValue")
+	// The user has a credential with the requested values, but it has expired
+	UnsatisfiedExpired = UnsatisfiedReason("Expired")
+	// The user has a credential with the requested values, but it has been revoked
+	UnsatisfiedRevoked = UnsatisfiedReason("Revoked")
+	// The user has a credential with the requested values, but it was issued without the
+	// nonrevocation witness needed for the nonrevocation proof that the request asks for
+	UnsatisfiedNoWitness = UnsatisfiedReason("NoWitness")
+	// The user declined to receive a credential of the requested type earlier in the chain of sessions
+	UnsatisfiedDeclined = UnsatisfiedReason("Declined")
+	// The user has credentials satisfying the disjunction, but they belong to a scheme with a
+	// keyshare server and the user lacks the registration credential of that keyshare server
+	UnsatisfiedKeyshareRegistrationMissing = UnsatisfiedReason("KeyshareRegistrationMissing")
+	// As UnsatisfiedKeyshareRegistrationMissing, but the user's registration credential has expired
+	UnsatisfiedKeyshareRegistrationExpired = UnsatisfiedReason("KeyshareRegistrationExpired")
+)
+
+// UnsatisfiableRequest explains why the user cannot satisfy a session request, so that the user
+// can be told what to do about it. It is passed to Handler.Unsatisfiable.
+type UnsatisfiableRequest struct {
+	// Disjunctions is the amount of disjunctions in the request, including satisfiable ones.
+	Disjunctions int `json:"disjunctions"`
+	// Unsatisfied contains an item for each disjunction that the user cannot satisfy.
+	Unsatisfied []*UnsatisfiedDisCon `json:"unsatisfied"`
+	// EmptyWallet is true if the user has no credentials at all apart from those of keyshare
+	// servers, e.g. right after installing the app, so that the app can show how to get started
+	// instead of listing everything that is missing.
+	EmptyWallet bool `json:"emptyWallet,omitempty"`
+}
+
+// UnsatisfiedDisCon explains why the user cannot satisfy a disjunction. Of the options of the
+// disjunction it describes the one that the user comes closest to satisfying: first those for
+// which the user only has to renew an expired credential, then revoked ones, then those requiring
+// different attribute values, and finally those for which the user has no credential at all.
+type UnsatisfiedDisCon struct {
+	// Index of the disjunction within the request.
+	Index int `json:"index"`
+	// Reason why the option cannot be satisfied.
+	Reason UnsatisfiedReason `json:"reason"`
+	// CredentialType is the type of the credential that the user lacks.
+	CredentialType irma.CredentialTypeIdentifier `json:"credentialType"`
+	// Nearest is the credential of the user of this type that comes closest to satisfying the
+	// option, e.g. the expired credential that needs renewing; nil if the user has none.
+	Nearest *irma.CredentialInfo `json:"nearest,omitempty"`
+	// CredentialTypeName and IssuerName are the names of the credential type and its issuer.
+	CredentialTypeName irma.TranslatedString `json:"credentialTypeName,omitempty"`
+	IssuerName         irma.TranslatedString `json:"issuerName,omitempty"`
+	// IssueURL is the web page at which the credential can be obtained, if the scheme specifies it.
+	IssueURL *irma.TranslatedString `json:"issueUrl,omitempty"`
+	// KeyshareScheme is set if Reason is UnsatisfiedKeyshareRegistrationMissing or
+	// UnsatisfiedKeyshareRegistrationExpired, to the scheme of the keyshare server. Enrolling
+	// again using Client.KeyshareEnroll issues a new registration credential.
+	KeyshareScheme *irma.SchemeManagerIdentifier `json:"keyshareScheme,omitempty"`
+}
+
+// severity orders the reasons from easiest to hardest to solve for the user.
+func (reason UnsatisfiedReason) severity() int {
+	switch reason {
+	case UnsatisfiedExpired:
+		return 1
+	case UnsatisfiedNoWitness:
+		return 2
+	case UnsatisfiedRevoked:
+		return 3
+	case UnsatisfiedWrongValue:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// missingWitness returns a credential type of which the user has a credential that would satisfy
+// the request if it had a nonrevocation witness, if that is the nearest option of any of the
+// unsatisfied disjunctions.
+func (request *UnsatisfiableRequest) missingWitness() *irma.CredentialTypeIdentifier {
+	if request == nil {
+		return nil
+	}
+	for _, unsatisfied := range request.Unsatisfied {
+		if unsatisfied.Reason == UnsatisfiedNoWitness {
+			return &unsatisfied.CredentialType
+		}
+	}
+	return nil
+}
+
+// unsatisfiedDisCon explains why the specified disjunction, which the user cannot satisfy,
+// is unsatisfiable.
+func (client *Client) unsatisfiedDisCon(base *irma.BaseRequest, index int, discon irma.AttributeDisCon) *UnsatisfiedDisCon {
+	var nearest *UnsatisfiedDisCon
+	for _, con := range discon {
+		// Of each option, the credential type that is hardest to obtain determines how
+		// near the user is to satisfying it
+		var option *UnsatisfiedDisCon
+		for _, credTypeID := range con.CredentialTypes() {
+			unsatisfied := client.unsatisfiedCredType(base, credTypeID, con)
+			if unsatisfied != nil && (option == nil || unsatisfied.Reason.severity() > option.Reason.severity()) {
+				option = unsatisfied
+			}
+		}
+		if option != nil && (nearest == nil || option.Reason.severity() < nearest.Reason.severity()) {
+			nearest = option
+		}
+	}
+	if nearest == nil {
+		return nil
+	}
+	nearest.Index = index
+	client.describeUnsatisfied(nearest)
+	return nearest
+}
+
+// describeUnsatisfied sets the names of the credential type and issuer of the specified
+// unsatisfied disjunction, and where to obtain the credential.
+func (client *Client) describeUnsatisfied(unsatisfied *UnsatisfiedDisCon) {
+	if credtype := client.Configuration.CredentialTypes[unsatisfied.CredentialType]; credtype != nil {
+		unsatisfied.CredentialTypeName = credtype.Name
+		unsatisfied.IssueURL = credtype.IssueURL
+	}
+	if issuer := client.Configuration.Issuers[unsatisfied.CredentialType.IssuerIdentifier()]; issuer != nil {
+		unsatisfied.IssuerName = issuer.Name
+	}
+}
+
+// keyshareRegistrationDisCon checks, for a disjunction that the user can satisfy, whether the
+// user holds a valid registration credential of the keyshare server of the scheme of each
+// candidate. If none of the usable options of the disjunction can be disclosed for lack of such a
+// credential, it explains why, preferring options of which the registration credential has
+// expired over those of which it is missing. Otherwise it returns nil.
+func (client *Client) keyshareRegistrationDisCon(index int, candidates []DisclosureCandidates) *UnsatisfiedDisCon {
+	var nearest *UnsatisfiedDisCon
+	for _, option := range candidates {
+		if !option.usable() {
+			continue
+		}
+		var unsatisfied *UnsatisfiedDisCon
+		for _, schemeID := range option.schemes() {
+			unsatisfied = client.keyshareRegistration(schemeID)
+			if unsatisfied != nil {
+				break
+			}
+		}
+		if unsatisfied == nil {
+			return nil
+		}
+		if nearest == nil || unsatisfied.Reason == UnsatisfiedKeyshareRegistrationExpired {
+			nearest = unsatisfied
+		}
+	}
+	if nearest == nil {
+		return nil
+	}
+	nearest.Index = index
+	client.describeUnsatisfied(nearest)
+	return nearest
+}
+
+// keyshareRegistration returns why the user has no valid registration credential of the keyshare
+// server of the specified scheme, or nil if the user has one or the scheme does not need it.
+func (client *Client) keyshareRegistration(schemeID irma.SchemeManagerIdentifier) *UnsatisfiedDisCon {
+	scheme := client.Configuration.SchemeManagers[schemeID]
+	if scheme == nil || !scheme.Distributed() || scheme.KeyshareAttribute == "" {
+		return nil
+	}
+	credTypeID := irma.NewAttributeTypeIdentifier(scheme.KeyshareAttribute).CredentialTypeIdentifier()
+	result := &UnsatisfiedDisCon{
+		Reason:         UnsatisfiedKeyshareRegistrationMissing,
+		CredentialType: credTypeID,
+		KeyshareScheme: &schemeID,
+	}
+	for _, attrs := range client.attributes[credTypeID] {
+		if attrs.Revoked {
+			continue
+		}
+		if attrs.IsValidOn(client.now()) {
+			return nil
+		}
+		result.Reason = UnsatisfiedKeyshareRegistrationExpired
+		result.Nearest = attrs.Info()
+	}
+	return result
+}
+
+// usable returns whether the attributes can be disclosed, i.e. none of them is expired or revoked.
+func (dc DisclosureCandidates) usable() bool {
+	for _, cand := range dc {
+		if cand.Expired || cand.Revoked {
+			return false
+		}
+	}
+	return true
+}
+
+// schemes returns the schemes of the attributes, in order of first occurrence.
+func (dc DisclosureCandidates) schemes() []irma.SchemeManagerIdentifier {
+	var schemes []irma.SchemeManagerIdentifier
+	seen := map[irma.SchemeManagerIdentifier]struct{}{}
+	for _, cand := range dc {
+		schemeID := cand.Type.CredentialTypeIdentifier().SchemeManagerIdentifier()
+		if _, ok := seen[schemeID]; ok {
+			continue
+		}
+		seen[schemeID] = struct{}{}
+		schemes = append(schemes, schemeID)
+	}
+	return schemes
+}
+
+// walletEmpty returns whether the user has no credentials other than those of keyshare servers,
+// which are issued when registering at the keyshare server.
+func (client *Client) walletEmpty() bool {
+	for credTypeID, attrs := range client.attributes {
+		if len(attrs) > 0 && !client.keyshareCredentialType(credTypeID) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyshareCredentialType returns whether the specified credential type contains the attribute
+// with which the keyshare server of its scheme identifies users.
+func (client *Client) keyshareCredentialType(credTypeID irma.CredentialTypeIdentifier) bool {
+	scheme := client.Configuration.SchemeManagers[credTypeID.SchemeManagerIdentifier()]
+	return scheme != nil && scheme.KeyshareAttribute != "" &&
+		irma.NewAttributeTypeIdentifier(scheme.KeyshareAttribute).CredentialTypeIdentifier() == credTypeID
+}
+
+// unsatisfiedCredType returns why the user has no usable credential of the specified type
+// satisfying the conjunction, or nil if the user has one.
+func (client *Client) unsatisfiedCredType(
+	base *irma.BaseRequest, credTypeID irma.CredentialTypeIdentifier, con irma.AttributeCon,
+) *UnsatisfiedDisCon {
+	result := &UnsatisfiedDisCon{Reason: UnsatisfiedNoCredential, CredentialType: credTypeID}
+	for _, attrs := range client.attributes[credTypeID] {
+		satisfies, usable := client.satisfiesCon(base, attrs, con)
+		reason := UnsatisfiedWrongValue
+		switch {
+		case satisfies && usable:
+			return nil
+		case satisfies && attrs.Revoked:
+			reason = UnsatisfiedRevoked
+		case satisfies && attrs.IsValidOn(client.now()):
+			// satisfiesCon deems valid unrevoked credentials only unusable without witness
+			reason = UnsatisfiedNoWitness
+		case satisfies:
+			reason = UnsatisfiedExpired
+		}
+		if reason.severity() < result.Reason.severity() {
+			result.Reason = reason
+			result.Nearest = attrs.Info()
+		}
+	}
+	return result
+}
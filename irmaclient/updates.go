@@ -242,7 +242,7 @@ var clientUpdates = []func(client *Client) error{
 
 			// Overwrite old with newly formatted log entry.
 			for _, log := range toBeMigratedLogs {
-				if err := storageOld.WriteLogEntry(bucket, log); err != nil {
+				if err := storageOld.WriteLogEntry(boltBucket{bucket}, log); err != nil {
 					return err
 				}
 			}
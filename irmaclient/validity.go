@@ -0,0 +1,71 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/gabikeys"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// ValidityPolicy decides whether the client accepts credentials with the validity chosen by the
+// issuer, e.g. to refuse absurdly short or long validities.
+type ValidityPolicy interface {
+	// Allow is called for each credential of an issuance session before the user is asked for
+	// permission, along with the public key with which the credential is to be issued. If it
+	// returns an error, the session fails with irma.ErrorValidityRefused.
+	Allow(credential irma.CredentialTypeIdentifier, validity *irma.CredentialValidity, pk *gabikeys.PublicKey) error
+}
+
+// ValidityPolicyFunc is a function implementing ValidityPolicy.
+type ValidityPolicyFunc func(credential irma.CredentialTypeIdentifier, validity *irma.CredentialValidity, pk *gabikeys.PublicKey) error
+
+func (f ValidityPolicyFunc) Allow(credential irma.CredentialTypeIdentifier, validity *irma.CredentialValidity, pk *gabikeys.PublicKey) error {
+	return f(credential, validity, pk)
+}
+
+// ValidityLimits returns a ValidityPolicy that refuses credentials that are valid for less than
+// the specified duration after their signing date, and credentials that remain valid after the
+// public key with which they are issued expires.
+func ValidityLimits(minimum time.Duration) ValidityPolicy {
+	return ValidityPolicyFunc(func(credential irma.CredentialTypeIdentifier, validity *irma.CredentialValidity, pk *gabikeys.PublicKey) error {
+		if validity.Duration() < minimum {
+			return errors.Errorf("%s would be valid for %s, less than the minimum of %s", credential, validity.Duration(), minimum)
+		}
+		if time.Time(validity.Expires).Unix() > pk.ExpiryDate {
+			return errors.Errorf("%s would remain valid after its public key %s-%d expires", credential, credential.IssuerIdentifier(), pk.Counter)
+		}
+		return nil
+	})
+}
+
+// SetValidityPolicy sets the policy consulted for the validity of all credentials to be issued.
+// A nil policy accepts all validities.
+func (client *Client) SetValidityPolicy(policy ValidityPolicy) {
+	client.policyMutex.Lock()
+	defer client.policyMutex.Unlock()
+	client.validityPolicy = policy
+}
+
+// checkValidities consults the ValidityPolicy of the client for the credentials of the issuance
+// request, of which the CredentialChanges must have been computed.
+func (session *session) checkValidities(ir *irma.IssuanceRequest) *irma.SessionError {
+	session.client.policyMutex.Lock()
+	policy := session.client.validityPolicy
+	session.client.policyMutex.Unlock()
+	if policy == nil {
+		return nil
+	}
+
+	for _, change := range ir.CredentialChanges {
+		credreq := ir.Credentials[change.Credential]
+		pk, err := session.client.Configuration.PublicKey(credreq.CredentialTypeID.IssuerIdentifier(), credreq.KeyCounter)
+		if err != nil {
+			return &irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err}
+		}
+		if err = policy.Allow(credreq.CredentialTypeID, change.Validity, pk); err != nil {
+			return &irma.SessionError{ErrorType: irma.ErrorValidityRefused, Info: credreq.CredentialTypeID.String(), Err: err}
+		}
+	}
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -54,6 +55,8 @@ type Configuration struct {
 
 	// Listeners for configuration changes from initialization and updating of the schemes
 	UpdateListeners []ConfigurationListener
+	// Listeners for the time according to the servers of the schemes, when checking for updates
+	ServerDateListeners []ServerDateListener
 
 	// Path to the irma_configuration folder that this instance represents
 	Path        string
@@ -63,14 +66,30 @@ type Configuration struct {
 	Warnings    []string `json:"-"`
 
 	options     ConfigurationOptions
+	jobs        []*gocron.Job // jobs scheduled on Scheduler, see RemoveJobs
 	initialized bool
 	assets      string
 	readOnly    bool
+
+	// developerMode allows unsigned schemes, see SetDeveloperMode
+	developerMode bool
+
+	attrIndex           *attributeIndex // see AttributeIndex
+	attributeIndexMutex sync.Mutex      // guards attrIndex
+
+	// validation collects the problems found while parsing, during ValidateScheme
+	validation *schemeValidation
+
+	downloads      map[string]*cacheDownload // see coalesce
+	downloadsMutex sync.Mutex                // guards downloads
 }
 
 // ConfigurationListeners are the interface provided to react to changes in schemes.
 type ConfigurationListener func(conf *Configuration)
 
+// ServerDateListeners receive the time according to the Date header of responses of scheme servers.
+type ServerDateListener func(date time.Time)
+
 type UnknownIdentifierError struct {
 	ErrorType
 	Missing *IrmaIdentifierSet
@@ -88,6 +107,17 @@ type ConfigurationOptions struct {
 	RevocationDBConnStr string
 	RevocationDBType    string
 	RevocationSettings  RevocationSettings
+
+	// Scheduler to run periodic jobs on. If nil, ParseFolder creates and starts a new one.
+	// Processes that create many configurations can share one, see Configuration.RemoveJobs.
+	Scheduler *gocron.Scheduler
+
+	// KeyCache, if set, is used to download public keys of issuers on demand from the servers of
+	// their schemes when they are absent from the scheme directories, see KeyCache.
+	KeyCache KeyCache
+	// KeyCacheTTL is how long downloaded scheme indices are cached in the KeyCache before they
+	// are downloaded again; by default an hour.
+	KeyCacheTTL time.Duration
 }
 
 // NewConfiguration returns a new configuration. After this
@@ -198,8 +228,12 @@ func (conf *Configuration) ParseFolder() (err error) {
 	}
 
 	if conf.Revocation == nil {
-		conf.Scheduler = gocron.NewScheduler(time.UTC)
-		conf.Scheduler.StartAsync()
+		if conf.options.Scheduler != nil {
+			conf.Scheduler = conf.options.Scheduler
+		} else {
+			conf.Scheduler = gocron.NewScheduler(time.UTC)
+			conf.Scheduler.StartAsync()
+		}
 		conf.Revocation = &RevocationStorage{conf: conf}
 		if err = conf.Revocation.Load(
 			Logger.IsLevelEnabled(logrus.DebugLevel),
@@ -253,6 +287,15 @@ func (conf *Configuration) ParseOrRestoreFolder() (rerr error) {
 	return rerr
 }
 
+// RemoveJobs removes the periodic jobs of the configuration from its Scheduler, for when the
+// configuration is discarded while the Scheduler, being shared, keeps running.
+func (conf *Configuration) RemoveJobs() {
+	for _, job := range conf.jobs {
+		conf.Scheduler.RemoveByReference(job)
+	}
+	conf.jobs = nil
+}
+
 // Download downloads the issuers, credential types and public keys specified in set
 // if the current Configuration does not already have them, and checks their authenticity
 // using the scheme index.
@@ -322,7 +365,11 @@ func (conf *Configuration) PublicKey(id IssuerIdentifier, counter uint) (*gabike
 			return nil, err
 		}
 	}
-	return conf.publicKeys.Get(PublicKeyIdentifier{id, counter}), nil
+	pk := conf.publicKeys.Get(PublicKeyIdentifier{id, counter})
+	if pk == nil && conf.options.KeyCache != nil {
+		return conf.downloadPublicKey(id, counter)
+	}
+	return pk, nil
 }
 
 // PublicKeyLatest returns the latest private key of the specified issuer.
@@ -342,9 +389,84 @@ func (conf *Configuration) PublicKeyIndices(issuerid IssuerIdentifier) (i []uint
 	return matchKeyPattern(filepath.Join(scheme.path(), issuerid.Name(), "PublicKeys", "*"))
 }
 
-func (conf *Configuration) ValidateKeys() error {
-	const expiryBoundary = int64(time.Hour/time.Second) * 24 * 31 // 1 month, TODO make configurable
+// KeyExpiryWarningPeriod is the period before the expiry of a public key in which it is
+// deprecated, see KeyStatus.
+const KeyExpiryWarningPeriod = 31 * 24 * time.Hour
+
+// KeyStatus is the status of a public key of an issuer at some time, see Configuration.KeyStatus.
+type KeyStatus string
+
+const (
+	// KeyStatusValid means that the key is the newest unexpired key of its issuer, and does not
+	// expire within KeyExpiryWarningPeriod.
+	KeyStatusValid = KeyStatus("valid")
+	// KeyStatusDeprecated means that the key has not expired, but either expires within
+	// KeyExpiryWarningPeriod, or the issuer has rolled over to a newer unexpired key.
+	KeyStatusDeprecated = KeyStatus("deprecated")
+	// KeyStatusExpired means that the key has expired, so that no credentials are to be issued
+	// with it anymore.
+	KeyStatusExpired = KeyStatus("expired")
+)
 
+// LatestKey returns the newest public key of the specified issuer that has not expired, which is
+// the one with which new credentials of the issuer are to be issued.
+func (conf *Configuration) LatestKey(id IssuerIdentifier) (*gabikeys.PublicKey, error) {
+	if conf.Issuers[id] == nil {
+		return nil, errors.Errorf("unknown issuer %s", id)
+	}
+	indices, err := conf.PublicKeyIndices(id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	for i := len(indices) - 1; i >= 0; i-- {
+		pk, err := conf.PublicKey(id, indices[i])
+		if err != nil {
+			return nil, err
+		}
+		if pk != nil && now <= pk.ExpiryDate {
+			return pk, nil
+		}
+	}
+	return nil, errors.Errorf("issuer %s has no unexpired public keys", id)
+}
+
+// KeyStatus returns the status of the specified public key at the specified time.
+func (conf *Configuration) KeyStatus(id PublicKeyIdentifier, at time.Time) (KeyStatus, error) {
+	pk, err := conf.PublicKey(id.Issuer, id.Counter)
+	if err != nil {
+		return "", err
+	}
+	if pk == nil {
+		return "", errors.Errorf("unknown public key %s-%d", id.Issuer, id.Counter)
+	}
+	if at.Unix() > pk.ExpiryDate {
+		return KeyStatusExpired, nil
+	}
+	if at.Add(KeyExpiryWarningPeriod).Unix() > pk.ExpiryDate {
+		return KeyStatusDeprecated, nil
+	}
+
+	indices, err := conf.PublicKeyIndices(id.Issuer)
+	if err != nil {
+		return "", err
+	}
+	for _, counter := range indices {
+		if counter <= id.Counter {
+			continue
+		}
+		newer, err := conf.PublicKey(id.Issuer, counter)
+		if err != nil {
+			return "", err
+		}
+		if newer != nil && at.Unix() <= newer.ExpiryDate {
+			return KeyStatusDeprecated, nil
+		}
+	}
+	return KeyStatusValid, nil
+}
+
+func (conf *Configuration) ValidateKeys() error {
 	for issuerid, issuer := range conf.Issuers {
 		if err := conf.parseKeysFolder(issuerid); err != nil {
 			return err
@@ -360,16 +482,18 @@ func (conf *Configuration) ValidateKeys() error {
 		if err != nil {
 			return err
 		}
+		scheme := conf.SchemeManagers[issuerid.SchemeManagerIdentifier()]
+		latestfile := filepath.Join(scheme.path(), issuerid.Name(), "PublicKeys", fmt.Sprintf("%d.xml", indices[len(indices)-1]))
 
 		// Check expiry date public keys only if issuer is not deprecated
 		now := time.Now()
 		if issuer.DeprecatedSince.IsZero() || issuer.DeprecatedSince.After(Timestamp(now)) {
 			if latest == nil || latest.ExpiryDate < now.Unix() {
-				conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no nonexpired public keys", issuerid.String()))
+				conf.addWarning(latestfile, "Issuer %s has no nonexpired public keys", issuerid.String())
 			}
-			if latest != nil && latest.ExpiryDate > now.Unix() && latest.ExpiryDate < now.Unix()+expiryBoundary {
-				conf.Warnings = append(conf.Warnings, fmt.Sprintf("Latest public key of issuer %s expires soon (at %s)",
-					issuerid.String(), time.Unix(latest.ExpiryDate, 0).String()))
+			if latest != nil && latest.ExpiryDate > now.Unix() && latest.ExpiryDate < now.Add(KeyExpiryWarningPeriod).Unix() {
+				conf.addWarning(latestfile, "Latest public key of issuer %s expires soon (at %s)",
+					issuerid.String(), time.Unix(latest.ExpiryDate, 0).String())
 			}
 		}
 
@@ -435,6 +559,19 @@ func (conf *Configuration) KeyshareServerPublicKey(schemeid SchemeManagerIdentif
 	return conf.kssPublicKeys[schemeid][i], nil
 }
 
+// SetDeveloperMode sets whether schemes lacking a signature (i.e. an index.sig file) may be
+// installed, updated and parsed, which is convenient when developing schemes but dangerous
+// otherwise. Schemes having a signature are still verified against it. The schemes should be
+// reparsed for this to take effect on schemes that were already parsed.
+func (conf *Configuration) SetDeveloperMode(enabled bool) {
+	conf.developerMode = enabled
+}
+
+// DeveloperMode returns whether unsigned schemes are allowed, see SetDeveloperMode.
+func (conf *Configuration) DeveloperMode() bool {
+	return conf.developerMode
+}
+
 // IsInitialized indicates whether this instance has successfully been initialized.
 func (conf *Configuration) IsInitialized() bool {
 	return conf.initialized
@@ -474,34 +611,50 @@ func (conf *Configuration) parseKeysFolder(issuerid IssuerIdentifier) error {
 	}
 
 	for _, file := range files {
-		filename := filepath.Base(file)
-		count := filename[:len(filename)-4]
-		i, err := strconv.ParseUint(count, 10, 32)
-		if err != nil {
-			return err
-		}
-		relativepath, err := filepath.Rel(scheme.path(), file)
-		if err != nil {
-			return err
-		}
-		bts, found, err := conf.readSignedFile(scheme.index, scheme.path(), relativepath)
-		if err != nil || !found {
-			return err
-		}
-		pk, err := gabikeys.NewPublicKeyFromBytes(bts)
-		if err != nil {
+		pk, err := conf.parsePublicKeyFile(scheme, issuerid, file)
+		if err != nil || pk == nil {
 			return err
 		}
-		if pk.Counter != uint(i) {
-			return errors.Errorf("Public key %s of issuer %s has wrong <Counter>", file, issuerid.String())
-		}
-		pk.Issuer = issuerid.String()
-		conf.publicKeys.Set(PublicKeyIdentifier{issuerid, uint(i)}, pk)
+		conf.publicKeys.Set(PublicKeyIdentifier{issuerid, pk.Counter}, pk)
 	}
 
 	return nil
 }
 
+// parsePublicKeyFile parses the specified public key file of the issuer, returning nil if the file
+// is not signed.
+func (conf *Configuration) parsePublicKeyFile(scheme *SchemeManager, issuerid IssuerIdentifier, file string) (*gabikeys.PublicKey, error) {
+	filename := filepath.Base(file)
+	count := filename[:len(filename)-4]
+	i, err := strconv.ParseUint(count, 10, 32)
+	if err != nil {
+		return nil, &schemeFileError{path: file, err: err}
+	}
+	relativepath, err := filepath.Rel(scheme.path(), file)
+	if err != nil {
+		return nil, err
+	}
+	bts, found, err := conf.readSignedFile(scheme.index, scheme.path(), relativepath)
+	if err != nil || !found {
+		return nil, err
+	}
+	return parsePublicKey(issuerid, uint(i), file, bts)
+}
+
+// parsePublicKey parses the public key of the issuer with the specified counter from the contents
+// of the public key file at path.
+func parsePublicKey(issuerid IssuerIdentifier, counter uint, path string, bts []byte) (*gabikeys.PublicKey, error) {
+	pk, err := gabikeys.NewPublicKeyFromBytes(bts)
+	if err != nil {
+		return nil, &schemeFileError{path: path, err: err}
+	}
+	if pk.Counter != counter {
+		return nil, &schemeFileError{path: path, err: errors.Errorf("Public key %s of issuer %s has wrong <Counter>", path, issuerid.String())}
+	}
+	pk.Issuer = issuerid.String()
+	return pk, nil
+}
+
 func sorter(ints []uint) func(i, j int) bool {
 	return func(i, j int) bool { return ints[i] < ints[j] }
 }
@@ -528,6 +681,7 @@ func (conf *Configuration) clear() {
 	conf.Issuers = make(map[IssuerIdentifier]*Issuer)
 	conf.CredentialTypes = make(map[CredentialTypeIdentifier]*CredentialType)
 	conf.AttributeTypes = make(map[AttributeTypeIdentifier]*AttributeType)
+	conf.invalidateAttributeIndex()
 	conf.DisabledSchemeManagers = make(map[SchemeManagerIdentifier]*SchemeManagerError)
 	conf.RequestorSchemes = make(map[RequestorSchemeIdentifier]*RequestorScheme)
 	conf.Requestors = make(map[string]*RequestorInfo)
@@ -568,7 +722,7 @@ func (conf *Configuration) checkCredentialTypes(session SessionRequest, missing
 
 			// Check for attributes in the request that are not in the credential configuration
 			for reqAttr := range credreq.Attributes {
-				attrID := NewAttributeTypeIdentifier(credreq.CredentialTypeID.String() + "." + reqAttr)
+				attrID := credreq.CredentialTypeID.AttributeTypeIdentifier(reqAttr)
 				if !typ.ContainsAttribute(attrID) {
 					missing.AttributeTypes[attrID] = struct{}{}
 				}
@@ -643,7 +797,8 @@ func (conf *Configuration) checkIssuers(set *IrmaIdentifierSet, missing *IrmaIde
 
 func (conf *Configuration) validateIssuer(scheme *SchemeManager, issuer *Issuer, dir string) error {
 	issuerid := issuer.Identifier()
-	conf.validateTranslations(fmt.Sprintf("Issuer %s", issuerid.String()), issuer, issuer.Languages)
+	description := filepath.Join(dir, "description.xml")
+	conf.validateTranslations(description, fmt.Sprintf("Issuer %s", issuerid.String()), issuer, issuer.Languages)
 	// Check that the issuer has public keys
 	pkpath := filepath.Join(scheme.path(), issuer.ID, "PublicKeys", "*")
 	files, err := filepath.Glob(pkpath)
@@ -651,7 +806,7 @@ func (conf *Configuration) validateIssuer(scheme *SchemeManager, issuer *Issuer,
 		return err
 	}
 	if len(files) == 0 {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no public keys", issuerid.String()))
+		conf.addWarning(filepath.Dir(pkpath), "Issuer %s has no public keys", issuerid.String())
 	}
 
 	if filepath.Base(dir) != issuer.ID {
@@ -664,14 +819,15 @@ func (conf *Configuration) validateIssuer(scheme *SchemeManager, issuer *Issuer,
 		return errors.Errorf("Name of demo issuer %s invalid: %s", issuer.ID, err.Error())
 	}
 	if err = common.AssertPathExists(filepath.Join(dir, "logo.png")); err != nil {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no logo.png", issuerid.String()))
+		conf.addWarning(filepath.Join(dir, "logo.png"), "Issuer %s has no logo.png", issuerid.String())
 	}
 	return nil
 }
 
 func (conf *Configuration) validateCredentialType(manager *SchemeManager, issuer *Issuer, cred *CredentialType, dir string) error {
 	credid := cred.Identifier()
-	conf.validateTranslations(fmt.Sprintf("Credential type %s", credid.String()), cred, cred.Languages)
+	description := filepath.Join(dir, "description.xml")
+	conf.validateTranslations(description, fmt.Sprintf("Credential type %s", credid.String()), cred, cred.Languages)
 	if cred.XMLVersion < 4 {
 		return errors.New("Unsupported credential type description")
 	}
@@ -697,12 +853,12 @@ func (conf *Configuration) validateCredentialType(manager *SchemeManager, issuer
 		}
 	}
 	if err := common.AssertPathExists(filepath.Join(dir, "logo.png")); err != nil {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has no logo.png", credid.String()))
+		conf.addWarning(filepath.Join(dir, "logo.png"), "Credential type %s has no logo.png", credid.String())
 	}
-	return conf.validateAttributes(cred)
+	return conf.validateAttributes(cred, description)
 }
 
-func (conf *Configuration) validateAttributes(cred *CredentialType) error {
+func (conf *Configuration) validateAttributes(cred *CredentialType, description string) error {
 	name := cred.Identifier().String()
 	indices := make(map[int]struct{})
 	revocation := false
@@ -712,14 +868,14 @@ func (conf *Configuration) validateAttributes(cred *CredentialType) error {
 	}
 	for i, attr := range cred.AttributeTypes {
 		if !attr.RevocationAttribute {
-			conf.validateTranslations(fmt.Sprintf("Attribute %s of credential type %s", attr.ID, cred.Identifier().String()), attr, cred.Languages)
+			conf.validateTranslations(description, fmt.Sprintf("Attribute %s of credential type %s", attr.ID, cred.Identifier().String()), attr, cred.Languages)
 		}
 		index := i
 		if attr.DisplayIndex != nil {
 			index = *attr.DisplayIndex
 		}
 		if index >= count {
-			conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid attribute displayIndex at attribute %d", name, i))
+			conf.addWarning(description, "Credential type %s has invalid attribute displayIndex at attribute %d", name, i)
 		}
 		indices[index] = struct{}{}
 		if attr.RevocationAttribute {
@@ -729,9 +885,12 @@ func (conf *Configuration) validateAttributes(cred *CredentialType) error {
 		if attr.RevocationAttribute && attr.RandomBlind {
 			return errors.New("attribute cannot be both revocation attribute and randomblind attribute")
 		}
+		if !attr.Sensitivity.valid() {
+			conf.addWarning(description, "Credential type %s has unknown sensitivity %s at attribute %s", name, attr.Sensitivity, attr.ID)
+		}
 	}
 	if len(indices) != count {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid attribute ordering, check the displayIndex tags", name))
+		conf.addWarning(description, "Credential type %s has invalid attribute ordering, check the displayIndex tags", name)
 	}
 	if revocation && !cred.RevocationSupported() {
 		return errors.New("revocation attribute found but no RevocationServers configured")
@@ -743,8 +902,9 @@ func (conf *Configuration) validateAttributes(cred *CredentialType) error {
 }
 
 // validateTranslations checks for each member of the interface o that is of type TranslatedString
-// that it contains all necessary translations.
-func (conf *Configuration) validateTranslations(file string, o interface{}, langs []string) {
+// that it contains all necessary translations. The path is that of the file from which o was parsed,
+// if known.
+func (conf *Configuration) validateTranslations(path, file string, o interface{}, langs []string) {
 	v := reflect.ValueOf(o)
 
 	// Dereference in case of pointer or interface
@@ -771,13 +931,13 @@ func (conf *Configuration) validateTranslations(file string, o interface{}, lang
 		}
 
 		if len(val) == 0 {
-			conf.Warnings = append(conf.Warnings, fmt.Sprintf("%s has empty <%s> tag", file, name))
+			conf.addWarning(path, "%s has empty <%s> tag", file, name)
 		}
 
 		// assuming that translations also never should be empty
 		if l := val.validate(langs); len(l) > 0 {
 			for _, invalidLang := range l {
-				conf.Warnings = append(conf.Warnings, fmt.Sprintf("%s misses %s translation in <%s> tag", file, invalidLang, name))
+				conf.addWarning(path, "%s misses %s translation in <%s> tag", file, invalidLang, name)
 			}
 		}
 	}
@@ -802,6 +962,7 @@ func (conf *Configuration) join(other *Configuration) {
 	for key, val := range other.AttributeTypes {
 		conf.AttributeTypes[key] = val
 	}
+	conf.invalidateAttributeIndex()
 	for key, val := range other.kssPublicKeys {
 		conf.kssPublicKeys[key] = val
 	}
@@ -1,20 +1,38 @@
 package irma
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"image/color"
+	"image/png"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
@@ -31,7 +49,7 @@ func init() {
 	Logger.SetLevel(logrus.FatalLevel)
 }
 
-func parseConfiguration(t *testing.T) *Configuration {
+func parseConfiguration(t testing.TB) *Configuration {
 	conf, err := NewConfiguration("testdata/irma_configuration", ConfigurationOptions{})
 	require.NoError(t, err)
 	require.NoError(t, conf.ParseFolder())
@@ -475,8 +493,8 @@ func TestSessionRequests(t *testing.T) {
 
 		{
 			expected: &SignatureRequest{
-				DisclosureRequest{BaseRequest{LDContext: LDContextSignatureRequest}, base.Disclose, base.Labels},
-				sigMessage,
+				DisclosureRequest: DisclosureRequest{BaseRequest{LDContext: LDContextSignatureRequest}, base.Disclose, base.Labels, nil},
+				Message:           sigMessage,
 			},
 			old: &SignatureRequest{},
 			oldJson: `{
@@ -530,11 +548,12 @@ func TestSessionRequests(t *testing.T) {
 
 		{
 			expected: &IssuanceRequest{
-				DisclosureRequest: DisclosureRequest{BaseRequest{LDContext: LDContextIssuanceRequest}, base.Disclose, base.Labels},
+				DisclosureRequest: DisclosureRequest{BaseRequest{LDContext: LDContextIssuanceRequest}, base.Disclose, base.Labels, nil},
 				Credentials: []*CredentialRequest{
 					{
-						CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
-						Attributes:       map[string]string{"BSN": "12345"},
+						CredentialTypeID:  NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+						Attributes:        map[string]string{"BSN": "12345"},
+						keyCounterMissing: true,
 					},
 				},
 			},
@@ -1608,3 +1627,2268 @@ func TestInstallSchemeUnstableRemote(t *testing.T) {
 	err = conf.ParseFolder()
 	require.NoError(t, err)
 }
+
+func TestInstallUnsignedScheme(t *testing.T) {
+	testSchemeID := NewSchemeManagerIdentifier("test")
+	testSchemeURL := "http://localhost:48681/irma_configuration/test"
+
+	// Host test scheme without signature and public key
+	unsignedTestData := t.TempDir()
+	require.NoError(t, common.CopyDirectory(test.FindTestdataFolder(t), unsignedTestData))
+	require.NoError(t, os.Remove(path.Join(unsignedTestData, "irma_configuration", "test", "index.sig")))
+	require.NoError(t, os.Remove(path.Join(unsignedTestData, "irma_configuration", "test", "pk.pem")))
+	schemeServer := &http.Server{Addr: "localhost:48681", Handler: http.FileServer(http.Dir(unsignedTestData))}
+	go func() {
+		_ = schemeServer.ListenAndServe()
+	}()
+	defer func() {
+		require.NoError(t, schemeServer.Close())
+	}()
+
+	// Unsigned schemes are refused by default
+	storage := t.TempDir()
+	conf, err := NewConfiguration(storage, ConfigurationOptions{})
+	require.NoError(t, err)
+	require.False(t, conf.DeveloperMode())
+	require.Error(t, conf.DangerousTOFUInstallScheme(testSchemeURL))
+	require.NotContains(t, conf.SchemeManagers, testSchemeID)
+
+	// In developer mode they are accepted
+	conf.SetDeveloperMode(true)
+	require.NoError(t, conf.DangerousTOFUInstallScheme(testSchemeURL))
+	require.Contains(t, conf.SchemeManagers, testSchemeID)
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("test.test.email"))
+	require.NoError(t, conf.ParseFolder())
+	require.Equal(t, SchemeManagerStatusValid, conf.SchemeManagers[testSchemeID].Status)
+	require.Len(t, conf.UnsignedSchemes(), 1)
+
+	// Without developer mode, the installed unsigned scheme is rejected when parsing
+	conf, err = NewConfiguration(storage, ConfigurationOptions{})
+	require.NoError(t, err)
+	require.Error(t, conf.ParseFolder())
+
+	// Unsigned schemes can be deleted in developer mode
+	conf.SetDeveloperMode(true)
+	require.NoError(t, conf.ParseFolder())
+	require.NoError(t, conf.DangerousDeleteUnsignedSchemes())
+	require.NotContains(t, conf.SchemeManagers, testSchemeID)
+	require.Empty(t, conf.UnsignedSchemes())
+	conf.SetDeveloperMode(false)
+	require.NoError(t, conf.ParseFolder())
+}
+
+func TestDeveloperModeKeepsSchemeSigned(t *testing.T) {
+	testSchemeID := NewSchemeManagerIdentifier("test")
+	testSchemeURL := "http://localhost:48681/irma_configuration/test"
+
+	hostedTestData := t.TempDir()
+	require.NoError(t, common.CopyDirectory(test.FindTestdataFolder(t), hostedTestData))
+	schemeServer := &http.Server{Addr: "localhost:48681", Handler: http.FileServer(http.Dir(hostedTestData))}
+	go func() {
+		_ = schemeServer.ListenAndServe()
+	}()
+	defer func() {
+		require.NoError(t, schemeServer.Close())
+	}()
+
+	// Install the signed scheme
+	conf, err := NewConfiguration(t.TempDir(), ConfigurationOptions{})
+	require.NoError(t, err)
+	conf.SetDeveloperMode(true)
+	require.NoError(t, conf.DangerousTOFUInstallScheme(testSchemeURL))
+	scheme := conf.SchemeManagers[testSchemeID]
+	sigPath := filepath.Join(scheme.path(), "index.sig")
+	_, exists, err := common.Stat(sigPath)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// A remote from which the signature is stripped is refused, even in developer mode
+	hostedScheme := path.Join(hostedTestData, "irma_configuration", "test")
+	require.NoError(t, os.Remove(path.Join(hostedScheme, "index.sig")))
+	timestamp := []byte(strconv.FormatInt(time.Now().Unix(), 10))
+	require.NoError(t, os.WriteFile(path.Join(hostedScheme, "timestamp"), timestamp, 0644))
+	indexbts, err := os.ReadFile(path.Join(hostedScheme, "index"))
+	require.NoError(t, err)
+	index := SchemeManagerIndex{}
+	require.NoError(t, index.FromString(string(indexbts)))
+	sha := sha256.Sum256(timestamp)
+	index["test/timestamp"] = sha[:]
+	require.NoError(t, os.WriteFile(path.Join(hostedScheme, "index"), []byte(index.String()), 0644))
+	require.Error(t, conf.UpdateScheme(scheme, nil))
+
+	_, exists, err = common.Stat(sigPath)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Empty(t, conf.UnsignedSchemes())
+	require.NoError(t, conf.ParseFolder())
+}
+
+// errorTypeConstants parses messages.go and returns all declared ErrorType constants by name.
+func errorTypeConstants(t *testing.T) map[string]ErrorType {
+	f, err := parser.ParseFile(token.NewFileSet(), "messages.go", nil, 0)
+	require.NoError(t, err)
+
+	consts := map[string]ErrorType{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok || len(spec.Values) != 1 {
+			return true
+		}
+		call, ok := spec.Values[0].(*ast.CallExpr)
+		if !ok || len(call.Args) != 1 {
+			return true
+		}
+		if fun, ok := call.Fun.(*ast.Ident); !ok || fun.Name != "ErrorType" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		require.True(t, ok, "ErrorType constant %s not a string literal", spec.Names[0].Name)
+		val, err := strconv.Unquote(lit.Value)
+		require.NoError(t, err)
+		consts[spec.Names[0].Name] = ErrorType(val)
+		return true
+	})
+	return consts
+}
+
+func TestErrorTypes(t *testing.T) {
+	consts := errorTypeConstants(t)
+	require.Contains(t, consts, "ErrorTransport")
+	require.Contains(t, consts, "ErrorLocked")
+
+	seen := map[ErrorType]string{}
+	for name, typ := range consts {
+		require.NotEmpty(t, typ, name)
+		other, duplicate := seen[typ]
+		require.False(t, duplicate, "%s and %s have the same value %s", name, other, typ)
+		seen[typ] = name
+
+		cause := errors.New("cause")
+		var err error = &SessionError{ErrorType: typ, Err: cause}
+		err = fmt.Errorf("wrapped: %w", err)
+		require.True(t, IsErrorType(err, typ), name)
+		require.ErrorIs(t, err, cause)
+		require.Equal(t, typ == ErrorTransport, IsTransportError(err), name)
+		require.Equal(t, typ == ErrorKeyshare || typ == ErrorKeyshareUnenrolled, IsKeyshareError(err), name)
+
+		var serr *SessionError
+		require.ErrorAs(t, err, &serr)
+		require.Equal(t, typ, serr.ErrorType)
+	}
+
+	require.False(t, IsErrorType(errors.New("transport"), ErrorTransport))
+	require.False(t, IsRemoteError(&SessionError{ErrorType: ErrorTransport}))
+	require.True(t, IsRemoteError(&SessionError{ErrorType: ErrorApi, RemoteError: &RemoteError{Status: 400}}))
+}
+
+func TestErrorMessages(t *testing.T) {
+	for name, typ := range errorTypeConstants(t) {
+		require.Contains(t, ErrorMessages, typ, "no message for %s", name)
+		require.NotEmpty(t, ErrorMessages[typ]["en"], "no English message for %s", name)
+		require.NotEmpty(t, ErrorMessages[typ]["nl"], "no Dutch message for %s", name)
+	}
+	for name, msg := range RemoteErrorMessages {
+		require.NotEmpty(t, msg["en"], "no English message for %s", name)
+		require.NotEmpty(t, msg["nl"], "no Dutch message for %s", name)
+	}
+
+	transport := NewHTTPTransport("http://localhost:1/", false)
+	err := transport.Get("", &struct{}{})
+	serr, ok := err.(*SessionError)
+	require.True(t, ok)
+	require.Equal(t, ErrorTransport, serr.ErrorType)
+	require.Equal(t, "Could not connect to localhost. Please check your internet connection and try again.", serr.UserMessage("en"))
+	require.Equal(t, "Kan geen verbinding maken met localhost. Controleer je internetverbinding en probeer het opnieuw.", serr.UserMessage("nl"))
+	require.Equal(t, serr.UserMessage("en"), serr.UserMessage("de"))
+
+	serr = &SessionError{ErrorType: ErrorKeysharePinBackoff, Info: "30", Err: errors.New("secret details")}
+	require.Equal(t, "You entered an incorrect PIN too often. Please try again in 30 seconds.", serr.UserMessage("en"))
+
+	serr = &SessionError{ErrorType: ErrorApi, RemoteError: &RemoteError{ErrorName: "SESSION_UNKNOWN", Message: "secret details"}}
+	require.Equal(t, "Deze sessie is verlopen of bestaat niet. Start een nieuwe sessie.", serr.UserMessage("nl"))
+	serr = &SessionError{ErrorType: ErrorApi, RemoteError: &RemoteError{ErrorName: "NONEXISTENT"}}
+	require.Equal(t, "An error was reported by the server.", serr.UserMessage("en"))
+	require.Equal(t, "An unknown error occurred.", (&SessionError{ErrorType: "nonexistent"}).UserMessage("en"))
+
+	// Apps can add their own translations
+	ErrorMessages[ErrorLocked]["de"] = "Die App ist gesperrt."
+	defer delete(ErrorMessages[ErrorLocked], "de")
+	require.Equal(t, "Die App ist gesperrt.", (&SessionError{ErrorType: ErrorLocked}).UserMessage("de"))
+}
+
+func TestSessionErrorJSON(t *testing.T) {
+	err := &SessionError{
+		ErrorType:    ErrorApi,
+		Err:          errors.New("cause"),
+		Info:         "info",
+		RemoteStatus: 400,
+		RemoteError:  &RemoteError{Status: 400, ErrorName: "SESSION_UNKNOWN"},
+	}
+	bts, e := json.Marshal(err)
+	require.NoError(t, e)
+	require.JSONEq(t,
+		`{"type":"api","message":"cause","info":"info","remoteStatus":400,"remoteError":{"status":400,"error":"SESSION_UNKNOWN"}}`,
+		string(bts),
+	)
+
+	bts, e = json.Marshal(&SessionError{ErrorType: ErrorTransport})
+	require.NoError(t, e)
+	require.JSONEq(t, `{"type":"transport"}`, string(bts))
+}
+
+func TestProtocolVersion(t *testing.T) {
+	v, err := ParseVersion("2.8")
+	require.NoError(t, err)
+	require.Equal(t, NewVersion(2, 8), v)
+	require.Equal(t, "2.8", v.String())
+
+	for _, str := range []string{"", "2", "2.8.1", "a.b", "2.-1", "-2.8"} {
+		_, err = ParseVersion(str)
+		require.Error(t, err, str)
+	}
+
+	require.True(t, v.AtLeast(NewVersion(2, 8)))
+	require.True(t, v.AtLeast(NewVersion(2, 7)))
+	require.True(t, v.AtLeast(NewVersion(1, 9)))
+	require.False(t, v.AtLeast(NewVersion(2, 9)))
+	require.False(t, v.AtLeast(NewVersion(3, 0)))
+	require.True(t, v.Above(2, 7))
+	require.False(t, v.Above(2, 8))
+
+	bts, err := json.Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `"2.8"`, string(bts))
+	var parsed ProtocolVersion
+	require.NoError(t, json.Unmarshal(bts, &parsed))
+	require.Equal(t, *v, parsed)
+	require.NoError(t, json.Unmarshal([]byte(`2.8`), &parsed))
+	require.Equal(t, *v, parsed)
+	require.Error(t, json.Unmarshal([]byte(`"2"`), &parsed))
+}
+
+// fuzzSessionRequest uses the specified session request in the ways that the IRMA server and
+// client do after having validated it, which should not panic.
+func fuzzSessionRequest(conf *Configuration, request SessionRequest) {
+	request.Identifiers()
+	request.Base().GetNonce(nil)
+	request.Base().GetContext()
+	request.Disclosure().Disclose.Iterate(func(*AttributeRequest) error { return nil })
+	_ = request.Base().Validate(conf)
+	_ = request.Disclosure().Disclose.Validate(conf)
+	if ir, ok := request.(*IssuanceRequest); ok {
+		for _, cred := range ir.Credentials {
+			_ = cred.Validate(conf)
+		}
+	}
+}
+
+// fuzzRequests returns session requests of each type, used as seeds for fuzzing.
+func fuzzRequests() []SessionRequest {
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	cred := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		Attributes:       map[string]string{"university": "Radboud", "studentID": "s1234567"},
+	}
+	return []SessionRequest{
+		NewDisclosureRequest(attr),
+		NewSignatureRequest("message", attr),
+		NewIssuanceRequest([]*CredentialRequest{cred}, attr),
+	}
+}
+
+func FuzzParseRequestorJwt(f *testing.F) {
+	for _, request := range fuzzRequests() {
+		var claims RequestorJwt
+		switch r := request.(type) {
+		case *DisclosureRequest:
+			claims = NewServiceProviderJwt("testrequestor", r)
+		case *SignatureRequest:
+			claims = NewSignatureRequestorJwt("testrequestor", r)
+		case *IssuanceRequest:
+			claims = NewIdentityProviderJwt("testrequestor", r)
+		}
+		j, err := claims.Sign(jwt.SigningMethodHS256, []byte("key"))
+		require.NoError(f, err)
+		f.Add(string(request.Action()), j)
+	}
+
+	conf := parseConfiguration(f)
+	f.Fuzz(func(t *testing.T, action, requestorJwt string) {
+		parsed, err := ParseRequestorJwt(action, requestorJwt)
+		if err != nil {
+			return
+		}
+		fuzzSessionRequest(conf, parsed.SessionRequest())
+	})
+}
+
+func FuzzUnmarshalSessionRequest(f *testing.F) {
+	for _, request := range fuzzRequests() {
+		request.Base().ProtocolVersion = NewVersion(2, 8)
+		bts, err := json.Marshal(request)
+		require.NoError(f, err)
+		f.Add(bts) // legacy format
+		bts, err = json.Marshal(&ClientSessionRequest{
+			LDContext:       LDContextClientSessionRequest,
+			ProtocolVersion: NewVersion(2, 8),
+			Options:         &SessionOptions{LDContext: LDContextSessionOptions, PairingMethod: PairingMethodNone},
+			Request:         request,
+		})
+		require.NoError(f, err)
+		f.Add(bts)
+	}
+
+	conf := parseConfiguration(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, request := range []SessionRequest{&DisclosureRequest{}, &SignatureRequest{}, &IssuanceRequest{}} {
+			cr := &ClientSessionRequest{Request: request}
+			if err := UnmarshalValidate(data, cr); err != nil {
+				continue
+			}
+			fuzzSessionRequest(conf, cr.Request)
+		}
+	})
+}
+
+// TestServerSessionResponse pins how responses of IRMA servers to proofs and commitments,
+// as recorded from servers of the respective protocol versions, are decoded.
+func TestServerSessionResponse(t *testing.T) {
+	sigs := `[{"proof":{"c":"AQ==","e_response":"Ag=="},"signature":{"A":"Aw==","e":"BA==","v":"BQ==","KeyshareP":null}}]`
+	tests := []struct {
+		version, body string
+		action        Action
+		status        ProofStatus
+		sigs          int
+		err           bool
+	}{
+		{version: "2.1", action: ActionDisclosing, body: `"VALID"`, status: ProofStatusValid},
+		{version: "2.1", action: ActionSigning, body: `"INVALID_TIMESTAMP"`, status: ProofStatusInvalidTimestamp},
+		{version: "2.1", action: ActionDisclosing, body: `"expired"`, status: ProofStatusExpired},
+		{version: "2.1", action: ActionDisclosing, body: `{"proofStatus":"MISSING_ATTRIBUTES"}`, status: ProofStatusMissingAttributes},
+		{version: "2.1", action: ActionIssuing, body: sigs, status: ProofStatusValid, sigs: 1},
+		{version: "2.1", action: ActionIssuing, body: `"INVALID"`, status: ProofStatusInvalid},
+		{version: "2.2", action: ActionDisclosing, body: ` "valid"` + "\n", status: ProofStatusValid},
+		{version: "2.2", action: ActionSigning, body: `"UNMATCHED_REQUEST"`, status: ProofStatusUnmatchedRequest},
+		{version: "2.2", action: ActionIssuing, body: sigs, status: ProofStatusValid, sigs: 1},
+		{version: "2.2", action: ActionIssuing, body: `{"proofStatus":"EXPIRED"}`, status: ProofStatusExpired},
+		{version: "2.8", action: ActionDisclosing, body: `{"proofStatus":"Valid"}`, status: ProofStatusValid},
+		{version: "2.8", action: ActionIssuing, body: `{"proofStatus":"VALID","sigs":` + sigs + `}`, status: ProofStatusValid, sigs: 1},
+
+		{version: "2.1", action: ActionDisclosing, body: `"MAYBE"`, err: true},
+		{version: "2.1", action: ActionDisclosing, body: `true`, err: true},
+		{version: "2.1", action: ActionDisclosing, body: `<html>Bad gateway</html>`, err: true},
+		{version: "2.1", action: ActionDisclosing, body: sigs, err: true},
+		{version: "2.1", action: ActionIssuing, body: `"VALID"`, err: true},
+		{version: "2.2", action: ActionSigning, body: `{}`, err: true},
+		{version: "2.8", action: ActionDisclosing, body: `{"proofStatus":"MAYBE"}`, err: true},
+		{version: "2.8", action: ActionDisclosing, body: `{}`, err: true},
+	}
+	for _, tst := range tests {
+		version, err := ParseVersion(tst.version)
+		require.NoError(t, err)
+		response := &ServerSessionResponse{ProtocolVersion: version, SessionType: tst.action}
+		err = json.Unmarshal([]byte(tst.body), response)
+		if tst.err {
+			require.Error(t, err, "%s %s %s", tst.version, tst.action, tst.body)
+			continue
+		}
+		require.NoError(t, err, "%s %s %s", tst.version, tst.action, tst.body)
+		require.Equal(t, tst.status, response.ProofStatus)
+		require.Len(t, response.IssueSignatures, tst.sigs)
+	}
+}
+
+// TestServerSessionResponseIssueErrors checks that issuance responses in which errors take the
+// place of the signatures of some credentials are decoded and encoded.
+func TestServerSessionResponseIssueErrors(t *testing.T) {
+	sig := `{"proof":{"c":"AQ==","e_response":"Ag=="},"signature":{"A":"Aw==","e":"BA==","v":"BQ==","KeyshareP":null}}`
+	body := `{"proofStatus":"VALID","sigs":[` + sig + `,{"status":500,"error":"ISSUANCE_FAILED","description":"unavailable"}]}`
+	version, err := ParseVersion("2.8")
+	require.NoError(t, err)
+
+	response := &ServerSessionResponse{ProtocolVersion: version, SessionType: ActionIssuing}
+	require.NoError(t, json.Unmarshal([]byte(body), response))
+	require.Len(t, response.IssueSignatures, 2)
+	require.NotNil(t, response.IssueSignatures[0])
+	require.Nil(t, response.IssueSignatures[1])
+	require.Len(t, response.IssueErrors, 1)
+	require.Equal(t, &RemoteError{Status: 500, ErrorName: "ISSUANCE_FAILED", Description: "unavailable"}, response.IssueErrors[1])
+
+	bts, err := json.Marshal(response)
+	require.NoError(t, err)
+	decoded := &ServerSessionResponse{ProtocolVersion: version, SessionType: ActionIssuing}
+	require.NoError(t, json.Unmarshal(bts, decoded))
+	require.Equal(t, response.IssueErrors, decoded.IssueErrors)
+	require.Equal(t, response.IssueSignatures[0].Signature.A, decoded.IssueSignatures[0].Signature.A)
+	require.Nil(t, decoded.IssueSignatures[1])
+}
+
+// TestProofStatusWireStrings guards the strings with which proof statuses are sent over the wire,
+// which must never change as other IRMA implementations depend on them.
+func TestProofStatusWireStrings(t *testing.T) {
+	require.Equal(t, []ProofStatus{
+		"VALID", "INVALID", "INVALID_TIMESTAMP", "UNMATCHED_REQUEST", "MISSING_ATTRIBUTES", "EXPIRED",
+	}, proofStatuses)
+	require.Equal(t, []ProofStatus{
+		ProofStatusValid, ProofStatusInvalid, ProofStatusInvalidTimestamp,
+		ProofStatusUnmatchedRequest, ProofStatusMissingAttributes, ProofStatusExpired,
+	}, proofStatuses)
+
+	require.Equal(t, []AttributeProofStatus{
+		"PRESENT", "EXTRA", "NULL", "MISSING", "INVALID_VALUE", "REVOKED",
+	}, attributeProofStatuses)
+	require.Equal(t, []AttributeProofStatus{
+		AttributeProofStatusPresent, AttributeProofStatusExtra, AttributeProofStatusNull,
+		AttributeProofStatusMissing, AttributeProofStatusInvalidValue, AttributeProofStatusRevoked,
+	}, attributeProofStatuses)
+}
+
+func TestProofStatusMarshaling(t *testing.T) {
+	for _, status := range proofStatuses {
+		bts, err := json.Marshal(status)
+		require.NoError(t, err)
+		require.Equal(t, `"`+string(status)+`"`, string(bts))
+		var parsed ProofStatus
+		require.NoError(t, json.Unmarshal(bts, &parsed))
+		require.Equal(t, status, parsed)
+		require.NoError(t, json.Unmarshal([]byte(strings.ToLower(string(bts))), &parsed))
+		require.Equal(t, status, parsed)
+	}
+	for _, status := range attributeProofStatuses {
+		bts, err := json.Marshal(status)
+		require.NoError(t, err)
+		require.Equal(t, `"`+string(status)+`"`, string(bts))
+		var parsed AttributeProofStatus
+		require.NoError(t, json.Unmarshal(bts, &parsed))
+		require.Equal(t, status, parsed)
+		require.NoError(t, json.Unmarshal([]byte(strings.ToLower(string(bts))), &parsed))
+		require.Equal(t, status, parsed)
+	}
+
+	// Unknown statuses are neither sent nor accepted
+	_, err := json.Marshal(ProofStatus("MAYBE"))
+	require.Error(t, err)
+	_, err = json.Marshal(ProofStatus("valid"))
+	require.Error(t, err)
+	_, err = json.Marshal(AttributeProofStatus("MAYBE"))
+	require.Error(t, err)
+	var status ProofStatus
+	require.Error(t, json.Unmarshal([]byte(`"MAYBE"`), &status))
+	var attrStatus AttributeProofStatus
+	require.Error(t, json.Unmarshal([]byte(`"MAYBE"`), &attrStatus))
+
+	// Absent statuses remain absent
+	bts, err := json.Marshal(struct {
+		Status ProofStatus `json:"status,omitempty"`
+	}{})
+	require.NoError(t, err)
+	require.Equal(t, `{}`, string(bts))
+	require.NoError(t, json.Unmarshal([]byte(`""`), &status))
+	require.Equal(t, ProofStatus(""), status)
+
+	// Statuses nested in results are checked too
+	attr := &DisclosedAttribute{Status: AttributeProofStatusPresent}
+	bts, err = json.Marshal(attr)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), `"status":"PRESENT"`)
+	require.Error(t, json.Unmarshal([]byte(`{"status":"GONE"}`), attr))
+}
+
+func TestRequestLimits(t *testing.T) {
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	credreq := func() *CredentialRequest {
+		return &CredentialRequest{CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard")}
+	}
+
+	dr := NewDisclosureRequest(attr)
+	for len(dr.Disclose) < MaxRequestDisjunctions {
+		dr.Disclose = append(dr.Disclose, dr.Disclose[0])
+	}
+	require.NoError(t, dr.Validate())
+	dr.Disclose = append(dr.Disclose, dr.Disclose[0])
+	require.Error(t, dr.Validate())
+
+	dr = NewDisclosureRequest(attr)
+	con := make(AttributeCon, MaxRequestAttributes+1)
+	for i := range con {
+		con[i] = AttributeRequest{Type: attr}
+	}
+	dr.Disclose[0] = AttributeDisCon{con}
+	require.Error(t, dr.Validate())
+
+	ir := NewIssuanceRequest([]*CredentialRequest{credreq()})
+	for len(ir.Credentials) < MaxRequestCredentials {
+		ir.Credentials = append(ir.Credentials, credreq())
+	}
+	require.NoError(t, ir.Validate())
+	ir.Credentials = append(ir.Credentials, credreq())
+	require.Error(t, ir.Validate())
+
+	ir = NewIssuanceRequest([]*CredentialRequest{credreq()})
+	validity := Timestamp(time.Now().AddDate(1000, 0, 0))
+	ir.Credentials[0].Validity = &validity
+	require.NoError(t, ir.Validate())
+	validity = Timestamp(time.Now().AddDate(2000, 0, 0))
+	require.Error(t, ir.Validate())
+	ir.Credentials[0] = nil
+	require.Error(t, ir.Validate())
+
+	j, err := NewServiceProviderJwt("testsp", NewDisclosureRequest(attr)).Sign(jwt.SigningMethodHS256, []byte("key"))
+	require.NoError(t, err)
+	_, err = ParseRequestorJwt("disclosing", j)
+	require.NoError(t, err)
+	_, err = ParseRequestorJwt("disclosing", j+strings.Repeat("a", MaxRequestorJwtLength))
+	require.Error(t, err)
+}
+
+func TestResponseSizeLimit(t *testing.T) {
+	var written int64
+	chunk := []byte(`"` + strings.Repeat("a", 32<<10))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/declared":
+			w.Header().Set("Content-Length", strconv.Itoa(1<<30))
+		case "/small":
+			_, _ = w.Write([]byte(`"small"`))
+			return
+		case "/large":
+			_, _ = w.Write([]byte(`"` + strings.Repeat("a", 2*MaxIssuanceResponseSize) + `"`))
+			return
+		}
+		// Stream up to 1 GB until the client stops reading
+		for i := 0; i < (1<<30)/len(chunk); i++ {
+			n, err := w.Write(chunk)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for _, path := range []string{"stream", "declared", "commitments"} {
+		transport := NewHTTPTransport(server.URL, false)
+		transport.SetTimeout(10 * time.Second)
+		transport.SetMaxResponseSize("", MaxSessionResponseSize)
+		transport.SetMaxResponseSize("commitments", MaxIssuanceResponseSize)
+		var result string
+		err := transport.Get(path, &result)
+		require.True(t, IsErrorType(err, ErrorResponseTooLarge), path)
+		require.Equal(t, "127.0.0.1", err.(*SessionError).Info)
+	}
+	runtime.ReadMemStats(&after)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(64<<20))
+	require.Less(t, atomic.LoadInt64(&written), int64(1<<30))
+
+	// By default responses are not limited
+	transport := NewHTTPTransport(server.URL, false)
+	var result string
+	require.NoError(t, transport.Get("large", &result))
+	require.Equal(t, 2*MaxIssuanceResponseSize+2, len(result))
+
+	// Limits are configurable, for all paths or per path
+	require.NoError(t, transport.Get("small", &result))
+	require.Equal(t, `"small"`, result)
+	transport.SetMaxResponseSize("", 4)
+	require.True(t, IsErrorType(transport.Get("small", &result), ErrorResponseTooLarge))
+	transport.SetMaxResponseSize("small", 7)
+	require.NoError(t, transport.Get("small", &result))
+	_, err := transport.GetBytes("small")
+	require.NoError(t, err)
+}
+
+func TestExtendedSessionRequest(t *testing.T) {
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	credreq := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		KeyCounter:       2,
+		Attributes:       map[string]string{"studentID": "s1234567"},
+	}
+	requests := []struct {
+		request SessionRequest
+		typed   RequestorRequest
+	}{
+		{NewDisclosureRequest(attr), &ServiceProviderRequest{}},
+		{NewSignatureRequest("message", attr), &SignatureRequestorRequest{}},
+		{NewIssuanceRequest([]*CredentialRequest{credreq}), &IdentityProviderRequest{}},
+	}
+	for _, tt := range requests {
+		t.Run(string(tt.request.Action()), func(t *testing.T) {
+			extended := NewExtendedSessionRequest(tt.request)
+			extended.CallbackURL = "https://example.com/callback"
+			extended.ClientTimeout = 60
+			extended.ResultJwtValidity = 300
+			require.NoError(t, extended.Validate())
+
+			// Marshals to the same JSON as the typed requestor request, and back
+			typed, err := extended.Typed()
+			require.NoError(t, err)
+			require.IsType(t, tt.typed, typed)
+			bts, err := json.Marshal(extended)
+			require.NoError(t, err)
+			typedBts, err := json.Marshal(typed)
+			require.NoError(t, err)
+			require.JSONEq(t, string(typedBts), string(bts))
+			require.Contains(t, string(bts), `"callbackUrl":"https://example.com/callback"`)
+
+			parsed := &ExtendedSessionRequest{}
+			require.NoError(t, json.Unmarshal(bts, parsed))
+			require.IsType(t, tt.request, parsed.Request)
+			require.Equal(t, extended.RequestorBaseRequest, parsed.RequestorBaseRequest)
+			require.NoError(t, parsed.Validate())
+
+			// Can be signed into a requestor JWT
+			j, err := SignRequestorRequest(extended, jwt.SigningMethodHS256, []byte("key"), "requestor")
+			require.NoError(t, err)
+			rjwt, err := ParseRequestorJwt(string(tt.request.Action()), j)
+			require.NoError(t, err)
+			require.Equal(t, "https://example.com/callback", rjwt.RequestorRequest().Base().CallbackURL)
+		})
+	}
+
+	extended := NewExtendedSessionRequest(NewDisclosureRequest(attr))
+	for _, callback := range []string{"http://example.com/callback", "example.com/callback", "https://"} {
+		extended.CallbackURL = callback
+		require.Error(t, extended.Validate(), callback)
+	}
+	extended.CallbackURL = ""
+	extended.ClientTimeout = -1
+	require.Error(t, extended.Validate())
+	require.Error(t, (&ExtendedSessionRequest{}).Validate())
+	require.Error(t, json.Unmarshal([]byte(`{"request":{"@context":"https://irma.app/ld/request/revocation/v1"}}`), &ExtendedSessionRequest{}))
+}
+
+func TestQr(t *testing.T) {
+	qr := NewQr(ActionDisclosing, "https://example.com/irma/session/token")
+	require.NoError(t, qr.Validate())
+
+	// The protocol version range supported by irmago is included when the Qr has none
+	bts, err := json.Marshal(qr)
+	require.NoError(t, err)
+	require.JSONEq(t,
+		`{"u":"https://example.com/irma/session/token","irmaqr":"disclosing","v":"2.4","vmax":"2.8"}`,
+		string(bts))
+	parsed := &Qr{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, MinProtocolVersion, parsed.ProtocolVersion)
+	require.Equal(t, MaxProtocolVersion, parsed.MaxProtocolVersion)
+	require.NoError(t, parsed.Validate())
+
+	// An explicit range is kept, also when the Qr is marshaled by value
+	qr.ProtocolVersion, qr.MaxProtocolVersion = NewVersion(2, 5), NewVersion(2, 8)
+	bts, err = json.Marshal(*qr)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), `"v":"2.5","vmax":"2.8"`)
+
+	qr.ProtocolVersion = NewVersion(2, 9)
+	require.Error(t, qr.Validate())
+
+	link, err := NewQr(ActionIssuing, "https://example.com/irma/session/token").Link()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(link, "irma://qr/json/"))
+	require.NotContains(t, link, " ")
+	parsed, err = ParseQrLink(link)
+	require.NoError(t, err)
+	require.Equal(t, ActionIssuing, parsed.Type)
+	require.Equal(t, "https://example.com/irma/session/token", parsed.URL)
+
+	_, err = NewQr(Action("unknown"), "https://example.com").Link()
+	require.Error(t, err)
+	_, err = ParseQrLink("https://example.com")
+	require.Error(t, err)
+	_, err = ParseQrLink("irma://qr/json/" + url.PathEscape(`{"u":"","irmaqr":"disclosing"}`))
+	require.Error(t, err)
+}
+
+func TestRenderQr(t *testing.T) {
+	qr := NewQr(ActionDisclosing, "https://example.com/irma/session/token")
+	code, err := qrCode(qr)
+	require.NoError(t, err)
+	modules := code.Size + 2*qrQuietZone
+
+	// The modules read back from the PNG are those of the encoded JSON of the Qr
+	bts, err := RenderQrPNG(qr, 300)
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(bts))
+	require.NoError(t, err)
+	width := img.Bounds().Dx()
+	require.Equal(t, width, img.Bounds().Dy())
+	require.LessOrEqual(t, width, 300)
+	require.Zero(t, width%modules)
+	scale := width / modules
+	for y := 0; y < modules; y++ {
+		for x := 0; x < modules; x++ {
+			gray := color.GrayModel.Convert(img.At(x*scale+scale/2, y*scale+scale/2)).(color.Gray)
+			require.Equal(t, code.Black(x-qrQuietZone, y-qrQuietZone), gray.Y < 128, "module (%d, %d)", x, y)
+		}
+	}
+
+	// Too small sizes result in one pixel per module
+	bts, err = RenderQrPNG(qr, 1)
+	require.NoError(t, err)
+	img, err = png.Decode(bytes.NewReader(bts))
+	require.NoError(t, err)
+	require.Equal(t, modules, img.Bounds().Dx())
+	_, err = RenderQrPNG(qr, 0)
+	require.Error(t, err)
+
+	// Likewise for the terminal, where blocks are light and each line contains two rows of modules
+	var sb strings.Builder
+	require.NoError(t, RenderQrTerminal(qr, &sb))
+	lines := strings.Split(strings.TrimSuffix(sb.String(), "\n"), "\n")
+	require.Len(t, lines, (modules+1)/2)
+	for i, line := range lines {
+		runes := []rune(line)
+		require.Len(t, runes, modules)
+		for x, r := range runes {
+			top, bottom := r == '█' || r == '▀', r == '█' || r == '▄'
+			require.Equal(t, code.Black(x-qrQuietZone, 2*i-qrQuietZone), !top)
+			require.Equal(t, code.Black(x-qrQuietZone, 2*i+1-qrQuietZone), !bottom)
+		}
+	}
+
+	// The encoded JSON is a Qr from which sessions can be started
+	expected, err := json.Marshal(qr)
+	require.NoError(t, err)
+	parsed := &Qr{}
+	require.NoError(t, json.Unmarshal(expected, parsed))
+	require.True(t, parsed.IsQr())
+	require.NoError(t, parsed.Validate())
+
+	_, err = RenderQrPNG(NewQr(ActionDisclosing, ""), 300)
+	require.Error(t, err)
+	require.Error(t, RenderQrTerminal(NewQr(Action("unknown"), "https://example.com"), &sb))
+}
+
+func TestAnalyzeSignatureMessage(t *testing.T) {
+	tests := []struct {
+		message   string
+		sanitized string
+		anomalies []MessageAnomaly
+	}{
+		{"I agree", "I agree", nil},
+		{"Line 1\nLine 2\tand a tab", "Line 1\nLine 2\tand a tab", nil},
+		{"Crème brûlée", "Crème brûlée", nil},
+		{"Пример", "Пример", nil},
+		{"Cre\u0300me", "Crème", []MessageAnomaly{MessageAnomalyNotNormalized}},
+		{"Pay \u202eRUE 001", "Pay RUE 001", []MessageAnomaly{MessageAnomalyBidiControl}},
+		{"Pay\u0007 now", "Pay now", []MessageAnomaly{MessageAnomalyControlCharacter}},
+		{"Pay\u200b now", "Pay now", []MessageAnomaly{MessageAnomalyInvisibleCharacter}},
+		{"p\u0430ypal", "p\u0430ypal", []MessageAnomaly{MessageAnomalyMixedScripts}},
+		{"I agree ", "I agree ", []MessageAnomaly{MessageAnomalySurroundingWhitespace}},
+		{"I agree\xff", "I agree\ufffd", []MessageAnomaly{MessageAnomalyInvalidUTF8}},
+		{" \u202ep\u0430y\u0000", " p\u0430y", []MessageAnomaly{
+			MessageAnomalyBidiControl, MessageAnomalyControlCharacter, MessageAnomalyMixedScripts, MessageAnomalySurroundingWhitespace,
+		}},
+	}
+	for _, tt := range tests {
+		analysis := AnalyzeSignatureMessage(tt.message)
+		require.Equal(t, tt.message, analysis.Raw)
+		require.Equal(t, tt.sanitized, analysis.Sanitized, "%q", tt.message)
+		require.Equal(t, tt.anomalies, analysis.Anomalies, "%q", tt.message)
+	}
+
+	// Relying parties can analyze the message of signatures they receive
+	sm := &SignedMessage{Message: "Pay \u202eRUE 001"}
+	require.Equal(t, []MessageAnomaly{MessageAnomalyBidiControl}, sm.AnalyzeMessage().Anomalies)
+}
+
+func TestSignatureMessageType(t *testing.T) {
+	digest := sha256.Sum256([]byte("%PDF-1.7 contract"))
+	hexDigest := hex.EncodeToString(digest[:])
+	stringHash := sha256.Sum256([]byte(hexDigest))
+
+	hash, err := SignatureMessageHash("", hexDigest)
+	require.NoError(t, err)
+	require.Equal(t, stringHash[:], hash)
+	hash, err = SignatureMessageHash(SignatureMessageTypeString, hexDigest)
+	require.NoError(t, err)
+	require.Equal(t, stringHash[:], hash)
+	hash, err = SignatureMessageHash(SignatureMessageTypeRawHash, hexDigest)
+	require.NoError(t, err)
+	require.Equal(t, digest[:], hash)
+	for _, message := range []string{"not hex", hexDigest[:62], hexDigest + "00"} {
+		_, err = SignatureMessageHash(SignatureMessageTypeRawHash, message)
+		require.Error(t, err, message)
+	}
+	_, err = SignatureMessageHash("PDF", hexDigest)
+	require.Error(t, err)
+
+	// Requests without a type are unchanged on the wire and sign the message as a string
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := NewSignatureRequest(hexDigest, attr)
+	bts, err := json.Marshal(request)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "messageType")
+	explicit := NewSignatureRequest(hexDigest, attr)
+	explicit.Nonce = request.Nonce
+	explicit.MessageType = SignatureMessageTypeString
+	require.Equal(t, request.GetNonce(nil), explicit.GetNonce(nil))
+	signature, err := explicit.SignatureFromMessage(&Disclosure{}, nil)
+	require.NoError(t, err)
+	bts, err = json.Marshal(signature)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "messageType")
+	require.True(t, signature.MatchesNonceAndContext(request))
+
+	// Raw hashes are signed as such, and the type must match that of the request
+	raw := NewSignatureRequest(hexDigest, attr)
+	raw.Nonce = request.Nonce
+	raw.MessageType = SignatureMessageTypeRawHash
+	raw.MessageFilename = "contract.pdf"
+	require.NoError(t, raw.Validate())
+	require.NotEqual(t, request.GetNonce(nil), raw.GetNonce(nil))
+	signature, err = raw.SignatureFromMessage(&Disclosure{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, SignatureMessageTypeRawHash, signature.MessageType)
+	require.True(t, signature.MatchesNonceAndContext(raw))
+	require.False(t, signature.MatchesNonceAndContext(request))
+
+	bts, err = json.Marshal(raw)
+	require.NoError(t, err)
+	parsed := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, SignatureMessageTypeRawHash, parsed.MessageType)
+	require.Equal(t, "contract.pdf", parsed.MessageFilename)
+
+	raw.Message = "not a hash"
+	require.Error(t, raw.Validate())
+	_, err = raw.Legacy()
+	require.Error(t, err)
+}
+
+func TestAgeLimit(t *testing.T) {
+	for id, n := range map[string]int{"over18": 18, "over12": 12, "over65": 65, "over": 0, "over0": 0, "over100": 0, "over18plus": 0, "level": 0} {
+		require.Equal(t, n, AttributeType{ID: id}.AgeLimit(), id)
+	}
+	require.Zero(t, AttributeType{ID: "over18", RandomBlind: true}.AgeLimit())
+
+	for value, affirmative := range map[string]bool{"yes": true, "Yes": true, "ja": true, "true": true, "no": false, "nee": false, "": false, "18": false} {
+		require.Equal(t, affirmative, IsAffirmativeAgeValue(&value), value)
+	}
+	require.False(t, IsAffirmativeAgeValue(nil))
+
+	over18 := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLimits.over18")
+	conf := &Configuration{AttributeTypes: map[AttributeTypeIdentifier]*AttributeType{over18: {ID: "over18"}}}
+	yes, no := "yes", "no"
+	request := &AttributeRequest{Type: over18}
+	require.True(t, request.SatisfyAge(over18, &yes, conf))
+	require.False(t, request.SatisfyAge(over18, &no, conf))
+	require.False(t, request.SatisfyAge(over18, nil, conf))
+	require.True(t, (&AttributeRequest{Type: over18, Value: &no}).SatisfyAge(over18, &no, conf))
+
+	// Attributes not following the convention are unaffected
+	other := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	require.True(t, (&AttributeRequest{Type: other}).SatisfyAge(other, &no, conf))
+}
+
+func TestParseIdentifiers(t *testing.T) {
+	scheme, err := ParseSchemeManagerIdentifier("irma-demo")
+	require.NoError(t, err)
+	require.Equal(t, NewSchemeManagerIdentifier("irma-demo"), scheme)
+
+	issuer, err := ParseIssuerIdentifier("irma-demo.MijnOverheid")
+	require.NoError(t, err)
+	require.Equal(t, scheme, issuer.SchemeManagerIdentifier())
+	require.Equal(t, "MijnOverheid", issuer.Name())
+
+	cred, err := ParseCredentialTypeIdentifier("irma-demo.MijnOverheid.address")
+	require.NoError(t, err)
+	require.Equal(t, issuer, cred.IssuerIdentifier())
+	require.Equal(t, "irma-demo.MijnOverheid", cred.Parent())
+
+	attr, err := ParseAttributeTypeIdentifier("irma-demo.MijnOverheid.address.street")
+	require.NoError(t, err)
+	require.Equal(t, cred.AttributeTypeIdentifier("street"), attr)
+	require.Equal(t, cred, attr.CredentialTypeIdentifier())
+	require.Equal(t, issuer, attr.IssuerIdentifier())
+	require.Equal(t, scheme, attr.SchemeManagerIdentifier())
+	require.Equal(t, "street", attr.Name())
+
+	// Attribute type identifiers may also refer to the credential itself
+	attr, err = ParseAttributeTypeIdentifier("irma-demo.MijnOverheid.address")
+	require.NoError(t, err)
+	require.True(t, attr.IsCredential())
+	require.Equal(t, issuer, attr.IssuerIdentifier())
+
+	for _, id := range []string{"", ".", "irma-demo.", ".irma-demo", "irma demo", "irma/demo", "irma-démo"} {
+		_, err = ParseSchemeManagerIdentifier(id)
+		require.Error(t, err, id)
+	}
+	for _, id := range []string{"irma-demo", "irma-demo.MijnOverheid.address", "irma-demo..MijnOverheid", "irma-demo.Mijn Overheid"} {
+		_, err = ParseIssuerIdentifier(id)
+		require.Error(t, err, id)
+	}
+	for _, id := range []string{"irma-demo.MijnOverheid", "irma-demo.MijnOverheid.address.street", "irma-demo.MijnOverheid.", "irma-demo.MijnOverheid.add*ress"} {
+		_, err = ParseCredentialTypeIdentifier(id)
+		require.Error(t, err, id)
+	}
+	for _, id := range []string{"irma-demo.MijnOverheid", "irma-demo.MijnOverheid.address.street.number", "irma-demo.MijnOverheid.address.", "irma-demo.MijnOverheid.address.str\neet"} {
+		_, err = ParseAttributeTypeIdentifier(id)
+		require.Error(t, err, id)
+	}
+}
+
+func TestIdentifiersJSON(t *testing.T) {
+	// Identifiers are marshaled as strings, also as map keys
+	attr := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.address.street")
+	bts, err := json.Marshal(map[AttributeTypeIdentifier]CredentialTypeIdentifier{attr: attr.CredentialTypeIdentifier()})
+	require.NoError(t, err)
+	require.Equal(t, `{"irma-demo.MijnOverheid.address.street":"irma-demo.MijnOverheid.address"}`, string(bts))
+	var m map[AttributeTypeIdentifier]CredentialTypeIdentifier
+	require.NoError(t, json.Unmarshal(bts, &m))
+	require.Equal(t, attr.CredentialTypeIdentifier(), m[attr])
+
+	var req DisclosureRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.MijnOverheid.address.street"]]]}`), &req))
+	require.Equal(t, attr, req.Disclose[0][0][0].Type)
+
+	// Malformed identifiers are refused wherever they are unmarshaled
+	require.Error(t, json.Unmarshal([]byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.MijnOverheid..street"]]]}`), &req))
+	require.Error(t, json.Unmarshal([]byte(`{"irma-demo.MijnOverheid.address.st reet":"irma-demo.MijnOverheid.address"}`), &m))
+	require.Error(t, json.Unmarshal([]byte(`{"irma-demo.MijnOverheid.address.street":"irma-demo/MijnOverheid.address"}`), &m))
+	var cr CredentialRequest
+	require.Error(t, json.Unmarshal([]byte(`{"credential":"irma-demo.MijnOverheid.<address>","attributes":{}}`), &cr))
+	var issuer IssuerIdentifier
+	require.Error(t, json.Unmarshal([]byte(`"irma-demo.Mijn Overheid"`), &issuer))
+	var scheme SchemeManagerIdentifier
+	require.Error(t, json.Unmarshal([]byte(`"irma-demo "`), &scheme))
+
+	// Empty identifiers remain allowed, e.g. for omitted fields
+	require.NoError(t, json.Unmarshal([]byte(`""`), &scheme))
+	require.True(t, scheme.Empty())
+}
+
+func TestDisclosureChoiceExtraAttributes(t *testing.T) {
+	attr := func(id string) *AttributeIdentifier {
+		return &AttributeIdentifier{Type: NewAttributeTypeIdentifier(id), CredentialHash: "hash"}
+	}
+	request := &DisclosureRequest{Disclose: AttributeConDisCon{
+		AttributeDisCon{
+			AttributeCon{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")}},
+			AttributeCon{
+				{Type: NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")},
+				{Type: NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname")},
+			},
+		},
+		AttributeDisCon{
+			AttributeCon{{Type: NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root")}},
+			AttributeCon{}, // optional
+		},
+	}}
+
+	// Choices within the request
+	for _, choice := range [][][]*AttributeIdentifier{
+		{{attr("irma-demo.RU.studentCard.studentID")}, {attr("irma-demo.MijnOverheid.root")}},
+		{{attr("irma-demo.MijnOverheid.fullName.firstname"), attr("irma-demo.MijnOverheid.fullName.familyname")}, {}},
+		{{attr("irma-demo.MijnOverheid.fullName.firstname")}},
+	} {
+		require.Empty(t, (&DisclosureChoice{Attributes: choice}).ExtraAttributes(request))
+	}
+	require.Empty(t, (*DisclosureChoice)(nil).ExtraAttributes(request))
+
+	// Mixing inner conjunctions
+	extra := (&DisclosureChoice{Attributes: [][]*AttributeIdentifier{
+		{attr("irma-demo.RU.studentCard.studentID"), attr("irma-demo.MijnOverheid.fullName.firstname")},
+	}}).ExtraAttributes(request)
+	require.Len(t, extra, 1)
+
+	// Attributes of a credential of which only the credential itself was requested
+	extra = (&DisclosureChoice{Attributes: [][]*AttributeIdentifier{
+		{attr("irma-demo.RU.studentCard.studentID")},
+		{attr("irma-demo.MijnOverheid.root.BSN")},
+	}}).ExtraAttributes(request)
+	require.Equal(t, []*AttributeIdentifier{attr("irma-demo.MijnOverheid.root.BSN")}, extra)
+
+	// Disjunctions that were not requested
+	extra = (&DisclosureChoice{Attributes: [][]*AttributeIdentifier{
+		{attr("irma-demo.RU.studentCard.studentID")}, {}, {attr("irma-demo.RU.studentCard.level")},
+	}}).ExtraAttributes(request)
+	require.Equal(t, []*AttributeIdentifier{attr("irma-demo.RU.studentCard.level")}, extra)
+
+	// Explicitly allowed extras
+	request.AllowedExtras = []AttributeTypeIdentifier{
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"),
+		NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+	}
+	require.Empty(t, (&DisclosureChoice{Attributes: [][]*AttributeIdentifier{
+		{attr("irma-demo.RU.studentCard.studentID"), attr("irma-demo.RU.studentCard.level")},
+		{attr("irma-demo.MijnOverheid.root.BSN")}, {attr("irma-demo.RU.studentCard.level")},
+	}}).ExtraAttributes(request))
+}
+
+// statusFixture serves the status endpoints of a session with requestor token "token".
+// The statusevents endpoint is handled by events, or fails as if server-sent events are disabled
+// if it is nil; the status endpoint returns the statuses in turn, repeating the last one, and
+// signals fetched so that events can wait for the client to catch up after connecting.
+type statusFixture struct {
+	*httptest.Server
+	mutex        sync.Mutex
+	statuses     []ServerStatus
+	lastEventIDs []string
+	fetched      chan struct{}
+	events       func(w http.ResponseWriter, r *http.Request, connection int)
+}
+
+func newStatusFixture(t *testing.T, statuses ...ServerStatus) *statusFixture {
+	f := &statusFixture{statuses: statuses, fetched: make(chan struct{}, 10)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mutex.Lock()
+		switch r.URL.Path {
+		case "/session/token/status":
+			status := f.statuses[0]
+			if len(f.statuses) > 1 {
+				f.statuses = f.statuses[1:]
+			}
+			f.mutex.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `"%s"`, status)
+			f.fetched <- struct{}{}
+		case "/session/token/statusevents":
+			f.lastEventIDs = append(f.lastEventIDs, r.Header.Get("Last-Event-ID"))
+			connection := len(f.lastEventIDs)
+			f.mutex.Unlock()
+			if f.events == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"error":"SSE_DISABLED","status":500}`))
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			f.events(w, r, connection)
+		default:
+			f.mutex.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *statusFixture) setStatus(status ServerStatus) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.statuses = []ServerStatus{status}
+}
+
+func (f *statusFixture) subscribe(ctx context.Context) (<-chan ServerStatus, <-chan error) {
+	return SubscribeSessionStatus(ctx, NewHTTPTransport(f.URL, false), "token")
+}
+
+func receiveStatuses(t *testing.T, statuschan <-chan ServerStatus, errorchan <-chan error) ([]ServerStatus, error) {
+	var statuses []ServerStatus
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case status, ok := <-statuschan:
+			if !ok {
+				return statuses, <-errorchan
+			}
+			statuses = append(statuses, status)
+		case <-timeout:
+			t.Fatal("status channel not closed")
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string) {
+	_, _ = w.Write([]byte(event + "\n\n"))
+	w.(http.Flusher).Flush()
+}
+
+func TestSubscribeSessionStatus(t *testing.T) {
+	t.Run("server-sent events with disconnect", func(t *testing.T) {
+		f := newStatusFixture(t, ServerStatusInitialized)
+		f.events = func(w http.ResponseWriter, r *http.Request, connection int) {
+			writeEvent(w, "retry: 10")
+			writeEvent(w, "event: open")
+			<-f.fetched
+			switch connection {
+			case 1:
+				f.setStatus(ServerStatusConnected)
+				writeEvent(w, `id: 1`+"\n"+`data: "CONNECTED"`)
+				// Drop the connection mid-stream
+			case 2:
+				writeEvent(w, `: comment`)
+				writeEvent(w, `id: 2`+"\n"+`data: "CONNECTED"`) // duplicates are not sent again
+				f.setStatus(ServerStatusDone)
+				writeEvent(w, `id: 3`+"\n"+`data: "DONE"`)
+				<-r.Context().Done()
+			}
+		}
+
+		statuschan, errorchan := f.subscribe(context.Background())
+		statuses, err := receiveStatuses(t, statuschan, errorchan)
+		require.NoError(t, err)
+		require.Equal(t, []ServerStatus{ServerStatusInitialized, ServerStatusConnected, ServerStatusDone}, statuses)
+		require.Equal(t, []string{"", "1"}, f.lastEventIDs)
+	})
+
+	t.Run("status changed while disconnected", func(t *testing.T) {
+		f := newStatusFixture(t, ServerStatusConnected)
+		f.events = func(w http.ResponseWriter, r *http.Request, connection int) {
+			writeEvent(w, "retry: 10")
+			<-f.fetched
+			if connection == 1 {
+				writeEvent(w, `id: 1`+"\n"+`data: "CONNECTED"`)
+				// The session finishes before we reconnect
+				f.setStatus(ServerStatusCancelled)
+				return
+			}
+			<-r.Context().Done()
+		}
+
+		statuschan, errorchan := f.subscribe(context.Background())
+		statuses, err := receiveStatuses(t, statuschan, errorchan)
+		require.NoError(t, err)
+		require.Equal(t, []ServerStatus{ServerStatusConnected, ServerStatusCancelled}, statuses)
+	})
+
+	t.Run("server-sent events unsupported", func(t *testing.T) {
+		f := newStatusFixture(t, ServerStatusInitialized, ServerStatusConnected, ServerStatusTimeout)
+		statuschan, errorchan := f.subscribe(context.Background())
+		statuses, err := receiveStatuses(t, statuschan, errorchan)
+		require.NoError(t, err)
+		require.Equal(t, []ServerStatus{ServerStatusInitialized, ServerStatusConnected, ServerStatusTimeout}, statuses)
+		require.Len(t, f.lastEventIDs, 1)
+	})
+
+	t.Run("connections without events", func(t *testing.T) {
+		f := newStatusFixture(t, ServerStatusInitialized, ServerStatusInitialized, ServerStatusInitialized, ServerStatusDone)
+		f.events = func(w http.ResponseWriter, r *http.Request, connection int) {
+			writeEvent(w, "retry: 10")
+		}
+		statuschan, errorchan := f.subscribe(context.Background())
+		statuses, err := receiveStatuses(t, statuschan, errorchan)
+		require.NoError(t, err)
+		require.Equal(t, []ServerStatus{ServerStatusInitialized, ServerStatusDone}, statuses)
+		require.Len(t, f.lastEventIDs, sseMaxReconnects)
+	})
+
+	t.Run("unknown session", func(t *testing.T) {
+		f := newStatusFixture(t, ServerStatusInitialized)
+		statuschan, errorchan := SubscribeSessionStatus(context.Background(), NewHTTPTransport(f.URL, false), "other")
+		statuses, err := receiveStatuses(t, statuschan, errorchan)
+		require.Error(t, err)
+		require.Empty(t, statuses)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		f := newStatusFixture(t, ServerStatusInitialized)
+		f.events = func(w http.ResponseWriter, r *http.Request, connection int) {
+			writeEvent(w, "retry: 10")
+			<-r.Context().Done()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		statuschan, errorchan := f.subscribe(ctx)
+		require.Equal(t, ServerStatusInitialized, <-statuschan)
+		cancel()
+		statuses, err := receiveStatuses(t, statuschan, errorchan)
+		require.NoError(t, err)
+		require.Empty(t, statuses)
+	})
+}
+
+func TestTranslatedStringTranslation(t *testing.T) {
+	// Some entries are translated into German, others are not
+	var credtype CredentialType
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+		<Name><en>Student Card</en><nl>Studentenkaart</nl><de>Studentenausweis</de></Name>
+		<SchemeManager>irma-demo</SchemeManager>
+		<IssuerID>RU</IssuerID>
+		<CredentialID>studentCard</CredentialID>
+		<Description><en>Student card</en><nl>Studentenkaart</nl></Description>
+		<Attributes>
+			<Attribute id="university"><Name><en>University</en><nl>Universiteit</nl><de>Universität</de></Name></Attribute>
+			<Attribute id="studentID"><Name><en>Student number</en><nl>Studentnummer</nl></Name></Attribute>
+			<Attribute id="level"><Name><nl>Niveau</nl><de>Stufe</de></Name></Attribute>
+			<Attribute id="remark"><Name><fr></fr><nl>Opmerking</nl><de>Bemerkung</de></Name></Attribute>
+		</Attributes>
+	</IssueSpecification>`), &credtype))
+
+	require.Equal(t, TranslatedString{"en": "Student Card", "nl": "Studentenkaart", "de": "Studentenausweis"}, credtype.Name)
+	require.Equal(t, "Studentenausweis", credtype.Name.Translation("de"))
+	require.Equal(t, "Universität", credtype.AttributeTypes[0].Name.Translation("de"))
+	// Missing in the requested language: English
+	require.Equal(t, "Student number", credtype.AttributeTypes[1].Name.Translation("de"))
+	// Missing in the requested language and English: the first available language alphabetically
+	require.Equal(t, "Stufe", credtype.AttributeTypes[2].Name.Translation("fr"))
+	require.Equal(t, "Bemerkung", credtype.AttributeTypes[3].Name.Translation("fr"))
+	require.Equal(t, "", TranslatedString{}.Translation("en"))
+	require.Equal(t, "", TranslatedString(nil).Translation(""))
+
+	// Without a requested language, the preferred language is used
+	require.Equal(t, "Student Card", credtype.Name.Translation(""))
+	SetPreferredLanguage("de")
+	defer SetPreferredLanguage("en")
+	require.Equal(t, "Studentenausweis", credtype.Name.Translation(""))
+	require.Equal(t, "Student number", credtype.AttributeTypes[1].Name.Translation(""))
+	require.Equal(t, "Studentenkaart", credtype.Name.Translation("nl"))
+
+	// Labels of legacy disclosure requests are rendered in the preferred language
+	disjunctions, err := convertConDisCon(
+		AttributeConDisCon{{{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")}}}},
+		map[int]TranslatedString{0: {"en": "Student", "de": "Student*in"}},
+	)
+	require.NoError(t, err)
+	require.Equal(t, "Student*in", disjunctions[0].Label)
+}
+
+func TestBigIntWire(t *testing.T) {
+	nonce, _ := new(big.Int).SetString("272928078450884172688614363462324278601", 10)
+	disclose := `"disclose":[[["irma-demo.RU.studentCard.studentID"]]]`
+
+	t.Run("session requests", func(t *testing.T) {
+		for name, requestJson := range map[string]string{
+			// Recorded from current servers, encoding integers canonically in base64
+			"base64": `{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"zVQJMG6TKZwfcv5TExFVSQ==","protocolVersion":"2.5",` + disclose + `}`,
+			// Recorded from legacy servers, encoding integers as JSON numbers
+			"number":  `{"type":"disclosing","context":1,"nonce":272928078450884172688614363462324278601,"protocolVersion":"2.3","content":[{"label":"Student number","attributes":["irma-demo.RU.studentCard.studentID"]}]}`,
+			"decimal": `{"@context":"https://irma.app/ld/request/disclosure/v2","context":"1","nonce":"272928078450884172688614363462324278601",` + disclose + `}`,
+			"hex":     `{"@context":"https://irma.app/ld/request/disclosure/v2","context":"0x1","nonce":"0xcd5409306e93299c1f72fe5313115549",` + disclose + `}`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				request := &DisclosureRequest{}
+				require.NoError(t, json.Unmarshal([]byte(requestJson), request))
+				require.Equal(t, 0, nonce.Cmp(request.Nonce))
+				require.Equal(t, 0, big.NewInt(1).Cmp(request.Context))
+
+				bts, err := json.Marshal(request)
+				require.NoError(t, err)
+				require.Contains(t, string(bts), `"context":"AQ==","nonce":"zVQJMG6TKZwfcv5TExFVSQ=="`)
+			})
+		}
+
+		sigrequest := &SignatureRequest{}
+		require.NoError(t, json.Unmarshal([]byte(`{"@context":"https://irma.app/ld/request/signature/v2","context":"0x1","nonce":42,"message":"a",`+disclose+`}`), sigrequest))
+		require.Equal(t, int64(42), sigrequest.Nonce.Int64())
+		issrequest := &IssuanceRequest{}
+		require.NoError(t, json.Unmarshal([]byte(`{"@context":"https://irma.app/ld/request/issuance/v2","context":"1","nonce":"Kg==","credentials":[]}`), issrequest))
+		require.Equal(t, int64(42), issrequest.Nonce.Int64())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, value := range map[string]string{
+			"negative":  `-42`,
+			"fraction":  `4.2`,
+			"signed":    `"+42"`,
+			"hex":       `"0xg"`,
+			"base64":    `"Kg="`,
+			"oversized": `"0x` + strings.Repeat("ff", DefaultBigIntLimits.Nonce+1) + `"`,
+			"long":      strings.Repeat("9", 10000),
+		} {
+			t.Run(name, func(t *testing.T) {
+				request := &DisclosureRequest{}
+				requestJson := `{"@context":"https://irma.app/ld/request/disclosure/v2","nonce":` + value + `,` + disclose + `}`
+				require.Error(t, json.Unmarshal([]byte(requestJson), request))
+			})
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		_, _, disclosure := parseDisclosure(t)
+		bts, err := json.Marshal(disclosure)
+		require.NoError(t, err)
+
+		defer SetBigIntLimits(DefaultBigIntLimits)
+		SetBigIntLimits(BigIntLimits{Nonce: 8, Proof: 64})
+
+		request := &DisclosureRequest{}
+		requestJson := `{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"zVQJMG6TKZwfcv5TExFVSQ==",` + disclose + `}`
+		require.Error(t, json.Unmarshal([]byte(requestJson), request))
+
+		// The proofs contain integers of more than 64 bytes
+		require.Error(t, UnmarshalValidate(bts, &Disclosure{}))
+
+		SetBigIntLimits(DefaultBigIntLimits)
+		require.NoError(t, UnmarshalValidate(bts, &Disclosure{}))
+		require.NoError(t, json.Unmarshal([]byte(requestJson), request))
+	})
+}
+
+// revocationFixture issues an irma-demo.MijnOverheid.root credential against a new accumulator,
+// which it stores in the revocation storage of the returned configuration.
+func revocationFixture(t *testing.T) (*Configuration, *gabikeys.PrivateKey, *revocation.Update, *gabi.Credential) {
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	issuerid := credid.IssuerIdentifier()
+
+	ring, err := newPrivateKeyRingScheme(conf)
+	require.NoError(t, err)
+	sk, err := ring.Get(issuerid, 2)
+	require.NoError(t, err)
+	pk, err := conf.PublicKey(issuerid, 2)
+	require.NoError(t, err)
+
+	update, err := revocation.NewAccumulator(sk)
+	require.NoError(t, err)
+	require.NoError(t, conf.Revocation.AddUpdate(credid, update))
+	conf.Revocation.settings.Get(credid).updated = time.Now() // prevent fetching updates
+
+	witness, err := revocation.RandomWitness(sk, update.SignedAccumulator.Accumulator)
+	require.NoError(t, err)
+	witness.SignedAccumulator = update.SignedAccumulator
+
+	// The public key has expired, so we issue the credential before its expiry date
+	validity := Timestamp(time.Now().AddDate(1, 0, 0))
+	credreq := &CredentialRequest{
+		CredentialTypeID: credid,
+		KeyCounter:       2,
+		Validity:         &validity,
+		Attributes:       map[string]string{"BSN": "123456789"},
+	}
+	attrs, err := credreq.AttributeList(conf, 0x03, witness.E, time.Unix(pk.ExpiryDate, 0).AddDate(0, 0, -1))
+	require.NoError(t, err)
+
+	secret, err := gabi.GenerateSecretAttribute()
+	require.NoError(t, err)
+	nonce1, nonce2 := big.NewInt(1), big.NewInt(2)
+	builder, err := gabi.NewCredentialBuilder(pk, bigOne, secret, nonce2, nil)
+	require.NoError(t, err)
+	commit, err := builder.CommitToSecretAndProve(nonce1)
+	require.NoError(t, err)
+	msg, err := gabi.NewIssuer(sk, pk, bigOne).IssueSignature(commit.U, attrs.Ints, witness, nonce2, nil)
+	require.NoError(t, err)
+	cred, err := builder.ConstructCredential(msg, attrs.Ints)
+	require.NoError(t, err)
+
+	return conf, sk, update, cred
+}
+
+func revocationDisclosure(t *testing.T, conf *Configuration, cred *gabi.Credential) (*DisclosureRequest, *Disclosure) {
+	request := NewDisclosureRequest(NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"))
+	request.Context, request.Nonce = bigOne, big.NewInt(42)
+	require.NoError(t, request.RequestRevocation(conf, 0))
+
+	proof, err := cred.CreateDisclosureProof([]int{1, 2}, nil, true, request.Context, request.Nonce)
+	require.NoError(t, err)
+	return request, &Disclosure{
+		Proofs:  gabi.ProofList{proof},
+		Indices: DisclosedAttributeIndices{{{CredentialIndex: 0, AttributeIndex: 2}}},
+	}
+}
+
+func TestVerifyRevocation(t *testing.T) {
+	credid := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+
+	t.Run("not revoked", func(t *testing.T) {
+		conf, _, _, cred := revocationFixture(t)
+		request, disclosure := revocationDisclosure(t, conf, cred)
+
+		attrs, status, err := disclosure.Verify(conf, request)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusValid, status)
+		require.Equal(t, AttributeProofStatusPresent, attrs[0][0].Status)
+		require.True(t, attrs[0][0].NotRevoked)
+	})
+
+	t.Run("revoked within staleness window", func(t *testing.T) {
+		conf, sk, update, cred := revocationFixture(t)
+		request, disclosure := revocationDisclosure(t, conf, cred)
+
+		acc, event, err := update.SignedAccumulator.Accumulator.Remove(sk, cred.NonRevocationWitness.E, update.Events[0])
+		require.NoError(t, err)
+		revupdate, err := revocation.NewUpdate(sk, acc, []*revocation.Event{event})
+		require.NoError(t, err)
+		require.NoError(t, conf.Revocation.AddUpdate(credid, revupdate))
+
+		// The proof was made against the previous accumulator, which was current a moment ago
+		attrs, status, err := disclosure.Verify(conf, request)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusValid, status)
+		require.Equal(t, AttributeProofStatusPresent, attrs[0][0].Status)
+	})
+
+	t.Run("revoked with stale accumulator", func(t *testing.T) {
+		conf, sk, update, cred := revocationFixture(t)
+		request, disclosure := revocationDisclosure(t, conf, cred)
+
+		acc, event, err := update.SignedAccumulator.Accumulator.Remove(sk, cred.NonRevocationWitness.E, update.Events[0])
+		require.NoError(t, err)
+		revupdate, err := revocation.NewUpdate(sk, acc, []*revocation.Event{event})
+		require.NoError(t, err)
+		require.NoError(t, conf.Revocation.AddUpdate(credid, revupdate))
+
+		validAt := time.Now().Add(time.Duration(RevocationParameters.DefaultStaleness+60) * time.Second)
+		attrs, status, err := disclosure.VerifyAgainstRequest(conf, request, request.GetContext(), request.GetNonce(nil), nil, &validAt, false)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusMissingAttributes, status)
+		require.Equal(t, AttributeProofStatusRevoked, attrs[0][0].Status)
+		require.False(t, attrs[0][0].NotRevoked)
+	})
+
+	t.Run("stale accumulator not superseded", func(t *testing.T) {
+		conf, _, _, cred := revocationFixture(t)
+		request, disclosure := revocationDisclosure(t, conf, cred)
+
+		validAt := time.Now().Add(time.Duration(RevocationParameters.DefaultStaleness+60) * time.Second)
+		attrs, status, err := disclosure.VerifyAgainstRequest(conf, request, request.GetContext(), request.GetNonce(nil), nil, &validAt, false)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusValid, status)
+		require.Equal(t, AttributeProofStatusPresent, attrs[0][0].Status)
+		require.True(t, attrs[0][0].NotRevoked)
+	})
+}
+
+func TestRequestRevocation(t *testing.T) {
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+
+	request := NewDisclosureRequest(
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+	)
+	require.Error(t, request.RequestRevocation(conf, 0))
+	require.Error(t, request.RequestRevocation(conf, 2))
+	require.NoError(t, request.RequestRevocation(conf, 1))
+	require.Len(t, request.Revocation, 1)
+	require.NotNil(t, request.Revocation[credid])
+
+	// The nonrevocation requirement survives the requestor JWT
+	j, err := NewServiceProviderJwt("testsp", request).Sign(jwt.SigningMethodHS256, []byte("key"))
+	require.NoError(t, err)
+	parsed, err := ParseRequestorJwt(string(ActionDisclosing), j)
+	require.NoError(t, err)
+	require.NotNil(t, parsed.SessionRequest().Base().Revocation[credid])
+}
+
+func TestDisclosureResponseJSON(t *testing.T) {
+	_, request, disclosure := parseDisclosure(t)
+	expected, err := json.Marshal(disclosure)
+	require.NoError(t, err)
+
+	response := &DisclosureResponse{Disclosure: *disclosure, Context: request.GetContext(), Nonce: request.GetNonce(nil)}
+	bts, err := json.Marshal(response)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(bts))
+}
+
+func TestCanonicalDisclosure(t *testing.T) {
+	t.Run("condiscon", func(t *testing.T) {
+		request := &DisclosureRequest{}
+		require.NoError(t, json.Unmarshal([]byte(`{
+			"@context":"https://irma.app/ld/request/disclosure/v2",
+			"disclose":[
+				[["irma-demo.RU.studentCard.studentID"]],
+				[["irma-demo.MijnOverheid.root.BSN"],["irma-demo.MijnOverheid.root.BSN"]],
+				[["irma-demo.RU.studentCard.studentID"]],
+				[["irma-demo.RU.studentCard.university","irma-demo.RU.studentCard.university"]],
+				[[{"type":"irma-demo.RU.studentCard.studentID","value":"456"}]],
+				[["irma-demo.MijnOverheid.root.BSN"]]
+			],
+			"labels":{"0":{"en":"first"},"2":{"en":"third"},"5":{"en":"sixth"}}
+		}`), request))
+
+		indices := request.Canonicalize()
+		require.Equal(t, []int{0, 1, 0, 2, 3, 1}, indices)
+		value := "456"
+		require.Equal(t, AttributeConDisCon{
+			{{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")}}},
+			{{{Type: NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")}}},
+			{{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")}}},
+			{{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), Value: &value}}},
+		}, request.Disclose)
+		require.Equal(t, map[int]TranslatedString{0: {"en": "first"}, 1: {"en": "sixth"}}, request.Labels)
+
+		// Canonicalizing again changes nothing
+		require.Nil(t, request.Canonicalize())
+	})
+
+	t.Run("order of distinct disjunctions", func(t *testing.T) {
+		request := NewDisclosureRequest(
+			NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+			NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+			NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"),
+		)
+		expected := request.Disclose
+		require.Nil(t, request.Canonicalize())
+		require.Equal(t, expected, request.Disclose)
+
+		request.Disclose = append(request.Disclose, expected[1], expected[0])
+		require.Equal(t, []int{0, 1, 2, 1, 0}, request.Canonicalize())
+		require.Equal(t, expected, request.Disclose)
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		request := &DisclosureRequest{}
+		require.NoError(t, json.Unmarshal([]byte(`{"type":"disclosing","context":1,"nonce":1,"protocolVersion":"2.3","content":[
+			{"label":"Student number","attributes":["irma-demo.RU.studentCard.studentID","irma-demo.RU.studentCard.studentID"]},
+			{"label":"BSN","attributes":["irma-demo.MijnOverheid.root.BSN"]},
+			{"label":"Student number","attributes":["irma-demo.RU.studentCard.studentID"]}
+		]}`), request))
+
+		require.Equal(t, []int{0, 1, 0}, request.Canonicalize())
+		require.Equal(t, AttributeConDisCon{
+			{{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")}}},
+			{{{Type: NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")}}},
+		}, request.Disclose)
+		require.Equal(t, "Student number", request.Labels[0]["en"])
+		require.Equal(t, "BSN", request.Labels[1]["en"])
+	})
+}
+
+func TestCredentialValidity(t *testing.T) {
+	conf := parseConfiguration(t)
+	issuedAt := time.Now()
+	credreq := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+		KeyCounter:       1,
+		Attributes:       map[string]string{"BSN": "12345"},
+	}
+	check := func(validity *CredentialValidity) {
+		attrs, err := credreq.AttributeList(conf, 0x03, nil, issuedAt)
+		require.NoError(t, err)
+		require.Equal(t, attrs.MetadataAttribute.SigningDate().Unix(), time.Time(validity.SignedOn).Unix())
+		require.Equal(t, attrs.MetadataAttribute.Expiry().Unix(), time.Time(validity.Expires).Unix())
+		require.Equal(t, FloorToEpochBoundary(issuedAt).Unix(), time.Time(validity.SignedOn).Unix())
+		require.Zero(t, validity.Duration()%(ExpiryFactor*time.Second))
+	}
+
+	// Without validity, credentials are valid for six months, rounded down to whole epochs
+	validity, err := credreq.ValidityAt(issuedAt)
+	require.NoError(t, err)
+	check(validity)
+	require.Nil(t, validity.Requested)
+	sixMonths := time.Time(validity.SignedOn).AddDate(0, 6, 0)
+	require.False(t, time.Time(validity.Expires).After(sixMonths))
+	require.True(t, time.Time(validity.Expires).After(sixMonths.Add(-ExpiryFactor*time.Second)))
+
+	// The requested validity is rounded down to the epoch boundary after the signing date
+	requested := Timestamp(issuedAt.Add(10*24*time.Hour + 3*time.Hour))
+	credreq.Validity = &requested
+	validity, err = credreq.ValidityAt(issuedAt)
+	require.NoError(t, err)
+	check(validity)
+	require.Equal(t, &requested, validity.Requested)
+	require.Equal(t, ExpiryFactor*time.Second, validity.Duration())
+
+	// Validities ending before the signing date are invalid
+	expired := Timestamp(FloorToEpochBoundary(issuedAt).Add(-time.Hour))
+	credreq.Validity = &expired
+	_, err = credreq.ValidityAt(issuedAt)
+	require.Error(t, err)
+}
+
+// TestRequestJSONShape guards the JSON of session requests and disclosure choices, which UI
+// layers depend on.
+func TestRequestJSONShape(t *testing.T) {
+	studentID := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	level := "42"
+
+	dr := NewDisclosureRequest(studentID)
+	dr.Disclose[0] = append(dr.Disclose[0], AttributeCon{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"), Value: &level}})
+	dr.Labels = map[int]TranslatedString{0: {"en": "Student", "nl": "Student"}}
+	sr := NewSignatureRequest("message", studentID)
+	ir := NewIssuanceRequest([]*CredentialRequest{{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+		KeyCounter:       1,
+		Attributes:       map[string]string{"BSN": "12345"},
+	}})
+	ir.CredentialChanges = []*CredentialChange{{Credential: 0, New: &CredentialInfo{ID: "root"}, Declined: true}}
+
+	tests := []struct {
+		value interface{}
+		json  string
+	}{
+		{dr, `{
+			"@context": "https://irma.app/ld/request/disclosure/v2",
+			"disclose": [[["irma-demo.RU.studentCard.studentID"], [{"type": "irma-demo.RU.studentCard.level", "value": "42"}]]],
+			"labels": {"0": {"en": "Student", "nl": "Student"}}
+		}`},
+		{sr, `{
+			"@context": "https://irma.app/ld/request/signature/v2",
+			"disclose": [[["irma-demo.RU.studentCard.studentID"]]],
+			"labels": {"0": null},
+			"message": "message"
+		}`},
+		{ir, `{
+			"@context": "https://irma.app/ld/request/issuance/v2",
+			"credentials": [{"keyCounter": 1, "credential": "irma-demo.MijnOverheid.root", "attributes": {"BSN": "12345"}}],
+			"credentialChanges": [{"credential": 0, "declined": true, "new": {
+				"ID": "root", "IssuerID": "", "SchemeManagerID": "", "SignedOn": -62135596800, "Expires": -62135596800,
+				"Attributes": null, "Hash": "", "Revoked": false, "RevocationSupported": false
+			}}]
+		}`},
+		{&DisclosureChoice{
+			Attributes:          [][]*AttributeIdentifier{{{Type: studentID, CredentialHash: "hash"}}},
+			DeclinedCredentials: []int{1},
+		}, `{
+			"attributes": [[{"type": "irma-demo.RU.studentCard.studentID", "credentialHash": "hash"}]],
+			"declinedCredentials": [1]
+		}`},
+		{&DisclosureChoice{Attributes: [][]*AttributeIdentifier{{}}}, `{"attributes": [[]]}`},
+	}
+	for _, tt := range tests {
+		bts, err := json.Marshal(tt.value)
+		require.NoError(t, err)
+		require.JSONEq(t, tt.json, string(bts), "shape of %T changed", tt.value)
+
+		// The JSON parses back to the same value, apart from the derived data of issuance requests
+		parsed := reflect.New(reflect.TypeOf(tt.value).Elem()).Interface()
+		require.NoError(t, json.Unmarshal(bts, parsed))
+		if parsed, ok := parsed.(*IssuanceRequest); ok {
+			require.Nil(t, parsed.CredentialChanges)
+			parsed.CredentialChanges = ir.CredentialChanges
+		}
+		bts, err = json.Marshal(parsed)
+		require.NoError(t, err)
+		require.JSONEq(t, tt.json, string(bts))
+	}
+}
+
+func TestDisclosureChoiceJSON(t *testing.T) {
+	expected := &DisclosureChoice{Attributes: [][]*AttributeIdentifier{{
+		{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), CredentialHash: "hash"},
+	}}}
+
+	// Choices in the field names of earlier versions are still accepted
+	for _, choiceJson := range []string{
+		`{"attributes":[[{"type":"irma-demo.RU.studentCard.studentID","credentialHash":"hash"}]]}`,
+		`{"Attributes":[[{"Type":"irma-demo.RU.studentCard.studentID","CredentialHash":"hash"}]]}`,
+	} {
+		choice := &DisclosureChoice{}
+		require.NoError(t, json.Unmarshal([]byte(choiceJson), choice))
+		require.Equal(t, expected, choice)
+	}
+
+	for _, choiceJson := range []string{
+		`{"attributes":[[null]]}`,
+		`{"attributes":[[{"credentialHash":"hash"}]]}`,
+		`{"attributes":[[{"type":"irma-demo.RU.studentCard.studentID"}],[{}]]}`,
+	} {
+		require.Error(t, json.Unmarshal([]byte(choiceJson), &DisclosureChoice{}), choiceJson)
+	}
+}
+
+func TestCatalogue(t *testing.T) {
+	conf := parseConfiguration(t)
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	ru := NewIssuerIdentifier("irma-demo.RU")
+	studentCard := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	schemes := conf.CatalogueSchemes()
+	require.Len(t, schemes, len(conf.SchemeManagers))
+	require.True(t, sort.SliceIsSorted(schemes, func(i, j int) bool { return schemes[i].ID.String() < schemes[j].ID.String() }))
+	require.Equal(t, demo, schemes[0].ID)
+
+	issuers := conf.CatalogueIssuers(demo)
+	var ids []string
+	for _, issuer := range issuers {
+		ids = append(ids, issuer.ID.String())
+	}
+	require.Equal(t, []string{"irma-demo.MijnOverheid", "irma-demo.RU", "irma-demo.stemmen"}, ids)
+	require.Equal(t, "Demo Radboud University Nijmegen", issuers[1].Name.Translation("en"))
+	require.FileExists(t, issuers[1].Logo)
+
+	credtypes := conf.CatalogueCredentialTypes(ru)
+	require.Len(t, credtypes, 1)
+	require.Equal(t, studentCard, credtypes[0].ID)
+	require.Equal(t, "Demo Studentenkaart", credtypes[0].Name.Translation("nl"))
+	require.Equal(t, "https://example.com", credtypes[0].IssueURL.Translation("en"))
+	require.FileExists(t, credtypes[0].Logo)
+	require.False(t, credtypes[0].Singleton)
+	for _, credtype := range conf.CatalogueCredentialTypes(NewIssuerIdentifier("irma-demo.MijnOverheid")) {
+		require.Equal(t, conf.CredentialTypes[credtype.ID].IsSingleton, credtype.Singleton)
+	}
+
+	t.Run("search", func(t *testing.T) {
+		results := conf.SearchCatalogue("studenten", "nl")
+		require.Len(t, results, 1)
+		require.Equal(t, studentCard, results[0].ID)
+		require.Empty(t, conf.SearchCatalogue("studenten", "en"))
+
+		// Matching the issuer name yields its credential types, ignoring case
+		results = conf.SearchCatalogue("RADBOUD", "en")
+		require.Len(t, results, 1)
+		require.Equal(t, studentCard, results[0].ID)
+
+		require.Empty(t, conf.SearchCatalogue("no such credential", "en"))
+		require.Len(t, conf.SearchCatalogue("", "en"), len(conf.SearchCatalogue(" ", "nl")))
+	})
+
+	t.Run("deprecated", func(t *testing.T) {
+		conf.CredentialTypes[studentCard].DeprecatedSince = Timestamp(time.Now().Add(-time.Hour))
+		require.Empty(t, conf.CatalogueCredentialTypes(ru))
+		conf.CredentialTypes[studentCard].DeprecatedSince = Timestamp(time.Now().Add(time.Hour))
+		require.Len(t, conf.CatalogueCredentialTypes(ru), 1)
+
+		conf.Issuers[ru].DeprecatedSince = Timestamp(time.Now().Add(-time.Hour))
+		require.Empty(t, conf.CatalogueCredentialTypes(ru))
+		require.Len(t, conf.CatalogueIssuers(demo), 2)
+		require.Empty(t, conf.SearchCatalogue("radboud", "en"))
+	})
+}
+
+func TestEncryptAttributes(t *testing.T) {
+	pk, sk, err := GenerateSessionKey(rand.Reader)
+	require.NoError(t, err)
+	credreq := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		Attributes:       map[string]string{"studentID": "s1234567", "level": "42"},
+	}
+	require.NoError(t, credreq.EncryptAttribute("studentID", pk[:], rand.Reader))
+	require.Error(t, credreq.EncryptAttribute("studentID", pk[:], rand.Reader))
+	require.Error(t, credreq.EncryptAttribute("level", pk[:5], rand.Reader))
+	require.Equal(t, map[string]string{"level": "42"}, credreq.Attributes)
+	require.NotContains(t, string(credreq.EncryptedAttributes["studentID"]), "s1234567")
+
+	bts, err := json.Marshal(credreq)
+	require.NoError(t, err)
+	decoded := &CredentialRequest{}
+	require.NoError(t, json.Unmarshal(bts, decoded))
+
+	other, otherSk, err := GenerateSessionKey(rand.Reader)
+	require.NoError(t, err)
+	require.Error(t, decoded.DecryptAttributes(other, otherSk))
+	require.NoError(t, decoded.DecryptAttributes(pk, sk))
+	require.Equal(t, map[string]string{"studentID": "s1234567", "level": "42"}, decoded.Attributes)
+	require.Nil(t, decoded.EncryptedAttributes)
+
+	// An attribute may not be both encrypted and not encrypted
+	credreq.Attributes["studentID"] = "s7654321"
+	require.Error(t, NewIssuanceRequest([]*CredentialRequest{credreq}).Validate())
+
+	hello := &ClientHello{LDContext: LDContextClientHello, MinProtocolVersion: NewVersion(2, 4), MaxProtocolVersion: NewVersion(2, 8)}
+	require.NoError(t, hello.Validate())
+	hello.EncryptionKey = pk[:5]
+	require.Error(t, hello.Validate())
+}
+
+func TestHTTPTransportRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("target"))
+	}))
+	defer target.Close()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/moved/same", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/cross":
+			http.Redirect(w, r, target.URL+"/cross", http.StatusFound)
+		default:
+			_, _ = w.Write([]byte("origin"))
+		}
+	})
+	origin := httptest.NewServer(handler)
+	defer origin.Close()
+
+	// Redirects within the origin are followed, and subsequent requests go to the new URL
+	transport := NewHTTPTransport(origin.URL, false)
+	var result string
+	require.NoError(t, transport.Get("same", &result))
+	require.Equal(t, "origin", result)
+	require.Equal(t, origin.URL+"/moved/", transport.Server)
+
+	err := NewHTTPTransport(origin.URL, false).Get("loop", &result)
+	require.True(t, IsErrorType(err, ErrorRedirect))
+
+	// Redirects to other origins need to be allowed by the RedirectFunc
+	transport = NewHTTPTransport(origin.URL, false)
+	err = transport.Get("cross", &result)
+	require.True(t, IsErrorType(err, ErrorRedirect))
+	require.Equal(t, target.URL+"/cross", err.(*SessionError).Info)
+
+	var from, to string
+	transport.SetRedirectFunc(func(f, t *url.URL) bool {
+		from, to = f.String(), t.String()
+		return true
+	})
+	require.NoError(t, transport.Get("cross", &result))
+	require.Equal(t, "target", result)
+	require.Equal(t, origin.URL+"/cross", from)
+	require.Equal(t, target.URL+"/cross", to)
+	require.Equal(t, target.URL+"/", transport.Server)
+
+	// Redirects from https to http are never followed
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	transport = NewHTTPTransport(secure.URL, false)
+	transport.SetRoundTripper(secure.Client().Transport)
+	transport.SetRedirectFunc(func(_, _ *url.URL) bool { return true })
+	err = transport.Get("cross", &result)
+	require.True(t, IsErrorType(err, ErrorRedirect))
+}
+
+func TestHTTPTransportContentType(t *testing.T) {
+	status := `{"proofStatus":"VALID"}`
+	html := "<html><body>" + strings.Repeat("Bad gateway ", 50) + "</body></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/html":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(html))
+		case "/mislabeled":
+			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			_, _ = w.Write([]byte(status))
+		case "/latin1":
+			w.Header().Set("Content-Type", "application/json; charset=ISO-8859-1")
+			_, _ = w.Write([]byte(status))
+		case "/valid":
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte("VALID"))
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_, _ = w.Write([]byte(status))
+		}
+	}))
+	defer server.Close()
+	transport := NewHTTPTransport(server.URL, false)
+
+	// An HTML page with status 200 is rejected with the start of the page
+	result := ServerSessionResponse{ProtocolVersion: NewVersion(2, 8)}
+	err := transport.Get("html", &result)
+	require.True(t, IsErrorType(err, ErrorUnexpectedContentType))
+	require.Equal(t, html[:contentTypeErrorBodySize], err.(*SessionError).Info)
+	require.Equal(t, http.StatusOK, err.(*SessionError).RemoteStatus)
+	var str string
+	require.True(t, IsErrorType(transport.Get("html", &str), ErrorUnexpectedContentType))
+
+	// JSON is rejected if it is labeled as something else, or in another charset than UTF-8
+	err = transport.Get("mislabeled", &result)
+	require.True(t, IsErrorType(err, ErrorUnexpectedContentType))
+	require.Equal(t, status, err.(*SessionError).Info)
+	require.True(t, IsErrorType(transport.Get("latin1", &result), ErrorUnexpectedContentType))
+
+	// Correct responses are accepted, regardless of the case of the charset
+	require.NoError(t, transport.Get("json", &result))
+	require.Equal(t, ProofStatusValid, result.ProofStatus)
+	require.NoError(t, transport.Get("valid", &str))
+	require.Equal(t, "VALID", str)
+}
+
+func TestAttributeIndex(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	attrs := conf.AttributeIndex()
+	require.NotEmpty(t, attrs)
+	require.True(t, sort.SliceIsSorted(attrs, func(i, j int) bool { return attrs[i].ID.String() < attrs[j].ID.String() }))
+	var studentID, prefix *IndexedAttribute
+	for _, attr := range attrs {
+		require.False(t, conf.AttributeTypes[attr.ID].RevocationAttribute)
+		switch attr.ID {
+		case NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"):
+			studentID = attr
+		case NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.prefix"):
+			prefix = attr
+		}
+	}
+	require.NotNil(t, studentID)
+	require.Equal(t, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), studentID.CredentialType)
+	require.Equal(t, "Student number", studentID.Name["en"])
+	require.Equal(t, "Demo Student Card", studentID.CredentialTypeName["en"])
+	require.False(t, studentID.Optional)
+	require.NotNil(t, prefix)
+	require.True(t, prefix.Optional)
+
+	// The reverse index ignores case
+	require.Equal(t, []CredentialTypeIdentifier{NewCredentialTypeIdentifier("irma-demo.RU.studentCard")},
+		conf.CredentialTypesContaining("StudentID"))
+	email := conf.CredentialTypesContaining("email")
+	require.Len(t, email, 5)
+	require.True(t, sort.SliceIsSorted(email, func(i, j int) bool { return email[i].String() < email[j].String() }))
+	require.Empty(t, conf.CredentialTypesContaining("nonexistent"))
+
+	// The index follows changes of the schemes
+	require.NoError(t, conf.ParseFolder())
+	require.Len(t, conf.AttributeIndex(), len(attrs))
+	conf.SchemeManagers[NewSchemeManagerIdentifier("test2")].purge(conf)
+	require.Len(t, conf.CredentialTypesContaining("email"), 4)
+}
+
+func TestValidateScheme(t *testing.T) {
+	conf := parseConfiguration(t)
+	issues, err := conf.ValidateScheme(NewSchemeManagerIdentifier("irma-demo"))
+	require.NoError(t, err)
+	for _, issue := range issues {
+		require.Equal(t, SchemeValidationWarning, issue.Severity, issue.String())
+	}
+	_, err = conf.ValidateScheme(NewSchemeManagerIdentifier("nonexistent"))
+	require.Error(t, err)
+
+	// Validate an unsigned copy of the scheme, of which we keep the index up to date while breaking it
+	storage := t.TempDir()
+	dir := filepath.Join(storage, "irma-demo")
+	require.NoError(t, common.CopyDirectory(filepath.Join(test.FindTestdataFolder(t), "irma_configuration", "irma-demo"), dir))
+	require.NoError(t, os.Remove(filepath.Join(dir, "index.sig")))
+	conf, err = NewConfiguration(storage, ConfigurationOptions{ReadOnly: true})
+	require.NoError(t, err)
+	conf.SetDeveloperMode(true)
+
+	write := func(file, contents string, rehash bool) {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+		if !rehash {
+			return
+		}
+		bts, err := ioutil.ReadFile(filepath.Join(dir, "index"))
+		require.NoError(t, err)
+		index := SchemeManagerIndex{}
+		require.NoError(t, index.FromString(string(bts)))
+		hash := sha256.Sum256([]byte(contents))
+		index["irma-demo/"+file] = hash[:]
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index"), []byte(index.String()), 0644))
+	}
+	validate := func() (errs, warnings []*SchemeValidationIssue) {
+		issues, err := conf.ValidateScheme(NewSchemeManagerIdentifier("irma-demo"))
+		require.NoError(t, err)
+		for _, issue := range issues {
+			if issue.Severity == SchemeValidationError {
+				errs = append(errs, issue)
+			} else {
+				warnings = append(warnings, issue)
+			}
+		}
+		return
+	}
+
+	// Public keys that don't parse, and missing logos
+	write("MijnOverheid/PublicKeys/1.xml", "<IssuerPublicKey>", true)
+	require.NoError(t, os.Remove(filepath.Join(dir, "RU", "Issues", "studentCard", "logo.png")))
+	errs, warnings := validate()
+	require.Len(t, errs, 1)
+	require.Equal(t, "MijnOverheid/PublicKeys/1.xml", errs[0].File)
+	require.Contains(t, warnings, &SchemeValidationIssue{
+		Severity: SchemeValidationWarning,
+		File:     "RU/Issues/studentCard/logo.png",
+		Message:  "Credential type irma-demo.RU.studentCard has no logo.png",
+	})
+	require.Contains(t, warnings, &SchemeValidationIssue{
+		Severity: SchemeValidationWarning,
+		File:     "RU/Issues/studentCard/logo.png",
+		Message:  "File irma-demo/RU/Issues/studentCard/logo.png in scheme index does not exist",
+	})
+
+	// Malformed descriptions are reported with their line
+	write("RU/Issues/studentCard/description.xml", "<IssueSpecification version=\"4\">\n<Name>\n</IssueSpecification>", true)
+	errs, _ = validate()
+	require.Len(t, errs, 1)
+	require.Equal(t, "RU/Issues/studentCard/description.xml", errs[0].File)
+	require.Equal(t, 3, errs[0].Line)
+
+	// All files not matching the index are reported
+	write("RU/Issues/studentCard/description.xml", "modified", false)
+	write("MijnOverheid/description.xml", "modified", false)
+	errs, _ = validate()
+	require.Len(t, errs, 2)
+	require.Equal(t, "MijnOverheid/description.xml", errs[0].File)
+	require.Equal(t, "RU/Issues/studentCard/description.xml", errs[1].File)
+	require.Contains(t, errs[1].Message, "does not match scheme manager index")
+}
+
+func TestAttributeSensitivity(t *testing.T) {
+	cred := &CredentialType{}
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+		<SchemeManager>irma-demo</SchemeManager><IssuerID>RU</IssuerID><CredentialID>contact</CredentialID>
+		<Attributes>
+			<Attribute id="email" sensitivity="contact"></Attribute>
+			<Attribute id="bsn" sensitivity="identifier"></Attribute>
+			<Attribute id="name"></Attribute>
+			<Attribute id="other" sensitivity="secret"></Attribute>
+		</Attributes>
+	</IssueSpecification>`), cred))
+	require.Equal(t, AttributeSensitivityContact, cred.AttributeTypes[0].Sensitivity)
+	require.Equal(t, AttributeSensitivityIdentifier, cred.AttributeTypes[1].Sensitivity)
+	require.Equal(t, AttributeSensitivityNone, cred.AttributeTypes[2].Sensitivity)
+	require.True(t, cred.AttributeTypes[1].Sensitivity.Sensitive())
+	require.False(t, cred.AttributeTypes[2].Sensitivity.Sensitive())
+
+	conf := &Configuration{}
+	require.NoError(t, conf.validateAttributes(cred, ""))
+	require.Contains(t, conf.Warnings, "Credential type irma-demo.RU.contact has unknown sensitivity secret at attribute other")
+}
+
+func TestKeyRollover(t *testing.T) {
+	conf := parseConfiguration(t)
+	now := time.Now()
+	status := func(issuer string, counter uint, at time.Time) KeyStatus {
+		s, err := conf.KeyStatus(PublicKeyIdentifier{Issuer: NewIssuerIdentifier(issuer), Counter: counter}, at)
+		require.NoError(t, err)
+		return s
+	}
+
+	// The newest key that has not expired, skipping newer expired keys
+	pk, err := conf.LatestKey(NewIssuerIdentifier("irma-demo.RU"))
+	require.NoError(t, err)
+	require.Equal(t, uint(2), pk.Counter)
+	pk, err = conf.LatestKey(NewIssuerIdentifier("irma-demo.MijnOverheid"))
+	require.NoError(t, err)
+	require.Equal(t, uint(1), pk.Counter)
+	_, err = conf.LatestKey(NewIssuerIdentifier("irma-demo.unknown"))
+	require.Error(t, err)
+
+	require.Equal(t, KeyStatusValid, status("irma-demo.RU", 2, now))
+	require.Equal(t, KeyStatusExpired, status("irma-demo.RU", 1, now))
+	require.Equal(t, KeyStatusValid, status("irma-demo.MijnOverheid", 1, now))
+
+	// Keys are deprecated when the issuer rolled over to a newer key, or when they expire soon
+	require.Equal(t, KeyStatusDeprecated, status("test.test", 1, now))
+	require.Equal(t, KeyStatusValid, status("test.test", 3, now))
+	pk, err = conf.PublicKey(NewIssuerIdentifier("test.test"), 3)
+	require.NoError(t, err)
+	expiry := time.Unix(pk.ExpiryDate, 0)
+	require.Equal(t, KeyStatusDeprecated, status("test.test", 3, expiry.Add(-KeyExpiryWarningPeriod/2)))
+	require.Equal(t, KeyStatusExpired, status("test.test", 3, expiry.Add(time.Second)))
+
+	_, err = conf.KeyStatus(PublicKeyIdentifier{Issuer: NewIssuerIdentifier("irma-demo.RU"), Counter: 9}, now)
+	require.Error(t, err)
+}
+
+// batchFixture returns n disclosures of the studentID of one of two student cards with different
+// studentIDs, alternately, each against its own request.
+func batchFixture(t testing.TB, conf *Configuration, n int) []VerificationItem {
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	ring, err := NewPrivateKeyRingFolder("testdata/privatekeys", conf)
+	require.NoError(t, err)
+	sk, err := ring.Get(credid.IssuerIdentifier(), 2)
+	require.NoError(t, err)
+	pk, err := conf.PublicKey(credid.IssuerIdentifier(), 2)
+	require.NoError(t, err)
+
+	var creds []*gabi.Credential
+	for _, studentID := range []string{"s1", "s2"} {
+		credreq := &CredentialRequest{
+			CredentialTypeID: credid,
+			KeyCounter:       2,
+			Attributes: map[string]string{
+				"university": "Radboud", "studentCardNumber": "1", "studentID": studentID, "level": "1",
+			},
+		}
+		attrs, err := credreq.AttributeList(conf, 0x03, nil, time.Now())
+		require.NoError(t, err)
+		secret, err := gabi.GenerateSecretAttribute()
+		require.NoError(t, err)
+		nonce1, nonce2 := big.NewInt(1), big.NewInt(2)
+		builder, err := gabi.NewCredentialBuilder(pk, bigOne, secret, nonce2, nil)
+		require.NoError(t, err)
+		commit, err := builder.CommitToSecretAndProve(nonce1)
+		require.NoError(t, err)
+		msg, err := gabi.NewIssuer(sk, pk, bigOne).IssueSignature(commit.U, attrs.Ints, nil, nonce2, nil)
+		require.NoError(t, err)
+		cred, err := builder.ConstructCredential(msg, attrs.Ints)
+		require.NoError(t, err)
+		creds = append(creds, cred)
+	}
+
+	items := make([]VerificationItem, n)
+	for i := range items {
+		request := NewDisclosureRequest(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+		request.Context, request.Nonce = bigOne, big.NewInt(int64(i))
+		proof, err := creds[i%2].CreateDisclosureProof([]int{1, 4}, nil, false, request.Context, request.Nonce)
+		require.NoError(t, err)
+		items[i] = VerificationItem{
+			Request: request,
+			Disclosure: &Disclosure{
+				Proofs:  gabi.ProofList{proof},
+				Indices: DisclosedAttributeIndices{{{CredentialIndex: 0, AttributeIndex: 4}}},
+			},
+		}
+	}
+	return items
+}
+
+func TestVerifyProofsBatch(t *testing.T) {
+	conf := parseConfiguration(t)
+	items := batchFixture(t, conf, 20)
+
+	// Tamper with the disclosed studentID of one of the proofs
+	tampered := 13
+	proofd := items[tampered].Disclosure.Proofs[0].(*gabi.ProofD)
+	proofd.ADisclosed[4] = items[tampered-1].Disclosure.Proofs[0].(*gabi.ProofD).ADisclosed[4]
+
+	// A missing request does not affect the other items either
+	items = append(items, VerificationItem{Disclosure: items[0].Disclosure})
+
+	results := conf.VerifyProofsBatch(items)
+	require.Len(t, results, len(items))
+	for i, result := range results[:len(results)-1] {
+		if i == tampered {
+			require.Equal(t, ProofStatusInvalid, result.Status)
+			require.Nil(t, result.Attributes)
+			continue
+		}
+		require.NoError(t, result.Err)
+		require.Equal(t, ProofStatusValid, result.Status, i)
+		require.Equal(t, fmt.Sprintf("s%d", i%2+1), *result.Attributes[0][0].RawValue)
+
+		// Results equal those of verifying the items one by one
+		attrs, status, err := items[i].Disclosure.Verify(conf, items[i].Request)
+		require.NoError(t, err)
+		require.Equal(t, status, result.Status)
+		require.Equal(t, attrs, result.Attributes)
+	}
+	require.Equal(t, ProofStatusInvalid, results[len(results)-1].Status)
+	require.Error(t, results[len(results)-1].Err)
+}
+
+func BenchmarkVerifyProofs(b *testing.B) {
+	conf := parseConfiguration(b)
+	items := batchFixture(b, conf, 1000)
+
+	b.Run("single", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, item := range items {
+				_, status, err := item.Disclosure.Verify(conf, item.Request)
+				require.NoError(b, err)
+				require.Equal(b, ProofStatusValid, status)
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, result := range conf.VerifyProofsBatch(items) {
+				require.NoError(b, result.Err)
+				require.Equal(b, ProofStatusValid, result.Status)
+			}
+		}
+	})
+}
+
+// keyCacheFixture returns a configuration lacking the public keys of irma-demo.RU, which downloads
+// them using the cache from a scheme server serving the scheme in the specified testdata directory,
+// of which the requests are counted.
+func keyCacheFixture(t *testing.T, storage string, cache KeyCache, dir string) (*Configuration, map[string]int, *sync.Mutex) {
+	path := filepath.Join(storage, "keycache_configuration")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+		require.NoError(t, os.RemoveAll(filepath.Join(path, "irma-demo", "RU", "PublicKeys")))
+	}
+	conf, err := NewConfiguration(path, ConfigurationOptions{ReadOnly: true, KeyCache: cache})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	requests, mutex := map[string]int{}, &sync.Mutex{}
+	fileserver := http.FileServer(http.Dir(filepath.Join("testdata", dir, "irma-demo")))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests[r.URL.Path]++
+		mutex.Unlock()
+		fileserver.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")].URL = server.URL
+	return conf, requests, mutex
+}
+
+func TestKeyCache(t *testing.T) {
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+	issuer := NewIssuerIdentifier("irma-demo.RU")
+
+	t.Run("coalesced download", func(t *testing.T) {
+		conf, requests, mutex := keyCacheFixture(t, storage, NewMemoryKeyCache(), "irma_configuration")
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pk, err := conf.PublicKey(issuer, 2)
+				require.NoError(t, err)
+				require.NotNil(t, pk)
+				require.Equal(t, uint(2), pk.Counter)
+				require.Equal(t, "irma-demo.RU", pk.Issuer)
+			}()
+		}
+		wg.Wait()
+		mutex.Lock()
+		defer mutex.Unlock()
+		require.Equal(t, map[string]int{"/index": 1, "/index.sig": 1, "/timestamp": 1, "/RU/PublicKeys/2.xml": 1}, requests)
+
+		// Keys that are not in the index are not downloaded
+		pk, err := conf.PublicKey(issuer, 9)
+		require.NoError(t, err)
+		require.Nil(t, pk)
+		require.Len(t, requests, 4)
+	})
+
+	t.Run("file cache", func(t *testing.T) {
+		cache, err := NewFileKeyCache(filepath.Join(storage, "keycache"))
+		require.NoError(t, err)
+		conf, requests, _ := keyCacheFixture(t, storage, cache, "irma_configuration")
+		pk, err := conf.PublicKey(issuer, 2)
+		require.NoError(t, err)
+		require.NotNil(t, pk)
+		require.Len(t, requests, 4)
+
+		// Another configuration finds the index and the key in the cache
+		conf, requests, _ = keyCacheFixture(t, storage, cache, "irma_configuration")
+		pk, err = conf.PublicKey(issuer, 2)
+		require.NoError(t, err)
+		require.NotNil(t, pk)
+		require.Empty(t, requests)
+
+		// Tampered cache entries are downloaded again
+		key := "irma-demo/RU/PublicKeys/2.xml"
+		bts, ok := cache.Get(key)
+		require.True(t, ok)
+		require.NoError(t, cache.Put(key, bytes.Replace(bts, []byte("<Counter>2"), []byte("<Counter>1"), 1), time.Hour))
+		conf, requests, _ = keyCacheFixture(t, storage, cache, "irma_configuration")
+		pk, err = conf.PublicKey(issuer, 2)
+		require.NoError(t, err)
+		require.NotNil(t, pk)
+		require.Equal(t, map[string]int{"/RU/PublicKeys/2.xml": 1}, requests)
+	})
+
+	t.Run("index timestamp", func(t *testing.T) {
+		cache := NewMemoryKeyCache()
+		conf, requests, _ := keyCacheFixture(t, storage, cache, "irma_configuration")
+		pk, err := conf.PublicKey(issuer, 2)
+		require.NoError(t, err)
+		require.NotNil(t, pk)
+		require.Equal(t, 1, requests["/index"])
+
+		// Once the scheme is updated, the cached index is outdated
+		conf, requests, _ = keyCacheFixture(t, storage, cache, "irma_configuration_updated")
+		scheme := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+		scheme.Timestamp = Timestamp(time.Time(scheme.Timestamp).Add(time.Second))
+		pk, err = conf.PublicKey(issuer, 1)
+		require.NoError(t, err)
+		require.NotNil(t, pk)
+		require.Equal(t, map[string]int{"/index": 1, "/index.sig": 1, "/timestamp": 1, "/RU/PublicKeys/1.xml": 1}, requests)
+
+		// Indices older than the scheme are refused
+		scheme.Timestamp = Timestamp(time.Time(scheme.Timestamp).Add(time.Hour))
+		_, err = conf.PublicKey(issuer, 0)
+		require.Error(t, err)
+	})
+}
+
+func TestIssuanceBindings(t *testing.T) {
+	studentID := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	disclosed := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	request := NewIssuanceRequest([]*CredentialRequest{{
+		CredentialTypeID: studentID.CredentialTypeIdentifier(),
+		Attributes:       map[string]string{"studentID": "s1234567"},
+	}}, disclosed)
+	request.Bindings = []*AttributeBinding{{Attribute: studentID, Disclosed: disclosed}}
+	require.NoError(t, request.Validate())
+
+	// The attributes of a binding must be issued and requested respectively
+	request.Bindings[0].Attribute = NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	require.Error(t, request.Validate())
+	request.Bindings[0].Attribute = studentID
+	request.Bindings[0].Disclosed = studentID
+	require.Error(t, request.Validate())
+	request.Bindings[0].Disclosed = disclosed
+
+	value, other := "s1234567", "s7654321"
+	require.NoError(t, request.VerifyBindings([][]*DisclosedAttribute{{{Identifier: disclosed, RawValue: &value}}}))
+	require.Error(t, request.VerifyBindings([][]*DisclosedAttribute{{{Identifier: disclosed, RawValue: &other}}}))
+	require.Error(t, request.VerifyBindings([][]*DisclosedAttribute{{{Identifier: disclosed}}}))
+	require.Error(t, request.VerifyBindings(nil))
+
+	// Credentials that are not issued are not checked
+	require.NoError(t, request.VerifyBindings([][]*DisclosedAttribute{{{Identifier: disclosed, RawValue: &other}}}, 0))
+
+	// Bindings survive (un)marshaling
+	bts, err := json.Marshal(request)
+	require.NoError(t, err)
+	parsed := &IssuanceRequest{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, request.Bindings, parsed.Bindings)
+}
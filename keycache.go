@@ -0,0 +1,242 @@
+package irma
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// This file contains the downloading of public keys on demand, for verifiers that do not keep the
+// public keys of all issuers in their scheme directories. Of a missing public key, only the key
+// file is downloaded from the scheme server, along with the signed index of the scheme to verify
+// it against. Both are cached in a KeyCache.
+
+// KeyCache caches files downloaded from scheme servers, see ConfigurationOptions.KeyCache.
+// Its values are verified against the signed scheme index whenever they are used, so a KeyCache
+// may be shared between Configurations and processes.
+type KeyCache interface {
+	// Get returns the value stored under the key, or false if there is none or it has expired.
+	Get(key string) ([]byte, bool)
+	// Put stores the value under the key, until the ttl has passed.
+	Put(key string, value []byte, ttl time.Duration) error
+}
+
+const (
+	// defaultKeyCacheTTL is how long scheme indices are cached by default, see
+	// ConfigurationOptions.KeyCacheTTL.
+	defaultKeyCacheTTL = time.Hour
+
+	// publicKeyCacheTTL is how long public keys are cached. Public key files do not change, and
+	// they are checked against the current scheme index whenever they are used.
+	publicKeyCacheTTL = 30 * 24 * time.Hour
+)
+
+// MemoryKeyCache is a KeyCache that keeps its values in memory.
+type MemoryKeyCache struct {
+	sync.Mutex
+	entries map[string]keyCacheEntry
+}
+
+// FileKeyCache is a KeyCache that stores its values as files in a directory.
+type FileKeyCache struct {
+	dir string
+}
+
+type keyCacheEntry struct {
+	Value   []byte `json:"value"`
+	Expires int64  `json:"expires"`
+}
+
+// cachedSchemeIndex is a scheme index as stored in a KeyCache.
+type cachedSchemeIndex struct {
+	Index     []byte `json:"index"`
+	Signature []byte `json:"signature,omitempty"`
+	Timestamp []byte `json:"timestamp"`
+}
+
+// cacheDownload is a download of a file into the KeyCache, of which the result is shared by all
+// callers that need the file while it is in progress, see coalesce.
+type cacheDownload struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// NewMemoryKeyCache returns an empty KeyCache keeping its values in memory.
+func NewMemoryKeyCache() *MemoryKeyCache {
+	return &MemoryKeyCache{entries: map[string]keyCacheEntry{}}
+}
+
+func (c *MemoryKeyCache) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().Unix() > entry.Expires {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+func (c *MemoryKeyCache) Put(key string, value []byte, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = keyCacheEntry{Value: value, Expires: time.Now().Add(ttl).Unix()}
+	return nil
+}
+
+// NewFileKeyCache returns a KeyCache storing its values in the specified directory, which is
+// created if it does not exist.
+func NewFileKeyCache(dir string) (*FileKeyCache, error) {
+	if err := common.EnsureDirectoryExists(dir); err != nil {
+		return nil, err
+	}
+	return &FileKeyCache{dir: dir}, nil
+}
+
+func (c *FileKeyCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:]))
+}
+
+func (c *FileKeyCache) Get(key string) ([]byte, bool) {
+	bts, err := os.ReadFile(c.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Logger.WithField("key", key).Warn("failed to read key cache: ", err)
+		}
+		return nil, false
+	}
+	var entry keyCacheEntry
+	if err = json.Unmarshal(bts, &entry); err != nil || time.Now().Unix() > entry.Expires {
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+func (c *FileKeyCache) Put(key string, value []byte, ttl time.Duration) error {
+	bts, err := json.Marshal(keyCacheEntry{Value: value, Expires: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return err
+	}
+	return common.SaveFile(c.path(key), bts)
+}
+
+// coalesce returns the result of f, calling it only if no other call of coalesce with the same key
+// is in progress; otherwise it waits for that call and returns its result.
+func (conf *Configuration) coalesce(key string, f func() (interface{}, error)) (interface{}, error) {
+	conf.downloadsMutex.Lock()
+	if d, ok := conf.downloads[key]; ok {
+		conf.downloadsMutex.Unlock()
+		<-d.done
+		return d.value, d.err
+	}
+	d := &cacheDownload{done: make(chan struct{})}
+	if conf.downloads == nil {
+		conf.downloads = map[string]*cacheDownload{}
+	}
+	conf.downloads[key] = d
+	conf.downloadsMutex.Unlock()
+
+	d.value, d.err = f()
+	conf.downloadsMutex.Lock()
+	delete(conf.downloads, key)
+	conf.downloadsMutex.Unlock()
+	close(d.done)
+	return d.value, d.err
+}
+
+// downloadPublicKey returns the specified public key from the KeyCache, downloading it from the
+// server of its scheme if it is not cached; or nil if the index of the scheme does not contain it.
+func (conf *Configuration) downloadPublicKey(id IssuerIdentifier, counter uint) (*gabikeys.PublicKey, error) {
+	scheme := conf.SchemeManagers[id.SchemeManagerIdentifier()]
+	if scheme == nil || scheme.URL == "" {
+		return nil, nil
+	}
+	path := fmt.Sprintf("%s/PublicKeys/%d.xml", id.Name(), counter)
+	key := scheme.ID + "/" + path
+
+	pk, err := conf.coalesce(key, func() (interface{}, error) {
+		index, err := conf.cachedSchemeIndex(scheme)
+		if err != nil {
+			return nil, err
+		}
+		hash, ok := index[key]
+		if !ok {
+			return nil, nil
+		}
+
+		bts, cached := conf.options.KeyCache.Get(key)
+		if sha := sha256.Sum256(bts); !cached || !bytes.Equal(sha[:], hash) {
+			Logger.WithField("key", key).Info("downloading public key")
+			if bts, err = conf.newSchemeTransport(scheme.URL).GetBytes(path); err != nil {
+				return nil, err
+			}
+			if sha = sha256.Sum256(bts); !bytes.Equal(sha[:], hash) {
+				return nil, errors.Errorf("Hash of %s does not match scheme manager index", key)
+			}
+			if err = conf.options.KeyCache.Put(key, bts, publicKeyCacheTTL); err != nil {
+				Logger.WithField("key", key).Warn("failed to cache public key: ", err)
+			}
+		}
+		return parsePublicKey(id, counter, key, bts)
+	})
+	if err != nil || pk == nil {
+		return nil, err
+	}
+	conf.publicKeys.Set(PublicKeyIdentifier{id, counter}, pk.(*gabikeys.PublicKey))
+	return pk.(*gabikeys.PublicKey), nil
+}
+
+// cachedSchemeIndex returns the index of the scheme from the KeyCache, downloading it from the
+// server of the scheme if it is not cached, or if the cached index is older than the scheme in
+// the scheme directory, e.g. because the scheme was updated since.
+func (conf *Configuration) cachedSchemeIndex(scheme *SchemeManager) (SchemeManagerIndex, error) {
+	key := scheme.ID + "/index"
+	index, err := conf.coalesce(key, func() (interface{}, error) {
+		if bts, ok := conf.options.KeyCache.Get(key); ok {
+			var cached cachedSchemeIndex
+			if err := json.Unmarshal(bts, &cached); err == nil {
+				index, timestamp, err := conf.verifySchemeIndex(scheme, cached.Index, cached.Signature, cached.Timestamp)
+				if err == nil && !timestamp.Before(scheme.Timestamp) {
+					return index, nil
+				}
+			}
+		}
+
+		Logger.WithField("scheme", scheme.ID).Info("downloading scheme index")
+		state, err := conf.checkRemoteTimestamp(scheme)
+		if err != nil {
+			return nil, err
+		}
+		if state.timestamp.Before(scheme.Timestamp) {
+			return nil, errors.Errorf("index of scheme %s at its server is older than the scheme", scheme.ID)
+		}
+		bts, err := json.Marshal(cachedSchemeIndex{Index: state.indexBytes, Signature: state.signatureBytes, Timestamp: state.timestampBytes})
+		if err != nil {
+			return nil, err
+		}
+		ttl := conf.options.KeyCacheTTL
+		if ttl == 0 {
+			ttl = defaultKeyCacheTTL
+		}
+		if err = conf.options.KeyCache.Put(key, bts, ttl); err != nil {
+			Logger.WithField("scheme", scheme.ID).Warn("failed to cache scheme index: ", err)
+		}
+		return state.index, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index.(SchemeManagerIndex), nil
+}
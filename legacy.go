@@ -1,10 +1,12 @@
 package irma
 
 import (
+	"bytes"
 	"encoding/json"
 
 	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago/internal/common"
 )
 
@@ -74,7 +76,7 @@ func convertConDisCon(cdc AttributeConDisCon, labels map[int]TranslatedString) (
 			}
 			l.Attributes = append(l.Attributes, AttributeRequest{Type: con[0].Type, Value: con[0].Value})
 		}
-		l.Label = labels[i]["en"]
+		l.Label = labels[i].Translation("")
 		if l.Label == "" {
 			l.Label = l.Attributes[0].Type.Name()
 		}
@@ -179,19 +181,30 @@ func (dr *DisclosureRequest) UnmarshalJSON(bts []byte) (err error) {
 
 	if ldContext != "" {
 		type newDisclosureRequest DisclosureRequest // Same type with default JSON unmarshaler
-		var req newDisclosureRequest
+		var req struct {
+			newDisclosureRequest
+			Context *BigInt `json:"context"`
+			Nonce   *BigInt `json:"nonce"`
+		}
 		if err = json.Unmarshal(bts, &req); err != nil {
 			return err
 		}
-		*dr = DisclosureRequest(req)
-		return nil
+		*dr = DisclosureRequest(req.newDisclosureRequest)
+		return dr.setWireInts(req.Context, req.Nonce)
 	}
 
-	var legacy LegacyDisclosureRequest
+	var legacy struct {
+		LegacyDisclosureRequest
+		Context *BigInt `json:"context"`
+		Nonce   *BigInt `json:"nonce"`
+	}
 	if err = json.Unmarshal(bts, &legacy); err != nil {
 		return err
 	}
 	dr.BaseRequest = legacy.BaseRequest
+	if err = dr.setWireInts(legacy.Context, legacy.Nonce); err != nil {
+		return err
+	}
 	dr.legacy = true
 	dr.LDContext = LDContextDisclosureRequest
 	dr.Disclose, dr.Labels = convertDisjunctions(legacy.Content)
@@ -200,6 +213,9 @@ func (dr *DisclosureRequest) UnmarshalJSON(bts []byte) (err error) {
 }
 
 func (sr *SignatureRequest) Legacy() (SessionRequest, error) {
+	if sr.MessageType.orDefault() != SignatureMessageTypeString {
+		return nil, errors.Errorf("message type %s not supported in legacy protocol", sr.MessageType)
+	}
 	disjunctions, err := convertConDisCon(sr.Disclose, sr.Labels)
 	if err != nil {
 		return nil, err
@@ -227,9 +243,17 @@ func (sr *SignatureRequest) UnmarshalJSON(bts []byte) (err error) {
 	if ldContext != "" {
 		var req struct { // Identical type with default JSON unmarshaler
 			BaseRequest
-			Disclose AttributeConDisCon       `json:"disclose"`
-			Labels   map[int]TranslatedString `json:"labels"`
-			Message  string                   `json:"message"`
+			Disclose      AttributeConDisCon        `json:"disclose"`
+			Labels        map[int]TranslatedString  `json:"labels"`
+			AllowedExtras []AttributeTypeIdentifier `json:"allowedExtras"`
+			Message       string                    `json:"message"`
+
+			MessageType     SignatureMessageType `json:"messageType"`
+			MessageFilename string               `json:"messageFilename"`
+			MessageMimeType string               `json:"messageMimeType"`
+
+			Context *BigInt `json:"context"`
+			Nonce   *BigInt `json:"nonce"`
 		}
 		if err = json.Unmarshal(bts, &req); err != nil {
 			return err
@@ -239,17 +263,28 @@ func (sr *SignatureRequest) UnmarshalJSON(bts []byte) (err error) {
 				req.BaseRequest,
 				req.Disclose,
 				req.Labels,
+				req.AllowedExtras,
 			},
 			req.Message,
+			req.MessageType,
+			req.MessageFilename,
+			req.MessageMimeType,
 		}
-		return nil
+		return sr.setWireInts(req.Context, req.Nonce)
 	}
 
-	var legacy LegacySignatureRequest
+	var legacy struct {
+		LegacySignatureRequest
+		Context *BigInt `json:"context"`
+		Nonce   *BigInt `json:"nonce"`
+	}
 	if err = json.Unmarshal(bts, &legacy); err != nil {
 		return err
 	}
 	sr.BaseRequest = legacy.BaseRequest
+	if err = sr.setWireInts(legacy.Context, legacy.Nonce); err != nil {
+		return err
+	}
 	sr.legacy = true
 	sr.LDContext = LDContextSignatureRequest
 	sr.Disclose, sr.Labels = convertDisjunctions(legacy.Content)
@@ -284,25 +319,40 @@ func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) (err error) {
 	if ldContext != "" {
 		var req struct { // Identical type with default JSON unmarshaler
 			BaseRequest
-			Disclose    AttributeConDisCon       `json:"disclose"`
-			Labels      map[int]TranslatedString `json:"labels"`
-			Credentials []*CredentialRequest     `json:"credentials"`
+			Disclose      AttributeConDisCon        `json:"disclose"`
+			Labels        map[int]TranslatedString  `json:"labels"`
+			AllowedExtras []AttributeTypeIdentifier `json:"allowedExtras"`
+			Credentials   []*CredentialRequest      `json:"credentials"`
+			Atomic        bool                      `json:"atomic"`
+			Bindings      []*AttributeBinding       `json:"bindings"`
+
+			Context *BigInt `json:"context"`
+			Nonce   *BigInt `json:"nonce"`
 		}
 		if err = json.Unmarshal(bts, &req); err != nil {
 			return err
 		}
 		*ir = IssuanceRequest{
-			DisclosureRequest: DisclosureRequest{req.BaseRequest, req.Disclose, req.Labels},
+			DisclosureRequest: DisclosureRequest{req.BaseRequest, req.Disclose, req.Labels, req.AllowedExtras},
 			Credentials:       req.Credentials,
+			Atomic:            req.Atomic,
+			Bindings:          req.Bindings,
 		}
-		return nil
+		return ir.setWireInts(req.Context, req.Nonce)
 	}
 
-	var legacy LegacyIssuanceRequest
+	var legacy struct {
+		LegacyIssuanceRequest
+		Context *BigInt `json:"context"`
+		Nonce   *BigInt `json:"nonce"`
+	}
 	if err = json.Unmarshal(bts, &legacy); err != nil {
 		return err
 	}
 	ir.BaseRequest = legacy.BaseRequest
+	if err = ir.setWireInts(legacy.Context, legacy.Nonce); err != nil {
+		return err
+	}
 	ir.legacy = true
 	ir.LDContext = LDContextIssuanceRequest
 	ir.Credentials = legacy.Credentials
@@ -314,7 +364,21 @@ func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) (err error) {
 func (s *ServerSessionResponse) MarshalJSON() ([]byte, error) {
 	if !s.ProtocolVersion.Below(2, 7) {
 		type response ServerSessionResponse
-		return json.Marshal((*response)(s))
+		if len(s.IssueErrors) == 0 {
+			return json.Marshal((*response)(s))
+		}
+		sigs := make([]interface{}, len(s.IssueSignatures))
+		for i, sig := range s.IssueSignatures {
+			if err, ok := s.IssueErrors[i]; ok {
+				sigs[i] = err
+			} else {
+				sigs[i] = sig
+			}
+		}
+		return json.Marshal(struct {
+			*response
+			IssueSignatures []interface{} `json:"sigs"`
+		}{(*response)(s), sigs})
 	}
 
 	if s.NextSession != nil {
@@ -330,20 +394,121 @@ func (s *ServerSessionResponse) MarshalJSON() ([]byte, error) {
 func (s *ServerSessionResponse) UnmarshalJSON(bts []byte) error {
 	if !s.ProtocolVersion.Below(2, 7) {
 		type response ServerSessionResponse
-		return json.Unmarshal(bts, (*response)(s))
-	}
-	if s.SessionType != ActionIssuing {
-		return json.Unmarshal(bts, &s.ProofStatus)
+		var r struct {
+			*response
+			IssueSignatures []json.RawMessage `json:"sigs,omitempty"`
+		}
+		r.response = (*response)(s)
+		if err := json.Unmarshal(bts, &r); err != nil {
+			return err
+		}
+		status, err := parseProofStatus(s.ProofStatus)
+		s.ProofStatus = status
+		if err != nil {
+			return err
+		}
+		if err = s.parseIssueSignatures(r.IssueSignatures); err != nil {
+			return err
+		}
+		return checkProofInts(s.IssueSignatures)
 	}
 
-	err := json.Unmarshal(bts, &s.IssueSignatures)
+	// Legacy servers respond to proofs with the bare proof status, and to commitments with the
+	// bare signatures; some respond with an object containing the proof status instead, and on
+	// rejected commitments they respond with the proof status.
+	var legacy legacyServerSessionResponse
+	if err := json.Unmarshal(bts, &legacy); err != nil {
+		return err
+	}
+	if legacy.IssueSignatures != nil {
+		if s.SessionType != ActionIssuing {
+			return errors.New("received issuance signatures in non-issuance session")
+		}
+		s.IssueSignatures = legacy.IssueSignatures
+		s.ProofStatus = ProofStatusValid
+		return checkProofInts(s.IssueSignatures)
+	}
+	status, err := parseProofStatus(legacy.ProofStatus)
 	if err != nil {
 		return err
 	}
-	s.ProofStatus = ProofStatusValid
+	if s.SessionType == ActionIssuing && status == ProofStatusValid {
+		return errors.New("received no issuance signatures")
+	}
+	s.ProofStatus = status
+	return nil
+}
+
+// parseIssueSignatures parses the signatures of an issuance response, which newer servers may
+// mix with errors for the credentials they could not issue.
+func (s *ServerSessionResponse) parseIssueSignatures(sigs []json.RawMessage) error {
+	s.IssueSignatures, s.IssueErrors = nil, nil
+	if sigs == nil {
+		return nil
+	}
+	s.IssueSignatures = make([]*gabi.IssueSignatureMessage, len(sigs))
+	for i, bts := range sigs {
+		var probe struct {
+			Error *string `json:"error"`
+		}
+		if err := json.Unmarshal(bts, &probe); err != nil {
+			return err
+		}
+		if probe.Error == nil {
+			if err := json.Unmarshal(bts, &s.IssueSignatures[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		remoteErr := &RemoteError{}
+		if err := json.Unmarshal(bts, remoteErr); err != nil {
+			return err
+		}
+		if s.IssueErrors == nil {
+			s.IssueErrors = map[int]*RemoteError{}
+		}
+		s.IssueErrors[i] = remoteErr
+	}
 	return nil
 }
 
+// legacyServerSessionResponse is any of the shapes of the server session response of protocol
+// versions below 2.7.
+type legacyServerSessionResponse struct {
+	ProofStatus     ProofStatus
+	IssueSignatures []*gabi.IssueSignatureMessage
+}
+
+func (r *legacyServerSessionResponse) UnmarshalJSON(bts []byte) error {
+	bts = bytes.TrimSpace(bts)
+	if len(bts) == 0 {
+		return errors.New("empty server session response")
+	}
+	switch bts[0] {
+	case '"':
+		return json.Unmarshal(bts, &r.ProofStatus)
+	case '[':
+		if err := json.Unmarshal(bts, &r.IssueSignatures); err != nil {
+			return err
+		}
+		if r.IssueSignatures == nil {
+			r.IssueSignatures = []*gabi.IssueSignatureMessage{}
+		}
+		return nil
+	case '{':
+		var obj struct {
+			ProofStatus ProofStatus `json:"proofStatus"`
+		}
+		if err := json.Unmarshal(bts, &obj); err != nil {
+			return err
+		}
+		r.ProofStatus = obj.ProofStatus
+		return nil
+	default:
+		return errors.Errorf("unexpected server session response %.20s", bts)
+	}
+}
+
 type KeyshareKeyRegistration struct {
 	PublicKeyRegistrationJWT string `json:"jwt"`
 }
@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/privacybydesign/irmago/internal/common"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 )
 
 // ClientStatus encodes the client status of an IRMA session (e.g., connected).
@@ -40,24 +42,41 @@ func NewVersion(major, minor int) *ProtocolVersion {
 	return &ProtocolVersion{major, minor}
 }
 
+// ParseVersion parses a protocol version of the form x.y.
+func ParseVersion(str string) (*ProtocolVersion, error) {
+	parts := strings.Split(str, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid protocol version number: not of form x.y")
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if major < 0 || minor < 0 {
+		return nil, errors.New("Invalid protocol version number: negative number")
+	}
+	return NewVersion(major, minor), nil
+}
+
 func (v *ProtocolVersion) String() string {
 	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
 }
 
-func (v *ProtocolVersion) UnmarshalJSON(b []byte) (err error) {
+func (v *ProtocolVersion) UnmarshalJSON(b []byte) error {
 	var str string
 	if err := json.Unmarshal(b, &str); err != nil {
 		str = string(b) // If b is not enclosed by quotes, try it directly
 	}
-	parts := strings.Split(str, ".")
-	if len(parts) != 2 {
-		return errors.New("Invalid protocol version number: not of form x.y")
-	}
-	if v.Major, err = strconv.Atoi(parts[0]); err != nil {
-		return
+	parsed, err := ParseVersion(str)
+	if err != nil {
+		return err
 	}
-	v.Minor, err = strconv.Atoi(parts[1])
-	return
+	*v = *parsed
+	return nil
 }
 
 func (v *ProtocolVersion) MarshalJSON() ([]byte, error) {
@@ -87,6 +106,11 @@ func (v *ProtocolVersion) AboveVersion(other *ProtocolVersion) bool {
 	return v.Above(other.Major, other.Minor)
 }
 
+// AtLeast returns true if v is equal to or above the given version.
+func (v *ProtocolVersion) AtLeast(other *ProtocolVersion) bool {
+	return !v.BelowVersion(other)
+}
+
 // GetMetadataVersion maps a chosen protocol version to a metadata version that
 // the server will use.
 func GetMetadataVersion(v *ProtocolVersion) byte {
@@ -109,6 +133,8 @@ type SessionError struct {
 	Info         string
 	RemoteError  *RemoteError
 	RemoteStatus int
+	// ProofStatus is the status with which the server rejected our response, in case of ErrorRejected.
+	ProofStatus ProofStatus
 }
 
 // RemoteError is an error message returned by the API server on errors.
@@ -169,6 +195,76 @@ type Qr struct {
 	URL string `json:"u"`
 	// Session type (disclosing, signing, issuing)
 	Type Action `json:"irmaqr"`
+	// Hello indicates that the server requires the client to POST a ClientHello before it
+	// hands out the session request.
+	Hello bool `json:"hello,omitempty"`
+	// Range of protocol versions that the server supports for this session. When absent the
+	// client assumes that the server supports all versions that the client supports.
+	ProtocolVersion    *ProtocolVersion `json:"v,omitempty"`
+	MaxProtocolVersion *ProtocolVersion `json:"vmax,omitempty"`
+}
+
+// MinProtocolVersion and MaxProtocolVersion bound the IRMA protocol versions supported by
+// irmago, and are included in QRs generated by NewQr that do not specify their own range.
+var (
+	MinProtocolVersion = NewVersion(2, 4)
+	MaxProtocolVersion = NewVersion(2, 8)
+)
+
+// qrLinkPrefix is the prefix of links that open a session in the IRMA app, followed by
+// the URL-escaped JSON of the Qr.
+const qrLinkPrefix = "irma://qr/json/"
+
+// NewQr returns the session pointer of a session of the specified type at sessionURL, that
+// requestors can show to the user as QR or link, see Link.
+func NewQr(action Action, sessionURL string) *Qr {
+	return &Qr{URL: sessionURL, Type: action}
+}
+
+// MarshalJSON marshals the Qr, including the range of protocol versions supported by irmago
+// if the Qr does not specify its own.
+func (qr Qr) MarshalJSON() ([]byte, error) {
+	type alias Qr
+	a := alias(qr)
+	if a.ProtocolVersion == nil {
+		a.ProtocolVersion = MinProtocolVersion
+	}
+	if a.MaxProtocolVersion == nil {
+		a.MaxProtocolVersion = MaxProtocolVersion
+	}
+	return json.Marshal(a)
+}
+
+// Link returns the irma:// link with which the IRMA app starts the session of the Qr, for
+// users that open the session on the device on which the IRMA app is installed.
+func (qr *Qr) Link() (string, error) {
+	if err := qr.Validate(); err != nil {
+		return "", err
+	}
+	bts, err := json.Marshal(qr)
+	if err != nil {
+		return "", err
+	}
+	return qrLinkPrefix + url.PathEscape(string(bts)), nil
+}
+
+// ParseQrLink parses a link as returned by Qr.Link.
+func ParseQrLink(link string) (*Qr, error) {
+	if !strings.HasPrefix(link, qrLinkPrefix) {
+		return nil, errors.New("not an IRMA session link")
+	}
+	str, err := url.PathUnescape(strings.TrimPrefix(link, qrLinkPrefix))
+	if err != nil {
+		return nil, err
+	}
+	qr := &Qr{}
+	if err = json.Unmarshal([]byte(str), qr); err != nil {
+		return nil, err
+	}
+	if err = qr.Validate(); err != nil {
+		return nil, err
+	}
+	return qr, nil
 }
 
 // Tokens to identify a session from the perspective of the different agents
@@ -199,9 +295,16 @@ type FrontendAuthorization string
 
 // Client statuses
 const (
-	ClientStatusConnected     = ClientStatus("connected")
-	ClientStatusCommunicating = ClientStatus("communicating")
-	ClientStatusManualStarted = ClientStatus("manualStarted")
+	ClientStatusCreated       = ClientStatus("created")       // The session has been created but not yet started
+	ClientStatusManualStarted = ClientStatus("manualStarted") // A session without server has been started
+	ClientStatusCommunicating = ClientStatus("communicating") // The client is communicating with the server or keyshare server
+	ClientStatusConnected     = ClientStatus("connected")     // The client is waiting for the user, e.g. for permission or a PIN
+	ClientStatusPairing       = ClientStatus("pairing")       // The client waits for the user to enter the pairing code in the frontend
+	ClientStatusRetrying      = ClientStatus("retrying")      // The client could not reach the server to send its response and will retry
+	ClientStatusCancelled     = ClientStatus("cancelled")     // The session was cancelled by the user or the server
+	ClientStatusDone          = ClientStatus("done")          // The session has completed successfully
+	ClientStatusTimeout       = ClientStatus("timeout")       // The session expired at the server
+	ClientStatusError         = ClientStatus("error")         // The session failed
 )
 
 // Server statuses
@@ -240,6 +343,10 @@ const (
 	ErrorCrypto = ErrorType("crypto")
 	// Error involving revocation or nonrevocation proofs
 	ErrorRevocation = ErrorType("revocation")
+	// The request asks for a nonrevocation proof of a credential that was issued to us without the
+	// nonrevocation witness that this requires, so that the user has to obtain it again; the Info
+	// of the error contains the credential type
+	ErrorMissingWitness = ErrorType("missingWitness")
 	// Our pairing attempt was rejected by the server
 	ErrorPairingRejected = ErrorType("pairingRejected")
 	// Server rejected our response (second IRMA message)
@@ -250,6 +357,16 @@ const (
 	ErrorKeyshare = ErrorType("keyshare")
 	// The user is not enrolled at one of the keyshare servers needed for the request
 	ErrorKeyshareUnenrolled = ErrorType("keyshareUnenrolled")
+	// Too many incorrect PINs were entered recently; the user has to wait before trying again
+	ErrorKeysharePinBackoff = ErrorType("keysharePinBackoff")
+	// The PIN does not satisfy the PIN policy of the keyshare server; the Info of the error
+	// contains the violated constraint
+	ErrorKeysharePinPolicy = ErrorType("keysharePinPolicy")
+	// The keyshare server can't be used until the user has verified their email address;
+	// the Info of the error contains the scheme of the keyshare server
+	ErrorKeyshareEmailNotVerified = ErrorType("keyshareEmailNotVerified")
+	// The keyshare server supports none of the keyshare protocol versions that we support
+	ErrorKeyshareVersionUnsupported = ErrorType("keyshareVersionUnsupported")
 	// API server error
 	ErrorApi = ErrorType("api")
 	// Server returned unexpected or malformed response
@@ -266,10 +383,51 @@ const (
 	ErrorInvalidSchemeManager = ErrorType("invalidSchemeManager")
 	// Invalid session request
 	ErrorInvalidRequest = ErrorType("invalidRequest")
+	// The nonce or context sent by the server is out of the bounds of the protocol
+	ErrorInvalidSessionInfo = ErrorType("invalidSessionInfo")
 	// Recovered panic
 	ErrorPanic = ErrorType("panic")
 	// Error involving random blind attributes
 	ErrorRandomBlind = ErrorType("randomblind")
+	// The client is locked and was not unlocked when requested
+	ErrorLocked = ErrorType("locked")
+	// The client has been closed
+	ErrorClosed = ErrorType("closed")
+	// The session was blocked by a session policy of the client
+	ErrorRequestorBlocked = ErrorType("requestorBlocked")
+	// The server does not know the session, because it expired or another device already started it
+	ErrorSessionUnknownOrExpired = ErrorType("sessionUnknownOrExpired")
+	// The session expired at the server before the client could send its response
+	ErrorSessionExpired = ErrorType("sessionExpired")
+	// The chosen attributes would disclose more than the session request asked for
+	ErrorOverDisclosure = ErrorType("overDisclosure")
+	// The issuance request does not specify the public key of an issuer;
+	// the Info of the error contains the issuer
+	ErrorMissingPublicKeyCounter = ErrorType("missingPublicKeyCounter")
+	// The validity of a credential to be issued was refused by the ValidityPolicy of the client;
+	// the Info of the error contains the credential type
+	ErrorValidityRefused = ErrorType("validityRefused")
+	// The server sent a response larger than the transport accepts, see
+	// HTTPTransport.SetMaxResponseSize; the Info of the error contains the host of the server
+	ErrorResponseTooLarge = ErrorType("responseTooLarge")
+	// The issuer did not issue all credentials while the issuance request is atomic, or did not
+	// issue any of them; the Info of the error contains the host of the issuer and its
+	// RemoteError the reason given by the issuer
+	ErrorIssuanceFailed = ErrorType("issuanceFailed")
+	// The server redirected to a URL that the transport does not follow, see
+	// HTTPTransport.SetRedirectFunc; the Info of the error contains the URL
+	ErrorRedirect = ErrorType("redirect")
+	// The server responded with another content type or charset than the protocol prescribes,
+	// e.g. an HTML page of a misconfigured proxy; the Info of the error contains the first 200
+	// bytes of the response
+	ErrorUnexpectedContentType = ErrorType("unexpectedContentType")
+	// An issued credential does not satisfy an AttributeBinding of the issuance request, so it was
+	// not stored; the Info of the error contains the bound attribute
+	ErrorIssuanceBindingViolated = ErrorType("issuanceBindingViolated")
+	// Sensitive attributes were chosen, but the Handler of the session cannot let the user confirm
+	// their disclosure a second time, so nothing was disclosed; the Info of the error contains the
+	// first sensitive attribute
+	ErrorSensitiveDisclosureUnconfirmed = ErrorType("sensitiveDisclosureUnconfirmed")
 )
 
 type Disclosure struct {
@@ -289,6 +447,15 @@ type DisclosedAttributeIndex struct {
 	Identifier      CredentialIdentifier `json:"-"` // credential from which this attribute was disclosed
 }
 
+// DisclosureResponse is the response of the client in disclosure and signature sessions: the
+// disclosure proofs, along with the context and nonce of the session request against which they
+// were computed. On the wire it is encoded as the Disclosure only.
+type DisclosureResponse struct {
+	Disclosure
+	Context *big.Int `json:"-"`
+	Nonce   *big.Int `json:"-"`
+}
+
 type IssueCommitmentMessage struct {
 	*gabi.IssueCommitmentMessage
 	Indices DisclosedAttributeIndices `json:"indices,omitempty"`
@@ -366,6 +533,45 @@ type KeysharePinStatus struct {
 	Message string `json:"message"`
 }
 
+// KeyshareStatus is advertised by keyshare servers at their status endpoint. It contains the range
+// of keyshare protocol versions that the keyshare server supports:
+//   - 1: PINs are verified by sending the hashed PIN, and enrollments and PIN changes are unsigned;
+//   - 2: PINs are verified using ECDSA challenge-response, and enrollments and PIN changes are signed.
+type KeyshareStatus struct {
+	MinVersion int `json:"min_version"`
+	MaxVersion int `json:"max_version"`
+}
+
+// KeysharePinPolicy contains the constraints that a keyshare server imposes on the PINs of its
+// users. Keyshare servers only receive hashed PINs, so the policy is enforced by the client.
+type KeysharePinPolicy struct {
+	MinLength  int    `json:"min_length"`
+	MaxLength  int    `json:"max_length,omitempty"` // 0 if there is no maximum
+	Characters string `json:"characters,omitempty"` // allowed characters; all if empty
+}
+
+// Check returns a *SessionError of type ErrorKeysharePinPolicy if the PIN violates the policy,
+// with the JSON name of the violated constraint as Info.
+func (policy *KeysharePinPolicy) Check(pin string) error {
+	length := utf8.RuneCountInString(pin)
+	var constraint string
+	switch {
+	case length < policy.MinLength:
+		constraint = "min_length"
+	case policy.MaxLength != 0 && length > policy.MaxLength:
+		constraint = "max_length"
+	case policy.Characters != "" && strings.Trim(pin, policy.Characters) != "":
+		constraint = "characters"
+	default:
+		return nil
+	}
+	return &SessionError{
+		Err:       errors.Errorf("PIN violates %s constraint of PIN policy", constraint),
+		ErrorType: ErrorKeysharePinPolicy,
+		Info:      constraint,
+	}
+}
+
 const (
 	KeyshareAuthMethodChallengeResponse = "pin_challengeresponse"
 )
@@ -416,10 +622,15 @@ func (e *SessionError) Error() string {
 		buffer.WriteString("\nStatus code: ")
 		buffer.WriteString(strconv.Itoa(e.RemoteStatus))
 	}
-	if e.RemoteError != nil {
+	var remote *RemoteError
+	if e.RemoteError != nil && !(errors.As(e.Err, &remote) && remote == e.RemoteError) { // not already described
 		buffer.WriteString("\nIRMA server error: ")
 		buffer.WriteString(e.RemoteError.Error())
 	}
+	if e.ProofStatus != "" {
+		buffer.WriteString("\nProof status: ")
+		buffer.WriteString(string(e.ProofStatus))
+	}
 
 	return buffer.String()
 }
@@ -440,6 +651,71 @@ func (e *SessionError) Stack() string {
 	return ""
 }
 
+// Unwrap returns the error that caused this error, if any, so that errors.Is and errors.As
+// can inspect the causal chain.
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether this error is of the specified ErrorType, so that e.g.
+// errors.Is(err, ErrorTransport) returns true if err is a transport *SessionError.
+func (e *SessionError) Is(target error) bool {
+	typ, ok := target.(ErrorType)
+	return ok && typ == e.ErrorType
+}
+
+// MarshalJSON renders the error in a stable format, independent of the (unexported)
+// structure of the wrapped error.
+func (e *SessionError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ErrorType    ErrorType    `json:"type"`
+		Message      string       `json:"message,omitempty"`
+		Info         string       `json:"info,omitempty"`
+		RemoteStatus int          `json:"remoteStatus,omitempty"`
+		RemoteError  *RemoteError `json:"remoteError,omitempty"`
+	}{
+		ErrorType:    e.ErrorType,
+		Message:      e.WrappedError(),
+		Info:         e.Info,
+		RemoteStatus: e.RemoteStatus,
+		RemoteError:  e.RemoteError,
+	})
+}
+
+// IsErrorType reports whether err, or any error in its chain, is a *SessionError of the specified type.
+func IsErrorType(err error, typ ErrorType) bool {
+	return errors.Is(err, typ)
+}
+
+// IsTransportError reports whether err was caused by a failure in HTTP communication.
+func IsTransportError(err error) bool {
+	return IsErrorType(err, ErrorTransport)
+}
+
+// IsRemoteError reports whether err was caused by an error returned by the IRMA server or keyshare server,
+// i.e. whether it carries a *RemoteError.
+func IsRemoteError(err error) bool {
+	var serr *SessionError
+	return errors.As(err, &serr) && serr.RemoteError != nil
+}
+
+// IsKeyshareError reports whether err was caused by the keyshare protocol,
+// including the user not being enrolled at the keyshare server.
+func IsKeyshareError(err error) bool {
+	return IsErrorType(err, ErrorKeyshare) || IsErrorType(err, ErrorKeyshareUnenrolled)
+}
+
+func (d *DisclosureResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&d.Disclosure)
+}
+
+// MarshalJSON encodes the commitments and the indices in one JSON object, as the fields of the
+// embedded gabi.IssueCommitmentMessage are promoted.
+func (i *IssueCommitmentMessage) MarshalJSON() ([]byte, error) {
+	type message IssueCommitmentMessage // alias without MarshalJSON, to prevent recursion
+	return json.Marshal((*message)(i))
+}
+
 func (i *IssueCommitmentMessage) Disclosure() *Disclosure {
 	return &Disclosure{
 		Proofs:  i.Proofs,
@@ -447,6 +723,18 @@ func (i *IssueCommitmentMessage) Disclosure() *Disclosure {
 	}
 }
 
+// Validate checks that the integers of the commitments do not exceed the maximum length of
+// proof elements, see SetBigIntLimits.
+func (i *IssueCommitmentMessage) Validate() error {
+	return checkProofInts(i.IssueCommitmentMessage)
+}
+
+// Validate checks that the integers of the proofs do not exceed the maximum length of proof
+// elements, see SetBigIntLimits.
+func (d *Disclosure) Validate() error {
+	return checkProofInts(d.Proofs)
+}
+
 // ParseRequestorJwt parses the specified JWT and returns the contents.
 // Note: this function does not verify the signature! Do that elsewhere.
 func ParseRequestorJwt(action string, requestorJwt string) (RequestorJwt, error) {
@@ -461,6 +749,9 @@ func ParseRequestorJwt(action string, requestorJwt string) (RequestorJwt, error)
 	default:
 		return nil, errors.New("Invalid session type")
 	}
+	if len(requestorJwt) > MaxRequestorJwtLength {
+		return nil, errors.Errorf("JWT too long: %d bytes, maximum is %d", len(requestorJwt), MaxRequestorJwtLength)
+	}
 	if _, _, err := new(jwt.Parser).ParseUnverified(requestorJwt, retval); err != nil {
 		return nil, err
 	}
@@ -492,6 +783,10 @@ func (qr *Qr) Validate() (err error) {
 	if !qr.IsQr() {
 		return errors.New("unsupported session type")
 	}
+	if qr.ProtocolVersion != nil && qr.MaxProtocolVersion != nil &&
+		qr.MaxProtocolVersion.BelowVersion(qr.ProtocolVersion) {
+		return errors.Errorf("empty protocol version range %s - %s", qr.ProtocolVersion, qr.MaxProtocolVersion)
+	}
 	return nil
 }
 
@@ -499,11 +794,22 @@ func (status ServerStatus) Finished() bool {
 	return status == ServerStatusDone || status == ServerStatusCancelled || status == ServerStatusTimeout
 }
 
+// Finished returns whether the status is final, i.e. the session has ended.
+func (status ClientStatus) Finished() bool {
+	return status == ClientStatusCancelled || status == ClientStatusDone ||
+		status == ClientStatusTimeout || status == ClientStatusError
+}
+
 type ServerSessionResponse struct {
 	ProofStatus     ProofStatus                   `json:"proofStatus"`
 	IssueSignatures []*gabi.IssueSignatureMessage `json:"sigs,omitempty"`
 	NextSession     *Qr                           `json:"nextSession,omitempty"`
 
+	// IssueErrors contains, per index of the credentials of the issuance request, the reason
+	// why the issuer did not issue that credential, in which case its entry of IssueSignatures
+	// is nil. In JSON these errors take the place of the signatures of those credentials.
+	IssueErrors map[int]*RemoteError `json:"-"`
+
 	// needed for legacy (un)marshaling
 	ProtocolVersion *ProtocolVersion `json:"-"`
 	SessionType     Action           `json:"-"`
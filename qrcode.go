@@ -0,0 +1,93 @@
+package irma
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the width in modules of the white border around rendered QR codes.
+const qrQuietZone = 4
+
+// qrCode encodes the JSON of the Qr, as accepted by irmaclient.Client.NewSession, in a QR code.
+func qrCode(q *Qr) (*qr.Code, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	bts, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	return qr.Encode(string(bts), qr.L)
+}
+
+// RenderQrTerminal writes the Qr to w as a QR code of unicode blocks, two modules per character
+// vertically. The light modules are drawn as blocks, so that the QR code can be scanned from a
+// terminal with a dark background.
+func RenderQrTerminal(q *Qr, w io.Writer) error {
+	code, err := qrCode(q)
+	if err != nil {
+		return err
+	}
+	// Black returns false outside the code, so the quiet zone is light
+	light := func(x, y int) bool {
+		return !code.Black(x, y)
+	}
+	var sb strings.Builder
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// RenderQrPNG returns a PNG image of the Qr as a QR code, of at most size by size pixels
+// including the white border. If size is too small to draw each module as at least one pixel,
+// the image is as large as needed for that.
+func RenderQrPNG(q *Qr, size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, errors.New("size of QR image must be positive")
+	}
+	code, err := qrCode(q)
+	if err != nil {
+		return nil, err
+	}
+	scale := size / (code.Size + 2*qrQuietZone)
+	if scale < 1 {
+		scale = 1
+	}
+	// qr.Code.PNG fails for small scales, and qr.Code.Image omits the top and left quiet zone
+	width := (code.Size + 2*qrQuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, width, width))
+	for y := 0; y < width; y++ {
+		for x := 0; x < width; x++ {
+			if !code.Black(x/scale-qrQuietZone, y/scale-qrQuietZone) {
+				img.Pix[y*img.Stride+x] = 0xff
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"reflect"
 	"strconv"
 	"time"
@@ -26,9 +27,29 @@ const (
 	LDContextFrontendOptionsRequest = "https://irma.app/ld/request/frontendoptions/v1"
 	LDContextClientSessionRequest   = "https://irma.app/ld/request/client/v1"
 	LDContextSessionOptions         = "https://irma.app/ld/options/v1"
+	LDContextClientHello            = "https://irma.app/ld/request/clienthello/v1"
 	DefaultJwtValidity              = 120
 )
 
+// Limits on the size of session requests. Session requests may come from hostile requestors or
+// IRMA servers, so we refuse requests that are much larger than any legitimate request, before
+// they can exhaust our resources.
+const (
+	// MaxRequestorJwtLength is the maximum length of the requestor JWTs parsed by ParseRequestorJwt.
+	MaxRequestorJwtLength = 1 << 20
+	// MaxRequestDisjunctions is the maximum amount of disjunctions of attributes to be disclosed.
+	MaxRequestDisjunctions = 128
+	// MaxRequestAttributes is the maximum total amount of attributes occurring in the
+	// disjunctions of attributes to be disclosed.
+	MaxRequestAttributes = 1024
+	// MaxRequestCredentials is the maximum amount of credentials to be issued.
+	MaxRequestCredentials = 64
+	// MaxCredentialValidity is the maximum validity in seconds of credentials to be issued. The
+	// validity is encoded in the metadata attribute as a 16-bit amount of weeks since the signing
+	// date, which is rounded down to weeks, so we subtract one week.
+	MaxCredentialValidity = (1<<16 - 2) * ExpiryFactor
+)
+
 // BaseRequest contains information used by all IRMA session types, such the context and nonce,
 // and revocation information.
 type BaseRequest struct {
@@ -69,6 +90,10 @@ type DisclosureRequest struct {
 
 	Disclose AttributeConDisCon       `json:"disclose,omitempty"`
 	Labels   map[int]TranslatedString `json:"labels,omitempty"`
+	// AllowedExtras lists attribute types that the client may disclose in addition to those
+	// requested in Disclose, e.g. because the requestor composes disclosures itself; otherwise the
+	// client refuses disclosures containing attributes that were not requested.
+	AllowedExtras []AttributeTypeIdentifier `json:"allowedExtras,omitempty"`
 }
 
 // A SignatureRequest is a a request to sign a message with certain attributes. Construct new
@@ -76,6 +101,12 @@ type DisclosureRequest struct {
 type SignatureRequest struct {
 	DisclosureRequest
 	Message string `json:"message"`
+	// MessageType is the type of Message; omitted for SignatureMessageTypeString.
+	MessageType SignatureMessageType `json:"messageType,omitempty"`
+	// MessageFilename and MessageMimeType optionally describe the document of which Message is
+	// the hash, for messages of type SignatureMessageTypeRawHash, to be shown to the user.
+	MessageFilename string `json:"messageFilename,omitempty"`
+	MessageMimeType string `json:"messageMimeType,omitempty"`
 }
 
 // An IssuanceRequest is a request to issue certain credentials,
@@ -84,22 +115,90 @@ type SignatureRequest struct {
 type IssuanceRequest struct {
 	DisclosureRequest
 	Credentials []*CredentialRequest `json:"credentials"`
-
-	// Derived data
-	CredentialInfoList        CredentialInfoList `json:",omitempty"`
-	RemovalCredentialInfoList CredentialInfoList `json:",omitempty"`
+	// Atomic requires the client to reject the issuance response if the issuer did not issue all
+	// credentials, instead of storing the credentials that were issued.
+	Atomic bool `json:"atomic,omitempty"`
+	// Bindings require attributes of the credentials to be issued to equal attributes that the
+	// user discloses in the session, see AttributeBinding.
+	Bindings []*AttributeBinding `json:"bindings,omitempty"`
+
+	// Derived data, computed by the client for the UI and ignored when parsing the request
+	CredentialInfoList        CredentialInfoList  `json:"credentialInfoList,omitempty"`
+	RemovalCredentialInfoList CredentialInfoList  `json:"removalCredentialInfoList,omitempty"`
+	CredentialChanges         []*CredentialChange `json:"credentialChanges,omitempty"`
+}
+
+// CredentialChange describes what issuing a credential of an issuance request does to the
+// credentials that the user already has: the new credential either replaces an existing one,
+// when the credential type is a singleton or when the user has a credential with the same
+// attribute values, or it is added next to the existing credentials.
+type CredentialChange struct {
+	// Credential is the index of the new credential within the Credentials of the IssuanceRequest.
+	Credential int `json:"credential"`
+	// Existing is the credential that is replaced, or nil if the new credential is added.
+	Existing *CredentialInfo `json:"existing,omitempty"`
+	// New is the credential to be issued.
+	New *CredentialInfo `json:"new"`
+	// Declined is set when the user declined the new credential, in which case nothing changes.
+	Declined bool `json:"declined,omitempty"`
+	// Error is the reason given by the issuer for not issuing the new credential, in which case
+	// nothing changes.
+	Error *RemoteError `json:"error,omitempty"`
+	// Validity is the validity of the new credential.
+	Validity *CredentialValidity `json:"validity,omitempty"`
+	// KeyStatus is the status of the public key with which the new credential is to be issued,
+	// of which the user may be warned if it is deprecated; see Configuration.KeyStatus.
+	KeyStatus KeyStatus `json:"keyStatus,omitempty"`
+	// KeyExpires is the expiry date of that public key.
+	KeyExpires *Timestamp `json:"keyExpires,omitempty"`
+	// Bindings are the bindings of the issuance request to attributes of the new credential.
+	Bindings []*AttributeBinding `json:"bindings,omitempty"`
+}
+
+// AttributeBinding requires the value of an attribute of a credential to be issued to equal the
+// value of an attribute that the user discloses in the same session, e.g. the name on a diploma
+// to equal the name in the user's civil registry credential. The disclosed attribute must be
+// requested in the disclosure part of the issuance request. The client refuses to store
+// credentials violating a binding, and the IRMA server refuses to issue them.
+type AttributeBinding struct {
+	// Attribute is the attribute of the credential to be issued.
+	Attribute AttributeTypeIdentifier `json:"attribute"`
+	// Disclosed is the attribute whose disclosed value Attribute must equal.
+	Disclosed AttributeTypeIdentifier `json:"disclosed"`
+}
+
+// CredentialValidity is the validity of a credential to be issued as it ends up in the metadata
+// attribute of the credential: the signing date is rounded down to the start of its epoch (see
+// ExpiryFactor), and the credential expires a whole amount of epochs later.
+type CredentialValidity struct {
+	SignedOn Timestamp `json:"signedOn"`
+	Expires  Timestamp `json:"expires"`
+	// Requested is the expiry date specified in the credential request, or nil if the request
+	// did not specify one, in which case the credential is valid for six months.
+	Requested *Timestamp `json:"requested,omitempty"`
+}
+
+// Duration returns how long the credential is valid after its signing date.
+func (v *CredentialValidity) Duration() time.Duration {
+	return time.Time(v.Expires).Sub(time.Time(v.SignedOn))
 }
 
 // A CredentialRequest contains the attributes and metadata of a credential
 // that will be issued in an IssuanceRequest.
 type CredentialRequest struct {
-	Validity                    *Timestamp               `json:"validity,omitempty"`
-	KeyCounter                  uint                     `json:"keyCounter,omitempty"`
-	CredentialTypeID            CredentialTypeIdentifier `json:"credential"`
-	Attributes                  map[string]string        `json:"attributes"`
-	RevocationKey               string                   `json:"revocationKey,omitempty"`
-	RevocationSupported         bool                     `json:"revocationSupported,omitempty"`
-	RandomBlindAttributeTypeIDs []string                 `json:"randomblindIDs,omitempty"`
+	Validity         *Timestamp               `json:"validity,omitempty"`
+	KeyCounter       uint                     `json:"keyCounter,omitempty"`
+	CredentialTypeID CredentialTypeIdentifier `json:"credential"`
+	Attributes       map[string]string        `json:"attributes"`
+	// EncryptedAttributes contains attribute values encrypted against the EncryptionKey of the
+	// ClientHello of the session (see EncryptAttribute), which the client decrypts into
+	// Attributes before using them.
+	EncryptedAttributes         map[string][]byte `json:"encryptedAttributes,omitempty"`
+	RevocationKey               string            `json:"revocationKey,omitempty"`
+	RevocationSupported         bool              `json:"revocationSupported,omitempty"`
+	RandomBlindAttributeTypeIDs []string          `json:"randomblindIDs,omitempty"`
+
+	keyCounterMissing bool // see HasKeyCounter
 }
 
 // SessionRequest instances contain all information the irmaclient needs to perform an IRMA session.
@@ -168,6 +267,22 @@ type IdentityProviderRequest struct {
 	Request *IssuanceRequest `json:"request"`
 }
 
+// An ExtendedSessionRequest contains a session request of any type, along with the options of
+// RequestorBaseRequest with which the requestor starts the session at an IRMA server:
+//   - CallbackURL, to which the server posts the session result, which must use https;
+//   - ClientTimeout, the lifetime of the session in seconds until the IRMA app connects to it;
+//   - ResultJwtValidity, the validity in seconds of the session result JWTs of the server.
+//
+// It marshals to the same JSON as the ServiceProviderRequest, SignatureRequestorRequest or
+// IdentityProviderRequest containing the session request, which IRMA servers accept when
+// starting sessions. The start of a session is answered by the server with a
+// server.SessionPackage, containing the session pointer for the frontend and the requestor
+// token with which the requestor retrieves the session result.
+type ExtendedSessionRequest struct {
+	RequestorBaseRequest
+	Request SessionRequest `json:"request"`
+}
+
 // ServiceProviderJwt is a requestor JWT for a disclosure session.
 type ServiceProviderJwt struct {
 	ServerJwt
@@ -201,9 +316,35 @@ type RequestorJwt interface {
 	Sign(jwt.SigningMethod, interface{}) (string, error)
 }
 
-// A DisclosureChoice contains the attributes chosen to be disclosed.
+// A DisclosureChoice contains the attributes chosen to be disclosed. UI layers pass it back to
+// the client in JSON of the following shape, in which declinedCredentials is optional:
+//
+//	{
+//	  "attributes": [[{"type": "irma-demo.RU.studentCard.studentID", "credentialHash": "..."}]],
+//	  "declinedCredentials": [1]
+//	}
 type DisclosureChoice struct {
-	Attributes [][]*AttributeIdentifier
+	Attributes [][]*AttributeIdentifier `json:"attributes"`
+
+	// DeclinedCredentials contains, in issuance sessions, the indices within the Credentials of the
+	// IssuanceRequest of the credentials that the user does not want to receive.
+	DeclinedCredentials []int `json:"declinedCredentials,omitempty"`
+}
+
+// UnmarshalJSON parses a DisclosureChoice, refusing attributes that are null or lack a type.
+func (dc *DisclosureChoice) UnmarshalJSON(bts []byte) error {
+	type disclosureChoice DisclosureChoice // Same type with default JSON unmarshaler
+	if err := json.Unmarshal(bts, (*disclosureChoice)(dc)); err != nil {
+		return err
+	}
+	for i, con := range dc.Attributes {
+		for _, attr := range con {
+			if attr == nil || attr.Type.Empty() {
+				return errors.Errorf("disclosure choice contains attribute without type in conjunction %d", i)
+			}
+		}
+	}
+	return nil
 }
 
 // An AttributeRequest asks for an instance of an attribute type, possibly requiring it to have
@@ -265,12 +406,70 @@ type ClientSessionRequest struct {
 	ProtocolVersion *ProtocolVersion `json:"protocolVersion,omitempty"`
 	Options         *SessionOptions  `json:"options,omitempty"`
 	Request         SessionRequest   `json:"request,omitempty"`
+	// Lifetime is the amount of seconds that the session remains valid at the server, if known.
+	Lifetime int `json:"lifetime,omitempty"`
+}
+
+// ClientHello is POSTed by the client to servers that require it (see Qr.Hello) before they
+// hand out the session request, which they then include in their response as a
+// ClientSessionRequest.
+type ClientHello struct {
+	LDContext string `json:"@context,omitempty"`
+	// MinProtocolVersion that the client supports for this session.
+	MinProtocolVersion *ProtocolVersion `json:"minProtocolVersion"`
+	// MaxProtocolVersion that the client supports for this session.
+	MaxProtocolVersion *ProtocolVersion `json:"maxProtocolVersion"`
+	// ClientName and ClientVersion identify the client software.
+	ClientName    string `json:"clientName,omitempty"`
+	ClientVersion string `json:"clientVersion,omitempty"`
+	// EncryptionKey is the X25519 public key of the client for this session, against which
+	// issuers may encrypt attribute values, see CredentialRequest.EncryptedAttributes.
+	EncryptionKey []byte `json:"encryptionKey,omitempty"`
+}
+
+// ClientErrorReport is POSTed by clients that opted in to it to the "error" endpoint of the
+// session at the IRMA server when the session fails, to help debugging interoperability issues.
+// It never contains attribute values, PINs or the messages of errors, which may contain them.
+type ClientErrorReport struct {
+	ErrorType ErrorType `json:"error"`
+	// RemoteError is the name of the error reported by a server, if any.
+	RemoteError  string `json:"remoteError,omitempty"`
+	RemoteStatus int    `json:"remoteStatus,omitempty"`
+	// Phase is the status of the session when it failed.
+	Phase           ClientStatus     `json:"phase"`
+	Action          Action           `json:"action,omitempty"`
+	ProtocolVersion *ProtocolVersion `json:"protocolVersion,omitempty"`
+	ClientName      string           `json:"clientName,omitempty"`
+	ClientVersion   string           `json:"clientVersion,omitempty"`
+	// Timings contains the time in milliseconds that the session spent in each of its phases.
+	Timings map[string]int64 `json:"timings,omitempty"`
+}
+
+func (hello *ClientHello) Validate() error {
+	if hello.LDContext != LDContextClientHello {
+		return errors.New("Not a client hello")
+	}
+	if hello.MinProtocolVersion == nil || hello.MaxProtocolVersion == nil {
+		return errors.New("Client hello does not specify protocol versions")
+	}
+	if hello.MaxProtocolVersion.BelowVersion(hello.MinProtocolVersion) {
+		return errors.New("Client hello specifies empty protocol version range")
+	}
+	if hello.EncryptionKey != nil && len(hello.EncryptionKey) != SessionKeyLength {
+		return errors.New("Client hello specifies invalid encryption key")
+	}
+	return nil
 }
 
 func (choice *DisclosureChoice) Validate() error {
 	if choice == nil {
 		return nil
 	}
+	for _, i := range choice.DeclinedCredentials {
+		if i < 0 {
+			return errors.Errorf("invalid declined credential index %d", i)
+		}
+	}
 	for _, attrlist := range choice.Attributes {
 		for _, attr := range attrlist {
 			if attr.CredentialHash == "" {
@@ -281,6 +480,56 @@ func (choice *DisclosureChoice) Validate() error {
 	return nil
 }
 
+// ExtraAttributes returns the attributes in the choice that were not requested in the disclosure
+// request and not explicitly allowed in its AllowedExtras. Per disjunction of the request, the
+// chosen attributes must all be contained in one of its inner conjunctions; chosen attributes
+// for disjunctions beyond those of the request are all extra.
+func (choice *DisclosureChoice) ExtraAttributes(request *DisclosureRequest) []*AttributeIdentifier {
+	if choice == nil {
+		return nil
+	}
+	allowed := map[AttributeTypeIdentifier]struct{}{}
+	for _, typ := range request.AllowedExtras {
+		allowed[typ] = struct{}{}
+	}
+
+	var extra []*AttributeIdentifier
+	for i, attrlist := range choice.Attributes {
+		var discon AttributeDisCon
+		if i < len(request.Disclose) {
+			discon = request.Disclose[i]
+		}
+		// Find the inner conjunction that leaves the fewest chosen attributes unrequested
+		var best []*AttributeIdentifier
+		for j := -1; j < len(discon); j++ {
+			var con AttributeCon
+			if j >= 0 {
+				con = discon[j]
+			}
+			var unrequested []*AttributeIdentifier
+			for _, attr := range attrlist {
+				if _, ok := allowed[attr.Type]; !ok && !con.contains(attr.Type) {
+					unrequested = append(unrequested, attr)
+				}
+			}
+			if j == -1 || len(unrequested) < len(best) {
+				best = unrequested
+			}
+		}
+		extra = append(extra, best...)
+	}
+	return extra
+}
+
+func (c AttributeCon) contains(typ AttributeTypeIdentifier) bool {
+	for _, attr := range c {
+		if attr.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
 func (n *NonRevocationParameters) UnmarshalJSON(bts []byte) error {
 	var slice []CredentialTypeIdentifier
 	if *n == nil {
@@ -417,6 +666,20 @@ func (ar *AttributeRequest) Satisfy(attr AttributeTypeIdentifier, val *string) b
 		(ar.Value == nil || (val != nil && *ar.Value == *val))
 }
 
+// SatisfyAge indicates whether the given attribute type and value satisfies this AttributeRequest
+// like Satisfy, additionally requiring the value of attributes following the over-N convention
+// (see AttributeType.AgeLimit) to be affirmative if the request does not specify a value.
+func (ar *AttributeRequest) SatisfyAge(attr AttributeTypeIdentifier, val *string, conf *Configuration) bool {
+	if !ar.Satisfy(attr, val) {
+		return false
+	}
+	if ar.Value != nil {
+		return true
+	}
+	typ := conf.AttributeTypes[attr]
+	return typ == nil || typ.AgeLimit() == 0 || IsAffirmativeAgeValue(val)
+}
+
 // Satisfy returns if each of the attributes specified by proofs and indices satisfies each of
 // the contained AttributeRequests's. If so it also returns a list of the disclosed attribute values.
 func (c AttributeCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAttributeIndex, revocation map[int]*time.Time, conf *Configuration) (bool, []*DisclosedAttribute, error) {
@@ -434,7 +697,7 @@ func (c AttributeCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAttribu
 		if err != nil {
 			return false, nil, err
 		}
-		if !c[j].Satisfy(attr.Identifier, val) {
+		if !c[j].SatisfyAge(attr.Identifier, val, conf) {
 			return false, nil, nil
 		}
 		attrs = append(attrs, attr)
@@ -470,13 +733,35 @@ func (dc AttributeDisCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAtt
 	return false, nil, nil
 }
 
+// validateSize checks that the size of the condiscon is within MaxRequestDisjunctions and
+// MaxRequestAttributes.
+func (cdc AttributeConDisCon) validateSize() error {
+	if len(cdc) > MaxRequestDisjunctions {
+		return errors.Errorf("Too many disjunctions: %d, maximum is %d", len(cdc), MaxRequestDisjunctions)
+	}
+	count := 0
+	for _, discon := range cdc {
+		for _, con := range discon {
+			count += len(con)
+		}
+	}
+	if count > MaxRequestAttributes {
+		return errors.Errorf("Too many attributes: %d, maximum is %d", count, MaxRequestAttributes)
+	}
+	return nil
+}
+
 func (cdc AttributeConDisCon) Validate(conf *Configuration) error {
 	for _, discon := range cdc {
 		for _, con := range discon {
 			var nonsingleton *CredentialTypeIdentifier
 			for _, attr := range con {
 				typ := attr.Type.CredentialTypeIdentifier()
-				if !conf.CredentialTypes[typ].IsSingleton {
+				credtype := conf.CredentialTypes[typ]
+				if credtype == nil {
+					return &SessionError{ErrorType: ErrorUnknownIdentifier, Err: errors.Errorf("Unknown credential type %s", typ)}
+				}
+				if !credtype.IsSingleton {
 					if nonsingleton != nil && *nonsingleton != typ {
 						return errors.New("Multiple non-singletons within one inner conjunction are not allowed")
 					} else {
@@ -505,6 +790,12 @@ func (cdc AttributeConDisCon) Satisfy(disclosure *Disclosure, revocation map[int
 		}
 		if satisfied {
 			list[i] = attrs
+			// Attributes of possibly revoked credentials are included, but do not satisfy the disjunction
+			for _, attr := range attrs {
+				if attr.Status == AttributeProofStatusRevoked {
+					complete = false
+				}
+			}
 		} else {
 			complete = false
 			list[i] = nil
@@ -514,6 +805,94 @@ func (cdc AttributeConDisCon) Satisfy(disclosure *Disclosure, revocation map[int
 	return complete, list, nil
 }
 
+// Canonical returns the condiscon with duplicate attribute requests within inner conjunctions,
+// duplicate inner conjunctions within disjunctions, and disjunctions that are then identical to
+// an earlier one removed, without altering the order of the remaining disjunctions. It also
+// returns for each disjunction of cdc the index of the corresponding canonical disjunction, and
+// whether anything was removed.
+func (cdc AttributeConDisCon) Canonical() (AttributeConDisCon, []int, bool) {
+	canonical := make(AttributeConDisCon, 0, len(cdc))
+	indices := make([]int, len(cdc))
+	seen := map[string]int{}
+	changed := false
+	for i, discon := range cdc {
+		dc, key, removed := discon.canonical()
+		changed = changed || removed
+		if j, ok := seen[key]; ok {
+			indices[i] = j
+			changed = true
+			continue
+		}
+		seen[key] = len(canonical)
+		indices[i] = len(canonical)
+		canonical = append(canonical, dc)
+	}
+	return canonical, indices, changed
+}
+
+// canonical returns the disjunction with duplicate attribute requests and inner conjunctions
+// removed, a key identifying it, and whether anything was removed.
+func (dc AttributeDisCon) canonical() (AttributeDisCon, string, bool) {
+	canonical := make(AttributeDisCon, 0, len(dc))
+	keys := make([]string, 0, len(dc))
+	seen := map[string]struct{}{}
+	changed := false
+	for _, con := range dc {
+		c := make(AttributeCon, 0, len(con))
+		attrkeys := make([]string, 0, len(con))
+		attrseen := map[string]struct{}{}
+		for _, attr := range con {
+			key := attr.key()
+			if _, ok := attrseen[key]; ok {
+				changed = true
+				continue
+			}
+			attrseen[key] = struct{}{}
+			attrkeys = append(attrkeys, key)
+			c = append(c, attr)
+		}
+		key := fmt.Sprintf("%q", attrkeys)
+		if _, ok := seen[key]; ok {
+			changed = true
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+		canonical = append(canonical, c)
+	}
+	return canonical, fmt.Sprintf("%q", keys), changed
+}
+
+func (ar AttributeRequest) key() string {
+	value := "-"
+	if ar.Value != nil {
+		value = strconv.Quote(*ar.Value)
+	}
+	return fmt.Sprintf("%s %s %t", ar.Type, value, ar.NotNull)
+}
+
+// Canonicalize replaces the disjunctions of the request by their canonical form, see
+// AttributeConDisCon.Canonical, keeping the label of the first of identical disjunctions. It
+// returns for each of the original disjunctions the index of its canonical disjunction, or nil
+// if the request was already canonical, in which case it is left as is.
+func (dr *DisclosureRequest) Canonicalize() []int {
+	canonical, indices, changed := dr.Disclose.Canonical()
+	if !changed {
+		return nil
+	}
+	labels := map[int]TranslatedString{}
+	for i, j := range indices {
+		if _, ok := labels[j]; ok {
+			continue
+		}
+		if label, ok := dr.Labels[i]; ok {
+			labels[j] = label
+		}
+	}
+	dr.Disclose, dr.Labels = canonical, labels
+	return indices
+}
+
 func (cdc AttributeConDisCon) Iterate(f func(attr *AttributeRequest) error) error {
 	var err error
 	for _, discon := range cdc {
@@ -535,6 +914,36 @@ func (dr *DisclosureRequest) AddSingle(attr AttributeTypeIdentifier, value *stri
 	dr.Labels[len(dr.Disclose)-1] = label
 }
 
+// RequestRevocation requires nonrevocation proofs for the credential types of the attributes in
+// the specified disjunction of the request that support revocation. The IRMA server includes the
+// latest revocation updates of these credential types in the request when the session starts.
+func (dr *DisclosureRequest) RequestRevocation(conf *Configuration, disjunction int) error {
+	if disjunction < 0 || disjunction >= len(dr.Disclose) {
+		return errors.Errorf("cannot request nonrevocation proofs: disjunction %d out of range", disjunction)
+	}
+	found := false
+	for _, con := range dr.Disclose[disjunction] {
+		for _, attr := range con {
+			id := attr.Type.CredentialTypeIdentifier()
+			credtype := conf.CredentialTypes[id]
+			if credtype == nil || !credtype.RevocationSupported() {
+				continue
+			}
+			if dr.Revocation == nil {
+				dr.Revocation = NonRevocationParameters{}
+			}
+			if dr.Revocation[id] == nil {
+				dr.Revocation[id] = &NonRevocationRequest{}
+			}
+			found = true
+		}
+	}
+	if !found {
+		return errors.Errorf("cannot request nonrevocation proofs: no credential type in disjunction %d supports revocation", disjunction)
+	}
+	return nil
+}
+
 func NewDisclosureRequest(attrs ...AttributeTypeIdentifier) *DisclosureRequest {
 	request := &DisclosureRequest{
 		BaseRequest: BaseRequest{LDContext: LDContextDisclosureRequest},
@@ -603,6 +1012,9 @@ func (dr *DisclosureRequest) Validate() error {
 	if !dr.IsDisclosureRequest() {
 		return errors.New("Not a disclosure request")
 	}
+	if err := dr.Disclose.validateSize(); err != nil {
+		return err
+	}
 	if len(dr.Identifiers().AttributeTypes) == 0 {
 		return errors.New("Disclosure request had no attributes")
 	}
@@ -615,6 +1027,50 @@ func (dr *DisclosureRequest) Validate() error {
 	return nil
 }
 
+// UnmarshalJSON records whether the keyCounter field was present. IRMA servers omit it when the
+// key counter is zero, but clients may be configured to distrust that (see HasKeyCounter).
+func (cr *CredentialRequest) UnmarshalJSON(bts []byte) error {
+	type credentialRequest CredentialRequest
+	var counter struct {
+		KeyCounter *uint `json:"keyCounter"`
+	}
+	if err := json.Unmarshal(bts, (*credentialRequest)(cr)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bts, &counter); err != nil {
+		return err
+	}
+	cr.keyCounterMissing = counter.KeyCounter == nil
+	return nil
+}
+
+// HasKeyCounter returns false if the credential request was parsed from JSON lacking the
+// keyCounter field, in which case KeyCounter is zero. IRMA servers omit the field exactly when the
+// key counter is zero, so for requests of IRMA servers the KeyCounter is correct either way.
+func (cr *CredentialRequest) HasKeyCounter() bool {
+	return !cr.keyCounterMissing
+}
+
+// SetKeyCounter sets the counter of the public key with which the credential is issued.
+func (cr *CredentialRequest) SetKeyCounter(counter uint) {
+	cr.KeyCounter = counter
+	cr.keyCounterMissing = false
+}
+
+// ValidityAt returns the validity of the credential if it is issued at the specified time.
+func (cr *CredentialRequest) ValidityAt(issuedAt time.Time) (*CredentialValidity, error) {
+	meta := NewMetadataAttribute(0x03)
+	meta.setSigningDate(issuedAt)
+	if err := meta.setExpiryDate(cr.Validity); err != nil {
+		return nil, err
+	}
+	return &CredentialValidity{
+		SignedOn:  Timestamp(meta.SigningDate()),
+		Expires:   Timestamp(meta.Expiry()),
+		Requested: cr.Validity,
+	}, nil
+}
+
 func (cr *CredentialRequest) Info(conf *Configuration, metadataVersion byte, issuedAt time.Time) (*CredentialInfo, error) {
 	list, err := cr.AttributeList(conf, metadataVersion, nil, issuedAt)
 	if err != nil {
@@ -747,8 +1203,8 @@ func (ir *IssuanceRequest) Identifiers() *IrmaIdentifierSet {
 			ir.ids.Issuers[issuer] = struct{}{}
 			credID := credreq.CredentialTypeID
 			ir.ids.CredentialTypes[credID] = struct{}{}
-			for attr, _ := range credreq.Attributes { // this is kind of ugly
-				ir.ids.AttributeTypes[NewAttributeTypeIdentifier(credID.String()+"."+attr)] = struct{}{}
+			for attr := range credreq.Attributes {
+				ir.ids.AttributeTypes[credID.AttributeTypeIdentifier(attr)] = struct{}{}
 			}
 			if ir.ids.PublicKeys[issuer] == nil {
 				ir.ids.PublicKeys[issuer] = []uint{}
@@ -787,14 +1243,32 @@ func (ir *IssuanceRequest) Validate() error {
 	if len(ir.Credentials) == 0 {
 		return errors.New("Empty issuance request")
 	}
+	if len(ir.Credentials) > MaxRequestCredentials {
+		return errors.Errorf("Too many credentials: %d, maximum is %d", len(ir.Credentials), MaxRequestCredentials)
+	}
+	if err := ir.Disclose.validateSize(); err != nil {
+		return err
+	}
+	now := time.Now()
 	for _, cred := range ir.Credentials {
+		if cred == nil {
+			return errors.New("Empty credential request")
+		}
 		count := cred.CredentialTypeID.PartsCount()
 		if count != 2 {
 			return errors.Errorf("Expected credential ID to consist of 3 parts, %d found", count+1)
 		}
-		if cred.Validity != nil && cred.Validity.Floor().Before(Timestamp(time.Now())) {
+		for name := range cred.EncryptedAttributes {
+			if _, ok := cred.Attributes[name]; ok {
+				return errors.Errorf("Attribute %s is both encrypted and not encrypted", name)
+			}
+		}
+		if cred.Validity != nil && cred.Validity.Floor().Before(Timestamp(now)) {
 			return errors.New("Expired credential request")
 		}
+		if cred.Validity != nil && time.Time(*cred.Validity).Unix() > now.Unix()+MaxCredentialValidity {
+			return errors.New("Credential request validity too far in the future")
+		}
 	}
 	var err error
 	for _, discon := range ir.Disclose {
@@ -802,13 +1276,103 @@ func (ir *IssuanceRequest) Validate() error {
 			return err
 		}
 	}
+	return ir.validateBindings()
+}
+
+// validateBindings checks that the attributes of the bindings are issued respectively requested
+// for disclosure by the request.
+func (ir *IssuanceRequest) validateBindings() error {
+	for _, binding := range ir.Bindings {
+		if binding == nil {
+			return errors.New("Empty attribute binding")
+		}
+		bound := ir.boundCredentials(binding)
+		if len(bound) == 0 {
+			return errors.Errorf("Bound attribute %s is not issued", binding.Attribute)
+		}
+		for _, i := range bound {
+			// The IRMA server cannot check the values of encrypted attributes
+			if _, encrypted := ir.Credentials[i].EncryptedAttributes[binding.Attribute.Name()]; encrypted {
+				return errors.Errorf("Bound attribute %s is encrypted", binding.Attribute)
+			}
+		}
+		requested := false
+		for _, discon := range ir.Disclose {
+			for _, con := range discon {
+				for _, attr := range con {
+					requested = requested || attr.Type == binding.Disclosed
+				}
+			}
+		}
+		if !requested {
+			return errors.Errorf("Bound attribute %s is not requested for disclosure", binding.Disclosed)
+		}
+	}
+	return nil
+}
+
+// boundCredentials returns the indices of the credentials of the request containing the
+// attribute of the binding.
+func (ir *IssuanceRequest) boundCredentials(binding *AttributeBinding) []int {
+	var indices []int
+	for i, cred := range ir.Credentials {
+		if cred != nil && cred.CredentialTypeID == binding.Attribute.CredentialTypeIdentifier() {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// VerifyBindings checks that the credentials of the request satisfy its Bindings, given the
+// attributes that the user disclosed in the session: each bound attribute must be disclosed,
+// and all disclosed values of it must equal the value of the attribute to be issued. Credentials
+// whose index is in skip, e.g. because they are not issued, are not checked.
+func (ir *IssuanceRequest) VerifyBindings(disclosed [][]*DisclosedAttribute, skip ...int) error {
+	for _, binding := range ir.Bindings {
+		var values []*string
+		for _, con := range disclosed {
+			for _, attr := range con {
+				if attr.Identifier == binding.Disclosed {
+					values = append(values, attr.RawValue)
+				}
+			}
+		}
+		if len(values) == 0 {
+			return errors.Errorf("Bound attribute %s was not disclosed", binding.Disclosed)
+		}
+		for _, i := range ir.boundCredentials(binding) {
+			if containsInt(skip, i) {
+				continue
+			}
+			issued, ok := ir.Credentials[i].Attributes[binding.Attribute.Name()]
+			for _, value := range values {
+				if !ok || value == nil || *value != issued {
+					return errors.Errorf("Attribute %s does not equal disclosed attribute %s", binding.Attribute, binding.Disclosed)
+				}
+			}
+		}
+	}
 	return nil
 }
 
+func containsInt(list []int, i int) bool {
+	for _, j := range list {
+		if i == j {
+			return true
+		}
+	}
+	return false
+}
+
 // GetNonce returns the nonce of this signature session
 // (with the message already hashed into it).
 func (sr *SignatureRequest) GetNonce(timestamp *atum.Timestamp) *big.Int {
-	return ASN1ConvertSignatureNonce(sr.Message, sr.BaseRequest.GetNonce(nil), timestamp)
+	return asn1ConvertSignatureNonce(messageHash(sr.MessageType, sr.Message), sr.BaseRequest.GetNonce(nil), timestamp)
+}
+
+// MessageHash returns the hash of the message that is included in the nonce and timestamp.
+func (sr *SignatureRequest) MessageHash() ([]byte, error) {
+	return SignatureMessageHash(sr.MessageType, sr.Message)
 }
 
 func (sr *SignatureRequest) SignatureFromMessage(message interface{}, timestamp *atum.Timestamp) (*SignedMessage, error) {
@@ -823,13 +1387,14 @@ func (sr *SignatureRequest) SignatureFromMessage(message interface{}, timestamp
 		nonce = bigZero
 	}
 	return &SignedMessage{
-		LDContext: LDContextSignedMessage,
-		Signature: signature.Proofs,
-		Indices:   signature.Indices,
-		Nonce:     nonce,
-		Context:   sr.GetContext(),
-		Message:   sr.Message,
-		Timestamp: timestamp,
+		LDContext:   LDContextSignedMessage,
+		Signature:   signature.Proofs,
+		Indices:     signature.Indices,
+		Nonce:       nonce,
+		Context:     sr.GetContext(),
+		Message:     sr.Message,
+		Timestamp:   timestamp,
+		MessageType: sr.MessageType.omitDefault(),
 	}, nil
 }
 
@@ -846,9 +1411,15 @@ func (sr *SignatureRequest) Validate() error {
 	if sr.Message == "" {
 		return errors.New("Signature request had empty message")
 	}
+	if _, err := sr.MessageHash(); err != nil {
+		return err
+	}
 	if len(sr.Disclose) == 0 {
 		return errors.New("Signature request had no attributes")
 	}
+	if err := sr.Disclose.validateSize(); err != nil {
+		return err
+	}
 	var err error
 	for _, discon := range sr.Disclose {
 		if err = discon.Validate(); err != nil {
@@ -991,21 +1562,21 @@ func NewIdentityProviderJwt(servername string, ir *IssuanceRequest) *IdentityPro
 func (jwt *ServerJwt) Requestor() string { return jwt.ServerName }
 
 func (r *ServiceProviderRequest) Validate() error {
-	if r.Request == nil {
+	if r == nil || r.Request == nil {
 		return errors.New("Not a ServiceProviderRequest")
 	}
 	return r.Request.Validate()
 }
 
 func (r *SignatureRequestorRequest) Validate() error {
-	if r.Request == nil {
+	if r == nil || r.Request == nil {
 		return errors.New("Not a SignatureRequestorRequest")
 	}
 	return r.Request.Validate()
 }
 
 func (r *IdentityProviderRequest) Validate() error {
-	if r.Request == nil {
+	if r == nil || r.Request == nil {
 		return errors.New("Not a IdentityProviderRequest")
 	}
 	return r.Request.Validate()
@@ -1035,6 +1606,72 @@ func (r *IdentityProviderRequest) Base() *RequestorBaseRequest {
 	return &r.RequestorBaseRequest
 }
 
+// NewExtendedSessionRequest returns a new ExtendedSessionRequest for the session request, whose
+// options can be set subsequently.
+func NewExtendedSessionRequest(request SessionRequest) *ExtendedSessionRequest {
+	return &ExtendedSessionRequest{Request: request}
+}
+
+func (r *ExtendedSessionRequest) Validate() error {
+	if r == nil || r.Request == nil {
+		return errors.New("Not an ExtendedSessionRequest")
+	}
+	if r.CallbackURL != "" {
+		u, err := url.Parse(r.CallbackURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.Errorf("callbackUrl %s is not an https URL", r.CallbackURL)
+		}
+	}
+	if r.ClientTimeout < 0 || r.ResultJwtValidity < 0 {
+		return errors.New("timeout and validity must not be negative")
+	}
+	return r.Request.Validate()
+}
+
+func (r *ExtendedSessionRequest) SessionRequest() SessionRequest {
+	return r.Request
+}
+
+func (r *ExtendedSessionRequest) Base() *RequestorBaseRequest {
+	return &r.RequestorBaseRequest
+}
+
+// Typed returns the ServiceProviderRequest, SignatureRequestorRequest or IdentityProviderRequest
+// with the same session request and options.
+func (r *ExtendedSessionRequest) Typed() (RequestorRequest, error) {
+	switch request := r.Request.(type) {
+	case *DisclosureRequest:
+		return &ServiceProviderRequest{RequestorBaseRequest: r.RequestorBaseRequest, Request: request}, nil
+	case *SignatureRequest:
+		return &SignatureRequestorRequest{RequestorBaseRequest: r.RequestorBaseRequest, Request: request}, nil
+	case *IssuanceRequest:
+		return &IdentityProviderRequest{RequestorBaseRequest: r.RequestorBaseRequest, Request: request}, nil
+	default:
+		return nil, errors.Errorf("unsupported session request type %T", r.Request)
+	}
+}
+
+func (r *ExtendedSessionRequest) UnmarshalJSON(data []byte) error {
+	context, err := common.ParseNestedLDContext(data)
+	if err != nil {
+		return err
+	}
+	switch context {
+	case LDContextDisclosureRequest:
+		r.Request = &DisclosureRequest{}
+	case LDContextSignatureRequest:
+		r.Request = &SignatureRequest{}
+	case LDContextIssuanceRequest:
+		r.Request = &IssuanceRequest{}
+	default:
+		return errors.Errorf("unsupported session request type %s", context)
+	}
+	// Unmarshal in alias to prevent infinite recursion; the session request is unmarshaled into
+	// the value pointed to by the Request field
+	type alias ExtendedSessionRequest
+	return json.Unmarshal(data, (*alias)(r))
+}
+
 // SessionRequest returns an IRMA session object.
 func (claims *ServiceProviderJwt) SessionRequest() SessionRequest { return claims.Request.Request }
 
@@ -1135,6 +1772,12 @@ func SignRequestorRequest(request RequestorRequest, alg jwt.SigningMethod, key i
 	case *SignatureRequestorRequest:
 		jwtcontents = NewSignatureRequestorJwt(name, nil)
 		jwtcontents.(*SignatureRequestorJwt).Request = r
+	case *ExtendedSessionRequest:
+		typed, err := r.Typed()
+		if err != nil {
+			return "", err
+		}
+		return SignRequestorRequest(typed, alg, key, name)
 	}
 	return jwtcontents.Sign(alg, key)
 }
@@ -65,6 +65,7 @@ type (
 		Authority           bool   `json:"authority,omitempty" mapstructure:"authority"`
 		RevocationServerURL string `json:"revocation_server_url,omitempty" mapstructure:"revocation_server_url"`
 		Tolerance           uint64 `json:"tolerance,omitempty" mapstructure:"tolerance"` // in seconds, min 30
+		Staleness           uint64 `json:"staleness,omitempty" mapstructure:"staleness"` // in seconds
 		SSE                 bool   `json:"sse,omitempty" mapstructure:"sse"`
 
 		// set to now whenever a new update is received, or when the RA indicates
@@ -132,6 +133,16 @@ var RevocationParameters = struct {
 	// server will report the time up until nonrevocation of the attribute is guaranteed to the requestor.
 	DefaultTolerance uint64
 
+	// DefaultStaleness is the default staleness window in seconds: for this long after a proof's
+	// accumulator was superseded by a newer one, verifiers accept the nonrevocation proof, since
+	// clients may not yet have updated their witness. Beyond it, the attributes of the proof are
+	// reported as revoked, as the credential may have been revoked in the meantime.
+	DefaultStaleness uint64
+
+	// AccumulatorMaxAge is the maximum age in seconds of the issuer's current accumulator as
+	// cached by verifiers, before they fetch it again from the revocation server.
+	AccumulatorMaxAge uint64
+
 	// If server mode is enabled for a credential type, then once every so many seconds
 	// the timestamp in each accumulator is updated to now.
 	AccumulatorUpdateInterval int
@@ -164,6 +175,8 @@ var RevocationParameters = struct {
 }{
 	RequestorUpdateInterval:       10,
 	DefaultTolerance:              10 * 60,
+	DefaultStaleness:              5 * 60,
+	AccumulatorMaxAge:             60,
 	AccumulatorUpdateInterval:     60,
 	DeleteIssuanceRecordsInterval: 5 * 60,
 	ClientUpdateInterval:          10,
@@ -542,6 +555,23 @@ func (rs *RevocationStorage) accumulator(tx sqlRevStorage, id CredentialTypeIden
 	return sacc, nil
 }
 
+// currentAccumulator returns the most recent accumulator of the given type and key that we know of,
+// first fetching updates from the revocation server if we did not do so in the last
+// RevocationParameters.AccumulatorMaxAge seconds.
+func (rs *RevocationStorage) currentAccumulator(id CredentialTypeIdentifier, pkcounter uint) (*revocation.Accumulator, error) {
+	if rs.memdb == nil && !rs.sqlMode {
+		return nil, ErrRevocationStateNotFound
+	}
+	if err := rs.SyncIfOld(id, RevocationParameters.AccumulatorMaxAge); err != nil {
+		return nil, err
+	}
+	sacc, err := rs.Accumulator(id, pkcounter)
+	if err != nil {
+		return nil, err
+	}
+	return sacc.Accumulator, nil
+}
+
 func (rs *RevocationStorage) updateAccumulatorTimes() error {
 	if !rs.sqlMode {
 		return nil
@@ -754,24 +784,28 @@ func (rs *RevocationStorage) Load(debug bool, dbtype, connstr string, settings R
 		return errors.Errorf("revocation mode for %s requires SQL database but no connection string given", *t)
 	}
 
-	if _, err := rs.conf.Scheduler.Every(RevocationParameters.AccumulatorUpdateInterval).Seconds().WaitForSchedule().Do(func() {
+	job, err := rs.conf.Scheduler.Every(RevocationParameters.AccumulatorUpdateInterval).Seconds().WaitForSchedule().Do(func() {
 		if err := rs.updateAccumulatorTimes(); err != nil {
 			Logger.WithField("error", err).Error("failed to write updated accumulator record")
 		}
-	}); err != nil {
+	})
+	if err != nil {
 		return err
 	}
+	rs.conf.jobs = append(rs.conf.jobs, job)
 
-	if _, err := rs.conf.Scheduler.Every(RevocationParameters.DeleteIssuanceRecordsInterval).Minutes().WaitForSchedule().Do(func() {
+	job, err = rs.conf.Scheduler.Every(RevocationParameters.DeleteIssuanceRecordsInterval).Minutes().WaitForSchedule().Do(func() {
 		if !rs.sqlMode {
 			return
 		}
 		if err := rs.sqldb.Delete(IssuanceRecord{}, "valid_until < ?", time.Now().UnixNano()); err != nil {
 			Logger.WithField("error", err).Error("failed to delete expired issuance records")
 		}
-	}); err != nil {
+	})
+	if err != nil {
 		return err
 	}
+	rs.conf.jobs = append(rs.conf.jobs, job)
 
 	if connstr == "" {
 		Logger.Trace("Using memory revocation database")
@@ -1122,6 +1156,9 @@ func (rs RevocationSettings) Get(id CredentialTypeIdentifier) *RevocationSetting
 	if s.Tolerance == 0 {
 		s.Tolerance = RevocationParameters.DefaultTolerance
 	}
+	if s.Staleness == 0 {
+		s.Staleness = RevocationParameters.DefaultStaleness
+	}
 	return s
 }
 
@@ -158,10 +158,11 @@ func (conf *Configuration) AutoUpdateSchemes(interval int) error {
 			}
 		}
 	}
-	_, err := conf.Scheduler.Every(interval).Minutes().Do(update)
+	job, err := conf.Scheduler.Every(interval).Minutes().Do(update)
 	if err != nil {
 		return err
 	}
+	conf.jobs = append(conf.jobs, job)
 	// Run first update after a small delay
 	go func() {
 		<-time.NewTimer(200 * time.Millisecond).C
@@ -242,6 +243,7 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 	if newconf, err = NewConfiguration(dir, ConfigurationOptions{}); err != nil {
 		return err
 	}
+	newconf.developerMode = conf.developerMode
 	if scheme, err = newconf.ParseSchemeFolder(newSchemePath); err != nil {
 		return err
 	}
@@ -324,7 +326,7 @@ func (conf *Configuration) updateSchemeFiles(
 	scheme Scheme, index SchemeManagerIndex, newschemepath string, downloaded *IrmaIdentifierSet,
 ) error {
 	var (
-		transport = NewHTTPTransport(scheme.url(), true)
+		transport = conf.newSchemeTransport(scheme.url())
 		oldIndex  = scheme.idx()
 		id        = scheme.id()
 	)
@@ -414,13 +416,16 @@ func (conf *Configuration) parseSchemeFile(
 
 	bts, found, err := conf.readSignedFile(scheme.idx(), scheme.path(), path)
 	if !found {
-		return false, errors.Errorf("File %s (%s) not present in scheme index", path, abs)
+		return false, &schemeFileError{path: abs, err: errors.Errorf("File %s (%s) not present in scheme index", path, abs)}
 	}
 	if err != nil {
 		return true, err
 	}
 
-	return true, common.Unmarshal(filepath.Base(path), bts, description)
+	if err = common.Unmarshal(filepath.Base(path), bts, description); err != nil {
+		return true, &schemeFileError{path: abs, err: err}
+	}
+	return true, nil
 }
 
 func (conf *Configuration) reinstallScheme(scheme Scheme) (err error) {
@@ -531,7 +536,13 @@ func (conf *Configuration) installScheme(url string, publickey []byte, dir strin
 		}
 	} else {
 		if _, err = downloadFile(NewHTTPTransport(url, true), dirPath, "pk.pem"); err != nil {
-			return
+			if !conf.developerMode {
+				return
+			}
+			// Unsigned schemes need no public key; whether or not the scheme is signed
+			// is checked when parsing it below
+			Logger.WithField("url", url).Warn("scheme public key not found, installing scheme as unsigned scheme")
+			err = nil
 		}
 	}
 
@@ -576,44 +587,78 @@ func (conf *Configuration) checkRemoteScheme(scheme Scheme) (bool, *remoteScheme
 	return true, remoteState, nil
 }
 
+// newSchemeTransport returns a transport to the specified scheme server, which passes the time
+// of the server to the ServerDateListeners.
+func (conf *Configuration) newSchemeTransport(url string) *HTTPTransport {
+	transport := NewHTTPTransport(url, true)
+	transport.SetDateListener(func(date time.Time) {
+		for _, listener := range conf.ServerDateListeners {
+			listener(date)
+		}
+	})
+	return transport
+}
+
 func (conf *Configuration) checkRemoteTimestamp(scheme Scheme) (*remoteSchemeState, error) {
-	t := NewHTTPTransport(scheme.url(), true)
+	t := conf.newSchemeTransport(scheme.url())
 	indexbts, err := t.GetBytes("index")
 	if err != nil {
 		return nil, err
 	}
 	sig, err := t.GetBytes("index.sig")
 	if err != nil {
-		return nil, err
+		if serr, ok := err.(*SessionError); !ok || serr.RemoteStatus != 404 || !conf.developerMode {
+			return nil, err
+		}
+		sig = nil
 	}
 	timestampbts, err := t.GetBytes("timestamp")
 	if err != nil {
 		return nil, err
 	}
-	pk, err := conf.schemePublicKey(scheme.path())
+
+	index, timestamp, err := conf.verifySchemeIndex(scheme, indexbts, sig, timestampbts)
 	if err != nil {
 		return nil, err
 	}
+	return &remoteSchemeState{scheme, timestamp, timestampbts, index, indexbts, sig}, nil
+}
 
-	// Verify signature and the timestamp hash in the index
-	if err = signed.Verify(pk, indexbts, sig); err != nil {
-		return nil, err
+// verifySchemeIndex verifies the signature over the index of the scheme, which may be absent only in
+// developer mode, and the timestamp against the index, returning both parsed.
+func (conf *Configuration) verifySchemeIndex(scheme Scheme, indexbts, sig, timestampbts []byte) (SchemeManagerIndex, *Timestamp, error) {
+	if sig != nil {
+		pk, err := conf.schemePublicKey(scheme.path())
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = signed.Verify(pk, indexbts, sig); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		unsigned, err := conf.locallyUnsigned(scheme)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !conf.developerMode || !unsigned {
+			return nil, nil, errors.Errorf("index of scheme %s is unsigned", scheme.id())
+		}
+		Logger.WithField("scheme", scheme.id()).Warn("remote scheme is unsigned, accepting because of developer mode")
 	}
 	index := SchemeManagerIndex(make(map[string]SchemeFileHash))
-	if err = index.FromString(string(indexbts)); err != nil {
-		return nil, err
+	if err := index.FromString(string(indexbts)); err != nil {
+		return nil, nil, err
 	}
 	sha := sha256.Sum256(timestampbts)
 	if !bytes.Equal(index[scheme.id()+"/timestamp"], sha[:]) {
-		return nil, errors.Errorf("signature over timestamp is not valid")
+		return nil, nil, errors.Errorf("signature over timestamp is not valid")
 	}
 
 	timestamp, err := parseTimestamp(timestampbts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	return &remoteSchemeState{scheme, timestamp, timestampbts, index, indexbts, sig}, nil
+	return index, timestamp, nil
 }
 
 func (conf *Configuration) writeSchemeIndex(dest string, indexbts, sigbts []byte) error {
@@ -623,9 +668,35 @@ func (conf *Configuration) writeSchemeIndex(dest string, indexbts, sigbts []byte
 	if err := common.SaveFile(filepath.Join(dest, "index"), indexbts); err != nil {
 		return err
 	}
+	if sigbts == nil {
+		// Unsigned scheme, only accepted in developer mode for schemes that are unsigned already
+		if _, exists, err := common.Stat(filepath.Join(dest, "index.sig")); err != nil {
+			return err
+		} else if exists {
+			return errors.New("refusing to replace signed scheme index by unsigned one")
+		}
+		return nil
+	}
 	return common.SaveFile(filepath.Join(dest, "index.sig"), sigbts)
 }
 
+// locallyUnsigned returns whether the scheme lacks a signature on disk: either it is installed
+// without index.sig, or it is being installed without public key. Only such schemes may be updated
+// from a remote lacking a signature, so that neither the scheme server nor anyone in between can
+// strip the signature of a signed scheme.
+func (conf *Configuration) locallyUnsigned(scheme Scheme) (bool, error) {
+	dir := scheme.path()
+	if _, exists, err := common.Stat(filepath.Join(dir, "index.sig")); err != nil || exists {
+		return false, err
+	}
+	_, installed, err := common.Stat(filepath.Join(dir, "index"))
+	if err != nil || installed {
+		return installed, err
+	}
+	_, pk, err := common.Stat(filepath.Join(dir, "pk.pem"))
+	return !pk, err
+}
+
 func (conf *Configuration) isUpToDate(subdir string) (bool, error) {
 	if conf.assets == "" || conf.readOnly {
 		return true, nil
@@ -657,6 +728,51 @@ func (conf *Configuration) copyFromAssets(subdir string) (bool, error) {
 	)
 }
 
+// UnsignedSchemes returns the schemes lacking a signature, which can only be installed and
+// parsed in developer mode, see SetDeveloperMode.
+func (conf *Configuration) UnsignedSchemes() []Scheme {
+	var schemes []Scheme
+	for _, scheme := range conf.SchemeManagers {
+		schemes = append(schemes, scheme)
+	}
+	for _, scheme := range conf.RequestorSchemes {
+		schemes = append(schemes, scheme)
+	}
+	var unsigned []Scheme
+	for _, scheme := range schemes {
+		if _, exists, err := common.Stat(filepath.Join(scheme.path(), "index.sig")); err == nil && !exists {
+			unsigned = append(unsigned, scheme)
+		}
+	}
+	return unsigned
+}
+
+// DangerousDeleteUnsignedSchemes deletes the schemes lacking a signature (see UnsignedSchemes),
+// restoring those included in the assets to their version in the assets, and reparses the schemes.
+// Be aware: this action is dangerous when the schemes are still in use.
+func (conf *Configuration) DangerousDeleteUnsignedSchemes() error {
+	if conf.readOnly {
+		return errors.New("cannot delete schemes from a read-only configuration")
+	}
+	for _, scheme := range conf.UnsignedSchemes() {
+		inAssets := false
+		if conf.assets != "" {
+			var err error
+			if _, inAssets, err = common.Stat(filepath.Join(conf.assets, filepath.Base(scheme.path()))); err != nil {
+				return err
+			}
+		}
+		if inAssets {
+			if err := conf.reinstallSchemeFromAssets(scheme); err != nil {
+				return err
+			}
+		} else if err := scheme.delete(conf); err != nil {
+			return err
+		}
+	}
+	return conf.ParseFolder()
+}
+
 // verifySignature verifies the signature on the scheme index file
 // (which contains the SHA256 hashes of all files under this scheme,
 // which are used for verifying file authenticity).
@@ -671,6 +787,14 @@ func (conf *Configuration) verifySignature(dir string) (err error) {
 		}
 	}()
 
+	if conf.developerMode {
+		if _, exists, err := common.Stat(filepath.Join(dir, "index.sig")); err != nil {
+			return err
+		} else if !exists {
+			Logger.WithField("dir", dir).Warn("scheme is unsigned, accepting because of developer mode")
+			return nil
+		}
+	}
 	if err := common.AssertPathExists(filepath.Join(dir, "index"), filepath.Join(dir, "index.sig"), filepath.Join(dir, "pk.pem")); err != nil {
 		return errors.New("Missing scheme manager index file, signature, or public key")
 	}
@@ -725,7 +849,7 @@ func (conf *Configuration) readHashedFile(path string, hash SchemeFileHash) ([]b
 	computedHash := sha256.Sum256(bts)
 
 	if !bytes.Equal(computedHash[:], hash) {
-		return nil, errors.Errorf("Hash of %s does not match scheme manager index", path)
+		return nil, &schemeFileError{path: path, err: errors.Errorf("Hash of %s does not match scheme manager index", path)}
 	}
 	return bts, nil
 }
@@ -768,11 +892,11 @@ func (conf *Configuration) checkUnsignedFiles(dir string, index SchemeManagerInd
 
 		if info.IsDir() {
 			if !dirInScheme(index, schemepath) {
-				conf.Warnings = append(conf.Warnings, "Ignored dir: "+schemepath)
+				conf.addWarning(path, "Ignored dir: %s", schemepath)
 			}
 		} else {
 			if _, ok := index[schemepath]; !ok {
-				conf.Warnings = append(conf.Warnings, "Ignored file: "+schemepath)
+				conf.addWarning(path, "Ignored file: %s", schemepath)
 			}
 		}
 
@@ -930,6 +1054,27 @@ func (scheme *SchemeManager) Distributed() bool {
 	return len(scheme.KeyshareServer) > 0
 }
 
+// defaultKeysharePinMinLength is the minimum PIN length of keyshare servers whose scheme does not
+// specify one.
+const defaultKeysharePinMinLength = 5
+
+// KeysharePinLength returns the minimum and maximum length of the PIN of the keyshare server of
+// this scheme. The maximum is 0 if there is none.
+func (scheme *SchemeManager) KeysharePinLength() (min, max int) {
+	min = scheme.KeysharePinMinLength
+	if min == 0 {
+		min = defaultKeysharePinMinLength
+	}
+	return min, scheme.KeysharePinMaxLength
+}
+
+// KeysharePinPolicy returns the PIN policy of the keyshare server of this scheme as far as it is
+// specified by the scheme, for use when the keyshare server does not publish its PIN policy.
+func (scheme *SchemeManager) KeysharePinPolicy() *KeysharePinPolicy {
+	min, max := scheme.KeysharePinLength()
+	return &KeysharePinPolicy{MinLength: min, MaxLength: max}
+}
+
 func (scheme *SchemeManager) id() string { return scheme.ID }
 
 func (scheme *SchemeManager) idx() SchemeManagerIndex { return scheme.index }
@@ -960,14 +1105,14 @@ func (scheme *SchemeManager) parseContents(conf *Configuration) error {
 			return nil
 		}
 		if issuer.XMLVersion < 4 {
-			return errors.New("Unsupported issuer description")
+			return &schemeFileError{path: filepath.Join(dir, "description.xml"), err: errors.New("Unsupported issuer description")}
 		}
 
 		if len(issuer.Languages) == 0 {
 			issuer.Languages = scheme.Languages
 		}
 		if err = conf.validateIssuer(scheme, issuer, dir); err != nil {
-			return err
+			return &schemeFileError{path: filepath.Join(dir, "description.xml"), err: err}
 		}
 
 		conf.Issuers[issuer.Identifier()] = issuer
@@ -982,7 +1127,8 @@ func (scheme *SchemeManager) parseContents(conf *Configuration) error {
 	for _, credType := range conf.CredentialTypes {
 		if credType.SchemeManagerID == scheme.ID {
 			if err := credType.validateDependencies(conf, []CredentialTypeIdentifier{}, credType.Identifier()); err != nil {
-				return err
+				path := filepath.Join(scheme.path(), credType.IssuerID, "Issues", credType.ID, "description.xml")
+				return &schemeFileError{path: path, err: err}
 			}
 		}
 	}
@@ -1004,6 +1150,10 @@ func (ct CredentialType) validateDependencies(conf *Configuration, validatedDeps
 			conSatisfied := true
 
 			for _, item := range con {
+				if conf.CredentialTypes[item] == nil {
+					return errors.Errorf("credential type %s has dependency on unknown credential type %s",
+						ct.Identifier().String(), item.String())
+				}
 				if conf.CredentialTypes[item].SchemeManagerID != ct.SchemeManagerID {
 					return errors.Errorf("credential type %s in scheme %s has dependency outside the scheme: %s",
 						ct.Identifier().String(), ct.SchemeManagerID, conf.CredentialTypes[item].Identifier().String())
@@ -1065,7 +1215,7 @@ func (scheme *SchemeManager) validate(conf *Configuration) (error, SchemeManager
 			return errors.Errorf("Scheme %s has keyshare URL but no keyshare public key kss-0.pem", scheme.ID), SchemeManagerStatusParsingError
 		}
 	}
-	conf.validateTranslations(fmt.Sprintf("Scheme %s", scheme.ID), scheme, scheme.Languages)
+	conf.validateTranslations(filepath.Join(scheme.path(), "description.xml"), fmt.Sprintf("Scheme %s", scheme.ID), scheme, scheme.Languages)
 
 	// Verify that all other files are validly signed
 	if err := scheme.verifyFiles(conf); err != nil {
@@ -1190,6 +1340,7 @@ func (scheme *SchemeManager) purge(conf *Configuration) {
 			delete(conf.AttributeTypes, attrid)
 		}
 	}
+	conf.invalidateAttributeIndex()
 	for hash, credid := range conf.reverseHashes {
 		if credid.Root() == id.String() {
 			delete(conf.reverseHashes, hash)
@@ -1236,7 +1387,7 @@ func (scheme *SchemeManager) parseCredentialsFolder(conf *Configuration, issuer
 			cred.Languages = issuer.Languages
 		}
 		if err = conf.validateCredentialType(scheme, issuer, cred, dir); err != nil {
-			return err
+			return &schemeFileError{path: filepath.Join(dir, "description.xml"), err: err}
 		}
 		foundcred = true
 		if cred.RevocationUpdateCount == 0 {
@@ -1260,10 +1411,11 @@ func (scheme *SchemeManager) parseCredentialsFolder(conf *Configuration, issuer
 			attr.CredentialTypeID = cred.ID
 			conf.AttributeTypes[attr.GetAttributeTypeIdentifier()] = attr
 		}
+		conf.invalidateAttributeIndex()
 		return nil
 	})
 	if !foundcred {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no credential types", issuer.Identifier().String()))
+		conf.addWarning(filepath.Dir(path), "Issuer %s has no credential types", issuer.Identifier().String())
 	}
 	return err
 }
@@ -0,0 +1,234 @@
+package irma
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// This file contains Configuration.ValidateScheme, with which scheme maintainers can check a scheme
+// directory before publishing it. The scheme is parsed by the same code that parses schemes when
+// loading them, which records the problems it runs into in a schemeValidation; a few checks that
+// normal loading skips or stops after are added on top.
+
+// SchemeValidationSeverity is the severity of a SchemeValidationIssue.
+type SchemeValidationSeverity string
+
+const (
+	// SchemeValidationError means that the scheme would not be loaded, or parts of it not be usable.
+	SchemeValidationError = SchemeValidationSeverity("error")
+	// SchemeValidationWarning means that the scheme would be loaded, but should be fixed.
+	SchemeValidationWarning = SchemeValidationSeverity("warning")
+)
+
+// SchemeValidationIssue is a problem with a scheme found by Configuration.ValidateScheme.
+type SchemeValidationIssue struct {
+	Severity SchemeValidationSeverity `json:"severity"`
+	// File in which the problem occurs, relative to the scheme directory, if known.
+	File string `json:"file,omitempty"`
+	// Line in File at which the problem occurs, if known.
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (issue *SchemeValidationIssue) String() string {
+	location := issue.File
+	if location != "" && issue.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, issue.Line)
+	}
+	if location == "" {
+		return fmt.Sprintf("%s: %s", issue.Severity, issue.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", issue.Severity, location, issue.Message)
+}
+
+// schemeValidation collects the issues found while validating the scheme in dir.
+type schemeValidation struct {
+	dir    string
+	issues []*SchemeValidationIssue
+}
+
+// schemeFileError is an error in the scheme file at path. Its message is that of err, so that it
+// does not change the errors returned when loading schemes.
+type schemeFileError struct {
+	path string
+	err  error
+}
+
+func (e *schemeFileError) Error() string { return e.err.Error() }
+
+func (e *schemeFileError) Unwrap() error { return e.err }
+
+// ValidateScheme checks the directory of the specified scheme for everything that normal loading
+// of the scheme would check, reporting all problems instead of stopping at the first. This
+// includes the signature of the index and the hashes of all files in it; the issuers, credential
+// types and their attributes, dependencies, translations and logos; and the public keys of the
+// issuers. Warnings are problems that do not prevent the scheme from being loaded.
+//
+// The scheme is the one at its path if it is installed, and otherwise the directory in the
+// configuration path named after it. This Configuration is not modified. Only issuer schemes are
+// supported. The returned error is only non-nil if the scheme could not be validated at all.
+func (conf *Configuration) ValidateScheme(id SchemeManagerIdentifier) ([]*SchemeValidationIssue, error) {
+	dir := filepath.Join(conf.Path, id.String())
+	if scheme, ok := conf.SchemeManagers[id]; ok && scheme.path() != "" {
+		dir = scheme.path()
+	}
+	if err := common.AssertPathExists(dir); err != nil {
+		return nil, errors.Errorf("scheme %s not found", id)
+	}
+	filename, err := common.SchemeFilename(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the scheme into a new configuration, so that this one and its other schemes are
+	// not involved
+	validation := &schemeValidation{dir: dir}
+	parsed := &Configuration{
+		Path:          conf.Path,
+		options:       ConfigurationOptions{ReadOnly: true, IgnorePrivateKeys: true},
+		readOnly:      true,
+		developerMode: conf.developerMode,
+		validation:    validation,
+	}
+	parsed.clear()
+
+	s, err := parsed.ParseSchemeFolder(dir)
+	if s != nil && s.typ() != SchemeTypeIssuer {
+		return nil, errors.Errorf("%s is not an issuer scheme", dir)
+	}
+	var scheme *SchemeManager
+	if s != nil {
+		scheme = s.(*SchemeManager)
+		if scheme.ID != id.String() {
+			validation.add(SchemeValidationError, filepath.Join(dir, filename), 0,
+				fmt.Sprintf("Scheme directory of %s contains scheme %s", id, scheme.ID))
+		}
+	}
+
+	hashesValid := true
+	if scheme != nil && scheme.index != nil {
+		hashesValid = validation.checkIndex(parsed, scheme)
+	}
+	if err != nil {
+		serr := err.(*SchemeManagerError)
+		// If the index does not match the files, we reported all mismatches already
+		if hashesValid || serr.Status != SchemeManagerStatusInvalidSignature {
+			validation.addError(serr.Err)
+		}
+	} else {
+		validation.checkKeys(parsed, scheme)
+	}
+
+	issues := validation.issues
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].Severity == SchemeValidationError && issues[j].Severity != SchemeValidationError
+	})
+	return issues, nil
+}
+
+// addWarning appends a warning about the scheme file at path, if known, to conf.Warnings.
+func (conf *Configuration) addWarning(path string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	conf.Warnings = append(conf.Warnings, msg)
+	if conf.validation != nil {
+		conf.validation.add(SchemeValidationWarning, path, 0, msg)
+	}
+}
+
+func (v *schemeValidation) add(severity SchemeValidationSeverity, path string, line int, msg string) {
+	file := path
+	if rel, err := filepath.Rel(v.dir, path); path != "" && err == nil && !strings.HasPrefix(rel, "..") {
+		file = rel
+	}
+	v.issues = append(v.issues, &SchemeValidationIssue{
+		Severity: severity,
+		File:     filepath.ToSlash(file),
+		Line:     line,
+		Message:  msg,
+	})
+}
+
+// addError adds an error, taking the file and line from err if it contains them.
+func (v *schemeValidation) addError(err error) {
+	var (
+		path      string
+		line      int
+		fileErr   *schemeFileError
+		syntaxErr *xml.SyntaxError
+	)
+	if errors.As(err, &fileErr) {
+		path = fileErr.path
+	}
+	if errors.As(err, &syntaxErr) {
+		line = syntaxErr.Line
+	}
+	v.add(SchemeValidationError, path, line, err.Error())
+}
+
+// checkIndex checks the hashes of all files in the index of the scheme, returning whether all of
+// them match. Files in the index that do not exist are ignored by normal loading, and reported as
+// warnings.
+func (v *schemeValidation) checkIndex(conf *Configuration, scheme *SchemeManager) bool {
+	files := make([]string, 0, len(scheme.index))
+	for file := range scheme.index {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	valid := true
+	for _, file := range files {
+		path := filepath.Join(scheme.path(), filepath.FromSlash(file[len(scheme.id())+1:]))
+		exists, err := common.PathExists(path)
+		if err != nil {
+			v.addError(err)
+			continue
+		}
+		if !exists {
+			v.add(SchemeValidationWarning, path, 0, fmt.Sprintf("File %s in scheme index does not exist", file))
+			continue
+		}
+		if _, err = conf.readHashedFile(path, scheme.index[file]); err != nil {
+			v.addError(err)
+			valid = false
+		}
+	}
+	return valid
+}
+
+// checkKeys checks that all public keys of the issuers of the scheme parse, and then validates the
+// latest ones as normal loading does.
+func (v *schemeValidation) checkKeys(conf *Configuration, scheme *SchemeManager) {
+	issuerids := make([]IssuerIdentifier, 0, len(conf.Issuers))
+	for issuerid := range conf.Issuers {
+		issuerids = append(issuerids, issuerid)
+	}
+	sort.Slice(issuerids, func(i, j int) bool { return issuerids[i].String() < issuerids[j].String() })
+
+	valid := true
+	for _, issuerid := range issuerids {
+		files, err := filepath.Glob(filepath.Join(scheme.path(), issuerid.Name(), "PublicKeys", "*"))
+		if err != nil {
+			v.addError(err)
+			valid = false
+			continue
+		}
+		for _, file := range files {
+			if _, err = conf.parsePublicKeyFile(scheme, issuerid, file); err != nil {
+				v.addError(&schemeFileError{path: file, err: err})
+				valid = false
+			}
+		}
+	}
+	if !valid {
+		return
+	}
+	if err := conf.ValidateKeys(); err != nil {
+		v.addError(err)
+	}
+}
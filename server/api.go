@@ -175,7 +175,8 @@ func WriteString(w http.ResponseWriter, str string) {
 }
 
 // ParseSessionRequest attempts to parse the input as an irma.RequestorRequest instance, accepting (skipping "irma.")
-//   - RequestorRequest instances directly (ServiceProviderRequest, SignatureRequestorRequest, IdentityProviderRequest)
+//   - RequestorRequest instances directly (ServiceProviderRequest, SignatureRequestorRequest, IdentityProviderRequest),
+//     or an ExtendedSessionRequest, which is validated and converted to one of those
 //   - SessionRequest instances (DisclosureRequest, SignatureRequest, IssuanceRequest)
 //   - JSON representations ([]byte or string) of any of the above.
 func ParseSessionRequest(request interface{}) (irma.RequestorRequest, error) {
@@ -190,6 +191,11 @@ func ParseSessionRequest(request interface{}) (irma.RequestorRequest, error) {
 
 func parseInput(request interface{}) (irma.RequestorRequest, error) {
 	switch r := request.(type) {
+	case *irma.ExtendedSessionRequest:
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		return r.Typed()
 	case irma.RequestorRequest:
 		return r, nil
 	case irma.SessionRequest:
@@ -74,6 +74,27 @@ func TestParseSessionRequest(t *testing.T) {
 		require.Equal(t, request, req.Request)
 	})
 
+	t.Run("extended session request", func(t *testing.T) {
+		request := &irma.DisclosureRequest{}
+		require.NoError(t, json.Unmarshal([]byte(requestJson), request))
+		extended := irma.NewExtendedSessionRequest(request)
+		extended.CallbackURL = "https://example.com/callback"
+		extended.ClientTimeout = 60
+
+		res, err := ParseSessionRequest(extended)
+		require.NoError(t, err)
+		req, ok := res.(*irma.ServiceProviderRequest)
+		require.True(t, ok)
+		require.Equal(t, request, req.Request)
+		require.Equal(t, "https://example.com/callback", req.CallbackURL)
+		require.Equal(t, 60, req.ClientTimeout)
+		require.Equal(t, irma.DefaultJwtValidity, req.ResultJwtValidity)
+
+		extended.CallbackURL = "http://example.com/callback"
+		_, err = ParseSessionRequest(extended)
+		require.Error(t, err)
+	})
+
 	t.Run("invalid type", func(t *testing.T) {
 		_, err := ParseSessionRequest(42)
 		require.Error(t, err)
@@ -85,6 +106,21 @@ func TestParseSessionRequest(t *testing.T) {
 	})
 }
 
+func TestParseSessionPackage(t *testing.T) {
+	pkgJson := `{
+		"sessionPtr": {"u": "https://example.com/irma/session/abc", "irmaqr": "disclosing"},
+		"token": "requestortoken",
+		"frontendRequest": {"authorization": "frontendauth", "pairingHint": true, "minProtocolVersion": "1.0", "maxProtocolVersion": "1.1"}
+	}`
+	pkg := &SessionPackage{}
+	require.NoError(t, json.Unmarshal([]byte(pkgJson), pkg))
+	require.Equal(t, irma.ActionDisclosing, pkg.SessionPtr.Type)
+	require.Equal(t, "https://example.com/irma/session/abc", pkg.SessionPtr.URL)
+	require.Equal(t, irma.RequestorToken("requestortoken"), pkg.Token)
+	require.Equal(t, irma.FrontendAuthorization("frontendauth"), pkg.FrontendRequest.Authorization)
+	require.True(t, pkg.FrontendRequest.PairingRecommended)
+}
+
 type readerFunc func(p []byte) (int, error)
 
 func (r readerFunc) Read(p []byte) (int, error) { return r(p) }
@@ -189,6 +189,7 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 		r.Delete("/", s.handleSessionDelete)
 		r.Get("/status", s.handleSessionStatus)
 		r.Get("/statusevents", s.handleSessionStatusEvents)
+		r.Post("/error", s.handleSessionErrorReport)
 		r.Route("/frontend", func(r chi.Router) {
 			r.Use(s.frontendMiddleware)
 			r.Get("/status", s.handleFrontendStatus)
@@ -313,8 +314,10 @@ func (s *Server) startNextSession(
 	}
 	session.handler = handler
 	return &irma.Qr{
-			Type: action,
-			URL:  s.conf.URL + "session/" + string(session.ClientToken),
+			Type:               action,
+			URL:                s.conf.URL + "session/" + string(session.ClientToken),
+			ProtocolVersion:    minProtocolVersion,
+			MaxProtocolVersion: maxProtocolVersion,
 		},
 		session.RequestorToken,
 		&irma.FrontendSessionRequest{
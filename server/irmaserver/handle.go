@@ -206,6 +206,9 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	if session.Result.ProofStatus != irma.ProofStatusValid {
 		return nil, session.fail(server.ErrorInvalidProofs, "")
 	}
+	if err = request.VerifyBindings(session.Result.Disclosed); err != nil {
+		return nil, session.fail(server.ErrorBindingViolated, err.Error())
+	}
 
 	// Compute CL signatures
 	var sigs []*gabi.IssueSignatureMessage
@@ -413,20 +416,51 @@ func (s *Server) handleSessionDelete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
+// handleSessionErrorReport logs the irma.ClientErrorReport of a client whose session failed.
+func (s *Server) handleSessionErrorReport(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value("session").(*session)
+	clientAuth := irma.ClientAuthorization(r.Header.Get(irma.AuthorizationHeader))
+	if session.ClientAuth != "" && session.ClientAuth != clientAuth {
+		server.WriteError(w, server.ErrorIrmaUnauthorized, "")
+		return
+	}
+	bts, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	report := &irma.ClientErrorReport{}
+	if err = json.Unmarshal(bts, report); err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	s.conf.Logger.WithFields(logrus.Fields{
+		"session":         session.RequestorToken,
+		"error":           report.ErrorType,
+		"remoteError":     report.RemoteError,
+		"phase":           report.Phase,
+		"protocolVersion": report.ProtocolVersion,
+		"client":          report.ClientName + " " + report.ClientVersion,
+		"timings":         report.Timings,
+	}).Warn("Client reported session failure")
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) handleSessionGet(w http.ResponseWriter, r *http.Request) {
-	var min, max irma.ProtocolVersion
-	if err := json.Unmarshal([]byte(r.Header.Get(irma.MinVersionHeader)), &min); err != nil {
+	min, err := irma.ParseVersion(r.Header.Get(irma.MinVersionHeader))
+	if err != nil {
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
-	if err := json.Unmarshal([]byte(r.Header.Get(irma.MaxVersionHeader)), &max); err != nil {
+	max, err := irma.ParseVersion(r.Header.Get(irma.MaxVersionHeader))
+	if err != nil {
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
 	session := r.Context().Value("session").(*session)
 	clientAuth := irma.ClientAuthorization(r.Header.Get(irma.AuthorizationHeader))
-	res, err := session.handleGetClientRequest(&min, &max, clientAuth)
-	server.WriteResponse(w, res, err)
+	res, rerr := session.handleGetClientRequest(min, max, clientAuth)
+	server.WriteResponse(w, res, rerr)
 }
 
 func (s *Server) handleSessionGetRequest(w http.ResponseWriter, r *http.Request) {
@@ -511,7 +545,11 @@ func (s *Server) handleStaticMessage(w http.ResponseWriter, r *http.Request) {
 
 // GET revocation/events/{credtype}/{pkcounter}/{min}/{max}
 func (s *Server) handleRevocationGetEvents(w http.ResponseWriter, r *http.Request) {
-	cred := irma.NewCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	cred, err := irma.ParseCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
+		return
+	}
 	pkcounter, _ := strconv.ParseUint(chi.URLParam(r, "counter"), 10, 32)
 	min, _ := strconv.ParseUint(chi.URLParam(r, "min"), 10, 64)
 	max, _ := strconv.ParseUint(chi.URLParam(r, "max"), 10, 64)
@@ -546,7 +584,11 @@ func (s *Server) handleRevocationUpdateEvents(w http.ResponseWriter, r *http.Req
 
 // GET revocation/update/{credtype}/{count}[/{pkcounter}]
 func (s *Server) handleRevocationGetUpdateLatest(w http.ResponseWriter, r *http.Request) {
-	cred := irma.NewCredentialTypeIdentifier(chi.URLParam(r, "id")) // id
+	cred, err := irma.ParseCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
+		return
+	}
 	count, _ := strconv.ParseUint(chi.URLParam(r, "count"), 10, 64) // count
 	c := chi.URLParam(r, "counter")
 	var counter *uint
@@ -582,7 +624,11 @@ func (s *Server) handleRevocationGetUpdateLatest(w http.ResponseWriter, r *http.
 
 // POST revocation/issuancerecord/{credtype}/{counter}
 func (s *Server) handleRevocationPostIssuanceRecord(w http.ResponseWriter, r *http.Request) {
-	cred := irma.NewCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	cred, err := irma.ParseCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
+		return
+	}
 	counter, _ := strconv.ParseUint(chi.URLParam(r, "counter"), 10, 32)
 
 	if settings := s.conf.RevocationSettings[cred]; settings == nil || !settings.Authority {
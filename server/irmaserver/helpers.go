@@ -278,7 +278,7 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 		if now.Unix() > pubkey.ExpiryDate {
 			return errors.Errorf("cannot issue using expired public key %s-%d", iss.String(), privatekey.Counter)
 		}
-		cred.KeyCounter = privatekey.Counter
+		cred.SetKeyCounter(privatekey.Counter)
 
 		if s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RevocationSupported() {
 			settings := s.conf.RevocationSettings[cred.CredentialTypeID]
@@ -341,6 +341,7 @@ func (session *session) getClientRequest() (*irma.ClientSessionRequest, error) {
 		LDContext:       irma.LDContextClientSessionRequest,
 		ProtocolVersion: session.Version,
 		Options:         &session.Options,
+		Lifetime:        session.conf.MaxSessionLifetime * 60,
 	}
 
 	if session.Options.PairingMethod == irma.PairingMethodNone {
@@ -1,8 +1,13 @@
 package irmaserver
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/privacybydesign/irmago/internal/test"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -108,3 +113,54 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 	require.True(t, addingCompleted)
 	require.False(t, deletingCompleted)
 }
+
+func TestRevocationMalformedCredentialType(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+	handler := s.HandlerFunc()
+
+	for _, path := range []string{
+		"/revocation/irma-demo.MijnOverheid/update/1",
+		"/revocation/irma-demo.MijnOverheid.root.BSN/events/2/0/1",
+		"/revocation/irma-demo..root/update/1/2",
+		"/revocation/irma-demo.MijnOverheid.r%20ot/update/1",
+	} {
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			var rerr irma.RemoteError
+			require.NoError(t, irma.UnmarshalBinary(w.Body.Bytes(), &rerr))
+			require.Equal(t, string(server.ErrorMalformedInput.Type), rerr.ErrorName)
+		})
+	}
+
+	// Well-formed but unsupported credential types are still refused as before
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/revocation/irma-demo.MijnOverheid.root/update/1", nil))
+	var rerr irma.RemoteError
+	require.NoError(t, irma.UnmarshalBinary(w.Body.Bytes(), &rerr))
+	require.Equal(t, string(server.ErrorInvalidRequest.Type), rerr.ErrorName)
+}
+
+func TestSessionErrorReport(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+	handler := s.HandlerFunc()
+
+	qr, _, _, err := s.StartSession(irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")), nil)
+	require.NoError(t, err)
+	path := "/session/" + qr.URL[strings.LastIndex(qr.URL, "/")+1:] + "/error"
+
+	bts, err := json.Marshal(&irma.ClientErrorReport{ErrorType: irma.ErrorApi, Phase: irma.ClientStatusCommunicating})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(bts)))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{")))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
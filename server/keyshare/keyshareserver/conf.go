@@ -26,6 +26,9 @@ const (
 	DBTypePostgres DBType = "postgres"
 )
 
+// PinMinLengthDefault is the minimum PIN length of the PIN policy if none is configured.
+const PinMinLengthDefault = 5
+
 // Configuration contains configuration for the irmaserver library and irmad.
 type Configuration struct {
 	// IRMA server configuration
@@ -52,6 +55,11 @@ type Configuration struct {
 	StorageFallbackKeyFiles []string `json:"storage_fallback_key_files" mapstructure:"storage_fallback_key_files"`
 	StoragePrimaryKeyFile   string   `json:"storage_primary_key_file" mapstructure:"storage_primary_key_file"`
 
+	// PIN policy published to clients, which enforce it; see irma.KeysharePinPolicy
+	PinMinLength  int    `json:"pin_min_length" mapstructure:"pin_min_length"`
+	PinMaxLength  int    `json:"pin_max_length" mapstructure:"pin_max_length"`
+	PinCharacters string `json:"pin_characters" mapstructure:"pin_characters"`
+
 	// Keyshare attribute to issue during registration
 	KeyshareAttribute irma.AttributeTypeIdentifier `json:"keyshare_attribute" mapstructure:"keyshare_attribute"`
 
@@ -117,6 +125,13 @@ func validateConf(conf *Configuration) error {
 	}
 	conf.URL += "irma/"
 
+	if conf.PinMinLength == 0 {
+		conf.PinMinLength = PinMinLengthDefault
+	}
+	if conf.PinMaxLength != 0 && conf.PinMaxLength < conf.PinMinLength {
+		return server.LogError(errors.Errorf("PinMaxLength (%d) is less than PinMinLength (%d)", conf.PinMaxLength, conf.PinMinLength))
+	}
+
 	if conf.EmailTokenValidity == 0 {
 		conf.EmailTokenValidity = 168 // set default of 7 days
 	}
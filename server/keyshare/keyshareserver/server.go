@@ -46,6 +46,12 @@ type Server struct {
 
 var errMissingCommitment = errors.New("missing previous call to getCommitments")
 
+// Range of keyshare protocol versions supported by this server, see irma.KeyshareStatus
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 2
+)
+
 func New(conf *Configuration) (*Server, error) {
 	var err error
 	s := &Server{
@@ -131,8 +137,12 @@ func (s *Server) Handler() http.Handler {
 
 func (s *Server) routeHandler(r chi.Router) http.Handler {
 
+	// Status
+	r.Get("/status", s.handleStatus)
+
 	// Registration
 	r.Post("/client/register", s.handleRegister)
+	r.Get("/client/pin_policy", s.handlePinPolicy)
 
 	// Authentication
 	r.Post("/users/verify_start", s.handleVerifyStart)
@@ -552,6 +562,22 @@ func (s *Server) updatePin(user *User, jwtt string) (irma.KeysharePinStatus, err
 	return irma.KeysharePinStatus{Status: "success"}, nil
 }
 
+// /status
+// Advertises the keyshare protocol versions that this server supports.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, irma.KeyshareStatus{MinVersion: minProtocolVersion, MaxVersion: maxProtocolVersion})
+}
+
+// /client/pin_policy
+// Returns the PIN policy, which clients enforce when users choose a PIN.
+func (s *Server) handlePinPolicy(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, irma.KeysharePinPolicy{
+		MinLength:  s.conf.PinMinLength,
+		MaxLength:  s.conf.PinMaxLength,
+		Characters: s.conf.PinCharacters,
+	})
+}
+
 // /client/register
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	// Extract request
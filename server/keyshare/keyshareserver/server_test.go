@@ -131,6 +131,24 @@ func TestServerHandleRegister(t *testing.T) {
 	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/register", string(msg), nil, 500, nil)
 }
 
+func TestStatus(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var status irma.KeyshareStatus
+	test.HTTPGet(t, nil, "http://localhost:8080/api/v1/status", nil, 200, &status)
+	assert.Equal(t, irma.KeyshareStatus{MinVersion: 1, MaxVersion: 2}, status)
+}
+
+func TestPinPolicy(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var policy irma.KeysharePinPolicy
+	test.HTTPGet(t, nil, "http://localhost:8080/api/v1/client/pin_policy", nil, 200, &policy)
+	assert.Equal(t, irma.KeysharePinPolicy{MinLength: PinMinLengthDefault}, policy)
+}
+
 func TestPinTries(t *testing.T) {
 	db := createDB(t)
 	keyshareServer, httpServer := StartKeyshareServer(t, &testDB{db: db, ok: true, tries: 1, wait: 0, err: nil}, "")
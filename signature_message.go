@@ -0,0 +1,135 @@
+package irma
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MessageAnomaly is a property of the message of an attribute-based signature that may cause
+// it to be displayed differently from how it is signed, see AnalyzeSignatureMessage.
+type MessageAnomaly string
+
+const (
+	// MessageAnomalyInvalidUTF8 is a message that is not valid UTF-8.
+	MessageAnomalyInvalidUTF8 = MessageAnomaly("invalidUtf8")
+	// MessageAnomalyNotNormalized is a message that is not in Unicode normalization form NFC,
+	// so that it contains characters that can also be encoded differently.
+	MessageAnomalyNotNormalized = MessageAnomaly("notNormalized")
+	// MessageAnomalyBidiControl is a message containing characters that change the direction
+	// of the text, which can be used to reorder how the message is displayed.
+	MessageAnomalyBidiControl = MessageAnomaly("bidiControl")
+	// MessageAnomalyControlCharacter is a message containing control characters other than
+	// newlines and tabs.
+	MessageAnomalyControlCharacter = MessageAnomaly("controlCharacter")
+	// MessageAnomalyInvisibleCharacter is a message containing characters that are not
+	// displayed, such as zero width spaces.
+	MessageAnomalyInvisibleCharacter = MessageAnomaly("invisibleCharacter")
+	// MessageAnomalyMixedScripts is a message containing words mixing letters of different
+	// scripts, such as Latin and Cyrillic, which may be homoglyphs of each other.
+	MessageAnomalyMixedScripts = MessageAnomaly("mixedScripts")
+	// MessageAnomalySurroundingWhitespace is a message that starts or ends with whitespace,
+	// which is easily overlooked.
+	MessageAnomalySurroundingWhitespace = MessageAnomaly("surroundingWhitespace")
+)
+
+// MessageAnalysis is the result of AnalyzeSignatureMessage.
+type MessageAnalysis struct {
+	// Raw is the message exactly as it is (to be) signed.
+	Raw string `json:"raw"`
+	// Sanitized is the message in normalization form NFC, without control and invisible
+	// characters, suitable for display next to a warning if Anomalies is not empty.
+	Sanitized string `json:"sanitized"`
+	// Anomalies of Raw, in the order of the MessageAnomaly constants.
+	Anomalies []MessageAnomaly `json:"anomalies,omitempty"`
+}
+
+// confusableScripts are scripts containing letters that look like letters of another of them.
+var confusableScripts = []*unicode.RangeTable{unicode.Latin, unicode.Greek, unicode.Cyrillic, unicode.Armenian, unicode.Cherokee}
+
+// AnalyzeSignatureMessage detects properties of the message of an attribute-based signature
+// that may cause the message to be displayed differently from how it is signed, so that the
+// user, or a relying party verifying the signature, can be warned about them. Signatures are
+// always computed and verified over the raw message, never over the sanitized one.
+func AnalyzeSignatureMessage(message string) *MessageAnalysis {
+	raw := message
+	found := map[MessageAnomaly]bool{}
+	if !utf8.ValidString(message) {
+		found[MessageAnomalyInvalidUTF8] = true
+		message = strings.ToValidUTF8(message, string(utf8.RuneError))
+	}
+	if !norm.NFC.IsNormalString(message) {
+		found[MessageAnomalyNotNormalized] = true
+	}
+	if strings.TrimSpace(message) != message {
+		found[MessageAnomalySurroundingWhitespace] = true
+	}
+
+	var sanitized strings.Builder
+	for _, r := range norm.NFC.String(message) {
+		switch {
+		case r == '\n' || r == '\t':
+		case unicode.Is(unicode.Bidi_Control, r):
+			found[MessageAnomalyBidiControl] = true
+			continue
+		case unicode.IsControl(r):
+			found[MessageAnomalyControlCharacter] = true
+			continue
+		case unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Other_Default_Ignorable_Code_Point, r):
+			found[MessageAnomalyInvisibleCharacter] = true
+			continue
+		}
+		sanitized.WriteRune(r)
+	}
+	if hasMixedScriptWord(sanitized.String()) {
+		found[MessageAnomalyMixedScripts] = true
+	}
+
+	analysis := &MessageAnalysis{Raw: raw, Sanitized: sanitized.String()}
+	for _, anomaly := range []MessageAnomaly{
+		MessageAnomalyInvalidUTF8,
+		MessageAnomalyNotNormalized,
+		MessageAnomalyBidiControl,
+		MessageAnomalyControlCharacter,
+		MessageAnomalyInvisibleCharacter,
+		MessageAnomalyMixedScripts,
+		MessageAnomalySurroundingWhitespace,
+	} {
+		if found[anomaly] {
+			analysis.Anomalies = append(analysis.Anomalies, anomaly)
+		}
+	}
+	return analysis
+}
+
+// hasMixedScriptWord returns whether any word of the message contains letters of more than
+// one of the confusableScripts.
+func hasMixedScriptWord(message string) bool {
+	for _, word := range strings.FieldsFunc(message, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		var script *unicode.RangeTable
+		for _, r := range word {
+			for _, s := range confusableScripts {
+				if !unicode.Is(s, r) {
+					continue
+				}
+				if script != nil && script != s {
+					return true
+				}
+				script = s
+			}
+		}
+	}
+	return false
+}
+
+// AnalyzeMessage analyzes the message of the signature, see AnalyzeSignatureMessage.
+func (sm *SignedMessage) AnalyzeMessage() *MessageAnalysis {
+	return AnalyzeSignatureMessage(sm.Message)
+}
+
+// AnalyzeMessage analyzes the message to be signed, see AnalyzeSignatureMessage.
+func (sr *SignatureRequest) AnalyzeMessage() *MessageAnalysis {
+	return AnalyzeSignatureMessage(sr.Message)
+}
@@ -12,10 +12,10 @@ import (
 )
 
 // GetTimestamp GETs a signed timestamp (a signature over the current time and the parameters)
-// over the message to be signed, the randomized signatures over the attributes, and the disclosed
-// attributes, for in attribute-based signature sessions.
-func GetTimestamp(message string, sigs []*big.Int, disclosed [][]*big.Int, conf *Configuration) (*atum.Timestamp, error) {
-	nonce, timestampServerUrl, err := TimestampRequest(message, sigs, disclosed, true, conf)
+// over the hash of the message to be signed (see SignatureMessageHash), the randomized signatures
+// over the attributes, and the disclosed attributes, for in attribute-based signature sessions.
+func GetTimestamp(msgHash []byte, sigs []*big.Int, disclosed [][]*big.Int, conf *Configuration) (*atum.Timestamp, error) {
+	nonce, timestampServerUrl, err := TimestampRequest(msgHash, sigs, disclosed, true, conf)
 	if err != nil {
 		return nil, err
 	}
@@ -26,14 +26,12 @@ func GetTimestamp(message string, sigs []*big.Int, disclosed [][]*big.Int, conf
 	})
 }
 
-// TimestampRequest computes the nonce to be signed by a timestamp server, given a message to be signed
-// in an attribute-based signature session along with the randomized signatures over the attributes
-// and the disclosed attributes. The url of the timestamp server that should be used to validate the
-// request is returned as the second return value.
-func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, new bool, conf *Configuration) (
+// TimestampRequest computes the nonce to be signed by a timestamp server, given the hash of a message
+// to be signed in an attribute-based signature session (see SignatureMessageHash) along with the
+// randomized signatures over the attributes and the disclosed attributes. The url of the timestamp
+// server that should be used to validate the request is returned as the second return value.
+func TimestampRequest(msgHash []byte, sigs []*big.Int, disclosed [][]*big.Int, new bool, conf *Configuration) (
 	[]byte, string, error) {
-	msgHash := sha256.Sum256([]byte(message))
-
 	// Convert the sigs and disclosed (double) slices to (double) slices of gobig.Int's for asn1
 	sigsint := make([]*gobig.Int, len(sigs))
 	for i, k := range sigs {
@@ -89,7 +87,7 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, n
 		MsgHash   []byte
 		Disclosed interface{}
 	}{
-		sigsint, msgHash[:], d,
+		sigsint, msgHash, d,
 	})
 	if err != nil {
 		return nil, "", err
@@ -99,9 +97,9 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, n
 	return hashed[:], timestampServerUrl, nil
 }
 
-// Given an SignedMessage, verify the timestamp over the signed message, disclosed attributes,
-// and rerandomized CL-signatures.
-func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) error {
+// Given an SignedMessage, verify the timestamp over the hash of the signed message, disclosed
+// attributes, and rerandomized CL-signatures.
+func (sm *SignedMessage) VerifyTimestamp(msgHash []byte, conf *Configuration) error {
 	// Extract the disclosed attributes and randomized CL-signatures from the proofs in order to
 	// construct the nonce that should be signed by the timestamp server.
 	zero := big.NewInt(0)
@@ -127,7 +125,7 @@ func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) er
 		}
 	}
 
-	bts, timestampServerUrl, err := TimestampRequest(message, sigs, disclosed, sm.Version() >= 2, conf)
+	bts, timestampServerUrl, err := TimestampRequest(msgHash, sigs, disclosed, sm.Version() >= 2, conf)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,223 @@
+package irma
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains a record/replay layer for HTTPTransport, for regression testing the
+// compatibility of the client with (particular versions of) IRMA servers and keyshare servers.
+// A TranscriptRecorder, installed using HTTPTransport.SetRoundTripper, records the requests
+// of a session and the responses to them in a Transcript; a TranscriptReplayer answers the
+// requests of a session from a Transcript, so that the session can be run without network.
+
+// Transcript is a recording of the HTTP exchanges of one or more sessions.
+type Transcript struct {
+	// Qr starts the recorded session.
+	Qr *Qr `json:"qr,omitempty"`
+	// Randomness is the randomness that the client used during the session, so that the client
+	// can be made to send the same messages when the transcript is replayed.
+	Randomness []byte                `json:"randomness,omitempty"`
+	Exchanges  []*TranscriptExchange `json:"exchanges"`
+}
+
+// TranscriptExchange is a recorded HTTP request and the response to it. Headers are not
+// recorded, and secrets are redacted from the bodies, see RedactTranscriptExchange.
+type TranscriptExchange struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	Request     string `json:"request,omitempty"`
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType,omitempty"`
+	Response    string `json:"response,omitempty"`
+}
+
+// transcriptRedacted replaces secrets in transcripts.
+const transcriptRedacted = "REDACTED"
+
+// transcriptSecretFields are the fields of JSON request bodies that contain (hashed) PINs.
+var transcriptSecretFields = map[string]bool{"pin": true, "oldpin": true, "newpin": true, "auth_response_jwt": true}
+
+// RedactTranscriptExchange removes the PINs from requests to keyshare servers, and the
+// authorization tokens from the responses of keyshare servers to PIN verification.
+func RedactTranscriptExchange(exchange *TranscriptExchange) {
+	exchange.Request = redactJSONFields(exchange.Request, transcriptSecretFields)
+	if strings.Contains(exchange.URL, "/users/verify/") {
+		var result KeysharePinStatus
+		if json.Unmarshal([]byte(exchange.Response), &result) == nil && result.Status == "success" {
+			exchange.Response = redactJSONFields(exchange.Response, map[string]bool{"message": true})
+		}
+	}
+}
+
+// redactJSONFields replaces the values of the specified fields of the JSON object in body.
+// Bodies that are not a JSON object are returned as is.
+func redactJSONFields(body string, fields map[string]bool) string {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal([]byte(body), &obj) != nil {
+		return body
+	}
+	redacted := false
+	for field := range obj {
+		if fields[field] {
+			obj[field] = json.RawMessage(`"` + transcriptRedacted + `"`)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return body
+	}
+	bts, err := json.Marshal(obj)
+	if err != nil {
+		return body
+	}
+	return string(bts)
+}
+
+// LoadTranscript reads the transcript from the specified file.
+func LoadTranscript(path string) (*Transcript, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	transcript := &Transcript{}
+	if err = json.Unmarshal(bts, transcript); err != nil {
+		return nil, err
+	}
+	return transcript, nil
+}
+
+// Save writes the transcript to the specified file.
+func (t *Transcript) Save(path string) error {
+	bts, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(bts, '\n'), 0644)
+}
+
+// TranscriptRecorder is a http.RoundTripper that records the exchanges that it passes on to
+// another http.RoundTripper.
+type TranscriptRecorder struct {
+	next       http.RoundTripper
+	mutex      sync.Mutex
+	transcript Transcript
+}
+
+// NewTranscriptRecorder returns a TranscriptRecorder passing requests on to next, or to
+// http.DefaultTransport if next is nil.
+func NewTranscriptRecorder(next http.RoundTripper) *TranscriptRecorder {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &TranscriptRecorder{next: next}
+}
+
+func (r *TranscriptRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	res, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resBody, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+
+	exchange := &TranscriptExchange{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		Request:     string(reqBody),
+		Status:      res.StatusCode,
+		ContentType: res.Header.Get("Content-Type"),
+		Response:    string(resBody),
+	}
+	RedactTranscriptExchange(exchange)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.transcript.Exchanges = append(r.transcript.Exchanges, exchange)
+	return res, nil
+}
+
+// Transcript returns the exchanges recorded so far.
+func (r *TranscriptRecorder) Transcript() *Transcript {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &Transcript{Exchanges: append([]*TranscriptExchange(nil), r.transcript.Exchanges...)}
+}
+
+// TranscriptReplayer is a http.RoundTripper that answers requests with the responses from a
+// transcript. Each request is answered by the first exchange of the transcript with the same
+// method and URL that has not been used before; the bodies of the requests are not compared,
+// so that the replayed client need not send exactly the same messages.
+type TranscriptReplayer struct {
+	transcript *Transcript
+	mutex      sync.Mutex
+	used       []bool
+}
+
+// NewTranscriptReplayer returns a TranscriptReplayer for the transcript.
+func NewTranscriptReplayer(transcript *Transcript) *TranscriptReplayer {
+	return &TranscriptReplayer{transcript: transcript, used: make([]bool, len(transcript.Exchanges))}
+}
+
+func (r *TranscriptReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_, _ = io.Copy(ioutil.Discard, req.Body)
+		_ = req.Body.Close()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, exchange := range r.transcript.Exchanges {
+		if r.used[i] || exchange.Method != req.Method || exchange.URL != req.URL.String() {
+			continue
+		}
+		r.used[i] = true
+		header := http.Header{}
+		if exchange.ContentType != "" {
+			header.Set("Content-Type", exchange.ContentType)
+		}
+		return &http.Response{
+			Status:        http.StatusText(exchange.Status),
+			StatusCode:    exchange.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          ioutil.NopCloser(strings.NewReader(exchange.Response)),
+			ContentLength: int64(len(exchange.Response)),
+			Request:       req,
+		}, nil
+	}
+	return nil, errors.Errorf("transcript contains no exchange for %s %s", req.Method, req.URL)
+}
+
+// Remaining returns the exchanges of the transcript that have not been replayed.
+func (r *TranscriptReplayer) Remaining() []*TranscriptExchange {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var remaining []*TranscriptExchange
+	for i, exchange := range r.transcript.Exchanges {
+		if !r.used[i] {
+			remaining = append(remaining, exchange)
+		}
+	}
+	return remaining
+}
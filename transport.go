@@ -3,16 +3,19 @@ package irma
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -34,8 +37,37 @@ type HTTPTransport struct {
 	ForceHTTPS bool
 	client     *retryablehttp.Client
 	headers    http.Header
+	ctx        context.Context
+
+	peerMutex  sync.Mutex
+	peerKey    []byte    // see PeerKeyFingerprint
+	serverDate time.Time // see ServerDate
+
+	dateListener func(date time.Time) // see SetDateListener
+	redirectFunc RedirectFunc         // see SetRedirectFunc
+
+	maxResponseSize  int64            // see SetMaxResponseSize
+	maxResponseSizes map[string]int64 // per path, see SetMaxResponseSize
 }
 
+const (
+	// MaxSessionResponseSize is the maximum size in bytes of responses of IRMA servers to the
+	// messages of a session, such as the session request, that IRMA clients should accept.
+	MaxSessionResponseSize = 256 << 10
+	// MaxIssuanceResponseSize is the maximum size in bytes of the response to the commitments of
+	// an issuance session, which contains the signatures of the new credentials.
+	MaxIssuanceResponseSize = 4 << 20
+	// MaxDownloadSize is the maximum size in bytes of files downloaded with GetBytes, such as
+	// the files of schemes.
+	MaxDownloadSize = 16 << 20
+	// MaxRedirects is the maximum number of redirects that HTTPTransport follows per request.
+	MaxRedirects = 3
+)
+
+// RedirectFunc decides whether HTTPTransport follows a redirect from its server to another
+// origin (i.e. scheme, host or port), see HTTPTransport.SetRedirectFunc.
+type RedirectFunc func(from, to *url.URL) bool
+
 var HTTPHeaders = map[string]http.Header{}
 
 // Logger is used for logging. If not set, init() will initialize it to logrus.StandardLogger().
@@ -103,7 +135,11 @@ func NewHTTPTransport(serverURL string, forceHTTPS bool) *HTTPTransport {
 		RetryMax:     2,
 		Backoff:      retryablehttp.DefaultBackoff,
 		CheckRetry: func(ctx context.Context, resp *http.Response, err error) (bool, error) {
-			// Don't retry on 5xx (which retryablehttp does by default)
+			// Don't retry on 5xx (which retryablehttp does by default), nor on refused redirects
+			var serr *SessionError
+			if errors.As(err, &serr) {
+				return false, err
+			}
 			return err != nil || resp.StatusCode == 0, err
 		},
 		HTTPClient: &http.Client{
@@ -123,12 +159,16 @@ func NewHTTPTransport(serverURL string, forceHTTPS bool) *HTTPTransport {
 	if headers == nil {
 		headers = http.Header{}
 	}
-	return &HTTPTransport{
+	transport := &HTTPTransport{
 		Server:     serverURL,
 		ForceHTTPS: forceHTTPS,
 		headers:    headers,
 		client:     client,
+
+		maxResponseSizes: map[string]int64{},
 	}
+	client.HTTPClient.CheckRedirect = transport.checkRedirect
+	return transport
 }
 
 func (transport *HTTPTransport) marshal(o interface{}) ([]byte, error) {
@@ -179,6 +219,141 @@ func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers.Set(name, val)
 }
 
+// SetContext sets the context of the requests of the transport, so that cancelling it aborts
+// requests in flight and prevents further ones.
+func (transport *HTTPTransport) SetContext(ctx context.Context) {
+	transport.ctx = ctx
+}
+
+// SetTimeout sets the time limit for each HTTP request of the transport, which is 3 seconds
+// by default. Failed requests are retried twice, each of which is also subject to the limit.
+func (transport *HTTPTransport) SetTimeout(timeout time.Duration) {
+	transport.client.HTTPClient.Timeout = timeout
+}
+
+// SetRoundTripper sets the http.RoundTripper that performs the requests of the transport,
+// e.g. a TranscriptRecorder or TranscriptReplayer.
+func (transport *HTTPTransport) SetRoundTripper(rt http.RoundTripper) {
+	transport.client.HTTPClient.Transport = rt
+}
+
+// SetRedirectFunc sets the function that decides whether redirects to another origin than that
+// of the server of the transport are followed; if none is set, they are refused. Redirects
+// within the origin of the server are always followed, up to MaxRedirects per request. It should
+// be called before the transport is used.
+func (transport *HTTPTransport) SetRedirectFunc(f RedirectFunc) {
+	transport.redirectFunc = f
+}
+
+// checkRedirect is the http.Client.CheckRedirect of the transport. Redirects from https to http
+// are refused, as are redirects to http if the transport requires https.
+func (transport *HTTPTransport) checkRedirect(req *http.Request, via []*http.Request) error {
+	redirectErr := func(reason string) error {
+		return &SessionError{ErrorType: ErrorRedirect, Info: req.URL.String(), Err: errors.New(reason)}
+	}
+	if len(via) > MaxRedirects {
+		return redirectErr("too many redirects")
+	}
+	from := via[len(via)-1].URL
+	if req.URL.Scheme != "https" &&
+		(from.Scheme == "https" || (common.ForceHTTPS && transport.ForceHTTPS)) {
+		return redirectErr("redirect to http")
+	}
+	if sameOrigin(via[0].URL, req.URL) {
+		return nil
+	}
+	if transport.redirectFunc == nil || !transport.redirectFunc(via[0].URL, req.URL) {
+		return redirectErr("redirect to another origin refused")
+	}
+	return nil
+}
+
+func sameOrigin(u, v *url.URL) bool {
+	return u.Scheme == v.Scheme && u.Host == v.Host
+}
+
+// rebase makes subsequent requests of the transport go to the server to which the request of
+// the specified path was redirected, if it was, so that all messages of a session reach the same
+// server. The server URL remains unchanged if the new URL does not end with the path.
+func (transport *HTTPTransport) rebase(path string, res *http.Response) {
+	if res.Request == nil || res.Request.URL == nil || path != "" && strings.Contains(path, "://") {
+		return
+	}
+	final := res.Request.URL.String()
+	if final == transport.Server+path {
+		return
+	}
+	if !strings.HasSuffix(final, path) {
+		Logger.Warnf("redirected to %s, which does not end with %s; not changing server URL", final, path)
+		return
+	}
+	server := strings.TrimSuffix(final, path)
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+	Logger.Infof("server %s redirected to %s", transport.Server, server)
+	transport.Server = server
+}
+
+// SetDateListener sets a function that is called with the time according to the Date header of
+// each response of the server that has one. It should be called before the transport is used.
+func (transport *HTTPTransport) SetDateListener(listener func(date time.Time)) {
+	transport.dateListener = listener
+}
+
+// SetMaxResponseSize sets the maximum size in bytes of responses to messages sent to the
+// specified path relative to the server URL, or of responses to all other messages if path is
+// empty. Larger responses are not read, and fail with ErrorResponseTooLarge. By default, and if
+// size is 0, responses are not limited. It should be called before the transport is used.
+func (transport *HTTPTransport) SetMaxResponseSize(path string, size int64) {
+	if path == "" {
+		transport.maxResponseSize = size
+		return
+	}
+	transport.maxResponseSizes[path] = size
+}
+
+func (transport *HTTPTransport) responseLimit(path string) int64 {
+	if size, ok := transport.maxResponseSizes[path]; ok {
+		return size
+	}
+	return transport.maxResponseSize
+}
+
+// readBody reads and closes the body of the response, without reading more than limit bytes
+// into memory if limit is positive.
+func readBody(res *http.Response, limit int64) ([]byte, error) {
+	defer res.Body.Close()
+	if limit <= 0 {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+		}
+		return body, nil
+	}
+	var host string
+	if res.Request != nil {
+		host = res.Request.URL.Hostname()
+	}
+	toolarge := &SessionError{
+		ErrorType:    ErrorResponseTooLarge,
+		Info:         host,
+		Err:          errors.Errorf("response exceeds maximum size of %d bytes", limit),
+		RemoteStatus: res.StatusCode,
+	}
+	if res.ContentLength > limit {
+		return nil, toolarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+	}
+	if int64(len(body)) > limit {
+		return nil, toolarge
+	}
+	return body, nil
+}
+
 func (transport *HTTPTransport) request(
 	url string, method string, reader io.Reader, contenttype string,
 ) (response *http.Response, err error) {
@@ -187,7 +362,11 @@ func (transport *HTTPTransport) request(
 	if common.ForceHTTPS && transport.ForceHTTPS && !strings.HasPrefix(u, "https") {
 		return nil, &SessionError{ErrorType: ErrorHTTPS, Err: errors.New("remote server does not use https")}
 	}
-	req.Request, err = http.NewRequest(method, u, reader)
+	ctx := transport.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req.Request, err = http.NewRequestWithContext(ctx, method, u, reader)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
@@ -200,11 +379,46 @@ func (transport *HTTPTransport) request(
 	}
 	res, err := transport.client.Do(&req)
 	if err != nil {
+		var serr *SessionError
+		if errors.As(err, &serr) {
+			return nil, serr
+		}
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	transport.rebase(url, res)
+	if res.TLS != nil && len(res.TLS.PeerCertificates) > 0 {
+		fingerprint := sha256.Sum256(res.TLS.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		transport.peerMutex.Lock()
+		transport.peerKey = fingerprint[:]
+		transport.peerMutex.Unlock()
+	}
+	if date, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+		transport.peerMutex.Lock()
+		transport.serverDate = date
+		transport.peerMutex.Unlock()
+		if transport.dateListener != nil {
+			transport.dateListener(date)
+		}
+	}
 	return res, nil
 }
 
+// PeerKeyFingerprint returns the SHA-256 hash of the public key of the TLS certificate that the
+// server presented in the last response, or nil if the server does not use TLS.
+func (transport *HTTPTransport) PeerKeyFingerprint() []byte {
+	transport.peerMutex.Lock()
+	defer transport.peerMutex.Unlock()
+	return transport.peerKey
+}
+
+// ServerDate returns the time according to the Date header of the last response of the server
+// that had one, or the zero time if there was none.
+func (transport *HTTPTransport) ServerDate() time.Time {
+	transport.peerMutex.Lock()
+	defer transport.peerMutex.Unlock()
+	return transport.serverDate
+}
+
 func (transport *HTTPTransport) jsonRequest(url string, method string, result interface{}, object interface{}) error {
 	if method != http.MethodPost && method != http.MethodGet && method != http.MethodDelete {
 		panic("Unsupported HTTP method " + method)
@@ -250,9 +464,9 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		return nil
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := readBody(res, transport.responseLimit(url))
 	if err != nil {
-		return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+		return err
 	}
 	if res.StatusCode == http.StatusNoContent {
 		if result != nil {
@@ -269,14 +483,18 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 			return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
 		}
 		transport.log("error", apierr, false)
-		return &SessionError{ErrorType: ErrorApi, RemoteStatus: res.StatusCode, RemoteError: apierr}
+		return &SessionError{ErrorType: ErrorApi, RemoteStatus: res.StatusCode, RemoteError: apierr, Err: apierr}
 	}
 
 	transport.log("response", body, transport.Binary)
 	if result == nil { // caller doesn't care about server response
 		return nil
 	}
-	if _, resultstr := result.(*string); resultstr {
+	_, resultstr := result.(*string)
+	if err = transport.checkContentType(res.Header.Get("Content-Type"), resultstr); err != nil {
+		return unexpectedContentTypeError(res, body, err)
+	}
+	if resultstr {
 		*result.(*string) = string(body)
 	} else {
 		err = transport.unmarshalValidate(body, result)
@@ -295,13 +513,57 @@ func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	}
 
 	if res.StatusCode != 200 {
-		return nil, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+		return nil, &SessionError{
+			ErrorType:    ErrorServerResponse,
+			RemoteStatus: res.StatusCode,
+			Err:          errors.Errorf("server responded with status %d", res.StatusCode),
+		}
+	}
+	return readBody(res, MaxDownloadSize)
+}
+
+// contentTypeErrorBodySize is the amount of bytes of a response with an unexpected content type
+// that is included in the error, to help finding out what sent it.
+const contentTypeErrorBodySize = 200
+
+// checkContentType checks that a response that we decode has a content type that we can decode,
+// so that e.g. HTML error pages are not mistaken for malformed messages. Legacy servers may send
+// JSON as text/plain, and responses without content type are decoded as usual. Bare strings, like
+// the VALID proof status of legacy servers, may be sent as text/plain or application/json. Text
+// must be encoded in UTF-8, of which US-ASCII is a subset.
+func (transport *HTTPTransport) checkContentType(contenttype string, text bool) error {
+	if contenttype == "" {
+		return nil
 	}
-	b, err := ioutil.ReadAll(res.Body)
+	mediatype, params, err := mime.ParseMediaType(contenttype)
 	if err != nil {
-		return nil, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+		return errors.Errorf("invalid content type %s", contenttype)
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") &&
+		!strings.EqualFold(charset, "utf8") && !strings.EqualFold(charset, "us-ascii") {
+		return errors.Errorf("unsupported charset %s", charset)
+	}
+	switch {
+	case transport.Binary && mediatype == "application/octet-stream",
+		(text || !transport.Binary) && (mediatype == "application/json" || mediatype == "text/plain"):
+		return nil
+	default:
+		return errors.Errorf("unexpected content type %s", mediatype)
+	}
+}
+
+// unexpectedContentTypeError returns the error for a response rejected by checkContentType,
+// including the start of the body for diagnostics.
+func unexpectedContentTypeError(res *http.Response, body []byte, err error) *SessionError {
+	if len(body) > contentTypeErrorBodySize {
+		body = body[:contentTypeErrorBodySize]
+	}
+	return &SessionError{
+		ErrorType:    ErrorUnexpectedContentType,
+		Err:          err,
+		Info:         string(body),
+		RemoteStatus: res.StatusCode,
 	}
-	return b, nil
 }
 
 // Post sends the object to the server and parses its response into result.
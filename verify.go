@@ -2,6 +2,7 @@ package irma
 
 import (
 	"crypto/rsa"
+	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -12,10 +13,12 @@ import (
 	"github.com/privacybydesign/gabi/revocation"
 )
 
-// ProofStatus is the status of the complete proof
+// ProofStatus is the status of the complete proof. Its values, of which the wire strings must
+// never change, are enforced when marshaling and unmarshaling.
 type ProofStatus string
 
-// Status is the proof status of a single attribute
+// Status is the proof status of a single attribute. Like ProofStatus its values are enforced
+// when marshaling and unmarshaling.
 type AttributeProofStatus string
 
 const (
@@ -26,11 +29,98 @@ const (
 	ProofStatusMissingAttributes = ProofStatus("MISSING_ATTRIBUTES") // Proof does not contain all requested attributes
 	ProofStatusExpired           = ProofStatus("EXPIRED")            // Attributes were expired at proof creation time (now, or according to timestamp in case of abs)
 
-	AttributeProofStatusPresent = AttributeProofStatus("PRESENT") // Attribute is disclosed and matches the value
-	AttributeProofStatusExtra   = AttributeProofStatus("EXTRA")   // Attribute is disclosed, but wasn't requested in request
-	AttributeProofStatusNull    = AttributeProofStatus("NULL")    // Attribute is disclosed but is null
+	AttributeProofStatusPresent      = AttributeProofStatus("PRESENT")       // Attribute is disclosed and matches the value
+	AttributeProofStatusExtra        = AttributeProofStatus("EXTRA")         // Attribute is disclosed, but wasn't requested in request
+	AttributeProofStatusNull         = AttributeProofStatus("NULL")          // Attribute is disclosed but is null
+	AttributeProofStatusMissing      = AttributeProofStatus("MISSING")       // Attribute is requested, but wasn't disclosed
+	AttributeProofStatusInvalidValue = AttributeProofStatus("INVALID_VALUE") // Attribute is disclosed, but has a different value than requested
+	AttributeProofStatusRevoked      = AttributeProofStatus("REVOKED")       // Attribute is disclosed, but its credential may have been revoked
 )
 
+var proofStatuses = []ProofStatus{
+	ProofStatusValid, ProofStatusInvalid, ProofStatusInvalidTimestamp,
+	ProofStatusUnmatchedRequest, ProofStatusMissingAttributes, ProofStatusExpired,
+}
+
+var attributeProofStatuses = []AttributeProofStatus{
+	AttributeProofStatusPresent, AttributeProofStatusExtra, AttributeProofStatusNull,
+	AttributeProofStatusMissing, AttributeProofStatusInvalidValue, AttributeProofStatusRevoked,
+}
+
+// parseProofStatus returns the proof status matching the specified status case-insensitively,
+// or an error if it is not a known proof status.
+func parseProofStatus(status ProofStatus) (ProofStatus, error) {
+	for _, s := range proofStatuses {
+		if strings.EqualFold(string(s), string(status)) {
+			return s, nil
+		}
+	}
+	return "", errors.Errorf("unknown proof status %q", status)
+}
+
+// MarshalText implements encoding.TextMarshaler, refusing unknown proof statuses.
+func (status ProofStatus) MarshalText() ([]byte, error) {
+	if status == "" {
+		return []byte{}, nil
+	}
+	s, err := parseProofStatus(status)
+	if err != nil || s != status {
+		return nil, errors.Errorf("unknown proof status %q", status)
+	}
+	return []byte(status), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting known proof statuses in any case.
+func (status *ProofStatus) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*status = ""
+		return nil
+	}
+	s, err := parseProofStatus(ProofStatus(text))
+	if err != nil {
+		return err
+	}
+	*status = s
+	return nil
+}
+
+// parseAttributeProofStatus returns the attribute proof status matching the specified status
+// case-insensitively, or an error if it is not a known attribute proof status.
+func parseAttributeProofStatus(status AttributeProofStatus) (AttributeProofStatus, error) {
+	for _, s := range attributeProofStatuses {
+		if strings.EqualFold(string(s), string(status)) {
+			return s, nil
+		}
+	}
+	return "", errors.Errorf("unknown attribute proof status %q", status)
+}
+
+// MarshalText implements encoding.TextMarshaler, refusing unknown attribute proof statuses.
+func (status AttributeProofStatus) MarshalText() ([]byte, error) {
+	if status == "" {
+		return []byte{}, nil
+	}
+	s, err := parseAttributeProofStatus(status)
+	if err != nil || s != status {
+		return nil, errors.Errorf("unknown attribute proof status %q", status)
+	}
+	return []byte(status), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting known attribute proof statuses in any case.
+func (status *AttributeProofStatus) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*status = ""
+		return nil
+	}
+	s, err := parseAttributeProofStatus(AttributeProofStatus(text))
+	if err != nil {
+		return err
+	}
+	*status = s
+	return nil
+}
+
 // DisclosedAttribute represents a disclosed attribute.
 type DisclosedAttribute struct {
 	RawValue         *string                 `json:"rawvalue"`
@@ -116,12 +206,19 @@ func extractAttribute(pl gabi.ProofList, index *DisclosedAttributeIndex, notrevo
 	if err != nil {
 		return nil, nil, err
 	}
+	if notrevoked != nil && notrevoked.IsZero() {
+		attr.Status = AttributeProofStatusRevoked
+		return attr, str, nil
+	}
 	attr.NotRevokedBefore = (*Timestamp)(notrevoked)
 	attr.NotRevoked = proofd.NonRevocationProof != nil
 	return attr, str, nil
 }
 
-// VerifyProofs verifies the proofs cryptographically.
+// VerifyProofs verifies the proofs cryptographically. It returns per proof with a nonrevocation proof
+// up to what time the credential is known not to be revoked, if that is longer ago than the
+// tolerance; or the zero time if the proof was made against an accumulator of the issuer that was
+// superseded longer ago than the staleness window, so that the credential may have been revoked.
 func (pl ProofList) VerifyProofs(
 	configuration *Configuration,
 	request SessionRequest,
@@ -236,6 +333,11 @@ func (pl ProofList) VerifyProofs(
 			t := time.Now()
 			validAt = &t
 		}
+		if revParams[id] != nil && pl.superseded(configuration, id, sig.PKCounter, theirs) &&
+			validAt.Sub(acctime) > time.Duration(settings.Staleness)*time.Second {
+			revocationtime[i] = &time.Time{}
+			continue
+		}
 		tolerance := settings.Tolerance
 		if s := revParams[id]; s != nil && s.Tolerance != 0 {
 			tolerance = s.Tolerance
@@ -248,6 +350,18 @@ func (pl ProofList) VerifyProofs(
 	return true, revocationtime, nil
 }
 
+// superseded returns whether the issuer's current accumulator of the given type and key is newer
+// than the accumulator with the specified index. If the current accumulator cannot be fetched we
+// cannot tell, in which case the nonrevocation guarantees are limited by the tolerance instead.
+func (pl ProofList) superseded(configuration *Configuration, id CredentialTypeIdentifier, pkcounter uint, index uint64) bool {
+	current, err := configuration.Revocation.currentAccumulator(id, pkcounter)
+	if err != nil {
+		Logger.WithField("credtype", id).Warn("failed to fetch current accumulator: ", err)
+		return false
+	}
+	return current.Index > index
+}
+
 func (d *Disclosure) extraIndices(condiscon AttributeConDisCon) []*DisclosedAttributeIndex {
 	disclosed := make([]map[int]struct{}, len(d.Proofs))
 	for i, proof := range d.Proofs {
@@ -401,7 +515,10 @@ func (d *Disclosure) Verify(configuration *Configuration, request *DisclosureReq
 // The signature request is optional; if it is nil then the attribute-based signature is still verified, and all
 // containing attributes returned in the result.
 func (sm *SignedMessage) Verify(configuration *Configuration, request *SignatureRequest) ([][]*DisclosedAttribute, ProofStatus, error) {
-	var message string
+	var (
+		msgHash []byte
+		err     error
+	)
 
 	if len(sm.Signature) == 0 {
 		return nil, ProofStatusInvalid, nil
@@ -413,16 +530,19 @@ func (sm *SignedMessage) Verify(configuration *Configuration, request *Signature
 			return nil, ProofStatusUnmatchedRequest, nil
 		}
 		// If there is a request, then the signed message must be that of the request
-		message = request.Message
+		msgHash, err = request.MessageHash()
 	} else {
 		// If not, we just verify that the signed message is a valid signature over its contained message
-		message = sm.Message
+		msgHash, err = sm.MessageHash()
+	}
+	if err != nil {
+		return nil, ProofStatusInvalid, nil
 	}
 
 	// Next, verify the timestamp so we can safely use its time
 	t := time.Now()
 	if sm.Timestamp != nil {
-		if err := sm.VerifyTimestamp(message, configuration); err != nil {
+		if err := sm.VerifyTimestamp(msgHash, configuration); err != nil {
 			return nil, ProofStatusInvalidTimestamp, nil
 		}
 		t = time.Unix(sm.Timestamp.Time, 0)
@@ -1,14 +1,28 @@
 package irma
 
 import (
+	"bufio"
 	"context"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
 	sseclient "github.com/sietseringers/go-sse"
 )
 
-const pollInterval = 1000 * time.Millisecond
+const (
+	pollInterval = 1000 * time.Millisecond
+
+	// sseReconnectInterval is how long SubscribeSessionStatus waits before reconnecting to the
+	// server-sent events endpoint, unless the server specifies otherwise.
+	sseReconnectInterval = 1000 * time.Millisecond
+	// sseMaxReconnects is the amount of consecutive connections to the server-sent events
+	// endpoint not delivering any event after which SubscribeSessionStatus falls back to polling.
+	sseMaxReconnects = 3
+)
 
 func WaitStatus(transport *HTTPTransport, initialStatus ServerStatus, statuschan chan ServerStatus, errorchan chan error) {
 	if err := subscribeSSE(transport, statuschan, errorchan, false); err != nil {
@@ -100,3 +114,187 @@ func pollUntilChange(transport *HTTPTransport, initialStatus ServerStatus, statu
 
 	go pollUntilChange(transport, status, statuschan, errorchan)
 }
+
+// SubscribeSessionStatus subscribes to the status of the session with the specified requestor
+// token at the IRMA server to whose requestor endpoint the transport points, i.e. the URL to which
+// session requests are POSTed, without "session". The current status and each subsequent change
+// of it are sent on the returned status channel, which is closed after the session reaches a
+// final status or when ctx is cancelled.
+//
+// The status is received using server-sent events from the statusevents endpoint, reconnecting
+// with the Last-Event-ID header if the connection drops. If the server does not support
+// server-sent events, the status is polled instead. If polling fails, the error is sent on the
+// returned error channel before both channels are closed.
+func SubscribeSessionStatus(ctx context.Context, transport *HTTPTransport, token RequestorToken) (<-chan ServerStatus, <-chan error) {
+	session := NewHTTPTransport(transport.Server+"session/"+string(token), transport.ForceHTTPS)
+	session.headers = transport.headers.Clone()
+	session.client.HTTPClient.Transport = transport.client.HTTPClient.Transport
+	session.SetContext(ctx)
+
+	sub := &statusSubscription{
+		transport:  session,
+		client:     &http.Client{Transport: transport.client.HTTPClient.Transport}, // no timeout
+		statuschan: make(chan ServerStatus),
+		errorchan:  make(chan error, 1),
+		retry:      sseReconnectInterval,
+	}
+	go sub.run(ctx)
+	return sub.statuschan, sub.errorchan
+}
+
+type statusSubscription struct {
+	transport   *HTTPTransport
+	client      *http.Client
+	statuschan  chan ServerStatus
+	errorchan   chan error
+	status      ServerStatus // last status sent on statuschan
+	lastEventID string
+	retry       time.Duration
+}
+
+func (sub *statusSubscription) run(ctx context.Context) {
+	defer close(sub.errorchan)
+	defer close(sub.statuschan)
+
+	for attempts := 0; attempts < sseMaxReconnects; {
+		res, err := sub.connect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			Logger.Debug("Server-sent events unavailable, polling session status: ", err)
+			break
+		}
+
+		// Catch up on status changes that we missed while we were not connected
+		var s string
+		finished := false
+		if err = sub.transport.Get("status", &s); err == nil {
+			finished = sub.send(ctx, ServerStatus(strings.Trim(s, `"`)))
+		}
+		received := false
+		if !finished && ctx.Err() == nil {
+			finished, received = sub.read(ctx, res)
+		}
+		if received {
+			attempts = 0
+		} else {
+			attempts++
+		}
+		_ = res.Body.Close()
+		if finished || ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sub.retry):
+		}
+	}
+
+	sub.poll(ctx)
+}
+
+// connect opens a connection to the server-sent events endpoint of the session.
+func (sub *statusSubscription) connect(ctx context.Context) (*http.Response, error) {
+	u := sub.transport.Server + "statusevents"
+	if common.ForceHTTPS && sub.transport.ForceHTTPS && !strings.HasPrefix(u, "https") {
+		return nil, errors.New("remote server does not use https")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = sub.transport.headers.Clone()
+	req.Header.Set("Accept", "text/event-stream")
+	if sub.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", sub.lastEventID)
+	}
+	res, err := sub.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		_ = res.Body.Close()
+		return nil, errors.Errorf("unexpected response: status %d, Content-Type %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	return res, nil
+}
+
+// read sends the statuses received as server-sent events until the connection drops or the
+// session finishes, returning whether it finished and whether any event was received.
+func (sub *statusSubscription) read(ctx context.Context, res *http.Response) (finished bool, received bool) {
+	scanner := bufio.NewScanner(res.Body)
+	var event, data, id string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" { // dispatch the event
+			if data != "" && (event == "" || event == "message") {
+				received = true
+				sub.lastEventID = id
+				if sub.send(ctx, ServerStatus(strings.Trim(data, `"`))) {
+					return true, received
+				}
+			}
+			event, data = "", ""
+			continue
+		}
+		if strings.HasPrefix(line, ":") { // comment
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data += value
+		case "id":
+			id = value
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 32); err == nil {
+				sub.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	return false, received
+}
+
+// poll polls the status of the session until it finishes.
+func (sub *statusSubscription) poll(ctx context.Context) {
+	for {
+		var s string
+		if err := sub.transport.Get("status", &s); err != nil {
+			if ctx.Err() == nil {
+				sub.errorchan <- err
+			}
+			return
+		}
+		if sub.send(ctx, ServerStatus(strings.Trim(s, `"`))) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// send sends the status on the status channel if it differs from the previous one, returning
+// whether the session has finished.
+func (sub *statusSubscription) send(ctx context.Context, status ServerStatus) bool {
+	if status == sub.status {
+		return status.Finished()
+	}
+	select {
+	case sub.statuschan <- status:
+		sub.status = status
+	case <-ctx.Done():
+		return false
+	}
+	return status.Finished()
+}